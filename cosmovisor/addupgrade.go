@@ -0,0 +1,272 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// stagedRecord is written next to the binary of an upgrade added with AddUpgrade
+const stagedRecord = "staged.json"
+
+// StagedUpgrade is an upgrade directory with the binary staged for it
+type StagedUpgrade struct {
+	Name string `json:"name"`
+	// Height is the height the upgrade is expected at, 0 if unknown
+	Height int64 `json:"height,omitempty"`
+	// Source is the file or URL the binary was added from, empty if it was placed by hand
+	Source  string    `json:"source,omitempty"`
+	SHA256  string    `json:"sha256,omitempty"`
+	AddedAt time.Time `json:"added_at,omitempty"`
+	// Err is why the staged binary can't be run, nil if it can
+	Err error `json:"-"`
+}
+
+// AddUpgradeOptions are the optional arguments of AddUpgrade
+type AddUpgradeOptions struct {
+	// Height is the height the upgrade is expected at. It is shown by the status and an
+	// upgrade at another height is logged.
+	Height int64
+	// Force replaces a different binary staged for the upgrade before
+	Force bool
+}
+
+// AddUpgrade stages the binary for the named upgrade ahead of time, so nothing needs to be
+// downloaded when the upgrade fires. src is the path of the binary, or a URL downloaded
+// like the binaries of upgrade plans, honoring checksums and the download settings. The
+// binary must be executable and built for this platform.
+func AddUpgrade(cfg *Config, name, src string, opts AddUpgradeOptions) (*StagedUpgrade, error) {
+	if err := ValidateUpgradeName(name); err != nil {
+		return nil, err
+	}
+	if cfg.Immutable {
+		return nil, errors.New("binaries can't be added to an immutable layout, they ship with the image")
+	}
+	upgradeDirMutex.Lock()
+	defer upgradeDirMutex.Unlock()
+
+	fs := cfg.fs()
+	bin := cfg.UpgradeBin(name)
+	_, err := os.Stat(bin)
+	staged := err == nil
+
+	record := &StagedUpgrade{Name: name, Height: opts.Height, Source: src, AddedAt: NowUTC()}
+	if info, err := os.Stat(src); err == nil || !isURL(src) {
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the binary: %w", err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a regular file", src)
+		}
+		if err := checkPlatform(src); err != nil {
+			return nil, err
+		}
+		if record.SHA256, err = sha256File(src); err != nil {
+			return nil, err
+		}
+		if existing, err := sha256File(bin); staged && err == nil && existing == record.SHA256 {
+			logger.Debugf("%s is in place already", bin)
+		} else if staged && !opts.Force {
+			return nil, fmt.Errorf("upgrade %q has a different binary already, force it to be replaced", name)
+		} else if err := installBinary(fs, src, record.SHA256, bin); err != nil {
+			return nil, fmt.Errorf("copying the binary: %w", err)
+		}
+	} else {
+		if staged && !opts.Force {
+			return nil, fmt.Errorf("upgrade %q has a binary already, force it to be replaced", name)
+		}
+		if err := fs.removeAll(cfg.UpgradeDir(name)); err != nil {
+			return nil, err
+		}
+		if err := cfg.addUpgradeFrom(name, src); err != nil {
+			if rerr := fs.removeAll(cfg.UpgradeDir(name)); rerr != nil {
+				logger.Warnf("removing partial download: %v", rerr)
+			}
+			return nil, err
+		}
+		if record.SHA256, err = sha256File(bin); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.normalizeStaged(fs, cfg.UpgradeDir(name), bin); err != nil {
+		return nil, err
+	}
+	if err := EnsureBinary(bin); err != nil {
+		return nil, err
+	}
+	bz, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.writeFile(filepath.Join(cfg.UpgradeDir(name), stagedRecord), bz, 0644); err != nil {
+		return nil, fmt.Errorf("recording the staged upgrade: %w", err)
+	}
+	return record, nil
+}
+
+// addUpgradeFrom downloads the binary of the named upgrade from rawURL
+func (cfg *Config) addUpgradeFrom(name, rawURL string) error {
+	doc, err := json.Marshal(UpgradeConfig{Binaries: map[string]URLList{"any": {rawURL}}})
+	if err != nil {
+		return err
+	}
+	if err := DownloadBinary(cfg, &UpgradeInfo{Name: name, Info: string(doc)}); err != nil {
+		return fmt.Errorf("cannot download binary: %w", err)
+	}
+	return checkPlatform(cfg.UpgradeBin(name))
+}
+
+// isURL returns true if src names a download rather than a local file
+func isURL(src string) bool {
+	u, err := url.Parse(src)
+	return err == nil && u.Scheme != "" && strings.Contains(src, "://")
+}
+
+// StagedUpgrades lists the upgrade directories, with what AddUpgrade recorded about them
+func (cfg *Config) StagedUpgrades() ([]*StagedUpgrade, error) {
+	entries, err := ioutil.ReadDir(cfg.upgradesPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var upgrades []*StagedUpgrade
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		name, err := url.PathUnescape(e.Name())
+		if err != nil {
+			continue
+		}
+		staged, err := cfg.stagedUpgrade(name)
+		if err != nil {
+			return nil, err
+		}
+		upgrades = append(upgrades, staged)
+	}
+	return upgrades, nil
+}
+
+// stagedUpgrade reads the record of the named upgrade, or describes a directory placed by hand
+func (cfg *Config) stagedUpgrade(name string) (*StagedUpgrade, error) {
+	staged := &StagedUpgrade{Name: name}
+	bz, err := ioutil.ReadFile(filepath.Join(cfg.UpgradeDir(name), stagedRecord))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(bz, staged); err != nil {
+			return nil, fmt.Errorf("%s of upgrade %q: %w", stagedRecord, name, err)
+		}
+		staged.Name = name
+	}
+	staged.Err = EnsureBinary(cfg.UpgradeBin(name))
+	return staged, nil
+}
+
+// checkStagedHeight logs if the upgrade fires at another height than it was staged for
+func (cfg *Config) checkStagedHeight(info *UpgradeInfo) {
+	staged, err := cfg.stagedUpgrade(info.Name)
+	if err == nil && staged.Height > 0 && info.Height > 0 && staged.Height != info.Height {
+		logger.Warnf("upgrade %q was staged for height %d but fires at height %d", info.Name, staged.Height, info.Height)
+	}
+}
+
+// elfMachines are the ELF machines of the architectures Go builds for
+var elfMachines = map[string]elf.Machine{
+	"386":     elf.EM_386,
+	"amd64":   elf.EM_X86_64,
+	"arm":     elf.EM_ARM,
+	"arm64":   elf.EM_AARCH64,
+	"ppc64":   elf.EM_PPC64,
+	"ppc64le": elf.EM_PPC64,
+	"riscv64": elf.EM_RISCV,
+	"s390x":   elf.EM_S390,
+}
+
+// machoCPUs are the Mach-O CPUs of the architectures Go builds for on darwin
+var machoCPUs = map[string]macho.Cpu{
+	"amd64": macho.CpuAmd64,
+	"arm64": macho.CpuArm64,
+}
+
+// peMachines are the PE machines of the architectures Go builds for on windows
+var peMachines = map[string]uint16{
+	"386":   pe.IMAGE_FILE_MACHINE_I386,
+	"amd64": pe.IMAGE_FILE_MACHINE_AMD64,
+	"arm64": pe.IMAGE_FILE_MACHINE_ARM64,
+}
+
+// checkPlatform returns an error if the binary at path can't run on OSArch, or if it's a
+// dynamically linked ELF binary whose shared libraries aren't on this host. Scripts and
+// formats it doesn't know are accepted, the daemon may well be started by a wrapper.
+func checkPlatform(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		// too short to be a binary
+		return nil
+	}
+
+	var format string
+	var runs bool
+	// bin is set for an ELF binary, its shared libraries are checked too
+	var bin *elf.File
+	switch {
+	case bytes.Equal(magic, []byte(elf.ELFMAG)):
+		if bin, err = elf.NewFile(f); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		want, known := elfMachines[runtime.GOARCH]
+		format = fmt.Sprintf("an ELF binary for %s", bin.Machine)
+		runs = runtime.GOOS != "darwin" && runtime.GOOS != "windows" && (!known || bin.Machine == want)
+	case bytes.HasPrefix(magic, []byte("MZ")):
+		bin, err := pe.NewFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		want, known := peMachines[runtime.GOARCH]
+		format = fmt.Sprintf("a windows binary for machine %#x", bin.Machine)
+		runs = runtime.GOOS == "windows" && (!known || bin.Machine == want)
+	default:
+		want, known := machoCPUs[runtime.GOARCH]
+		if bin, err := macho.NewFile(f); err == nil {
+			format = fmt.Sprintf("a Mach-O binary for %s", bin.Cpu)
+			runs = runtime.GOOS == "darwin" && (!known || bin.Cpu == want)
+		} else if fat, err := macho.NewFatFile(f); err == nil {
+			format = "a universal Mach-O binary"
+			for _, arch := range fat.Arches {
+				runs = runs || (runtime.GOOS == "darwin" && (!known || arch.Cpu == want))
+			}
+		} else {
+			return nil
+		}
+	}
+	if !runs {
+		return fmt.Errorf("%s is %s, it can't run on %s", path, format, OSArch())
+	}
+	if bin != nil {
+		return checkLibraries(path, bin)
+	}
+	return nil
+}
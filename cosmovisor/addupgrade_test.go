@@ -0,0 +1,185 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// elfHeader returns the header of an empty 64-bit ELF executable for machine
+func elfHeader(machine elf.Machine) []byte {
+	h := append([]byte(elf.ELFMAG), make([]byte, 60)...)
+	h[elf.EI_CLASS], h[elf.EI_DATA], h[elf.EI_VERSION] = byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)
+	binary.LittleEndian.PutUint16(h[16:], uint16(elf.ET_EXEC))
+	binary.LittleEndian.PutUint16(h[18:], uint16(machine))
+	binary.LittleEndian.PutUint32(h[20:], uint32(elf.EV_CURRENT))
+	binary.LittleEndian.PutUint16(h[52:], 64)
+	return h
+}
+
+func TestCheckPlatform(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, content, 0755))
+		return path
+	}
+	self, err := os.Executable()
+	require.NoError(t, err)
+
+	require.NoError(t, checkPlatform(self))
+	require.NoError(t, checkPlatform(write("script", []byte("#!/bin/sh\necho hi\n"))))
+	require.NoError(t, checkPlatform(write("tiny", []byte("hi"))))
+	require.NoError(t, checkPlatform(write("native", elfHeader(elfMachines[runtime.GOARCH]))))
+
+	err = checkPlatform(write("mips", elfHeader(elf.EM_MIPS)))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is an ELF binary for EM_MIPS, it can't run on "+OSArch())
+	err = checkPlatform(write("windows", append([]byte("MZ"), make([]byte, 62)...)))
+	require.Error(t, err)
+}
+
+func TestAddUpgrade(t *testing.T) {
+	src := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(src, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0755))
+		return path
+	}
+	v2 := write("v2", "#!/bin/sh\necho v2\n")
+	other := write("other", "#!/bin/sh\necho other\n")
+	mips := write("mips", string(elfHeader(elf.EM_MIPS)))
+
+	cases := map[string]struct {
+		// before adds this binary to the upgrade first
+		before string
+		src    string
+		opts   AddUpgradeOptions
+		err    string
+	}{
+		"new upgrade":       {src: v2, opts: AddUpgradeOptions{Height: 100}},
+		"again":             {before: v2, src: v2},
+		"different binary":  {before: v2, src: other, err: "has a different binary already"},
+		"forced":            {before: v2, src: other, opts: AddUpgradeOptions{Force: true}},
+		"missing binary":    {src: filepath.Join(src, "missing"), err: "cannot read the binary"},
+		"directory":         {src: src, err: "is not a regular file"},
+		"other platform":    {src: mips, err: "it can't run on " + OSArch()},
+		"not a binary path": {src: "ftp:/nowhere", err: "cannot read the binary"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home := validateHome(t)
+			cfg := &Config{Home: home, Name: "dummyd"}
+			if tc.before != "" {
+				_, err := AddUpgrade(cfg, "v2", tc.before, AddUpgradeOptions{})
+				require.NoError(t, err)
+			}
+			staged, err := AddUpgrade(cfg, "v2", tc.src, tc.opts)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				if tc.before == "" {
+					_, err := os.Stat(cfg.UpgradeBin("v2"))
+					require.True(t, os.IsNotExist(err))
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.opts.Height, staged.Height)
+			want, err := ioutil.ReadFile(tc.src)
+			require.NoError(t, err)
+			got, err := ioutil.ReadFile(cfg.UpgradeBin("v2"))
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+
+			record, err := cfg.stagedUpgrade("v2")
+			require.NoError(t, err)
+			require.NoError(t, record.Err)
+			require.Equal(t, tc.src, record.Source)
+			require.Equal(t, tc.opts.Height, record.Height)
+			require.Equal(t, staged.SHA256, record.SHA256)
+		})
+	}
+}
+
+func TestAddUpgradeFromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2":
+			w.Write([]byte("#!/bin/sh\necho v2\n"))
+		case "/mips":
+			w.Write(elfHeader(elf.EM_MIPS))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", DownloadAttempts: 1}
+
+	staged, err := AddUpgrade(cfg, "v2", server.URL+"/v2", AddUpgradeOptions{Height: 100})
+	require.NoError(t, err)
+	require.NoError(t, EnsureBinary(cfg.UpgradeBin("v2")))
+	require.Equal(t, server.URL+"/v2", staged.Source)
+	var decisions []string
+	for _, e := range Explain(cfg, &UpgradeInfo{Name: "v2", Height: 120}) {
+		decisions = append(decisions, e.Decision)
+	}
+	require.Contains(t, decisions, "log that it was staged for height 100, not 120")
+
+	_, err = AddUpgrade(cfg, "v2", server.URL+"/v2", AddUpgradeOptions{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "has a binary already")
+	_, err = AddUpgrade(cfg, "v2", server.URL+"/v2", AddUpgradeOptions{Force: true})
+	require.NoError(t, err)
+
+	_, err = AddUpgrade(cfg, "v3", server.URL+"/mips", AddUpgradeOptions{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "it can't run on")
+	_, err = os.Stat(cfg.UpgradeDir("v3"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestStagedUpgrades(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	_, err := AddUpgrade(cfg, "chain4", cfg.UpgradeBin("chain2"), AddUpgradeOptions{Height: 200})
+	require.NoError(t, err)
+
+	upgrades, err := cfg.StagedUpgrades()
+	require.NoError(t, err)
+	byName := map[string]*StagedUpgrade{}
+	for _, u := range upgrades {
+		byName[u.Name] = u
+	}
+	require.Len(t, byName, 5)
+	require.NoError(t, byName["chain2"].Err)
+	require.Empty(t, byName["chain2"].Source)
+	require.Error(t, byName["nobin"].Err)
+	require.Error(t, byName["noexec"].Err)
+	require.Equal(t, int64(200), byName["chain4"].Height)
+	require.Contains(t, describeStaged(byName["chain4"]), "staged for height 200 from "+cfg.UpgradeBin("chain2"))
+
+	bz, err := json.Marshal(byName["chain4"])
+	require.NoError(t, err)
+	require.Contains(t, string(bz), `"height":200`)
+}
+
+func TestAddUpgradeImmutable(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", Immutable: true}
+	_, err := AddUpgrade(cfg, "v2", os.Args[0], AddUpgradeOptions{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "immutable layout")
+}
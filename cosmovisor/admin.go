@@ -0,0 +1,515 @@
+package cosmovisor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// recentEventsSize is how many events the admin API keeps for `events`
+	recentEventsSize = 100
+	// adminClientTimeout bounds a request to the admin API, the actions only start a change
+	adminClientTimeout = 10 * time.Second
+)
+
+// errRestartRequested is returned by LaunchProcessContext when the daemon was stopped to
+// be restarted through the admin API
+var errRestartRequested = errors.New("restart requested")
+
+// admin is the control the admin API has over the supervision of this process
+var admin = &adminControl{resumed: make(chan struct{})}
+
+// adminControl holds what the admin API may change: the daemon launched right now and
+// whether the supervision is paused
+type adminControl struct {
+	mutex  sync.Mutex
+	launch *launchControl
+	paused bool
+	since  time.Time
+	// deferred is the upgrade the daemon reached while paused
+	deferred *UpgradeInfo
+	// resumed is closed when the supervision is resumed
+	resumed chan struct{}
+}
+
+// launchControl acts on the daemon launched by LaunchProcessContext while it runs
+type launchControl struct {
+	cfg   *Config
+	cmd   *exec.Cmd
+	plans chan<- *UpgradeInfo
+
+	mutex     sync.Mutex
+	restart   bool
+	upgrading bool
+	// cause is what LaunchProcessContext returns for the restart
+	cause error
+}
+
+// attach makes the running daemon available to the admin API until detach is called
+func (a *adminControl) attach(l *launchControl) (detach func()) {
+	a.mutex.Lock()
+	a.launch = l
+	a.mutex.Unlock()
+	return func() {
+		a.mutex.Lock()
+		a.launch = nil
+		a.mutex.Unlock()
+	}
+}
+
+func (a *adminControl) running() (*launchControl, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.launch == nil {
+		return nil, errors.New("the daemon isn't running")
+	}
+	return a.launch, nil
+}
+
+// setPaused pauses or resumes the supervision of the home of cfg, it returns false if it
+// was already so. An upgrade deferred while paused is applied to the running daemon on
+// resume, a daemon that exited meanwhile gets it before it is launched again.
+func (a *adminControl) setPaused(cfg *Config, paused bool) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.paused == paused {
+		return false
+	}
+	a.paused = paused
+	if paused {
+		a.since = NowUTC()
+		cfg.writePauseState(&PauseState{PID: os.Getpid(), Since: a.since})
+		return true
+	}
+	close(a.resumed)
+	a.resumed = make(chan struct{})
+	cfg.writePauseState(nil)
+	if a.deferred != nil && a.launch != nil {
+		if err := a.launch.requestUpgrade(a.deferred); err != nil {
+			logger.Warnf("applying upgrade %q deferred while paused: %v", a.deferred.Name, err)
+		}
+		a.deferred = nil
+	}
+	return true
+}
+
+// deferUpgrade keeps the upgrade the daemon reached for the resume and returns true if
+// the supervision is paused, it returns false if the upgrade is to be applied now
+func (a *adminControl) deferUpgrade(cfg *Config, info *UpgradeInfo) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.paused {
+		return false
+	}
+	logger.Warnf("upgrade %q reached at height %d while the supervision is paused, it is applied once resumed", info.Name, info.Height)
+	a.deferred = info
+	cfg.writePauseState(&PauseState{PID: os.Getpid(), Since: a.since, Deferred: info})
+	return true
+}
+
+// takeDeferred returns the upgrade deferred while paused for a daemon that exited, once
+func (a *adminControl) takeDeferred() *UpgradeInfo {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	info := a.deferred
+	a.deferred = nil
+	return info
+}
+
+func (a *adminControl) isPaused() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.paused
+}
+
+// waitResumed returns true once the supervision isn't paused, false if ctx is done or a
+// stop signal is received first
+func (a *adminControl) waitResumed(ctx context.Context, stops <-chan os.Signal) bool {
+	a.mutex.Lock()
+	paused, resumed := a.paused, a.resumed
+	a.mutex.Unlock()
+	if !paused {
+		return true
+	}
+	logger.Infof("supervision paused, the daemon is launched once it is resumed")
+	select {
+	case <-resumed:
+		return true
+	case sig := <-stops:
+		logger.Infof("received %s while paused, exiting", sig)
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// requestRestart stops the daemon, to be launched again right away
+func (l *launchControl) requestRestart() error {
+	return l.stopForRestart(errRestartRequested)
+}
+
+// requestScheduledRestart stops the daemon for the restart scheduled by RestartMaxUptime
+func (l *launchControl) requestScheduledRestart() error {
+	return l.stopForRestart(errRestartScheduled)
+}
+
+// requestScheduledBackup stops the daemon for the backup scheduled by BackupSchedule
+func (l *launchControl) requestScheduledBackup() error {
+	return l.stopForRestart(errBackupScheduled)
+}
+
+// requestLivenessRestart stops the daemon of a node that stopped making blocks
+func (l *launchControl) requestLivenessRestart() error {
+	return l.stopForRestart(errRestartStalled)
+}
+
+// requestMemoryRestart stops the daemon that uses more memory than MemoryRestart
+func (l *launchControl) requestMemoryRestart() error {
+	return l.stopForRestart(errRestartMemory)
+}
+
+// stopForRestart stops the daemon for a restart, LaunchProcessContext returns cause, an
+// errRestartRequested
+func (l *launchControl) stopForRestart(cause error) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.upgrading {
+		return errors.New("the daemon is being stopped for an upgrade")
+	}
+	if !l.restart {
+		l.restart, l.cause = true, cause
+		logger.Infof("restart requested, stopping %s", l.cmd.Path)
+		l.cfg.stopForUpgrade(l.cmd)
+	}
+	return nil
+}
+
+// fence kills the daemon of a node that lost the leader lease right away, another node may
+// launch its own once the lease expires. If it was being stopped for an upgrade, the upgrade
+// is still applied.
+func (l *launchControl) fence() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.upgrading && !l.restart {
+		l.restart, l.cause = true, errLeadershipLost
+	}
+	logger.Warnf("not the leader anymore, killing %s", l.cmd.Path)
+	_ = l.cmd.Process.Kill()
+}
+
+// abort kills the daemon right away as running it any longer isn't safe,
+// LaunchProcessContext returns cause
+func (l *launchControl) abort(cause error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.restart, l.cause = true, cause
+	logger.Errorf("%v, killing %s", cause, l.cmd.Path)
+	_ = l.cmd.Process.Kill()
+}
+
+// requestUpgrade stops the daemon to apply the upgrade, as if the app reached its plan
+func (l *launchControl) requestUpgrade(info *UpgradeInfo) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.restart || l.upgrading {
+		return errors.New("the daemon is being stopped already")
+	}
+	select {
+	case l.plans <- info:
+	default:
+		return errors.New("an upgrade is being applied already")
+	}
+	l.upgrading = true
+	logger.Infof("upgrade %q requested", info.Name)
+	return nil
+}
+
+// restartRequested returns true if the daemon was stopped by requestRestart
+func (l *launchControl) restartRequested() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.restart
+}
+
+// restartErr is the error LaunchProcessContext returns for the restart the daemon was
+// stopped for
+func (l *launchControl) restartErr() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.cause == nil {
+		return errRestartRequested
+	}
+	return l.cause
+}
+
+// stagedUpgradeInfo returns the plan to force the staged upgrade, which must have a
+// binary that runs and must not be current
+func (cfg *Config) stagedUpgradeInfo(name string) (*UpgradeInfo, error) {
+	staged, err := cfg.StagedUpgrades()
+	if err != nil {
+		return nil, err
+	}
+	bin, _ := cfg.resolveCurrentBin()
+	if cfg.upgradeOf(bin) == name {
+		return nil, fmt.Errorf("upgrade %q is current already", name)
+	}
+	for _, s := range staged {
+		if s.Name != name {
+			continue
+		}
+		if s.Err != nil {
+			return nil, fmt.Errorf("upgrade %q can't be applied: %w", name, s.Err)
+		}
+		return &UpgradeInfo{Name: s.Name, Height: s.Height}, nil
+	}
+	return nil, fmt.Errorf("upgrade %q isn't staged in %s", name, cfg.UpgradeDir(name))
+}
+
+// recentEvents are the last events sent, for the admin API
+var recentEvents = &eventRing{max: recentEventsSize}
+
+type eventRing struct {
+	mutex  sync.Mutex
+	max    int
+	events []Event
+}
+
+func (r *eventRing) add(ev Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, ev)
+	if len(r.events) > r.max {
+		r.events = r.events[len(r.events)-r.max:]
+	}
+}
+
+// last returns the n most recent events, the oldest first, all of them if n is 0
+func (r *eventRing) last(n int) []Event {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if n <= 0 || n > len(r.events) {
+		n = len(r.events)
+	}
+	return append([]Event{}, r.events[len(r.events)-n:]...)
+}
+
+// AdminStatus is the status of the home with the state of the supervision of this process
+type AdminStatus struct {
+	*Status
+	// Paused is set while the upgrades the daemon reaches aren't applied and the daemon
+	// isn't launched again once it exits
+	Paused bool `json:"paused"`
+}
+
+// AdminHandler serves the admin API of this process:
+//
+//	GET  /status           the status of the home and whether the supervision is paused
+//	POST /restart          stops the daemon gracefully and launches it again
+//	POST /upgrade?name=X   stops the daemon and applies the staged upgrade X
+//	POST /pause            defers upgrades and stops launching the daemon again once it exits
+//	POST /resume           applies a deferred upgrade and launches the daemon again
+//	GET  /events?n=N       the N most recent events, all that are kept without n
+func AdminHandler(cfg *Config) http.Handler {
+	mux := http.NewServeMux()
+	action := func(path string, fn func(r *http.Request) error) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				writeAdminError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+				return
+			}
+			if err := fn(r); err != nil {
+				writeAdminError(w, http.StatusConflict, err)
+				return
+			}
+			writeAdminJSON(w, map[string]string{})
+		})
+	}
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status, err := GetStatus(cfg)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAdminJSON(w, AdminStatus{Status: status, Paused: admin.isPaused()})
+	})
+	action("/restart", func(*http.Request) error {
+		l, err := admin.running()
+		if err != nil {
+			return err
+		}
+		return l.requestRestart()
+	})
+	action("/upgrade", func(r *http.Request) error {
+		info, err := cfg.stagedUpgradeInfo(r.URL.Query().Get("name"))
+		if err != nil {
+			return err
+		}
+		l, err := admin.running()
+		if err != nil {
+			return err
+		}
+		return l.requestUpgrade(info)
+	})
+	action("/pause", func(*http.Request) error {
+		if admin.setPaused(cfg, true) {
+			logger.Infof("supervision paused through the admin API")
+		}
+		return nil
+	})
+	action("/resume", func(*http.Request) error {
+		if admin.setPaused(cfg, false) {
+			logger.Infof("supervision resumed through the admin API")
+		}
+		return nil
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		if s := r.URL.Query().Get("n"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n < 0 {
+				writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid n %q: must be a number, 0 or more", s))
+				return
+			}
+		}
+		writeAdminJSON(w, recentEvents.last(n))
+	})
+	return mux
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// ServeAdmin serves the admin API on the unix socket AdminSocket until stop is called. The
+// socket is only accessible to the user cosmovisor runs as. The home is locked until then,
+// so it fails with an AlreadyRunningError while another cosmovisor supervises the home.
+func ServeAdmin(cfg *Config) (stop func(), err error) {
+	path := cfg.AdminSocket
+	fs := cfg.fs()
+	if err := fs.check("serve the admin API", path); err != nil {
+		return nil, err
+	}
+	unlock, err := cfg.lockHome()
+	if err != nil {
+		return nil, err
+	}
+	// a socket left behind by a cosmovisor that is gone, the home lock keeps the socket of
+	// a running one from being removed
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := fs.remove(path); err != nil {
+			unlock()
+			return nil, fmt.Errorf("serving the admin API: %w", err)
+		}
+	}
+	l, err := listenPrivate(fs, path)
+	if err != nil {
+		unlock()
+		return nil, fmt.Errorf("serving the admin API: %w", err)
+	}
+	stopServing := serveHTTP(cfg, l, AdminHandler(cfg))
+	return func() {
+		stopServing()
+		unlock()
+	}, nil
+}
+
+// AdminClient calls the admin API of a running cosmovisor
+type AdminClient struct {
+	client *http.Client
+}
+
+// NewAdminClient returns a client of the admin API served on the unix socket at path
+func NewAdminClient(path string) *AdminClient {
+	return &AdminClient{client: &http.Client{
+		Timeout: adminClientTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}}
+}
+
+// Status returns the status of the home and of the supervision
+func (c *AdminClient) Status() (*AdminStatus, error) {
+	var status AdminStatus
+	return &status, c.call(http.MethodGet, "/status", nil, &status)
+}
+
+// Restart stops the daemon gracefully, to be launched again
+func (c *AdminClient) Restart() error {
+	return c.call(http.MethodPost, "/restart", nil, nil)
+}
+
+// Upgrade stops the daemon and applies the named staged upgrade
+func (c *AdminClient) Upgrade(name string) error {
+	return c.call(http.MethodPost, "/upgrade", url.Values{"name": {name}}, nil)
+}
+
+// Pause stops launching the daemon again once it exits, until Resume
+func (c *AdminClient) Pause() error {
+	return c.call(http.MethodPost, "/pause", nil, nil)
+}
+
+// Resume launches the daemon again if it exited while paused
+func (c *AdminClient) Resume() error {
+	return c.call(http.MethodPost, "/resume", nil, nil)
+}
+
+// Events returns the n most recent events, all that are kept if n is 0
+func (c *AdminClient) Events(n int) ([]Event, error) {
+	var events []Event
+	return events, c.call(http.MethodGet, "/events", url.Values{"n": {strconv.Itoa(n)}}, &events)
+}
+
+func (c *AdminClient) call(method, path string, query url.Values, out interface{}) error {
+	u := url.URL{Scheme: "http", Host: "cosmovisor", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling the admin API, is cosmovisor running? %w", err)
+	}
+	defer resp.Body.Close()
+	bz, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(bz, &failure) != nil || failure.Error == "" {
+			return fmt.Errorf("admin API: %s", resp.Status)
+		}
+		return errors.New(failure.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(bz, out)
+}
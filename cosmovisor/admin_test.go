@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+package cosmovisor_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/cosmos-sdk/cosmovisor"
+)
+
+// waitFor polls cond until it holds or a few seconds passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	home := copyTestData(t, "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", RestartAfterUpgrade: true, AdminSocket: filepath.Join(t.TempDir(), "admin.sock")}
+	runs := filepath.Join(home, "runs")
+	// the daemon runs until it is stopped
+	script := fmt.Sprintf("#!/bin/sh\necho run >> %s\ntrap 'exit 0' TERM\nwhile true; do sleep 1 >/dev/null 2>&1 & wait; done\n", runs)
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+	countRuns := func() int {
+		bz, _ := ioutil.ReadFile(runs)
+		return strings.Count(string(bz), "run\n")
+	}
+
+	stop, err := cosmovisor.ServeAdmin(cfg)
+	require.NoError(t, err)
+	defer stop()
+	client := cosmovisor.NewAdminClient(cfg.AdminSocket)
+	require.EqualError(t, client.Restart(), "the daemon isn't running")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	supervised := make(chan error, 1)
+	var stdout, stderr bytes.Buffer
+	go func() { supervised <- cosmovisor.SuperviseContext(ctx, cfg, nil, &stdout, &stderr) }()
+	running := func() bool {
+		status, err := client.Status()
+		return err == nil && status.Running != nil
+	}
+	waitFor(t, "the daemon", running)
+
+	// a second supervision would take the admin API over, even of another home
+	other := &cosmovisor.Config{Home: copyTestData(t, "validate"), Name: "dummyd"}
+	require.Equal(t, cosmovisor.ErrSupervising, cosmovisor.Supervise(other, nil, ioutil.Discard, ioutil.Discard))
+	_, err = cosmovisor.LaunchProcess(other, nil, ioutil.Discard, ioutil.Discard)
+	require.Equal(t, cosmovisor.ErrSupervising, err)
+
+	require.NoError(t, client.Restart())
+	waitFor(t, "the restart", func() bool { return countRuns() == 2 && running() })
+
+	// paused, the daemon stopped by the restart isn't launched again
+	require.NoError(t, client.Pause())
+	status, err := client.Status()
+	require.NoError(t, err)
+	require.True(t, status.Paused)
+	require.NotNil(t, status.Pause)
+	require.NoError(t, client.Restart())
+	waitFor(t, "the daemon to stop", func() bool { return !running() })
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 2, countRuns())
+	require.NoError(t, client.Resume())
+	waitFor(t, "the daemon after resuming", func() bool { return countRuns() == 3 && running() })
+
+	require.EqualError(t, client.Upgrade("chain9"), fmt.Sprintf("upgrade %q isn't staged in %s", "chain9", cfg.UpgradeDir("chain9")))
+	require.NoError(t, client.Upgrade("chain2"))
+	// chain2 finishes right away, ending the supervision
+	select {
+	case err := <-supervised:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the upgrade wasn't applied")
+	}
+	require.Contains(t, stdout.String(), "Chain 2 is live!")
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.UpgradeBin("chain2"), bin)
+
+	events, err := client.Events(0)
+	require.NoError(t, err)
+	var types []string
+	for _, ev := range events {
+		if ev.Upgrade == "chain2" {
+			types = append(types, ev.Type)
+		}
+	}
+	require.Contains(t, types, cosmovisor.EventUpgradeApplied)
+	last, err := client.Events(1)
+	require.NoError(t, err)
+	require.Len(t, last, 1)
+	require.Equal(t, events[len(events)-1].ID, last[0].ID)
+}
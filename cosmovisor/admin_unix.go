@@ -0,0 +1,62 @@
+//go:build !windows
+// +build !windows
+
+package cosmovisor
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// listenPrivate listens on the unix socket at path, accessible to the user cosmovisor runs
+// as only. The socket is bound in a directory no other user can enter, made private there
+// and only then renamed to path, so nobody can connect in between. The umask is left
+// alone, it is process wide.
+func listenPrivate(fs fsGuard, path string) (net.Listener, error) {
+	if err := fs.check("listen", path); err != nil {
+		return nil, err
+	}
+	// bind refuses an existing path, the rename would replace it
+	if _, err := os.Lstat(path); err == nil {
+		return nil, &os.PathError{Op: "listen", Path: path, Err: syscall.EADDRINUSE}
+	}
+	// the directory is created 0700, next to path so the rename stays on one filesystem
+	dir, err := fs.mkdirTemp(filepath.Dir(path), ".admin-")
+	if err != nil {
+		return nil, err
+	}
+	defer fs.removeAll(dir)
+	tmp := filepath.Join(dir, filepath.Base(path))
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed under its final name on close
+	l.SetUnlinkOnClose(false)
+	// fail closed: a socket others may connect to isn't served
+	if err = fs.chmod(tmp, 0600); err == nil {
+		err = fs.rename(tmp, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &renamedListener{UnixListener: l, fs: fs, path: path}, nil
+}
+
+// renamedListener is a listener whose socket was renamed to path after the bind
+type renamedListener struct {
+	*net.UnixListener
+	fs   fsGuard
+	path string
+}
+
+func (l *renamedListener) Close() error {
+	err := l.UnixListener.Close()
+	if rmErr := l.fs.remove(l.path); err == nil && !os.IsNotExist(rmErr) {
+		err = rmErr
+	}
+	return err
+}
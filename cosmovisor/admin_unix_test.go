@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenPrivate(t *testing.T) {
+	// with an open umask, a socket bound in place would be accessible to all
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.sock")
+	l, err := listenPrivate(fsGuard{}, path)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	require.NotZero(t, info.Mode()&os.ModeSocket)
+	// the umask of the process is left alone, and nothing is left of the bind
+	require.Equal(t, 0, syscall.Umask(0))
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// an existing path isn't replaced
+	_, err = listenPrivate(fsGuard{}, path)
+	require.True(t, errors.Is(err, syscall.EADDRINUSE), "%v", err)
+
+	// the socket is removed under its final name on close
+	require.NoError(t, l.Close())
+	_, err = os.Lstat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestServeAdminLocked(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", AdminSocket: filepath.Join(t.TempDir(), "admin.sock")}
+
+	// the socket of another cosmovisor supervising the home
+	other, err := lockDir(cfg.Root())
+	require.NoError(t, err)
+	defer other.Close()
+	l, err := listenPrivate(fsGuard{}, cfg.AdminSocket)
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = ServeAdmin(cfg)
+	var running *AlreadyRunningError
+	require.True(t, errors.As(err, &running), err)
+	info, err := os.Lstat(cfg.AdminSocket)
+	require.NoError(t, err, "the socket of the running cosmovisor is left alone")
+	require.NotZero(t, info.Mode()&os.ModeSocket)
+}
@@ -0,0 +1,21 @@
+package cosmovisor
+
+import "net"
+
+// listenPrivate listens on the unix socket at path, accessible to the user cosmovisor runs
+// as only as far as windows honors the mode
+func listenPrivate(fs fsGuard, path string) (net.Listener, error) {
+	if err := fs.check("listen", path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// fail closed: a socket others may connect to isn't served
+	if err := fs.chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
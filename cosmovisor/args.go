@@ -4,10 +4,16 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"net/mail"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
 )
 
 const (
@@ -24,6 +30,395 @@ type Config struct {
 	AllowDownloadBinaries bool
 	RestartAfterUpgrade   bool
 	LogBufferSize         int
+	// HaltAfterUpgrade keeps the new binary from being launched once an upgrade is applied,
+	// whatever RestartAfterUpgrade says
+	HaltAfterUpgrade HaltMode
+
+	// RestartAfterFailure launches the daemon again when it dies on its own
+	RestartAfterFailure bool
+	// RestartDelay is the wait before restarting a daemon that died, doubling with each
+	// failure in a row. One second if zero.
+	RestartDelay time.Duration
+	// RestartMaxAttempts is how many restarts in a row are tried before giving up, 5 if zero
+	RestartMaxAttempts int
+	// RestartMaxUptime restarts the daemon once it ran that long, to keep a slow leak of the
+	// app in check. Never if zero.
+	RestartMaxUptime time.Duration
+	// RestartWindow is the time of the day RestartMaxUptime restarts are made in, any time
+	// if nil
+	RestartWindow *RestartWindow
+	// MaintenanceWindows are the times the optional restarts of the daemon, for
+	// RestartMaxUptime and MemoryRestart, are made in, any time if empty
+	MaintenanceWindows MaintenanceWindows
+	// Rollback decides what happens when the binary of an upgrade fails right after the switch
+	Rollback RollbackPolicy
+	// RollbackWindow is how long after the switch a failure of the binary counts against
+	// the upgrade, two minutes if zero
+	RollbackWindow time.Duration
+	// RollbackAttempts is how many failures in the window roll the upgrade back, 1 if zero
+	RollbackAttempts int
+	// VerifyUpgrade asks PlanAPI after the switch whether x/upgrade applied the upgrade,
+	// and flags it if the chain didn't within VerifyUpgradeTimeout
+	VerifyUpgrade bool
+	// VerifyUpgradeTimeout is how long after the switch the chain may take to apply the
+	// upgrade, ten minutes if zero
+	VerifyUpgradeTimeout time.Duration
+	// HealthGateBlocks is how many blocks the binary of an upgrade must commit before the
+	// upgrade is healthy, no health gate if zero
+	HealthGateBlocks int
+	// HealthGateTimeout is how long after its launch the binary may take to commit them,
+	// ten minutes if zero
+	HealthGateTimeout time.Duration
+	// HealthGateOnFailure is what a failed health gate does, an alert if empty
+	HealthGateOnFailure HealthGateFailure
+
+	// DownloadMustHaveChecksum refuses downloads without a checksum cosmovisor can verify
+	DownloadMustHaveChecksum bool
+	// UnsafeSkipPlanChecksum switches to binaries that don't match the checksums of the
+	// plan, for emergencies
+	UnsafeSkipPlanChecksum bool
+	// SelfUpgrade installs the cosmovisor binary a plan lists when it requires a newer
+	// cosmovisor, and runs it to apply the upgrade
+	SelfUpgrade bool
+	// BinaryPubKey, if set, must have signed every downloaded binary
+	BinaryPubKey SignatureKey
+	// PlanPubKeys, if set, are the keys one of which must have signed the plan file before
+	// cosmovisor acts on it
+	PlanPubKeys []SignatureKey
+	// DownloaderCommand is the template of an external command fetching downloads instead
+	// of go-getter, see CommandDownloader
+	DownloaderCommand string
+	// Downloader, if set, fetches downloads. It takes precedence over DownloaderCommand.
+	Downloader Downloader
+	// DownloadProxy is the proxy of the HTTP downloads of the built-in downloader, taken
+	// from HTTP_PROXY, HTTPS_PROXY and NO_PROXY if empty
+	DownloadProxy string
+	// DownloadCACert is a PEM file of CA certificates trusted by the built-in downloader
+	// besides the system roots, e.g. of a TLS-intercepting proxy
+	DownloadCACert string
+	// DownloadClientCert and DownloadClientKey are the PEM files of the client certificate
+	// the built-in downloader presents to servers asking for one
+	DownloadClientCert string
+	DownloadClientKey  string
+	// UnsafeSkipTLSVerify makes the built-in downloader accept any server certificate
+	UnsafeSkipTLSVerify bool
+	// IPFSGateway is the HTTP gateway the ipfs:// downloads are fetched from, https://ipfs.io
+	// if empty
+	IPFSGateway string
+	// DownloadAttempts is how often each URL of a binary is tried, 3 if zero
+	DownloadAttempts int
+	// DownloadBackoff is the wait before retrying a download, doubling with each retry.
+	// One second if zero.
+	DownloadBackoff time.Duration
+	// DownloadStagingDir is where downloads are unpacked and verified before they are
+	// installed in the upgrade directory, TmpDir if empty
+	DownloadStagingDir string
+
+	// PredownloadAPI is the REST API of the node, asked for the upgrade plan so its binary
+	// is downloaded ahead of the upgrade height. Nothing is pre-downloaded if empty.
+	PredownloadAPI string
+	// PredownloadBlocks is how many blocks before the upgrade height the binary is
+	// downloaded, 1000 if zero
+	PredownloadBlocks int64
+	// PreUpgradeActions are run while the old binary runs, once the plan of x/upgrade is
+	// within their blocks of its height, as reported by PredownloadAPI or PlanAPI
+	PreUpgradeActions HeightActions
+	// PlanAPI is the REST API of the node, polled for the plan of x/upgrade to start the
+	// upgrade once the node reached its height
+	PlanAPI string
+
+	// LivenessRPC is the CometBFT RPC of the node, polled for its height to restart a node
+	// that stopped making blocks. Nothing is polled if empty.
+	LivenessRPC string
+	// LivenessTimeout is how long the height may stand still before the node is restarted,
+	// five minutes if zero
+	LivenessTimeout time.Duration
+	// LivenessMaxRestarts is how many restarts in a row may not get the node going again
+	// before it is left to the operator, 3 if zero
+	LivenessMaxRestarts int
+	// PeerRPCs are the CometBFT RPCs of reference nodes of the chain, whose height the
+	// height of the node is compared with. Nothing is compared if empty.
+	PeerRPCs []string
+	// PeerLagBlocks is how many blocks the node may be behind the reference nodes, 20 if
+	// zero
+	PeerLagBlocks int64
+	// PeerLagPeriod is how long the node must be behind before it is reported, five
+	// minutes if zero
+	PeerLagPeriod time.Duration
+
+	// LeaderElection is the URL of the lock in consul, etcd or redis that the nodes sharing a
+	// validator key campaign for, only the leader launches the daemon. No election if empty.
+	LeaderElection string
+	// LeaderBackend, if set, holds the lock instead of the backend of LeaderElection
+	LeaderBackend LeaderBackend
+	// LeaderID names this node in the election, the hostname if empty
+	LeaderID string
+	// LeaderTTL is how long the lease of the leader lasts without being renewed, 15 seconds
+	// if zero
+	LeaderTTL time.Duration
+
+	// RestartCoordination is the URL of the key in consul, etcd or redis the restart slots
+	// of a fleet are named after. The optional restarts of the daemon wait for a free slot,
+	// so the nodes sharing it never all restart at once. No coordination if empty.
+	RestartCoordination string
+	// RestartSlots, if set, are the locks of the restart slots instead of those of the
+	// backend of RestartCoordination
+	RestartSlots []LeaderBackend
+	// RestartConcurrency is how many slots RestartCoordination has, 1 if zero
+	RestartConcurrency int
+	// RestartSettle is how long a slot is held at most after the daemon was launched again,
+	// if it commits no block before, a minute if zero
+	RestartSettle time.Duration
+
+	// MemoryLimit is the memory.max of the cgroup the daemon is launched in, in bytes. No
+	// limit if zero.
+	MemoryLimit int64
+	// CPULimit is how many CPUs the cgroup the daemon is launched in may use, no limit if zero
+	CPULimit float64
+	// MemoryRestart restarts the daemon once its RSS exceeds it, in bytes. Never if zero.
+	MemoryRestart int64
+
+	// StopSignal asks the daemon to exit, for an upgrade or a hotfix and when cosmovisor is
+	// stopped. If zero, SIGTERM is used, or the signal cosmovisor received.
+	StopSignal syscall.Signal
+	// ShutdownGrace is the time the daemon gets to exit after the stop signal when it reached
+	// an upgrade, before it is killed. 10 seconds if zero.
+	ShutdownGrace time.Duration
+
+	// TerminationGrace is the time the orchestrator grants between the stop signal and SIGKILL
+	TerminationGrace time.Duration
+	// TerminationMargin is kept back from TerminationGrace for in-flight upgrade work
+	TerminationMargin time.Duration
+	// TerminationUpgradePolicy decides what happens if the grace period can't cover the upgrade
+	TerminationUpgradePolicy UpgradePolicy
+
+	// PreUpgradeExport runs the old binary's export command before every upgrade switch
+	PreUpgradeExport bool
+	// ExportCommand is the template of the export arguments, DefaultExportCommand if empty
+	ExportCommand string
+	// ExportTimeout bounds the export command
+	ExportTimeout time.Duration
+	// ExportPolicy decides if a failed export aborts the upgrade
+	ExportPolicy ExportPolicy
+	// Preflight runs `<daemon> version` with the binary of an upgrade before the switch, so
+	// a binary that can't run fails the upgrade while the old binary is still current
+	Preflight bool
+	// PreflightTimeout bounds the preflight run, 30 seconds if zero
+	PreflightTimeout time.Duration
+	// PreflightVersion is a template of what the preflight output must contain, e.g. the
+	// version or commit of the release, with {{.Name}} and {{.Height}} of the upgrade.
+	// Setting it turns Preflight on.
+	PreflightVersion string
+	// PreUpgradeMaxRetries is how often the new binary's pre-upgrade command is run again
+	// when it exits with 1
+	PreUpgradeMaxRetries int
+	// DataBackup is how the data directory is backed up before an upgrade
+	DataBackup DataBackup
+	// DataBackupDir holds the data backups, the backups of the state directory if empty
+	DataBackupDir string
+	// DataBackupDest is the s3://, gs:// or http(s):// URL the data backup archives are
+	// streamed to instead of DataBackupDir
+	DataBackupDest string
+	// DataBackupSnapshotCommand are the arguments of the old binary taking a state sync
+	// snapshot of the stopped node before a snapshot backup, the newest snapshot is backed
+	// up as is if empty
+	DataBackupSnapshotCommand string
+	// DataBackupName is the template of the name of the data backups, see
+	// defaultDataBackupName for the default
+	DataBackupName string
+	// DataBackupExclude are the patterns of the paths in the data directory left out of the
+	// data backups
+	DataBackupExclude []string
+	// BackupSpaceCheck decides what happens if the backup destination has less free space
+	// than the data directory holds
+	BackupSpaceCheck SpaceCheck
+	// BackupKeepRecent is how many data backups are kept after an upgrade, all if zero
+	BackupKeepRecent int
+	// BackupMaxAge removes data backups older than it after an upgrade, none if zero
+	BackupMaxAge time.Duration
+	// UpgradesKeepRecent is how many of the upgrades applied last keep their directories
+	// after an upgrade, all if zero
+	UpgradesKeepRecent int
+	// BackupCommand is the template of the command backing up the node before an upgrade
+	BackupCommand string
+	// BackupBackends are the backup backends run before an upgrade, in order, those of
+	// DataBackup, DataBackupDest and BackupCommand if empty
+	BackupBackends []string
+	// BackupSchedule are the times of the day the daemon is stopped for a backup, as before
+	// an upgrade, and launched again. Never if empty.
+	BackupSchedule BackupSchedule
+	// PostUpgradeHook is a script, or a directory of them, run after the switch to an upgrade
+	PostUpgradeHook string
+	// PostUpgradeHookTimeout bounds each post-upgrade hook
+	PostUpgradeHookTimeout time.Duration
+	// Hooks are the policies of the hook points of HooksDir, by hook point. They are set
+	// in the hooks table of the config file.
+	Hooks map[string]HookPolicy
+	// SignerPauseCommand is the template of the command pausing the remote signer of the
+	// node, e.g. tmkms or horcrux, once the old binary stopped for an upgrade
+	SignerPauseCommand string
+	// SignerResumeCommand is the template of the command resuming the remote signer once the
+	// node caught up after the upgrade
+	SignerResumeCommand string
+	// SignerTimeout bounds each signer command, a minute if zero
+	SignerTimeout time.Duration
+
+	// Sidecars run alongside the daemon, started in this order and stopped in reverse, see
+	// Sidecar. GetConfigFromEnv reads them from the config file, ordered by their After.
+	Sidecars []Sidecar
+
+	// ChildEnvAllow are the variables of cosmovisor passed on to the daemon, all if empty.
+	// A name ending in * stands for all names starting with the rest.
+	ChildEnvAllow []string
+	// ChildEnv are KEY=value variables set for the daemon, replacing those of cosmovisor.
+	// GetConfigFromEnv reads them from the child_env table of the config file.
+	ChildEnv []string
+	// ExtraArgs are added to the arguments of every launch of the daemon, before the
+	// arguments of its launch overrides
+	ExtraArgs []string
+	// SupervisedCommands are the daemon commands that are supervised, ["start"] if empty, or
+	// ["*"] for all of them. The others are passed through to the current binary.
+	SupervisedCommands []string
+	// WorkDir is the working directory of the daemon, DAEMON_HOME if empty
+	WorkDir string
+
+	// ReloadSignal is sent to the daemon when cosmovisor receives SIGUSR2
+	ReloadSignal syscall.Signal
+	// PauseSignal pauses the supervision when cosmovisor receives it, and resumes it the
+	// next time, instead of being forwarded to the daemon. Nothing pauses on a signal if 0.
+	PauseSignal syscall.Signal
+
+	// CrashChildPolicy decides if the daemon is stopped when cosmovisor itself crashes
+	CrashChildPolicy CrashChildPolicy
+	// Init decides if cosmovisor runs as the init of a container, reaping orphaned
+	// zombies, see RunInit. It does when it is PID 1 if empty.
+	Init InitMode
+
+	// NotifyWebhook receives every lifecycle event as JSON, if set
+	NotifyWebhook string
+	// NotifyInterval is the minimum time between two notifications to a destination
+	NotifyInterval time.Duration
+	// NotifySMTP is the smtp:// or smtps:// URL of the SMTP server the events are mailed
+	// through, if set
+	NotifySMTP string
+	// NotifyEmailFrom is the sender of the emails, and NotifyEmailTo their recipients
+	NotifyEmailFrom string
+	NotifyEmailTo   []string
+	// NotifyEmailEvents are the types of the events mailed, all if empty
+	NotifyEmailEvents []string
+	// NotifyEmailSubject is the template of the subject of the emails, see EmailData
+	NotifyEmailSubject string
+	// NotifyEmailTemplate is a file with the template of the body of the emails
+	NotifyEmailTemplate string
+
+	// OutputPrefix starts every line of the daemon's output with the time and the stream
+	OutputPrefix bool
+	// OutputFile is a file the daemon's output is appended to as well, if set
+	OutputFile string
+	// OutputDir is a directory the output of each launch of the daemon is written to as
+	// well, in a file of its own, if set
+	OutputDir string
+	// OutputRotateSize rotates the output file before it grows beyond it, in bytes, never if zero
+	OutputRotateSize int64
+	// OutputRotateInterval rotates the output file when an interval starts, like every day at
+	// midnight UTC for 24h, never if zero
+	OutputRotateInterval time.Duration
+	// OutputKeepRecent is how many rotated output files are kept, all if zero
+	OutputKeepRecent int
+	// OutputMaxAge removes rotated output files older than it, none if zero
+	OutputMaxAge time.Duration
+	// OutputCompress compresses the rotated output files with gzip
+	OutputCompress bool
+
+	// MetricsAddr is the address Prometheus metrics are served on, e.g. 127.0.0.1:26661 or
+	// unix:/run/cosmovisor.sock, off if empty
+	MetricsAddr string
+	// MetricsPushURL is the Prometheus Pushgateway the metrics are pushed to, off if empty
+	MetricsPushURL string
+	// MetricsPushInterval is how often the metrics are pushed, 15s if zero
+	MetricsPushInterval time.Duration
+	// MetricsPushInstance is the instance label of the pushed metrics, the host name if empty
+	MetricsPushInstance string
+	// HealthAddr is the address /healthz and /status are served on, like MetricsAddr, off if empty
+	HealthAddr string
+	// AdminSocket is the unix socket the admin API is served on, off if empty
+	AdminSocket string
+
+	// LogLevel is the least severe level cosmovisor logs at, info if empty
+	LogLevel LogLevel
+	// LogFormat is how cosmovisor formats its log lines, text if empty
+	LogFormat LogFormat
+
+	// RunAs is the user, user:group, the node runs as. Binaries staged by cosmovisor running
+	// as root are given to it.
+	RunAs string
+	// DropPrivileges launches the daemon as RunAs when cosmovisor runs as root, which keeps
+	// root for the links, the backups and the staging of binaries
+	DropPrivileges bool
+
+	// WritableRoot holds the state of an immutable layout, DAEMON_HOME if empty
+	WritableRoot string
+	// StatePath holds the state instead of the cosmovisor directory, or of the directory
+	// below WritableRoot in an immutable layout, if set
+	StatePath string
+	// TmpDir holds the temporary files, the tmp directory of the state directory if empty
+	TmpDir string
+	// Immutable is set if the cosmovisor directory is read-only, e.g. baked into a container
+	// image: binaries are never downloaded or replaced and the state lives below WritableRoot
+	Immutable bool
+	// GenesisDir, UpgradesDir and CurrentLink move the genesis directory, the directory of
+	// the upgrade directories and the current link out of the cosmovisor directory, e.g.
+	// the binaries to a read-only volume. They are below it if empty.
+	GenesisDir  string
+	UpgradesDir string
+	CurrentLink string
+
+	// UpgradeDetection is where the upgrade is detected, the output and the plan file if empty
+	UpgradeDetection UpgradeDetection
+	// UpgradeSources ranks the sources of upgrades, highest priority first, the default order
+	// if empty. Sources left out rank below those listed.
+	UpgradeSources []string
+	// UpgradeConflict is what sources disagreeing about the upgrade do, the priority decides
+	// if empty
+	UpgradeConflict UpgradeConflict
+	// PollInterval is how often the plan file is read when its directory can't be watched,
+	// 300 milliseconds if zero
+	PollInterval time.Duration
+	// PollJitter is the most added at random to each PollInterval, so nodes sharing a
+	// filesystem don't all read it at the same time
+	PollJitter time.Duration
+
+	// InjectHome appends --home DAEMON_HOME to the arguments of the daemon unless they set
+	// --home, and refuses arguments setting another home
+	InjectHome bool
+
+	// StrictHeightCheck refuses to start if the node's height contradicts the applied upgrades
+	StrictHeightCheck bool
+	// ValidatorStateCheck records priv_validator_state.json before the daemon is stopped for
+	// an upgrade, and refuses to run the new binary if it went back since
+	ValidatorStateCheck bool
+
+	// SkipUpgrades are the upgrades the app is told to skip with --unsafe-skip-upgrades
+	// rather than applied
+	SkipUpgrades SkipUpgrades
+
+	// ReadOnly refuses every write, for inspecting the home of a node supervised by another
+	// cosmovisor process. Inspection entry points set it.
+	ReadOnly bool
+}
+
+// ScanBufferSize is the longest line of output the upgrade scanners can match.
+// LogBufferSize is only used if it is larger than bufio.MaxScanTokenSize.
+func (cfg *Config) ScanBufferSize() int {
+	if cfg.LogBufferSize < bufio.MaxScanTokenSize {
+		return bufio.MaxScanTokenSize
+	}
+	return cfg.LogBufferSize
+}
+
+// ShouldRestart returns true if the daemon is launched again after LaunchProcess returned
+func (cfg *Config) ShouldRestart(upgraded bool, err error) bool {
+	return cfg.RestartAfterUpgrade && err == nil && upgraded
 }
 
 // Root returns the root directory where all info lives
@@ -31,28 +426,77 @@ func (cfg *Config) Root() string {
 	return filepath.Join(cfg.Home, rootName)
 }
 
+// genesisPath is the genesis directory, GenesisDir if set
+func (cfg *Config) genesisPath() string {
+	if cfg.GenesisDir != "" {
+		return cfg.GenesisDir
+	}
+	return filepath.Join(cfg.Root(), genesisDir)
+}
+
+// upgradesPath is the directory holding the upgrade directories, UpgradesDir if set
+func (cfg *Config) upgradesPath() string {
+	if cfg.UpgradesDir != "" {
+		return cfg.UpgradesDir
+	}
+	return filepath.Join(cfg.Root(), upgradesDir)
+}
+
+// currentPath is the current link, CurrentLink if set
+func (cfg *Config) currentPath() string {
+	if cfg.CurrentLink != "" {
+		return cfg.CurrentLink
+	}
+	return filepath.Join(cfg.Root(), currentLink)
+}
+
+// binName is the file name of the daemon binary, DAEMON_NAME with .exe on windows
+func (cfg *Config) binName() string {
+	return exeName(cfg.Name)
+}
+
 // GenesisBin is the path to the genesis binary - must be in place to start manager
 func (cfg *Config) GenesisBin() string {
-	return filepath.Join(cfg.Root(), genesisDir, "bin", cfg.Name)
+	return cfg.versionBin(cfg.genesisPath())
 }
 
-// UpgradeBin is the path to the binary for the named upgrade
+// UpgradeBin is the path to the binary for the named upgrade, see binNameIn for its name
 func (cfg *Config) UpgradeBin(upgradeName string) string {
-	return filepath.Join(cfg.UpgradeDir(upgradeName), "bin", cfg.Name)
+	return cfg.versionBin(cfg.UpgradeDir(upgradeName))
+}
+
+// ValidateUpgradeName returns an error if name can't name an upgrade directory
+func ValidateUpgradeName(name string) error {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return errors.New("upgrade name is empty")
+	case name == "." || name == "..":
+		return fmt.Errorf("invalid upgrade name %q", name)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("invalid upgrade name %q: control character", name)
+		}
+	}
+	return nil
 }
 
 // UpgradeDir is the directory named upgrade
 func (cfg *Config) UpgradeDir(upgradeName string) string {
 	safeName := url.PathEscape(upgradeName)
-	return filepath.Join(cfg.Root(), upgradesDir, safeName)
+	return filepath.Join(cfg.upgradesPath(), safeName)
 }
 
 // Symlink to genesis
 func (cfg *Config) SymLinkToGenesis() (string, error) {
-	genesis := filepath.Join(cfg.Root(), genesisDir)
-	link := filepath.Join(cfg.Root(), currentLink)
+	genesis := cfg.genesisPath()
+	link := cfg.currentPath()
 
-	if err := os.Symlink(genesis, link); err != nil {
+	if err := cfg.fs().linkDir(cfg.linkTarget(genesis, link), link); errors.Is(err, errNoDirLinks) {
+		if err := cfg.pointCurrent(genesis, err); err != nil {
+			return "", err
+		}
+	} else if err != nil {
 		return "", err
 	}
 	// and return the genesis binary
@@ -60,80 +504,910 @@ func (cfg *Config) SymLinkToGenesis() (string, error) {
 }
 
 // CurrentBin is the path to the currently selected binary (genesis if no link is set)
-// This will resolve the symlink to the underlying directory to make it easier to debug
+// This will resolve the symlink to the underlying directory to make it easier to debug.
+// In read-only mode and in an immutable layout a missing link is not created.
 func (cfg *Config) CurrentBin() (string, error) {
-	cur := filepath.Join(cfg.Root(), currentLink)
-	// if nothing here, fallback to genesis
-	info, err := os.Lstat(cur)
-	if err != nil {
-		//Create symlink to the genesis
-		return cfg.SymLinkToGenesis()
-	}
-	// if it is there, ensure it is a symlink
-	if info.Mode()&os.ModeSymlink == 0 {
+	bin, linked := cfg.resolveCurrentBin()
+	if !linked && !cfg.ReadOnly && !cfg.Immutable {
 		//Create symlink to the genesis
 		return cfg.SymLinkToGenesis()
 	}
+	return bin, nil
+}
 
-	// resolve it
-	dest, err := os.Readlink(cur)
+// resolveCurrentBin is CurrentBin without creating the link, linked is false if there is
+// no valid current link and the genesis binary is returned. In an immutable layout the
+// current pointer wins over a link shipped with the image. Elsewhere current is the pointer
+// itself on file systems that can't hold links.
+func (cfg *Config) resolveCurrentBin() (bin string, linked bool) {
+	if cfg.Immutable {
+		if bin, ok := cfg.readCurrentPointer(); ok {
+			return bin, true
+		}
+	}
+	cur := cfg.currentPath()
+	// resolve it, if it is there and a link
+	dest, err := readDirLink(cur)
 	if err != nil {
-		//Create symlink to the genesis
-		return cfg.SymLinkToGenesis()
+		if bin, ok := cfg.readCurrentPointer(); ok && !cfg.Immutable {
+			return bin, true
+		}
+		// fallback to genesis
+		return cfg.GenesisBin(), false
 	}
 
+	// a relative link is relative to the directory holding it
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(filepath.Dir(cur), dest)
+	}
 	// and return the binary
-	return filepath.Join(dest, "bin", cfg.Name), nil
+	return cfg.versionBin(dest), true
 }
 
 // GetConfigFromEnv will read the environmental variables into a config
-// and then validate it is reasonable
+// and then validate it is reasonable. The variables that are unset or empty are taken
+// from the config file in the cosmovisor directory, if there is one. An unset DAEMON_HOME
+// or DAEMON_NAME is detected from the node homes of the user, see detectHome. All invalid
+// settings are reported at once, as ConfigErrors.
 func GetConfigFromEnv() (*Config, error) {
-	cfg := &Config{
-		Home: os.Getenv("DAEMON_HOME"),
-		Name: os.Getenv("DAEMON_NAME"),
+	cfg, errs := configFromEnv()
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return cfg, nil
+}
+
+// configFromEnv is GetConfigFromEnv, returning the settings that could be read along with
+// the problems of the others
+func configFromEnv() (*Config, ConfigErrors) {
+	var errs ConfigErrors
+	cfg := &Config{Home: os.Getenv("DAEMON_HOME")}
+	if cfg.Home == "" {
+		cfg.Home = detectHome(os.Getenv("DAEMON_NAME"))
+	}
+	var file configFile
+	if filepath.IsAbs(cfg.Home) {
+		var err error
+		if file, err = readConfigFile(cfg.ConfigFile()); err != nil {
+			errs = append(errs, fmt.Errorf("invalid config file %s: %w", cfg.ConfigFile(), err))
+		}
+		cfg.Sidecars, cfg.ChildEnv, cfg.Hooks = file.sidecars, file.childEnv, file.hooks
+	}
+	getenv := func(env string) string {
+		if value := os.Getenv(env); value != "" {
+			return value
+		}
+		return file.settings[env]
+	}
+	cfg.Name = getenv("DAEMON_NAME")
+	if cfg.Name == "" && filepath.IsAbs(cfg.Home) {
+		cfg.Name = detectName(cfg.Home)
 	}
 
-	if os.Getenv("DAEMON_ALLOW_DOWNLOAD_BINARIES") == "true" {
+	if getenv("DAEMON_ALLOW_DOWNLOAD_BINARIES") == "true" {
 		cfg.AllowDownloadBinaries = true
 	}
 
-	if os.Getenv("DAEMON_RESTART_AFTER_UPGRADE") == "true" {
+	if getenv("DAEMON_DOWNLOAD_MUST_HAVE_CHECKSUM") == "true" {
+		cfg.DownloadMustHaveChecksum = true
+	}
+
+	if getenv("DAEMON_UNSAFE_SKIP_PLAN_CHECKSUM") == "true" {
+		cfg.UnsafeSkipPlanChecksum = true
+	}
+
+	if getenv("DAEMON_SELF_UPGRADE") == "true" {
+		cfg.SelfUpgrade = true
+	}
+
+	cfg.DownloadProxy = getenv("DAEMON_DOWNLOAD_PROXY")
+	for env, file := range map[string]*string{"DAEMON_DOWNLOAD_CA_CERT": &cfg.DownloadCACert,
+		"DAEMON_DOWNLOAD_CLIENT_CERT": &cfg.DownloadClientCert, "DAEMON_DOWNLOAD_CLIENT_KEY": &cfg.DownloadClientKey} {
+		if path := getenv(env); path != "" && !filepath.IsAbs(path) {
+			errs = append(errs, fmt.Errorf("%s must be an absolute path", env))
+		} else {
+			*file = path
+		}
+	}
+	if getenv("DAEMON_UNSAFE_SKIP_TLS_VERIFY") == "true" {
+		cfg.UnsafeSkipTLSVerify = true
+	}
+	if err := cfg.validateDownloadTLS(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if pubkey := getenv("DAEMON_BINARY_PUBKEY"); pubkey != "" {
+		if key, err := LoadSignatureKey(pubkey); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_BINARY_PUBKEY: %w", err))
+		} else {
+			cfg.BinaryPubKey = key
+		}
+	}
+	if keys, err := parsePlanPubKeys(getenv("DAEMON_PLAN_PUBKEYS")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_PLAN_PUBKEYS: %w", err))
+	} else {
+		cfg.PlanPubKeys = keys
+	}
+
+	if command := getenv("DAEMON_DOWNLOADER_CMD"); command != "" {
+		if _, err := (CommandDownloader{Command: command}).Args("https://example.com/file", "/tmp/file"); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_DOWNLOADER_CMD: %w", err))
+		} else {
+			cfg.DownloaderCommand = command
+		}
+	}
+
+	if attempts := getenv("DAEMON_DOWNLOAD_ATTEMPTS"); attempts != "" {
+		if n, err := strconv.Atoi(attempts); err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_DOWNLOAD_ATTEMPTS %q: must be a positive number", attempts))
+		} else {
+			cfg.DownloadAttempts = n
+		}
+	}
+	if backoff := getenv("DAEMON_DOWNLOAD_BACKOFF"); backoff != "" {
+		if d, err := parseGraceDuration(backoff); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_DOWNLOAD_BACKOFF: %w", err))
+		} else {
+			cfg.DownloadBackoff = d
+		}
+	}
+
+	if gateway := getenv("DAEMON_IPFS_GATEWAY"); gateway != "" {
+		if u, err := url.Parse(gateway); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_IPFS_GATEWAY %q: must be an http or https URL", gateway))
+		} else {
+			cfg.IPFSGateway = gateway
+		}
+	}
+
+	if api := getenv("DAEMON_PREDOWNLOAD_API"); api != "" {
+		if u, err := url.Parse(api); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_PREDOWNLOAD_API %q: must be an http or https URL", api))
+		} else {
+			cfg.PredownloadAPI = api
+		}
+	}
+	if api := getenv("DAEMON_PLAN_API"); api != "" {
+		if u, err := url.Parse(api); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_PLAN_API %q: must be an http or https URL", api))
+		} else {
+			cfg.PlanAPI = api
+		}
+	}
+	if blocks := getenv("DAEMON_PREDOWNLOAD_BLOCKS"); blocks != "" {
+		if n, err := strconv.ParseInt(blocks, 10, 64); err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_PREDOWNLOAD_BLOCKS %q: must be a positive number", blocks))
+		} else {
+			cfg.PredownloadBlocks = n
+		}
+	}
+	if actions, err := parsePreUpgradeActions(getenv("DAEMON_PRE_UPGRADE_ACTIONS")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_PRE_UPGRADE_ACTIONS %q: %w", getenv("DAEMON_PRE_UPGRADE_ACTIONS"), err))
+	} else {
+		cfg.PreUpgradeActions = actions
+	}
+	if rpc := getenv("DAEMON_LIVENESS_RPC"); rpc != "" {
+		if u, err := url.Parse(rpc); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_LIVENESS_RPC %q: must be an http or https URL", rpc))
+		} else {
+			cfg.LivenessRPC = rpc
+		}
+	}
+	if timeout := getenv("DAEMON_LIVENESS_TIMEOUT"); timeout != "" {
+		if d, err := parseGraceDuration(timeout); err != nil || d == 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_LIVENESS_TIMEOUT %q: must be a positive duration", timeout))
+		} else {
+			cfg.LivenessTimeout = d
+		}
+	}
+	if restarts := getenv("DAEMON_LIVENESS_MAX_RESTARTS"); restarts != "" {
+		if n, err := strconv.Atoi(restarts); err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_LIVENESS_MAX_RESTARTS %q: must be a positive number", restarts))
+		} else {
+			cfg.LivenessMaxRestarts = n
+		}
+	}
+	if rpcs := getenv("DAEMON_PEER_RPCS"); rpcs != "" {
+		for _, rpc := range strings.Split(rpcs, ",") {
+			rpc = strings.TrimSpace(rpc)
+			if u, err := url.Parse(rpc); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				errs = append(errs, fmt.Errorf("invalid DAEMON_PEER_RPCS %q: must be http or https URLs separated by commas", rpcs))
+				cfg.PeerRPCs = nil
+				break
+			}
+			cfg.PeerRPCs = append(cfg.PeerRPCs, rpc)
+		}
+	}
+	if blocks := getenv("DAEMON_PEER_LAG_BLOCKS"); blocks != "" {
+		if n, err := strconv.ParseInt(blocks, 10, 64); err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_PEER_LAG_BLOCKS %q: must be a positive number", blocks))
+		} else {
+			cfg.PeerLagBlocks = n
+		}
+	}
+	if period := getenv("DAEMON_PEER_LAG_PERIOD"); period != "" {
+		if d, err := parseGraceDuration(period); err != nil || d == 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_PEER_LAG_PERIOD %q: must be a positive duration", period))
+		} else {
+			cfg.PeerLagPeriod = d
+		}
+	}
+
+	if ttl := getenv("DAEMON_LEADER_TTL"); ttl != "" {
+		if d, err := parseGraceDuration(ttl); err != nil || d < minLeaderTTL {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_LEADER_TTL %q: must be a duration of at least %s", ttl, minLeaderTTL))
+		} else {
+			cfg.LeaderTTL = d
+		}
+	}
+	if election := getenv("DAEMON_LEADER_ELECTION"); election != "" {
+		if _, err := parseLeaderElection(election, cfg.leaderTTL()); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_LEADER_ELECTION %q: %w", election, err))
+		} else {
+			cfg.LeaderElection = election
+		}
+	}
+	cfg.LeaderID = getenv("DAEMON_LEADER_ID")
+	if coordination := getenv("DAEMON_RESTART_COORDINATION"); coordination != "" {
+		if _, err := parseRestartCoordination(coordination, cfg.leaderTTL()); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_RESTART_COORDINATION %q: %w", coordination, err))
+		} else {
+			cfg.RestartCoordination = coordination
+		}
+	}
+	if concurrency := getenv("DAEMON_RESTART_CONCURRENCY"); concurrency != "" {
+		if n, err := strconv.Atoi(concurrency); err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_RESTART_CONCURRENCY %q: must be a positive number", concurrency))
+		} else {
+			cfg.RestartConcurrency = n
+		}
+	}
+	if settle := getenv("DAEMON_RESTART_SETTLE"); settle != "" {
+		if d, err := parseGraceDuration(settle); err != nil || d == 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_RESTART_SETTLE %q: must be a positive duration", settle))
+		} else {
+			cfg.RestartSettle = d
+		}
+	}
+
+	if limit := getenv("DAEMON_MEMORY_LIMIT"); limit != "" {
+		if n, err := strconv.ParseInt(limit, 10, 64); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_MEMORY_LIMIT %q: must be a number of MiB, 0 or more", limit))
+		} else {
+			cfg.MemoryLimit = n * 1024 * 1024
+		}
+	}
+	if limit := getenv("DAEMON_CPU_LIMIT"); limit != "" {
+		if n, err := strconv.ParseFloat(limit, 64); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_CPU_LIMIT %q: must be a number of CPUs, 0 or more", limit))
+		} else {
+			cfg.CPULimit = n
+		}
+	}
+	if restart := getenv("DAEMON_MEMORY_RESTART"); restart != "" {
+		if n, err := strconv.ParseInt(restart, 10, 64); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_MEMORY_RESTART %q: must be a number of MiB, 0 or more", restart))
+		} else {
+			cfg.MemoryRestart = n * 1024 * 1024
+		}
+	}
+	if cfg.MemoryLimit > 0 && cfg.MemoryRestart >= cfg.MemoryLimit {
+		errs = append(errs, errors.New("DAEMON_MEMORY_RESTART must be below DAEMON_MEMORY_LIMIT, the daemon would be killed before it is restarted"))
+	}
+
+	if getenv("DAEMON_RESTART_AFTER_UPGRADE") == "true" {
 		cfg.RestartAfterUpgrade = true
 	}
 
-	logBufferSizeStr := os.Getenv("DAEMON_LOG_BUFFER_SIZE")
-	if logBufferSizeStr != "" {
-		logBufferSize, err := strconv.Atoi(logBufferSizeStr)
-		if err != nil {
-			return nil, err
+	if mode, err := parseHaltMode(getenv("DAEMON_HALT_AFTER_UPGRADE")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_HALT_AFTER_UPGRADE: %w", err))
+	} else {
+		cfg.HaltAfterUpgrade = mode
+	}
+
+	if getenv("DAEMON_RESTART_AFTER_FAILURE") == "true" {
+		cfg.RestartAfterFailure = true
+	}
+	if delay := getenv("DAEMON_RESTART_DELAY"); delay != "" {
+		if d, err := parseGraceDuration(delay); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_RESTART_DELAY: %w", err))
+		} else {
+			cfg.RestartDelay = d
+		}
+	}
+	if detection, err := parseUpgradeDetection(getenv("DAEMON_UPGRADE_DETECTION")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_UPGRADE_DETECTION: %w", err))
+	} else {
+		cfg.UpgradeDetection = detection
+	}
+	if sources, err := parseUpgradeSources(getenv("DAEMON_UPGRADE_SOURCES")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_UPGRADE_SOURCES: %w", err))
+	} else {
+		cfg.UpgradeSources = sources
+	}
+	if conflict, err := parseUpgradeConflict(getenv("DAEMON_UPGRADE_CONFLICT")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_UPGRADE_CONFLICT: %w", err))
+	} else {
+		cfg.UpgradeConflict = conflict
+	}
+	if interval := getenv("DAEMON_POLL_INTERVAL"); interval != "" {
+		if d, err := parsePollDuration(interval); err != nil || d == 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_POLL_INTERVAL %q: must be a positive duration or number of milliseconds", interval))
+		} else {
+			cfg.PollInterval = d
 		}
-		cfg.LogBufferSize = logBufferSize * 1024
+	}
+	if jitter := getenv("DAEMON_POLL_JITTER"); jitter != "" {
+		if d, err := parsePollDuration(jitter); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_POLL_JITTER %q: must be a duration or number of milliseconds", jitter))
+		} else {
+			cfg.PollJitter = d
+		}
+	}
+	if attempts := getenv("DAEMON_RESTART_MAX_ATTEMPTS"); attempts != "" {
+		if n, err := strconv.Atoi(attempts); err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_RESTART_MAX_ATTEMPTS %q: must be a positive number", attempts))
+		} else {
+			cfg.RestartMaxAttempts = n
+		}
+	}
+	if uptime := getenv("DAEMON_RESTART_MAX_UPTIME"); uptime != "" {
+		if d, err := parseGraceDuration(uptime); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_RESTART_MAX_UPTIME: %w", err))
+		} else {
+			cfg.RestartMaxUptime = d
+		}
+	}
+	if window, err := parseRestartWindow(getenv("DAEMON_RESTART_WINDOW")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_RESTART_WINDOW: %w", err))
+	} else if window != nil && cfg.RestartMaxUptime == 0 {
+		errs = append(errs, errors.New("DAEMON_RESTART_WINDOW is set without DAEMON_RESTART_MAX_UPTIME"))
+	} else {
+		cfg.RestartWindow = window
+	}
+	if windows, err := parseMaintenanceWindows(getenv("DAEMON_MAINTENANCE_WINDOW")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_MAINTENANCE_WINDOW: %w", err))
+	} else {
+		cfg.MaintenanceWindows = windows
+	}
+	if policy, err := parseRollbackPolicy(getenv("DAEMON_ROLLBACK")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_ROLLBACK: %w", err))
 	} else {
-		cfg.LogBufferSize = bufio.MaxScanTokenSize
+		cfg.Rollback = policy
+	}
+	if window := getenv("DAEMON_ROLLBACK_WINDOW"); window != "" {
+		if d, err := parseGraceDuration(window); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_ROLLBACK_WINDOW: %w", err))
+		} else {
+			cfg.RollbackWindow = d
+		}
+	}
+	if attempts := getenv("DAEMON_ROLLBACK_ATTEMPTS"); attempts != "" {
+		if n, err := strconv.Atoi(attempts); err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_ROLLBACK_ATTEMPTS %q: must be a positive number", attempts))
+		} else {
+			cfg.RollbackAttempts = n
+		}
+	}
+	if getenv("DAEMON_VERIFY_UPGRADE") == "true" {
+		cfg.VerifyUpgrade = true
+	}
+	if timeout := getenv("DAEMON_VERIFY_UPGRADE_TIMEOUT"); timeout != "" {
+		if d, err := parseGraceDuration(timeout); err != nil || d == 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_VERIFY_UPGRADE_TIMEOUT %q: must be a positive duration", timeout))
+		} else {
+			cfg.VerifyUpgradeTimeout = d
+		}
+	}
+	if blocks := getenv("DAEMON_HEALTH_GATE_BLOCKS"); blocks != "" {
+		if n, err := strconv.Atoi(blocks); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_HEALTH_GATE_BLOCKS %q: must be a number of blocks", blocks))
+		} else {
+			cfg.HealthGateBlocks = n
+		}
+	}
+	if timeout := getenv("DAEMON_HEALTH_GATE_TIMEOUT"); timeout != "" {
+		if d, err := parseGraceDuration(timeout); err != nil || d == 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_HEALTH_GATE_TIMEOUT %q: must be a positive duration", timeout))
+		} else {
+			cfg.HealthGateTimeout = d
+		}
+	}
+	if failure, err := parseHealthGateFailure(getenv("DAEMON_HEALTH_GATE_ON_FAILURE")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_HEALTH_GATE_ON_FAILURE: %w", err))
+	} else {
+		cfg.HealthGateOnFailure = failure
 	}
 
-	if err := cfg.validate(); err != nil {
-		return nil, err
+	cfg.LogBufferSize = bufio.MaxScanTokenSize
+	if logBufferSizeStr := getenv("DAEMON_LOG_BUFFER_SIZE"); logBufferSizeStr != "" {
+		if logBufferSize, err := strconv.Atoi(logBufferSizeStr); err != nil || logBufferSize < 1 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_LOG_BUFFER_SIZE %q: must be a positive number of KiB", logBufferSizeStr))
+		} else {
+			cfg.LogBufferSize = logBufferSize * 1024
+		}
 	}
 
-	return cfg, nil
-}
+	if grace := getenv("DAEMON_SHUTDOWN_GRACE"); grace != "" {
+		if d, err := parseGraceDuration(grace); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_SHUTDOWN_GRACE: %w", err))
+		} else {
+			cfg.ShutdownGrace = d
+		}
+	}
 
-// validate returns an error if this config is invalid.
-// it enforces Home/cosmovisor is a valid directory and exists,
-// and that Name is set
-func (cfg *Config) validate() error {
-	if cfg.Name == "" {
-		return errors.New("DAEMON_NAME is not set")
+	if grace := getenv("DAEMON_TERMINATION_GRACE"); grace != "" {
+		if d, err := parseGraceDuration(grace); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_TERMINATION_GRACE: %w", err))
+		} else {
+			cfg.TerminationGrace = d
+		}
+	} else if path := getenv("DAEMON_TERMINATION_GRACE_FILE"); path != "" {
+		if d, err := readGraceFile(path); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_TERMINATION_GRACE_FILE: %w", err))
+		} else {
+			cfg.TerminationGrace = d
+		}
 	}
 
-	if cfg.Home == "" {
-		return errors.New("DAEMON_HOME is not set")
+	if margin := getenv("DAEMON_TERMINATION_GRACE_MARGIN"); margin != "" {
+		if d, err := parseGraceDuration(margin); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_TERMINATION_GRACE_MARGIN: %w", err))
+		} else {
+			cfg.TerminationMargin = d
+		}
 	}
 
-	if !filepath.IsAbs(cfg.Home) {
-		return errors.New("DAEMON_HOME must be an absolute path")
+	if policy, err := parseUpgradePolicy(getenv("DAEMON_TERMINATION_UPGRADE_POLICY")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_TERMINATION_UPGRADE_POLICY: %w", err))
+	} else {
+		cfg.TerminationUpgradePolicy = policy
+	}
+
+	if getenv("DAEMON_PRE_UPGRADE_EXPORT") == "true" {
+		cfg.PreUpgradeExport = true
+	}
+	cfg.ExportCommand = getenv("DAEMON_PRE_UPGRADE_EXPORT_COMMAND")
+
+	if timeout := getenv("DAEMON_PRE_UPGRADE_EXPORT_TIMEOUT"); timeout != "" {
+		if d, err := parseGraceDuration(timeout); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_PRE_UPGRADE_EXPORT_TIMEOUT: %w", err))
+		} else {
+			cfg.ExportTimeout = d
+		}
+	}
+
+	if exportPolicy, err := parseExportPolicy(getenv("DAEMON_PRE_UPGRADE_EXPORT_POLICY")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_PRE_UPGRADE_EXPORT_POLICY: %w", err))
+	} else {
+		cfg.ExportPolicy = exportPolicy
+	}
+
+	if getenv("DAEMON_PREFLIGHT") == "true" {
+		cfg.Preflight = true
+	}
+	if timeout := getenv("DAEMON_PREFLIGHT_TIMEOUT"); timeout != "" {
+		if d, err := parseGraceDuration(timeout); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_PREFLIGHT_TIMEOUT: %w", err))
+		} else {
+			cfg.PreflightTimeout = d
+		}
+	}
+	if version := getenv("DAEMON_PREFLIGHT_VERSION"); version != "" {
+		if _, err := renderPreflightVersion(version, preflightTemplateData{Name: "v2", Height: 1}); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_PREFLIGHT_VERSION: %w", err))
+		} else {
+			cfg.PreflightVersion = version
+		}
+	}
+
+	if retries := getenv("DAEMON_PREUPGRADE_MAX_RETRIES"); retries != "" {
+		if n, err := strconv.Atoi(retries); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_PREUPGRADE_MAX_RETRIES %q: must be a number, 0 or more", retries))
+		} else {
+			cfg.PreUpgradeMaxRetries = n
+		}
+	}
+
+	if backends, err := parseBackupBackends(getenv("DAEMON_BACKUP_BACKENDS")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_BACKUP_BACKENDS: %w", err))
+	} else {
+		cfg.BackupBackends = backends
+	}
+	if dataBackup, err := parseDataBackup(getenv("DAEMON_DATA_BACKUP")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_DATA_BACKUP: %w", err))
+	} else {
+		cfg.DataBackup = dataBackup
+	}
+	// the data backup of the backends tells the rollback, the explanation and the checks
+	// what to expect when DAEMON_DATA_BACKUP leaves it open
+	if cfg.DataBackup == DataBackupNone && getenv("DAEMON_DATA_BACKUP") == "" {
+		for _, key := range cfg.BackupBackends {
+			if isDataBackend(key) {
+				cfg.DataBackup = cfg.backendMode(key)
+				break
+			}
+		}
+	}
+	if dir := getenv("DAEMON_DATA_BACKUP_DIR"); dir != "" && !filepath.IsAbs(dir) {
+		errs = append(errs, errors.New("DAEMON_DATA_BACKUP_DIR must be an absolute path"))
+	} else if dir != "" && insideDir(cfg.DataDir(), dir) {
+		errs = append(errs, errors.New("DAEMON_DATA_BACKUP_DIR must not be inside the data directory"))
+	} else {
+		cfg.DataBackupDir = dir
+	}
+	if dest := getenv("DAEMON_DATA_BACKUP_DEST"); dest != "" {
+		if _, err := parseBackupDest(dest); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_DATA_BACKUP_DEST: %w", err))
+		} else if len(cfg.BackupBackends) == 0 && cfg.DataBackup != DataBackupArchive && cfg.DataBackup != DataBackupSnapshot {
+			errs = append(errs, fmt.Errorf("DAEMON_DATA_BACKUP_DEST streams an archive, DAEMON_DATA_BACKUP must be %s or %s", DataBackupArchive, DataBackupSnapshot))
+		} else if cfg.DataBackupDir != "" {
+			errs = append(errs, errors.New("DAEMON_DATA_BACKUP_DEST and DAEMON_DATA_BACKUP_DIR can't both be set"))
+		} else {
+			cfg.DataBackupDest = dest
+		}
+	}
+	if command := getenv("DAEMON_DATA_BACKUP_SNAPSHOT_CMD"); command != "" {
+		if cfg.DataBackup != DataBackupSnapshot {
+			errs = append(errs, fmt.Errorf("DAEMON_DATA_BACKUP_SNAPSHOT_CMD takes the snapshot backed up, DAEMON_DATA_BACKUP must be %s", DataBackupSnapshot))
+		} else if _, err := renderCommand("snapshot", command, backupTemplateData{}); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_DATA_BACKUP_SNAPSHOT_CMD: %w", err))
+		} else {
+			cfg.DataBackupSnapshotCommand = command
+		}
+	}
+	if name := getenv("DAEMON_DATA_BACKUP_NAME"); name != "" {
+		sample := backupTemplateData{Name: "v2", Height: 1, Time: FormatTimestamp(time.Time{})}
+		if _, err := renderDataBackupName(name, sample); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_DATA_BACKUP_NAME: %w", err))
+		} else {
+			cfg.DataBackupName = name
+		}
+	}
+	if exclude, err := parseBackupExclude(getenv("DAEMON_DATA_BACKUP_EXCLUDE")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_DATA_BACKUP_EXCLUDE: %w", err))
+	} else {
+		cfg.DataBackupExclude = exclude
+	}
+	if check, err := parseSpaceCheck(getenv("DAEMON_DATA_BACKUP_SPACE_CHECK")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_DATA_BACKUP_SPACE_CHECK: %w", err))
+	} else {
+		cfg.BackupSpaceCheck = check
+	}
+	if keep := getenv("DAEMON_BACKUP_KEEP_RECENT"); keep != "" {
+		if n, err := strconv.Atoi(keep); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_BACKUP_KEEP_RECENT %q: must be a number, 0 or more", keep))
+		} else {
+			cfg.BackupKeepRecent = n
+		}
+	}
+	if age := getenv("DAEMON_BACKUP_MAX_AGE"); age != "" {
+		if d, err := parseGraceDuration(age); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_BACKUP_MAX_AGE: %w", err))
+		} else {
+			cfg.BackupMaxAge = d
+		}
+	}
+	if keep := getenv("DAEMON_UPGRADES_KEEP_RECENT"); keep != "" {
+		if n, err := strconv.Atoi(keep); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_UPGRADES_KEEP_RECENT %q: must be a number, 0 or more", keep))
+		} else {
+			cfg.UpgradesKeepRecent = n
+		}
+	}
+	cfg.BackupCommand = getenv("DAEMON_BACKUP_CMD")
+	if containsString(cfg.BackupBackends, BackendRemote) && getenv("DAEMON_DATA_BACKUP_DEST") == "" {
+		errs = append(errs, fmt.Errorf("DAEMON_BACKUP_BACKENDS lists %s, DAEMON_DATA_BACKUP_DEST must be set", BackendRemote))
+	} else if len(cfg.BackupBackends) > 0 && !containsString(cfg.BackupBackends, BackendRemote) && cfg.DataBackupDest != "" {
+		errs = append(errs, fmt.Errorf("DAEMON_DATA_BACKUP_DEST is set, DAEMON_BACKUP_BACKENDS must list %s", BackendRemote))
+	}
+	if containsString(cfg.BackupBackends, BackendCommand) && cfg.BackupCommand == "" {
+		errs = append(errs, fmt.Errorf("DAEMON_BACKUP_BACKENDS lists %s, DAEMON_BACKUP_CMD must be set", BackendCommand))
+	} else if len(cfg.BackupBackends) > 0 && !containsString(cfg.BackupBackends, BackendCommand) && cfg.BackupCommand != "" {
+		errs = append(errs, fmt.Errorf("DAEMON_BACKUP_CMD is set, DAEMON_BACKUP_BACKENDS must list %s", BackendCommand))
+	}
+	if schedule, err := parseBackupSchedule(getenv("DAEMON_BACKUP_SCHEDULE")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_BACKUP_SCHEDULE: %w", err))
+	} else if schedule != nil && len(cfg.backupBackendKeys()) == 0 {
+		errs = append(errs, errors.New("DAEMON_BACKUP_SCHEDULE is set without DAEMON_DATA_BACKUP or DAEMON_BACKUP_CMD"))
+	} else {
+		cfg.BackupSchedule = schedule
+	}
+	if hook := getenv("DAEMON_POST_UPGRADE_HOOK"); hook != "" && !filepath.IsAbs(hook) {
+		errs = append(errs, errors.New("DAEMON_POST_UPGRADE_HOOK must be an absolute path"))
+	} else {
+		cfg.PostUpgradeHook = hook
+	}
+	if timeout := getenv("DAEMON_POST_UPGRADE_HOOK_TIMEOUT"); timeout != "" {
+		if d, err := parseGraceDuration(timeout); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_POST_UPGRADE_HOOK_TIMEOUT: %w", err))
+		} else {
+			cfg.PostUpgradeHookTimeout = d
+		}
+	}
+
+	cfg.SignerPauseCommand = getenv("DAEMON_SIGNER_PAUSE_CMD")
+	cfg.SignerResumeCommand = getenv("DAEMON_SIGNER_RESUME_CMD")
+	if (cfg.SignerPauseCommand == "") != (cfg.SignerResumeCommand == "") {
+		errs = append(errs, errors.New("DAEMON_SIGNER_PAUSE_CMD and DAEMON_SIGNER_RESUME_CMD must be set together, a paused signer would never be resumed"))
+	}
+	if timeout := getenv("DAEMON_SIGNER_TIMEOUT"); timeout != "" {
+		if d, err := parseGraceDuration(timeout); err != nil || d == 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_SIGNER_TIMEOUT %q: must be a positive duration", timeout))
+		} else {
+			cfg.SignerTimeout = d
+		}
+	}
+
+	if allow, err := parseEnvAllow(getenv("DAEMON_CHILD_ENV_ALLOW")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_CHILD_ENV_ALLOW: %w", err))
+	} else {
+		cfg.ChildEnvAllow = allow
+	}
+
+	cfg.ExtraArgs = strings.Fields(getenv("DAEMON_EXTRA_ARGS"))
+	if commands := getenv("DAEMON_SUPERVISED_COMMANDS"); commands != "" {
+		for _, command := range strings.Split(commands, ",") {
+			if command = strings.TrimSpace(command); command != "" {
+				cfg.SupervisedCommands = append(cfg.SupervisedCommands, command)
+			}
+		}
+	}
+
+	if reloadSignal, err := parseReloadSignal(getenv("DAEMON_RELOAD_SIGNAL")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_RELOAD_SIGNAL: %w", err))
+	} else {
+		cfg.ReloadSignal = reloadSignal
+	}
+
+	if pauseSignal, err := parsePauseSignal(getenv("DAEMON_PAUSE_SIGNAL")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_PAUSE_SIGNAL: %w", err))
+	} else {
+		cfg.PauseSignal = pauseSignal
+	}
+
+	if stopSignal, err := parseStopSignal(getenv("DAEMON_STOP_SIGNAL")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_STOP_SIGNAL: %w", err))
+	} else if stopSignal != 0 && stopSignal == cfg.ReloadSignal {
+		errs = append(errs, fmt.Errorf("DAEMON_STOP_SIGNAL and DAEMON_RELOAD_SIGNAL are both %s", signalName(stopSignal)))
+	} else {
+		cfg.StopSignal = stopSignal
+	}
+
+	if crashPolicy, err := parseCrashChildPolicy(getenv("DAEMON_CRASH_CHILD_POLICY")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_CRASH_CHILD_POLICY: %w", err))
+	} else {
+		cfg.CrashChildPolicy = crashPolicy
+	}
+
+	if mode, err := parseInitMode(getenv(InitEnv)); err != nil {
+		errs = append(errs, fmt.Errorf("invalid %s: %w", InitEnv, err))
+	} else {
+		cfg.Init = mode
+	}
+
+	if getenv("DAEMON_INJECT_HOME") == "true" {
+		cfg.InjectHome = true
+	}
+
+	if getenv("DAEMON_STRICT_HEIGHT_CHECK") == "true" {
+		cfg.StrictHeightCheck = true
+	}
+	if getenv("DAEMON_VALIDATOR_STATE_CHECK") == "true" {
+		cfg.ValidatorStateCheck = true
+	}
+
+	if skip, err := parseSkipUpgrades(getenv("DAEMON_SKIP_UPGRADES")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_SKIP_UPGRADES: %w", err))
+	} else {
+		cfg.SkipUpgrades = skip
+	}
+
+	if runAs := getenv("DAEMON_RUN_AS"); runAs != "" {
+		if _, err := lookupOwner(runAs); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_RUN_AS: %w", err))
+		} else {
+			cfg.RunAs = runAs
+		}
+	}
+	if getenv("DAEMON_DROP_PRIVILEGES") == "true" {
+		switch {
+		case runtime.GOOS == "windows":
+			errs = append(errs, errors.New("DAEMON_DROP_PRIVILEGES is not supported on windows"))
+		case cfg.RunAs == "":
+			errs = append(errs, errors.New("DAEMON_DROP_PRIVILEGES requires DAEMON_RUN_AS, the user to launch the daemon as"))
+		default:
+			cfg.DropPrivileges = true
+		}
+	}
+	if root := getenv("DAEMON_WRITABLE_ROOT"); root != "" && !filepath.IsAbs(root) {
+		errs = append(errs, errors.New("DAEMON_WRITABLE_ROOT must be an absolute path"))
+	} else {
+		cfg.WritableRoot = root
+	}
+	for env, dir := range map[string]*string{"DAEMON_GENESIS_DIR": &cfg.GenesisDir, "DAEMON_UPGRADES_DIR": &cfg.UpgradesDir, "DAEMON_CURRENT_LINK": &cfg.CurrentLink,
+		"DAEMON_STATE_DIR": &cfg.StatePath, "DAEMON_TMP_DIR": &cfg.TmpDir, "DAEMON_WORK_DIR": &cfg.WorkDir, "DAEMON_DOWNLOAD_STAGING_DIR": &cfg.DownloadStagingDir} {
+		if path := getenv(env); path != "" && !filepath.IsAbs(path) {
+			errs = append(errs, fmt.Errorf("%s must be an absolute path", env))
+		} else if path != "" {
+			*dir = filepath.Clean(path)
+		}
+	}
+
+	cfg.NotifyWebhook = getenv("DAEMON_NOTIFY_WEBHOOK")
+	if interval := getenv("DAEMON_NOTIFY_INTERVAL"); interval != "" {
+		if d, err := parseGraceDuration(interval); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_NOTIFY_INTERVAL: %w", err))
+		} else {
+			cfg.NotifyInterval = d
+		}
+	}
+	if smtpServer := getenv("DAEMON_NOTIFY_SMTP"); smtpServer != "" {
+		if _, err := parseSMTPServer(smtpServer); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_NOTIFY_SMTP: %w", err))
+		} else {
+			cfg.NotifySMTP = smtpServer
+		}
+	}
+	cfg.NotifyEmailFrom = getenv("DAEMON_NOTIFY_EMAIL_FROM")
+	cfg.NotifyEmailTo = splitEmailList(getenv("DAEMON_NOTIFY_EMAIL_TO"))
+	cfg.NotifyEmailEvents = splitEmailList(getenv("DAEMON_NOTIFY_EMAIL_EVENTS"))
+	cfg.NotifyEmailSubject = getenv("DAEMON_NOTIFY_EMAIL_SUBJECT")
+	if path := getenv("DAEMON_NOTIFY_EMAIL_TEMPLATE"); path != "" && !filepath.IsAbs(path) {
+		errs = append(errs, errors.New("DAEMON_NOTIFY_EMAIL_TEMPLATE must be an absolute path"))
+	} else {
+		cfg.NotifyEmailTemplate = path
+	}
+	for _, address := range append([]string{cfg.NotifyEmailFrom}, cfg.NotifyEmailTo...) {
+		if _, err := mail.ParseAddress(address); address != "" && err != nil {
+			errs = append(errs, fmt.Errorf("invalid email address %q: %w", address, err))
+		}
+	}
+	if cfg.NotifySMTP != "" {
+		if cfg.NotifyEmailFrom == "" || len(cfg.NotifyEmailTo) == 0 {
+			errs = append(errs, errors.New("DAEMON_NOTIFY_SMTP needs DAEMON_NOTIFY_EMAIL_FROM and DAEMON_NOTIFY_EMAIL_TO"))
+		}
+		if _, _, err := cfg.emailTemplates(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %w", err))
+		}
+	}
+
+	if getenv("DAEMON_OUTPUT_PREFIX") == "true" {
+		cfg.OutputPrefix = true
+	}
+	if file := getenv("DAEMON_OUTPUT_FILE"); file != "" && !filepath.IsAbs(file) {
+		errs = append(errs, errors.New("DAEMON_OUTPUT_FILE must be an absolute path"))
+	} else {
+		cfg.OutputFile = file
+	}
+	if dir := getenv("DAEMON_OUTPUT_DIR"); dir != "" && !filepath.IsAbs(dir) {
+		errs = append(errs, errors.New("DAEMON_OUTPUT_DIR must be an absolute path"))
+	} else {
+		cfg.OutputDir = dir
+	}
+	if size := getenv("DAEMON_OUTPUT_ROTATE_SIZE"); size != "" {
+		if n, err := strconv.Atoi(size); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_OUTPUT_ROTATE_SIZE %q: must be a number of MiB, 0 or more", size))
+		} else {
+			cfg.OutputRotateSize = int64(n) * 1024 * 1024
+		}
+	}
+	if interval := getenv("DAEMON_OUTPUT_ROTATE_INTERVAL"); interval != "" {
+		if d, err := parseGraceDuration(interval); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_OUTPUT_ROTATE_INTERVAL: %w", err))
+		} else {
+			cfg.OutputRotateInterval = d
+		}
+	}
+	if keep := getenv("DAEMON_OUTPUT_KEEP_RECENT"); keep != "" {
+		if n, err := strconv.Atoi(keep); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_OUTPUT_KEEP_RECENT %q: must be a number, 0 or more", keep))
+		} else {
+			cfg.OutputKeepRecent = n
+		}
+	}
+	if age := getenv("DAEMON_OUTPUT_MAX_AGE"); age != "" {
+		if d, err := parseGraceDuration(age); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_OUTPUT_MAX_AGE: %w", err))
+		} else {
+			cfg.OutputMaxAge = d
+		}
+	}
+	if getenv("DAEMON_OUTPUT_COMPRESS") == "true" {
+		cfg.OutputCompress = true
+	}
+	if cfg.OutputFile == "" && (cfg.OutputRotateSize > 0 || cfg.OutputRotateInterval > 0) {
+		errs = append(errs, errors.New("DAEMON_OUTPUT_ROTATE_SIZE and DAEMON_OUTPUT_ROTATE_INTERVAL rotate the output file, DAEMON_OUTPUT_FILE must be set"))
+	}
+
+	if addr := getenv("DAEMON_METRICS_ADDR"); addr != "" {
+		if err := validHTTPAddr(addr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_METRICS_ADDR: %w", err))
+		} else {
+			cfg.MetricsAddr = addr
+		}
+	}
+	if push := getenv("DAEMON_METRICS_PUSH_URL"); push != "" {
+		if err := validPushURL(push); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_METRICS_PUSH_URL: %w", err))
+		} else {
+			cfg.MetricsPushURL = push
+		}
+	}
+	if interval := getenv("DAEMON_METRICS_PUSH_INTERVAL"); interval != "" {
+		if d, err := parseGraceDuration(interval); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_METRICS_PUSH_INTERVAL %q: must be a positive duration", interval))
+		} else {
+			cfg.MetricsPushInterval = d
+		}
+	}
+	cfg.MetricsPushInstance = getenv("DAEMON_METRICS_PUSH_INSTANCE")
+	if addr := getenv("DAEMON_HEALTH_ADDR"); addr != "" {
+		if err := validHTTPAddr(addr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DAEMON_HEALTH_ADDR: %w", err))
+		} else {
+			cfg.HealthAddr = addr
+		}
+	}
+	if socket := getenv("DAEMON_ADMIN_SOCKET"); socket != "" && !filepath.IsAbs(socket) {
+		errs = append(errs, errors.New("DAEMON_ADMIN_SOCKET must be an absolute path"))
+	} else {
+		cfg.AdminSocket = socket
+	}
+
+	if level, err := parseLogLevel(getenv("DAEMON_LOG_LEVEL")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_LOG_LEVEL: %w", err))
+	} else {
+		cfg.LogLevel = level
+	}
+	if format, err := parseLogFormat(getenv("DAEMON_LOG_FORMAT")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DAEMON_LOG_FORMAT: %w", err))
+	} else {
+		cfg.LogFormat = format
+	}
+
+	if cfg.HaltAfterUpgrade == HaltPause && cfg.AdminSocket == "" && cfg.PauseSignal == 0 {
+		errs = append(errs, fmt.Errorf("DAEMON_HALT_AFTER_UPGRADE=%s needs DAEMON_ADMIN_SOCKET or DAEMON_PAUSE_SIGNAL to resume", HaltPause))
+	}
+
+	if cfg.UpgradeDetection == DetectChain && cfg.PlanAPI == "" {
+		errs = append(errs, fmt.Errorf("DAEMON_UPGRADE_DETECTION=%s polls the plan of the chain, DAEMON_PLAN_API must be set", DetectChain))
+	}
+
+	if len(cfg.PreUpgradeActions) > 0 && cfg.actionsAPI() == "" {
+		errs = append(errs, errors.New("DAEMON_PRE_UPGRADE_ACTIONS count down to the plan of the chain, DAEMON_PREDOWNLOAD_API or DAEMON_PLAN_API must be set"))
+	}
+
+	if cfg.VerifyUpgrade && cfg.PlanAPI == "" {
+		errs = append(errs, errors.New("DAEMON_VERIFY_UPGRADE asks x/upgrade for the applied upgrade, DAEMON_PLAN_API must be set"))
+	}
+
+	if cfg.HealthGateOnFailure == HealthGateRollback && cfg.rollback() == RollbackOff {
+		errs = append(errs, fmt.Errorf("DAEMON_HEALTH_GATE_ON_FAILURE=%s rolls back as DAEMON_ROLLBACK says, DAEMON_ROLLBACK must be set", HealthGateRollback))
+	}
+
+	if cfg.Rollback == RollbackFull && cfg.dataBackup() == DataBackupNone {
+		errs = append(errs, errors.New("DAEMON_ROLLBACK=full restores the data backup of the upgrade, DAEMON_DATA_BACKUP must be set"))
+	}
+	if cfg.Rollback == RollbackFull && cfg.dataBackup() == DataBackupSnapshot {
+		errs = append(errs, errors.New("DAEMON_ROLLBACK=full restores the data directory, a snapshot backup can't be restored in place"))
+	}
+	if cfg.Rollback == RollbackFull && cfg.DataBackupDest != "" {
+		errs = append(errs, errors.New("DAEMON_ROLLBACK=full restores a local data backup, DAEMON_DATA_BACKUP_DEST can't be set"))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return cfg, errs
+}
+
+// Validate returns an error if this config is invalid, e.g. one built without GetConfigFromEnv.
+// it enforces Home/cosmovisor is a valid directory and exists,
+// and that Name is set
+func (cfg *Config) Validate() error {
+	if err := cfg.validateNames(); err != nil {
+		return err
 	}
 
 	// ensure the root directory exists
@@ -148,3 +1422,20 @@ func (cfg *Config) validate() error {
 
 	return nil
 }
+
+// validateNames is Validate for a home that doesn't exist yet
+func (cfg *Config) validateNames() error {
+	if cfg.Name == "" {
+		return errors.New("DAEMON_NAME is not set")
+	}
+
+	if cfg.Home == "" {
+		return errors.New("DAEMON_HOME is not set")
+	}
+
+	if !filepath.IsAbs(cfg.Home) {
+		return errors.New("DAEMON_HOME must be an absolute path")
+	}
+
+	return nil
+}
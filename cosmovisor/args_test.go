@@ -47,7 +47,16 @@ func (s *argsTestSuite) TestConfigPaths() {
 	}
 }
 
-// Test validate
+// Test Validate
+func (s *argsTestSuite) TestValidateUpgradeName() {
+	for _, name := range []string{"chain2", "some spaces", "v1.0/rc1", "ünïcode"} {
+		s.Require().NoError(ValidateUpgradeName(name), name)
+	}
+	for _, name := range []string{"", "  ", ".", "..", "chain\n2", "chain\x002"} {
+		s.Require().Error(ValidateUpgradeName(name), "%q", name)
+	}
+}
+
 func (s *argsTestSuite) TestValidate() {
 	relPath := filepath.Join("testdata", "validate")
 	absPath, err := filepath.Abs(relPath)
@@ -91,7 +100,7 @@ func (s *argsTestSuite) TestValidate() {
 	}
 
 	for _, tc := range cases {
-		err := tc.cfg.validate()
+		err := tc.cfg.Validate()
 		if tc.valid {
 			s.Require().NoError(err)
 		} else {
@@ -106,7 +115,7 @@ func (s *argsTestSuite) TestEnsureBin() {
 	s.Require().NoError(err)
 
 	cfg := Config{Home: absPath, Name: "dummyd"}
-	s.Require().NoError(cfg.validate())
+	s.Require().NoError(cfg.Validate())
 
 	s.Require().NoError(EnsureBinary(cfg.GenesisBin()))
 
@@ -0,0 +1,124 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// backupTemplateData is available to the backup command template
+type backupTemplateData struct {
+	Home    string
+	DataDir string
+	Name    string
+	Height  int64
+	// Time is when the backup starts, as a UTC timestamp usable in snapshot names
+	Time string
+}
+
+// backupArgs renders the configured backup command for the upgrade
+func (cfg *Config) backupArgs(info *UpgradeInfo) ([]string, error) {
+	data := backupTemplateData{
+		Home:    cfg.Home,
+		DataDir: cfg.DataDir(),
+		Name:    info.Name,
+		Height:  info.Height,
+		Time:    FormatTimestamp(NowUTC()),
+	}
+	args, err := renderCommand("backup", cfg.BackupCommand, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty backup command")
+	}
+	return args, nil
+}
+
+// backupBeforeSwitch backs up the node while the daemon is stopped, before anything of the
+// upgrade touches it: the pre-backup hooks run, then each backup backend in turn, see
+// backupBackendKeys. Filesystem snapshots taken by the backup command are much faster than
+// copying a large data directory. A failed backup fails the upgrade, the old binary stays
+// current, and the backends after it don't run.
+func (cfg *Config) backupBeforeSwitch(plan *UpgradePlan, timings *UpgradeTimings) error {
+	// a reload of the backup settings waits for the backup
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	keys := cfg.backupBackendKeys()
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := cfg.runHooks(HookPreBackup, cfg.upgradeEnv(plan)); err != nil {
+		return err
+	}
+	var stats *BackupStats
+	for _, key := range keys {
+		backend, err := cfg.backupBackend(key)
+		if err != nil {
+			return err
+		}
+		// the data backups are timed apart from the other backups, as they were before the
+		// backends could be chosen
+		var phase *PhaseTiming
+		if isDataBackend(key) {
+			phase = timings.Phase("data-backup")
+			phase.Set("mode", string(cfg.backendMode(key)))
+		} else {
+			phase = timings.Phase("backup")
+		}
+		phase.Set("backend", backend.Name())
+		err = backend.Backup(plan, phase)
+		if err != nil && isDataBackend(key) {
+			err = fmt.Errorf("backing up the data directory: %w", err)
+		} else if err != nil {
+			err = fmt.Errorf("backup: %w", err)
+		}
+		phase.End(err)
+		if err != nil {
+			return err
+		}
+		if s := backupStatsOf(phase); s != nil {
+			metrics.dataBackedUp(s)
+			if stats == nil {
+				stats = s
+			}
+		}
+	}
+	msg := fmt.Sprintf("backed up the node at height %d", plan.Info.Height)
+	fields := map[string]string{"data_backup": string(cfg.dataBackup()), "backup_command": strconv.FormatBool(containsString(keys, BackendCommand)),
+		"backends": strings.Join(keys, ",")}
+	if stats != nil {
+		msg += ", " + stats.String()
+		fields["duration_seconds"] = strconv.FormatFloat(stats.DurationSeconds, 'f', 3, 64)
+		fields["data_bytes"] = strconv.FormatInt(stats.DataBytes, 10)
+		fields["bytes"] = strconv.FormatInt(stats.Bytes, 10)
+		fields["compression_ratio"] = strconv.FormatFloat(stats.CompressionRatio, 'f', 3, 64)
+		fields["destination"] = stats.Destination
+	}
+	completed := NewEvent(EventBackupCompleted, plan.Info.Name, msg)
+	completed.Height = plan.Info.Height
+	completed.Fields = fields
+	recordEvent(cfg, completed)
+	return nil
+}
+
+// runBackup runs the backup command for the plan, with the upgrade in its environment
+func (cfg *Config) runBackup(plan *UpgradePlan) error {
+	args, err := cfg.backupArgs(plan.Info)
+	if err != nil {
+		return err
+	}
+	logger.Infof("backing up with %s", strings.Join(args, " "))
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = cfg.upgradeEnv(plan)
+	out, err := cmd.CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", strings.Join(args, " "), err, output)
+	}
+	if output != "" {
+		logger.Infof("%s: %s", args[0], output)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupBeforeSwitch(t *testing.T) {
+	home := validateHome(t)
+	snapshot := filepath.Join(home, "snapshot.sh")
+	out := filepath.Join(home, "snapshots")
+	script := "#!/bin/sh\n[ -n \"$FAIL\" ] && { echo no space left >&2; exit 1; }\necho \"$@ $COSMOVISOR_UPGRADE_NAME\" >> " + out + "\n"
+	require.NoError(t, ioutil.WriteFile(snapshot, []byte(script), 0755))
+	cfg := &Config{Home: home, Name: "dummyd", BackupCommand: snapshot + " {{.DataDir}} {{.Name}}@{{.Height}}"}
+
+	// a failed backup leaves the old binary current
+	setenv(t, "FAIL", "1")
+	err := DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "backup: ")
+	require.Contains(t, err.Error(), "no space left")
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.GenesisBin(), bin)
+
+	setenv(t, "FAIL", "")
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49}))
+	snapshots, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, cfg.DataDir()+" chain2@49 chain2\n", string(snapshots))
+	bin, err = cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.UpgradeBin("chain2"), bin)
+}
+
+func TestBackupArgs(t *testing.T) {
+	cfg := &Config{Home: "/node", BackupCommand: "restic backup {{.DataDir}} --tag {{.Name}}"}
+	args, err := cfg.backupArgs(&UpgradeInfo{Name: "v2", Height: 100})
+	require.NoError(t, err)
+	require.Equal(t, []string{"restic", "backup", "/node/data", "--tag", "v2"}, args)
+
+	cfg.BackupCommand = "zfs snapshot tank@{{.Upgrade}}"
+	_, err = cfg.backupArgs(&UpgradeInfo{Name: "v2"})
+	require.Error(t, err)
+	cfg.BackupCommand = " "
+	_, err = cfg.backupArgs(&UpgradeInfo{Name: "v2"})
+	require.EqualError(t, err, "empty backup command")
+}
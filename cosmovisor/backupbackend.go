@@ -0,0 +1,205 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// The names of the built-in backup backends in DAEMON_BACKUP_BACKENDS
+const (
+	// BackendCopy copies the data directory file by file to DAEMON_DATA_BACKUP_DIR
+	BackendCopy = string(DataBackupCopy)
+	// BackendArchive writes a zstd compressed tar archive of the data directory to
+	// DAEMON_DATA_BACKUP_DIR
+	BackendArchive = string(DataBackupArchive)
+	// BackendSnapshot archives the newest state sync snapshot to DAEMON_DATA_BACKUP_DIR
+	BackendSnapshot = string(DataBackupSnapshot)
+	// BackendRemote streams the archive to the object storage of DAEMON_DATA_BACKUP_DEST
+	BackendRemote = "remote"
+	// BackendCommand runs DAEMON_BACKUP_CMD, e.g. a filesystem snapshot
+	BackendCommand = "command"
+)
+
+// defaultBackupBackends describes the backends run when DAEMON_BACKUP_BACKENDS is unset
+const defaultBackupBackends = "from DAEMON_DATA_BACKUP, DAEMON_DATA_BACKUP_DEST and DAEMON_BACKUP_CMD"
+
+// builtinBackends are the built-in backup backends
+var builtinBackends = []string{BackendCopy, BackendArchive, BackendSnapshot, BackendRemote, BackendCommand}
+
+// BackupBackend backs up the node before an upgrade, while the daemon is stopped: a built-in
+// one, or a backend added with RegisterBackupBackend
+type BackupBackend interface {
+	// Name describes the backend in the logs
+	Name() string
+	// Backup backs up the node for the plan. phase times it, the backend may set attributes
+	// of it such as the path of the backup. A failure fails the upgrade.
+	Backup(plan *UpgradePlan, phase *PhaseTiming) error
+}
+
+var backupBackends struct {
+	mutex    sync.Mutex
+	backends []registeredBackend
+}
+
+// registeredBackend is a backend added with RegisterBackupBackend
+type registeredBackend struct {
+	key        string
+	newBackend func(*Config) BackupBackend
+}
+
+// RegisterBackupBackend adds a backup backend, typically from an init function. newBackend
+// returns the backend for the config the upgrade runs with. It runs where key is listed in
+// DAEMON_BACKUP_BACKENDS, which only accepts it once it is added.
+func RegisterBackupBackend(key string, newBackend func(cfg *Config) BackupBackend) {
+	backupBackends.mutex.Lock()
+	defer backupBackends.mutex.Unlock()
+	backupBackends.backends = append(backupBackends.backends, registeredBackend{key: strings.ToLower(key), newBackend: newBackend})
+}
+
+// lookupBackupBackend returns the backend added as key, if any
+func lookupBackupBackend(key string) (registeredBackend, bool) {
+	backupBackends.mutex.Lock()
+	defer backupBackends.mutex.Unlock()
+	for _, r := range backupBackends.backends {
+		if r.key == key {
+			return r, true
+		}
+	}
+	return registeredBackend{}, false
+}
+
+// registeredBackendKeys are the keys of the backends added with RegisterBackupBackend
+func registeredBackendKeys() []string {
+	backupBackends.mutex.Lock()
+	defer backupBackends.mutex.Unlock()
+	keys := make([]string, len(backupBackends.backends))
+	for i, r := range backupBackends.backends {
+		keys[i] = r.key
+	}
+	return keys
+}
+
+// parseBackupBackends validates the value of DAEMON_BACKUP_BACKENDS, the comma separated
+// backends run before an upgrade, in order
+func parseBackupBackends(s string) ([]string, error) {
+	known := append(append([]string(nil), builtinBackends...), registeredBackendKeys()...)
+	var keys []string
+	for _, key := range strings.Split(s, ",") {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			continue
+		}
+		if !containsString(known, key) {
+			return nil, fmt.Errorf("unknown backup backend %q, must be one of %s", key, strings.Join(known, ", "))
+		}
+		if containsString(keys, key) {
+			return nil, fmt.Errorf("backup backend %q is listed twice", key)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// backupBackendKeys are the backends run before an upgrade: BackupBackends, or else the data
+// backup of DAEMON_DATA_BACKUP, streamed if DAEMON_DATA_BACKUP_DEST is set, then the backup
+// command
+func (cfg *Config) backupBackendKeys() []string {
+	if len(cfg.BackupBackends) > 0 {
+		return cfg.BackupBackends
+	}
+	var keys []string
+	switch {
+	case cfg.dataBackup() == DataBackupNone:
+	case cfg.DataBackupDest != "":
+		keys = append(keys, BackendRemote)
+	default:
+		keys = append(keys, string(cfg.dataBackup()))
+	}
+	if cfg.BackupCommand != "" {
+		keys = append(keys, BackendCommand)
+	}
+	return keys
+}
+
+// isDataBackend returns true for the built-in backends backing up the data directory, which
+// record the stats of the backup
+func isDataBackend(key string) bool {
+	return key == BackendCopy || key == BackendArchive || key == BackendSnapshot || key == BackendRemote
+}
+
+// backendMode is the data backup the built-in data backend key makes: the remote backend
+// streams the archive of the newest state sync snapshot if DAEMON_DATA_BACKUP is snapshot,
+// else that of the data directory
+func (cfg *Config) backendMode(key string) DataBackup {
+	if key != BackendRemote {
+		return DataBackup(key)
+	}
+	if cfg.dataBackup() == DataBackupSnapshot {
+		return DataBackupSnapshot
+	}
+	return DataBackupArchive
+}
+
+// backupBackend returns the backend of key
+func (cfg *Config) backupBackend(key string) (BackupBackend, error) {
+	switch key {
+	case BackendCopy, BackendArchive, BackendSnapshot:
+		return localBackend{cfg: cfg, mode: DataBackup(key)}, nil
+	case BackendRemote:
+		return remoteBackend{cfg: cfg}, nil
+	case BackendCommand:
+		return commandBackend{cfg: cfg}, nil
+	}
+	if r, ok := lookupBackupBackend(key); ok {
+		if b := r.newBackend(cfg); b != nil {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("backup backend %q is not registered", key)
+}
+
+// localBackend writes a data backup to DAEMON_DATA_BACKUP_DIR
+type localBackend struct {
+	cfg  *Config
+	mode DataBackup
+}
+
+func (b localBackend) Name() string { return string(b.mode) }
+
+func (b localBackend) Backup(plan *UpgradePlan, phase *PhaseTiming) error {
+	if b.mode == DataBackupSnapshot && b.cfg.DataBackupSnapshotCommand != "" {
+		if err := b.cfg.takeSnapshot(plan); err != nil {
+			return err
+		}
+	}
+	return b.cfg.localDataBackup(plan.Info, phase, b.mode)
+}
+
+// remoteBackend streams a data backup to DAEMON_DATA_BACKUP_DEST, see backendMode
+type remoteBackend struct {
+	cfg *Config
+}
+
+func (b remoteBackend) Name() string { return BackendRemote }
+
+func (b remoteBackend) Backup(plan *UpgradePlan, phase *PhaseTiming) error {
+	mode := b.cfg.backendMode(BackendRemote)
+	if mode == DataBackupSnapshot && b.cfg.DataBackupSnapshotCommand != "" {
+		if err := b.cfg.takeSnapshot(plan); err != nil {
+			return err
+		}
+	}
+	return b.cfg.streamDataBackup(plan.Info, phase, mode)
+}
+
+// commandBackend runs DAEMON_BACKUP_CMD
+type commandBackend struct {
+	cfg *Config
+}
+
+func (b commandBackend) Name() string { return BackendCommand }
+
+func (b commandBackend) Backup(plan *UpgradePlan, _ *PhaseTiming) error {
+	return b.cfg.runBackup(plan)
+}
@@ -0,0 +1,123 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingBackend records the upgrades it backed up, and fails with err
+type recordingBackend struct {
+	backups *[]string
+	err     error
+}
+
+func (b recordingBackend) Name() string { return "recording" }
+
+func (b recordingBackend) Backup(plan *UpgradePlan, phase *PhaseTiming) error {
+	*b.backups = append(*b.backups, plan.Info.Name)
+	phase.Set("path", "vault://"+plan.Info.Name)
+	return b.err
+}
+
+func TestParseBackupBackends(t *testing.T) {
+	cases := map[string]struct {
+		s    string
+		keys []string
+		err  string
+	}{
+		"empty":     {s: ""},
+		"in order":  {s: "command, Archive,remote", keys: []string{BackendCommand, BackendArchive, BackendRemote}},
+		"unknown":   {s: "archive,tape", err: `unknown backup backend "tape"`},
+		"twice":     {s: "copy,copy", err: `backup backend "copy" is listed twice`},
+		"separator": {s: "snapshot,,", keys: []string{BackendSnapshot}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			keys, err := parseBackupBackends(tc.s)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.keys, keys)
+		})
+	}
+}
+
+func TestBackupBackendKeys(t *testing.T) {
+	cases := map[string]struct {
+		cfg  Config
+		keys []string
+	}{
+		"none":              {},
+		"data backup":       {cfg: Config{DataBackup: DataBackupCopy}, keys: []string{BackendCopy}},
+		"streamed":          {cfg: Config{DataBackup: DataBackupArchive, DataBackupDest: "s3://backups"}, keys: []string{BackendRemote}},
+		"command":           {cfg: Config{BackupCommand: "zfs snapshot tank"}, keys: []string{BackendCommand}},
+		"data then command": {cfg: Config{DataBackup: DataBackupSnapshot, BackupCommand: "zfs snapshot tank"}, keys: []string{BackendSnapshot, BackendCommand}},
+		"chosen":            {cfg: Config{DataBackup: DataBackupCopy, BackupBackends: []string{BackendArchive}}, keys: []string{BackendArchive}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.keys, tc.cfg.backupBackendKeys())
+		})
+	}
+}
+
+func TestBackupBackends(t *testing.T) {
+	var backups []string
+	var fail error
+	RegisterBackupBackend("Vault", func(cfg *Config) BackupBackend {
+		if cfg.DataBackupName == "off" {
+			return nil
+		}
+		return recordingBackend{backups: &backups, err: fail}
+	})
+	defer func() { backupBackends.backends = nil }()
+
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", DataBackupName: "{{.Name}}", BackupBackends: []string{BackendCopy, BackendArchive, "vault"}}
+	require.NoError(t, os.MkdirAll(filepath.Join(cfg.DataDir(), "application.db"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "application.db", "000001.ldb"), []byte("state"), 0644))
+	timings := NewUpgradeTimings("v2")
+	require.NoError(t, cfg.backupBeforeSwitch(&UpgradePlan{Info: &UpgradeInfo{Name: "v2", Height: 100}}, timings))
+
+	// each backend backed up the node, in order, and the data backups are timed as such
+	require.DirExists(t, filepath.Join(cfg.dataBackupDir(), "v2"))
+	entries := readArchive(t, filepath.Join(cfg.dataBackupDir(), "v2"+dataArchiveExt))
+	require.Equal(t, "state", entries["data/application.db/000001.ldb"])
+	require.Equal(t, []string{"v2"}, backups)
+	require.Len(t, timings.Phases, 3)
+	for i, p := range []struct{ name, backend, mode string }{{"data-backup", "copy", "copy"}, {"data-backup", "archive", "archive"}, {"backup", "recording", ""}} {
+		require.Equal(t, p.name, timings.Phases[i].Name)
+		require.Equal(t, p.backend, timings.Phases[i].Attributes["backend"])
+		require.Equal(t, p.mode, timings.Phases[i].Attributes["mode"])
+	}
+	require.Equal(t, "vault://v2", timings.Phases[2].Attributes["path"])
+	records, err := cfg.dataBackups()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	// a failed backend fails the upgrade, the backends after it don't run
+	backups = nil
+	cfg.BackupBackends = []string{"vault", BackendArchive}
+	fail = errors.New("the vault is sealed")
+	err = cfg.backupBeforeSwitch(&UpgradePlan{Info: &UpgradeInfo{Name: "v3", Height: 200}}, NewUpgradeTimings("v3"))
+	require.Error(t, err)
+	require.True(t, errors.Is(err, fail))
+	require.Equal(t, "backup: the vault is sealed", err.Error())
+	require.Equal(t, []string{"v3"}, backups)
+	require.NoFileExists(t, filepath.Join(cfg.dataBackupDir(), "v3"+dataArchiveExt))
+
+	// a registered backend can refuse a config
+	cfg.DataBackupName = "off"
+	require.EqualError(t, cfg.backupBeforeSwitch(&UpgradePlan{Info: &UpgradeInfo{Name: "v4", Height: 300}}, NewUpgradeTimings("v4")),
+		`backup backend "vault" is not registered`)
+}
@@ -0,0 +1,95 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// DataBackupInfo is a data backup cosmovisor made, as `cosmovisor backup list` shows it
+type DataBackupInfo struct {
+	DataBackupRecord
+	// Size is the size of the backup, measured for a local backup recorded without its
+	// stats, 0 if unknown
+	Size int64 `json:"size"`
+	// Missing is set for a local backup that was removed since
+	Missing bool `json:"missing,omitempty"`
+}
+
+// DataBackups returns the data backups cosmovisor made and didn't prune, oldest first
+func (cfg *Config) DataBackups() ([]DataBackupInfo, error) {
+	records, err := cfg.dataBackups()
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]DataBackupInfo, len(records))
+	for i, r := range records {
+		b := DataBackupInfo{DataBackupRecord: r}
+		if r.Stats != nil {
+			b.Size = r.Stats.Bytes
+		}
+		if !isRemoteBackup(r.Path) {
+			if _, err := os.Lstat(r.Path); os.IsNotExist(err) {
+				b.Missing = true
+			} else if r.Stats == nil {
+				b.Size, _ = backupSize(r.Path)
+			}
+		}
+		backups[i] = b
+	}
+	return backups, nil
+}
+
+// WriteDataBackups prints the backups as aligned columns, the newest last, with their age
+// at now
+func WriteDataBackups(w io.Writer, backups []DataBackupInfo, now time.Time) error {
+	if len(backups) == 0 {
+		_, err := fmt.Fprintln(w, "no data backups made yet")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "CREATED\tAGE\tUPGRADE\tHEIGHT\tMODE\tSIZE\tDATA\tRATIO\tDURATION\tPATH\n")
+	for _, b := range backups {
+		height := "-"
+		if b.Height > 0 {
+			height = strconv.FormatInt(b.Height, 10)
+		}
+		size := "-"
+		switch {
+		case b.Missing:
+			size = "missing"
+		case b.Size > 0:
+			size = formatBytes(b.Size)
+		}
+		mode, data, ratio, took := "-", "-", "-", "-"
+		if s := b.Stats; s != nil {
+			mode, data = string(s.Mode), formatBytes(s.DataBytes)
+			if s.CompressionRatio > 0 {
+				ratio = fmt.Sprintf("%.2f", s.CompressionRatio)
+			}
+			took = time.Duration(s.DurationSeconds * float64(time.Second)).Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", b.CreatedAt.Format(time.RFC3339), formatAge(now.Sub(b.CreatedAt)),
+			b.Upgrade, height, mode, size, data, ratio, took, b.Path)
+	}
+	return tw.Flush()
+}
+
+// formatAge formats the age of a backup to the largest two units, e.g. 3d4h or 12m
+func formatAge(d time.Duration) string {
+	if d < time.Minute {
+		return "<1m"
+	}
+	days, hours, minutes := int(d/(24*time.Hour)), int(d/time.Hour)%24, int(d/time.Minute)%60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
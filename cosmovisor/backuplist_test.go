@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataBackups(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", DataBackup: DataBackupArchive, DataBackupName: "{{.Name}}"}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "state.db"), bytes.Repeat([]byte("state"), 1000), 0644))
+
+	// a copy recorded before the stats were, and a backup removed by hand
+	old := filepath.Join(t.TempDir(), "data-backup-v1")
+	require.NoError(t, os.MkdirAll(old, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(old, "state.db"), []byte("state"), 0644))
+	cfg.recordDataBackup(DataBackupRecord{Upgrade: "v1", Height: 10, Path: old, CreatedAt: NowUTC().Add(-50 * time.Hour)})
+	cfg.recordDataBackup(DataBackupRecord{Upgrade: "v1.1", Path: filepath.Join(t.TempDir(), "gone"), CreatedAt: NowUTC().Add(-2 * time.Hour)})
+	require.NoError(t, cfg.backupData(&UpgradeInfo{Name: "v2", Height: 100}, NewUpgradeTimings("v2").Phase("data-backup")))
+
+	backups, err := cfg.DataBackups()
+	require.NoError(t, err)
+	require.Len(t, backups, 3)
+	require.Equal(t, int64(len("state")), backups[0].Size)
+	require.Nil(t, backups[0].Stats)
+	require.True(t, backups[1].Missing)
+	archive := backups[2]
+	require.Equal(t, "v2", archive.Upgrade)
+	require.NotNil(t, archive.Stats)
+	require.Equal(t, int64(5000), archive.Stats.DataBytes)
+	info, err := os.Stat(archive.Path)
+	require.NoError(t, err)
+	require.Equal(t, info.Size(), archive.Size)
+	require.Equal(t, float64(5000)/float64(info.Size()), archive.Stats.CompressionRatio)
+	manifest, err := ReadBackupManifest(archive.Path)
+	require.NoError(t, err)
+	require.Equal(t, archive.Stats, manifest.Stats)
+
+	var out bytes.Buffer
+	require.NoError(t, WriteDataBackups(&out, backups, NowUTC()))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 4)
+	require.Regexp(t, `^CREATED\s+AGE\s+UPGRADE\s+HEIGHT\s+MODE\s+SIZE\s+DATA\s+RATIO\s+DURATION\s+PATH$`, lines[0])
+	require.Regexp(t, `\s2d2h\s+v1\s+10\s+-\s+5 B\s+-\s+-\s+-\s+`+old+`$`, lines[1])
+	require.Regexp(t, `\s2h0m\s+v1.1\s+-\s+-\s+missing\s+`, lines[2])
+	require.Regexp(t, `\s<1m\s+v2\s+100\s+archive\s+\d+ B\s+4.9 KiB\s+\d+\.\d\d\s+0s\s+`, lines[3])
+
+	out.Reset()
+	require.NoError(t, WriteDataBackups(&out, nil, NowUTC()))
+	require.Equal(t, "no data backups made yet\n", out.String())
+}
+
+func TestFormatAge(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		time.Second:                   "<1m",
+		42 * time.Minute:              "42m",
+		5*time.Hour + 12*time.Minute:  "5h12m",
+		76*time.Hour + 30*time.Minute: "3d4h",
+	} {
+		require.Equal(t, want, formatAge(d), d)
+	}
+}
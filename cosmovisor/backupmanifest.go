@@ -0,0 +1,239 @@
+package cosmovisor
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// manifestExt is appended to the path of a data backup for its manifest
+const manifestExt = ".manifest.json"
+
+// BackupManifest lists the files of a data backup, so it can be verified before it is needed
+type BackupManifest struct {
+	Upgrade   string    `json:"upgrade"`
+	Height    int64     `json:"height,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Snapshot is the height of the state sync snapshot a snapshot backup holds instead of
+	// the data directory
+	Snapshot int64 `json:"snapshot,omitempty"`
+	// Stats is how the backup went
+	Stats *BackupStats `json:"stats,omitempty"`
+	// Files are the regular files and symlinks, sorted by path
+	Files []BackupFile `json:"files"`
+}
+
+// BackupFile is a file in a data backup. Path is relative to the data directory, with /
+// as separator. A symlink has Link set and neither size nor hash.
+type BackupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	Link   string `json:"link,omitempty"`
+}
+
+// BackupMismatch is a data backup that doesn't match its manifest. Problems describes
+// each file that differs.
+type BackupMismatch struct {
+	Path     string
+	Problems []string
+}
+
+func (m *BackupMismatch) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "backup %s doesn't match its manifest, %d problems:", m.Path, len(m.Problems))
+	for _, p := range m.Problems {
+		fmt.Fprintf(&b, "\n  - %s", p)
+	}
+	return b.String()
+}
+
+// manifestPath is the manifest of the data backup at path
+func manifestPath(path string) string {
+	return path + manifestExt
+}
+
+// hashFile returns the entry of a regular file read from r
+func hashFile(path string, r io.Reader) (BackupFile, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	return BackupFile{Path: path, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// treeFiles lists the regular files and symlinks below root with their hashes
+func treeFiles(root string) ([]BackupFile, error) {
+	var files []BackupFile
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		switch mode := info.Mode(); {
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			files = append(files, BackupFile{Path: rel, Link: link})
+		case mode.IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			file, err := hashFile(rel, f)
+			if err != nil {
+				return fmt.Errorf("hashing %s: %w", path, err)
+			}
+			files = append(files, file)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// archiveFiles lists the regular files and symlinks in the data backup archive at path
+// with their hashes, reading it to the end
+func archiveFiles(path string) ([]BackupFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	var files []BackupFile
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		// the archive unpacks to the data directory
+		parts := strings.SplitN(hdr.Name, "/", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			files = append(files, BackupFile{Path: parts[1], Link: hdr.Linkname})
+		case tar.TypeReg:
+			file, err := hashFile(parts[1], tr)
+			if err != nil {
+				return nil, fmt.Errorf("reading %s from %s: %w", hdr.Name, path, err)
+			}
+			files = append(files, file)
+		}
+	}
+}
+
+// backupFiles lists the files of the data backup at path, an archive or a copy
+func backupFiles(path string) ([]BackupFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return treeFiles(path)
+	}
+	return archiveFiles(path)
+}
+
+// writeManifest writes the manifest of the data backup at path next to it
+func (cfg *Config) writeManifest(path string, manifest *BackupManifest) error {
+	bz, err := marshalManifest(manifest)
+	if err != nil {
+		return err
+	}
+	fs := cfg.fs()
+	dst := manifestPath(path)
+	if err := fs.writeFile(dst+".tmp", bz, 0644); err != nil {
+		return err
+	}
+	return fs.rename(dst+".tmp", dst)
+}
+
+// marshalManifest encodes the manifest with its files sorted by path
+func marshalManifest(manifest *BackupManifest) ([]byte, error) {
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+	return json.MarshalIndent(manifest, "", "  ")
+}
+
+// ReadBackupManifest reads the manifest of the data backup at path
+func ReadBackupManifest(path string) (*BackupManifest, error) {
+	bz, err := ioutil.ReadFile(manifestPath(path))
+	if err != nil {
+		return nil, err
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(bz, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", manifestPath(path), err)
+	}
+	return &manifest, nil
+}
+
+// VerifyDataBackup reads the data backup at path, an archive or a copy, and checks every
+// file against the manifest written with it. Files that are missing, differ or aren't in
+// the manifest are returned as a *BackupMismatch.
+func VerifyDataBackup(path string) (*BackupManifest, error) {
+	manifest, err := ReadBackupManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	files, err := backupFiles(path)
+	if err != nil {
+		return manifest, err
+	}
+	found := make(map[string]BackupFile, len(files))
+	for _, f := range files {
+		found[f.Path] = f
+	}
+	var problems []string
+	for _, want := range manifest.Files {
+		got, ok := found[want.Path]
+		delete(found, want.Path)
+		switch {
+		case !ok:
+			problems = append(problems, "missing "+want.Path)
+		case got.Link != want.Link:
+			problems = append(problems, fmt.Sprintf("%s: links to %q, expected %q", want.Path, got.Link, want.Link))
+		case got.Size != want.Size:
+			problems = append(problems, fmt.Sprintf("%s: %d bytes, expected %d", want.Path, got.Size, want.Size))
+		case got.SHA256 != want.SHA256:
+			problems = append(problems, fmt.Sprintf("%s: sha256 %s, expected %s", want.Path, got.SHA256, want.SHA256))
+		}
+	}
+	var unexpected []string
+	for p := range found {
+		unexpected = append(unexpected, "not in the manifest: "+p)
+	}
+	sort.Strings(unexpected)
+	problems = append(problems, unexpected...)
+	if len(problems) > 0 {
+		return manifest, &BackupMismatch{Path: path, Problems: problems}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,96 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// makeDataBackup backs up a small data directory with the mode, returning the config and
+// the path of the backup
+func makeDataBackup(t *testing.T, mode DataBackup) (*Config, string) {
+	home := t.TempDir()
+	cfg := &Config{Home: home, Name: "dummyd", DataBackup: mode, DataBackupName: "backup"}
+	data := cfg.DataDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(data, "state.db"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(data, "state.db", "000001.ldb"), []byte("state"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(data, "priv_validator_state.json"), []byte("{}"), 0600))
+	require.NoError(t, os.Symlink("state.db", filepath.Join(data, "latest")))
+	require.NoError(t, cfg.backupData(&UpgradeInfo{Name: "v2", Height: 100}, NewUpgradeTimings("v2").Phase("data-backup")))
+
+	path := filepath.Join(cfg.StateDir(), "backups", "backup")
+	if mode == DataBackupArchive {
+		path += dataArchiveExt
+	}
+	return cfg, path
+}
+
+func TestVerifyDataBackup(t *testing.T) {
+	for _, mode := range []DataBackup{DataBackupArchive, DataBackupCopy} {
+		t.Run(string(mode), func(t *testing.T) {
+			_, path := makeDataBackup(t, mode)
+			manifest, err := VerifyDataBackup(path)
+			require.NoError(t, err)
+			require.Equal(t, "v2", manifest.Upgrade)
+			require.Equal(t, int64(100), manifest.Height)
+			require.Equal(t, []BackupFile{
+				{Path: "latest", Link: "state.db"},
+				{Path: "priv_validator_state.json", Size: 2, SHA256: sha256Hex("{}")},
+				{Path: "state.db/000001.ldb", Size: 5, SHA256: sha256Hex("state")},
+			}, manifest.Files)
+
+			// a manifest that doesn't match what is in the backup
+			manifest.Files = append(manifest.Files[1:], BackupFile{Path: "state.db/CURRENT", Size: 16})
+			manifest.Files[0].SHA256 = sha256Hex("[]")
+			manifest.Files[1].Size = 6
+			require.NoError(t, (&Config{}).writeManifest(path, manifest))
+			_, err = VerifyDataBackup(path)
+			var mismatch *BackupMismatch
+			require.True(t, errors.As(err, &mismatch), "%v", err)
+			require.Equal(t, []string{
+				"priv_validator_state.json: sha256 " + sha256Hex("{}") + ", expected " + sha256Hex("[]"),
+				"state.db/000001.ldb: 5 bytes, expected 6",
+				"missing state.db/CURRENT",
+				"not in the manifest: latest",
+			}, mismatch.Problems)
+		})
+	}
+}
+
+func TestVerifyDataBackupCopyChanged(t *testing.T) {
+	_, path := makeDataBackup(t, DataBackupCopy)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(path, "state.db", "000001.ldb"), []byte("STATE"), 0644))
+	_, err := VerifyDataBackup(path)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "doesn't match its manifest, 1 problems:\n  - state.db/000001.ldb: sha256 ")
+
+	_, err = VerifyDataBackup(filepath.Join(filepath.Dir(path), "other"))
+	require.True(t, os.IsNotExist(err), "%v", err)
+}
+
+func TestPruneRemovesManifest(t *testing.T) {
+	cfg, path := makeDataBackup(t, DataBackupArchive)
+	_, err := os.Stat(manifestPath(path))
+	require.NoError(t, err)
+
+	cfg.DataBackupName = "newer"
+	require.NoError(t, cfg.backupData(&UpgradeInfo{Name: "v3", Height: 200}, NewUpgradeTimings("v3").Phase("data-backup")))
+	cfg.BackupKeepRecent = 1
+	cfg.pruneDataBackups()
+	_, err = os.Stat(manifestPath(path))
+	require.True(t, os.IsNotExist(err))
+}
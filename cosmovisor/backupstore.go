@@ -0,0 +1,194 @@
+package cosmovisor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// gcsEndpoint is the XML API of Google Cloud Storage, which speaks the S3 protocol
+	gcsEndpoint = "https://storage.googleapis.com"
+	// defaultS3Region is used when neither the URL nor the AWS configuration has a region
+	defaultS3Region = "us-east-1"
+)
+
+// backupUploader streams data backups to remote storage, the objects are named relative to
+// the destination
+type backupUploader interface {
+	// Upload stores what r reads as the object name, without knowing its size up front
+	Upload(ctx context.Context, name string, r io.Reader) error
+	// Delete removes the object name
+	Delete(ctx context.Context, name string) error
+	// URL is where the object name is stored, without credentials
+	URL(name string) string
+}
+
+// parseBackupDest checks a DAEMON_DATA_BACKUP_DEST URL
+func parseBackupDest(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "s3", "gs", "http", "https":
+	default:
+		return nil, fmt.Errorf("unknown scheme %q, must be s3, gs, http or https", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s has no bucket or host", s)
+	}
+	return u, nil
+}
+
+// isRemoteBackup returns true if the data backup at path was streamed to remote storage
+func isRemoteBackup(path string) bool {
+	return strings.Contains(path, "://")
+}
+
+// backupDestScheme is the scheme of the DAEMON_DATA_BACKUP_DEST dest, the destination of
+// the backup stats: the URL itself may hold credentials
+func backupDestScheme(dest string) string {
+	if u, err := url.Parse(dest); err == nil && u.Scheme != "" {
+		return u.Scheme
+	}
+	return "remote"
+}
+
+// backupUploader returns the uploader of DataBackupDest
+func (cfg *Config) backupUploader() (backupUploader, error) {
+	u, err := parseBackupDest(cfg.DataBackupDest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DAEMON_DATA_BACKUP_DEST: %w", err)
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return &httpUploader{client: &http.Client{}, base: u}, nil
+	}
+	return newS3Uploader(u)
+}
+
+// s3Uploader uploads to a bucket of S3, of Google Cloud Storage, or of another store
+// speaking the S3 protocol, in parts, so nothing is buffered beyond a few of them
+type s3Uploader struct {
+	scheme   string
+	bucket   string
+	prefix   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+// newS3Uploader uploads to s3://<bucket>/<prefix> or gs://<bucket>/<prefix>, with the
+// credentials of the AWS SDK: the AWS_* variables, the shared files or the instance role.
+// Google Cloud Storage takes HMAC keys. The endpoint and the region can be given as
+// ?endpoint= and ?region=, e.g. for MinIO.
+func newS3Uploader(u *url.URL) (*s3Uploader, error) {
+	config := aws.NewConfig()
+	if u.Scheme == "gs" {
+		config = config.WithEndpoint(gcsEndpoint).WithRegion("auto")
+	}
+	query := u.Query()
+	if endpoint := query.Get("endpoint"); endpoint != "" {
+		config = config.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	if region := query.Get("region"); region != "" {
+		config = config.WithRegion(region)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{Config: *config, SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		sess.Config.Region = aws.String(defaultS3Region)
+	}
+	return &s3Uploader{
+		scheme:   u.Scheme,
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		client:   s3.New(sess),
+		uploader: s3manager.NewUploader(sess),
+	}, nil
+}
+
+func (s *s3Uploader) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *s3Uploader) Upload(ctx context.Context, name string, r io.Reader) error {
+	_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+		Body:   r,
+	})
+	return err
+}
+
+func (s *s3Uploader) Delete(ctx context.Context, name string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.key(name))})
+	return err
+}
+
+func (s *s3Uploader) URL(name string) string {
+	return s.scheme + "://" + s.bucket + "/" + s.key(name)
+}
+
+// httpUploader PUTs the objects below a base URL with chunked transfer encoding, e.g. to
+// a WebDAV share or a pre-authorized upload endpoint. Credentials in the URL are sent as
+// basic auth.
+type httpUploader struct {
+	client *http.Client
+	base   *url.URL
+}
+
+func (h *httpUploader) object(name string) *url.URL {
+	u := *h.base
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + name
+	u.RawPath = ""
+	return &u
+}
+
+func (h *httpUploader) Upload(ctx context.Context, name string, r io.Reader) error {
+	// a reader the request doesn't know the length of is sent chunked
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, h.object(name).String(), ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return h.do(req)
+}
+
+func (h *httpUploader) Delete(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, h.object(name).String(), nil)
+	if err != nil {
+		return err
+	}
+	return h.do(req)
+}
+
+func (h *httpUploader) do(req *http.Request) error {
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, h.URL(path.Base(req.URL.Path)), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (h *httpUploader) URL(name string) string {
+	u := h.object(name)
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,111 @@
+package cosmovisor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// exeName is the file name of the binary name, with .exe on windows
+func exeName(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), exeSuffix) {
+		return name
+	}
+	return name + exeSuffix
+}
+
+// daemonNameOf is the name of the daemon the binary runs, its file name without .exe
+func daemonNameOf(bin string) string {
+	name := filepath.Base(bin)
+	if strings.HasSuffix(strings.ToLower(name), exeSuffix) {
+		return name[:len(name)-len(exeSuffix)]
+	}
+	return name
+}
+
+// validateBinaryName returns an error if name can't name the binary of a version directory
+func validateBinaryName(name string) error {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return errors.New("binary name is empty")
+	case name == "." || name == ".." || strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("invalid binary name %q, must be a file name", name)
+	}
+	return nil
+}
+
+// versionBin is the binary of the version directory dir
+func (cfg *Config) versionBin(dir string) string {
+	return filepath.Join(dir, "bin", cfg.binNameIn(dir))
+}
+
+// binNameIn is the file name of the binary of the version directory dir. Chains occasionally
+// rename their daemon: the overrides of the upgrade that renamed it name the new binary, and
+// the upgrades after it hold a binary of that name too. So it is the binary the overrides of
+// dir name, else DAEMON_NAME, else a binary the overrides of another version directory name,
+// if dir holds it.
+func (cfg *Config) binNameIn(dir string) string {
+	if o, err := readOverrides(dir); err == nil && o != nil && o.Binary != "" {
+		return exeName(o.Binary)
+	}
+	name := cfg.binName()
+	if _, err := os.Stat(filepath.Join(dir, "bin", name)); err == nil {
+		return name
+	}
+	for _, renamed := range cfg.renamedBinaries() {
+		if _, err := os.Stat(filepath.Join(dir, "bin", renamed)); err == nil {
+			return renamed
+		}
+	}
+	return name
+}
+
+// renamedBinaries are the file names of the binaries the overrides of the version directories
+// name
+func (cfg *Config) renamedBinaries() []string {
+	dirs := []string{cfg.genesisPath()}
+	if entries, err := ioutil.ReadDir(cfg.upgradesPath()); err == nil {
+		for _, e := range entries {
+			dirs = append(dirs, filepath.Join(cfg.upgradesPath(), e.Name()))
+		}
+	}
+	var names []string
+	for _, dir := range dirs {
+		if o, err := readOverrides(dir); err == nil && o != nil && o.Binary != "" {
+			names = append(names, exeName(o.Binary))
+		}
+	}
+	return names
+}
+
+// DaemonName is the name of the daemon the current binary runs, DAEMON_NAME unless an upgrade
+// renamed it
+func (cfg *Config) DaemonName() string {
+	bin, _ := cfg.resolveCurrentBin()
+	return daemonNameOf(bin)
+}
+
+// writeBinaryName names the binary of the version directory dir in its overrides, keeping
+// the other overrides
+func (cfg *Config) writeBinaryName(dir, name string) error {
+	if err := validateBinaryName(name); err != nil {
+		return err
+	}
+	o, err := readOverrides(dir)
+	if err != nil {
+		return err
+	}
+	if o == nil {
+		o = &LaunchOverrides{}
+	}
+	o.Binary = name
+	bz, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return err
+	}
+	return cfg.fs().writeFile(filepath.Join(dir, overridesFile), append(bz, '\n'), 0644)
+}
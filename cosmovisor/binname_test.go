@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinNameIn(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "gaiad"}
+	stage := func(dir, name string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "bin"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bin", name), []byte("#!/bin/sh\n"), 0755))
+	}
+	stage(cfg.genesisPath(), "gaiad")
+	// v2 renames the daemon, v3 keeps the new name
+	stage(cfg.UpgradeDir("v2"), "cosmoshubd")
+	require.NoError(t, cfg.writeBinaryName(cfg.UpgradeDir("v2"), "cosmoshubd"))
+	stage(cfg.UpgradeDir("v3"), "cosmoshubd")
+
+	require.Equal(t, filepath.Join(cfg.genesisPath(), "bin", "gaiad"), cfg.GenesisBin())
+	require.Equal(t, filepath.Join(cfg.UpgradeDir("v2"), "bin", "cosmoshubd"), cfg.UpgradeBin("v2"))
+	require.Equal(t, filepath.Join(cfg.UpgradeDir("v3"), "bin", "cosmoshubd"), cfg.UpgradeBin("v3"))
+	// an upgrade not staged yet has the binary of DAEMON_NAME
+	require.Equal(t, filepath.Join(cfg.UpgradeDir("v4"), "bin", "gaiad"), cfg.UpgradeBin("v4"))
+
+	require.Equal(t, "gaiad", cfg.DaemonName())
+	for _, upgrade := range []string{"v2", "v3"} {
+		require.NoError(t, cfg.SetCurrentUpgrade(upgrade))
+		bin, err := cfg.CurrentBin()
+		require.NoError(t, err)
+		require.Equal(t, cfg.UpgradeBin(upgrade), bin)
+		require.Equal(t, "cosmoshubd", cfg.DaemonName())
+	}
+	require.NoError(t, cfg.setCurrent(cfg.genesisPath()))
+	require.Equal(t, "gaiad", cfg.DaemonName())
+
+	o, err := readOverrides(cfg.UpgradeDir("v2"))
+	require.NoError(t, err)
+	require.Equal(t, "binary cosmoshubd", o.String())
+	require.EqualError(t, cfg.writeBinaryName(cfg.UpgradeDir("v3"), "../gaiad"), `invalid binary name "../gaiad", must be a file name`)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.UpgradeDir("v3"), overridesFile), []byte(`{"binary": "bin/cosmoshubd"}`), 0644))
+	_, err = readOverrides(cfg.UpgradeDir("v3"))
+	require.EqualError(t, err, "invalid "+filepath.Join(cfg.UpgradeDir("v3"), overridesFile)+`: invalid binary name "bin/cosmoshubd", must be a file name`)
+}
+
+func TestDownloadRenamedBinary(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "gaiad", AllowDownloadBinaries: true}
+	src := filepath.Join(t.TempDir(), "cosmoshubd")
+	require.NoError(t, ioutil.WriteFile(src, []byte("#!/bin/sh\necho cosmoshubd\n"), 0755))
+
+	info := &UpgradeInfo{Name: "v2", Info: fmt.Sprintf(`{"binaries":{"%s": "%s"}, "binary_name": "cosmoshubd"}`, OSArch(), src)}
+	require.NoError(t, DownloadBinary(cfg, info))
+	require.Equal(t, filepath.Join(cfg.UpgradeDir("v2"), "bin", "cosmoshubd"), cfg.UpgradeBin("v2"))
+	require.NoError(t, EnsureBinary(cfg.UpgradeBin("v2")))
+	o, err := readOverrides(cfg.UpgradeDir("v2"))
+	require.NoError(t, err)
+	require.Equal(t, &LaunchOverrides{Binary: "cosmoshubd"}, o)
+
+	info = &UpgradeInfo{Name: "v3", Info: fmt.Sprintf(`{"binaries":{"%s": "%s"}, "binary_name": "../cosmoshubd"}`, OSArch(), src)}
+	require.EqualError(t, DownloadBinary(cfg, info), `invalid binary name "../cosmoshubd", must be a file name`)
+}
@@ -0,0 +1,65 @@
+//go:build leveldb
+// +build leveldb
+
+package cosmovisor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// blockStoreKey holds the base and height of tendermint's block store
+var blockStoreKey = []byte("blockStore")
+
+// readBlockstoreHeight reads the height of the block store in the data directory. The
+// database is opened read-only, which fails while the node holds its lock.
+func readBlockstoreHeight(dataDir string) (int64, error) {
+	dir := filepath.Join(dataDir, blockstoreDB)
+	// a read-only open still creates a missing LOCK file, a database always has one
+	if _, err := os.Stat(filepath.Join(dir, "LOCK")); err != nil {
+		return 0, fmt.Errorf("%s is not a leveldb database: %w", dir, err)
+	}
+	db, err := leveldb.OpenFile(dir, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return 0, fmt.Errorf("opening %s: %w", dir, err)
+	}
+	defer db.Close()
+	value, err := db.Get(blockStoreKey, nil)
+	if err != nil {
+		return 0, fmt.Errorf("reading %s from %s: %w", blockStoreKey, dir, err)
+	}
+	return decodeBlockStoreState(value)
+}
+
+// decodeBlockStoreState decodes tendermint's BlockStoreState, protobuf since v0.34 and
+// JSON before
+func decodeBlockStoreState(bz []byte) (int64, error) {
+	if trimmed := bytes.TrimSpace(bz); len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJSONHeight(trimmed, "height")
+	}
+	var height int64
+	for len(bz) > 0 {
+		tag, n := binary.Uvarint(bz)
+		if n <= 0 || tag&7 != 0 {
+			return 0, fmt.Errorf("invalid block store state")
+		}
+		v, m := binary.Uvarint(bz[n:])
+		if m <= 0 {
+			return 0, fmt.Errorf("invalid block store state")
+		}
+		if tag>>3 == 2 {
+			height = int64(v)
+		}
+		bz = bz[n+m:]
+	}
+	if height <= 0 {
+		return 0, fmt.Errorf("block store state has no height")
+	}
+	return height, nil
+}
@@ -0,0 +1,12 @@
+//go:build !leveldb
+// +build !leveldb
+
+package cosmovisor
+
+import "errors"
+
+// readBlockstoreHeight needs the leveldb build tag, without it the local height is only
+// read from priv_validator_state.json
+func readBlockstoreHeight(string) (int64, error) {
+	return 0, errors.New("reading the block store needs cosmovisor built with -tags leveldb")
+}
@@ -0,0 +1,75 @@
+//go:build leveldb
+// +build leveldb
+
+package cosmovisor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestReadBlockstoreHeight(t *testing.T) {
+	// the fixtures have older heights compacted into a table and the latest in the journal
+	cases := map[string]int64{
+		"old-snapshot": 100,
+		"new-snapshot": 5000,
+	}
+	for scenario, expect := range cases {
+		t.Run(scenario, func(t *testing.T) {
+			height, err := readBlockstoreHeight(filepath.Join("testdata", "height", scenario, dataDir))
+			require.NoError(t, err)
+			require.Equal(t, expect, height)
+		})
+	}
+
+	_, err := readBlockstoreHeight(filepath.Join("testdata", "validate"))
+	require.Error(t, err)
+
+	// the database of a running node is locked, it isn't read
+	dir := t.TempDir()
+	require.NoError(t, copy.Copy(filepath.Join("testdata", "height", "new-snapshot", dataDir), dir))
+	db, err := leveldb.OpenFile(filepath.Join(dir, blockstoreDB), nil)
+	require.NoError(t, err)
+	_, err = readBlockstoreHeight(dir)
+	require.Error(t, err)
+	require.NoError(t, db.Close())
+	height, err := readBlockstoreHeight(dir)
+	require.NoError(t, err)
+	require.Equal(t, int64(5000), height)
+
+	// nor is a directory without a LOCK file, which opening would create
+	require.NoError(t, os.Remove(filepath.Join(dir, blockstoreDB, "LOCK")))
+	_, err = readBlockstoreHeight(dir)
+	require.Contains(t, err.Error(), "is not a leveldb database")
+	_, err = os.Stat(filepath.Join(dir, blockstoreDB, "LOCK"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestDecodeBlockStoreState(t *testing.T) {
+	cases := map[string]struct {
+		bz     []byte
+		expect int64
+		err    bool
+	}{
+		"protobuf":        {bz: []byte{0x08, 0x01, 0x10, 0xe8, 0x07}, expect: 1000},
+		"json":            {bz: []byte(`{"base": "1", "height": "1000"}`), expect: 1000},
+		"no height":       {bz: []byte{0x08, 0x01}, err: true},
+		"wrong wire type": {bz: []byte{0x12, 0x01, 0x00}, err: true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			height, err := decodeBlockStoreState(tc.bz)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, height)
+		})
+	}
+}
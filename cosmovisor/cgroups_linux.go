@@ -0,0 +1,142 @@
+package cosmovisor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// setupCgroup prepares the cgroup of the daemon, with MemoryLimit and CPULimit, and returns
+// its directory. It needs cgroups v2 and the memory and cpu controllers delegated to the
+// cgroup of cosmovisor, e.g. with Delegate=yes of systemd.
+func (cfg *Config) setupCgroup() (string, error) {
+	own, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	return cfg.setupCgroupIn(cgroupRoot, own)
+}
+
+// setupCgroupIn is setupCgroup with the hierarchy mounted at root, and cosmovisor in the
+// cgroup own
+func (cfg *Config) setupCgroupIn(root, own string) (string, error) {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("cgroups v2 aren't mounted at %s", root)
+	}
+	// a launch after the first finds cosmovisor moved already
+	if filepath.Base(own) == supervisorCgroup {
+		own = filepath.Dir(own)
+	}
+	parent := filepath.Join(root, own)
+	available, err := ioutil.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	var enable []string
+	for _, c := range []struct {
+		name   string
+		wanted bool
+	}{{"memory", cfg.MemoryLimit > 0}, {"cpu", cfg.CPULimit > 0}} {
+		if !c.wanted {
+			continue
+		}
+		if !strings.Contains(" "+strings.TrimSpace(string(available))+" ", " "+c.name+" ") {
+			return "", fmt.Errorf("the %s controller isn't delegated to %s, e.g. with Delegate=yes of systemd", c.name, parent)
+		}
+		enable = append(enable, "+"+c.name)
+	}
+
+	fs := cfg.fs()
+	supervisor := filepath.Join(parent, supervisorCgroup)
+	if err := fs.mkdirAll(supervisor, 0755); err != nil {
+		return "", err
+	}
+	procs, err := ioutil.ReadFile(filepath.Join(parent, "cgroup.procs"))
+	if err != nil {
+		return "", err
+	}
+	for _, pid := range strings.Fields(string(procs)) {
+		if err := writeCgroupFile(fs, supervisor, "cgroup.procs", pid); err != nil {
+			return "", fmt.Errorf("moving process %s to %s: %w", pid, supervisor, err)
+		}
+	}
+	if err := writeCgroupFile(fs, parent, "cgroup.subtree_control", strings.Join(enable, " ")); err != nil {
+		return "", fmt.Errorf("enabling the controllers of %s: %w", parent, err)
+	}
+
+	daemon := filepath.Join(parent, daemonCgroup)
+	if err := fs.mkdirAll(daemon, 0755); err != nil {
+		return "", err
+	}
+	if cfg.MemoryLimit > 0 {
+		if err := writeCgroupFile(fs, daemon, "memory.max", cfg.memoryMax()); err != nil {
+			return "", err
+		}
+	}
+	if cfg.CPULimit > 0 {
+		if err := writeCgroupFile(fs, daemon, "cpu.max", cfg.cpuMax()); err != nil {
+			return "", err
+		}
+	}
+	return daemon, nil
+}
+
+// joinCgroup moves the process pid to the cgroup at dir
+func joinCgroup(fs fsGuard, dir string, pid int) error {
+	return writeCgroupFile(fs, dir, "cgroup.procs", strconv.Itoa(pid))
+}
+
+func writeCgroupFile(fs fsGuard, dir, name, value string) error {
+	if err := fs.writeFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("writing %q to %s: %w", value, filepath.Join(dir, name), err)
+	}
+	return nil
+}
+
+// ownCgroup returns the cgroup v2 of this process, relative to cgroupRoot
+func ownCgroup() (string, error) {
+	bz, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(bz), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", errors.New("this process isn't in a cgroup v2")
+}
+
+// processRSS returns the resident memory of the process pid, in bytes
+func processRSS(pid int) (int64, error) {
+	bz, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	return parseRSS(bz)
+}
+
+// parseRSS reads VmRSS out of /proc/<pid>/status
+func parseRSS(status []byte) (int64, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "VmRSS:" && fields[2] == "kB" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid VmRSS %q: %w", fields[1], err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, errors.New("no VmRSS in the process status")
+}
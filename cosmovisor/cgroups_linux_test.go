@@ -0,0 +1,65 @@
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupCgroupIn(t *testing.T) {
+	root := t.TempDir()
+	parent := filepath.Join(root, "system.slice", "cosmovisor.service")
+	require.NoError(t, os.MkdirAll(parent, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpuset cpu io memory pids\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(parent, "cgroup.controllers"), []byte("cpu memory pids\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(parent, "cgroup.procs"), []byte("41\n"), 0644))
+
+	cfg := &Config{MemoryLimit: 8 << 30, CPULimit: 1.5}
+	daemon, err := cfg.setupCgroupIn(root, "/system.slice/cosmovisor.service")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(parent, daemonCgroup), daemon)
+	for file, value := range map[string]string{
+		filepath.Join(parent, supervisorCgroup, "cgroup.procs"): "41",
+		filepath.Join(parent, "cgroup.subtree_control"):         "+memory +cpu",
+		filepath.Join(daemon, "memory.max"):                     "8589934592",
+		filepath.Join(daemon, "cpu.max"):                        "150000 100000",
+	} {
+		bz, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		require.Equal(t, value, string(bz), file)
+	}
+
+	// the next launch finds cosmovisor in the supervisor cgroup
+	again, err := cfg.setupCgroupIn(root, "/system.slice/cosmovisor.service/"+supervisorCgroup)
+	require.NoError(t, err)
+	require.Equal(t, daemon, again)
+	require.NoError(t, joinCgroup(cfg.fs(), daemon, 42))
+	bz, err := ioutil.ReadFile(filepath.Join(daemon, "cgroup.procs"))
+	require.NoError(t, err)
+	require.Equal(t, "42", string(bz))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(parent, "cgroup.controllers"), []byte("pids\n"), 0644))
+	_, err = cfg.setupCgroupIn(root, "/system.slice/cosmovisor.service")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "the memory controller isn't delegated")
+
+	unmounted := t.TempDir()
+	_, err = cfg.setupCgroupIn(unmounted, "/")
+	require.EqualError(t, err, "cgroups v2 aren't mounted at "+unmounted)
+}
+
+func TestParseRSS(t *testing.T) {
+	rss, err := parseRSS([]byte("Name:\tgaiad\nVmPeak:\t 9000 kB\nVmRSS:\t  524288 kB\nThreads:\t12\n"))
+	require.NoError(t, err)
+	require.Equal(t, int64(512<<20), rss)
+
+	_, err = parseRSS([]byte("Name:\tgaiad\n"))
+	require.Error(t, err)
+
+	rss, err = processRSS(os.Getpid())
+	require.NoError(t, err)
+	require.True(t, rss > 0)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package cosmovisor
+
+import "errors"
+
+// setupCgroup fails, resource limits need cgroups v2
+func (cfg *Config) setupCgroup() (string, error) {
+	return "", errors.New("DAEMON_MEMORY_LIMIT and DAEMON_CPU_LIMIT need cgroups v2, which are only on linux")
+}
+
+func joinCgroup(fsGuard, string, int) error {
+	return nil
+}
+
+// processRSS can't read the memory of a process outside of linux
+func processRSS(int) (int64, error) {
+	return 0, errors.New("DAEMON_MEMORY_RESTART is only supported on linux")
+}
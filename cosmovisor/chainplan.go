@@ -0,0 +1,63 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"time"
+)
+
+// chainPlanPoll is how often the node is asked for the plan of x/upgrade and its height
+// when DAEMON_PLAN_API is set
+const chainPlanPoll = 2 * time.Second
+
+// watchChainPlan asks the node for the plan of x/upgrade every chainPlanPoll and returns
+// it once the node committed the block before its height, the last one the old binary
+// runs. It returns nil once done is closed. Unlike the plan file, the chain doesn't depend
+// on filesystem events, so it also works for a data directory on a network filesystem.
+func (cfg *Config) watchChainPlan(api *NodeAPI, done <-chan struct{}) *UpgradeInfo {
+	ticker := time.NewTicker(chainPlanPoll)
+	defer ticker.Stop()
+	var failing bool
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+		plan, err := cfg.dueChainPlan(api)
+		switch {
+		case err != nil:
+			// the API is down while the node loads its stores, only the first failure is logged
+			if !failing {
+				logger.Warnf("polling the upgrade plan on %s: %v", api.URL, err)
+			}
+			failing = true
+		case plan != nil:
+			logger.Infof("the node reached height %d of upgrade %q found on %s", plan.Height-1, plan.Name, api.URL)
+			return plan
+		default:
+			failing = false
+		}
+	}
+}
+
+// dueChainPlan returns the plan of x/upgrade if the node is at the block before its
+// height or past it, nil while it isn't due or if it is stale (see stalePlan). Plans
+// scheduled by time have no height to wait for and are left to the other sources.
+func (cfg *Config) dueChainPlan(api *NodeAPI) (*UpgradeInfo, error) {
+	plan, err := api.CurrentPlan()
+	if err != nil || plan == nil || plan.Height <= 0 || cfg.skipsUpgrade(plan) {
+		return nil, err
+	}
+	if err := ValidateUpgradeName(plan.Name); err != nil {
+		return nil, fmt.Errorf("plan %q: %w", plan.Name, err)
+	}
+	height, err := api.LatestHeight()
+	if err != nil || height < plan.Height-1 {
+		return nil, err
+	}
+	if reason := cfg.stalePlan(plan, time.Time{}, time.Time{}); reason != "" {
+		logger.Debugf("ignoring upgrade %q found on %s: %s", plan.Name, api.URL, reason)
+		return nil, nil
+	}
+	return plan, nil
+}
@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDueChainPlan(t *testing.T) {
+	plan := `{"name": "amazonas", "height": "5000", "info": "{}"}`
+	cases := map[string]struct {
+		plan   string
+		height int64
+		skip   SkipUpgrades
+		due    bool
+		err    string
+	}{
+		"no plan":      {plan: "null", height: 4999},
+		"ahead":        {plan: plan, height: 4998},
+		"block before": {plan: plan, height: 4999, due: true},
+		"halted":       {plan: plan, height: 5000, due: true},
+		"skipped":      {plan: plan, height: 4999, skip: SkipUpgrades{Heights: []int64{5000}}},
+		"by time":      {plan: `{"name": "amazonas", "time": "2021-06-01T00:00:00Z", "height": "0"}`, height: 4999},
+		"bad name":     {plan: `{"name": "..", "height": "5000"}`, height: 4999, err: `plan ".."`},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Home: t.TempDir(), Name: "dummyd", SkipUpgrades: tc.skip}
+			api := NewNodeAPI(nodeServer(t, tc.plan, tc.height).URL)
+			info, err := cfg.dueChainPlan(api)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			if !tc.due {
+				require.Nil(t, info)
+				return
+			}
+			require.Equal(t, &UpgradeInfo{Name: "amazonas", Height: 5000, Info: "{}"}, info)
+		})
+	}
+}
+
+func TestWatchChainPlan(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", PlanAPI: "http://localhost:1317"}
+	api := NewNodeAPI(nodeServer(t, `{"name": "amazonas", "height": "5000"}`, 4999).URL)
+	done := make(chan struct{})
+	found := make(chan *UpgradeInfo, 1)
+	go func() { found <- cfg.watchChainPlan(api, done) }()
+	select {
+	case info := <-found:
+		require.Equal(t, "amazonas", info.Name)
+	case <-time.After(3 * chainPlanPoll):
+		t.Fatal("the plan wasn't found")
+	}
+
+	// nothing due, the watch ends with the daemon
+	api = NewNodeAPI(nodeServer(t, "null", 4999).URL)
+	go func() { found <- cfg.watchChainPlan(api, done) }()
+	close(done)
+	require.Nil(t, <-found)
+}
@@ -0,0 +1,240 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// errChecksumRequired is returned for downloads without a usable checksum when
+// DAEMON_DOWNLOAD_MUST_HAVE_CHECKSUM is set
+var errChecksumRequired = errors.New("a checksum is required to download binaries")
+
+// checksumAlgorithm is a hash function accepted for download verification
+type checksumAlgorithm struct {
+	name string
+	size int
+	new  func() hash.Hash
+	// multihash is the multihash code of the function
+	multihash uint64
+	// getter is set if go-getter verifies this algorithm itself
+	getter bool
+}
+
+var checksumAlgorithms = []checksumAlgorithm{
+	{name: "sha256", size: sha256.Size, new: sha256.New, multihash: 0x12, getter: true},
+	{name: "sha512", size: sha512.Size, new: sha512.New, multihash: 0x13, getter: true},
+	{name: "blake2b-256", size: blake2b.Size256, new: newBlake2b256, multihash: 0xb220},
+	{name: "sha1", size: sha1.Size, new: sha1.New, multihash: 0x11, getter: true},
+	{name: "md5", size: md5.Size, new: md5.New, multihash: 0xd5, getter: true},
+}
+
+// checksumFile is a checksum read by go-getter from a checksum file, file:<url>
+var checksumFile = checksumAlgorithm{name: "file", getter: true}
+
+// checksumNames lists the algorithms ParseChecksum accepts as <algorithm>:
+func checksumNames() []string {
+	names := make([]string, 0, len(checksumAlgorithms)+1)
+	for _, alg := range checksumAlgorithms {
+		names = append(names, alg.name)
+	}
+	return append(names, checksumFile.name)
+}
+
+func newBlake2b256() hash.Hash {
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+// Checksum is the expected digest of a download
+type Checksum struct {
+	algorithm checksumAlgorithm
+	Digest    []byte
+	// file is the URL of the checksum file, for the file algorithm
+	file string
+}
+
+// Algorithm is the name of the hash function, e.g. sha256
+func (c *Checksum) Algorithm() string {
+	return c.algorithm.name
+}
+
+// String formats the checksum as <algorithm>:<hex digest>
+func (c *Checksum) String() string {
+	if c.algorithm.name == checksumFile.name {
+		return "file:" + c.file
+	}
+	return c.algorithm.name + ":" + hex.EncodeToString(c.Digest)
+}
+
+// Verify hashes r and compares the digest
+func (c *Checksum) Verify(r io.Reader) error {
+	h := c.algorithm.new()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, c.Digest) {
+		return fmt.Errorf("checksums did not match: expected %s, got %s:%s", c, c.algorithm.name, hex.EncodeToString(sum))
+	}
+	return nil
+}
+
+// ParseChecksum parses <algorithm>:<hex digest>, for sha256, sha512, blake2b-256 (and the
+// legacy sha1 and md5), a bare hex digest whose algorithm is guessed from its length like
+// go-getter does, a bare multihash, in hex or base58, or file:<url> of a checksum file
+// verified by go-getter. Unknown algorithms are an error.
+func ParseChecksum(s string) (*Checksum, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("empty checksum")
+	}
+	if i := strings.Index(s, ":"); i >= 0 {
+		name := strings.ToLower(s[:i])
+		if name == checksumFile.name {
+			return &Checksum{algorithm: checksumFile, file: s[i+1:]}, nil
+		}
+		for _, alg := range checksumAlgorithms {
+			if alg.name != name {
+				continue
+			}
+			digest, err := hex.DecodeString(s[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s checksum: %w", name, err)
+			}
+			if len(digest) != alg.size {
+				return nil, fmt.Errorf("invalid %s checksum: %d bytes, expected %d", name, len(digest), alg.size)
+			}
+			return &Checksum{algorithm: alg, Digest: digest}, nil
+		}
+		return nil, fmt.Errorf("unknown checksum algorithm %q, supported are %s", name, joinWords(checksumNames()))
+	}
+	return parseBareChecksum(s)
+}
+
+// parseBareChecksum parses a checksum without algorithm: a hex digest of md5, sha1, sha256
+// or sha512, as go-getter accepts in ?checksum=, or else a multihash. The lengths of the
+// digests and of the multihashes never collide.
+func parseBareChecksum(s string) (*Checksum, error) {
+	if digest, err := hex.DecodeString(s); err == nil {
+		for _, alg := range checksumAlgorithms {
+			// blake2b-256 digests are as long as sha256 ones, go-getter takes them for sha256
+			if alg.getter && len(digest) == alg.size {
+				return &Checksum{algorithm: alg, Digest: digest}, nil
+			}
+		}
+	}
+	return parseMultihash(s)
+}
+
+// parseMultihash parses a bare multihash: <varint code><varint length><digest>
+func parseMultihash(s string) (*Checksum, error) {
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		if raw, err = decodeBase58(s); err != nil {
+			return nil, fmt.Errorf("checksum %q is neither <algorithm>:<digest> nor a multihash", s)
+		}
+	}
+	sum, n, err := decodeMultihash(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multihash %q: %w", s, err)
+	}
+	if n != len(raw) {
+		return nil, fmt.Errorf("invalid multihash %q: %s digests have %d bytes", s, sum.algorithm.name, sum.algorithm.size)
+	}
+	return sum, nil
+}
+
+// decodeMultihash reads the multihash at the start of raw and returns how many bytes it has
+func decodeMultihash(raw []byte) (*Checksum, int, error) {
+	code, n := binary.Uvarint(raw)
+	if n <= 0 {
+		return nil, 0, errors.New("truncated code")
+	}
+	size, m := binary.Uvarint(raw[n:])
+	if m <= 0 {
+		return nil, 0, errors.New("truncated length")
+	}
+	digest := raw[n+m:]
+	for _, alg := range checksumAlgorithms {
+		if alg.multihash != code {
+			continue
+		}
+		if size != uint64(alg.size) || len(digest) < alg.size {
+			return nil, 0, fmt.Errorf("%s digests have %d bytes", alg.name, alg.size)
+		}
+		return &Checksum{algorithm: alg, Digest: digest[:alg.size]}, n + m + alg.size, nil
+	}
+	return nil, 0, fmt.Errorf("unknown checksum algorithm: multihash code 0x%x", code)
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// decodeBase58 decodes the bitcoin base58 encoding used for multihashes
+func decodeBase58(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, r := range s {
+		i := strings.IndexRune(base58Alphabet, r)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", r)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	// leading ones encode leading zero bytes
+	zeros := len(s) - len(strings.TrimLeft(s, "1"))
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+// splitChecksum removes the checksum query parameter from a go-getter URL and parses it.
+// The checksum is nil if the URL has none.
+func splitChecksum(src string) (string, *Checksum, error) {
+	i := strings.Index(src, "?")
+	if i < 0 {
+		return src, nil, nil
+	}
+	query, err := url.ParseQuery(src[i+1:])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid download URL %s: %w", src, err)
+	}
+	value := query.Get("checksum")
+	if value == "" {
+		return src, nil, nil
+	}
+	query.Del("checksum")
+	sum, err := ParseChecksum(value)
+	if err != nil {
+		return "", nil, err
+	}
+	return withQuery(src[:i], query), sum, nil
+}
+
+// withQuery adds the query parameters to a URL
+func withQuery(src string, query url.Values) string {
+	if len(query) == 0 {
+		return src
+	}
+	sep := "?"
+	if strings.Contains(src, "?") {
+		sep = "&"
+	}
+	return src + sep + query.Encode()
+}
+
+// withChecksum adds the checksum to a URL for go-getter
+func withChecksum(src string, sum *Checksum) string {
+	return withQuery(src, url.Values{"checksum": {sum.String()}})
+}
@@ -0,0 +1,82 @@
+package cosmovisor
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChecksum(t *testing.T) {
+	// digests of "abc"
+	const (
+		sha256abc  = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+		sha512abc  = "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"
+		blake2babc = "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"
+		sha1abc    = "a9993e364706816aba3e25717850c26c9cd0d89d"
+		md5abc     = "900150983cd24fb0d6963f7d28e17f72"
+	)
+
+	cases := map[string]struct {
+		checksum  string
+		algorithm string
+		err       string
+	}{
+		"sha256":                {checksum: "sha256:" + sha256abc, algorithm: "sha256"},
+		"upper case algorithm":  {checksum: "SHA256:" + sha256abc, algorithm: "sha256"},
+		"sha512":                {checksum: "sha512:" + sha512abc, algorithm: "sha512"},
+		"blake2b-256":           {checksum: "blake2b-256:" + blake2babc, algorithm: "blake2b-256"},
+		"sha1":                  {checksum: "sha1:" + sha1abc, algorithm: "sha1"},
+		"md5":                   {checksum: "md5:" + md5abc, algorithm: "md5"},
+		"bare sha256":           {checksum: sha256abc, algorithm: "sha256"},
+		"bare sha512":           {checksum: sha512abc, algorithm: "sha512"},
+		"bare sha1":             {checksum: sha1abc, algorithm: "sha1"},
+		"bare md5":              {checksum: md5abc, algorithm: "md5"},
+		"multihash sha256":      {checksum: "1220" + sha256abc, algorithm: "sha256"},
+		"multihash sha512":      {checksum: "1340" + sha512abc, algorithm: "sha512"},
+		"multihash blake2b-256": {checksum: "a0e40220" + blake2babc, algorithm: "blake2b-256"},
+		"multihash base58":      {checksum: "QmatYkNGZnELf8cAGdyJpUca2PyY4szai3RHyyWofNY1pY", algorithm: "sha256"},
+
+		"unknown algorithm":           {checksum: "sha3:" + sha256abc, err: `unknown checksum algorithm "sha3", supported are sha256, sha512, blake2b-256, sha1, md5 and file`},
+		"unknown multihash":           {checksum: "1620" + sha256abc, err: "unknown checksum algorithm: multihash code 0x16"},
+		"wrong length":                {checksum: "sha256:" + sha1abc, err: "20 bytes, expected 32"},
+		"not hex":                     {checksum: "sha256:" + strings.Repeat("z", 64), err: "invalid sha256 checksum"},
+		"multihash with wrong length": {checksum: "1214" + sha1abc, err: "sha256 digests have 32 bytes"},
+		"truncated multihash":         {checksum: "1220" + sha256abc[:62], err: "sha256 digests have 32 bytes"},
+		"garbage":                     {checksum: "not-a-checksum!", err: "neither <algorithm>:<digest> nor a multihash"},
+		"empty":                       {checksum: "", err: "empty checksum"},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			sum, err := ParseChecksum(tc.checksum)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.algorithm, sum.Algorithm())
+			require.NoError(t, sum.Verify(strings.NewReader("abc")))
+			require.Error(t, sum.Verify(strings.NewReader("abd")))
+		})
+	}
+}
+
+func TestSplitChecksum(t *testing.T) {
+	src, sum, err := splitChecksum("https://example.com/app.zip?archive=zip&checksum=sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/app.zip?archive=zip", src)
+	require.Equal(t, "sha256", sum.Algorithm())
+	require.Equal(t, "https://example.com/app.zip?archive=zip&checksum=sha256%3Aba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", withChecksum(src, sum))
+
+	src, sum, err = splitChecksum("https://example.com/app.zip")
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/app.zip", src)
+	require.Nil(t, sum)
+
+	// checksum files are left to go-getter
+	_, sum, err = splitChecksum("https://example.com/app.zip?checksum=file:https://example.com/SHA256SUMS")
+	require.NoError(t, err)
+	require.Equal(t, "file:https://example.com/SHA256SUMS", sum.String())
+}
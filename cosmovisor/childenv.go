@@ -0,0 +1,103 @@
+package cosmovisor
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// childEnvKey is the table of the config file with the variables set for the daemon
+const childEnvKey = "child_env"
+
+// parseEnvAllow parses the comma separated names of DAEMON_CHILD_ENV_ALLOW. A name ending
+// in * stands for all names starting with the rest, e.g. GAIA_*.
+func parseEnvAllow(s string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.Contains(name, "=") || strings.Contains(strings.TrimSuffix(name, "*"), "*") {
+			return nil, fmt.Errorf("%q is not a variable name, or a prefix followed by *", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// readChildEnv reads the child_env table of the config file as KEY=value variables
+func readChildEnv(tree *toml.Tree) ([]string, error) {
+	table, ok := tree.Get(childEnvKey).(*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a table, declared with [%s]", childEnvKey, childEnvKey)
+	}
+	keys := table.Keys()
+	sort.Strings(keys)
+	env := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value, ok := table.Get(key).(string)
+		if !ok {
+			return nil, fmt.Errorf("%s.%s must be a string", childEnvKey, key)
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, nil
+}
+
+// envAllowed returns true if the variable named key is in allow
+func envAllowed(allow []string, key string) bool {
+	for _, name := range allow {
+		if prefix := strings.TrimSuffix(name, "*"); prefix != name {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// daemonEnv is the environment of the daemon binary: the variables of cosmovisor in
+// ChildEnvAllow, or all of them, and ChildEnv. Nil stands for the environment of
+// cosmovisor unchanged.
+func (cfg *Config) daemonEnv() []string {
+	if len(cfg.ChildEnvAllow) == 0 && len(cfg.ChildEnv) == 0 && !tmpDirChanged() {
+		return nil
+	}
+	env := environ()
+	if len(cfg.ChildEnvAllow) > 0 {
+		allowed := make([]string, 0, len(env))
+		for _, kv := range env {
+			if envAllowed(cfg.ChildEnvAllow, strings.SplitN(kv, "=", 2)[0]) {
+				allowed = append(allowed, kv)
+			}
+		}
+		env = allowed
+	}
+	return mergeEnv(env, cfg.ChildEnv)
+}
+
+// workDir is the working directory of the daemon, so the paths it resolves relative to it
+// don't depend on where cosmovisor was started from
+func (cfg *Config) workDir() string {
+	if cfg.WorkDir != "" {
+		return cfg.WorkDir
+	}
+	return cfg.Home
+}
+
+// daemonCommand is exec.Command for the daemon binary, with the environment, the working
+// directory and the user of the daemon
+func (cfg *Config) daemonCommand(ctx context.Context, bin string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Env = cfg.daemonEnv()
+	cmd.Dir = cfg.workDir()
+	cmd.SysProcAttr = cfg.withCredential(nil)
+	return cmd
+}
@@ -0,0 +1,31 @@
+package cosmovisor
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDaemonEnv(t *testing.T) {
+	setenv(t, "GAIA_PRUNING", "nothing")
+	setenv(t, "DAEMON_NOTIFY_WEBHOOK", "https://hooks.example.com/secret")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "secret")
+
+	require.Nil(t, (&Config{}).daemonEnv())
+
+	env := (&Config{ChildEnv: []string{"GOGC=50"}}).daemonEnv()
+	require.Contains(t, env, "AWS_SECRET_ACCESS_KEY=secret")
+	require.Equal(t, "GOGC=50", env[len(env)-1])
+
+	env = (&Config{ChildEnvAllow: []string{"PATH", "GAIA_*"}, ChildEnv: []string{"GAIA_PRUNING=everything"}}).daemonEnv()
+	require.Equal(t, []string{"PATH=" + os.Getenv("PATH"), "GAIA_PRUNING=everything"}, env)
+}
+
+func TestDaemonCommandWorkDir(t *testing.T) {
+	cfg := &Config{Home: "/var/lib/gaia"}
+	require.Equal(t, "/var/lib/gaia", cfg.daemonCommand(context.Background(), "gaiad", "version").Dir)
+	cfg.WorkDir = "/var/lib/gaia/wasm"
+	require.Equal(t, "/var/lib/gaia/wasm", cfg.daemonCommand(context.Background(), "gaiad", "version").Dir)
+}
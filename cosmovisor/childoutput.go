@@ -0,0 +1,172 @@
+package cosmovisor
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+// outputPrefixFormat is the timestamp at the start of a prefixed line of the daemon's output,
+// with milliseconds so the lines of both streams can be ordered
+const outputPrefixFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// childOutput returns the writers the output of the launch of bin is copied to, after the
+// console writers: with OutputPrefix every line starts with the time and the stream, with
+// OutputFile the lines are also appended to that file, rotated as configured, and with
+// OutputDir they are also written to a run log of this launch. closeFile closes the files
+// once the streams are done.
+func (cfg *Config) childOutput(bin string, stdout, stderr io.Writer) (wout, werr io.Writer, closeFile func(), err error) {
+	var files []io.Closer
+	closeFile = func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}
+	if cfg.OutputFile != "" {
+		f, err := cfg.openOutputFile()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		fout, ferr := CombineOutput(f)
+		stdout, stderr = teeOutput(stdout, fout), teeOutput(stderr, ferr)
+		files = append(files, f)
+	}
+	if cfg.OutputDir != "" {
+		f, err := cfg.openRunLog(bin)
+		if err != nil {
+			closeFile()
+			return nil, nil, nil, err
+		}
+		fout, ferr := CombineOutput(f)
+		stdout, stderr = teeOutput(stdout, fout), teeOutput(stderr, ferr)
+		files = append(files, f)
+	}
+	if cfg.OutputPrefix {
+		stdout, stderr = PrefixOutput(stdout, "stdout"), PrefixOutput(stderr, "stderr")
+	}
+	return stdout, stderr, closeFile, nil
+}
+
+// PrefixOutput returns a writer starting every line written to w with the time its first
+// byte was written and the stream, e.g. "2022-01-02T15:04:05.123Z stderr | ".
+func PrefixOutput(w io.Writer, stream string) io.Writer {
+	if w == nil {
+		return nil
+	}
+	prefix := func() string { return NowUTC().Format(outputPrefixFormat) + " " + stream + " | " }
+	return &prefixWriter{w: w, prefix: prefix, lineStart: true}
+}
+
+// labelOutput returns a writer starting every line written to w with the label, e.g.
+// "gaiad | ", for the output of several processes going to the same place
+func labelOutput(w io.Writer, label string) io.Writer {
+	prefix := label + " | "
+	return &prefixWriter{w: w, prefix: func() string { return prefix }, lineStart: true}
+}
+
+// prefixWriter is a stream of PrefixOutput or labelOutput
+type prefixWriter struct {
+	mutex     sync.Mutex
+	w         io.Writer
+	prefix    func() string
+	lineStart bool
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	prefix := p.prefix()
+	out := make([]byte, 0, len(b)+len(prefix))
+	for _, c := range b {
+		if p.lineStart {
+			out = append(out, prefix...)
+		}
+		out = append(out, c)
+		p.lineStart = c == '\n'
+	}
+	if _, err := p.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush passes the end of the stream on to the writer
+func (p *prefixWriter) Flush() error {
+	return flushOutput(p.w)
+}
+
+// teeOutput returns a writer copying to the console, then to the file. The console is the
+// source of truth: a failing file doesn't fail the write.
+func teeOutput(console, file io.Writer) io.Writer {
+	if console == nil {
+		return file
+	}
+	return &tee{console: console, file: file}
+}
+
+type tee struct {
+	console io.Writer
+	file    io.Writer
+}
+
+func (t *tee) Write(b []byte) (int, error) {
+	n, err := t.console.Write(b)
+	_, _ = t.file.Write(b)
+	return n, err
+}
+
+// Flush passes the end of the stream on to both writers
+func (t *tee) Flush() error {
+	ferr := flushOutput(t.file)
+	if err := flushOutput(t.console); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// flushOutput flushes w if it holds back output, like the writers of CombineOutput do
+func flushOutput(w io.Writer) error {
+	if f, ok := w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// failureOutputLines is how many of the last lines of the daemon's stderr are kept for the
+// error of a daemon that died
+const failureOutputLines = 20
+
+// outputTail keeps the last lines written to it
+type outputTail struct {
+	mutex   sync.Mutex
+	max     int
+	lines   []string
+	partial string
+}
+
+func (t *outputTail) Write(b []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	text := t.partial + string(b)
+	lines := strings.Split(text, "\n")
+	t.partial = lines[len(lines)-1]
+	t.lines = append(t.lines, lines[:len(lines)-1]...)
+	if len(t.lines) > t.max {
+		t.lines = append([]string(nil), t.lines[len(t.lines)-t.max:]...)
+	}
+	return len(b), nil
+}
+
+// Lines returns the last lines, with a line that wasn't ended
+func (t *outputTail) Lines() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	lines := append([]string(nil), t.lines...)
+	if t.partial != "" {
+		lines = append(lines, t.partial)
+	}
+	if len(lines) > t.max {
+		lines = lines[len(lines)-t.max:]
+	}
+	return lines
+}
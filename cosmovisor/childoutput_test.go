@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package cosmovisor_test
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/cosmos-sdk/cosmovisor"
+)
+
+func TestPrefixOutput(t *testing.T) {
+	var console bytes.Buffer
+	w := cosmovisor.PrefixOutput(&console, "stderr")
+	for _, piece := range []string{"first line\nsecond ", "line\n", "\nunterminated"} {
+		_, err := io.WriteString(w, piece)
+		require.NoError(t, err)
+	}
+	stamp := `\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}Z`
+	require.Regexp(t, regexp.MustCompile(`^`+stamp+` stderr \| first line\n`+stamp+` stderr \| second line\n`+
+		stamp+` stderr \| \n`+stamp+` stderr \| unterminated$`), console.String())
+	require.Nil(t, cosmovisor.PrefixOutput(nil, "stdout"))
+}
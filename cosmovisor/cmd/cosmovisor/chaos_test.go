@@ -0,0 +1,354 @@
+//go:build cosmovisor_faults && linux
+// +build cosmovisor_faults,linux
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/cosmos-sdk/cosmovisor"
+)
+
+// runAsCosmovisorEnv makes the test binary run main, so the chaos tests see real exit codes
+const runAsCosmovisorEnv = "CHAOS_RUN_COSMOVISOR"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runAsCosmovisorEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// chaosHome is a copy of the validate fixture: genesis prints the chain2 upgrade, which is staged
+type chaosHome struct {
+	t   *testing.T
+	cfg *cosmovisor.Config
+}
+
+func newChaosHome(t *testing.T) *chaosHome {
+	home := t.TempDir()
+	require.NoError(t, copy.Copy(filepath.Join("..", "..", "testdata", "validate"), home))
+	return &chaosHome{t: t, cfg: &cosmovisor.Config{Home: home, Name: "dummyd"}}
+}
+
+// run runs cosmovisor with the faults and extra environment, returning its exit code and output
+func (h *chaosHome) run(faults string, env ...string) (int, string) {
+	cmd := exec.Command(os.Args[0], "run", "start")
+	cmd.Env = append(os.Environ(),
+		runAsCosmovisorEnv+"=1",
+		"DAEMON_HOME="+h.cfg.Home,
+		"DAEMON_NAME="+h.cfg.Name,
+		cosmovisor.FaultsEnv+"="+faults,
+	)
+	cmd.Env = append(cmd.Env, env...)
+	out, err := cmd.CombinedOutput()
+	if exit, ok := err.(*exec.ExitError); ok {
+		return exit.ExitCode(), string(out)
+	}
+	require.NoError(h.t, err)
+	return 0, string(out)
+}
+
+// requireCurrent asserts the current link points to the named upgrade, or genesis if empty
+func (h *chaosHome) requireCurrent(upgrade string) {
+	want := h.cfg.GenesisBin()
+	if upgrade != "" {
+		want = h.cfg.UpgradeBin(upgrade)
+	}
+	got, err := h.cfg.CurrentBin()
+	require.NoError(h.t, err)
+	require.Equal(h.t, want, got)
+	_, err = os.Lstat(filepath.Join(h.cfg.Root(), "current.tmp"))
+	require.True(h.t, os.IsNotExist(err), "temporary link left behind")
+}
+
+// requireRecovers asserts that a run without faults completes the chain2 upgrade
+func (h *chaosHome) requireRecovers(env ...string) {
+	code, out := h.run("", env...)
+	require.Equal(h.t, cosmovisor.ExitCodeUpgraded, code, out)
+	h.requireCurrent("chain2")
+}
+
+func (h *chaosHome) writeFile(path, content string, mode os.FileMode) {
+	require.NoError(h.t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(h.t, ioutil.WriteFile(path, []byte(content), mode))
+}
+
+func (h *chaosHome) genesisHash() string {
+	bz, err := ioutil.ReadFile(h.cfg.GenesisBin())
+	require.NoError(h.t, err)
+	sum := sha256.Sum256(bz)
+	return hex.EncodeToString(sum[:])
+}
+
+// dropHotfix places a valid hotfix for the genesis binary
+func (h *chaosHome) dropHotfix() {
+	h.writeFile(filepath.Join(h.cfg.HotfixDir(), "dummyd"), "#!/bin/sh\necho Patched $@\n", 0755)
+	h.writeFile(filepath.Join(h.cfg.HotfixDir(), "hotfix.json"), fmt.Sprintf(`{"base_sha256": "%s"}`, h.genesisHash()), 0644)
+}
+
+func TestChaosLaunchFails(t *testing.T) {
+	h := newChaosHome(t)
+	code, out := h.run("launch.start=error")
+	require.Equal(t, cosmovisor.ExitCodeFailure, code, out)
+	require.Contains(t, out, "injected fault at launch.start")
+	h.requireCurrent("")
+	h.requireRecovers()
+}
+
+func TestChaosRelaunchFailsAfterUpgrade(t *testing.T) {
+	h := newChaosHome(t)
+	// the first launch works, the restart after the upgrade fails
+	code, out := h.run("launch.start@2=error", "DAEMON_RESTART_AFTER_UPGRADE=true")
+	require.Equal(t, cosmovisor.ExitCodeFailure, code, out)
+	require.Contains(t, out, "Genesis start")
+	h.requireCurrent("chain2")
+}
+
+func TestChaosPanicWhileRunning(t *testing.T) {
+	h := newChaosHome(t)
+	code, out := h.run("upgrade.detect=panic")
+	require.Equal(t, cosmovisor.ExitCodeCrash, code, out)
+	require.Contains(t, out, "ERR [cosmovisor] cosmovisor crashed during running")
+
+	// the crash is reported and the daemon was stopped, the upgrade wasn't touched
+	reports, err := h.cfg.CrashReports()
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	report, err := ioutil.ReadFile(reports[0])
+	require.NoError(t, err)
+	require.Contains(t, string(report), "injected fault at upgrade.detect")
+	require.Contains(t, string(report), "daemon: stopping daemon (pid")
+	h.requireCurrent("")
+	h.requireRecovers()
+}
+
+func TestChaosPlanFails(t *testing.T) {
+	h := newChaosHome(t)
+	code, out := h.run("upgrade.plan=error")
+	require.Equal(t, cosmovisor.ExitCodeFailure, code, out)
+	require.Contains(t, out, "injected fault at upgrade.plan")
+	h.requireCurrent("")
+	h.requireRecovers()
+}
+
+func TestChaosDownloadDropped(t *testing.T) {
+	h := newChaosHome(t)
+	binary, err := filepath.Abs(filepath.Join("..", "..", "testdata", "repo", "raw_binary", "autod"))
+	require.NoError(t, err)
+	h.writeFile(h.cfg.GenesisBin(), fmt.Sprintf("#!/bin/sh\necho 'UPGRADE \"chain9\" NEEDED at height: 49: {\"binaries\":{\"%s\":\"%s\"}}'\nsleep 5\n", cosmovisor.OSArch(), binary), 0755)
+
+	// the download is cut off after the file was written
+	code, out := h.run("download.fetch=error", "DAEMON_ALLOW_DOWNLOAD_BINARIES=true")
+	require.Equal(t, cosmovisor.ExitCodeDownload, code, out)
+	require.Contains(t, out, "cannot download binary")
+	h.requireCurrent("")
+	_, err = os.Stat(h.cfg.UpgradeDir("chain9"))
+	require.True(t, os.IsNotExist(err), "partial download left behind")
+
+	// the next start downloads it again
+	code, out = h.run("", "DAEMON_ALLOW_DOWNLOAD_BINARIES=true")
+	require.Equal(t, cosmovisor.ExitCodeUpgraded, code, out)
+	h.requireCurrent("chain9")
+}
+
+func TestChaosDownloadDroppedMidStream(t *testing.T) {
+	h := newChaosHome(t)
+	binary, err := ioutil.ReadFile(filepath.Join("..", "..", "testdata", "repo", "raw_binary", "autod"))
+	require.NoError(t, err)
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("ETag", `"autod"`)
+		http.ServeContent(w, r, "autod", time.Time{}, strings.NewReader(string(binary)))
+	}))
+	defer srv.Close()
+	h.writeFile(h.cfg.GenesisBin(), fmt.Sprintf("#!/bin/sh\necho 'UPGRADE \"chain9\" NEEDED at height: 49: {\"binaries\":{\"%s\":\"%s/autod\"}}'\nsleep 5\n", cosmovisor.OSArch(), srv.URL), 0755)
+	download := []string{"DAEMON_ALLOW_DOWNLOAD_BINARIES=true", "DAEMON_DOWNLOAD_ATTEMPTS=1"}
+
+	// the connection drops at 90% of the binary, what was received is kept
+	code, out := h.run("download.stream=error", download...)
+	require.Equal(t, cosmovisor.ExitCodeDownload, code, out)
+	require.Contains(t, out, "injected fault at download.stream")
+	h.requireCurrent("")
+	parts, err := filepath.Glob(filepath.Join(h.cfg.StateDir(), "downloads", "*.part"))
+	require.NoError(t, err)
+	require.Len(t, parts, 1)
+	fi, err := os.Stat(parts[0])
+	require.NoError(t, err)
+	kept := int64(len(binary)) * 9 / 10
+	require.Equal(t, kept, fi.Size())
+
+	// the next start asks for the rest only
+	code, out = h.run("", download...)
+	require.Equal(t, cosmovisor.ExitCodeUpgraded, code, out)
+	h.requireCurrent("chain9")
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"", fmt.Sprintf("bytes=%d-", kept)}, ranges)
+	staged, err := ioutil.ReadFile(h.cfg.UpgradeBin("chain9"))
+	require.NoError(t, err)
+	require.Equal(t, binary, staged)
+}
+
+func TestChaosBackupKilled(t *testing.T) {
+	for _, mode := range []string{"archive", "copy"} {
+		t.Run(mode, func(t *testing.T) {
+			h := newChaosHome(t)
+			for i := 0; i < 6; i++ {
+				h.writeFile(filepath.Join(h.cfg.DataDir(), fmt.Sprintf("blocks-%d.db", i)), strings.Repeat("block", 1000), 0644)
+			}
+			backups := t.TempDir()
+			backup := []string{"DAEMON_DATA_BACKUP=" + mode, "DAEMON_DATA_BACKUP_DIR=" + backups}
+
+			// cosmovisor dies halfway through the data directory, the partial backup stays
+			code, out := h.run("backup.data@4=panic", backup...)
+			require.Equal(t, cosmovisor.ExitCodeCrash, code, out)
+			require.Contains(t, out, "injected fault at backup.data")
+			h.requireCurrent("")
+			partial, err := filepath.Glob(filepath.Join(backups, "*.tmp"))
+			require.NoError(t, err)
+			require.Len(t, partial, 1)
+
+			// the next start removes it, backs up the whole data directory and runs chain2
+			code, out = h.run("", backup...)
+			require.Equal(t, 0, code, out)
+			require.Contains(t, out, "resuming it after step downloaded")
+			require.Contains(t, out, "Chain 2 is live!")
+			h.requireCurrent("chain2")
+			partial, err = filepath.Glob(filepath.Join(backups, "*.tmp"))
+			require.NoError(t, err)
+			require.Empty(t, partial)
+			h.cfg.DataBackupDir = backups
+			list, err := h.cfg.DataBackups()
+			require.NoError(t, err)
+			require.Len(t, list, 1)
+		})
+	}
+}
+
+func TestChaosExportHangs(t *testing.T) {
+	export := []string{"DAEMON_PRE_UPGRADE_EXPORT=true", "DAEMON_PRE_UPGRADE_EXPORT_TIMEOUT=1s"}
+
+	// warn: the upgrade goes on without the export
+	h := newChaosHome(t)
+	code, out := h.run("export.run=hang", export...)
+	require.Equal(t, cosmovisor.ExitCodeUpgraded, code, out)
+	require.Contains(t, out, "export didn't finish within 1s")
+	require.Contains(t, out, "continuing upgrade without export")
+	h.requireCurrent("chain2")
+
+	// abort: the old binary stays current
+	h = newChaosHome(t)
+	code, out = h.run("export.run=hang", append(export, "DAEMON_PRE_UPGRADE_EXPORT_POLICY=abort")...)
+	require.Equal(t, cosmovisor.ExitCodeFailure, code, out)
+	require.Contains(t, out, "export didn't finish within 1s")
+	h.requireCurrent("")
+}
+
+func TestChaosPreUpgradeFails(t *testing.T) {
+	// retried like a pre-upgrade exiting with 1
+	h := newChaosHome(t)
+	code, out := h.run("preupgrade.run@1=error", "DAEMON_PREUPGRADE_MAX_RETRIES=1")
+	require.Equal(t, cosmovisor.ExitCodeUpgraded, code, out)
+	require.Contains(t, out, "retrying in 1s")
+	h.requireCurrent("chain2")
+
+	// without retries the upgrade fails, the next start applies it
+	h = newChaosHome(t)
+	code, out = h.run("preupgrade.run=error")
+	require.Equal(t, cosmovisor.ExitCodeFailure, code, out)
+	require.Contains(t, out, "injected fault at preupgrade.run")
+	h.requireCurrent("")
+	h.requireRecovers()
+}
+
+func TestChaosSwitchFails(t *testing.T) {
+	for _, point := range []string{"switch.symlink", "switch.rename"} {
+		t.Run(point, func(t *testing.T) {
+			h := newChaosHome(t)
+			code, out := h.run(point + "=error")
+			require.Equal(t, cosmovisor.ExitCodeFailure, code, out)
+			require.Contains(t, out, "injected fault at "+point)
+			// the link still points to the old binary, never to nothing
+			h.requireCurrent("")
+			h.requireRecovers()
+		})
+	}
+}
+
+func TestChaosHotfixFails(t *testing.T) {
+	for _, point := range []string{"hotfix.apply", "hotfix.smoke"} {
+		t.Run(point, func(t *testing.T) {
+			h := newChaosHome(t)
+			original := h.genesisHash()
+			h.dropHotfix()
+
+			// the hotfix is rejected, the daemon runs the unchanged binary and upgrades
+			code, out := h.run(point + "=error")
+			require.Equal(t, cosmovisor.ExitCodeUpgraded, code, out)
+			require.Contains(t, out, "rejecting hotfix")
+			require.Contains(t, out, "Genesis start")
+			require.Equal(t, original, h.genesisHash())
+			_, err := os.Stat(filepath.Join(h.cfg.HotfixDir(), "hotfix.json.rejected"))
+			require.NoError(t, err)
+			h.requireCurrent("chain2")
+			require.False(t, strings.Contains(out, "Patched"))
+		})
+	}
+}
+
+func TestChaosPlanWatchFails(t *testing.T) {
+	h := newChaosHome(t)
+	plan := filepath.Join(h.cfg.DataDir(), "upgrade-info.json")
+	require.NoError(t, os.MkdirAll(h.cfg.DataDir(), 0755))
+	h.writeFile(h.cfg.GenesisBin(), fmt.Sprintf("#!/bin/sh\necho Genesis\necho '{\"name\":\"chain2\",\"height\":49}' > %s\nexec sleep 10\n", plan), 0755)
+
+	// the plan file is read every so often instead of watched, the upgrade happens anyway
+	code, out := h.run("watch.plan=error")
+	require.Equal(t, cosmovisor.ExitCodeUpgraded, code, out)
+	require.Contains(t, out, "injected fault at watch.plan")
+	h.requireCurrent("chain2")
+}
+
+func TestChaosExitCodes(t *testing.T) {
+	cases := map[string]struct {
+		daemon string
+		env    []string
+		code   int
+	}{
+		"daemon fails":   {daemon: "#!/bin/sh\nexit 3\n", code: 3},
+		"daemon killed":  {daemon: "#!/bin/sh\nkill -KILL $$\n", code: 128 + 9},
+		"daemon done":    {daemon: "#!/bin/sh\necho done\n", code: 0},
+		"invalid config": {env: []string{"DAEMON_STOP_SIGNAL=KILL"}, code: cosmovisor.ExitCodeConfig},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			h := newChaosHome(t)
+			if tc.daemon != "" {
+				h.writeFile(h.cfg.GenesisBin(), tc.daemon, 0755)
+			}
+			code, out := h.run("", tc.env...)
+			require.Equal(t, tc.code, code, out)
+		})
+	}
+}
@@ -0,0 +1,1155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cosmos/cosmos-sdk/cosmovisor"
+)
+
+// loadConfig reads the config from the environment and applies its log level and format
+func loadConfig() (*cosmovisor.Config, error) {
+	cfg, err := cosmovisor.GetConfigFromEnv()
+	if err != nil {
+		return nil, configError{err}
+	}
+	cosmovisor.ConfigureLogging(cfg)
+	return cfg, nil
+}
+
+// inspectConfig reads the config for a command that only inspects the home, which may
+// belong to a node supervised by another cosmovisor process right now
+func inspectConfig() (*cosmovisor.Config, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.ReadOnly = true
+	cfg.DetectImmutableLayout()
+	return cfg, nil
+}
+
+// runDaemon supervises the daemon started with args
+func runDaemon(args []string, stdout, stderr io.Writer) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if !cfg.Supervises(args) {
+		cfg.DetectImmutableLayout()
+		return cosmovisor.Passthrough(cfg, args, stdout, stderr)
+	}
+	if cfg.RunsAsInit() {
+		return runInit(args)
+	}
+	defer cosmovisor.RecoverCrash(cfg)
+	if reason := cfg.DetectImmutableLayout(); reason != "" {
+		cosmovisor.Log().Infof("immutable layout: %s, keeping state in %s", reason, cfg.StateDir())
+	}
+	if err := cfg.CheckSetup(); err != nil {
+		return configError{err}
+	}
+	if err := useTmpDir(cfg); err != nil {
+		return configError{fmt.Errorf("temporary directory: %w", err)}
+	}
+	cosmovisor.RegisterWebhook(cfg)
+	if err := cosmovisor.RegisterEmail(cfg); err != nil {
+		return configError{err}
+	}
+	if cfg.MetricsAddr != "" || cfg.HealthAddr != "" {
+		stop, err := cosmovisor.ServeHTTP(cfg)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		if cfg.MetricsAddr != "" {
+			cosmovisor.Log().Infof("serving metrics on http://%s/metrics", cfg.MetricsAddr)
+		}
+		if cfg.HealthAddr != "" {
+			cosmovisor.Log().Infof("serving health on http://%s/healthz and status on http://%s/status", cfg.HealthAddr, cfg.HealthAddr)
+		}
+	}
+	if cfg.MetricsPushURL != "" {
+		defer cosmovisor.StartMetricsPush(cfg)()
+		cosmovisor.Log().Infof("pushing metrics to %s", cfg.MetricsPushURL)
+	}
+	if cfg.AdminSocket != "" {
+		stop, err := cosmovisor.ServeAdmin(cfg)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		cosmovisor.Log().Infof("serving the admin API on %s", cfg.AdminSocket)
+	}
+
+	queue, err := cfg.UpgradeQueue()
+	if err != nil {
+		return fmt.Errorf("invalid upgrade queue in %s: %w", cfg.QueueDir(), err)
+	}
+	for i, plan := range queue {
+		cosmovisor.Log().Infof("queued upgrade %d: %q at height %d (%s)", i+1, plan.Name, plan.Height, plan.File)
+	}
+	if err := cosmovisor.RepairCurrent(cfg); err != nil {
+		return err
+	}
+	if err := cosmovisor.StartupPlanCheck(cfg); err != nil {
+		return err
+	}
+
+	return cosmovisor.Supervise(cfg, args, stdout, stderr)
+}
+
+// execDaemon applies a pending upgrade and replaces cosmovisor by the daemon started with args
+func execDaemon(args []string, _, _ io.Writer) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	defer cosmovisor.RecoverCrash(cfg)
+	if reason := cfg.DetectImmutableLayout(); reason != "" {
+		cosmovisor.Log().Infof("immutable layout: %s, keeping state in %s", reason, cfg.StateDir())
+	}
+	if err := cfg.CheckSetup(); err != nil {
+		return configError{err}
+	}
+	return cosmovisor.ExecDaemon(cfg, args)
+}
+
+// runHomes supervises the nodes listed in the homes file, each by a cosmovisor of its own
+func runHomes(args []string, stdout, stderr io.Writer) error {
+	if len(args) != 1 {
+		return usageError{fmt.Errorf("usage: cosmovisor run-homes <homes.toml>")}
+	}
+	hc, err := cosmovisor.LoadHomesConfig(args[0])
+	if err != nil {
+		return configError{err}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if hc.MetricsAddr != "" {
+		cosmovisor.Log().Infof("serving the metrics of all homes on %s/metrics", hc.MetricsAddr)
+	}
+	if hc.HealthAddr != "" {
+		cosmovisor.Log().Infof("serving the health of all homes on %s/healthz and their status on %s/status", hc.HealthAddr, hc.HealthAddr)
+	}
+	return cosmovisor.RunHomes(context.Background(), exe, hc, stdout, stderr)
+}
+
+// runInit runs cosmovisor as the init of a container: it supervises the daemon in a child
+// cosmovisor started with the same arguments, and only reaps zombies and relays signals
+func runInit(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cosmovisor.Log().Infof("running as init (pid %d), supervising the daemon in a child process", os.Getpid())
+	// the child mustn't run as init again, whatever DAEMON_INIT says
+	env := []string{cosmovisor.InitEnv + "=" + string(cosmovisor.InitOff)}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, cosmovisor.InitEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	return cosmovisor.RunInit(append([]string{exe, "run"}, args...), env)
+}
+
+// initHome creates the cosmovisor directory of a new node
+func initHome(args []string, _, _ io.Writer) error {
+	if len(args) != 1 {
+		return usageError{fmt.Errorf("usage: cosmovisor init <path-to-binary>")}
+	}
+	// the cosmovisor directory doesn't exist yet, GetConfigFromEnv would refuse it
+	cfg := &cosmovisor.Config{Home: os.Getenv("DAEMON_HOME"), Name: os.Getenv("DAEMON_NAME")}
+	return cosmovisor.InitLayout(cfg, args[0])
+}
+
+// initService prints a service definition running the daemon with the DAEMON_* variables
+// set now, the daemon args default to start
+func initService(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor init-service [--openrc] [--user NAME] [--watchdog D] [-- daemon args]")}
+	flags := flag.NewFlagSet("init-service", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	openrc := flags.Bool("openrc", false, "print an OpenRC init script instead of a systemd unit")
+	user := flags.String("user", "", "the user running the service, root by default")
+	watchdog := flags.Duration("watchdog", 0, "the systemd watchdog interval, e.g. 60s, off by default")
+	if err := flags.Parse(args); err != nil || *watchdog < 0 {
+		return usage
+	}
+	cfg, err := inspectConfig()
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	opts := cosmovisor.ServiceOptions{Executable: exe, Args: flags.Args(), User: *user, Watchdog: *watchdog}
+	if len(opts.Args) == 0 {
+		opts.Args = []string{"start"}
+	}
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "DAEMON_") {
+			opts.Env = append(opts.Env, kv)
+		}
+	}
+	if *openrc {
+		return cosmovisor.WriteOpenRCScript(stdout, cfg, opts)
+	}
+	return cosmovisor.WriteSystemdUnit(stdout, cfg, opts)
+}
+
+// stdin answers the questions of setup
+var stdin io.Reader = os.Stdin
+
+// setup takes a fresh host to a supervised node. The choices not given as flags are asked
+// on stdin, the environment and the binary giving the defaults, or with --yes taken from
+// the defaults without asking.
+func setup(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor setup [--home PATH] [--name NAME] [--binary PATH] [--allow-download] [--data-backup MODE] [--data-backup-dir PATH] [--systemd PATH] [--user NAME] [--yes]")}
+	flags := flag.NewFlagSet("setup", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	home := flags.String("home", os.Getenv("DAEMON_HOME"), "the node home, DAEMON_HOME")
+	name := flags.String("name", os.Getenv("DAEMON_NAME"), "the name of the binary, DAEMON_NAME, the name of the genesis binary by default")
+	binary := flags.String("binary", "", "the genesis binary")
+	var opts cosmovisor.SetupOptions
+	flags.BoolVar(&opts.AllowDownloadBinaries, "allow-download", false, "download the binaries of the upgrades")
+	flags.StringVar(&opts.DataBackup, "data-backup", "none", "back up the data directory before the upgrades: none, archive, copy or snapshot")
+	flags.StringVar(&opts.DataBackupDir, "data-backup-dir", "", "the directory of the data backups")
+	flags.StringVar(&opts.Unit, "systemd", "", "write a systemd unit to the path, e.g. /etc/systemd/system/gaiad.service")
+	flags.StringVar(&opts.Service.User, "user", "", "the user running the service, root by default")
+	yes := flags.Bool("yes", false, "take the defaults of the choices not given as flags instead of asking")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return usage
+	}
+	given := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	p := prompter{in: bufio.NewReader(stdin), out: stdout, yes: *yes}
+	p.ask(given["home"], "Node home (DAEMON_HOME)", home)
+	p.ask(given["binary"], "Genesis binary", binary)
+	if *name == "" && *binary != "" {
+		*name = filepath.Base(*binary)
+	}
+	p.ask(given["name"], "Binary name (DAEMON_NAME)", name)
+	p.confirm(given["allow-download"], "Download the binaries of the upgrades", &opts.AllowDownloadBinaries)
+	p.ask(given["data-backup"], "Data backup before the upgrades (none, archive, copy, snapshot)", &opts.DataBackup)
+	if opts.DataBackup != "none" {
+		p.ask(given["data-backup-dir"], "Data backup directory (empty for the state directory)", &opts.DataBackupDir)
+	}
+	p.ask(given["systemd"], "Write a systemd unit to (empty for none)", &opts.Unit)
+	if opts.Unit != "" {
+		p.ask(given["user"], "User running the service (empty for root)", &opts.Service.User)
+	}
+	if p.err != nil {
+		return p.err
+	}
+	if *binary == "" {
+		return usageError{fmt.Errorf("the genesis binary is needed, set --binary")}
+	}
+
+	cfg := &cosmovisor.Config{Home: *home, Name: *name}
+	if cfg.Home != "" {
+		abs, err := filepath.Abs(cfg.Home)
+		if err != nil {
+			return err
+		}
+		cfg.Home = abs
+	}
+	if opts.Unit != "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		if exe, err = filepath.EvalSymlinks(exe); err != nil {
+			return err
+		}
+		opts.Service.Executable = exe
+		opts.Service.Args = []string{"start"}
+	}
+	opts.Genesis = *binary
+	if err := cosmovisor.Setup(cfg, opts); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s is set up for %s, the settings are in %s\n", cfg.Home, cfg.Name, cfg.ConfigFile())
+	if opts.Unit != "" {
+		fmt.Fprintf(stdout, "start the node with: systemctl daemon-reload && systemctl enable --now %s\n", filepath.Base(opts.Unit))
+	}
+	return nil
+}
+
+// prompter asks the questions of setup, keeping the first error
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	yes bool
+	err error
+}
+
+// ask asks for v, unless it was given or the defaults are taken. An empty answer keeps v,
+// a single - clears it.
+func (p *prompter) ask(given bool, question string, v *string) {
+	if given || p.yes || p.err != nil {
+		return
+	}
+	if *v != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, *v)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	answer, err := p.in.ReadString('\n')
+	if err != nil && err != io.EOF {
+		p.err = err
+		return
+	}
+	switch answer = strings.TrimSpace(answer); answer {
+	case "":
+	case "-":
+		*v = ""
+	default:
+		*v = answer
+	}
+}
+
+// confirm asks a yes or no question for v, like ask
+func (p *prompter) confirm(given bool, question string, v *bool) {
+	for {
+		answer := "n"
+		if *v {
+			answer = "y"
+		}
+		p.ask(given, question+" (y/n)", &answer)
+		if p.err != nil {
+			return
+		}
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			*v = true
+			return
+		case "n", "no":
+			*v = false
+			return
+		}
+		fmt.Fprintf(p.out, "please answer y or n\n")
+	}
+}
+
+// addUpgrade stages the binary of an upgrade, flags may come before or after the arguments
+func addUpgrade(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor add-upgrade <name> <path-or-url> [--height N] [--force]")}
+	flags := flag.NewFlagSet("add-upgrade", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var opts cosmovisor.AddUpgradeOptions
+	flags.Int64Var(&opts.Height, "height", 0, "height the upgrade is expected at")
+	flags.BoolVar(&opts.Force, "force", false, "replace a different binary staged before")
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return usage
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(positional) != 2 || opts.Height < 0 {
+		return usage
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.DetectImmutableLayout()
+	if err := useTmpDir(cfg); err != nil {
+		return err
+	}
+	staged, err := cosmovisor.AddUpgrade(cfg, positional[0], positional[1], opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "upgrade %q staged in %s\n", staged.Name, cfg.UpgradeBin(staged.Name))
+	return nil
+}
+
+// printVersion prints the build info of cosmovisor, then runs `<daemon> version` with args.
+// With `--output json` (or `-o json`), which the daemon gets too, both are printed as JSON.
+func printVersion(args []string, stdout, stderr io.Writer) error {
+	build := cosmovisor.GetBuildInfo()
+	if !jsonOutput(args) {
+		fmt.Fprintf(stdout, "cosmovisor version: %s\n", build.Version)
+		if build.Commit != "" {
+			fmt.Fprintf(stdout, "cosmovisor commit: %s\n", build.Commit)
+		}
+		fmt.Fprintf(stdout, "cosmovisor build: %s %s\n", build.GoVersion, build.Platform)
+	}
+	versions := struct {
+		Cosmovisor cosmovisor.BuildInfo    `json:"cosmovisor"`
+		Daemon     *cosmovisor.DaemonBuild `json:"daemon,omitempty"`
+	}{Cosmovisor: build}
+	cfg, err := inspectConfig()
+	if err == nil {
+		versions.Daemon, err = cosmovisor.GetDaemonBuild(cfg, args, stderr)
+	}
+
+	if jsonOutput(args) {
+		bz, jerr := json.MarshalIndent(versions, "", "  ")
+		if jerr != nil {
+			return jerr
+		}
+		fmt.Fprintf(stdout, "%s\n", bz)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	daemon := versions.Daemon
+	version := "genesis"
+	if daemon.Upgrade != "" {
+		version = fmt.Sprintf("upgrade %q", daemon.Upgrade)
+	}
+	fmt.Fprintf(stdout, "%s binary: %s (%s, sha256 %s)\n", daemon.Name, daemon.Binary, version, daemon.SHA256)
+	_, err = stdout.Write(daemon.Output)
+	return err
+}
+
+// jsonOutput returns true if the version flags ask for JSON, like the SDK's version command
+func jsonOutput(args []string) bool {
+	for i, arg := range args {
+		switch arg {
+		case "--output=json", "-o=json":
+			return true
+		case "--output", "-o":
+			if i+1 < len(args) && args[i+1] == "json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// printConfig prints the settings in effect, or checks them with `config validate`, as text
+// or with `--output json` as JSON
+func printConfig(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor config [validate] [--output json]")}
+	flags := flag.NewFlagSet("config", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var output string
+	flags.StringVar(&output, "output", "", "print as json")
+	flags.StringVar(&output, "o", "", "print as json")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil || output != "" && output != "json" || len(positional) > 1 || len(positional) == 1 && positional[0] != "validate" {
+		return usage
+	}
+
+	if len(positional) == 1 {
+		err := cosmovisor.CheckConfigFromEnv()
+		if output == "json" {
+			validation := struct {
+				Valid    bool     `json:"valid"`
+				Problems []string `json:"problems"`
+			}{Valid: err == nil, Problems: []string{}}
+			if errs, ok := err.(cosmovisor.ConfigErrors); ok {
+				for _, e := range errs {
+					validation.Problems = append(validation.Problems, e.Error())
+				}
+			} else if err != nil {
+				validation.Problems = append(validation.Problems, err.Error())
+			}
+			if jerr := writeJSON(stdout, validation); jerr != nil {
+				return jerr
+			}
+		}
+		if err != nil {
+			return configError{err}
+		}
+		if output != "json" {
+			fmt.Fprintln(stdout, "the configuration is valid")
+		}
+		return nil
+	}
+	cfg, err := inspectConfig()
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		return writeJSON(stdout, cfg.Settings())
+	}
+	return cosmovisor.WriteSettings(stdout, cfg.Settings())
+}
+
+// printStatus prints the state of the home and of the daemon supervised for it, or with
+// `--history` the changes cosmovisor made to the binary, as text or with `--output json`
+// as JSON
+func printStatus(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor status [--history] [--output json]")}
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var output string
+	flags.StringVar(&output, "output", "", "print as json")
+	flags.StringVar(&output, "o", "", "print as json")
+	history := flags.Bool("history", false, "print the upgrades, hotfixes and rollbacks applied instead")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 || output != "" && output != "json" {
+		return usage
+	}
+	cfg, err := inspectConfig()
+	if err != nil {
+		return err
+	}
+	if *history {
+		return writeHistory(cfg, output, stdout)
+	}
+	status, err := cosmovisor.GetStatus(cfg)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		return writeJSON(stdout, status)
+	}
+	return cosmovisor.WriteStatus(stdout, status)
+}
+
+// printHistory prints the changes cosmovisor made to the binary, like `status --history`
+func printHistory(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor history [--output json]")}
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var output string
+	flags.StringVar(&output, "output", "", "print as json")
+	flags.StringVar(&output, "o", "", "print as json")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 || output != "" && output != "json" {
+		return usage
+	}
+	cfg, err := inspectConfig()
+	if err != nil {
+		return err
+	}
+	return writeHistory(cfg, output, stdout)
+}
+
+// writeHistory prints the upgrade history of cfg as text, or as JSON if output is json
+func writeHistory(cfg *cosmovisor.Config, output string, stdout io.Writer) error {
+	entries, err := cfg.UpgradeHistory()
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		return writeJSON(stdout, entries)
+	}
+	return cosmovisor.WriteHistory(stdout, entries)
+}
+
+// bundle exports what was recorded about an upgrade, its snapshot, history, events and
+// journal, as a tar.gz archive for the investigation of an upgrade that went wrong
+func bundle(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor bundle <name> [--file <path>]")}
+	flags := flag.NewFlagSet("bundle", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	file := flags.String("file", "", "the archive to write, <name>-bundle.tar.gz by default, - for stdout")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil || len(positional) != 1 {
+		return usage
+	}
+	name := positional[0]
+	if err := cosmovisor.ValidateUpgradeName(name); err != nil {
+		return usageError{err}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.DetectImmutableLayout()
+	if *file == "-" {
+		return cfg.WriteUpgradeBundle(name, stdout)
+	}
+	path := *file
+	if path == "" {
+		path = url.PathEscape(name) + "-bundle.tar.gz"
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := cfg.WriteUpgradeBundle(name, f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "wrote the bundle of upgrade %q to %s\n", name, path)
+	return nil
+}
+
+// parseInterspersed parses flags given before, between or after the positional arguments,
+// which it returns
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// writeJSON prints v as indented JSON
+func writeJSON(w io.Writer, v interface{}) error {
+	bz, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", bz)
+	return err
+}
+
+// explain prints what cosmovisor will do for the named upgrade (optionally with its plan info),
+// without launching the daemon or changing anything, as text or with `--output json` as JSON
+func explain(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor explain [upgrade-name] [plan-info] [--output json]")}
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var output string
+	flags.StringVar(&output, "output", "", "print as json")
+	flags.StringVar(&output, "o", "", "print as json")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil || output != "" && output != "json" || len(positional) > 2 {
+		return usage
+	}
+	cfg, err := inspectConfig()
+	if err != nil {
+		return err
+	}
+	info := &cosmovisor.UpgradeInfo{Name: "next"}
+	if len(positional) > 0 {
+		info.Name = positional[0]
+	}
+	if len(positional) > 1 {
+		info.Info = positional[1]
+	}
+	if output == "json" {
+		return writeJSON(stdout, cosmovisor.Explain(cfg, info))
+	}
+	return cosmovisor.WriteExplanation(stdout, cosmovisor.Explain(cfg, info))
+}
+
+// simulateUpgrade rehearses an upgrade, named or read from a plan file, without touching
+// the node, and fails if the upgrade would
+func simulateUpgrade(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor simulate-upgrade <name> [plan-info] | --plan-file <path> [--output json]")}
+	flags := flag.NewFlagSet("simulate-upgrade", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var output, planFile string
+	flags.StringVar(&output, "output", "", "print as json")
+	flags.StringVar(&output, "o", "", "print as json")
+	flags.StringVar(&planFile, "plan-file", "", "upgrade-info.json to take the upgrade from")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil || output != "" && output != "json" || planFile == "" && (len(positional) == 0 || len(positional) > 2) || planFile != "" && len(positional) > 0 {
+		return usage
+	}
+
+	cfg, err := inspectConfig()
+	if err != nil {
+		return err
+	}
+	var info *cosmovisor.UpgradeInfo
+	if planFile != "" {
+		if info, err = cosmovisor.ReadPlanFile(planFile); err != nil {
+			return err
+		}
+	} else {
+		info = &cosmovisor.UpgradeInfo{Name: positional[0]}
+		if len(positional) > 1 {
+			info.Info = positional[1]
+		}
+	}
+	sim := cosmovisor.SimulateUpgrade(cfg, info)
+	if output == "json" {
+		err = writeJSON(stdout, sim)
+	} else {
+		err = cosmovisor.WriteSimulation(stdout, sim)
+	}
+	if err != nil {
+		return err
+	}
+	if failed := sim.Failed(); failed != nil {
+		return fmt.Errorf("upgrade %q would fail at %s: %s", info.Name, failed.Step, failed.Result)
+	}
+	return nil
+}
+
+// plan prints what changes when the named upgrade applies, and fails if it can't. The
+// arguments after -- are those the daemon is started with, start by default.
+func plan(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor plan <name> [plan-info] [--output json] [-- daemon args]")}
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var output string
+	flags.StringVar(&output, "output", "", "print as json")
+	flags.StringVar(&output, "o", "", "print as json")
+	daemonArgs := []string{"start"}
+	for i, arg := range args {
+		if arg == "--" {
+			args, daemonArgs = args[:i], args[i+1:]
+			break
+		}
+	}
+	positional, err := parseInterspersed(flags, args)
+	if err != nil || output != "" && output != "json" || len(positional) == 0 || len(positional) > 2 {
+		return usage
+	}
+
+	cfg, err := inspectConfig()
+	if err != nil {
+		return err
+	}
+	info := &cosmovisor.UpgradeInfo{Name: positional[0]}
+	if len(positional) > 1 {
+		info.Info = positional[1]
+	}
+	d := cosmovisor.DiffUpgrade(cfg, info, daemonArgs)
+	if output == "json" {
+		err = writeJSON(stdout, d)
+	} else {
+		err = cosmovisor.WriteUpgradeDiff(stdout, d)
+	}
+	if err != nil {
+		return err
+	}
+	if d.Error != "" {
+		return fmt.Errorf("upgrade %q can't be applied: %s", info.Name, d.Error)
+	}
+	return nil
+}
+
+// rehearse runs the new binary of an upgrade against a copy of the node and fails if it
+// doesn't start, the arguments after -- are appended to those of start
+func rehearse(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor rehearse <name> [plan-info] [--backup <path>] [--dir <path>] [--timeout D] [--keep] [--output json] [-- start args]")}
+	flags := flag.NewFlagSet("rehearse", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var output string
+	var opts cosmovisor.RehearseOptions
+	flags.StringVar(&output, "output", "", "print as json")
+	flags.StringVar(&output, "o", "", "print as json")
+	flags.StringVar(&opts.Backup, "backup", "", "the data backup to run against instead of a copy of the data directory")
+	flags.StringVar(&opts.Dir, "dir", "", "where to create the scratch home")
+	flags.DurationVar(&opts.Timeout, "timeout", 0, "how long the binary runs if it commits no block, 2m by default")
+	flags.BoolVar(&opts.Keep, "keep", false, "leave the scratch home in place")
+	for i, arg := range args {
+		if arg == "--" {
+			args, opts.Args = args[:i], args[i+1:]
+			break
+		}
+	}
+	positional, err := parseInterspersed(flags, args)
+	if err != nil || output != "" && output != "json" || len(positional) == 0 || len(positional) > 2 || opts.Timeout < 0 {
+		return usage
+	}
+
+	cfg, err := inspectConfig()
+	if err != nil {
+		return err
+	}
+	info := &cosmovisor.UpgradeInfo{Name: positional[0]}
+	if len(positional) > 1 {
+		info.Info = positional[1]
+	}
+	r := cosmovisor.Rehearse(cfg, info, opts)
+	if output == "json" {
+		err = writeJSON(stdout, r)
+	} else {
+		err = cosmovisor.WriteRehearsal(stdout, r)
+	}
+	if err != nil {
+		return err
+	}
+	if failed := r.Failed(); failed != nil {
+		return fmt.Errorf("rehearsal of upgrade %q failed at %s: %s", info.Name, failed.Step, failed.Result)
+	}
+	return nil
+}
+
+// doctor checks the environment of the node ahead of an upgrade and fails if a check does
+func doctor(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor doctor [--output json]")}
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var output string
+	flags.StringVar(&output, "output", "", "print as json")
+	flags.StringVar(&output, "o", "", "print as json")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 || output != "" && output != "json" {
+		return usage
+	}
+
+	cfg, err := inspectConfig()
+	if err != nil {
+		return err
+	}
+	report := cosmovisor.Doctor(cfg)
+	if output == "json" {
+		err = writeJSON(stdout, report)
+	} else {
+		err = cosmovisor.WriteDoctorReport(stdout, report)
+	}
+	if err != nil {
+		return err
+	}
+	if failed := report.Count(cosmovisor.CheckFail); failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// backup runs `backup verify`, which reads a data backup through and checks it against its
+// manifest. It needs no configuration, the backup may have been moved off the node.
+// `backup list` lists the data backups recorded in the home.
+func backup(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor backup verify <path> | list [--output json]")}
+	if len(args) > 0 && args[0] == "list" {
+		return listBackups(args[1:], usage, stdout, stderr)
+	}
+	if len(args) != 2 || args[0] != "verify" {
+		return usage
+	}
+	manifest, err := cosmovisor.VerifyDataBackup(args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s matches its manifest: %d files, backed up before upgrade %q\n", args[1], len(manifest.Files), manifest.Upgrade)
+	return nil
+}
+
+// listBackups prints the data backups cosmovisor made with their sizes and ages
+func listBackups(args []string, usage error, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("backup list", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var output string
+	flags.StringVar(&output, "output", "", "print as json")
+	flags.StringVar(&output, "o", "", "print as json")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 || output != "" && output != "json" {
+		return usage
+	}
+	cfg, err := inspectConfig()
+	if err != nil {
+		return err
+	}
+	backups, err := cfg.DataBackups()
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		return writeJSON(stdout, backups)
+	}
+	return cosmovisor.WriteDataBackups(stdout, backups, cosmovisor.NowUTC())
+}
+
+// restore replaces the data directory with a data backup, see cosmovisor.Restore
+func restore(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor restore <path> [--reset-current]")}
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var opts cosmovisor.RestoreOptions
+	flags.BoolVar(&opts.ResetCurrent, "reset-current", false, "point current back to the binary that ran before the upgrade")
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return usage
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(positional) != 1 {
+		return usage
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.DetectImmutableLayout()
+	result, err := cosmovisor.Restore(cfg, positional[0], opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s restored from %s, backed up before upgrade %q\n", cfg.DataDir(), positional[0], result.Manifest.Upgrade)
+	if result.Moved != "" {
+		fmt.Fprintf(stdout, "the data directory it replaced was moved to %s\n", result.Moved)
+	}
+	if result.Current != "" {
+		fmt.Fprintf(stdout, "current binary reset to %s\n", result.Current)
+	}
+	return nil
+}
+
+// prune removes the directories of old upgrades, keeping the --keep most recent ones or, by
+// default, as many as DAEMON_UPGRADES_KEEP_RECENT says
+func prune(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor prune [--keep N] [--dry-run]")}
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	keep := flags.Int("keep", 0, "how many of the upgrades applied last to keep, DAEMON_UPGRADES_KEEP_RECENT by default")
+	dryRun := flags.Bool("dry-run", false, "only print the directories that would be removed")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 || *keep < 0 {
+		return usage
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.DetectImmutableLayout()
+	if *keep == 0 {
+		*keep = cfg.UpgradesKeepRecent
+	}
+	if *keep == 0 {
+		return usageError{fmt.Errorf("how many upgrades to keep is unknown, pass --keep N or set DAEMON_UPGRADES_KEEP_RECENT")}
+	}
+	dirs, err := cosmovisor.PruneUpgrades(cfg, *keep, *dryRun)
+	for _, dir := range dirs {
+		if *dryRun {
+			fmt.Fprintf(stdout, "would remove %s\n", dir)
+		} else {
+			fmt.Fprintf(stdout, "removed %s\n", dir)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(dirs) == 0 {
+		fmt.Fprintf(stdout, "nothing to prune, %d upgrades kept\n", *keep)
+	}
+	return nil
+}
+
+// relink makes the absolute links of the home relative, see cosmovisor.Relink
+func relink(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor relink [--from <old home>] [--dry-run]")}
+	flags := flag.NewFlagSet("relink", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	from := flags.String("from", "", "the path the home was moved from, links into it are taken as links into DAEMON_HOME")
+	dryRun := flags.Bool("dry-run", false, "only print the links that would be changed")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return usage
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.DetectImmutableLayout()
+	links, err := cosmovisor.Relink(cfg, *from, *dryRun)
+	for _, l := range links {
+		if *dryRun {
+			fmt.Fprintf(stdout, "would point %s to %s instead of %s\n", l.Link, l.To, l.From)
+		} else {
+			fmt.Fprintf(stdout, "pointed %s to %s instead of %s\n", l.Link, l.To, l.From)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(links) == 0 {
+		fmt.Fprintln(stdout, "no absolute links into the home")
+	}
+	return nil
+}
+
+// selfUpgrade replaces the cosmovisor binary with the one at the URL, see cosmovisor.SelfUpgrade
+func selfUpgrade(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor self-upgrade <url?checksum=...> [--min-version V]")}
+	flags := flag.NewFlagSet("self-upgrade", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var opts cosmovisor.SelfUpgradeOptions
+	flags.StringVar(&opts.Required, "min-version", "", "refuse a binary older than this version")
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return usage
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(positional) != 1 {
+		return usage
+	}
+	opts.Source = positional[0]
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.DetectImmutableLayout()
+	if err := useTmpDir(cfg); err != nil {
+		return err
+	}
+	record, err := cosmovisor.SelfUpgrade(cfg, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "installed cosmovisor %s (sha256 %s) to %s, the previous binary is kept as %s\n", record.Version, record.SHA256, record.Path, record.Previous)
+	fmt.Fprintf(stdout, "a running cosmovisor switches to it before it launches the daemon again, or restart it now\n")
+	return nil
+}
+
+// printEvents prints the event log of the home, the last n events and with follow the
+// events appended to it until cosmovisor is stopped
+func printEvents(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor events [-n N] [--follow] [--output json]")}
+	flags := flag.NewFlagSet("events", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	n := flags.Int("n", 20, "how many of the most recent events to print, 0 for all")
+	follow := flags.Bool("follow", false, "keep printing the events as they are appended")
+	var output string
+	flags.StringVar(&output, "output", "", "print each event as a line of json")
+	flags.StringVar(&output, "o", "", "print each event as a line of json")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 || *n < 0 || output != "" && output != "json" {
+		return usage
+	}
+
+	cfg, err := inspectConfig()
+	if err != nil {
+		return err
+	}
+	write := func(ev cosmovisor.Event) error {
+		if output == "json" {
+			bz, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(stdout, "%s\n", bz)
+			return err
+		}
+		_, err := fmt.Fprintf(stdout, "%s  %-20s  %s\n", ev.Time.Format(time.RFC3339), ev.Type, ev.Message)
+		return err
+	}
+	events, offset, err := cosmovisor.ReadEvents(cfg)
+	if err != nil {
+		return err
+	}
+	if *n > 0 && len(events) > *n {
+		events = events[len(events)-*n:]
+	}
+	for _, ev := range events {
+		if err := write(ev); err != nil {
+			return err
+		}
+	}
+	if !*follow {
+		return nil
+	}
+	return cosmovisor.FollowEvents(context.Background(), cfg, offset, write)
+}
+
+// adminCommand calls the admin API of the cosmovisor supervising the home
+func adminCommand(args []string, stdout, stderr io.Writer) error {
+	usage := usageError{fmt.Errorf("usage: cosmovisor admin <status|restart|upgrade <name>|pause|resume|events [-n N]>")}
+	if len(args) == 0 {
+		return usage
+	}
+	flags := flag.NewFlagSet("admin "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var output string
+	n := 0
+	switch args[0] {
+	case "status":
+		flags.StringVar(&output, "output", "", "print as json")
+		flags.StringVar(&output, "o", "", "print as json")
+	case "events":
+		flags.IntVar(&n, "n", 20, "how many of the most recent events to print, 0 for all that are kept")
+	case "restart", "upgrade", "pause", "resume":
+	default:
+		return usage
+	}
+	if err := flags.Parse(args[1:]); err != nil || output != "" && output != "json" || n < 0 {
+		return usage
+	}
+	wantArgs := 0
+	if args[0] == "upgrade" {
+		wantArgs = 1
+	}
+	if flags.NArg() != wantArgs {
+		return usage
+	}
+
+	cfg, err := inspectConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.AdminSocket == "" {
+		return configError{fmt.Errorf("the admin API is off, set DAEMON_ADMIN_SOCKET")}
+	}
+	client := cosmovisor.NewAdminClient(cfg.AdminSocket)
+	switch args[0] {
+	case "status":
+		status, err := client.Status()
+		if err != nil {
+			return err
+		}
+		if output == "json" {
+			return writeJSON(stdout, status)
+		}
+		if err := cosmovisor.WriteStatus(stdout, status.Status); err != nil {
+			return err
+		}
+		if status.Paused {
+			fmt.Fprintf(stdout, "supervision paused, upgrades are deferred and the daemon isn't launched again once it exits\n")
+		}
+		return nil
+	case "restart":
+		if err := client.Restart(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "restarting the daemon\n")
+	case "upgrade":
+		if err := client.Upgrade(flags.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "applying upgrade %q\n", flags.Arg(0))
+	case "pause":
+		if err := client.Pause(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "supervision paused\n")
+	case "resume":
+		if err := client.Resume(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "supervision resumed\n")
+	case "events":
+		events, err := client.Events(n)
+		if err != nil {
+			return err
+		}
+		for _, ev := range events {
+			fmt.Fprintf(stdout, "%s  %-20s  %s\n", ev.Time.Format(time.RFC3339), ev.Type, ev.Message)
+		}
+	}
+	return nil
+}
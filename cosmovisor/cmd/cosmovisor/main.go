@@ -1,30 +1,163 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/cosmos/cosmos-sdk/cosmovisor"
 )
 
 func main() {
-	if err := Run(os.Args[1:]); err != nil {
-		fmt.Fprintf(os.Stderr, "%+v\n", err)
-		os.Exit(1)
+	// recent log lines end up in crash reports
+	cosmovisor.SetLogOutput(cosmovisor.RecordLogs(os.Stderr))
+	// libraries logging through the standard logger get the same format
+	log.SetFlags(0)
+	log.SetOutput(cosmovisor.LogWriter())
+	err := Run(os.Args[1:])
+	// give upgrade trace exporters and notifiers a chance to finish before exiting
+	cosmovisor.FlushUpgradeTraces(5 * time.Second)
+	cosmovisor.FlushNotifications(5 * time.Second)
+	// the daemon is stopped and the home unlocked, the new cosmovisor takes over
+	var self *cosmovisor.SelfUpgradedError
+	if errors.As(err, &self) {
+		cosmovisor.Log().Infof("%v, running it", self)
+		err = cosmovisor.ExecSelf(self.Record.Path, os.Args[1:])
 	}
+	if err != nil {
+		var usage usageError
+		var upgraded *cosmovisor.UpgradedError
+		var passthrough *cosmovisor.PassthroughExitError
+		if errors.As(err, &usage) {
+			fmt.Fprintln(os.Stderr, err)
+		} else if errors.As(err, &passthrough) {
+			cosmovisor.Log().Debugf("%v", err)
+		} else if errors.As(err, &upgraded) {
+			cosmovisor.Log().Infof("%v", err)
+		} else {
+			cosmovisor.Log().Errorf("%+v", err)
+		}
+		cosmovisor.Exit(exitCode(err))
+	}
+	cosmovisor.Exit(0)
 }
 
-// Run is the main loop, but returns an error
-func Run(args []string) error {
-	cfg, err := cosmovisor.GetConfigFromEnv()
+// useTmpDir points TMPDIR of cosmovisor at the directory of the temporary files, so that
+// go-getter unpacks archives and fetches checksum files there rather than in /tmp. The
+// processes cosmovisor starts get TMPDIR as it was.
+func useTmpDir(cfg *cosmovisor.Config) error {
+	dir, err := cfg.MakeTmpDir()
 	if err != nil {
 		return err
 	}
+	cosmovisor.SaveStartTmpDir()
+	return os.Setenv("TMPDIR", dir)
+}
+
+// configError is an invalid configuration, cosmovisor exits with ExitCodeConfig
+type configError struct {
+	error
+}
+
+func (e configError) Unwrap() error { return e.error }
+
+// usageError is a call with invalid arguments, cosmovisor exits with ExitCodeUsage
+type usageError struct {
+	error
+}
+
+func (e usageError) Unwrap() error { return e.error }
+
+// exitCode is the daemon's exit code, or one of cosmovisor's own
+func exitCode(err error) int {
+	var invalid configError
+	if errors.As(err, &invalid) {
+		return cosmovisor.ExitCodeConfig
+	}
+	var usage usageError
+	if errors.As(err, &usage) {
+		return cosmovisor.ExitCodeUsage
+	}
+	return cosmovisor.ExitCode(err)
+}
+
+// command is a cosmovisor subcommand
+type command struct {
+	name  string
+	args  string
+	short string
+	run   func(args []string, stdout, stderr io.Writer) error
+}
+
+// commands are listed in this order by help, which is not a command itself as it lists them
+var commands = []command{
+	{"run", "<daemon args>", "run the daemon with the arguments and upgrade it when a plan is reached", runDaemon},
+	{"exec", "<daemon args>", "apply the upgrade the node reached, then replace cosmovisor by the current binary without supervising it", execDaemon},
+	{"run-homes", "<homes.toml>", "supervise several nodes, each with its own DAEMON_HOME and DAEMON_NAME, and serve their metrics and status together", runHomes},
+	{"init", "<path-to-binary>", "create the cosmovisor directory with the binary as the genesis binary", initHome},
+	{"init-service", "[--openrc] [--user NAME] [--watchdog D] [-- daemon args]", "print a systemd unit, or an OpenRC script, running cosmovisor with the current configuration", initService},
+	{"setup", "[--home PATH] [--name NAME] [--binary PATH] [--systemd PATH] [--yes]", "set up a fresh host: ask for the home, the name, the genesis binary, downloads and backups, write the config file, create the cosmovisor directory and optionally a systemd unit", setup},
+	{"add-upgrade", "<name> <path-or-url>", "stage the binary of an upgrade ahead of time, flags: --height N, --force", addUpgrade},
+	{"version", "[daemon args]", "print the version of cosmovisor and of the current daemon binary", printVersion},
+	{"config", "[validate] [--output json]", "print the configuration read from the environment, or check it and report all problems", printConfig},
+	{"status", "[--history] [--output json]", "print the running daemon, the current binary, the pending plan, the upgrade queue, hotfixes and crashes, or the upgrade history", printStatus},
+	{"history", "[--output json]", "print the upgrades, hotfixes and rollbacks cosmovisor applied, oldest first", printHistory},
+	{"bundle", "<name> [--file <path>]", "export what was recorded about an upgrade as a tar.gz archive: the snapshot of its environment, its history, events and journal", bundle},
+	{"explain", "[upgrade-name] [plan-info] [--output json]", "print what cosmovisor will do for an upgrade, without changing anything", explain},
+	{"simulate-upgrade", "<name> [plan-info] | --plan-file <path>", "rehearse an upgrade without touching the node: check the plan, download and verify the binary in a scratch directory and measure the room for the backup", simulateUpgrade},
+	{"plan", "<name> [plan-info] [--output json] [-- daemon args]", "print what changes when an upgrade applies: the old and new binary with their hashes, the arguments and environment after the overrides, the hooks, the backups and the disk space they take", plan},
+	{"rehearse", "<name> [plan-info] [--backup <path>] [--dir <path>] [--timeout D] [--keep] [-- start args]", "run the new binary of an upgrade against a copy of the node's data in a scratch home, without peers, and report whether it starts", rehearse},
+	{"doctor", "[--output json]", "check the environment before an upgrade: the current binary, free space, permissions, open files limit, backup directory, download endpoints and conflicting processes", doctor},
+	{"backup", "<verify <path>|list [--output json]>", "check a data backup against the manifest written with it, or list the data backups with their sizes and ages", backup},
+	{"restore", "<path> [--reset-current]", "replace the data directory with a data backup while cosmovisor is stopped, flags: --reset-current", restore},
+	{"admin", "<status|restart|upgrade <name>|pause|resume|events [-n N]>", "control the running cosmovisor through its admin API on DAEMON_ADMIN_SOCKET", adminCommand},
+	{"events", "[-n N] [--follow] [--output json]", "print the recent events of the event log, and with --follow the new ones as they happen", printEvents},
+	{"self-upgrade", "<url?checksum=...>", "replace the cosmovisor binary with a verified download, a running cosmovisor switches to it before it launches the daemon again", selfUpgrade},
+	{"prune", "[--keep N] [--dry-run]", "remove the directories of the upgrades applied before the most recent ones, flags: --keep N, --dry-run", prune},
+	{"relink", "[--from <old home>] [--dry-run]", "make the absolute links into DAEMON_HOME relative, so the home can be moved, flags: --from, --dry-run", relink},
+}
+
+// Run is the main loop, but returns an error
+func Run(args []string) error {
+	return dispatch(args, os.Stdout, os.Stderr)
+}
+
+// dispatch runs the subcommand named by the first argument
+func dispatch(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		_ = printHelp(stderr)
+		return usageError{errors.New("missing command")}
+	}
+	switch args[0] {
+	case "help", "-h", "--help":
+		return printHelp(stdout)
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:], stdout, stderr)
+		}
+	}
+	// before subcommands existed, all arguments were passed on to the daemon
+	cosmovisor.Log().Warnf("DEPRECATED: running the daemon without the run command, use `cosmovisor run %s`", args[0])
+	return runDaemon(args, stdout, stderr)
+}
 
-	doUpgrade, err := cosmovisor.LaunchProcess(cfg, args, os.Stdout, os.Stderr)
-	// if RestartAfterUpgrade, we launch after a successful upgrade (only condition LaunchProcess returns nil)
-	for cfg.RestartAfterUpgrade && err == nil && doUpgrade {
-		doUpgrade, err = cosmovisor.LaunchProcess(cfg, args, os.Stdout, os.Stderr)
+// printHelp prints the commands and their arguments
+func printHelp(stdout io.Writer) error {
+	fmt.Fprintf(stdout, "cosmovisor runs a Cosmos SDK daemon and switches to the new binary at upgrades.\n\nUsage:\n")
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  cosmovisor %s\t%s\n", strings.TrimSpace(c.name+" "+c.args), c.short)
+	}
+	fmt.Fprintf(tw, "  cosmovisor help\tprint this help\n")
+	if err := tw.Flush(); err != nil {
+		return err
 	}
-	return err
+	fmt.Fprintf(stdout, "\nThe daemon and cosmovisor are configured with the environment, see `cosmovisor config`.\n")
+	return nil
 }
@@ -0,0 +1,230 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/cosmos-sdk/cosmovisor"
+)
+
+// setenv sets an environment variable for the rest of the test
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	require.NoError(t, os.Setenv(key, value))
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestDispatch(t *testing.T) {
+	home := t.TempDir()
+	require.NoError(t, copy.Copy(filepath.Join("..", "..", "testdata", "validate"), home))
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte("#!/bin/sh\necho dummyd $@\n"), 0755))
+	setenv(t, "DAEMON_HOME", home)
+	setenv(t, "DAEMON_NAME", "dummyd")
+	// run moves TMPDIR into the home
+	setenv(t, "TMPDIR", os.TempDir())
+
+	cases := map[string]struct {
+		args []string
+		out  string
+		code int
+	}{
+		"help":                 {args: []string{"--help"}, out: "  cosmovisor run <daemon args>"},
+		"missing command":      {code: cosmovisor.ExitCodeUsage},
+		"run":                  {args: []string{"run", "start", "--home", home}, out: "dummyd start --home " + home + "\n"},
+		"run a collision":      {args: []string{"run", "version"}, out: "dummyd version\n"},
+		"run passthrough":      {args: []string{"run", "query", "bank", "balances"}, out: "dummyd query bank balances\n"},
+		"legacy":               {args: []string{"start"}, out: "dummyd start\n"},
+		"init":                 {args: []string{"init", cfg.GenesisBin()}},
+		"init usage":           {args: []string{"init"}, code: cosmovisor.ExitCodeUsage},
+		"add-upgrade":          {args: []string{"add-upgrade", "v2", cfg.UpgradeBin("chain2"), "--height", "100"}, out: `upgrade "v2" staged in ` + cfg.UpgradeBin("v2")},
+		"add-upgrade flag":     {args: []string{"add-upgrade", "--force", "v3", cfg.UpgradeBin("chain2")}, out: `upgrade "v3" staged`},
+		"add-upgrade usage":    {args: []string{"add-upgrade", "v2"}, code: cosmovisor.ExitCodeUsage},
+		"negative height":      {args: []string{"add-upgrade", "v2", cfg.UpgradeBin("chain2"), "--height", "-1"}, code: cosmovisor.ExitCodeUsage},
+		"version":              {args: []string{"version", "--long"}, out: "(genesis, sha256 "},
+		"version output":       {args: []string{"version", "--long"}, out: "\ndummyd version --long\n"},
+		"version json":         {args: []string{"version", "-o", "json"}, out: `"version": "dummyd version -o json"`},
+		"config":               {args: []string{"config"}, out: "DAEMON_NAME                         dummyd\n"},
+		"config validate":      {args: []string{"config", "validate"}, out: "the configuration is valid\n"},
+		"config json":          {args: []string{"config", "-o", "json"}, out: `"env": "DAEMON_NAME",` + "\n    \"value\": \"dummyd\""},
+		"config validate json": {args: []string{"config", "validate", "--output", "json"}, out: `"valid": true,` + "\n  \"problems\": []"},
+		"config usage":         {args: []string{"config", "all"}, code: cosmovisor.ExitCodeUsage},
+		"status":               {args: []string{"status"}, out: "binary   " + cfg.GenesisBin() + " (genesis"},
+		"status json":          {args: []string{"status", "-o", "json"}, out: `"binary": "` + cfg.GenesisBin() + `"`},
+		"status usage":         {args: []string{"status", "all"}, code: cosmovisor.ExitCodeUsage},
+		"status history":       {args: []string{"status", "--history"}, out: "no upgrades applied yet\n"},
+		"status history json":  {args: []string{"status", "--history", "-o", "json"}, out: "[]\n"},
+		"history":              {args: []string{"history"}, out: "no upgrades applied yet\n"},
+		"history json":         {args: []string{"history", "--output", "json"}, out: "[]\n"},
+		"history usage":        {args: []string{"history", "all"}, code: cosmovisor.ExitCodeUsage},
+		"bundle missing":       {args: []string{"bundle", "chain2", "--file", filepath.Join(home, "chain2.tar.gz")}, code: cosmovisor.ExitCodeFailure},
+		"bundle usage":         {args: []string{"bundle"}, code: cosmovisor.ExitCodeUsage},
+		"status output":        {args: []string{"status", "--output", "yaml"}, code: cosmovisor.ExitCodeUsage},
+		"explain":              {args: []string{"explain", "chain2"}, out: "run " + cfg.GenesisBin()},
+		"explain json":         {args: []string{"explain", "chain2", "-o", "json"}, out: `"step": "launch",`},
+		"explain usage":        {args: []string{"explain", "chain2", "{}", "more"}, code: cosmovisor.ExitCodeUsage},
+		"simulate-upgrade":     {args: []string{"simulate-upgrade", "chain2"}, out: "binary  ok  staged at " + cfg.UpgradeBin("chain2")},
+		"simulate failed":      {args: []string{"simulate-upgrade", "chain9"}, code: cosmovisor.ExitCodeFailure},
+		"simulate usage":       {args: []string{"simulate-upgrade", "--plan-file", "upgrade-info.json", "chain2"}, code: cosmovisor.ExitCodeUsage},
+		"plan":                 {args: []string{"plan", "chain2"}, out: "binary  new  " + cfg.UpgradeBin("chain2") + " (staged, sha256 "},
+		"plan json":            {args: []string{"plan", "chain2", "-o", "json", "--", "start", "--trace"}, out: `"args": [` + "\n      \"start\",\n      \"--trace\""},
+		"plan failed":          {args: []string{"plan", "chain9"}, code: cosmovisor.ExitCodeFailure},
+		"plan usage":           {args: []string{"plan"}, code: cosmovisor.ExitCodeUsage},
+		"rehearse failed":      {args: []string{"rehearse", "chain9", "--timeout", "1s"}, code: cosmovisor.ExitCodeFailure},
+		"rehearse usage":       {args: []string{"rehearse", "--timeout", "-1s", "chain2"}, code: cosmovisor.ExitCodeUsage},
+		"doctor":               {args: []string{"doctor"}, out: " binary " + cfg.GenesisBin() + " runs on "},
+		"doctor json":          {args: []string{"doctor", "-o", "json"}, out: `"check": "binary"`},
+		"doctor usage":         {args: []string{"doctor", "all"}, code: cosmovisor.ExitCodeUsage},
+		"backup usage":         {args: []string{"backup", "check", home}, code: cosmovisor.ExitCodeUsage},
+		"backup missing":       {args: []string{"backup", "verify", filepath.Join(home, "missing.tar.zst")}, code: cosmovisor.ExitCodeFailure},
+		"backup list":          {args: []string{"backup", "list"}, out: "no data backups made yet\n"},
+		"backup list json":     {args: []string{"backup", "list", "-o", "json"}, out: "[]\n"},
+		"backup list usage":    {args: []string{"backup", "list", "all"}, code: cosmovisor.ExitCodeUsage},
+		"restore usage":        {args: []string{"restore", "--reset-current"}, code: cosmovisor.ExitCodeUsage},
+		"restore missing":      {args: []string{"restore", filepath.Join(home, "missing.tar.zst"), "--reset-current"}, code: cosmovisor.ExitCodeFailure},
+		"prune":                {args: []string{"prune", "--keep", "2", "--dry-run"}, out: "nothing to prune, 2 upgrades kept\n"},
+		"prune unknown":        {args: []string{"prune"}, code: cosmovisor.ExitCodeUsage},
+		"prune usage":          {args: []string{"prune", "--keep", "-1"}, code: cosmovisor.ExitCodeUsage},
+		"relink":               {args: []string{"relink", "--dry-run"}},
+		"relink usage":         {args: []string{"relink", home}, code: cosmovisor.ExitCodeUsage},
+		"self-upgrade usage":   {args: []string{"self-upgrade"}, code: cosmovisor.ExitCodeUsage},
+		"init-service":         {args: []string{"init-service", "--user", "node", "--", "start", "--x-crisis-skip-assert-invariants"}, out: " run start --x-crisis-skip-assert-invariants\n"},
+		"init-service env":     {args: []string{"init-service"}, out: "Environment=DAEMON_HOME=" + home + "\nEnvironment=DAEMON_NAME=dummyd\n"},
+		"init-service rc":      {args: []string{"init-service", "--openrc"}, out: "command_args='run start'\n"},
+		"init-service usage":   {args: []string{"init-service", "--watchdog", "soon"}, code: cosmovisor.ExitCodeUsage},
+		"events":               {args: []string{"events", "-n", "5", "-o", "json"}},
+		"events usage":         {args: []string{"events", "--output", "yaml"}, code: cosmovisor.ExitCodeUsage},
+		"admin off":            {args: []string{"admin", "status"}, code: cosmovisor.ExitCodeConfig},
+		"admin usage":          {args: []string{"admin", "upgrade"}, code: cosmovisor.ExitCodeUsage},
+		"admin unknown":        {args: []string{"admin", "stop"}, code: cosmovisor.ExitCodeUsage},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := dispatch(tc.args, &stdout, &stderr)
+			if tc.code != 0 {
+				require.Error(t, err)
+				require.Equal(t, tc.code, exitCode(err))
+				return
+			}
+			require.NoError(t, err, stderr.String())
+			require.Contains(t, stdout.String(), tc.out)
+		})
+	}
+}
+
+func TestVersionWithoutConfig(t *testing.T) {
+	setenv(t, "DAEMON_NAME", "")
+	var stdout bytes.Buffer
+	err := dispatch([]string{"version"}, &stdout, ioutil.Discard)
+	require.Equal(t, cosmovisor.ExitCodeConfig, exitCode(err))
+	require.True(t, strings.HasPrefix(stdout.String(), "cosmovisor version: devel\ncosmovisor build: "))
+	require.NotContains(t, stdout.String(), "binary")
+}
+
+func TestVersionJSON(t *testing.T) {
+	home := t.TempDir()
+	require.NoError(t, copy.Copy(filepath.Join("..", "..", "testdata", "validate"), home))
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	version := `{"name":"dummyd","version":"v2.0.0"}`
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("chain2"), []byte("#!/bin/sh\necho '"+version+"'\n"), 0755))
+	setenv(t, "DAEMON_HOME", home)
+	setenv(t, "DAEMON_NAME", "dummyd")
+
+	var stdout bytes.Buffer
+	require.NoError(t, dispatch([]string{"version", "--output=json"}, &stdout, ioutil.Discard))
+	var versions struct {
+		Cosmovisor cosmovisor.BuildInfo
+		Daemon     cosmovisor.DaemonBuild
+	}
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &versions))
+	require.Equal(t, "devel", versions.Cosmovisor.Version)
+	require.Equal(t, cfg.UpgradeBin("chain2"), versions.Daemon.Binary)
+	require.Equal(t, "chain2", versions.Daemon.Upgrade)
+	require.JSONEq(t, version, string(versions.Daemon.Version))
+}
+
+func TestConfigValidateReportsAll(t *testing.T) {
+	setenv(t, "DAEMON_HOME", t.TempDir())
+	setenv(t, "DAEMON_NAME", "dummyd")
+	setenv(t, "DAEMON_RESTART_DELAY", "soon")
+	err := dispatch([]string{"config", "validate"}, ioutil.Discard, ioutil.Discard)
+	require.Equal(t, cosmovisor.ExitCodeConfig, exitCode(err))
+	require.Contains(t, err.Error(), "2 configuration problems")
+	require.Contains(t, err.Error(), "invalid DAEMON_RESTART_DELAY")
+	require.Contains(t, err.Error(), "cannot stat home dir")
+	var stdout bytes.Buffer
+	err = dispatch([]string{"config", "validate", "-o", "json"}, &stdout, ioutil.Discard)
+	require.Equal(t, cosmovisor.ExitCodeConfig, exitCode(err))
+	var validation struct {
+		Valid    bool
+		Problems []string
+	}
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &validation))
+	require.False(t, validation.Valid)
+	require.Len(t, validation.Problems, 2)
+
+	// the daemon isn't started with a broken setup either
+	home := t.TempDir()
+	require.NoError(t, copy.Copy(filepath.Join("..", "..", "testdata", "validate"), home))
+	setenv(t, "DAEMON_HOME", home)
+	setenv(t, "DAEMON_RESTART_DELAY", "")
+	require.NoError(t, os.Remove((&cosmovisor.Config{Home: home, Name: "dummyd"}).GenesisBin()))
+	err = dispatch([]string{"run", "start"}, ioutil.Discard, ioutil.Discard)
+	require.Equal(t, cosmovisor.ExitCodeConfig, exitCode(err))
+	require.Contains(t, err.Error(), "genesis binary")
+}
+
+func TestSetupCommand(t *testing.T) {
+	genesis := filepath.Join(t.TempDir(), "dummyd")
+	require.NoError(t, ioutil.WriteFile(genesis, []byte("#!/bin/sh\necho dummyd $@\n"), 0755))
+	setenv(t, "DAEMON_HOME", "")
+	setenv(t, "DAEMON_NAME", "")
+
+	// the answers: home, binary, the name of the binary, an invalid then a yes to the
+	// downloads, the backup, its default directory and no unit
+	home := t.TempDir()
+	stdin = strings.NewReader(home + "\n" + genesis + "\n\nmaybe\ny\narchive\n\n\n")
+	defer func() { stdin = os.Stdin }()
+	var stdout bytes.Buffer
+	require.NoError(t, dispatch([]string{"setup"}, &stdout, ioutil.Discard))
+	require.Contains(t, stdout.String(), "Binary name (DAEMON_NAME) [dummyd]: ")
+	require.Contains(t, stdout.String(), "please answer y or n\n")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	bz, err := ioutil.ReadFile(cfg.ConfigFile())
+	require.NoError(t, err)
+	require.Equal(t, "name = \"dummyd\"\nallow_download_binaries = true\ndata_backup = \"archive\"\n", string(bz))
+	require.FileExists(t, cfg.GenesisBin())
+
+	// with --yes nothing is asked, the choices not given as flags take their defaults
+	home = t.TempDir()
+	stdout.Reset()
+	require.NoError(t, dispatch([]string{"setup", "--yes", "--home", home, "--binary", genesis, "--name", "simd"}, &stdout, ioutil.Discard))
+	require.NotContains(t, stdout.String(), "Node home")
+	cfg = &cosmovisor.Config{Home: home, Name: "simd"}
+	bz, err = ioutil.ReadFile(cfg.ConfigFile())
+	require.NoError(t, err)
+	require.Equal(t, "name = \"simd\"\nallow_download_binaries = false\n", string(bz))
+	require.FileExists(t, cfg.GenesisBin())
+
+	err = dispatch([]string{"setup", "--yes", "--home", t.TempDir()}, ioutil.Discard, ioutil.Discard)
+	require.Equal(t, cosmovisor.ExitCodeUsage, exitCode(err))
+}
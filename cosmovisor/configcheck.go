@@ -0,0 +1,125 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConfigErrors are all the problems found in a config, so they can be fixed in one go
+// rather than one failed start at a time
+type ConfigErrors []error
+
+func (errs ConfigErrors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d configuration problems:", len(errs))
+	for _, err := range errs {
+		fmt.Fprintf(&b, "\n  - %v", err)
+	}
+	return b.String()
+}
+
+// CheckConfigFromEnv reads the config like GetConfigFromEnv, then checks the home with
+// CheckSetup. It returns all the problems found as ConfigErrors, nil if there are none.
+// Nothing is written.
+func CheckConfigFromEnv() error {
+	cfg, errs := configFromEnv()
+	if cfg.Validate() == nil {
+		errs = append(errs, cfg.setupProblems()...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// CheckSetup returns the problems of the home that would stop the daemon from starting or
+// an upgrade from being applied, as ConfigErrors: the current binary must be executable
+// (the genesis binary before the first start), the upgrade queue valid and the state
+// directory, holding backups and crash reports, writable. Nothing is written.
+func (cfg *Config) CheckSetup() error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if errs := cfg.setupProblems(); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// setupProblems is CheckSetup for a config that validates
+func (cfg *Config) setupProblems() ConfigErrors {
+	// the layout is checked as it will be run, which doesn't change cfg
+	probe := *cfg
+	if !probe.Immutable {
+		probe.DetectImmutableLayout()
+	}
+
+	var errs ConfigErrors
+	bin, linked := probe.resolveCurrentBin()
+	if err := EnsureBinary(bin); err != nil {
+		if linked {
+			errs = append(errs, fmt.Errorf("current binary: %w", err))
+		} else {
+			errs = append(errs, fmt.Errorf("genesis binary: %w", err))
+		}
+	}
+	if _, err := probe.UpgradeQueue(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid upgrade queue in %s: %w", probe.QueueDir(), err))
+	}
+	if probe.PostUpgradeHook != "" {
+		if _, _, err := postUpgradeHooks(probe.PostUpgradeHook); err != nil {
+			errs = append(errs, fmt.Errorf("post-upgrade hook: %w", err))
+		}
+	}
+	for _, point := range hookPoints {
+		if _, _, err := postUpgradeHooks(probe.hookDir(point)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("%s hooks: %w", point, err))
+		}
+	}
+	if probe.dataBackup() != DataBackupNone && probe.DataBackupDir != "" {
+		if err := checkWritableAncestor(probe.DataBackupDir); err != nil {
+			errs = append(errs, fmt.Errorf("data backup directory %s can't be written: %w", probe.DataBackupDir, err))
+		}
+	}
+	if err := checkWritableAncestor(probe.StateDir()); err != nil {
+		errs = append(errs, fmt.Errorf("state directory %s can't be written: %w", probe.StateDir(), err))
+	}
+	errs = append(errs, probe.worldWritableUpgrades()...)
+	if info, err := os.Stat(probe.workDir()); err != nil {
+		errs = append(errs, fmt.Errorf("working directory of the daemon: %w", err))
+	} else if !info.IsDir() {
+		errs = append(errs, fmt.Errorf("working directory of the daemon %s isn't a directory", probe.workDir()))
+	}
+	if probe.TmpDir != "" {
+		if err := checkWritableAncestor(probe.TmpDir); err != nil {
+			errs = append(errs, fmt.Errorf("temporary directory %s can't be written: %w", probe.TmpDir, err))
+		}
+	}
+	if probe.DownloadStagingDir != "" && probe.AllowDownloadBinaries {
+		if err := checkWritableAncestor(probe.DownloadStagingDir); err != nil {
+			errs = append(errs, fmt.Errorf("download staging directory %s can't be written: %w", probe.DownloadStagingDir, err))
+		}
+	}
+	return errs
+}
+
+// checkWritableAncestor checks dir can be written, or created if it doesn't exist yet
+func checkWritableAncestor(dir string) error {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return checkWritable(dir)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,140 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigErrors(t *testing.T) {
+	require.Equal(t, "one", ConfigErrors{errors.New("one")}.Error())
+	require.Equal(t, "2 configuration problems:\n  - one\n  - two", ConfigErrors{errors.New("one"), errors.New("two")}.Error())
+}
+
+func TestGetConfigFromEnvReportsAll(t *testing.T) {
+	home := t.TempDir()
+	setenv(t, "DAEMON_HOME", home)
+	setenv(t, "DAEMON_NAME", "dummyd")
+	setenv(t, "DAEMON_DOWNLOAD_ATTEMPTS", "none")
+	setenv(t, "DAEMON_RESTART_DELAY", "soon")
+	setenv(t, "DAEMON_CRASH_CHILD_POLICY", "panic")
+
+	_, err := GetConfigFromEnv()
+	var errs ConfigErrors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 4)
+	require.Contains(t, err.Error(), "invalid DAEMON_DOWNLOAD_ATTEMPTS")
+	require.Contains(t, err.Error(), "invalid DAEMON_RESTART_DELAY")
+	require.Contains(t, err.Error(), "invalid DAEMON_CRASH_CHILD_POLICY")
+	require.Contains(t, err.Error(), "cannot stat home dir")
+}
+
+func TestCheckSetup(t *testing.T) {
+	cases := map[string]struct {
+		prepare func(t *testing.T, cfg *Config)
+		errs    []string
+	}{
+		"valid": {},
+		"upgraded": {
+			prepare: func(t *testing.T, cfg *Config) {
+				require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+			},
+		},
+		"current not executable": {
+			prepare: func(t *testing.T, cfg *Config) {
+				require.NoError(t, os.Symlink(cfg.UpgradeDir("noexec"), filepath.Join(cfg.Root(), currentLink)))
+			},
+			errs: []string{"current binary: ", "is not world executable"},
+		},
+		"genesis missing": {
+			prepare: func(t *testing.T, cfg *Config) {
+				require.NoError(t, os.Remove(cfg.GenesisBin()))
+			},
+			errs: []string{"genesis binary: cannot stat"},
+		},
+		"invalid queue": {
+			prepare: func(t *testing.T, cfg *Config) {
+				require.NoError(t, os.MkdirAll(cfg.QueueDir(), 0755))
+				require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.QueueDir(), "1-v2.json"), []byte("{"), 0644))
+			},
+			errs: []string{"invalid upgrade queue in ", "1-v2.json: unexpected end of JSON input"},
+		},
+		"data backup dir not writable": {
+			prepare: func(t *testing.T, cfg *Config) {
+				cfg.DataBackup = DataBackupArchive
+				cfg.DataBackupDir = filepath.Join(cfg.GenesisBin(), "backups")
+			},
+			errs: []string{"data backup directory ", "can't be written"},
+		},
+		"work dir missing": {
+			prepare: func(t *testing.T, cfg *Config) {
+				cfg.WorkDir = filepath.Join(cfg.Home, "wasm")
+			},
+			errs: []string{"working directory of the daemon: stat ", "no such file or directory"},
+		},
+		"everything": {
+			prepare: func(t *testing.T, cfg *Config) {
+				require.NoError(t, os.Remove(cfg.GenesisBin()))
+				require.NoError(t, os.MkdirAll(cfg.QueueDir(), 0755))
+				require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.QueueDir(), "1-v2.json"), []byte("{"), 0644))
+			},
+			errs: []string{"2 configuration problems", "genesis binary", "invalid upgrade queue"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home := validateHome(t)
+			cfg := &Config{Home: home, Name: "dummyd"}
+			if tc.prepare != nil {
+				tc.prepare(t, cfg)
+			}
+			err := cfg.CheckSetup()
+			if len(tc.errs) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			for _, msg := range tc.errs {
+				require.Contains(t, err.Error(), msg)
+			}
+		})
+	}
+}
+
+func TestCheckSetupWritableRoot(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	home := validateHome(t)
+	root := t.TempDir()
+	require.NoError(t, os.Chmod(root, 0555))
+	t.Cleanup(func() { os.Chmod(root, 0755) })
+	cfg := &Config{Home: home, Name: "dummyd", Immutable: true, WritableRoot: root}
+
+	err := cfg.CheckSetup()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "state directory "+cfg.StateDir()+" can't be written")
+}
+
+func TestCheckConfigFromEnv(t *testing.T) {
+	home := validateHome(t)
+	setenv(t, "DAEMON_HOME", home)
+	setenv(t, "DAEMON_NAME", "dummyd")
+	require.NoError(t, CheckConfigFromEnv())
+
+	// problems of the settings and of the home are reported together
+	setenv(t, "DAEMON_SHUTDOWN_GRACE", "forever")
+	require.NoError(t, os.Remove((&Config{Home: home, Name: "dummyd"}).GenesisBin()))
+	err := CheckConfigFromEnv()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "2 configuration problems")
+	require.Contains(t, err.Error(), "invalid DAEMON_SHUTDOWN_GRACE")
+	require.Contains(t, err.Error(), "genesis binary")
+}
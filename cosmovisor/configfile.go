@@ -0,0 +1,94 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// configFileName is the optional file in the cosmovisor directory holding the settings
+const configFileName = "config.toml"
+
+// ConfigFile is the path of the optional config file, read by GetConfigFromEnv
+func (cfg *Config) ConfigFile() string {
+	return filepath.Join(cfg.Root(), configFileName)
+}
+
+// configKey is the key in the config file for the environment variable env, e.g.
+// download_attempts for DAEMON_DOWNLOAD_ATTEMPTS
+func configKey(env string) string {
+	return strings.ToLower(strings.TrimPrefix(env, "DAEMON_"))
+}
+
+// configFile is what the config file holds
+type configFile struct {
+	// settings are keyed by the environment variable they stand for
+	settings map[string]string
+	sidecars []Sidecar
+	hooks    map[string]HookPolicy
+	// childEnv are the KEY=value variables of the child_env table
+	childEnv []string
+}
+
+// readConfigFile reads the config file at path. A missing file has no settings.
+func readConfigFile(path string) (configFile, error) {
+	var file configFile
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return file, nil
+	}
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		return file, err
+	}
+
+	known := map[string]string{}
+	for _, s := range (&Config{}).Settings() {
+		known[configKey(s.Env)] = s.Env
+	}
+	// the file is found through DAEMON_HOME, so it can't move it
+	delete(known, configKey("DAEMON_HOME"))
+
+	settings := map[string]string{}
+	keys := tree.Keys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch key {
+		case sidecarKey:
+			if file.sidecars, err = readSidecars(tree); err != nil {
+				return configFile{}, err
+			}
+			continue
+		case hooksKey:
+			if file.hooks, err = readHookPolicies(tree); err != nil {
+				return configFile{}, err
+			}
+			continue
+		case childEnvKey:
+			if file.childEnv, err = readChildEnv(tree); err != nil {
+				return configFile{}, err
+			}
+			continue
+		}
+		env, ok := known[key]
+		if !ok {
+			return configFile{}, fmt.Errorf("unknown setting %q", key)
+		}
+		switch v := tree.Get(key).(type) {
+		case string:
+			settings[env] = v
+		case bool:
+			settings[env] = strconv.FormatBool(v)
+		case int64:
+			settings[env] = strconv.FormatInt(v, 10)
+		default:
+			return configFile{}, fmt.Errorf("%s must be a string, a number or a boolean", key)
+		}
+	}
+	file.settings = settings
+	return file, nil
+}
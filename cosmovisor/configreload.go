@@ -0,0 +1,150 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// configReloadPoll is how often the config file is checked for changes
+	configReloadPoll = 5 * time.Second
+
+	// EventConfigReloaded is sent when changed settings of the config file were applied
+	EventConfigReloaded = "config_reloaded"
+)
+
+// reloadLock keeps the settings a reload applies from changing while they are used
+var reloadLock sync.RWMutex
+
+// reloadable applies the settings that can change while cosmovisor runs, by environment
+// variable. The others are structural: the home, the binaries, the servers and the
+// watchers of the daemon are set up with them.
+var reloadable = map[string]func(cfg, next *Config){
+	"DAEMON_LOG_LEVEL":                func(cfg, next *Config) { cfg.LogLevel = next.LogLevel },
+	"DAEMON_LOG_FORMAT":               func(cfg, next *Config) { cfg.LogFormat = next.LogFormat },
+	"DAEMON_POLL_INTERVAL":            func(cfg, next *Config) { cfg.PollInterval = next.PollInterval },
+	"DAEMON_POLL_JITTER":              func(cfg, next *Config) { cfg.PollJitter = next.PollJitter },
+	"DAEMON_NOTIFY_WEBHOOK":           func(cfg, next *Config) { cfg.NotifyWebhook = next.NotifyWebhook },
+	"DAEMON_NOTIFY_INTERVAL":          func(cfg, next *Config) { cfg.NotifyInterval = next.NotifyInterval },
+	"DAEMON_NOTIFY_SMTP":              func(cfg, next *Config) { cfg.NotifySMTP = next.NotifySMTP },
+	"DAEMON_NOTIFY_EMAIL_FROM":        func(cfg, next *Config) { cfg.NotifyEmailFrom = next.NotifyEmailFrom },
+	"DAEMON_NOTIFY_EMAIL_TO":          func(cfg, next *Config) { cfg.NotifyEmailTo = next.NotifyEmailTo },
+	"DAEMON_NOTIFY_EMAIL_EVENTS":      func(cfg, next *Config) { cfg.NotifyEmailEvents = next.NotifyEmailEvents },
+	"DAEMON_NOTIFY_EMAIL_SUBJECT":     func(cfg, next *Config) { cfg.NotifyEmailSubject = next.NotifyEmailSubject },
+	"DAEMON_NOTIFY_EMAIL_TEMPLATE":    func(cfg, next *Config) { cfg.NotifyEmailTemplate = next.NotifyEmailTemplate },
+	"DAEMON_DATA_BACKUP":              func(cfg, next *Config) { cfg.DataBackup = next.DataBackup },
+	"DAEMON_DATA_BACKUP_NAME":         func(cfg, next *Config) { cfg.DataBackupName = next.DataBackupName },
+	"DAEMON_DATA_BACKUP_SNAPSHOT_CMD": func(cfg, next *Config) { cfg.DataBackupSnapshotCommand = next.DataBackupSnapshotCommand },
+	"DAEMON_DATA_BACKUP_EXCLUDE":      func(cfg, next *Config) { cfg.DataBackupExclude = next.DataBackupExclude },
+	"DAEMON_DATA_BACKUP_SPACE_CHECK":  func(cfg, next *Config) { cfg.BackupSpaceCheck = next.BackupSpaceCheck },
+	"DAEMON_BACKUP_KEEP_RECENT":       func(cfg, next *Config) { cfg.BackupKeepRecent = next.BackupKeepRecent },
+	"DAEMON_BACKUP_MAX_AGE":           func(cfg, next *Config) { cfg.BackupMaxAge = next.BackupMaxAge },
+	"DAEMON_BACKUP_CMD":               func(cfg, next *Config) { cfg.BackupCommand = next.BackupCommand },
+	"DAEMON_BACKUP_BACKENDS":          func(cfg, next *Config) { cfg.BackupBackends = next.BackupBackends },
+}
+
+// configStamp tells a change of the config file, the zero stamp stands for a missing file
+type configStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statConfigFile(path string) configStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return configStamp{}
+	}
+	return configStamp{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+// watchConfigFile reloads the config file every time it changes, until stop is called.
+// The file is polled, as editors replace it rather than write it in place.
+func (cfg *Config) watchConfigFile() (stop func()) {
+	path := cfg.ConfigFile()
+	done := make(chan struct{})
+	goGuarded(cfg, func() {
+		stamp := statConfigFile(path)
+		ticker := time.NewTicker(configReloadPoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if next := statConfigFile(path); next != stamp {
+				stamp = next
+				cfg.reloadConfig()
+			}
+		}
+	})
+	return func() { close(done) }
+}
+
+// reloadConfig reads the config as GetConfigFromEnv does and applies the changed settings
+// that are reloadable. The other changed settings are applied once cosmovisor is restarted,
+// and an invalid config changes nothing. A variable set in the environment still takes
+// precedence over the file.
+func (cfg *Config) reloadConfig() (applied, pending []string, err error) {
+	path := cfg.ConfigFile()
+	next, errs := configFromEnv()
+	switch {
+	case len(errs) > 0:
+		err = errs
+	case next.ConfigFile() != path:
+		err = fmt.Errorf("the config is read from %s now", next.ConfigFile())
+	}
+	if err != nil {
+		logger.Errorf("not reloading %s, keeping the settings in effect: %v", path, err)
+		return nil, nil, err
+	}
+
+	current := map[string]string{}
+	for _, s := range cfg.Settings() {
+		current[s.Env] = s.Value
+	}
+	// the settings are listed before taking the lock, reading them takes it too
+	settings := next.Settings()
+	reloadLock.Lock()
+	for _, s := range settings {
+		if current[s.Env] == s.Value {
+			continue
+		}
+		if apply, ok := reloadable[s.Env]; ok {
+			apply(cfg, next)
+			applied = append(applied, s.Env)
+		} else {
+			pending = append(pending, s.Env)
+		}
+	}
+	reloadLock.Unlock()
+
+	if len(pending) > 0 {
+		logger.Warnf("%s changed in %s, it applies once cosmovisor is restarted", strings.Join(pending, ", "), path)
+	}
+	if len(applied) == 0 {
+		return applied, pending, nil
+	}
+	ConfigureLogging(cfg)
+	for _, env := range applied {
+		if strings.HasPrefix(env, "DAEMON_NOTIFY_") {
+			RegisterWebhook(cfg)
+			if err := RegisterEmail(cfg); err != nil {
+				logger.Errorf("not mailing the events: %v", err)
+			}
+			break
+		}
+	}
+	reloaded := fmt.Sprintf("reloaded %s, applied %s", path, strings.Join(applied, ", "))
+	logger.Infof("%s", reloaded)
+	ev := NewEvent(EventConfigReloaded, "", reloaded)
+	ev.Fields = map[string]string{"applied": strings.Join(applied, ",")}
+	if len(pending) > 0 {
+		ev.Fields["pending"] = strings.Join(pending, ",")
+	}
+	notify(cfg, ev)
+	return applied, pending, nil
+}
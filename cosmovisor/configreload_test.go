@@ -0,0 +1,92 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadConfig(t *testing.T) {
+	home := t.TempDir()
+	cfg := &Config{Home: home}
+	require.NoError(t, os.MkdirAll(cfg.Root(), 0755))
+	write := func(file string) {
+		require.NoError(t, ioutil.WriteFile(cfg.ConfigFile(), []byte(file), 0644))
+	}
+	write("name = \"gaiad\"\npoll_interval = \"1s\"\nrestart_delay = \"2s\"\n")
+	setenv(t, "DAEMON_HOME", home)
+	for _, env := range []string{"DAEMON_NAME", "DAEMON_POLL_INTERVAL", "DAEMON_LOG_LEVEL", "DAEMON_RESTART_DELAY"} {
+		setenv(t, env, "")
+	}
+	// a variable of the environment takes precedence over the file
+	setenv(t, "DAEMON_BACKUP_MAX_AGE", "24h")
+	cfg, err := GetConfigFromEnv()
+	require.NoError(t, err)
+	t.Cleanup(func() { ConfigureLogging(&Config{}) })
+
+	cases := []struct {
+		name    string
+		file    string
+		applied []string
+		pending []string
+		err     string
+		check   func(t *testing.T)
+	}{
+		{
+			name:    "reloadable",
+			file:    "name = \"gaiad\"\npoll_interval = \"2s\"\nrestart_delay = \"2s\"\nlog_level = \"debug\"\ndata_backup = \"archive\"\nbackup_keep_recent = 3\nbackup_max_age = \"1h\"\n",
+			applied: []string{"DAEMON_POLL_INTERVAL", "DAEMON_DATA_BACKUP", "DAEMON_BACKUP_KEEP_RECENT", "DAEMON_LOG_LEVEL"},
+			check: func(t *testing.T) {
+				require.Equal(t, 2*time.Second, cfg.pollInterval())
+				require.Equal(t, DataBackupArchive, cfg.dataBackup())
+				require.Equal(t, 3, cfg.BackupKeepRecent)
+				require.Equal(t, 24*time.Hour, cfg.BackupMaxAge)
+				require.Equal(t, LogDebug, logger.sink.level)
+			},
+		},
+		{
+			name:    "structural",
+			file:    "name = \"gaiad\"\npoll_interval = \"2s\"\nrestart_delay = \"5s\"\nlog_level = \"debug\"\ndata_backup = \"archive\"\nbackup_keep_recent = 3\n",
+			pending: []string{"DAEMON_RESTART_DELAY"},
+			check: func(t *testing.T) {
+				require.Equal(t, 2*time.Second, cfg.RestartDelay)
+			},
+		},
+		{
+			name: "invalid",
+			file: "name = \"gaiad\"\npoll_interval = \"soon\"\nlog_level = \"info\"\n",
+			err:  "invalid DAEMON_POLL_INTERVAL",
+			check: func(t *testing.T) {
+				require.Equal(t, 2*time.Second, cfg.pollInterval())
+				require.Equal(t, LogDebug, logger.sink.level)
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			write(tc.file)
+			applied, pending, err := cfg.reloadConfig()
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+			} else {
+				require.NoError(t, err)
+				require.ElementsMatch(t, tc.applied, applied)
+				require.ElementsMatch(t, tc.pending, pending)
+			}
+			tc.check(t)
+		})
+	}
+
+	events, _, err := ReadEvents(cfg)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, EventConfigReloaded, events[0].Type)
+	require.Equal(t, "DAEMON_POLL_INTERVAL,DAEMON_DATA_BACKUP,DAEMON_BACKUP_KEEP_RECENT,DAEMON_LOG_LEVEL", events[0].Fields["applied"])
+}
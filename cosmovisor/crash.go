@@ -0,0 +1,265 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	crashesDir = "crashes"
+
+	// ExitCodeCrash is the exit code of cosmovisor after it panicked (EX_SOFTWARE)
+	ExitCodeCrash = 70
+
+	// defaultCrashStopTimeout is how long a daemon stopped after a crash gets before SIGKILL,
+	// if no termination grace period is configured
+	defaultCrashStopTimeout = 30 * time.Second
+	// crashNotifyTimeout is how long the crash notification may take before cosmovisor exits
+	crashNotifyTimeout = 5 * time.Second
+	// recentLogSize is the number of log lines kept for crash reports
+	recentLogSize = 200
+)
+
+// CrashChildPolicy decides what happens to the daemon when cosmovisor itself crashes
+type CrashChildPolicy string
+
+const (
+	// CrashChildStop stops the daemon before cosmovisor exits
+	CrashChildStop CrashChildPolicy = "stop"
+	// CrashChildLeave leaves the daemon running without supervision
+	CrashChildLeave CrashChildPolicy = "leave"
+)
+
+// crashExit is replaced in tests
+var crashExit = os.Exit
+
+// crashing is held while a crash is handled, so a normal exit racing with it (e.g. after
+// the stopped daemon returned) doesn't hide the crash exit code
+var crashing sync.Mutex
+
+var (
+	// currentPhase is what cosmovisor is doing, reported on a crash
+	currentPhase struct {
+		sync.Mutex
+		name string
+	}
+	// runningChild is the daemon currently supervised
+	runningChild struct {
+		sync.Mutex
+		cmd *exec.Cmd
+	}
+	recentLogs = &logRing{max: recentLogSize}
+)
+
+// setPhase records what cosmovisor is doing now
+func setPhase(name string) {
+	currentPhase.Lock()
+	currentPhase.name = name
+	currentPhase.Unlock()
+}
+
+func phase() string {
+	currentPhase.Lock()
+	defer currentPhase.Unlock()
+	if currentPhase.name == "" {
+		return "startup"
+	}
+	return currentPhase.name
+}
+
+// setRunningChild records the daemon to act on if cosmovisor crashes, nil once it exited
+func setRunningChild(cmd *exec.Cmd) {
+	runningChild.Lock()
+	runningChild.cmd = cmd
+	runningChild.Unlock()
+}
+
+func child() *exec.Cmd {
+	runningChild.Lock()
+	defer runningChild.Unlock()
+	return runningChild.cmd
+}
+
+// RecordLogs returns a writer copying to w, keeping the recent lines for crash reports.
+// Use it as the output of the logger, see SetLogOutput.
+func RecordLogs(w io.Writer) io.Writer {
+	return io.MultiWriter(w, recentLogs)
+}
+
+// logRing keeps the last max writes, the logger writes one line at a time
+type logRing struct {
+	mutex sync.Mutex
+	max   int
+	lines []string
+}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lines = append(r.lines, string(p))
+	if len(r.lines) > r.max {
+		r.lines = r.lines[len(r.lines)-r.max:]
+	}
+	return len(p), nil
+}
+
+func (r *logRing) String() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return strings.Join(r.lines, "")
+}
+
+// goGuarded runs fn in a goroutine that reports a panic as a crash of cosmovisor
+func goGuarded(cfg *Config, fn func()) {
+	go func() {
+		defer RecoverCrash(cfg)
+		fn()
+	}()
+}
+
+// RecoverCrash must be deferred directly at the top of cosmovisor's goroutines. It turns a
+// panic into a crash report, applies the crash policy to the daemon and exits with ExitCodeCrash.
+func RecoverCrash(cfg *Config) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	crashing.Lock()
+	defer crashing.Unlock()
+	HandleCrash(cfg, r, debug.Stack())
+	crashExit(ExitCodeCrash)
+}
+
+// Exit exits with code, unless a crash is being handled: then the crash decides the exit code
+func Exit(code int) {
+	crashing.Lock()
+	os.Exit(code)
+}
+
+// HandleCrash writes the crash report and applies the crash policy to the daemon
+func HandleCrash(cfg *Config, r interface{}, stack []byte) {
+	cmd := child()
+	policy := CrashChildStop
+	if cfg != nil && cfg.CrashChildPolicy != "" {
+		policy = cfg.CrashChildPolicy
+	}
+	action := "no daemon running"
+	if cmd != nil && cmd.Process != nil {
+		if policy == CrashChildLeave {
+			action = fmt.Sprintf("leaving daemon (pid %d) running unsupervised", cmd.Process.Pid)
+		} else {
+			action = fmt.Sprintf("stopping daemon (pid %d)", cmd.Process.Pid)
+		}
+	}
+
+	report := crashReport(cfg, r, stack, action)
+	path, err := writeCrashReport(cfg, report)
+	if err != nil {
+		// the report must not get lost, print it in full
+		fmt.Fprintf(os.Stderr, "writing crash report: %v\n%s", err, report)
+		path = "stderr"
+	}
+	logger.Errorf("cosmovisor crashed during %s: %v; %s; report: %s", phase(), r, action, path)
+	notify(cfg, NewEvent(EventCrash, "", fmt.Sprintf("cosmovisor crashed during %s: %v; %s; report: %s", phase(), r, action, path)))
+
+	if cmd != nil && cmd.Process != nil && policy != CrashChildLeave {
+		stopAfterCrash(cfg, cmd)
+	}
+	FlushNotifications(crashNotifyTimeout)
+}
+
+// crashReport formats everything known about the crash
+func crashReport(cfg *Config, r interface{}, stack []byte, action string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "cosmovisor crash report\n\n")
+	fmt.Fprintf(&buf, "time: %s\n", FormatTimestamp(NowUTC()))
+	fmt.Fprintf(&buf, "version: %s\n", Version)
+	fmt.Fprintf(&buf, "phase: %s\n", phase())
+	fmt.Fprintf(&buf, "config fingerprint: %s\n", configFingerprint(cfg))
+	fmt.Fprintf(&buf, "daemon: %s\n", action)
+	fmt.Fprintf(&buf, "\npanic: %v\n\n%s\n", r, stack)
+	fmt.Fprintf(&buf, "recent log:\n%s", recentLogs.String())
+	return buf.Bytes()
+}
+
+// configFingerprint is a short hash identifying the effective config
+func configFingerprint(cfg *Config) string {
+	if cfg == nil {
+		return "none"
+	}
+	bz, err := json.Marshal(cfg)
+	if err != nil {
+		return "unknown"
+	}
+	h := sha256.Sum256(bz)
+	return hex.EncodeToString(h[:8])
+}
+
+// writeCrashReport stores the report in the crashes directory
+func writeCrashReport(cfg *Config, report []byte) (string, error) {
+	if cfg == nil {
+		return "", fmt.Errorf("no config loaded")
+	}
+	dir := filepath.Join(cfg.StateDir(), crashesDir)
+	if err := cfg.fs().mkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, FormatTimestamp(NowUTC())+".txt")
+	return path, cfg.fs().writeFile(path, report, 0644)
+}
+
+// stopAfterCrash stops the daemon, escalating to SIGKILL after the termination grace period
+func stopAfterCrash(cfg *Config, cmd *exec.Cmd) {
+	timeout := defaultCrashStopTimeout
+	if cfg != nil && cfg.TerminationGrace > 0 {
+		timeout = cfg.TerminationGrace
+	}
+	if err := signalProcess(cmd.Process, cfg.stopSignal()); err != nil {
+		return
+	}
+	exited := make(chan struct{})
+	go func() {
+		// races with a cmd.Wait still running in another goroutine, either return means it is gone
+		_, _ = cmd.Process.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(timeout):
+		_ = cmd.Process.Kill()
+	}
+}
+
+// parseCrashChildPolicy validates the value of DAEMON_CRASH_CHILD_POLICY
+func parseCrashChildPolicy(s string) (CrashChildPolicy, error) {
+	switch p := CrashChildPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return CrashChildStop, nil
+	case CrashChildStop, CrashChildLeave:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown crash policy %q, must be %s or %s", s, CrashChildStop, CrashChildLeave)
+	}
+}
+
+// CrashReports lists the crash reports in the home, oldest first
+func (cfg *Config) CrashReports() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(cfg.StateDir(), crashesDir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
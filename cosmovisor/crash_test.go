@@ -0,0 +1,105 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// launchSleeper starts a daemon that runs until it is stopped and waits until it is supervised
+func launchSleeper(t *testing.T, cfg *Config) <-chan error {
+	t.Helper()
+	bin := cfg.GenesisBin()
+	require.NoError(t, os.MkdirAll(filepath.Dir(bin), 0755))
+	require.NoError(t, ioutil.WriteFile(bin, []byte("#!/bin/sh\nexec sleep 30\n"), 0755))
+
+	exited := make(chan error, 1)
+	go func() {
+		_, err := LaunchProcess(cfg, nil, ioutil.Discard, ioutil.Discard)
+		exited <- err
+	}()
+	for i := 0; child() == nil; i++ {
+		require.Less(t, i, 100, "daemon didn't start")
+		time.Sleep(10 * time.Millisecond)
+	}
+	return exited
+}
+
+// crashDuring panics in the given phase, recovering like cosmovisor's goroutines do
+func crashDuring(cfg *Config, name string) (exitCode int) {
+	defer func(exit func(int)) { crashExit = exit }(crashExit)
+	crashExit = func(code int) { exitCode = code }
+
+	func() {
+		defer RecoverCrash(cfg)
+		setPhase(name)
+		panic("synthetic failure")
+	}()
+	return exitCode
+}
+
+func TestCrashStopsDaemon(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", TerminationGrace: 5 * time.Second}
+	defer SetLogOutput(os.Stderr)
+	SetLogOutput(RecordLogs(ioutil.Discard))
+	logger.Infof("last words before the crash")
+
+	exited := launchSleeper(t, cfg)
+	pid := child().Process.Pid
+	require.Equal(t, ExitCodeCrash, crashDuring(cfg, "upgrade download"))
+
+	select {
+	case err := <-exited:
+		require.Error(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("daemon wasn't stopped after the crash")
+	}
+
+	reports, err := cfg.CrashReports()
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	bz, err := ioutil.ReadFile(reports[0])
+	require.NoError(t, err)
+	report := string(bz)
+	require.Contains(t, report, "phase: upgrade download\n")
+	require.Contains(t, report, "panic: synthetic failure\n")
+	require.Contains(t, report, "crash_test.go")
+	require.Contains(t, report, "config fingerprint: "+configFingerprint(cfg)+"\n")
+	require.Contains(t, report, "daemon: stopping daemon (pid ")
+	require.True(t, strings.Contains(report, "last words before the crash"), report)
+	require.Error(t, syscall.Kill(pid, 0), "daemon still running")
+}
+
+func TestCrashLeavesDaemon(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", CrashChildPolicy: CrashChildLeave}
+
+	exited := launchSleeper(t, cfg)
+	cmd := child()
+	require.Equal(t, ExitCodeCrash, crashDuring(cfg, "running"))
+
+	// the daemon is still alive after the crash was handled
+	require.NoError(t, cmd.Process.Signal(syscall.Signal(0)))
+	reports, err := cfg.CrashReports()
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	bz, err := ioutil.ReadFile(reports[0])
+	require.NoError(t, err)
+	require.Contains(t, string(bz), "daemon: leaving daemon (pid ")
+
+	require.NoError(t, cmd.Process.Kill())
+	<-exited
+}
+
+func TestCrashWithoutConfig(t *testing.T) {
+	// nothing can be written without a home, but the exit code is still the crash code
+	require.Equal(t, ExitCodeCrash, crashDuring(nil, "startup"))
+}
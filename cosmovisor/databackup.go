@@ -0,0 +1,701 @@
+package cosmovisor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/otiai10/copy"
+)
+
+// DataBackup is how the data directory is backed up before an upgrade
+type DataBackup string
+
+const (
+	// DataBackupNone makes no backup of the data directory
+	DataBackupNone DataBackup = "none"
+	// DataBackupArchive streams the data directory into a zstd compressed tar archive
+	DataBackupArchive DataBackup = "archive"
+	// DataBackupCopy copies the data directory file by file
+	DataBackupCopy DataBackup = "copy"
+	// DataBackupSnapshot archives the newest state sync snapshot of the application
+	DataBackupSnapshot DataBackup = "snapshot"
+
+	// defaultDataBackupName names the data backups so those of different upgrades and runs
+	// can share a directory
+	defaultDataBackupName = "data-backup-{{.Name}}-{{.Height}}-{{.Time}}"
+	// dataArchiveExt is appended to the name of an archive
+	dataArchiveExt = ".tar.zst"
+	// dataBackupsFile lists the data backups in the state directory, only those are pruned
+	dataBackupsFile = "data-backups.json"
+)
+
+// backupDestLocal is the destination of a data backup written to the local filesystem
+const backupDestLocal = "local"
+
+// DataBackupRecord is a backup of the data directory made before an upgrade
+type DataBackupRecord struct {
+	Upgrade   string    `json:"upgrade"`
+	Height    int64     `json:"height,omitempty"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+	// Stats is how the backup went, nil for a backup recorded before they were
+	Stats *BackupStats `json:"stats,omitempty"`
+}
+
+// BackupStats is how a data backup went. Backups make up much of the downtime of an
+// upgrade, so they are recorded with the backup, in its manifest, in the history of the
+// upgrade and in the backup_completed event.
+type BackupStats struct {
+	Mode DataBackup `json:"mode"`
+	// DurationSeconds is how long writing the backup took
+	DurationSeconds float64 `json:"duration_seconds"`
+	// DataBytes is the size of the files backed up, Bytes the size of the backup
+	DataBytes int64 `json:"data_bytes"`
+	Bytes     int64 `json:"bytes"`
+	// CompressionRatio is DataBytes by Bytes, 1 for a copy
+	CompressionRatio float64 `json:"compression_ratio,omitempty"`
+	// Destination is local, or the scheme of the DAEMON_DATA_BACKUP_DEST the backup was
+	// streamed to
+	Destination string `json:"destination"`
+}
+
+// newBackupStats returns the stats of a backup of files taking bytes, written in took
+func newBackupStats(mode DataBackup, took time.Duration, files []BackupFile, bytes int64, destination string) *BackupStats {
+	stats := &BackupStats{Mode: mode, DurationSeconds: took.Seconds(), Bytes: bytes, Destination: destination}
+	for _, f := range files {
+		stats.DataBytes += f.Size
+	}
+	if bytes > 0 {
+		stats.CompressionRatio = float64(stats.DataBytes) / float64(bytes)
+	}
+	return stats
+}
+
+// annotate sets the stats as attributes of the phase of the backup
+func (s *BackupStats) annotate(phase *PhaseTiming) {
+	phase.Set("data_bytes", strconv.FormatInt(s.DataBytes, 10))
+	phase.Set("bytes", strconv.FormatInt(s.Bytes, 10))
+	phase.Set("compression_ratio", strconv.FormatFloat(s.CompressionRatio, 'f', 3, 64))
+	phase.Set("destination", s.Destination)
+}
+
+// backupStatsOf returns the stats of the data backup of the ended phase, nil if the
+// phase made none. The duration is that of the phase, including a snapshot command.
+func backupStatsOf(phase *PhaseTiming) *BackupStats {
+	if phase == nil || phase.Attributes["destination"] == "" {
+		return nil
+	}
+	stats := &BackupStats{Mode: DataBackup(phase.Attributes["mode"]), DurationSeconds: phase.Duration.Seconds(), Destination: phase.Attributes["destination"]}
+	stats.DataBytes, _ = strconv.ParseInt(phase.Attributes["data_bytes"], 10, 64)
+	stats.Bytes, _ = strconv.ParseInt(phase.Attributes["bytes"], 10, 64)
+	stats.CompressionRatio, _ = strconv.ParseFloat(phase.Attributes["compression_ratio"], 64)
+	return stats
+}
+
+// String describes the stats for messages
+func (s *BackupStats) String() string {
+	msg := fmt.Sprintf("%s of data in %s", formatBytes(s.DataBytes), (time.Duration(s.DurationSeconds * float64(time.Second))).Round(time.Millisecond))
+	if s.Mode != DataBackupCopy && s.CompressionRatio > 0 {
+		msg += fmt.Sprintf(", %s compressed %.2fx", formatBytes(s.Bytes), s.CompressionRatio)
+	}
+	return msg + " to " + s.Destination
+}
+
+// parseDataBackup validates the value of DAEMON_DATA_BACKUP
+func parseDataBackup(s string) (DataBackup, error) {
+	switch b := DataBackup(strings.ToLower(strings.TrimSpace(s))); b {
+	case "":
+		return DataBackupNone, nil
+	case DataBackupNone, DataBackupArchive, DataBackupCopy, DataBackupSnapshot:
+		return b, nil
+	default:
+		return "", fmt.Errorf("unknown data backup %q, must be %s, %s, %s or %s", s, DataBackupNone, DataBackupArchive, DataBackupCopy, DataBackupSnapshot)
+	}
+}
+
+// dataBackup is the configured data backup, none by default
+func (cfg *Config) dataBackup() DataBackup {
+	if cfg.DataBackup == "" {
+		return DataBackupNone
+	}
+	return cfg.DataBackup
+}
+
+// parseBackupExclude parses the comma separated patterns of DAEMON_DATA_BACKUP_EXCLUDE.
+// They are relative to the data directory, with / as separator.
+func parseBackupExclude(s string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("pattern %q must be relative to the data directory", pattern)
+		}
+		for _, segment := range strings.Split(pattern, "/") {
+			if segment == ".." {
+				return nil, fmt.Errorf("pattern %q leaves the data directory", pattern)
+			}
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("pattern %q: %w", pattern, err)
+			}
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// excludedFromBackup returns true if a pattern matches rel, a path relative to the data
+// directory. A pattern matches as path.Match does for each path element, and ** matches
+// any number of them: both snapshots and snapshots/** leave out the whole directory.
+func excludedFromBackup(patterns []string, rel string) bool {
+	name := strings.Split(rel, "/")
+	for _, pattern := range patterns {
+		if matchElements(strings.Split(pattern, "/"), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedFromDataBackup returns true if path, in the data directory, is left out of the
+// data backups
+func (cfg *Config) excludedFromDataBackup(path string) bool {
+	if len(cfg.DataBackupExclude) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(cfg.DataDir(), path)
+	return err == nil && rel != "." && excludedFromBackup(cfg.DataBackupExclude, filepath.ToSlash(rel))
+}
+
+// matchElements matches the elements of a path against those of a pattern
+func matchElements(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElements(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// dataBackupDir holds the data backups: DataBackupDir, or the backups directory next to the
+// export of each upgrade
+func (cfg *Config) dataBackupDir() string {
+	if cfg.DataBackupDir == "" {
+		return filepath.Join(cfg.StateDir(), backupsDir)
+	}
+	return cfg.DataBackupDir
+}
+
+// dataBackupName is the configured name template of the data backups or the default
+func (cfg *Config) dataBackupName() string {
+	return orDefault(cfg.DataBackupName, defaultDataBackupName)
+}
+
+// renderDataBackupName renders the name template of a data backup, which must give a file
+// name: the upgrade name is passed escaped, the home and data directory can't be used
+func renderDataBackupName(name string, data backupTemplateData) (string, error) {
+	tmpl, err := template.New("data backup name").Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("parsing data backup name: %w", err)
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("rendering data backup name: %w", err)
+	}
+	s := buf.String()
+	if strings.TrimSpace(s) == "" || s == "." || s == ".." || strings.ContainsRune(s, filepath.Separator) {
+		return "", fmt.Errorf("data backup name %q is not a file name", s)
+	}
+	return s, nil
+}
+
+// dataBackupPath is where the data directory is backed up before the upgrade, at the time
+// given as a timestamp. A backup already there is not taken into account.
+func (cfg *Config) dataBackupPath(info *UpgradeInfo, stamp string) (string, error) {
+	name, err := cfg.dataBackupFileName(info, stamp, cfg.dataBackup())
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cfg.dataBackupDir(), name), nil
+}
+
+// dataBackupFileName is the file name of the data backup of mode made before the upgrade,
+// at the time given as a timestamp
+func (cfg *Config) dataBackupFileName(info *UpgradeInfo, stamp string, mode DataBackup) (string, error) {
+	name, err := renderDataBackupName(cfg.dataBackupName(), backupTemplateData{
+		Home:    cfg.Home,
+		DataDir: cfg.DataDir(),
+		Name:    url.PathEscape(info.Name),
+		Height:  info.Height,
+		Time:    stamp,
+	})
+	if err != nil {
+		return "", err
+	}
+	return name + mode.ext(), nil
+}
+
+// ext is appended to the name of the data backups of the mode, the archives have one
+func (mode DataBackup) ext() string {
+	if mode == DataBackupCopy {
+		return ""
+	}
+	return dataArchiveExt
+}
+
+// uniquePath returns path if nothing is there, or else the first free path with -2, -3, ...
+// inserted before ext
+func uniquePath(path, ext string) (string, error) {
+	base := strings.TrimSuffix(path, ext)
+	for n := 2; ; n++ {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			return path, nil
+		} else if err != nil {
+			return "", err
+		}
+		path = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+}
+
+// backupData backs up the data directory of the stopped node before the upgrade as
+// DAEMON_DATA_BACKUP says, streamed to DAEMON_DATA_BACKUP_DEST if set
+func (cfg *Config) backupData(info *UpgradeInfo, phase *PhaseTiming) error {
+	if cfg.DataBackupDest != "" {
+		return cfg.streamDataBackup(info, phase, cfg.dataBackup())
+	}
+	return cfg.localDataBackup(info, phase, cfg.dataBackup())
+}
+
+// localDataBackup writes a data backup of mode to the data backup directory. An existing
+// backup is never replaced: if the name is taken, a number is appended. The backup is
+// written under a temporary name and renamed once complete, so a backup that is there is
+// whole.
+func (cfg *Config) localDataBackup(info *UpgradeInfo, phase *PhaseTiming, mode DataBackup) error {
+	sw := StartStopwatch()
+	fs := cfg.fs()
+	name, err := cfg.dataBackupFileName(info, FormatTimestamp(NowUTC()), mode)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(cfg.dataBackupDir(), name)
+	if err := fs.mkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	leftOut, snapshot, err := cfg.dataBackupLeftOut(phase, mode)
+	if err != nil {
+		return err
+	}
+	size, err := cfg.checkBackupSpace(filepath.Dir(dst), leftOut)
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		phase.Set("data_bytes", strconv.FormatInt(size, 10))
+	}
+	if dst, err = uniquePath(dst, mode.ext()); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	if err := fs.removeAll(tmp); err != nil {
+		return err
+	}
+	// a backup cosmovisor is killed while writing is removed as the upgrade is resumed
+	cfg.updateJournal(info.Name, StepBackedUp, func(j *UpgradeJournal) { j.Partial = tmp })
+	logger.Infof("backing up %s to %s", cfg.DataDir(), dst)
+	skip, excluded := countSkips(leftOut)
+	manifest := &BackupManifest{Upgrade: info.Name, Height: info.Height, Snapshot: snapshot, CreatedAt: NowUTC()}
+	if mode == DataBackupCopy {
+		// copy writes on its own, so refuse it up front
+		if err = fs.check("backup", tmp); err == nil {
+			err = copy.Copy(cfg.DataDir(), tmp, copy.Options{
+				Skip: func(src string) (bool, error) {
+					if err := injectFault("backup.data"); err != nil {
+						return false, err
+					}
+					return skip(src), nil
+				},
+			})
+		}
+		// the copy is hashed as written, a second read of the data directory wouldn't be
+		// any more telling
+		if err == nil {
+			manifest.Files, err = treeFiles(tmp)
+		}
+	} else {
+		manifest.Files, err = cfg.archiveData(tmp, skip)
+	}
+	// the manifest goes first, so a backup is never there without it
+	if err == nil {
+		var size int64
+		if size, err = backupSize(tmp); err == nil {
+			manifest.Stats = newBackupStats(mode, sw.Elapsed(), manifest.Files, size, backupDestLocal)
+		}
+	}
+	if err == nil {
+		err = cfg.writeManifest(dst, manifest)
+	}
+	if err == nil {
+		if err = fs.rename(tmp, dst); err != nil {
+			_ = fs.remove(manifestPath(dst))
+		}
+	}
+	if err != nil {
+		if rerr := fs.removeAll(tmp); rerr != nil {
+			logger.Warnf("removing partial backup: %v", rerr)
+		}
+		return err
+	}
+	phase.Set("path", dst)
+	manifest.Stats.annotate(phase)
+	if snapshot == 0 && *excluded > 0 {
+		phase.Set("excluded", strconv.Itoa(*excluded))
+	}
+	cfg.recordDataBackup(DataBackupRecord{Upgrade: info.Name, Height: info.Height, Path: dst, CreatedAt: NowUTC(), Stats: manifest.Stats})
+	return nil
+}
+
+// dataBackupLeftOut returns true for the paths of the data directory a data backup of mode
+// leaves out: those DataBackupExclude matches or, for a snapshot backup, all but the
+// newest state sync snapshot, whose height it returns
+func (cfg *Config) dataBackupLeftOut(phase *PhaseTiming, mode DataBackup) (func(string) bool, int64, error) {
+	if mode != DataBackupSnapshot {
+		return cfg.excludedFromDataBackup, 0, nil
+	}
+	height, err := latestSnapshot(cfg.snapshotsDir())
+	if err != nil {
+		return nil, 0, err
+	}
+	phase.Set("snapshot_height", strconv.FormatInt(height, 10))
+	logger.Infof("backing up the state sync snapshot at height %d", height)
+	return cfg.snapshotSkip(height), height, nil
+}
+
+// countSkips returns the skip function of a data backup, which counts the paths leftOut
+// leaves out
+func countSkips(leftOut func(string) bool) (skip func(string) bool, excluded *int) {
+	excluded = new(int)
+	return func(path string) bool {
+		if !leftOut(path) {
+			return false
+		}
+		*excluded++
+		return true
+	}, excluded
+}
+
+// streamDataBackup streams the archive of mode to DataBackupDest as it is written, so the
+// backup takes no local space. The manifest is only known once the whole
+// archive was read, so it is uploaded after it, and the archive is deleted again if that
+// fails. Remote backups aren't pruned, lifecycle rules of the bucket are meant for that.
+func (cfg *Config) streamDataBackup(info *UpgradeInfo, phase *PhaseTiming, mode DataBackup) error {
+	uploader, err := cfg.backupUploader()
+	if err != nil {
+		return err
+	}
+	name, err := cfg.dataBackupFileName(info, FormatTimestamp(NowUTC()), mode)
+	if err != nil {
+		return err
+	}
+	dst := uploader.URL(name)
+	leftOut, snapshot, err := cfg.dataBackupLeftOut(phase, mode)
+	if err != nil {
+		return err
+	}
+	logger.Infof("streaming a backup of %s to %s", cfg.DataDir(), dst)
+	sw := StartStopwatch()
+	skip, excluded := countSkips(leftOut)
+	manifest := &BackupManifest{Upgrade: info.Name, Height: info.Height, Snapshot: snapshot, CreatedAt: NowUTC()}
+
+	ctx := context.Background()
+	pr, pw := io.Pipe()
+	archive := &sizeWriter{w: pw}
+	archived := make(chan error, 1)
+	goGuarded(cfg, func() {
+		files, err := writeArchive(archive, cfg.DataDir(), skip)
+		manifest.Files = files
+		pw.CloseWithError(err)
+		archived <- err
+	})
+	err = uploader.Upload(ctx, name, pr)
+	// a failed upload stops the archive
+	pr.CloseWithError(io.ErrClosedPipe)
+	if aerr := <-archived; aerr != nil && aerr != io.ErrClosedPipe {
+		err = aerr
+	}
+	if err != nil {
+		return fmt.Errorf("streaming the data backup to %s: %w", dst, err)
+	}
+	manifest.Stats = newBackupStats(mode, sw.Elapsed(), manifest.Files, archive.n, backupDestScheme(cfg.DataBackupDest))
+	bz, err := marshalManifest(manifest)
+	if err == nil {
+		err = uploader.Upload(ctx, name+manifestExt, bytes.NewReader(bz))
+	}
+	if err != nil {
+		if derr := uploader.Delete(ctx, name); derr != nil {
+			logger.Warnf("deleting the data backup %s without manifest: %v", dst, derr)
+		}
+		return fmt.Errorf("uploading the manifest of %s: %w", dst, err)
+	}
+	phase.Set("path", dst)
+	manifest.Stats.annotate(phase)
+	if snapshot == 0 && *excluded > 0 {
+		phase.Set("excluded", strconv.Itoa(*excluded))
+	}
+	cfg.recordDataBackup(DataBackupRecord{Upgrade: info.Name, Height: info.Height, Path: dst, CreatedAt: NowUTC(), Stats: manifest.Stats})
+	return nil
+}
+
+// backupSize is the size of the local data backup at path, an archive or a copy
+func backupSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+	return treeSize(path, func(string) bool { return false })
+}
+
+// sizeWriter counts the bytes written through it
+type sizeWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (s *sizeWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.n += int64(n)
+	return n, err
+}
+
+// dataBackups returns the recorded data backups, oldest first
+func (cfg *Config) dataBackups() ([]DataBackupRecord, error) {
+	var backups []DataBackupRecord
+	if _, err := cfg.readStateFile(dataBackupsFile, &backups); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(backups, func(i, j int) bool { return backups[i].CreatedAt.Before(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// recordDataBackup adds the backup to the list pruning works on. The backup is there
+// either way, so a failure is only logged.
+func (cfg *Config) recordDataBackup(backup DataBackupRecord) {
+	backups, err := cfg.dataBackups()
+	if err == nil {
+		err = cfg.writeStateFile(dataBackupsFile, append(backups, backup))
+	}
+	if err != nil {
+		logger.Warnf("recording data backup %s: %v", backup.Path, err)
+	}
+}
+
+// pruneDataBackups removes the recorded data backups beyond the BackupKeepRecent newest
+// and those older than BackupMaxAge. The newest backup is always kept and backups removed
+// by hand are forgotten. A backup that can't be removed stays recorded for the next time.
+func (cfg *Config) pruneDataBackups() {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	if cfg.BackupKeepRecent <= 0 && cfg.BackupMaxAge <= 0 {
+		return
+	}
+	backups, err := cfg.dataBackups()
+	if err != nil {
+		logger.Warnf("not pruning data backups: %v", err)
+		return
+	}
+	now := NowUTC()
+	var kept []DataBackupRecord
+	for i := len(backups) - 1; i >= 0; i-- {
+		b := backups[i]
+		if isRemoteBackup(b.Path) {
+			kept = append(kept, b)
+			continue
+		}
+		if _, err := os.Lstat(b.Path); os.IsNotExist(err) {
+			continue
+		}
+		newer := len(kept)
+		expired := (cfg.BackupKeepRecent > 0 && newer >= cfg.BackupKeepRecent) ||
+			(cfg.BackupMaxAge > 0 && now.Sub(b.CreatedAt) > cfg.BackupMaxAge)
+		if newer > 0 && expired {
+			logger.Infof("pruning data backup %s made before %q", b.Path, b.Upgrade)
+			err := cfg.fs().removeAll(b.Path)
+			if err == nil {
+				if err := cfg.fs().remove(manifestPath(b.Path)); err != nil && !os.IsNotExist(err) {
+					logger.Warnf("removing the manifest of %s: %v", b.Path, err)
+				}
+				continue
+			}
+			logger.Warnf("pruning data backup %s: %v", b.Path, err)
+		}
+		kept = append(kept, b)
+	}
+	// kept is newest first
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	if err := cfg.writeStateFile(dataBackupsFile, kept); err != nil {
+		logger.Warnf("recording pruned data backups: %v", err)
+	}
+}
+
+// archiveData streams the data directory into a zstd compressed tar archive at path,
+// leaving out what skip returns true for. It returns the files archived.
+func (cfg *Config) archiveData(path string, skip func(string) bool) ([]BackupFile, error) {
+	f, err := cfg.fs().openFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	files, err := writeArchive(f, cfg.DataDir(), skip)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	return files, f.Close()
+}
+
+// writeArchive writes the tree at root to w as a zstd compressed tar archive, see writeTar
+func writeArchive(w io.Writer, root string, skip func(string) bool) ([]BackupFile, error) {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(zw)
+	files, err := writeTar(tw, root, skip)
+	if err != nil {
+		zw.Close()
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		zw.Close()
+		return nil, err
+	}
+	return files, zw.Close()
+}
+
+// writeTar writes the tree at root to tw, with paths relative to its parent so the archive
+// unpacks to a directory of the same name. Sockets and other special files are skipped, as
+// are the paths skip returns true for, directories with everything below them. The files
+// written are returned for the manifest, hashed as they are read. Each file is opened
+// inside root without following symlinks and must be the file walked, so a file swapped for
+// a symlink during the backup fails it rather than pulling in a file from outside.
+func writeTar(tw *tar.Writer, root string, skip func(string) bool) ([]BackupFile, error) {
+	var files []BackupFile
+	base := filepath.Dir(root)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := injectFault("backup.data"); err != nil {
+			return err
+		}
+		if skip(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		var link string
+		switch mode := info.Mode(); {
+		case mode&os.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case !mode.IsRegular() && !mode.IsDir():
+			logger.Warnf("not backing up %s: not a regular file (%s)", path, mode)
+			return nil
+		}
+		var src *os.File
+		if info.Mode().IsRegular() {
+			if src, err = openWalked(root, path, info); err != nil {
+				return fmt.Errorf("archiving %s: %w", path, err)
+			}
+			defer src.Close()
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		// the manifest is relative to the data directory
+		manifestPath := strings.TrimPrefix(hdr.Name, filepath.Base(root)+"/")
+		if link != "" {
+			files = append(files, BackupFile{Path: manifestPath, Link: link})
+		}
+		if src == nil {
+			return nil
+		}
+		file, err := hashFile(manifestPath, io.TeeReader(src, tw))
+		if err != nil {
+			return fmt.Errorf("archiving %s: %w", path, err)
+		}
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+// openWalked opens the file at path below root, walked as info, with openInDir and checks it
+// is still that file
+func openWalked(root, path string, info os.FileInfo) (*os.File, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := openInDir(root, rel)
+	if err != nil {
+		return nil, err
+	}
+	opened, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !os.SameFile(info, opened) {
+		f.Close()
+		return nil, fmt.Errorf("%s changed while it was backed up", path)
+	}
+	return f, nil
+}
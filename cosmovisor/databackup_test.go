@@ -0,0 +1,368 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDataBackup(t *testing.T) {
+	cases := map[string]DataBackup{
+		"":         DataBackupNone,
+		"none":     DataBackupNone,
+		" Archive": DataBackupArchive,
+		"copy":     DataBackupCopy,
+		"snapshot": DataBackupSnapshot,
+	}
+	for s, expected := range cases {
+		b, err := parseDataBackup(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, b, s)
+	}
+	_, err := parseDataBackup("rsync")
+	require.EqualError(t, err, `unknown data backup "rsync", must be none, archive, copy or snapshot`)
+}
+
+// readArchive returns the entries of a zstd compressed tar archive, with the contents of
+// the regular files and the targets of the links
+func readArchive(t *testing.T, path string) map[string]string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	require.NoError(t, err)
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	entries := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		require.NoError(t, err)
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			entries[hdr.Name] = "-> " + hdr.Linkname
+		case tar.TypeReg:
+			bz, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			entries[hdr.Name] = string(bz)
+		default:
+			entries[hdr.Name] = ""
+		}
+	}
+}
+
+func TestBackupDataArchive(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", DataBackup: DataBackupArchive}
+	data := cfg.DataDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(data, "blockstore.db"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(data, "blockstore.db", "000001.log"), []byte("blocks"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(data, "priv_validator_state.json"), []byte(`{"height":"48"}`), 0600))
+	require.NoError(t, os.Symlink("blockstore.db", filepath.Join(data, "latest")))
+
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49}))
+	paths, err := filepath.Glob(filepath.Join(cfg.StateDir(), "backups", "data-backup-chain2-49-*.tar.zst"))
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+	path := paths[0]
+	stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "data-backup-chain2-49-"), ".tar.zst")
+	_, err = time.Parse(TimestampFormat, stamp)
+	require.NoError(t, err, path)
+	entries := readArchive(t, path)
+	require.Equal(t, "blocks", entries["data/blockstore.db/000001.log"])
+	require.Equal(t, `{"height":"48"}`, entries["data/priv_validator_state.json"])
+	require.Equal(t, "-> blockstore.db", entries["data/latest"])
+	require.Contains(t, entries, "data/")
+	_, err = os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err))
+
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.UpgradeBin("chain2"), bin)
+}
+
+func TestBackupDataDir(t *testing.T) {
+	home := validateHome(t)
+	dir := filepath.Join(t.TempDir(), "mnt", "backups")
+	cfg := &Config{Home: home, Name: "dummyd", DataBackup: DataBackupArchive, DataBackupDir: dir, DataBackupName: "{{.Name}}"}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "state.db"), []byte("state"), 0644))
+
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49}))
+	entries := readArchive(t, filepath.Join(dir, "chain2.tar.zst"))
+	require.Equal(t, "state", entries["data/state.db"])
+	_, err := os.Stat(cfg.BackupDir("chain2"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestBackupDataCopy(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", DataBackup: DataBackupCopy, DataBackupName: "data-{{.Name}}"}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "state.db"), []byte("state"), 0644))
+
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49}))
+	bz, err := ioutil.ReadFile(filepath.Join(cfg.StateDir(), "backups", "data-chain2", "state.db"))
+	require.NoError(t, err)
+	require.Equal(t, "state", string(bz))
+
+	// a copy is as large as the data it holds
+	history, err := cfg.UpgradeHistory()
+	require.NoError(t, err)
+	stats := history[0].BackupStats
+	require.NotNil(t, stats)
+	require.Equal(t, DataBackupCopy, stats.Mode)
+	require.Equal(t, int64(len("state")), stats.DataBytes)
+	require.Equal(t, stats.DataBytes, stats.Bytes)
+	require.Equal(t, float64(1), stats.CompressionRatio)
+	require.Equal(t, backupDestLocal, stats.Destination)
+	manifest, err := ReadBackupManifest(filepath.Join(cfg.StateDir(), "backups", "data-chain2"))
+	require.NoError(t, err)
+	require.Equal(t, stats.Bytes, manifest.Stats.Bytes)
+}
+
+func TestBackupDataUnique(t *testing.T) {
+	home := t.TempDir()
+	cfg := &Config{Home: home, Name: "dummyd", DataBackup: DataBackupArchive, DataBackupName: "{{.Name}}"}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	info := &UpgradeInfo{Name: "v2/rc1", Height: 100}
+
+	// a backup with the same name is never replaced
+	for i := 0; i < 3; i++ {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "state.db"), []byte{byte('a' + i)}, 0644))
+		require.NoError(t, cfg.backupData(info, NewUpgradeTimings("v2/rc1").Phase("data-backup")))
+	}
+	dir := filepath.Join(cfg.StateDir(), "backups")
+	for i, name := range []string{"v2%2Frc1.tar.zst", "v2%2Frc1-2.tar.zst", "v2%2Frc1-3.tar.zst"} {
+		require.Equal(t, string([]byte{byte('a' + i)}), readArchive(t, filepath.Join(dir, name))["data/state.db"], name)
+	}
+}
+
+func TestWriteTarSwappedFile(t *testing.T) {
+	cases := map[string]struct {
+		// swap replaces the walked file before it is opened
+		swap   func(t *testing.T, path, outside string)
+		expect string
+	}{
+		"symlink": {
+			swap: func(t *testing.T, path, outside string) {
+				require.NoError(t, os.Remove(path))
+				require.NoError(t, os.Symlink(outside, path))
+			},
+			expect: errSymlinkNotFollowed.Error(),
+		},
+		"other file": {
+			swap: func(t *testing.T, path, outside string) {
+				require.NoError(t, ioutil.WriteFile(path+".new", []byte("other"), 0644))
+				require.NoError(t, os.Rename(path+".new", path))
+			},
+			expect: "changed while it was backed up",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "data")
+			require.NoError(t, os.MkdirAll(root, 0755))
+			path := filepath.Join(root, "state.db")
+			require.NoError(t, ioutil.WriteFile(path, []byte("state"), 0644))
+			outside := filepath.Join(t.TempDir(), "secret")
+			require.NoError(t, ioutil.WriteFile(outside, []byte("secret"), 0600))
+
+			// the walk has read the file info of path when skip is asked about it
+			skip := func(p string) bool {
+				if p == path {
+					tc.swap(t, path, outside)
+				}
+				return false
+			}
+			_, err := writeTar(tar.NewWriter(ioutil.Discard), root, skip)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expect)
+		})
+	}
+}
+
+func TestDataBackupPath(t *testing.T) {
+	cfg := &Config{Home: "/node", DataBackup: DataBackupCopy, DataBackupDir: "/mnt/backups"}
+	info := &UpgradeInfo{Name: "v2", Height: 100}
+	path, err := cfg.dataBackupPath(info, "20220102T150405Z")
+	require.NoError(t, err)
+	require.Equal(t, "/mnt/backups/data-backup-v2-100-20220102T150405Z", path)
+
+	cfg.DataBackup = DataBackupArchive
+	cfg.DataBackupName = "{{.Height}}-{{.Name}}"
+	path, err = cfg.dataBackupPath(info, "20220102T150405Z")
+	require.NoError(t, err)
+	require.Equal(t, "/mnt/backups/100-v2.tar.zst", path)
+
+	for _, name := range []string{"{{.DataDir}}", "backups/{{.Name}}", "{{.Upgrade}}", "{{.Name"} {
+		cfg.DataBackupName = name
+		_, err = cfg.dataBackupPath(info, "20220102T150405Z")
+		require.Error(t, err, name)
+	}
+}
+
+func TestBackupDataFails(t *testing.T) {
+	home := validateHome(t)
+	// without a data directory there is nothing to archive
+	cfg := &Config{Home: home, Name: "dummyd", DataBackup: DataBackupArchive}
+	require.NoError(t, os.RemoveAll(cfg.DataDir()))
+
+	err := DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "backing up the data directory: ")
+	tmps, err := filepath.Glob(filepath.Join(cfg.StateDir(), "backups", "*.tmp"))
+	require.NoError(t, err)
+	require.Empty(t, tmps)
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.GenesisBin(), bin)
+}
+
+func TestPruneDataBackups(t *testing.T) {
+	home := t.TempDir()
+	cfg := &Config{Home: home, Name: "dummyd"}
+	dir := filepath.Join(t.TempDir(), "backups")
+	now := NowUTC()
+	for i, name := range []string{"v1", "v2", "v3", "v4", "gone"} {
+		path := filepath.Join(dir, "data-backup-"+name)
+		if name != "gone" {
+			require.NoError(t, os.MkdirAll(path, 0755))
+		}
+		created := now.Add(time.Duration(i-5) * 24 * time.Hour)
+		cfg.recordDataBackup(DataBackupRecord{Upgrade: name, Path: path, CreatedAt: created})
+	}
+	names := func() []string {
+		backups, err := cfg.dataBackups()
+		require.NoError(t, err)
+		var names []string
+		for _, b := range backups {
+			names = append(names, b.Upgrade)
+			_, err := os.Stat(b.Path)
+			require.NoError(t, err, b.Path)
+		}
+		return names
+	}
+
+	// nothing is pruned unless asked for
+	cfg.pruneDataBackups()
+	_, err := os.Stat(filepath.Join(dir, "data-backup-v1"))
+	require.NoError(t, err)
+
+	// a backup removed by hand doesn't count
+	cfg.BackupKeepRecent = 3
+	cfg.pruneDataBackups()
+	require.Equal(t, []string{"v2", "v3", "v4"}, names())
+	_, err = os.Stat(filepath.Join(dir, "data-backup-v1"))
+	require.True(t, os.IsNotExist(err))
+
+	cfg.BackupKeepRecent = 0
+	cfg.BackupMaxAge = 36 * time.Hour
+	cfg.pruneDataBackups()
+	require.Equal(t, []string{"v4"}, names())
+
+	// the newest is kept however old
+	cfg.BackupMaxAge = time.Hour
+	cfg.pruneDataBackups()
+	require.Equal(t, []string{"v4"}, names())
+}
+
+func TestPruneAfterUpgrade(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", DataBackup: DataBackupArchive, DataBackupName: "{{.Name}}", BackupKeepRecent: 1}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	old := filepath.Join(cfg.StateDir(), "backups", "chain1.tar.zst")
+	require.NoError(t, os.MkdirAll(filepath.Dir(old), 0755))
+	require.NoError(t, ioutil.WriteFile(old, nil, 0644))
+	cfg.recordDataBackup(DataBackupRecord{Upgrade: "chain1", Path: old, CreatedAt: NowUTC().Add(-time.Hour)})
+
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49}))
+	_, err := os.Stat(old)
+	require.True(t, os.IsNotExist(err))
+	backups, err := cfg.dataBackups()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	require.Equal(t, "chain2", backups[0].Upgrade)
+	require.Equal(t, filepath.Join(cfg.StateDir(), "backups", "chain2.tar.zst"), backups[0].Path)
+}
+
+func TestExcludedFromBackup(t *testing.T) {
+	patterns, err := parseBackupExclude(" wasm/cache/**, snapshots,,*.log,**/LOCK ")
+	require.NoError(t, err)
+	require.Equal(t, []string{"wasm/cache/**", "snapshots", "*.log", "**/LOCK"}, patterns)
+	cases := map[string]bool{
+		"wasm/cache":                 true,
+		"wasm/cache/modules/a.wasm":  true,
+		"wasm/wasm":                  false,
+		"wasm":                       false,
+		"snapshots":                  true,
+		"snapshots/1200/metadata.db": false,
+		"node.log":                   true,
+		"logs/node.log":              false,
+		"application.db/LOCK":        true,
+		"LOCK":                       true,
+		"application.db/000001.ldb":  false,
+	}
+	for rel, expected := range cases {
+		require.Equal(t, expected, excludedFromBackup(patterns, rel), rel)
+	}
+
+	for _, s := range []string{"/var/data", "../config", "snapshots/[", "a/../../b"} {
+		_, err := parseBackupExclude(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestBackupDataExclude(t *testing.T) {
+	for _, mode := range []DataBackup{DataBackupArchive, DataBackupCopy} {
+		t.Run(string(mode), func(t *testing.T) {
+			home := t.TempDir()
+			cfg := &Config{Home: home, Name: "dummyd", DataBackup: mode, DataBackupName: "backup",
+				DataBackupExclude: []string{"wasm/cache/**", "snapshots"}}
+			for _, rel := range []string{"state.db/000001.ldb", "wasm/wasm/code", "wasm/cache/modules/a", "snapshots/1200/chunk"} {
+				path := filepath.Join(cfg.DataDir(), rel)
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+				require.NoError(t, ioutil.WriteFile(path, []byte(rel), 0644))
+			}
+			timings := NewUpgradeTimings("v2")
+			require.NoError(t, cfg.backupData(&UpgradeInfo{Name: "v2", Height: 100}, timings.Phase("data-backup")))
+
+			var backedUp []string
+			dir := filepath.Join(cfg.StateDir(), "backups")
+			if mode == DataBackupArchive {
+				for name := range readArchive(t, filepath.Join(dir, "backup.tar.zst")) {
+					if name != "data/" {
+						backedUp = append(backedUp, strings.TrimPrefix(name, "data/"))
+					}
+				}
+			} else {
+				root := filepath.Join(dir, "backup")
+				require.NoError(t, filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+					if err != nil || path == root {
+						return err
+					}
+					rel, _ := filepath.Rel(root, path)
+					if info.IsDir() {
+						rel += "/"
+					}
+					backedUp = append(backedUp, rel)
+					return nil
+				}))
+			}
+			require.ElementsMatch(t, []string{"state.db/", "state.db/000001.ldb", "wasm/", "wasm/wasm/", "wasm/wasm/code"}, backedUp)
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// nodeConfigFiles are the files of the config directory of a Cosmos SDK node home, one
+// of them is enough to tell a node home from other directories
+var nodeConfigFiles = []string{"app.toml", "client.toml", "config.toml"}
+
+// detectHome returns the home of the node cosmovisor manages for an unset DAEMON_HOME: the
+// only directory of the user's home named like the default home of a Cosmos SDK app,
+// ~/.<app>, that holds a node config and a cosmovisor directory. With name set, only the
+// homes with its genesis binary count. It returns an empty string if there is none or
+// several, DAEMON_HOME has to be set then.
+func detectHome(name string) string {
+	userHome, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	entries, err := ioutil.ReadDir(userHome)
+	if err != nil {
+		return ""
+	}
+	var found []string
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		home := filepath.Join(userHome, e.Name())
+		if !isNodeHome(home) {
+			continue
+		}
+		genesis := filepath.Join((&Config{Home: home}).Root(), genesisDir, "bin")
+		if name != "" {
+			genesis = (&Config{Home: home, Name: name}).GenesisBin()
+		}
+		if _, err := os.Stat(genesis); err == nil {
+			found = append(found, home)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return ""
+	case 1:
+		if chainID := clientChainID(found[0]); chainID != "" {
+			logger.Infof("DAEMON_HOME is not set, using %s, the only node home with a cosmovisor directory in %s (chain %s)", found[0], userHome, chainID)
+		} else {
+			logger.Infof("DAEMON_HOME is not set, using %s, the only node home with a cosmovisor directory in %s", found[0], userHome)
+		}
+		return found[0]
+	default:
+		logger.Warnf("DAEMON_HOME is not set and %s holds several node homes with a cosmovisor directory: %s", userHome, strings.Join(found, ", "))
+		return ""
+	}
+}
+
+// isNodeHome returns whether dir holds the config of a Cosmos SDK node
+func isNodeHome(dir string) bool {
+	for _, name := range nodeConfigFiles {
+		if _, err := os.Stat(filepath.Join(dir, "config", name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// clientChainID returns the chain-id of the client.toml of a node home, empty if it has
+// none or it can't be read
+func clientChainID(home string) string {
+	tree, err := toml.LoadFile(filepath.Join(home, "config", "client.toml"))
+	if err != nil {
+		return ""
+	}
+	chainID, _ := tree.Get("chain-id").(string)
+	return chainID
+}
+
+// detectName returns the daemon name for an unset DAEMON_NAME: the only binary of the
+// genesis directory of home, empty if there is none or several
+func detectName(home string) string {
+	dir := filepath.Join((&Config{Home: home}).Root(), genesisDir, "bin")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Mode().IsRegular() || e.Mode()&os.ModeSymlink != 0 {
+			names = append(names, e.Name())
+		}
+	}
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		name := strings.TrimSuffix(names[0], exeSuffix)
+		logger.Infof("DAEMON_NAME is not set, using %s, the only binary in %s", name, dir)
+		return name
+	default:
+		logger.Warnf("DAEMON_NAME is not set and %s holds several binaries: %s", dir, strings.Join(names, ", "))
+		return ""
+	}
+}
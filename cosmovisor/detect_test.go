@@ -0,0 +1,89 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// nodeHome creates a node home named dir in the user's home, with a config file and the
+// genesis binaries
+func nodeHome(t *testing.T, userHome, dir, configFile string, bins ...string) string {
+	home := filepath.Join(userHome, dir)
+	require.NoError(t, os.MkdirAll(filepath.Join(home, "config"), 0o755))
+	if configFile != "" {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(home, "config", configFile), []byte("chain-id = \"testchain-1\"\n"), 0o644))
+	}
+	genesis := filepath.Join(home, rootName, genesisDir, "bin")
+	require.NoError(t, os.MkdirAll(genesis, 0o755))
+	for _, bin := range bins {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(genesis, bin), []byte("#!/bin/sh\n"), 0o755))
+	}
+	return home
+}
+
+func TestDetectHome(t *testing.T) {
+	cases := map[string]struct {
+		homes map[string][]string
+		name  string
+		home  string
+	}{
+		"none":          {},
+		"one":           {homes: map[string][]string{".gaia": {"gaiad"}}, home: ".gaia"},
+		"several":       {homes: map[string][]string{".gaia": {"gaiad"}, ".osmosisd": {"osmosisd"}}},
+		"by name":       {homes: map[string][]string{".gaia": {"gaiad"}, ".osmosisd": {"osmosisd"}}, name: "osmosisd", home: ".osmosisd"},
+		"other name":    {homes: map[string][]string{".gaia": {"gaiad"}}, name: "osmosisd"},
+		"not dot dir":   {homes: map[string][]string{"gaia": {"gaiad"}}},
+		"empty genesis": {homes: map[string][]string{".gaia": nil}, home: ".gaia"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			userHome := t.TempDir()
+			setenv(t, "HOME", userHome)
+			for dir, bins := range tc.homes {
+				nodeHome(t, userHome, dir, "app.toml", bins...)
+			}
+			want := ""
+			if tc.home != "" {
+				want = filepath.Join(userHome, tc.home)
+			}
+			require.Equal(t, want, detectHome(tc.name))
+		})
+	}
+}
+
+func TestDetectHomeNeedsNodeConfig(t *testing.T) {
+	userHome := t.TempDir()
+	setenv(t, "HOME", userHome)
+	nodeHome(t, userHome, ".gaia", "", "gaiad")
+	require.Equal(t, "", detectHome(""))
+
+	home := nodeHome(t, userHome, ".gaia", "client.toml")
+	require.Equal(t, home, detectHome(""))
+	require.Equal(t, "testchain-1", clientChainID(home))
+}
+
+func TestDetectName(t *testing.T) {
+	userHome := t.TempDir()
+	require.Equal(t, "", detectName(filepath.Join(userHome, ".missing")))
+	require.Equal(t, "gaiad", detectName(nodeHome(t, userHome, ".gaia", "app.toml", "gaiad")))
+	require.Equal(t, "", detectName(nodeHome(t, userHome, ".two", "app.toml", "gaiad", "osmosisd")))
+}
+
+func TestConfigFromEnvDetects(t *testing.T) {
+	userHome := t.TempDir()
+	setenv(t, "HOME", userHome)
+	setenv(t, "DAEMON_HOME", "")
+	setenv(t, "DAEMON_NAME", "")
+	home := nodeHome(t, userHome, ".gaia", "app.toml", "gaiad")
+	cfg, errs := configFromEnv()
+	require.Empty(t, errs)
+	require.Equal(t, home, cfg.Home)
+	require.Equal(t, "gaiad", cfg.Name)
+}
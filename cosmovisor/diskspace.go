@@ -0,0 +1,116 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SpaceCheck decides what happens if the backup destination looks too small for a data backup
+type SpaceCheck string
+
+const (
+	// SpaceCheckAbort fails the upgrade before the backup starts, the old binary stays current
+	SpaceCheckAbort SpaceCheck = "abort"
+	// SpaceCheckWarn logs the shortfall and tries the backup anyway
+	SpaceCheckWarn SpaceCheck = "warn"
+	// SpaceCheckOff doesn't check the free space
+	SpaceCheckOff SpaceCheck = "off"
+)
+
+// errFreeSpaceUnknown is returned by diskFree where the free space can't be read
+var errFreeSpaceUnknown = errors.New("free space unknown on this platform")
+
+// freeSpace returns the bytes available to cosmovisor on the filesystem of dir.
+// Tests replace it.
+var freeSpace = diskFree
+
+// parseSpaceCheck validates the value of DAEMON_DATA_BACKUP_SPACE_CHECK
+func parseSpaceCheck(s string) (SpaceCheck, error) {
+	switch c := SpaceCheck(strings.ToLower(strings.TrimSpace(s))); c {
+	case "":
+		return SpaceCheckAbort, nil
+	case SpaceCheckAbort, SpaceCheckWarn, SpaceCheckOff:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown space check %q, must be %s, %s or %s", s, SpaceCheckAbort, SpaceCheckWarn, SpaceCheckOff)
+	}
+}
+
+// spaceCheck is the configured space check, abort by default
+func (cfg *Config) spaceCheck() SpaceCheck {
+	if cfg.BackupSpaceCheck == "" {
+		return SpaceCheckAbort
+	}
+	return cfg.BackupSpaceCheck
+}
+
+// treeSize adds up the sizes of the regular files below root, leaving out the paths skip
+// returns true for
+func treeSize(root string, skip func(string) bool) (int64, error) {
+	var size int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if skip(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// checkBackupSpace compares the free space in dir with the size of the data directory
+// without the paths leftOut returns true for, before a data backup is written to dir. The size is what a
+// copy needs and a bound for an archive: the databases of a node are compressed already, so
+// the archive is rarely much smaller. It returns the size measured.
+func (cfg *Config) checkBackupSpace(dir string, leftOut func(string) bool) (int64, error) {
+	check := cfg.spaceCheck()
+	if check == SpaceCheckOff {
+		return 0, nil
+	}
+	size, err := treeSize(cfg.DataDir(), leftOut)
+	if err != nil {
+		return 0, fmt.Errorf("measuring the data directory: %w", err)
+	}
+	free, err := freeSpace(dir)
+	if errors.Is(err, errFreeSpaceUnknown) {
+		logger.Warnf("not checking the space for the data backup: %v", err)
+		return size, nil
+	} else if err != nil {
+		return size, fmt.Errorf("reading the free space in %s: %w", dir, err)
+	}
+	if uint64(size) <= free {
+		return size, nil
+	}
+	err = fmt.Errorf("not enough space in %s for the data backup: %s free, the data directory holds %s",
+		dir, formatBytes(int64(free)), formatBytes(size))
+	if check == SpaceCheckWarn {
+		logger.Warnf("backing up anyway: %v", err)
+		return size, nil
+	}
+	return size, err
+}
+
+// formatBytes formats a size in bytes for messages, with binary prefixes
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// withFreeSpace makes freeSpace report free bytes for the rest of the test
+func withFreeSpace(t *testing.T, free uint64) {
+	t.Cleanup(func() { freeSpace = diskFree })
+	freeSpace = func(string) (uint64, error) { return free, nil }
+}
+
+func TestCheckBackupSpace(t *testing.T) {
+	home := t.TempDir()
+	cfg := &Config{Home: home, Name: "dummyd", DataBackup: DataBackupArchive, DataBackupExclude: []string{"snapshots"}}
+	require.NoError(t, os.MkdirAll(filepath.Join(cfg.DataDir(), "snapshots"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "state.db"), make([]byte, 3000), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "snapshots", "1200"), make([]byte, 5000), 0644))
+
+	withFreeSpace(t, 3000)
+	size, err := cfg.checkBackupSpace(home, cfg.excludedFromDataBackup)
+	require.NoError(t, err)
+	require.Equal(t, int64(3000), size)
+
+	withFreeSpace(t, 2048)
+	_, err = cfg.checkBackupSpace(home, cfg.excludedFromDataBackup)
+	require.EqualError(t, err, "not enough space in "+home+" for the data backup: 2.0 KiB free, the data directory holds 2.9 KiB")
+
+	cfg.BackupSpaceCheck = SpaceCheckWarn
+	_, err = cfg.checkBackupSpace(home, cfg.excludedFromDataBackup)
+	require.NoError(t, err)
+
+	// the check comes before anything is written
+	cfg.BackupSpaceCheck = SpaceCheckAbort
+	err = cfg.backupData(&UpgradeInfo{Name: "v2", Height: 100}, NewUpgradeTimings("v2").Phase("data-backup"))
+	require.Error(t, err)
+	entries, err := ioutil.ReadDir(filepath.Join(cfg.StateDir(), "backups"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	cfg.BackupSpaceCheck = SpaceCheckOff
+	require.NoError(t, cfg.backupData(&UpgradeInfo{Name: "v2", Height: 100}, NewUpgradeTimings("v2").Phase("data-backup")))
+}
+
+func TestDiskFree(t *testing.T) {
+	free, err := diskFree(t.TempDir())
+	require.NoError(t, err)
+	require.NotZero(t, free)
+	_, err = diskFree(filepath.Join(t.TempDir(), "missing"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestFormatBytes(t *testing.T) {
+	require.Equal(t, "512 B", formatBytes(512))
+	require.Equal(t, "1.5 KiB", formatBytes(1536))
+	require.Equal(t, "120.0 GiB", formatBytes(120<<30))
+}
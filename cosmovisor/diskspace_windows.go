@@ -0,0 +1,6 @@
+package cosmovisor
+
+// diskFree doesn't read the free space on windows, the space check is skipped
+func diskFree(string) (uint64, error) {
+	return 0, errFreeSpaceUnknown
+}
@@ -0,0 +1,55 @@
+/*
+Package cosmovisor supervises a Cosmos SDK daemon and switches it to a new binary when the
+chain reaches an upgrade. The cosmovisor command is a thin wrapper around this package, so
+tools that orchestrate nodes, e.g. local testnets, can embed the same supervision instead
+of running the command.
+
+Configuration
+
+A Config describes the layout under DAEMON_HOME and every policy of a run. GetConfigFromEnv
+reads it from the environment the way the command does; a Config built in code must set at
+least Home and Name and should be checked with Validate. Zero values of the optional fields
+select the same defaults as unset environment variables.
+
+Running the Daemon
+
+SuperviseContext runs the daemon from the current link, performs upgrades and hotfixes as
+the daemon reaches them, and restarts it as RestartAfterUpgrade and RestartAfterFailure
+ask. Cancelling the context stops the daemon with the configured stop signal, just like a
+signal to the cosmovisor process. LaunchProcessContext runs the daemon once, returning
+after it exited or after an upgrade, for callers that decide about restarts themselves. Only
+one of them runs in a process at a time, another returns ErrSupervising.
+
+ExitCode maps the error of either function to the exit status the command would use.
+
+Upgrades
+
+The daemon announces an upgrade with an "UPGRADE ... NEEDED at height" line on its output.
+WaitForUpdate finds that line in a scanner and returns the UpgradeInfo, which DoUpgrade
+then applies: it downloads the binary if allowed, checks it and switches the current link.
+Predownload fetches the binary of a plan ahead of time, and NodeAPI reads the pending plan
+and the chain height from a node.
+
+Explain returns the decisions a run would make for an upgrade without changing anything.
+
+Extending
+
+Downloads go through the Downloader of the Config, so binaries can be fetched from places
+the default client doesn't support. Lifecycle events reach every Notifier added with
+RegisterNotifier, and upgrade timings every exporter added with
+RegisterUpgradeTraceExporter. RegisterUpgradeSource adds an UpgradeSource to the output, the
+plan file, the plan of the chain and the admin API that report the upgrades. Subscribe and
+SubscribeFunc pass every event recorded in the process, such as EventDaemonStarted,
+EventUpgradeDetected, EventBackupCompleted and EventBinarySwitched, to the embedding
+program as it happens.
+
+Logging
+
+The package logs through Log, to stderr unless SetLogOutput says otherwise. ConfigureLogging
+applies the level and format of a Config; LogWriter turns the lines of another logger, like
+the standard one, into messages of the same format.
+
+Embedding processes share the global state of the package, such as the notifiers, so only
+one daemon should be supervised per process.
+*/
+package cosmovisor
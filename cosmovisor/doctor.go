@@ -0,0 +1,416 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// doctorMinFree is the free space the home should have for the binaries of an upgrade
+	// and the growth of the data directory until then
+	doctorMinFree = 1 << 30
+	// doctorMinOpenFiles is the limit of open files below which a node may run out of file
+	// descriptors as its databases and peers grow
+	doctorMinOpenFiles = 65536
+	// doctorRequestTimeout bounds each request to an endpoint
+	doctorRequestTimeout = 10 * time.Second
+)
+
+// errNotChecked is returned by the checks that can't be made on this platform
+var errNotChecked = errors.New("not checked on this platform")
+
+// CheckStatus is the outcome of a check of Doctor
+type CheckStatus string
+
+const (
+	// CheckPass is a check that found nothing wrong
+	CheckPass CheckStatus = "pass"
+	// CheckWarn is a check that found something to look at, which won't stop the node
+	CheckWarn CheckStatus = "warn"
+	// CheckFail is a check that found something that stops the node or fails an upgrade
+	CheckFail CheckStatus = "fail"
+)
+
+// DoctorCheck is one check of the environment made by Doctor
+type DoctorCheck struct {
+	Check  string      `json:"check"`
+	Status CheckStatus `json:"status"`
+	Result string      `json:"result"`
+}
+
+// DoctorReport is the outcome of Doctor
+type DoctorReport struct {
+	Checks []*DoctorCheck `json:"checks"`
+}
+
+// Count returns how many checks have the status
+func (r *DoctorReport) Count(status CheckStatus) int {
+	n := 0
+	for _, c := range r.Checks {
+		if c.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Doctor checks the environment the node runs in, ahead of an upgrade: the current link and
+// binary, the free space, the permissions of the directories cosmovisor writes, the owner of
+// those the daemon writes when it drops privileges, the limit of open files, the backup
+// directory, the endpoints of the downloads and services, and the processes that would
+// conflict with the daemon. Nothing is written.
+func Doctor(cfg *Config) *DoctorReport {
+	r := &DoctorReport{}
+	add := func(check string, status CheckStatus, format string, args ...interface{}) {
+		r.Checks = append(r.Checks, &DoctorCheck{Check: check, Status: status, Result: fmt.Sprintf(format, args...)})
+	}
+	// the layout is checked as it will be run, which doesn't change cfg
+	probe := *cfg
+	if !probe.Immutable {
+		probe.DetectImmutableLayout()
+	}
+	cfg = &probe
+
+	doctorCurrent(cfg, add)
+	doctorSpace(cfg, add)
+	doctorPermissions(cfg, add)
+	doctorPrivileges(cfg, add)
+	doctorOpenFiles(add)
+	doctorEndpoints(cfg, add)
+	doctorProcesses(cfg, add)
+	return r
+}
+
+// doctorCurrent checks the current link and the binary it points to
+func doctorCurrent(cfg *Config, add func(string, CheckStatus, string, ...interface{})) {
+	if problem, _ := cfg.currentProblem(); problem != "" {
+		add("current", CheckWarn, "%s, it is repaired when cosmovisor starts", problem)
+	}
+	bin, linked := cfg.resolveCurrentBin()
+	name := "current binary"
+	if !linked {
+		name = "genesis binary"
+	}
+	if err := EnsureBinary(bin); err != nil {
+		add("binary", CheckFail, "%s: %v", name, err)
+		return
+	}
+	add("binary", CheckPass, "%s %s runs on %s", name, bin, OSArch())
+	if _, err := cfg.UpgradeQueue(); err != nil {
+		add("queue", CheckFail, "invalid upgrade queue in %s: %v", cfg.QueueDir(), err)
+	}
+}
+
+// doctorSpace checks the free space of the home and of the data backup destination
+func doctorSpace(cfg *Config, add func(string, CheckStatus, string, ...interface{})) {
+	free, err := freeSpace(cfg.Home)
+	switch {
+	case errors.Is(err, errFreeSpaceUnknown):
+		add("disk", CheckWarn, "%v", err)
+		return
+	case err != nil:
+		add("disk", CheckWarn, "reading the free space in %s: %v", cfg.Home, err)
+	case free < doctorMinFree:
+		add("disk", CheckWarn, "only %s free in %s", formatBytes(int64(free)), cfg.Home)
+	default:
+		add("disk", CheckPass, "%s free in %s", formatBytes(int64(free)), cfg.Home)
+	}
+	simulateBackupSpace(cfg, &UpgradeInfo{Name: "<upgrade>"}, func(_ string, err error, format string, args ...interface{}) {
+		if err != nil {
+			status := CheckFail
+			if cfg.spaceCheck() == SpaceCheckWarn {
+				status = CheckWarn
+			}
+			add("backup space", status, "%v", err)
+			return
+		}
+		add("backup space", CheckPass, format, args...)
+	})
+}
+
+// doctorPermissions checks cosmovisor can write what it writes at an upgrade
+func doctorPermissions(cfg *Config, add func(string, CheckStatus, string, ...interface{})) {
+	dirs := [][2]string{{"data directory", cfg.DataDir()}, {"state directory", cfg.StateDir()}}
+	if !cfg.Immutable {
+		dirs = append(dirs, [2]string{"upgrades directory", filepath.Join(cfg.Root(), upgradesDir)})
+	}
+	if cfg.dataBackup() != DataBackupNone && cfg.DataBackupDest == "" {
+		dirs = append(dirs, [2]string{"backup directory", cfg.dataBackupDir()})
+	}
+	failed := false
+	for _, dir := range dirs {
+		if err := checkWritableAncestor(dir[1]); err != nil {
+			add("permissions", CheckFail, "%s %s can't be written: %v", dir[0], dir[1], err)
+			failed = true
+		}
+	}
+	if cfg.PostUpgradeHook != "" {
+		if _, _, err := postUpgradeHooks(cfg.PostUpgradeHook); err != nil {
+			add("permissions", CheckFail, "post-upgrade hook: %v", err)
+			failed = true
+		}
+	}
+	if !failed {
+		names := make([]string, len(dirs))
+		for i, dir := range dirs {
+			names[i] = dir[0]
+		}
+		add("permissions", CheckPass, "the %s can be written", joinWords(names))
+	}
+}
+
+// doctorPrivileges checks the daemon launched with dropped privileges owns the directories
+// it writes, the config and the data directories of the home
+func doctorPrivileges(cfg *Config, add func(string, CheckStatus, string, ...interface{})) {
+	o, ok := cfg.daemonOwner()
+	if !ok {
+		return
+	}
+	failed := false
+	for _, dir := range []string{filepath.Join(cfg.Home, "config"), cfg.DataDir()} {
+		uid, err := fileOwner(dir)
+		switch {
+		case os.IsNotExist(err) || errors.Is(err, errNotChecked):
+		case err != nil:
+			add("privileges", CheckWarn, "reading the owner of %s: %v", dir, err)
+			failed = true
+		case uid != o.uid:
+			add("privileges", CheckFail, "the daemon runs as %s (uid %d), but %s is owned by uid %d", cfg.RunAs, o.uid, dir, uid)
+			failed = true
+		}
+	}
+	if !failed {
+		add("privileges", CheckPass, "the daemon runs as %s (uid %d, gid %d), which owns its config and data", cfg.RunAs, o.uid, o.gid)
+	}
+}
+
+// doctorOpenFiles checks the limit of open files cosmovisor and the daemon start with
+func doctorOpenFiles(add func(string, CheckStatus, string, ...interface{})) {
+	limit, err := openFilesLimit()
+	switch {
+	case errors.Is(err, errNotChecked):
+	case err != nil:
+		add("open files", CheckWarn, "reading the limit of open files: %v", err)
+	case limit < doctorMinOpenFiles:
+		add("open files", CheckWarn, "the limit of open files is %d, raise it to %d or more, e.g. LimitNOFILE in the systemd unit", limit, doctorMinOpenFiles)
+	default:
+		add("open files", CheckPass, "the limit of open files is %d", limit)
+	}
+}
+
+// doctorEndpoint is a URL cosmovisor requests, and what it is for
+type doctorEndpoint struct {
+	what string
+	url  string
+	// download is set for the binaries of upgrades, which must be there
+	download bool
+}
+
+// doctorEndpoints checks the URLs cosmovisor will request answer: those of the binaries of
+// the queued and pending upgrades that aren't staged yet, and those of the services it is
+// configured with. The downloads go through the proxy and TLS settings of the downloads.
+func doctorEndpoints(cfg *Config, add func(string, CheckStatus, string, ...interface{})) {
+	var endpoints []doctorEndpoint
+	for _, e := range []struct{ env, url string }{
+		{"DAEMON_PLAN_API", cfg.PlanAPI},
+		{"DAEMON_PREDOWNLOAD_API", cfg.PredownloadAPI},
+		{"DAEMON_LIVENESS_RPC", cfg.LivenessRPC},
+		{"DAEMON_NOTIFY_WEBHOOK", cfg.NotifyWebhook},
+		{"DAEMON_METRICS_PUSH_URL", cfg.MetricsPushURL},
+		{"DAEMON_IPFS_GATEWAY", cfg.IPFSGateway},
+		{"DAEMON_DATA_BACKUP_DEST", cfg.DataBackupDest},
+	} {
+		if strings.HasPrefix(e.url, "http://") || strings.HasPrefix(e.url, "https://") {
+			endpoints = append(endpoints, doctorEndpoint{what: e.env, url: e.url})
+		}
+	}
+	for _, rpc := range cfg.PeerRPCs {
+		endpoints = append(endpoints, doctorEndpoint{what: "DAEMON_PEER_RPCS", url: rpc})
+	}
+	switch {
+	case !cfg.AllowDownloadBinaries:
+	case cfg.DownloaderCommand != "" || cfg.Downloader != nil:
+		add("endpoints", CheckPass, "the binaries are downloaded by the configured downloader, not checked")
+	default:
+		endpoints = append(endpoints, cfg.pendingDownloads()...)
+	}
+	if len(endpoints) == 0 {
+		return
+	}
+
+	client := &http.Client{Timeout: doctorRequestTimeout}
+	downloads := client
+	if transport, err := cfg.downloadTransport(); err != nil {
+		add("endpoints", CheckFail, "downloads: %v", err)
+		return
+	} else if cfg.customizesDownloads() {
+		downloads = &http.Client{Timeout: doctorRequestTimeout, Transport: transport}
+	}
+	for _, e := range endpoints {
+		c := client
+		if e.download {
+			c = downloads
+		}
+		status, err := probeEndpoint(c, e.url)
+		switch {
+		case err != nil && e.download:
+			add("endpoints", CheckFail, "%s: %s can't be reached: %v", e.what, redactURL(e.url), err)
+		case err != nil:
+			add("endpoints", CheckWarn, "%s: %s can't be reached: %v", e.what, redactURL(e.url), err)
+		case e.download && status >= 400:
+			add("endpoints", CheckFail, "%s: %s answered %d", e.what, redactURL(e.url), status)
+		default:
+			add("endpoints", CheckPass, "%s: %s answered %d", e.what, redactURL(e.url), status)
+		}
+	}
+}
+
+// pendingDownloads returns the URLs the binaries of the queued upgrades and of the plan in
+// the data directory will be downloaded from, for those that aren't staged yet. Only the
+// http and https URLs of plan infos naming the binaries directly are listed.
+func (cfg *Config) pendingDownloads() []doctorEndpoint {
+	var plans []*UpgradeInfo
+	if plan, err := cfg.PlanFile(); err == nil && plan != nil && !cfg.isCurrentUpgrade(plan.Name) {
+		plans = append(plans, plan)
+	}
+	if queue, err := cfg.UpgradeQueue(); err == nil {
+		for _, q := range queue {
+			plans = append(plans, q.UpgradeInfo())
+		}
+	}
+	var endpoints []doctorEndpoint
+	seen := map[string]bool{}
+	for _, plan := range plans {
+		doc := strings.TrimSpace(plan.Info)
+		if seen[plan.Name] || doc == "" || isReference(doc) {
+			continue
+		}
+		seen[plan.Name] = true
+		if _, err := os.Stat(cfg.UpgradeBin(plan.Name)); err == nil {
+			continue
+		}
+		_, config, err := binaryURL(doc)
+		if err != nil {
+			continue
+		}
+		urls, _ := config.BinaryURLs(OSArch())
+		for _, u := range urls {
+			src, _, err := splitChecksum(u)
+			if err != nil {
+				continue
+			}
+			if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+				endpoints = append(endpoints, doctorEndpoint{what: fmt.Sprintf("upgrade %q", plan.Name), url: src, download: true})
+			}
+		}
+	}
+	return endpoints
+}
+
+// isCurrentUpgrade returns true if current points to the directory of the named upgrade
+func (cfg *Config) isCurrentUpgrade(name string) bool {
+	bin, linked := cfg.resolveCurrentBin()
+	return linked && bin == cfg.UpgradeBin(name)
+}
+
+// probeEndpoint sends a HEAD request to u and returns the status code of the answer. Any
+// answer tells the endpoint can be reached.
+func probeEndpoint(client *http.Client, u string) (int, error) {
+	req, err := http.NewRequest(http.MethodHead, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	netrcAuth(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return 0, uerr.Err
+		}
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// redactURL hides the password of a URL for the report
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return parsed.Redacted()
+}
+
+// doctorProcesses checks no other process would run the node next to the daemon: another
+// cosmovisor holding the home, a daemon that outlived its cosmovisor, or a daemon started by
+// hand with the same binary
+func doctorProcesses(cfg *Config, add func(string, CheckStatus, string, ...interface{})) {
+	// running is set once a cosmovisor or the daemon is reported
+	running := false
+	var state RunState
+	recorded, _ := cfg.readStateFile(runStateFile, &state)
+	if f, err := lockDir(cfg.Root()); err == errLocked {
+		running = true
+		if supervisor := cfg.lockOwner(); supervisor > 0 {
+			add("processes", CheckPass, "cosmovisor (pid %d) supervises the home", supervisor)
+		} else {
+			add("processes", CheckPass, "a cosmovisor supervises the home")
+		}
+	} else if err == nil {
+		f.Close()
+		if recorded && processAlive(state.DaemonPID) {
+			running = true
+			add("processes", CheckFail, "the daemon (pid %d) outlived the cosmovisor that started it, stop it before starting cosmovisor", state.DaemonPID)
+		}
+	}
+
+	pids, err := daemonProcesses(cfg.DaemonName())
+	if errors.Is(err, errNotChecked) {
+		return
+	} else if err != nil {
+		add("processes", CheckWarn, "listing the processes: %v", err)
+		return
+	}
+	var others []string
+	for _, pid := range pids {
+		// the daemon of the run state was reported above
+		if pid != state.DaemonPID {
+			others = append(others, fmt.Sprint(pid))
+		}
+	}
+	if len(others) > 0 {
+		add("processes", CheckWarn, "%s also runs as pid %s: a second node with the same keys would double-sign, and one with the same home holds its databases", cfg.DaemonName(), strings.Join(others, ", "))
+	} else if !running {
+		add("processes", CheckPass, "no cosmovisor or %s is running", cfg.DaemonName())
+	}
+}
+
+// joinWords joins words as in a sentence: a, b and c
+func joinWords(words []string) string {
+	if len(words) < 2 {
+		return strings.Join(words, "")
+	}
+	return strings.Join(words[:len(words)-1], ", ") + " and " + words[len(words)-1]
+}
+
+// WriteDoctorReport prints the checks as aligned columns, then how many failed or warned
+func WriteDoctorReport(w io.Writer, r *DoctorReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range r.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Check, strings.ToUpper(string(c.Status)), c.Result)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%d passed, %d warnings, %d failed\n", r.Count(CheckPass), r.Count(CheckWarn), r.Count(CheckFail))
+	return err
+}
@@ -0,0 +1,42 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// daemonProcesses returns the pids of the processes running a binary named name, read from
+// /proc. The processes of other users whose binary can't be read are matched by the first
+// argument of their command line.
+func daemonProcesses(name string) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	self := os.Getpid()
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		dir := filepath.Join("/proc", e.Name())
+		if exe, err := os.Readlink(filepath.Join(dir, "exe")); err == nil {
+			if filepath.Base(exe) == name {
+				pids = append(pids, pid)
+			}
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		if arg0 := cmdline[:bytes.IndexByte(append(cmdline, 0), 0)]; filepath.Base(string(arg0)) == name {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package cosmovisor
+
+// daemonProcesses can't list the processes outside of linux
+func daemonProcesses(string) ([]int, error) {
+	return nil, errNotChecked
+}
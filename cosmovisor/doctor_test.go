@@ -0,0 +1,114 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// doctorChecks returns the results of the named check, prefixed by their status
+func doctorChecks(r *DoctorReport, check string) []string {
+	var results []string
+	for _, c := range r.Checks {
+		if c.Check == check {
+			results = append(results, string(c.Status)+": "+c.Result)
+		}
+	}
+	return results
+}
+
+func TestDoctor(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	r := Doctor(cfg)
+	require.Zero(t, r.Count(CheckFail), doctorChecks(r, "binary"))
+	require.Equal(t, []string{"pass: the data directory, state directory and upgrades directory can be written"}, doctorChecks(r, "permissions"))
+	require.Empty(t, doctorChecks(r, "endpoints"))
+
+	require.NoError(t, os.Chmod(cfg.GenesisBin(), 0644))
+	bin, _ := cfg.resolveCurrentBin()
+	require.NoError(t, os.Chmod(bin, 0644))
+	r = Doctor(cfg)
+	require.Equal(t, 1, r.Count(CheckFail))
+	require.Len(t, doctorChecks(r, "binary"), 1)
+	require.Contains(t, doctorChecks(r, "binary")[0], "fail: ")
+}
+
+func TestDoctorEndpoints(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodHead, r.Method)
+		if r.URL.Path != "/dummyd" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", AllowDownloadBinaries: true, PlanAPI: "http://127.0.0.1:1/plan"}
+	require.NoError(t, os.MkdirAll(cfg.QueueDir(), 0755))
+	queue := func(file, name, path string) {
+		info := fmt.Sprintf(`{\"binaries\":{\"%s\":\"%s%s\"}}`, OSArch(), server.URL, path)
+		plan := fmt.Sprintf(`{"name":%q,"height":%d,"info":"%s"}`, name, 100+len(file), info)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.QueueDir(), file), []byte(plan), 0644))
+	}
+	queue("1-v3.json", "v3", "/dummyd")
+	queue("2-v4.json", "v4", "/missing")
+	// chain2 is staged, its URL isn't checked
+	queue("3-chain2.json", "chain2", "/staged")
+
+	r := Doctor(cfg)
+	require.Equal(t, []string{
+		"warn: DAEMON_PLAN_API: http://127.0.0.1:1/plan can't be reached: dial tcp 127.0.0.1:1: connect: connection refused",
+		fmt.Sprintf("pass: upgrade \"v3\": %s/dummyd answered 200", server.URL),
+		fmt.Sprintf("fail: upgrade \"v4\": %s/missing answered 404", server.URL),
+	}, doctorChecks(r, "endpoints"))
+
+	cfg.DownloaderCommand = "fetch {{.URL}} {{.Dest}}"
+	require.Equal(t, []string{
+		"pass: the binaries are downloaded by the configured downloader, not checked",
+		"warn: DAEMON_PLAN_API: http://127.0.0.1:1/plan can't be reached: dial tcp 127.0.0.1:1: connect: connection refused",
+	}, doctorChecks(Doctor(cfg), "endpoints"))
+}
+
+func TestDoctorProcesses(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	require.Equal(t, []string{"pass: no cosmovisor or dummyd is running"}, doctorChecks(Doctor(cfg), "processes"))
+
+	// a daemon left running by a cosmovisor that is gone
+	daemon := exec.Command("sleep", "30")
+	require.NoError(t, daemon.Start())
+	defer daemon.Process.Kill()
+	require.NoError(t, cfg.writeStateFile(runStateFile, RunState{PID: 1 << 22, DaemonPID: daemon.Process.Pid}))
+	require.Equal(t, []string{
+		fmt.Sprintf("fail: the daemon (pid %d) outlived the cosmovisor that started it, stop it before starting cosmovisor", daemon.Process.Pid),
+	}, doctorChecks(Doctor(cfg), "processes"))
+
+	// another cosmovisor holds the home
+	f, err := lockDir(cfg.Root())
+	require.NoError(t, err)
+	defer f.Close()
+	// flock is per open file, the lock taken above conflicts with the probe of Doctor
+	require.Equal(t, []string{"pass: a cosmovisor supervises the home"}, doctorChecks(Doctor(cfg), "processes"))
+}
+
+func TestWriteDoctorReport(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteDoctorReport(&buf, &DoctorReport{Checks: []*DoctorCheck{
+		{Check: "binary", Status: CheckPass, Result: "genesis binary runs"},
+		{Check: "open files", Status: CheckWarn, Result: "the limit is 1024"},
+	}}))
+	require.Equal(t, "binary      PASS  genesis binary runs\nopen files  WARN  the limit is 1024\n\n1 passed, 1 warnings, 0 failed\n", buf.String())
+}
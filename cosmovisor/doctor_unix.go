@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package cosmovisor
+
+import (
+	"os"
+	"syscall"
+)
+
+// openFilesLimit returns the soft limit of open files of cosmovisor, which the daemon inherits
+func openFilesLimit() (uint64, error) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, err
+	}
+	return uint64(limit.Cur), nil
+}
+
+// fileOwner returns the uid of the owner of path
+func fileOwner(path string) (int, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	return int(st.Uid), nil
+}
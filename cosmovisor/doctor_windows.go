@@ -0,0 +1,11 @@
+package cosmovisor
+
+// openFilesLimit isn't read on windows, which has no such limit
+func openFilesLimit() (uint64, error) {
+	return 0, errNotChecked
+}
+
+// fileOwner isn't read on windows, where the daemon can't drop privileges
+func fileOwner(path string) (int, error) {
+	return 0, errNotChecked
+}
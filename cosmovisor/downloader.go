@@ -0,0 +1,165 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/hashicorp/go-getter"
+)
+
+// Downloader fetches the file at a URL to a local path, as is. Checksums and signatures are
+// verified and archives unpacked by cosmovisor afterwards.
+type Downloader interface {
+	Download(src, dst string) error
+}
+
+// getterDownloader is the built-in downloader, it supports everything go-getter does
+type getterDownloader struct {
+	// getters are go-getter's defaults if nil
+	getters map[string]getter.Getter
+	// err is why the getters couldn't be set up, each download fails with it
+	err error
+	// partialDir keeps the partial HTTP downloads, they aren't resumed if empty
+	partialDir string
+	// fs writes the partial downloads
+	fs fsGuard
+}
+
+func (d getterDownloader) Download(src, dst string) error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.resumes(src) {
+		return d.resume(src, dst)
+	}
+	return getWith(d.getterMap(), dst, withQuery(src, url.Values{"archive": {"false"}}), getter.ClientModeFile)
+}
+
+// getterMap returns the getters of the downloader
+func (d getterDownloader) getterMap() map[string]getter.Getter {
+	if d.getters == nil {
+		return getter.Getters
+	}
+	return d.getters
+}
+
+// CommandDownloader runs an external tool for each download, e.g. aria2c or an S3 client
+type CommandDownloader struct {
+	// Command is the template of the command line. It may use {{.URL}}, {{.Output}} (the
+	// file to write), {{.Dir}} and {{.File}} (its directory and name). If it uses none of
+	// them, the URL and the output are appended as the last two arguments.
+	Command string
+}
+
+// downloaderTemplateData is available to the downloader command template
+type downloaderTemplateData struct {
+	URL    string
+	Output string
+	Dir    string
+	File   string
+}
+
+// Args renders the command line downloading src to dst
+func (d CommandDownloader) Args(src, dst string) ([]string, error) {
+	data := downloaderTemplateData{URL: src, Output: dst, Dir: filepath.Dir(dst), File: filepath.Base(dst)}
+	args, err := renderCommand("downloader", d.Command, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty downloader command")
+	}
+	if !strings.Contains(d.Command, "{{") {
+		args = append(args, src, dst)
+	}
+	return args, nil
+}
+
+func (d CommandDownloader) Download(src, dst string) error {
+	args, err := d.Args(src, dst)
+	if err != nil {
+		return err
+	}
+	logger.Infof("downloading %s with %s", src, strings.Join(args, " "))
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	if _, err := os.Stat(dst); err != nil {
+		return fmt.Errorf("%s exited successfully but didn't write the download: %w", args[0], err)
+	}
+	return nil
+}
+
+// downloader returns the downloader configured for cfg, go-getter by default
+func (cfg *Config) downloader() Downloader {
+	switch {
+	case cfg.Downloader != nil:
+		return cfg.Downloader
+	case cfg.DownloaderCommand != "":
+		return CommandDownloader{Command: cfg.DownloaderCommand}
+	default:
+		if cfg.UnsafeSkipTLSVerify {
+			logger.Warnf("DAEMON_UNSAFE_SKIP_TLS_VERIFY is set, downloads accept any server certificate")
+		}
+		getters, err := cfg.downloadGetters()
+		return getterDownloader{getters: getters, err: err, partialDir: cfg.downloadsPath(), fs: cfg.fs()}
+	}
+}
+
+// renderCommand renders a command line template. The template is split into arguments
+// before rendering, so paths containing spaces stay a single argument, but spaces inside
+// an action like {{ .Home }} don't split it.
+func renderCommand(name, command string, data interface{}) ([]string, error) {
+	fields := splitCommand(command)
+	args := make([]string, len(fields))
+	for i, field := range fields {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(field)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s command: %w", name, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("rendering %s command: %w", name, err)
+		}
+		args[i] = buf.String()
+	}
+	return args, nil
+}
+
+// splitCommand splits a command line template on the whitespace outside of its actions
+func splitCommand(command string) []string {
+	var fields []string
+	var field strings.Builder
+	inAction := false
+	for i := 0; i < len(command); i++ {
+		switch {
+		case !inAction && strings.HasPrefix(command[i:], "{{"):
+			inAction = true
+			field.WriteString("{{")
+			i++
+		case inAction && strings.HasPrefix(command[i:], "}}"):
+			inAction = false
+			field.WriteString("}}")
+			i++
+		case !inAction && unicode.IsSpace(rune(command[i])):
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+		default:
+			field.WriteByte(command[i])
+		}
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
@@ -0,0 +1,223 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandDownloaderArgs(t *testing.T) {
+	cases := map[string]struct {
+		command string
+		expect  []string
+		err     string
+	}{
+		"appended":        {command: "curl -fsSL -o", expect: []string{"curl", "-fsSL", "-o", "https://example.com/a.zip", "/tmp/dl/a.zip"}},
+		"template":        {command: "curl -fsSL {{.URL}} -o {{.Output}}", expect: []string{"curl", "-fsSL", "https://example.com/a.zip", "-o", "/tmp/dl/a.zip"}},
+		"dir and file":    {command: "aria2c -x4 -d {{.Dir}} -o {{.File}} {{.URL}}", expect: []string{"aria2c", "-x4", "-d", "/tmp/dl", "-o", "a.zip", "https://example.com/a.zip"}},
+		"spaced actions":  {command: `curl -fsSL {{ .URL }} -o {{ printf "%s.part" .Output }}`, expect: []string{"curl", "-fsSL", "https://example.com/a.zip", "-o", "/tmp/dl/a.zip.part"}},
+		"unknown field":   {command: "fetch {{.Height}}", err: "rendering downloader command"},
+		"broken template": {command: "fetch {{.URL", err: "parsing downloader command"},
+		"empty":           {command: " ", err: "empty downloader command"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			args, err := CommandDownloader{Command: tc.command}.Args("https://example.com/a.zip", "/tmp/dl/a.zip")
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, args)
+		})
+	}
+}
+
+// recordingDownloader copies local files and records what was fetched
+type recordingDownloader struct {
+	fetched []string
+}
+
+func (d *recordingDownloader) Download(src, dst string) error {
+	d.fetched = append(d.fetched, src)
+	return copy.Copy(src, dst)
+}
+
+func TestDownloadBinaryWithDownloader(t *testing.T) {
+	repo, err := filepath.Abs(filepath.Join("testdata", "repo"))
+	require.NoError(t, err)
+	raw := filepath.Join(repo, "raw_binary", "autod")
+	zipped := filepath.Join(repo, "zip_directory", "autod.zip")
+
+	cases := map[string]struct {
+		command string
+		url     string
+		err     string
+	}{
+		"raw binary": {
+			command: "cp",
+			url:     raw + "?checksum=sha256:e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d",
+		},
+		"zipped directory": {
+			command: "cp {{.URL}} {{.Output}}",
+			url:     zipped + "?checksum=sha256:3784e4574cad69b67e34d4ea4425eff140063a3870270a301d6bb24a098a27ae",
+		},
+		"without checksum": {
+			command: "cp",
+			url:     raw,
+		},
+		"checksum mismatch": {
+			command: "cp",
+			url:     raw + "?checksum=sha256:73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906",
+			err:     "checksums did not match",
+		},
+		"checksum file": {
+			command: "cp",
+			url:     raw + "?checksum=file:https://example.com/SHA256SUMS",
+			err:     "file checksums can only be verified by the built-in downloader",
+		},
+		"command fails": {
+			command: "false",
+			url:     raw,
+			err:     "false " + raw,
+		},
+		"nothing written": {
+			command: "true",
+			url:     raw,
+			err:     "true exited successfully but didn't write the download",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home := t.TempDir()
+			require.NoError(t, copy.Copy(filepath.Join("testdata", "download"), home))
+			cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, DownloaderCommand: tc.command}
+			info := &UpgradeInfo{Name: "amazonas", Info: fmt.Sprintf(`{"binaries": {"any": "%s"}}`, tc.url)}
+
+			err := DownloadBinary(cfg, info)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, EnsureBinary(cfg.UpgradeBin("amazonas")))
+		})
+	}
+}
+
+func TestDownloaderFetchesEverything(t *testing.T) {
+	// the reference document, the binary and its signature all go through the downloader
+	m := newMinisigner(t)
+	key, err := ParseSignatureKey([]byte(m.publicKey()))
+	require.NoError(t, err)
+	artifact, err := filepath.Abs(filepath.Join("testdata", "repo", "raw_binary", "autod"))
+	require.NoError(t, err)
+	bz, err := ioutil.ReadFile(artifact)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	sig := filepath.Join(dir, "autod.minisig")
+	require.NoError(t, ioutil.WriteFile(sig, m.sign(bz, false), 0644))
+	ref := filepath.Join(dir, "plan.json")
+	require.NoError(t, ioutil.WriteFile(ref, []byte(fmt.Sprintf(`{"binaries": {"any": "%s"}, "signatures": {"any": "%s"}}`, artifact, sig)), 0644))
+
+	home := t.TempDir()
+	require.NoError(t, copy.Copy(filepath.Join("testdata", "download"), home))
+	dl := &recordingDownloader{}
+	cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, BinaryPubKey: key, Downloader: dl, DownloaderCommand: "false"}
+	require.NoError(t, DownloadBinary(cfg, &UpgradeInfo{Name: "amazonas", Info: ref}))
+	require.NoError(t, EnsureBinary(cfg.UpgradeBin("amazonas")))
+	require.Equal(t, []string{ref, artifact, sig}, dl.fetched)
+}
+
+// flakyDownloader fails the first downloads, then copies local files
+type flakyDownloader struct {
+	recordingDownloader
+	failures int
+}
+
+func (d *flakyDownloader) Download(src, dst string) error {
+	if d.failures > 0 {
+		d.failures--
+		d.fetched = append(d.fetched, src)
+		return errors.New("connection reset by peer")
+	}
+	return d.recordingDownloader.Download(src, dst)
+}
+
+func TestDownloadBinaryRetries(t *testing.T) {
+	raw, err := filepath.Abs(filepath.Join("testdata", "repo", "raw_binary", "autod"))
+	require.NoError(t, err)
+	missing := filepath.Join(filepath.Dir(raw), "missing")
+	sum := "?checksum=sha256:e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d"
+
+	cases := map[string]struct {
+		binaries string
+		failures int
+		fetched  []string
+		err      string
+	}{
+		"retried": {
+			binaries: fmt.Sprintf(`"%s%s"`, raw, sum),
+			failures: 2,
+			fetched:  []string{raw, raw, raw},
+		},
+		"out of attempts": {
+			binaries: fmt.Sprintf(`"%s%s"`, raw, sum),
+			failures: 3,
+			fetched:  []string{raw, raw, raw},
+			err:      "connection reset by peer",
+		},
+		"mirror": {
+			binaries: fmt.Sprintf(`["%s%s", "%s%s"]`, missing, sum, raw, sum),
+			fetched:  []string{missing, missing, missing, raw},
+		},
+		"all mirrors fail": {
+			binaries: fmt.Sprintf(`["%s%s", "%s%s"]`, missing, sum, missing, sum),
+			fetched:  []string{missing, missing, missing, missing, missing, missing},
+			err:      "all 2 URLs failed",
+		},
+		"mirror without checksum isn't retried": {
+			binaries: fmt.Sprintf(`["%s", "%s%s"]`, missing, raw, sum),
+			fetched:  []string{raw},
+		},
+		"empty list": {
+			binaries: `[]`,
+			err:      "no URL listed for any",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home := t.TempDir()
+			require.NoError(t, copy.Copy(filepath.Join("testdata", "download"), home))
+			dl := &flakyDownloader{failures: tc.failures}
+			cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, DownloadMustHaveChecksum: true,
+				Downloader: dl, DownloadBackoff: time.Millisecond}
+			info := &UpgradeInfo{Name: "amazonas", Info: fmt.Sprintf(`{"binaries": {"any": %s}}`, tc.binaries)}
+
+			err := DownloadBinary(cfg, info)
+			require.Equal(t, tc.fetched, dl.fetched)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				_, err = os.Stat(cfg.UpgradeDir("amazonas"))
+				require.True(t, os.IsNotExist(err))
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, EnsureBinary(cfg.UpgradeBin("amazonas")))
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package cosmovisor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bgentry/go-netrc/netrc"
+	"github.com/hashicorp/go-getter"
+	"github.com/otiai10/copy"
+)
+
+// downloadsDir keeps the partial HTTP downloads of the built-in downloader, which the next
+// attempt resumes
+const downloadsDir = "downloads"
+
+// resumeMu serializes the resumable downloads, the pre-download and the upgrade may fetch
+// the same URL
+var resumeMu sync.Mutex
+
+// downloadsPath is the directory of the partial downloads, none if nothing may be written
+// or there is no home to keep them in
+func (cfg *Config) downloadsPath() string {
+	if cfg.ReadOnly || cfg.Home == "" {
+		return ""
+	}
+	return filepath.Join(cfg.StateDir(), downloadsDir)
+}
+
+// resumes returns true if the downloader fetches src itself, keeping a partial file to
+// resume from. That is the http and https URLs, unless go-getter must read a checksum file.
+func (d getterDownloader) resumes(src string) bool {
+	if d.partialDir == "" {
+		return false
+	}
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	_, sum, err := splitChecksum(src)
+	return err == nil && (sum == nil || sum.algorithm.new != nil)
+}
+
+// httpClient is the client of the HTTP getter, with the proxy and TLS settings of the
+// downloads
+func (d getterDownloader) httpClient() *http.Client {
+	if g, ok := d.getterMap()["https"].(*getter.HttpGetter); ok && g.Client != nil {
+		return g.Client
+	}
+	return http.DefaultClient
+}
+
+// partialDownload is the partial file of a URL and the validator (ETag or Last-Modified)
+// of the response it holds the start of
+type partialDownload struct {
+	path      string
+	validator string
+	fs        fsGuard
+}
+
+// partial returns the partial download of src
+func (d getterDownloader) partial(src string) partialDownload {
+	sum := sha256.Sum256([]byte(src))
+	path := filepath.Join(d.partialDir, hex.EncodeToString(sum[:16])+".part")
+	return partialDownload{path: path, validator: path + ".validator", fs: d.fs}
+}
+
+// remove deletes the partial file, so the next attempt starts over
+func (p partialDownload) remove() {
+	p.fs.remove(p.path)
+	p.fs.remove(p.validator)
+}
+
+// resume downloads src to dst over HTTP. The bytes received are kept in a partial file,
+// and the next attempt asks for the rest of the file with a Range request, conditioned on
+// the validator of the first response so a changed file is downloaded anew. The checksum
+// in the URL, if there is one, is verified once the file is complete.
+func (d getterDownloader) resume(src, dst string) error {
+	fetch, sum, err := splitChecksum(src)
+	if err != nil {
+		return err
+	}
+	resumeMu.Lock()
+	defer resumeMu.Unlock()
+	if err := d.fs.mkdirAll(d.partialDir, 0755); err != nil {
+		return err
+	}
+	part := d.partial(fetch)
+	f, err := d.fs.openFile(part.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fetch, nil)
+	if err != nil {
+		return err
+	}
+	netrcAuth(req)
+	offset := fi.Size()
+	validator, _ := ioutil.ReadFile(part.validator)
+	if offset > 0 && len(validator) > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", string(validator))
+	} else {
+		offset = 0
+	}
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		offset = 0
+	case http.StatusPartialContent:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			part.remove()
+			return fmt.Errorf("resuming %s: the server sent the range %q instead of bytes %d-", fetch, resp.Header.Get("Content-Range"), offset)
+		}
+		logger.Infof("resuming the download of %s at byte %d", fetch, offset)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is complete if an attempt stopped before moving it
+		if resp.Header.Get("Content-Range") != fmt.Sprintf("bytes */%d", offset) {
+			part.remove()
+			return fmt.Errorf("resuming %s: the server refused bytes %d-, the next attempt starts over", fetch, offset)
+		}
+	default:
+		return fmt.Errorf("bad response code: %d", resp.StatusCode)
+	}
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		if offset == 0 {
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+			if err := savePartialValidator(part, resp); err != nil {
+				return err
+			}
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		var body io.Reader = resp.Body
+		if resp.ContentLength >= 0 {
+			body = faultReader("download.stream", body, offset, offset+resp.ContentLength)
+		}
+		n, err := io.Copy(f, body)
+		if err != nil {
+			return fmt.Errorf("download of %s stopped after %d bytes, the next attempt resumes it: %w", fetch, offset+n, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if sum != nil {
+		if err := verifyFile(part.path, sum); err != nil {
+			part.remove()
+			return fmt.Errorf("verifying %s: %w", fetch, err)
+		}
+	}
+	if err := d.fs.mkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := d.fs.rename(part.path, dst); err != nil {
+		// the partial downloads may be on another file system
+		if err := d.fs.check("copy", dst); err != nil {
+			return err
+		}
+		if err := copy.Copy(part.path, dst); err != nil {
+			return err
+		}
+	}
+	part.remove()
+	return nil
+}
+
+// savePartialValidator records what identifies the file being downloaded. If-Range needs a
+// strong ETag or a date, without either the download can't be resumed.
+func savePartialValidator(part partialDownload, resp *http.Response) error {
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if validator == "" {
+		if err := part.fs.remove(part.validator); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return part.fs.writeFile(part.validator, []byte(validator), 0644)
+}
+
+// contentRangeStart returns the first byte of a Content-Range header: bytes <start>-<end>/<size>
+func contentRangeStart(header string) (int64, bool) {
+	rest := strings.TrimPrefix(header, "bytes ")
+	i := strings.Index(rest, "-")
+	if rest == header || i < 0 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(rest[:i], 10, 64)
+	return start, err == nil
+}
+
+// netrcAuth adds the credentials .netrc has for the host of req, as go-getter does
+func netrcAuth(req *http.Request) {
+	if req.URL.User != nil {
+		return
+	}
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	machine, err := netrc.FindMachine(path, req.URL.Hostname())
+	if err != nil || machine == nil {
+		return
+	}
+	req.SetBasicAuth(machine.Login, machine.Password)
+}
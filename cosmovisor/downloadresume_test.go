@@ -0,0 +1,146 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyServer serves content with http.ServeContent, dropping the connection halfway
+// through the first response. It records the Range header of each request.
+type flakyServer struct {
+	content []byte
+	etag    string
+	// dropped is set once the first response was cut
+	dropped bool
+	ranges  []string
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	if s.etag != "" {
+		w.Header().Set("ETag", s.etag)
+	}
+	if !s.dropped {
+		s.dropped = true
+		w.Header().Set("Content-Length", fmt.Sprint(len(s.content)))
+		_, _ = w.Write(s.content[:len(s.content)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.content))
+}
+
+func TestResumeDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("wasmvm"), 10000)
+	changed := bytes.Repeat([]byte("WASMVM"), 10000)
+	sum := sha256.Sum256(content)
+	half := fmt.Sprintf("bytes=%d-", len(content)/2)
+
+	cases := map[string]struct {
+		etag string
+		// change replaces the file and its ETag after the first attempt
+		change   bool
+		checksum string
+		expect   []byte
+		ranges   []string
+		err      string
+	}{
+		"resumed":           {etag: `"v1"`, expect: content, ranges: []string{"", half}},
+		"resumed verified":  {etag: `"v1"`, checksum: "sha256:" + hex.EncodeToString(sum[:]), expect: content, ranges: []string{"", half}},
+		"file changed":      {etag: `"v1"`, change: true, expect: changed, ranges: []string{"", half}},
+		"no validator":      {expect: content, ranges: []string{"", ""}},
+		"weak etag":         {etag: `W/"v1"`, expect: content, ranges: []string{"", ""}},
+		"checksum mismatch": {etag: `"v1"`, change: true, checksum: "sha256:" + hex.EncodeToString(sum[:]), ranges: []string{"", half}, err: "checksums did not match"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := &flakyServer{content: content, etag: tc.etag}
+			server := httptest.NewServer(s)
+			defer server.Close()
+			d := getterDownloader{partialDir: t.TempDir()}
+			src := server.URL + "/gaiad"
+			if tc.checksum != "" {
+				src += "?checksum=" + tc.checksum
+			}
+			require.True(t, d.resumes(src))
+			dst := filepath.Join(t.TempDir(), "gaiad")
+
+			err := d.Download(src, dst)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "the next attempt resumes it")
+			if tc.change {
+				s.content, s.etag = changed, `"v2"`
+			}
+			err = d.Download(src, dst)
+			require.Equal(t, tc.ranges, s.ranges)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+			} else {
+				require.NoError(t, err)
+				bz, err := ioutil.ReadFile(dst)
+				require.NoError(t, err)
+				require.True(t, bytes.Equal(tc.expect, bz))
+			}
+			// nothing is left to resume
+			left, err := ioutil.ReadDir(d.partialDir)
+			require.NoError(t, err)
+			require.Empty(t, left)
+		})
+	}
+}
+
+func TestResumes(t *testing.T) {
+	d := getterDownloader{partialDir: t.TempDir()}
+	require.True(t, d.resumes("https://example.com/gaiad"))
+	require.True(t, d.resumes("http://example.com/gaiad?checksum=blake2b-256:"+strings.Repeat("00", 32)))
+	require.False(t, d.resumes("https://example.com/gaiad?checksum=file:https://example.com/SHA256SUMS"))
+	require.False(t, d.resumes("s3::https://s3.amazonaws.com/bucket/gaiad"))
+	require.False(t, d.resumes("/tmp/gaiad"))
+	require.False(t, getterDownloader{}.resumes("https://example.com/gaiad"))
+}
+
+func TestResumeReadOnly(t *testing.T) {
+	// the partial downloads are written through the guard, which refuses them
+	dir := filepath.Join(t.TempDir(), "downloads")
+	d := getterDownloader{partialDir: dir, fs: fsGuard{readOnly: true}}
+	require.Panics(t, func() { _ = d.resume("https://example.com/gaiad", filepath.Join(t.TempDir(), "gaiad")) })
+	_, err := os.Stat(dir)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadBinaryResumes(t *testing.T) {
+	script, err := ioutil.ReadFile(filepath.Join("testdata", "repo", "raw_binary", "autod"))
+	require.NoError(t, err)
+	s := &flakyServer{content: script, etag: `"autod"`}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	sum := sha256.Sum256(script)
+
+	home := t.TempDir()
+	require.NoError(t, copy.Copy(filepath.Join("testdata", "download"), home))
+	cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, DownloadBackoff: time.Millisecond}
+	info := &UpgradeInfo{Name: "amazonas", Info: fmt.Sprintf(`{"binaries": {"any": "%s/autod?checksum=sha256:%x"}}`, server.URL, sum)}
+	require.NoError(t, DownloadBinary(cfg, info))
+	require.NoError(t, EnsureBinary(cfg.UpgradeBin("amazonas")))
+	require.Equal(t, []string{"", fmt.Sprintf("bytes=%d-", len(script)/2)}, s.ranges)
+	left, err := ioutil.ReadDir(cfg.downloadsPath())
+	require.NoError(t, err)
+	require.Empty(t, left)
+}
@@ -0,0 +1,99 @@
+package cosmovisor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/hashicorp/go-getter"
+)
+
+// customizesDownloads returns whether the HTTP downloads of the built-in downloader use
+// other settings than go-getter's defaults
+func (cfg *Config) customizesDownloads() bool {
+	return cfg.DownloadProxy != "" || cfg.DownloadCACert != "" || cfg.DownloadClientCert != "" || cfg.UnsafeSkipTLSVerify
+}
+
+// downloadTransport returns the transport of the HTTP downloads: the proxy of
+// DownloadProxy or of HTTP_PROXY, HTTPS_PROXY and NO_PROXY, the system roots with
+// DownloadCACert added, and the client certificate if there is one
+func (cfg *Config) downloadTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.DownloadProxy != "" {
+		proxy, err := url.Parse(cfg.DownloadProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	// opted into with DAEMON_UNSAFE_SKIP_TLS_VERIFY, only checksums and signatures are left
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.UnsafeSkipTLSVerify}
+	if cfg.DownloadCACert != "" {
+		pem, err := ioutil.ReadFile(cfg.DownloadCACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading the CA certificates: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s holds no PEM certificate", cfg.DownloadCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.DownloadClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.DownloadClientCert, cfg.DownloadClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading the client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// downloadGetters returns the getters of the built-in downloader, go-getter's defaults
+// with the HTTP getters using the download transport if cfg customizes it
+func (cfg *Config) downloadGetters() (map[string]getter.Getter, error) {
+	if !cfg.customizesDownloads() {
+		return getter.Getters, nil
+	}
+	transport, err := cfg.downloadTransport()
+	if err != nil {
+		return nil, err
+	}
+	getters := make(map[string]getter.Getter, len(getter.Getters))
+	for k, g := range getter.Getters {
+		getters[k] = g
+	}
+	httpGetter := &getter.HttpGetter{Netrc: true, Client: &http.Client{Transport: transport}}
+	getters["http"], getters["https"] = httpGetter, httpGetter
+	return getters, nil
+}
+
+// validateDownloadTLS returns an error if the download settings can't be used
+func (cfg *Config) validateDownloadTLS() error {
+	if (cfg.DownloadClientCert == "") != (cfg.DownloadClientKey == "") {
+		return errors.New("DAEMON_DOWNLOAD_CLIENT_CERT and DAEMON_DOWNLOAD_CLIENT_KEY must be set together")
+	}
+	if cfg.DownloadProxy != "" {
+		u, err := url.Parse(cfg.DownloadProxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid DAEMON_DOWNLOAD_PROXY %q: must be a URL like http://proxy:3128", cfg.DownloadProxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("invalid DAEMON_DOWNLOAD_PROXY %q: the scheme must be http, https or socks5", cfg.DownloadProxy)
+		}
+	}
+	if _, err := cfg.downloadGetters(); err != nil {
+		return fmt.Errorf("invalid download TLS settings: %w", err)
+	}
+	return nil
+}
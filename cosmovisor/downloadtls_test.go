@@ -0,0 +1,135 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writePEM writes a PEM block of the type to a new file of dir and returns its path
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600))
+	return path
+}
+
+// clientCert writes a self-signed client certificate and its key to dir
+func clientCert(t *testing.T, dir string) (cert, key string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "validator"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	require.NoError(t, err)
+	return writePEM(t, dir, "client.pem", "CERTIFICATE", der), writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func TestDownloadTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 && r.URL.Path == "/mtls" {
+			http.Error(w, "no client certificate", http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("binary"))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	// the handshakes refused by the client are expected
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	dir := t.TempDir()
+	ca := writePEM(t, dir, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	cert, key := clientCert(t, dir)
+
+	cases := map[string]struct {
+		cfg  Config
+		path string
+		err  string
+	}{
+		"system roots":   {path: "/file", err: "certificate"},
+		"custom CA":      {cfg: Config{DownloadCACert: ca}, path: "/file"},
+		"skip verify":    {cfg: Config{UnsafeSkipTLSVerify: true}, path: "/file"},
+		"no client cert": {cfg: Config{DownloadCACert: ca}, path: "/mtls", err: "403"},
+		"client cert":    {cfg: Config{DownloadCACert: ca, DownloadClientCert: cert, DownloadClientKey: key}, path: "/mtls"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := tc.cfg
+			dst := filepath.Join(t.TempDir(), "download")
+			err := cfg.downloader().Download(server.URL+tc.path, dst)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			bz, err := ioutil.ReadFile(dst)
+			require.NoError(t, err)
+			require.Equal(t, "binary", string(bz))
+		})
+	}
+}
+
+func TestDownloadProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		_, _ = w.Write([]byte("binary"))
+	}))
+	defer proxy.Close()
+	cfg := &Config{DownloadProxy: proxy.URL}
+	dst := filepath.Join(t.TempDir(), "download")
+	require.NoError(t, cfg.downloader().Download("http://binaries.invalid/gaiad", dst))
+	require.Equal(t, "http://binaries.invalid/gaiad", proxied)
+}
+
+func TestValidateDownloadTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := clientCert(t, dir)
+	empty := filepath.Join(dir, "empty.pem")
+	require.NoError(t, ioutil.WriteFile(empty, nil, 0600))
+	cases := map[string]struct {
+		cfg Config
+		err string
+	}{
+		"defaults":      {},
+		"client cert":   {cfg: Config{DownloadClientCert: cert, DownloadClientKey: key}},
+		"no key":        {cfg: Config{DownloadClientCert: cert}, err: "DAEMON_DOWNLOAD_CLIENT_CERT and DAEMON_DOWNLOAD_CLIENT_KEY must be set together"},
+		"swapped":       {cfg: Config{DownloadClientCert: key, DownloadClientKey: cert}, err: "loading the client certificate"},
+		"empty CA":      {cfg: Config{DownloadCACert: empty}, err: "holds no PEM certificate"},
+		"missing CA":    {cfg: Config{DownloadCACert: filepath.Join(dir, "missing.pem")}, err: "reading the CA certificates"},
+		"proxy":         {cfg: Config{DownloadProxy: "socks5://localhost:1080"}},
+		"proxy scheme":  {cfg: Config{DownloadProxy: "ftp://proxy:21"}, err: "the scheme must be http, https or socks5"},
+		"proxy no host": {cfg: Config{DownloadProxy: "proxy:3128"}, err: "must be a URL like http://proxy:3128"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.cfg.validateDownloadTLS()
+			if tc.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// downtimeFile holds the timeline of the last upgrade until the new binary commits its first
+// block, in the state directory. It outlives cosmovisor, which may exit after the upgrade.
+const downtimeFile = "downtime.json"
+
+// downtimePollInterval is how often LivenessRPC is asked for the first block after an upgrade
+const downtimePollInterval = time.Second
+
+// blockCommitRegex matches the line CometBFT logs as it commits a block, in the text and the
+// JSON log formats, e.g. `INF committed state app_hash=... height=48 module=state`. JSON logs
+// may have the message after the fields.
+var blockCommitRegex = regexp.MustCompile(`(?:committed state|finalized block|finalizing commit of block).*?\bheight"?[=:]\s*"?(\d+)|` +
+	`\bheight"?[=:]\s*"?(\d+).*(?:committed state|finalized block|finalizing commit of block)`)
+
+// UpgradeDowntime is the timeline of an upgrade as the network sees it, from the last block
+// the old binary committed to the first block the new binary committed. Times are UTC and
+// taken when cosmovisor saw the block in the daemon's output or on LivenessRPC.
+type UpgradeDowntime struct {
+	// LastBlockHeight is the last block before the upgrade, the height of the upgrade minus
+	// one if no block was seen
+	LastBlockHeight int64 `json:"last_block_height,omitempty"`
+	// LastBlockAt is when the last block was seen, nil if no block was seen
+	LastBlockAt *time.Time `json:"last_block_at,omitempty"`
+	// StoppedAt is when cosmovisor stopped the old binary, or saw it exit
+	StoppedAt time.Time `json:"stopped_at"`
+	// StartedAt is when the new binary was launched
+	StartedAt time.Time `json:"started_at"`
+	// FirstBlockHeight and FirstBlockAt are the first block after the upgrade
+	FirstBlockHeight int64     `json:"first_block_height"`
+	FirstBlockAt     time.Time `json:"first_block_at"`
+}
+
+// Downtime is the time from the last block to the first block after the upgrade, from the
+// stop of the old binary if its last block wasn't seen
+func (d *UpgradeDowntime) Downtime() time.Duration {
+	if d.LastBlockAt != nil {
+		return d.FirstBlockAt.Sub(*d.LastBlockAt)
+	}
+	return d.FirstBlockAt.Sub(d.StoppedAt)
+}
+
+// pendingDowntime is the downtime of an upgrade whose new binary has no block yet
+type pendingDowntime struct {
+	Upgrade string `json:"upgrade"`
+	// Binary is the binary of the upgrade, the downtime is dropped once another one runs
+	Binary string `json:"binary"`
+	UpgradeDowntime
+}
+
+// blockWatch follows the blocks the daemon commits, as seen in its output and on LivenessRPC
+type blockWatch struct {
+	mutex  sync.Mutex
+	height int64
+	at     time.Time
+	// pending is the downtime the first block above its last block ends, if any
+	pending *pendingDowntime
+	// ending is set while the pending downtime is written to the history, it stays pending
+	// until it is there
+	ending bool
+	// failure is the first consensus failure the daemon logged
+	failure string
+	cfg     *Config
+}
+
+// scan records the block the output line tells was committed, or the consensus failure it
+// tells, if any
+func (w *blockWatch) scan(line []byte) {
+	if bytes.Contains(line, consensusFailureMarker) {
+		w.mutex.Lock()
+		if w.failure == "" {
+			w.failure = string(bytes.TrimSpace(line))
+		}
+		w.mutex.Unlock()
+	}
+	if !bytes.Contains(line, []byte("height")) {
+		return
+	}
+	m := blockCommitRegex.FindSubmatch(line)
+	if m == nil {
+		return
+	}
+	if height, err := strconv.ParseInt(string(m[1])+string(m[2]), 10, 64); err == nil {
+		w.committed(height, NowUTC())
+	}
+}
+
+// committed records a block seen at, and ends the pending downtime with the first block above
+// the last block before the upgrade
+func (w *blockWatch) committed(height int64, at time.Time) {
+	w.mutex.Lock()
+	if height <= w.height {
+		w.mutex.Unlock()
+		return
+	}
+	w.height, w.at = height, at
+	pending := w.pending
+	if pending == nil || w.ending || height <= pending.LastBlockHeight {
+		w.mutex.Unlock()
+		return
+	}
+	w.ending = true
+	w.mutex.Unlock()
+
+	pending.FirstBlockHeight, pending.FirstBlockAt = height, at
+	w.cfg.finishDowntime(pending)
+	w.mutex.Lock()
+	w.pending, w.ending = nil, false
+	w.mutex.Unlock()
+}
+
+// last returns the last block seen, zero if none
+func (w *blockWatch) last() (int64, time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.height, w.at
+}
+
+// consensusFailure returns the line of the first consensus failure the daemon logged, empty
+// if there was none
+func (w *blockWatch) consensusFailure() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.failure
+}
+
+// waiting returns true while the pending downtime has no first block, or isn't in the
+// history yet
+func (w *blockWatch) waiting() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.pending != nil
+}
+
+// watchBlocks follows the blocks of the daemon just launched with bin. The downtime of an
+// upgrade to bin is ended by its first block, seen in the output or, with LivenessRPC set,
+// polled every second until then.
+func (cfg *Config) watchBlocks(bin string, done <-chan struct{}) *blockWatch {
+	w := &blockWatch{cfg: cfg}
+	var pending pendingDowntime
+	if ok, err := cfg.readStateFile(downtimeFile, &pending); err != nil {
+		logger.Warnf("reading the downtime of the last upgrade: %v", err)
+		return w
+	} else if !ok {
+		return w
+	}
+	if pending.Binary != bin {
+		logger.Debugf("dropping the downtime of upgrade %q, %s runs instead of %s", pending.Upgrade, bin, pending.Binary)
+		cfg.removeDowntime()
+		return w
+	}
+	// a binary that failed before its first block was launched already
+	if pending.StartedAt.IsZero() {
+		pending.StartedAt = NowUTC()
+		if err := cfg.writeStateFile(downtimeFile, pending); err != nil {
+			logger.Warnf("recording the downtime of upgrade %q: %v", pending.Upgrade, err)
+		}
+	}
+	w.pending = &pending
+	if cfg.LivenessRPC != "" {
+		goGuarded(cfg, func() { w.pollRPC(done) })
+	}
+	return w
+}
+
+// pollRPC asks LivenessRPC for the height until the pending downtime ended or done is closed.
+// The RPC only answers once the node loaded its stores.
+func (w *blockWatch) pollRPC(done <-chan struct{}) {
+	client := &http.Client{Timeout: nodeAPITimeout}
+	ticker := time.NewTicker(downtimePollInterval)
+	defer ticker.Stop()
+	for w.waiting() {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if height, err := NodeHeight(client, w.cfg.LivenessRPC); err == nil {
+			w.committed(height, NowUTC())
+		}
+	}
+}
+
+// startDowntime records the start of the downtime of the upgrade just applied, from the last
+// block blocks saw and the time the old binary was stopped. It ends with the first block of
+// the new binary, which may be run by the next cosmovisor.
+func (cfg *Config) startDowntime(info *UpgradeInfo, blocks *blockWatch, stoppedAt time.Time) {
+	bin, err := cfg.CurrentBin()
+	if err != nil {
+		return
+	}
+	pending := pendingDowntime{Upgrade: info.Name, Binary: bin, UpgradeDowntime: UpgradeDowntime{StoppedAt: stoppedAt.UTC()}}
+	if height, at := blocks.last(); height > 0 {
+		pending.LastBlockHeight, pending.LastBlockAt = height, &at
+	} else if info.Height > 0 {
+		pending.LastBlockHeight = info.Height - 1
+	}
+	if err := cfg.writeStateFile(downtimeFile, pending); err != nil {
+		logger.Warnf("recording the downtime of upgrade %q: %v", info.Name, err)
+	}
+}
+
+// finishDowntime records the timeline of the upgrade whose new binary committed its first
+// block in the history, the metrics and the log
+func (cfg *Config) finishDowntime(pending *pendingDowntime) {
+	downtime := pending.UpgradeDowntime
+	cfg.removeDowntime()
+	metrics.upgradeDowntime(downtime.Downtime())
+	from := fmt.Sprintf("the stop of the old binary at %s", downtime.StoppedAt.Format(time.RFC3339))
+	if downtime.LastBlockAt != nil {
+		from = fmt.Sprintf("block %d at %s", downtime.LastBlockHeight, downtime.LastBlockAt.Format(time.RFC3339))
+	}
+	logger.Infof("upgrade %q: the node was down for %s, from %s to block %d at %s", pending.Upgrade,
+		downtime.Downtime().Round(time.Millisecond), from, downtime.FirstBlockHeight, downtime.FirstBlockAt.Format(time.RFC3339))
+
+	cfg.updateUpgradeHistory(pending.Upgrade, func(e *HistoryEntry) { e.Downtime = &downtime })
+}
+
+// removeDowntime removes the pending downtime
+func (cfg *Config) removeDowntime() {
+	path := filepath.Join(cfg.StateDir(), downtimeFile)
+	if err := cfg.fs().remove(path); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("removing %s: %v", path, err)
+	}
+}
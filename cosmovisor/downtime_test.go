@@ -0,0 +1,129 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCommitRegex(t *testing.T) {
+	cases := map[string]int64{
+		`3:04PM INF committed state app_hash=A1B2 height=48 module=state num_txs=0`:                            48,
+		`{"level":"info","module":"state","height":1200,"num_txs":3,"time":"...","message":"committed state"}`: 1200,
+		`{"level":"info","message":"committed state","height":1200,"app_hash":"A1B2"}`:                         1200,
+		`{"level":"info","message":"committed state","height":"1200"}`:                                         1200,
+		`INF finalized block block_app_hash=A1B2 height=7 module=state num_txs_res=0`:                          7,
+		`INF finalizing commit of block hash=A1B2 height=9 module=consensus num_txs=0 root=C3D4`:               9,
+		`INF received proposal height=48 module=consensus`:                                                     0,
+		`INF committed state`: 0,
+	}
+	for line, height := range cases {
+		w := &blockWatch{}
+		w.scan([]byte(line))
+		got, _ := w.last()
+		require.Equal(t, height, got, line)
+	}
+}
+
+func TestBlockWatchEndsDowntime(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49}))
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+
+	stopped := time.Date(2022, 1, 2, 15, 4, 5, 0, time.UTC)
+	old := &blockWatch{}
+	old.committed(48, stopped.Add(-2*time.Second))
+	cfg.startDowntime(&UpgradeInfo{Name: "chain2", Height: 49}, old, stopped)
+
+	// the downtime is dropped once another binary runs
+	done := make(chan struct{})
+	defer close(done)
+	other := cfg.watchBlocks(cfg.GenesisBin(), done)
+	require.False(t, other.waiting())
+	cfg.startDowntime(&UpgradeInfo{Name: "chain2", Height: 49}, old, stopped)
+
+	w := cfg.watchBlocks(bin, done)
+	require.True(t, w.waiting())
+	w.committed(48, NowUTC())
+	require.True(t, w.waiting(), "a block from before the upgrade")
+	first := stopped.Add(90 * time.Second)
+	w.committed(49, first)
+	require.False(t, w.waiting())
+
+	history, err := cfg.UpgradeHistory()
+	require.NoError(t, err)
+	downtime := history[len(history)-1].Downtime
+	require.NotNil(t, downtime)
+	require.Equal(t, int64(48), downtime.LastBlockHeight)
+	require.Equal(t, stopped.Add(-2*time.Second), *downtime.LastBlockAt)
+	require.Equal(t, stopped, downtime.StoppedAt)
+	require.False(t, downtime.StartedAt.IsZero())
+	require.Equal(t, int64(49), downtime.FirstBlockHeight)
+	require.Equal(t, first, downtime.FirstBlockAt)
+	require.Equal(t, 92*time.Second, downtime.Downtime())
+	require.Equal(t, 92.0, metrics.downtimeSeconds)
+
+	ok, err := cfg.readStateFile(downtimeFile, &pendingDowntime{})
+	require.NoError(t, err)
+	require.False(t, ok, "the downtime is only recorded once")
+}
+
+func TestDowntimeFromRPC(t *testing.T) {
+	var height int64 = 48
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"result":{"sync_info":{"latest_block_height":"%d"}}}`, atomic.AddInt64(&height, 1)-1)
+	}))
+	defer server.Close()
+
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", LivenessRPC: server.URL}
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49}))
+	// no block was seen in the output
+	cfg.startDowntime(&UpgradeInfo{Name: "chain2", Height: 49}, &blockWatch{}, NowUTC())
+
+	done := make(chan struct{})
+	defer close(done)
+	cfg.watchBlocks(cfg.UpgradeBin("chain2"), done)
+	var downtime *UpgradeDowntime
+	require.Eventually(t, func() bool {
+		history, err := cfg.UpgradeHistory()
+		require.NoError(t, err)
+		downtime = history[len(history)-1].Downtime
+		return downtime != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(48), downtime.LastBlockHeight)
+	require.Nil(t, downtime.LastBlockAt)
+	require.Equal(t, int64(49), downtime.FirstBlockHeight)
+	require.Equal(t, downtime.FirstBlockAt.Sub(downtime.StoppedAt), downtime.Downtime())
+}
+
+func TestSuperviseRecordsDowntime(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", RestartAfterUpgrade: true}
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte("#!/bin/sh\necho 'INF committed state app_hash=A1 height=48 module=state'\n"+
+		"echo 'UPGRADE \"chain2\" NEEDED at height: 49: {}'\nsleep 5\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("chain2"), []byte("#!/bin/sh\necho 'INF committed state app_hash=B2 height=49 module=state' >&2\n"), 0755))
+	require.NoError(t, Supervise(cfg, nil, ioutil.Discard, ioutil.Discard))
+
+	history, err := cfg.UpgradeHistory()
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	downtime := history[0].Downtime
+	require.NotNil(t, downtime)
+	require.Equal(t, int64(48), downtime.LastBlockHeight)
+	require.Equal(t, int64(49), downtime.FirstBlockHeight)
+	require.False(t, downtime.LastBlockAt.After(downtime.StoppedAt))
+	require.False(t, downtime.StoppedAt.After(downtime.StartedAt))
+	require.False(t, downtime.StartedAt.After(downtime.FirstBlockAt))
+}
@@ -0,0 +1,177 @@
+package cosmovisor
+
+import (
+	"bufio"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// smtpDelivery is an email received by fakeSMTPServer
+type smtpDelivery struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTPServer accepts the emails sent to it on localhost, offering AUTH PLAIN, and
+// returns its address and the deliveries
+func fakeSMTPServer(t *testing.T) (string, <-chan smtpDelivery) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	deliveries := make(chan smtpDelivery, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, deliveries)
+		}
+	}()
+	return l.Addr().String(), deliveries
+}
+
+func serveSMTP(conn net.Conn, deliveries chan<- smtpDelivery) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+	var d smtpDelivery
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			d.auth = strings.TrimPrefix(line, "AUTH PLAIN ")
+			reply("235 authenticated")
+		case "MAIL":
+			d.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+			reply("250 ok")
+		case "RCPT":
+			to := strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>")
+			if strings.HasPrefix(to, "unknown@") {
+				reply("550 no such user")
+				continue
+			}
+			d.to = append(d.to, to)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			d.data = data.String()
+			deliveries <- d
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	addr, deliveries := fakeSMTPServer(t)
+	server, err := url.Parse("smtp://node:secret@" + addr)
+	require.NoError(t, err)
+	cfg := &Config{Name: "gaiad", NotifyEmailSubject: "{{.Name}}: {{.Type}} of {{.Upgrade}}"}
+	subject, body, err := cfg.emailTemplates()
+	require.NoError(t, err)
+	n := &EmailNotifier{Server: server, From: "Node <node@example.com>", To: []string{"ops@example.com", "oncall@example.com"},
+		Events: []string{EventUpgradeApplied, EventCrash}, Subject: subject, Body: body, Name: "gaiad", Host: "validator1"}
+	require.Equal(t, "email ops@example.com,oncall@example.com", n.Destination())
+
+	ev := Event{ID: "upgrade_applied/chain2", Type: EventUpgradeApplied, Upgrade: "chain2", Height: 100,
+		Message: `upgrade "chain2" applied`, Time: time.Date(2021, 8, 24, 10, 15, 30, 0, time.UTC)}
+	require.NoError(t, n.Notify(ev))
+	d := <-deliveries
+	// AUTH PLAIN is sent to localhost without TLS
+	require.NotEmpty(t, d.auth)
+	require.Equal(t, "node@example.com", d.from)
+	require.Equal(t, []string{"ops@example.com", "oncall@example.com"}, d.to)
+	require.Contains(t, d.data, "From: Node <node@example.com>\r\n")
+	require.Contains(t, d.data, "To: ops@example.com, oncall@example.com\r\n")
+	require.Contains(t, d.data, "Subject: gaiad: upgrade_applied of chain2\r\n")
+	parts := strings.SplitN(d.data, "\r\n\r\n", 2)
+	require.Len(t, parts, 2)
+	text, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(parts[1])))
+	require.NoError(t, err)
+	require.Contains(t, string(text), "upgrade \"chain2\" applied\r\n\r\nevent:   upgrade_applied\r\nupgrade: chain2\r\nheight:  100\r\n")
+	require.Contains(t, string(text), "node:    gaiad on validator1\r\n")
+
+	// an event of another type isn't mailed
+	require.NoError(t, n.Notify(NewEvent(EventNodeStalled, "", "stalled")))
+	select {
+	case d := <-deliveries:
+		t.Fatalf("unexpected email: %s", d.data)
+	default:
+	}
+
+	// a refused recipient fails the notification, so it is retried
+	n.To = []string{"unknown@example.com"}
+	require.Error(t, n.Notify(NewEvent(EventCrash, "", "boom")))
+}
+
+func TestEmailTemplates(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "body.tmpl")
+	require.NoError(t, ioutil.WriteFile(file, []byte("{{.Type}} on {{.Host}}\n"), 0600))
+
+	cases := map[string]struct {
+		cfg  Config
+		body string
+		err  string
+	}{
+		"defaults":         {body: "boom\n\nevent:   crash\n"},
+		"template file":    {cfg: Config{NotifyEmailTemplate: file}, body: "crash on validator1\n"},
+		"missing template": {cfg: Config{NotifyEmailTemplate: filepath.Join(dir, "missing.tmpl")}, err: "email template: open "},
+		"invalid subject":  {cfg: Config{NotifyEmailSubject: "{{.Type"}, err: "email subject: "},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			subject, body, err := tc.cfg.emailTemplates()
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			out := execute(t, body, EmailData{Event: NewEvent(EventCrash, "", "boom"), Name: "gaiad", Host: "validator1"})
+			require.True(t, strings.HasPrefix(out, tc.body), out)
+			require.Equal(t, "[gaiad@validator1] boom", execute(t, subject, EmailData{Event: NewEvent(EventCrash, "", "boom"), Name: "gaiad", Host: "validator1"}))
+		})
+	}
+}
+
+func execute(t *testing.T, tmpl *template.Template, data EmailData) string {
+	var out strings.Builder
+	require.NoError(t, tmpl.Execute(&out, data))
+	return out.String()
+}
@@ -0,0 +1,186 @@
+package cosmovisor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventLogFile is the append-only log of the events of cosmovisor, one JSON per line
+	eventLogFile = "events.jsonl"
+	// eventFollowInterval is how often FollowEvents looks for new events
+	eventFollowInterval = 500 * time.Millisecond
+)
+
+// Event types only written to the event log, too frequent for the notifiers
+const (
+	EventDaemonStarted  = "daemon_started"
+	EventDaemonExited   = "daemon_exited"
+	EventUpgradeStarted = "upgrade_started"
+	EventUpgradePhase   = "upgrade_phase"
+	// EventBackupCompleted is recorded once the node is backed up, before an upgrade or as
+	// scheduled
+	EventBackupCompleted = "backup_completed"
+	// EventBinarySwitched is recorded once current points to another binary, for an upgrade
+	// or a rollback
+	EventBinarySwitched = "binary_switched"
+)
+
+// eventLog serializes the writes to the event log
+var eventLog struct {
+	mutex sync.Mutex
+	// failed keeps a log that can't be written from warning about each event
+	failed bool
+}
+
+// EventLogPath is the event log of the home of cfg
+func (cfg *Config) EventLogPath() string {
+	return filepath.Join(cfg.StateDir(), eventLogFile)
+}
+
+// recordEvent appends the event to the event log of the home of cfg and keeps it for the
+// admin API, without notifying anyone. A read-only home has no event log.
+func recordEvent(cfg *Config, ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = NowUTC()
+	}
+	recentEvents.add(ev)
+	publish(ev)
+	if cfg == nil || cfg.ReadOnly {
+		return
+	}
+
+	eventLog.mutex.Lock()
+	defer eventLog.mutex.Unlock()
+	if err := appendEvent(cfg, ev); err != nil {
+		if !eventLog.failed {
+			logger.Warnf("writing the event log: %v", err)
+		}
+		eventLog.failed = true
+		return
+	}
+	eventLog.failed = false
+}
+
+// recordSwitch records the switch of current from the binary from to the binary to
+func recordSwitch(cfg *Config, upgrade string, height int64, from, to, reason string) {
+	ev := NewEvent(EventBinarySwitched, upgrade, fmt.Sprintf("switched from %s to %s", from, to))
+	ev.Height = height
+	ev.Fields = map[string]string{"from": from, "to": to, "reason": reason}
+	recordEvent(cfg, ev)
+}
+
+// appendEvent writes the event as a line of the event log
+func appendEvent(cfg *Config, ev Event) error {
+	bz, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	path := cfg.EventLogPath()
+	if err := cfg.fs().mkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := cfg.fs().openFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// a single write keeps lines whole for readers following the file
+	if _, err := f.Write(append(bz, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadEvents returns the events of the event log of the home of cfg, the oldest first,
+// and the offset the log was read up to. A missing log has no events.
+func ReadEvents(cfg *Config) ([]Event, int64, error) {
+	f, err := os.Open(cfg.EventLogPath())
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	var events []Event
+	offset, err := readEventLines(f, func(ev Event) error {
+		events = append(events, ev)
+		return nil
+	})
+	return events, offset, err
+}
+
+// FollowEvents calls fn with each event appended to the event log of the home of cfg after
+// offset, until ctx is done or fn fails. A log that was replaced or truncated is followed
+// from its start.
+func FollowEvents(ctx context.Context, cfg *Config, offset int64, fn func(Event) error) error {
+	path := cfg.EventLogPath()
+	ticker := time.NewTicker(eventFollowInterval)
+	defer ticker.Stop()
+	for {
+		if fi, err := os.Stat(path); err == nil {
+			if fi.Size() < offset {
+				offset = 0
+			}
+			if fi.Size() > offset {
+				read, err := readEventsFrom(path, offset, fn)
+				offset += read
+				if err != nil {
+					return err
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// readEventsFrom calls fn with the whole lines of the log at path after offset, and
+// returns how many bytes they took
+func readEventsFrom(path string, offset int64, fn func(Event) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return readEventLines(f, fn)
+}
+
+// readEventLines calls fn with each whole line of r, skipping lines that aren't events, and
+// returns how many bytes the whole lines took. A line still being written is left for later.
+func readEventLines(r io.Reader, fn func(Event) error) (int64, error) {
+	reader := bufio.NewReader(r)
+	var read int64
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+		read += int64(len(line))
+		var ev Event
+		if strings.TrimSpace(line) == "" || json.Unmarshal([]byte(line), &ev) != nil {
+			continue
+		}
+		if err := fn(ev); err != nil {
+			return read, err
+		}
+	}
+}
@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventLog(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	events, offset, err := ReadEvents(cfg)
+	require.NoError(t, err)
+	require.Empty(t, events)
+	require.Zero(t, offset)
+
+	started := NewEvent(EventDaemonStarted, "", "launched dummyd")
+	started.Fields = map[string]string{"pid": "42"}
+	recordEvent(cfg, started)
+	notify(cfg, Event{ID: "upgrade_detected/chain2/49", Type: EventUpgradeDetected, Upgrade: "chain2", Height: 49, Message: "upgrade detected"})
+	// a line being written isn't read yet
+	f, err := os.OpenFile(cfg.EventLogPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"id":"partial"`)
+	require.NoError(t, err)
+
+	events, offset, err = ReadEvents(cfg)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, "42", events[0].Fields["pid"])
+	require.Equal(t, int64(49), events[1].Height)
+	require.False(t, events[1].Time.IsZero())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	followed := make(chan Event, 4)
+	go func() {
+		_ = FollowEvents(ctx, cfg, offset, func(ev Event) error {
+			followed <- ev
+			return nil
+		})
+	}()
+	_, err = f.WriteString(`,"type":"daemon_exited","message":"dummyd exited","time":"2024-03-10T00:00:00Z"}` + "\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	select {
+	case ev := <-followed:
+		require.Equal(t, "partial", ev.ID)
+		require.Equal(t, EventDaemonExited, ev.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the appended event wasn't followed")
+	}
+
+	// a read-only home has no event log
+	ro := &Config{Home: t.TempDir(), Name: "dummyd", ReadOnly: true}
+	recordEvent(ro, started)
+	_, err = ioutil.ReadFile(ro.EventLogPath())
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestPhaseEvents(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	timings := NewUpgradeTimings("chain2")
+	timings.Phase("stop").End(nil)
+	timings.cfg = cfg
+	phase := timings.Phase("download")
+	phase.Set("bytes", "1024")
+	phase.End(nil)
+
+	events, _, err := ReadEvents(cfg)
+	require.NoError(t, err)
+	require.Len(t, events, 1, "only phases of an upgrade of a home are recorded")
+	require.Equal(t, EventUpgradePhase, events[0].Type)
+	require.Equal(t, "chain2", events[0].Upgrade)
+	require.Equal(t, "download", events[0].Fields["phase"])
+	require.Equal(t, "1024", events[0].Fields["bytes"])
+}
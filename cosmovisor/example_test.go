@@ -0,0 +1,56 @@
+package cosmovisor_test
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/cosmos/cosmos-sdk/cosmovisor"
+)
+
+// Supervise a node from an orchestrator, stopping it when the orchestrator is interrupted.
+func ExampleSuperviseContext() {
+	cfg := &cosmovisor.Config{
+		Home:                "/var/lib/gaia",
+		Name:                "gaiad",
+		RestartAfterUpgrade: true,
+		RestartAfterFailure: true,
+		ShutdownGrace:       30 * time.Second,
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	err := cosmovisor.SuperviseContext(ctx, cfg, []string{"start"}, os.Stdout, os.Stderr)
+	if err != nil && ctx.Err() == nil {
+		log.Printf("node stopped: %v", err)
+	}
+	os.Exit(cosmovisor.ExitCode(err))
+}
+
+// Fetch the binary of the next upgrade while the node is still running the old one.
+func ExamplePredownload() {
+	cfg := &cosmovisor.Config{Home: "/var/lib/gaia", Name: "gaiad", AllowDownloadBinaries: true}
+	api := cosmovisor.NewNodeAPI("http://localhost:1317")
+
+	plan, err := api.CurrentPlan()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if plan == nil {
+		return
+	}
+	if _, err := cosmovisor.Predownload(cfg, plan); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,102 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ExecDaemon switches to the upgrade the node reached while no cosmovisor was watching it,
+// like Supervise does before the first launch, then replaces cosmovisor by the current
+// binary with args. Nothing supervises the daemon afterwards: the next upgrade is applied
+// the next time ExecDaemon runs, typically when the operator's own supervisor restarts the
+// daemon after it halted at the upgrade height. The daemon inherits the lock on the home,
+// so no cosmovisor can supervise a second daemon while it runs. It only returns on failure.
+func ExecDaemon(cfg *Config, args []string) error {
+	if err := cfg.fs().check("launch", cfg.Root()); err != nil {
+		return err
+	}
+	if cfg.wantsLeaderElection() {
+		return errors.New("exec mode can't take part in a leader election, nothing would kill the daemon once the lease is lost")
+	}
+	if cfg.wantsSignerPause() {
+		return errors.New("exec mode can't pause the remote signer for upgrades, nothing would resume it once the node caught up")
+	}
+	if _, drop := cfg.daemonOwner(); drop && !canDropCredential {
+		return errors.New("exec mode can't drop privileges with this build, rebuild cosmovisor with go 1.16 or newer or unset DAEMON_DROP_PRIVILEGES")
+	}
+	unlock, err := cfg.lockHome()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := cfg.checkRolledBack(); err != nil {
+		return err
+	}
+	if err := cfg.checkValidatorState(); err != nil {
+		return err
+	}
+	if err := RepairCurrent(cfg); err != nil {
+		return err
+	}
+	if err := StartupPlanCheck(cfg); err != nil {
+		return err
+	}
+	bin, err := cfg.CurrentBin()
+	if err != nil {
+		return fmt.Errorf("error creating symlink to genesis: %w", err)
+	}
+	if err := EnsureBinary(bin); err != nil {
+		return fmt.Errorf("current binary invalid: %w", err)
+	}
+	overrides, err := binOverrides(bin)
+	if err != nil {
+		return err
+	}
+	if overrides != nil {
+		logger.Infof("executing %s with the %s of %s", bin, overrides, overridesFile)
+	}
+	env := cfg.daemonEnv()
+	if env == nil {
+		env = environ()
+	}
+	args, env = overrides.apply(cfg.withExtraArgs(args), env)
+	if args, err = cfg.withHome(args); err != nil {
+		return err
+	}
+	args = cfg.withSkipUpgrades(args)
+
+	// the daemon keeps the pid of cosmovisor, the status shows it as running unsupervised
+	cfg.writeRunState(os.Getpid(), bin)
+	if err := cfg.inheritHomeLock(); err != nil {
+		cfg.clearRunState(os.Getpid())
+		return fmt.Errorf("handing the lock on %s to the daemon: %w", cfg.Root(), err)
+	}
+	// the exec is the launch the restart phase of an upgrade applied at startup waits for
+	upgradeRelaunched()
+	cfg.journalRestarted(bin)
+	FlushUpgradeTraces(5 * time.Second)
+	FlushNotifications(5 * time.Second)
+	logger.Infof("executing %s %s", bin, strings.Join(args, " "))
+	// the daemon runs as DAEMON_RUN_AS like a launched one, nothing of root survives the exec
+	if err = os.Chdir(cfg.workDir()); err == nil {
+		if err = cfg.dropCredential(); err == nil {
+			err = execBinary(bin, args, env)
+		}
+	}
+	cfg.clearRunState(os.Getpid())
+	return fmt.Errorf("executing %s: %w", bin, err)
+}
+
+// inheritHomeLock keeps the lock on the home open in the process replacing cosmovisor
+func (cfg *Config) inheritHomeLock() error {
+	homeLocks.Lock()
+	defer homeLocks.Unlock()
+	l := homeLocks.held[cfg.Root()]
+	if l == nil {
+		return fmt.Errorf("%s is not locked", cfg.Root())
+	}
+	return keepOnExec(l.file)
+}
@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// execHomeEnv makes TestExecDaemon call ExecDaemon, which replaces the test process
+	execHomeEnv = "COSMOVISOR_TEST_EXEC_HOME"
+	// execRunAsEnv has the daemon executed as the user given
+	execRunAsEnv = "COSMOVISOR_TEST_EXEC_RUN_AS"
+)
+
+func TestExecDaemon(t *testing.T) {
+	if home := os.Getenv(execHomeEnv); home != "" {
+		cfg := &Config{Home: home, Name: "dummyd", RunAs: os.Getenv(execRunAsEnv)}
+		cfg.DropPrivileges = cfg.RunAs != ""
+		err := ExecDaemon(cfg, []string{"start"})
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(ExitCodeFailure)
+	}
+	// the node reached the chain2 plan, which is applied before replacing cosmovisor
+	cfg := heightHome(t, "new-snapshot")
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("chain2"), []byte("#!/bin/sh\necho pid $$ $@\n"), 0755))
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExecDaemon$")
+	cmd.Env = append(os.Environ(), execHomeEnv+"="+cfg.Home)
+	var out strings.Builder
+	cmd.Stdout = &out
+	require.NoError(t, cmd.Run())
+	require.Equal(t, fmt.Sprintf("pid %d start\n", cmd.Process.Pid), out.String())
+	require.Equal(t, cfg.UpgradeBin("chain2"), mustCurrentBin(t, cfg))
+
+	// the daemon is recorded with the pid cosmovisor had
+	bz, err := ioutil.ReadFile(filepath.Join(cfg.StateDir(), pidFile))
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(cmd.Process.Pid), strings.TrimSpace(string(bz)))
+}
+
+func TestExecDaemonDropPrivileges(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("only root drops privileges")
+	}
+	cfg := heightHome(t, "")
+	// the user must reach the binary
+	for _, dir := range []string{filepath.Dir(cfg.Home), cfg.Home} {
+		require.NoError(t, os.Chmod(dir, 0755))
+	}
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte("#!/bin/sh\necho \"$(id -u):$(id -g):$(id -G)\"\n"), 0755))
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExecDaemon$")
+	cmd.Env = append(os.Environ(), execHomeEnv+"="+cfg.Home, execRunAsEnv+"=12345:23456")
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	// the daemon replacing cosmovisor runs as RunAs, without the groups of root
+	require.Equal(t, "12345:23456:23456\n", string(out))
+}
+
+func TestExecDaemonInvalidBinary(t *testing.T) {
+	cfg := heightHome(t, "")
+	require.NoError(t, os.Remove(cfg.GenesisBin()))
+	err := ExecDaemon(cfg, []string{"start"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "current binary invalid")
+	// nothing is handed to a daemon that never started
+	require.Empty(t, homeLocks.held)
+	_, err = os.Stat(filepath.Join(cfg.StateDir(), pidFile))
+	require.True(t, os.IsNotExist(err))
+}
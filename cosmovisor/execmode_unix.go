@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package cosmovisor
+
+import (
+	"os"
+	"syscall"
+)
+
+// keepOnExec clears close-on-exec of the file, which go sets on every file it opens
+func keepOnExec(f *os.File) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFD, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// execBinary replaces the process by bin with args and env
+func execBinary(bin string, args, env []string) error {
+	return syscall.Exec(bin, append([]string{bin}, args...), env)
+}
@@ -0,0 +1,19 @@
+package cosmovisor
+
+import (
+	"errors"
+	"os"
+)
+
+// errNoExec is returned by ExecDaemon, windows can't replace a process by another
+var errNoExec = errors.New("replacing cosmovisor by the daemon is not supported on windows, use run")
+
+// keepOnExec fails, there is no exec to keep the file open across
+func keepOnExec(*os.File) error {
+	return errNoExec
+}
+
+// execBinary fails, there is no exec on windows
+func execBinary(string, []string, []string) error {
+	return errNoExec
+}
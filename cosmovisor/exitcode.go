@@ -0,0 +1,122 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// The exit codes of cosmovisor are taken from sysexits.h, one for each class of failure, so
+// wrappers and service managers can branch on them. A daemon that exits with an error gets
+// its own exit code passed on, it tells more about the crash than a code for all of them,
+// unless it is one of the codes of cosmovisor, from ExitCodeUsage to ExitCodeRestart, which
+// a daemon is reported with ExitCodeDaemonFailed instead of.
+const (
+	// ExitCodeUsage is the exit code of cosmovisor called with invalid arguments (EX_USAGE)
+	ExitCodeUsage = 64
+	// ExitCodeBinaryMissing is the exit code of cosmovisor without a binary to run: the current
+	// binary or the binary of an upgrade is missing or can't be run, and won't be downloaded
+	// (EX_NOINPUT)
+	ExitCodeBinaryMissing = 66
+	// ExitCodeFailure is the exit code of cosmovisor after a failure of its own that has no
+	// code of its own, e.g. an upgrade that couldn't be applied (EX_UNAVAILABLE)
+	ExitCodeFailure = 69
+	// ExitCodeDaemonFailed is the exit code of cosmovisor after the daemon exited with one
+	// of the exit codes of cosmovisor, which would be taken for it (EX_OSERR)
+	ExitCodeDaemonFailed = 71
+	// ExitCodeBackup is the exit code of cosmovisor after the backup before an upgrade
+	// failed (EX_CANTCREAT)
+	ExitCodeBackup = 73
+	// ExitCodeDownload is the exit code of cosmovisor after the binary or the upgrade config
+	// of an upgrade couldn't be downloaded or verified (EX_PROTOCOL)
+	ExitCodeDownload = 76
+	// ExitCodeConfig is the exit code of cosmovisor with an invalid configuration (EX_CONFIG)
+	ExitCodeConfig = 78
+)
+
+// The exit codes of cosmovisor stopping without a failure, for the service manager to launch
+// it again
+const (
+	// ExitCodeUpgraded is the exit code of cosmovisor after it applied an upgrade and, as
+	// DAEMON_RESTART_AFTER_UPGRADE is off, left launching the new binary to the next start
+	ExitCodeUpgraded = 80
+	// ExitCodeRestart is the exit code of cosmovisor after it stopped the daemon for a restart,
+	// e.g. requested through the admin API, and was stopped before it launched the daemon again
+	ExitCodeRestart = 81
+)
+
+// exitClass marks an error with the exit code of its class of failure
+type exitClass struct {
+	error
+	code int
+}
+
+func (e exitClass) Unwrap() error { return e.error }
+
+// withExitCode marks err, if any, with the exit code of its class of failure
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return exitClass{error: err, code: code}
+}
+
+// UpgradedError is returned by Supervise after it applied an upgrade without launching the
+// new binary, as DAEMON_RESTART_AFTER_UPGRADE is off
+type UpgradedError struct {
+	// Bin is the binary of the upgrade, launched the next time cosmovisor starts
+	Bin string
+}
+
+func (e *UpgradedError) Error() string {
+	return fmt.Sprintf("upgraded, start cosmovisor again to launch %s", e.Bin)
+}
+
+// ExitCode is the code cosmovisor exits with after err: ExitCodeHalted after a halt,
+// ExitCodeUpgraded after an upgrade, the supervisor's exit code under RunInit, the code of
+// the class of the failure, and for a daemon that exited with an error, its exit code or 128
+// plus the signal number if a signal killed it, like shells do, or ExitCodeDaemonFailed if
+// its code is one of cosmovisor's. Any other error exits with ExitCodeFailure.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var halted *HaltedError
+	if errors.As(err, &halted) {
+		return ExitCodeHalted
+	}
+	var upgraded *UpgradedError
+	if errors.As(err, &upgraded) {
+		return ExitCodeUpgraded
+	}
+	var passthrough *PassthroughExitError
+	if errors.As(err, &passthrough) {
+		return passthrough.Code
+	}
+	var supervisor *InitExitError
+	if errors.As(err, &supervisor) {
+		return supervisor.Code
+	}
+	var class exitClass
+	if errors.As(err, &class) {
+		return class.code
+	}
+	if errors.Is(err, errRestartRequested) {
+		return ExitCodeRestart
+	}
+	var child *ChildExitError
+	var exit *exec.ExitError
+	if !errors.As(err, &child) || !errors.As(child.Err, &exit) {
+		return ExitCodeFailure
+	}
+	if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	if code := exit.ExitCode(); code >= ExitCodeUsage && code <= ExitCodeRestart {
+		return ExitCodeDaemonFailed
+	} else if code > 0 {
+		return code
+	}
+	return ExitCodeFailure
+}
@@ -0,0 +1,49 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitCode(t *testing.T) {
+	exited := func(script string) error {
+		err := exec.Command("sh", "-c", script).Run()
+		require.Error(t, err)
+		return err
+	}
+	cases := map[string]struct {
+		err  error
+		code int
+	}{
+		"success":          {code: 0},
+		"daemon failed":    {err: &ChildExitError{Err: exited("exit 3")}, code: 3},
+		"daemon stopped":   {err: &ChildExitError{Err: exited("exit 143"), Stopped: true}, code: 143},
+		"signaled":         {err: &ChildExitError{Err: exited("kill -TERM $$")}, code: 128 + 15},
+		"stopped signaled": {err: &ChildExitError{Err: exited("kill -TERM $$"), Stopped: true}, code: 128 + 15},
+		"wrapped":          {err: fmt.Errorf("giving up: %w", &ChildExitError{Err: exited("exit 2")}), code: 2},
+		"daemon usage":     {err: &ChildExitError{Err: exited("exit 64")}, code: ExitCodeDaemonFailed},
+		"daemon upgraded":  {err: &ChildExitError{Err: exited("exit 80")}, code: ExitCodeDaemonFailed},
+		"daemon restart":   {err: &ChildExitError{Err: exited("exit 81")}, code: ExitCodeDaemonFailed},
+		"daemon above":     {err: &ChildExitError{Err: exited("exit 82")}, code: 82},
+		"export failed":    {err: fmt.Errorf("export: %w", exited("exit 4")), code: ExitCodeFailure},
+		"upgrade failed":   {err: errors.New("cannot apply upgrade"), code: ExitCodeFailure},
+		"binary missing":   {err: withExitCode(ExitCodeBinaryMissing, errors.New("binary not present")), code: ExitCodeBinaryMissing},
+		"download failed":  {err: fmt.Errorf("upgrade: %w", withExitCode(ExitCodeDownload, errors.New("cannot download binary"))), code: ExitCodeDownload},
+		"backup failed":    {err: withExitCode(ExitCodeBackup, errors.New("data backup")), code: ExitCodeBackup},
+		"upgraded":         {err: &UpgradedError{Bin: "/node/cosmovisor/current/bin/gaiad"}, code: ExitCodeUpgraded},
+		"restart":          {err: errRestartScheduled, code: ExitCodeRestart},
+		"halted":           {err: &HaltedError{Bin: "/node/cosmovisor/current/bin/gaiad"}, code: ExitCodeHalted},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.code, ExitCode(tc.err))
+		})
+	}
+}
@@ -0,0 +1,656 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Explanation is one decision cosmovisor takes, annotated with the setting that determined it
+type Explanation struct {
+	Step     string `json:"step"`
+	Decision string `json:"decision"`
+	Setting  string `json:"setting"`
+}
+
+// Explain walks the decisions taken when the described upgrade fires, with the current
+// config and directory layout, without changing anything. It is built from the same
+// policies the real run uses: CheckPlanHeight, ShutdownBudget, PlanUpgrade and ShouldRestart.
+func Explain(cfg *Config, info *UpgradeInfo) []Explanation {
+	var lines []Explanation
+	add := func(step, setting, format string, args ...interface{}) {
+		lines = append(lines, Explanation{Step: step, Decision: fmt.Sprintf(format, args...), Setting: setting})
+	}
+
+	if cfg.Immutable {
+		add("layout", envSetting("DAEMON_WRITABLE_ROOT", cfg.WritableRoot, cfg.WritableRoot != ""),
+			"immutable layout: %s is read-only, keep state in %s", cfg.Root(), cfg.StateDir())
+	}
+	if cfg.StatePath != "" || cfg.TmpDir != "" {
+		add("layout", "DAEMON_STATE_DIR, DAEMON_TMP_DIR", "keep state in %s and temporary files in %s", cfg.StateDir(), cfg.tmpPath())
+	}
+	if cfg.GenesisDir != "" || cfg.UpgradesDir != "" {
+		add("layout", "DAEMON_GENESIS_DIR, DAEMON_UPGRADES_DIR", "binaries in %s and %s", cfg.genesisPath(), cfg.upgradesPath())
+	}
+	explainStartup(cfg, add)
+	bin, _ := cfg.resolveCurrentBin()
+	if cfg.Immutable {
+		add("launch", "current pointer", "run %s", bin)
+	} else {
+		add("launch", "current link", "run %s", bin)
+	}
+	if heights := cfg.skipHeights(); len(heights) > 0 {
+		add("launch", envSetting("DAEMON_SKIP_UPGRADES", cfg.SkipUpgrades, true), "add %s to the arguments of `start`", skipFlag(heights))
+	}
+	explainDetection(cfg, add)
+	if cfg.Immutable {
+		add("hotfix", "immutable layout", "ignore hotfixes, binaries can't be replaced")
+	} else {
+		add("hotfix", "built-in", "check %s every %s while the daemon runs", cfg.HotfixDir(), hotfixPollInterval)
+	}
+
+	budget := cfg.ShutdownBudget(false)
+	add("stop", envSetting("DAEMON_TERMINATION_GRACE", cfg.TerminationGrace, cfg.TerminationGrace > 0),
+		"on SIGTERM, SIGINT or SIGQUIT: %s, %s", explainStop(cfg), explainKill(budget))
+	budget = cfg.ShutdownBudget(true)
+	switch {
+	case budget.ChildWindow == 0:
+		add("stop", envSetting("DAEMON_TERMINATION_GRACE", cfg.TerminationGrace, false),
+			"on a stop signal during the upgrade: forward it, the upgrade is finished before exiting")
+	case budget.SkipUpgrade:
+		add("stop", "DAEMON_TERMINATION_UPGRADE_POLICY="+string(UpgradePolicySkip),
+			"on a stop signal during the upgrade: %s, the upgrade is left for the next start", explainKill(budget))
+	case budget.Reserved < cfg.terminationMargin():
+		add("stop", "DAEMON_TERMINATION_UPGRADE_POLICY="+string(UpgradePolicyTruncate),
+			"on a stop signal during the upgrade: %s, %s left to finish the upgrade, resumed on the next start if it takes longer", explainKill(budget), budget.Reserved)
+	default:
+		add("stop", envSetting("DAEMON_TERMINATION_GRACE_MARGIN", cfg.TerminationMargin, cfg.TerminationMargin > 0),
+			"on a stop signal during the upgrade: %s, %s left to finish the upgrade, resumed on the next start if it takes longer", explainKill(budget), budget.Reserved)
+	}
+
+	if len(reloadTriggers) > 0 {
+		sig := cfg.ReloadSignal
+		if sig == 0 {
+			sig = defaultReloadSignal
+		}
+		add("reload", envSetting("DAEMON_RELOAD_SIGNAL", signalName(sig), cfg.ReloadSignal != 0),
+			"on %s: send %s to the daemon, an exit within %s counts as a failed reload", signalName(reloadTriggers[0]), signalName(sig), reloadWatchWindow)
+	}
+
+	if forwarded := cfg.forwarded(); len(forwarded) > 0 {
+		names := make([]string, len(forwarded))
+		for i, sig := range forwarded {
+			names[i] = signalName(sig)
+		}
+		add("signals", "built-in", "forward %s to the daemon as they are", strings.Join(names, " and "))
+	}
+	if cfg.PauseSignal != 0 {
+		add("pause", envSetting("DAEMON_PAUSE_SIGNAL", signalName(cfg.PauseSignal), true),
+			"on %s: pause the supervision, upgrades are deferred and the daemon isn't launched again, until the next %s",
+			signalName(cfg.PauseSignal), signalName(cfg.PauseSignal))
+	}
+
+	if cfg.skipsUpgrade(info) {
+		add("upgrade", envSetting("DAEMON_SKIP_UPGRADES", cfg.SkipUpgrades, true),
+			"skip %q: if the daemon halts for it, launch it again with its height in %s, nothing is switched", info.Name, skipUpgradesFlag)
+		return lines
+	}
+	if cfg.actionsAPI() != "" {
+		for _, a := range cfg.heightActions() {
+			if what, ok := heightActionSteps[a.Action]; ok {
+				add("ahead", "DAEMON_PRE_UPGRADE_ACTIONS="+cfg.PreUpgradeActions.String(), "%s once the plan is %d blocks away", what, a.Blocks)
+			}
+		}
+	}
+	upgradeSetting := envSetting("DAEMON_SHUTDOWN_GRACE", cfg.ShutdownGrace, cfg.ShutdownGrace > 0)
+	if cfg.StopSignal != 0 && cfg.ShutdownGrace <= 0 {
+		upgradeSetting = envSetting("DAEMON_STOP_SIGNAL", signalName(cfg.StopSignal), true)
+	}
+	add("upgrade", upgradeSetting, "on %q: send %s to the daemon as soon as the upgrade line is seen, SIGKILL it after %s",
+		info.Name, signalName(cfg.stopSignal()), cfg.shutdownGrace())
+	// the time is only known when the backup starts
+	backupPath, backupErr := cfg.dataBackupPath(info, "<time>")
+	if len(cfg.BackupBackends) > 0 {
+		add("backup", "DAEMON_BACKUP_BACKENDS="+strings.Join(cfg.BackupBackends, ","), "back up with %s in turn, the first that fails fails the upgrade",
+			strings.Join(cfg.BackupBackends, ", then "))
+	}
+	if cfg.dataBackup() != DataBackupNone && backupErr == nil {
+		setting := envSetting("DAEMON_DATA_BACKUP_SPACE_CHECK", cfg.BackupSpaceCheck, cfg.BackupSpaceCheck != "")
+		switch cfg.spaceCheck() {
+		case SpaceCheckAbort:
+			add("backup", setting, "first check %s has room for the data directory, the upgrade fails if not", filepath.Dir(backupPath))
+		case SpaceCheckWarn:
+			add("backup", setting, "first check %s has room for the data directory, log a warning if not", filepath.Dir(backupPath))
+		}
+	}
+	switch mode := cfg.dataBackup(); {
+	case mode != DataBackupNone && backupErr != nil:
+		add("backup", envSetting("DAEMON_DATA_BACKUP", mode, true), "backup fails, so does the upgrade: %v", backupErr)
+	case mode == DataBackupArchive:
+		add("backup", "DAEMON_DATA_BACKUP=archive", "stream %s into the archive %s, a failure fails the upgrade", cfg.DataDir(), backupPath)
+	case mode == DataBackupCopy:
+		add("backup", "DAEMON_DATA_BACKUP=copy", "copy %s to %s, a failure fails the upgrade", cfg.DataDir(), backupPath)
+	case cfg.BackupCommand == "":
+		add("backup", "DAEMON_DATA_BACKUP unset", "no backup of the data directory is made")
+	}
+	if cfg.dataBackup() != DataBackupNone && len(cfg.DataBackupExclude) > 0 {
+		add("backup", "DAEMON_DATA_BACKUP_EXCLUDE set", "leave %s out of the backup", strings.Join(cfg.DataBackupExclude, ", "))
+	}
+	if cfg.BackupCommand != "" {
+		if args, err := cfg.backupArgs(info); err != nil {
+			add("backup", "DAEMON_BACKUP_CMD set", "backup fails, so does the upgrade: %v", err)
+		} else {
+			add("backup", "DAEMON_BACKUP_CMD set", "run %s with the daemon stopped, a failure fails the upgrade", strings.Join(args, " "))
+		}
+	}
+
+	plan, err := cfg.PlanUpgrade(info)
+	if err != nil {
+		setting := envSetting("DAEMON_ALLOW_DOWNLOAD_BINARIES", cfg.AllowDownloadBinaries, cfg.AllowDownloadBinaries)
+		if cfg.Immutable {
+			setting = "immutable layout"
+		}
+		add("binary", setting, "upgrade fails: %v", err)
+		var old *MinVersionError
+		if errors.As(err, &old) && cfg.SelfUpgrade {
+			if src, ok := old.Config.CosmovisorURL(OSArch()); ok {
+				add("binary", "DAEMON_SELF_UPGRADE=true", "install cosmovisor %s or newer from %s, then run it to apply the upgrade", old.Required, src)
+				return lines
+			}
+		}
+		add("failure", "built-in", "cosmovisor exits with an error, %s stays current", bin)
+		return lines
+	}
+
+	if plan.Export {
+		setting := "plan info export=true"
+		if cfg.PreUpgradeExport {
+			setting = "DAEMON_PRE_UPGRADE_EXPORT=true"
+		}
+		data := cfg.exportTemplateData(info)
+		if args, err := cfg.exportArgs(data); err != nil {
+			add("export", envSetting("DAEMON_PRE_UPGRADE_EXPORT_COMMAND", cfg.ExportCommand, cfg.ExportCommand != ""),
+				"export fails: %v", err)
+		} else {
+			add("export", setting, "run %s %s", plan.OldBin, strings.Join(args, " "))
+			add("export", envSetting("DAEMON_PRE_UPGRADE_EXPORT_TIMEOUT", cfg.ExportTimeout, cfg.ExportTimeout > 0),
+				"give up on the export after %s", cfg.exportTimeout())
+		}
+		if cfg.ExportPolicy == ExportPolicyAbort {
+			add("failure", "DAEMON_PRE_UPGRADE_EXPORT_POLICY=abort", "if the export fails: the upgrade fails, %s stays current", plan.OldBin)
+		} else {
+			add("failure", "DAEMON_PRE_UPGRADE_EXPORT_POLICY="+string(ExportPolicyWarn), "if the export fails: log it and continue the upgrade")
+		}
+	} else if isReference(strings.TrimSpace(info.Info)) && cfg.AllowDownloadBinaries {
+		add("export", "plan info link", "export the state only if the linked document asks for it")
+	} else {
+		add("export", "DAEMON_PRE_UPGRADE_EXPORT unset", "no state export")
+	}
+
+	if plan.Download {
+		add("binary", "DAEMON_ALLOW_DOWNLOAD_BINARIES=true", "download %s from %s", plan.NewBin, explainSource(cfg, info))
+		if cfg.Downloader == nil && cfg.DownloaderCommand != "" {
+			add("binary", "DAEMON_DOWNLOADER_CMD set", "fetch it with %s, then verify and unpack it", cfg.DownloaderCommand)
+		} else if cfg.Downloader == nil && cfg.customizesDownloads() {
+			add("binary", "download TLS settings", "fetch it over HTTP %s", explainDownloadTLS(cfg))
+		}
+		if cfg.wantsPredownload() {
+			setting := "DAEMON_PREDOWNLOAD_API=" + cfg.PredownloadAPI
+			if len(cfg.PreUpgradeActions) > 0 {
+				setting = "DAEMON_PRE_UPGRADE_ACTIONS=" + cfg.PreUpgradeActions.String()
+			}
+			add("binary", setting,
+				"download it while the daemon runs once the plan is %d blocks away, checking every %s", cfg.downloadAction().Blocks, predownloadPollInterval)
+		}
+		if cfg.BinaryPubKey != nil {
+			add("binary", "DAEMON_BINARY_PUBKEY set", "verify %s with %s before unpacking", explainSignature(info), cfg.BinaryPubKey)
+		}
+		if config, ok := parseUpgradeConfig(info); ok && config.BinaryPath != "" {
+			add("binary", "plan info binary_path", "unpack the download in %s and take the binary from %s", cfg.UpgradeDir(info.Name), config.BinaryPath)
+		}
+		add("failure", "built-in", "if the download fails: cosmovisor exits with an error, %s stays current", plan.OldBin)
+	} else {
+		add("binary", "staged binary present", "use %s", plan.NewBin)
+		if staged, err := cfg.stagedUpgrade(info.Name); err == nil && staged.Source != "" {
+			add("binary", "cosmovisor add-upgrade", "staged from %s at %s", staged.Source, staged.AddedAt.Format(time.RFC3339))
+			if staged.Height > 0 && info.Height > 0 && staged.Height != info.Height {
+				add("binary", "cosmovisor add-upgrade", "log that it was staged for height %d, not %d", staged.Height, info.Height)
+			}
+		}
+	}
+	if config := plan.upgradeConfig(); config != nil && len(config.Checksums) > 0 {
+		switch sum, err := config.BinaryChecksum(OSArch()); {
+		case err != nil && cfg.UnsafeSkipPlanChecksum:
+			add("binary", "DAEMON_UNSAFE_SKIP_PLAN_CHECKSUM=true", "log that the plan checksum can't be used and switch anyway: %v", err)
+		case err != nil:
+			add("binary", "plan info checksums", "upgrade fails: %v", err)
+		case sum == nil:
+			add("binary", "plan info checksums", "log that the plan has no checksum for %s", OSArch())
+		case cfg.UnsafeSkipPlanChecksum:
+			add("binary", "DAEMON_UNSAFE_SKIP_PLAN_CHECKSUM=true", "verify %s against %s, log a mismatch and switch anyway", plan.NewBin, sum)
+		default:
+			add("binary", "plan info checksums", "verify %s against %s before the switch, a mismatch fails the upgrade", plan.NewBin, sum)
+		}
+	}
+	if cfg.wantsPreflight() {
+		setting := envSetting("DAEMON_PREFLIGHT", true, cfg.Preflight)
+		if cfg.PreflightVersion != "" {
+			expected, err := renderPreflightVersion(cfg.PreflightVersion, preflightTemplateData{Name: info.Name, Height: info.Height})
+			if err != nil {
+				expected = err.Error()
+			}
+			add("preflight", "DAEMON_PREFLIGHT_VERSION set", "run %s version, its output must contain %q, within %s", plan.NewBin, expected, cfg.preflightTimeout())
+		} else {
+			add("preflight", setting, "run %s version, it must exit cleanly within %s", plan.NewBin, cfg.preflightTimeout())
+		}
+		add("failure", "built-in", "if the preflight fails: the upgrade fails before the backup, %s stays current", plan.OldBin)
+	}
+	retries := envSetting("DAEMON_PREUPGRADE_MAX_RETRIES", cfg.PreUpgradeMaxRetries, cfg.PreUpgradeMaxRetries > 0)
+	if cfg.PreUpgradeMaxRetries > 0 {
+		add("prepare", retries, "run %s %s, retrying exit code %d up to %d times", plan.NewBin, preUpgradeCommand, preUpgradeRetry, cfg.PreUpgradeMaxRetries)
+	} else {
+		add("prepare", retries, "run %s %s once", plan.NewBin, preUpgradeCommand)
+	}
+	add("failure", "built-in", "if pre-upgrade fails: the upgrade fails, %s stays current", plan.OldBin)
+	if cfg.Immutable {
+		add("switch", "immutable layout", "point %s to %s", cfg.currentPointer(), cfg.UpgradeDir(info.Name))
+	} else if cfg.CurrentLink != "" {
+		add("switch", envSetting("DAEMON_CURRENT_LINK", cfg.CurrentLink, true), "point %s to %s", cfg.CurrentLink, cfg.UpgradeDir(info.Name))
+	} else {
+		add("switch", "built-in", "point %s to %s", currentLink, cfg.UpgradeDir(info.Name))
+	}
+	explainPruning(cfg, add)
+	explainHooks(cfg, add)
+	explainHookDirs(cfg, add)
+	explainQueue(cfg, info, add)
+
+	var next *QueuedPlan
+	if queue, err := cfg.UpgradeQueue(); err == nil {
+		next = queuedAfter(queue, info)
+	}
+	switch mode := cfg.haltMode(); {
+	case mode == HaltExit:
+		add("restart", "DAEMON_HALT_AFTER_UPGRADE="+string(mode), "exit with code %d, %s is launched once cosmovisor is started again", ExitCodeHalted, plan.NewBin)
+	case mode == HaltPause:
+		add("restart", "DAEMON_HALT_AFTER_UPGRADE="+string(mode), "pause the supervision, %s is launched once it is resumed", plan.NewBin)
+	case cfg.ShouldRestart(true, nil):
+		add("restart", "DAEMON_RESTART_AFTER_UPGRADE=true", "run %s with the same arguments", plan.NewBin)
+	case next != nil:
+		add("restart", next.File, "run %s with the same arguments to reach queued upgrade %q at height %d", plan.NewBin, next.Name, next.Height)
+	default:
+		add("restart", "DAEMON_RESTART_AFTER_UPGRADE unset", "exit, the init system must start cosmovisor again")
+	}
+	if len(cfg.ExtraArgs) > 0 {
+		add("restart", "DAEMON_EXTRA_ARGS set", "launch %s with the arguments %s", plan.NewBin, strings.Join(cfg.ExtraArgs, " "))
+	}
+	if overrides, err := readOverrides(cfg.UpgradeDir(info.Name)); err != nil {
+		add("restart", overridesFile, "launching %s fails: %v", plan.NewBin, err)
+	} else if overrides != nil {
+		add("restart", overridesFile, "launch %s with the %s", plan.NewBin, overrides)
+	}
+	add("restart", "built-in", "after a stop signal or a failed upgrade: exit without restarting")
+	if cfg.RestartAfterFailure {
+		add("restart", "DAEMON_RESTART_AFTER_FAILURE=true", "if the daemon dies: run it again after %s, doubling up to %s, giving up after %d restarts in a row",
+			cfg.restartDelay(), maxRestartDelay, cfg.restartAttempts())
+	}
+	explainRollback(cfg, plan, add)
+	interval := cfg.NotifyInterval
+	if interval <= 0 {
+		interval = defaultNotifyInterval
+	}
+	if cfg.NotifyWebhook != "" {
+		add("notify", "DAEMON_NOTIFY_WEBHOOK set", "post each event to %s once, in order, at most one every %s", cfg.NotifyWebhook, interval)
+	}
+	if cfg.NotifySMTP != "" {
+		events := "each event"
+		if len(cfg.NotifyEmailEvents) > 0 {
+			events = "the " + strings.Join(cfg.NotifyEmailEvents, ", ") + " events"
+		}
+		add("notify", "DAEMON_NOTIFY_SMTP set", "mail %s to %s through %s once, in order, at most one every %s",
+			events, strings.Join(cfg.NotifyEmailTo, ", "), redactURL(cfg.NotifySMTP), interval)
+	}
+	if cfg.NotifyWebhook == "" && cfg.NotifySMTP == "" {
+		add("notify", "DAEMON_NOTIFY_WEBHOOK unset", "no notifications")
+	}
+	if cfg.CrashChildPolicy == CrashChildLeave {
+		add("crash", "DAEMON_CRASH_CHILD_POLICY=leave", "if cosmovisor panics: write a report to %s and leave the daemon running", filepath.Join(cfg.StateDir(), crashesDir))
+	} else {
+		add("crash", "DAEMON_CRASH_CHILD_POLICY="+string(CrashChildStop), "if cosmovisor panics: write a report to %s and stop the daemon", filepath.Join(cfg.StateDir(), crashesDir))
+	}
+	return lines
+}
+
+// explainStartup describes the check of the plan file against the node's height, if there
+// is anything to check
+func explainStartup(cfg *Config, add func(step, setting, format string, args ...interface{})) {
+	check, err := cfg.CheckPlanHeight()
+	if err != nil {
+		add("startup", upgradeInfoFile, "invalid plan file, cosmovisor refuses to start: %v", err)
+		return
+	}
+	strict := envSetting("DAEMON_STRICT_HEIGHT_CHECK", true, cfg.StrictHeightCheck)
+	for _, conflict := range check.Conflicts {
+		if cfg.StrictHeightCheck {
+			add("startup", strict, "refuse to start: %s", conflict)
+		} else {
+			add("startup", strict, "warn: %s", conflict)
+		}
+	}
+	plan := check.Plan
+	switch check.Action {
+	case PlanActionPending:
+		add("startup", upgradeInfoFile, "%q at height %d is ahead of the node at height %d, wait for the daemon to halt",
+			plan.Name, plan.Height, check.Local.Height)
+	case PlanActionSkip:
+		add("startup", envSetting("DAEMON_SKIP_UPGRADES", cfg.SkipUpgrades, true), "skip %q at height %d, start the daemon with %s",
+			plan.Name, plan.Height, skipUpgradesFlag)
+	case PlanActionAhead:
+		add("startup", upgradeInfoFile, "%q at height %d is far ahead of the node at height %d, assume an older snapshot and start as is",
+			plan.Name, plan.Height, check.Local.Height)
+	case PlanActionApply:
+		if check.Local == nil {
+			add("startup", upgradeInfoFile, "%q isn't applied and the node's height can't be read (%v), apply it before starting",
+				plan.Name, check.HeightErr)
+			break
+		}
+		add("startup", upgradeInfoFile, "the node at height %d reached %q at height %d, apply it before starting",
+			check.Local.Height, plan.Name, plan.Height)
+	}
+}
+
+// explainQueue describes what happens to the queued plans once the upgrade is applied
+func explainQueue(cfg *Config, info *UpgradeInfo, add func(step, setting, format string, args ...interface{})) {
+	setting := "queue directory"
+	queue, err := cfg.UpgradeQueue()
+	if err != nil {
+		add("queue", setting, "invalid queue, cosmovisor refuses to start: %v", err)
+		return
+	}
+	if len(queue) == 0 {
+		add("queue", setting, "no plans queued in %s", cfg.QueueDir())
+		return
+	}
+	head, chain, err := queueChain(queue, info)
+	if err != nil {
+		add("queue", setting, "leave the queue alone, the app's plan wins: %v", err)
+		return
+	}
+	add("queue", setting, "consume %s", head.File)
+	for _, next := range chain {
+		reason := "same height"
+		if next.ChainImmediately {
+			reason = "chain_immediately"
+		}
+		add("queue", next.File, "then apply %q before relaunching (%s)", next.Name, reason)
+	}
+}
+
+// WriteExplanation prints the explanations as aligned columns
+func WriteExplanation(w io.Writer, lines []Explanation) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, l := range lines {
+		fmt.Fprintf(tw, "%s\t%s\t[%s]\n", l.Step, l.Decision, l.Setting)
+	}
+	return tw.Flush()
+}
+
+// explainDetection describes how the upgrade is detected while the daemon runs
+func explainDetection(cfg *Config, add func(step, setting, format string, args ...interface{})) {
+	if cfg.scansOutput() {
+		add("detect", envSetting("DAEMON_LOG_BUFFER_SIZE", cfg.LogBufferSize/1024, cfg.LogBufferSize > 0),
+			"scan daemon stdout and stderr for upgrade lines up to %d bytes long", cfg.ScanBufferSize())
+	} else {
+		add("detect", "DAEMON_UPGRADE_DETECTION="+string(cfg.UpgradeDetection), "don't scan the daemon output for upgrade lines")
+	}
+	if cfg.watchesChainPlan() {
+		add("detect", "DAEMON_PLAN_API="+cfg.PlanAPI, "ask the node for the plan of x/upgrade every %s, upgrade once it committed the block before its height", chainPlanPoll)
+	}
+	if len(cfg.UpgradeSources) > 0 || cfg.UpgradeConflict != "" {
+		setting := envSetting("DAEMON_UPGRADE_SOURCES", strings.Join(cfg.UpgradeSources, ","), len(cfg.UpgradeSources) > 0)
+		if cfg.upgradeConflict() == ConflictHalt {
+			add("detect", "DAEMON_UPGRADE_CONFLICT="+string(ConflictHalt), "halt if sources report the same upgrade at different heights or different upgrades at the same height")
+		} else {
+			add("detect", setting, "if sources report the same upgrade at different heights or different upgrades at the same height, apply the upgrade of the first source of %s",
+				strings.Join(cfg.sourcePriority(), ", "))
+		}
+	}
+	planPath := filepath.Join(cfg.DataDir(), upgradeInfoFile)
+	if !cfg.watchesPlanFile() {
+		add("detect", "DAEMON_UPGRADE_DETECTION="+string(cfg.UpgradeDetection), "don't watch %s", planPath)
+		return
+	}
+	every := cfg.pollInterval().String()
+	if cfg.PollJitter > 0 {
+		every += fmt.Sprintf(" plus up to %s", cfg.PollJitter)
+	}
+	polling := envSetting("DAEMON_POLL_INTERVAL", cfg.pollInterval(), cfg.PollInterval > 0)
+	switch err := checkWatchable(cfg.DataDir()); {
+	case err == nil:
+		add("detect", "built-in", "watch %s for a new plan", planPath)
+	case os.IsNotExist(err):
+		add("detect", polling, "watch %s for a new plan, read it every %s until the data directory exists", planPath, every)
+	default:
+		add("detect", polling, "read %s every %s for a new plan: %v", planPath, every, err)
+	}
+	add("detect", "built-in", "ignore a new plan that is applied already or doesn't match the node's height")
+}
+
+// envSetting names the environment variable and its value, or that it is unset
+func envSetting(name string, value interface{}, set bool) string {
+	if !set {
+		return name + " unset"
+	}
+	return fmt.Sprintf("%s=%v", name, value)
+}
+
+// explainDownloadTLS describes the proxy and TLS settings of the built-in downloader
+func explainDownloadTLS(cfg *Config) string {
+	var parts []string
+	if cfg.DownloadProxy != "" {
+		parts = append(parts, "through the proxy "+cfg.DownloadProxy)
+	}
+	switch {
+	case cfg.UnsafeSkipTLSVerify:
+		parts = append(parts, "accepting any server certificate (DAEMON_UNSAFE_SKIP_TLS_VERIFY)")
+	case cfg.DownloadCACert != "":
+		parts = append(parts, "trusting the system roots and "+cfg.DownloadCACert)
+	}
+	if cfg.DownloadClientCert != "" {
+		parts = append(parts, "presenting the client certificate "+cfg.DownloadClientCert)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// explainSignature describes where the signature of the download comes from
+func explainSignature(info *UpgradeInfo) string {
+	config, ok := parseUpgradeConfig(info)
+	if !ok {
+		return fmt.Sprintf("the signature listed in %q for %s", strings.TrimSpace(info.Info), OSArch())
+	}
+	if url, ok := config.SignatureURL(OSArch()); ok {
+		return "the signature " + url
+	}
+	return fmt.Sprintf("nothing, the download will fail: the plan has no signature for %s", OSArch())
+}
+
+// explainStop describes the signal stopping the daemon when cosmovisor is stopped
+func explainStop(cfg *Config) string {
+	if cfg.StopSignal != 0 {
+		return fmt.Sprintf("send %s to the daemon", signalName(cfg.StopSignal))
+	}
+	return "forward the signal to the daemon"
+}
+
+// explainKill describes the SIGKILL escalation of a shutdown budget
+func explainKill(b ShutdownBudget) string {
+	if b.ChildWindow == 0 {
+		return "never SIGKILL it"
+	}
+	return fmt.Sprintf("SIGKILL it after %s", b.ChildWindow)
+}
+
+// explainPruning describes which data backups and upgrade directories are removed after
+// the switch
+func explainPruning(cfg *Config, add func(step, setting, format string, args ...interface{})) {
+	var limits, settings []string
+	if cfg.BackupKeepRecent > 0 {
+		limits = append(limits, fmt.Sprintf("beyond the %d newest", cfg.BackupKeepRecent))
+		settings = append(settings, envSetting("DAEMON_BACKUP_KEEP_RECENT", cfg.BackupKeepRecent, true))
+	}
+	if cfg.BackupMaxAge > 0 {
+		limits = append(limits, "older than "+cfg.BackupMaxAge.String())
+		settings = append(settings, envSetting("DAEMON_BACKUP_MAX_AGE", cfg.BackupMaxAge, true))
+	}
+	switch {
+	case len(limits) > 0:
+		add("prune", strings.Join(settings, " "), "after the switch: remove the data backups %s, never the newest", strings.Join(limits, " or "))
+	case cfg.dataBackup() != DataBackupNone:
+		add("prune", "DAEMON_BACKUP_KEEP_RECENT unset", "keep all data backups")
+	}
+	if cfg.UpgradesKeepRecent > 0 && !cfg.Immutable {
+		add("prune", envSetting("DAEMON_UPGRADES_KEEP_RECENT", cfg.UpgradesKeepRecent, true),
+			"after the switch: remove the directories of the upgrades applied before the %d most recent, never the current one or the one before", cfg.UpgradesKeepRecent)
+	}
+}
+
+// explainRollback describes what happens if the new binary fails right after the switch
+func explainRollback(cfg *Config, plan *UpgradePlan, add func(step, setting, format string, args ...interface{})) {
+	if cfg.HealthGateBlocks > 0 {
+		add("health", fmt.Sprintf("DAEMON_HEALTH_GATE_BLOCKS=%d", cfg.HealthGateBlocks), "the upgrade is healthy once %s committed %d blocks, within %s of its launch",
+			plan.NewBin, cfg.HealthGateBlocks, cfg.healthGateTimeout())
+		var otherwise string
+		switch cfg.healthGateOnFailure() {
+		case HealthGateAlert:
+			otherwise = "report it and leave the node running"
+		case HealthGateHalt:
+			otherwise = "report it, stop the daemon and exit"
+		case HealthGateRollback:
+			otherwise = "report it and roll the upgrade back"
+		}
+		add("health", "DAEMON_HEALTH_GATE_ON_FAILURE="+string(cfg.healthGateOnFailure()), "if it doesn't: %s", otherwise)
+	}
+	policy := cfg.rollback()
+	if policy == RollbackOff {
+		add("revert", "DAEMON_ROLLBACK unset", "if %s fails after the switch: no rollback", plan.NewBin)
+		return
+	}
+	undo := fmt.Sprintf("point %s back to %s", orDefault(cfg.CurrentLink, currentLink), plan.OldBin)
+	if policy == RollbackFull {
+		undo += " and restore the data backup taken for the upgrade"
+	}
+	add("revert", "DAEMON_ROLLBACK="+string(policy), "if %s fails %d times within %s of the switch: %s, then stop", plan.NewBin, cfg.rollbackAttempts(), cfg.rollbackWindow(), undo)
+	add("revert", "built-in", "refuse to start after a rollback until %s is removed", filepath.Join(cfg.StateDir(), rollbackFile))
+}
+
+// explainHooks describes the post-upgrade hooks run after the switch
+func explainHooks(cfg *Config, add func(step, setting, format string, args ...interface{})) {
+	if cfg.PostUpgradeHook == "" {
+		add("hooks", "DAEMON_POST_UPGRADE_HOOK unset", "no post-upgrade hook")
+		return
+	}
+	setting := "DAEMON_POST_UPGRADE_HOOK set"
+	hooks, skipped, err := postUpgradeHooks(cfg.PostUpgradeHook)
+	switch {
+	case err != nil:
+		add("hooks", setting, "no post-upgrade hook runs: %v", err)
+		return
+	case len(hooks) == 0:
+		add("hooks", setting, "no post-upgrade hook runs: %s has no executables", cfg.PostUpgradeHook)
+		return
+	}
+	add("hooks", setting, "after the switch: run %s in order, with the upgrade in COSMOVISOR_* variables", strings.Join(hooks, ", "))
+	if len(skipped) > 0 {
+		add("hooks", setting, "skip %s, not executable", strings.Join(skipped, ", "))
+	}
+	add("hooks", envSetting("DAEMON_POST_UPGRADE_HOOK_TIMEOUT", cfg.PostUpgradeHookTimeout, cfg.PostUpgradeHookTimeout > 0),
+		"give up on a hook after %s, a failed hook is logged and the upgrade stands", cfg.postUpgradeHookTimeout())
+}
+
+// explainHookDirs describes the hooks of the hooks directory run for an upgrade
+func explainHookDirs(cfg *Config, add func(step, setting, format string, args ...interface{})) {
+	when := map[string]string{HookPreUpgrade: "before the backup", HookPreBackup: "before backing up", HookPostUpgrade: "after the switch"}
+	for _, point := range []string{HookPreUpgrade, HookPreBackup, HookPostUpgrade} {
+		hooks, skipped, err := postUpgradeHooks(cfg.hookDir(point))
+		if os.IsNotExist(err) || err == nil && len(hooks)+len(skipped) == 0 {
+			continue
+		}
+		setting := "hooks/" + point + ".d"
+		switch {
+		case err != nil:
+			add("hooks", setting, "no %s hook runs: %v", point, err)
+			continue
+		case len(hooks) == 0:
+			add("hooks", setting, "no %s hook runs: %s has no executables", point, cfg.hookDir(point))
+			continue
+		}
+		if point == HookPreBackup && len(cfg.backupBackendKeys()) == 0 {
+			add("hooks", setting, "no %s hook runs: nothing is backed up", point)
+			continue
+		}
+		policy := cfg.hookPolicy(point)
+		failure := "a failed hook is logged and the next one runs"
+		if policy.OnFailure == HookAbort {
+			failure = "a failed hook skips the others"
+			if point != HookPostUpgrade {
+				failure += " and fails the upgrade"
+			}
+		}
+		add("hooks", setting, "%s: run %s in order within %s each, %s", when[point], strings.Join(hooks, ", "), policy.Timeout, failure)
+		if len(skipped) > 0 {
+			add("hooks", setting, "skip %s, not executable", strings.Join(skipped, ", "))
+		}
+	}
+}
+
+// explainReference describes a download listed in the document the plan info links to
+func explainReference(cfg *Config, ref string) string {
+	listed := fmt.Sprintf("the URL listed for %s in the document at", OSArch())
+	src, sum, err := splitChecksum(ref)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("%s %s, the download will fail: %v", listed, ref, err)
+	case sum == nil && cfg.DownloadMustHaveChecksum:
+		return fmt.Sprintf("%s %s, the download will fail: DAEMON_DOWNLOAD_MUST_HAVE_CHECKSUM is set and the link has no checksum", listed, ref)
+	case sum == nil:
+		return fmt.Sprintf("%s %s, which isn't pinned by a checksum", listed, src)
+	default:
+		return fmt.Sprintf("%s %s, pinned by its %s checksum", listed, src, sum.Algorithm())
+	}
+}
+
+// explainSource describes where the binary is downloaded from and how it is verified,
+// without downloading anything
+func explainSource(cfg *Config, info *UpgradeInfo) string {
+	doc := strings.TrimSpace(info.Info)
+	if doc == "" {
+		return "nowhere, the download will fail: the plan info is empty"
+	}
+	if isReference(doc) {
+		return explainReference(cfg, doc)
+	}
+	url, config, err := binaryURL(doc)
+	if err != nil {
+		return fmt.Sprintf("nowhere, the download will fail: %v", err)
+	}
+	if urls, _ := config.BinaryURLs(OSArch()); len(urls) > 1 {
+		return fmt.Sprintf("%s, falling back to %s, each tried up to %d times", url, strings.Join(urls[1:], " then "), cfg.downloadAttempts())
+	}
+	src, sum, err := splitChecksum(url)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("%s, the download will fail: %v", url, err)
+	case sum == nil && isIPFS(src):
+		return fmt.Sprintf("%s through the gateway %s, verifying its CID", src, cfg.ipfsGateway())
+	case sum == nil && cfg.DownloadMustHaveChecksum:
+		return fmt.Sprintf("%s, the download will fail: DAEMON_DOWNLOAD_MUST_HAVE_CHECKSUM is set and it has no checksum", url)
+	case sum == nil:
+		return src + " without verifying a checksum"
+	default:
+		return fmt.Sprintf("%s, verifying its %s checksum", src, sum.Algorithm())
+	}
+}
@@ -0,0 +1,185 @@
+//go:build linux
+// +build linux
+
+package cosmovisor_test
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/cosmos-sdk/cosmovisor"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of the explain tests")
+
+func TestExplain(t *testing.T) {
+	pubkey, err := cosmovisor.ParseSignatureKey([]byte("RWQBAgMEBQYHCAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f"))
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		cfg  cosmovisor.Config
+		info cosmovisor.UpgradeInfo
+		// hookDirs are the hook points given a script in the hooks directory
+		hookDirs []string
+	}{
+		"staged": {
+			info: cosmovisor.UpgradeInfo{Name: "chain2", Height: 50},
+		},
+		"download": {
+			cfg: cosmovisor.Config{AllowDownloadBinaries: true, RestartAfterUpgrade: true, RestartAfterFailure: true, RestartDelay: 10 * time.Second, LogBufferSize: 256 * 1024},
+			info: cosmovisor.UpgradeInfo{
+				Name: "chain9",
+				Info: `{"binaries":{"linux/amd64":"https://example.com/chain9.zip","any":"https://example.com/any.zip"}}`,
+			},
+		},
+		"download_signed": {
+			cfg: cosmovisor.Config{AllowDownloadBinaries: true, BinaryPubKey: pubkey, DownloaderCommand: "aria2c -d {{.Dir}} -o {{.File}} {{.URL}}"},
+			info: cosmovisor.UpgradeInfo{
+				Name: "chain9",
+				Info: `{"binaries":{"any":"https://example.com/chain9.tar.gz"},"signatures":{"any":"https://example.com/chain9.tar.gz.minisig"},"binary_path":"chain9/bin/dummyd"}`,
+			},
+		},
+		"download_mirrors": {
+			cfg: cosmovisor.Config{AllowDownloadBinaries: true, DownloadAttempts: 5},
+			info: cosmovisor.UpgradeInfo{
+				Name: "chain9",
+				Info: `{"binaries":{"any":["https://example.com/chain9.zip","https://mirror.example.org/chain9.zip"]}}`,
+			},
+		},
+		"download_ahead": {
+			cfg: cosmovisor.Config{AllowDownloadBinaries: true, PredownloadAPI: "http://localhost:1317", PredownloadBlocks: 200},
+			info: cosmovisor.UpgradeInfo{
+				Name:   "chain9",
+				Height: 5000,
+				Info:   `{"binaries":{"any":"https://example.com/chain9.zip?checksum=sha256:aec070645fe53ee3b3763059376134f058cc337247c978add178b6ccdfb0019f"}}`,
+			},
+		},
+		"download_reference": {
+			cfg: cosmovisor.Config{AllowDownloadBinaries: true, DownloadMustHaveChecksum: true},
+			info: cosmovisor.UpgradeInfo{
+				Name: "chain9",
+				Info: "https://example.com/chain9.json?checksum=sha256:aec070645fe53ee3b3763059376134f058cc337247c978add178b6ccdfb0019f",
+			},
+		},
+		"download_disabled": {
+			info: cosmovisor.UpgradeInfo{Name: "chain9"},
+		},
+		"immutable": {
+			cfg: cosmovisor.Config{Immutable: true, AllowDownloadBinaries: true},
+			info: cosmovisor.UpgradeInfo{
+				Name: "chain9",
+				Info: `{"binaries":{"any":"https://example.com/any.zip"}}`,
+			},
+		},
+		"export_truncate": {
+			cfg: cosmovisor.Config{
+				TerminationGrace:         3 * time.Second,
+				TerminationMargin:        5 * time.Second,
+				TerminationUpgradePolicy: cosmovisor.UpgradePolicyTruncate,
+				ExportPolicy:             cosmovisor.ExportPolicyAbort,
+				ExportTimeout:            10 * time.Minute,
+				PreUpgradeMaxRetries:     3,
+			},
+			info: cosmovisor.UpgradeInfo{Name: "chain2", Height: 50, Info: `{"export":true}`},
+		},
+		"grace_skip": {
+			cfg: cosmovisor.Config{
+				TerminationGrace:         3 * time.Second,
+				TerminationUpgradePolicy: cosmovisor.UpgradePolicySkip,
+				StopSignal:               syscall.SIGINT,
+				PreUpgradeExport:         true,
+				ExportCommand:            "export --height {{.Height}} --output-document {{.Output}} --for-zero-height",
+			},
+			info: cosmovisor.UpgradeInfo{Name: "chain2", Height: 50},
+		},
+		"post_upgrade_hooks": {
+			cfg:  cosmovisor.Config{PostUpgradeHook: "hooks.d", PostUpgradeHookTimeout: 30 * time.Second},
+			info: cosmovisor.UpgradeInfo{Name: "chain2", Height: 50},
+		},
+		"hook_dirs": {
+			cfg: cosmovisor.Config{BackupCommand: "zfs snapshot tank/node@{{.Name}}", Hooks: map[string]cosmovisor.HookPolicy{
+				cosmovisor.HookPreUpgrade:  {Timeout: time.Minute},
+				cosmovisor.HookPostUpgrade: {OnFailure: cosmovisor.HookAbort},
+			}},
+			info:     cosmovisor.UpgradeInfo{Name: "chain2", Height: 50},
+			hookDirs: []string{cosmovisor.HookPreUpgrade, cosmovisor.HookPreBackup, cosmovisor.HookPostUpgrade, cosmovisor.HookOnCrash},
+		},
+		"health_gate": {
+			cfg:  cosmovisor.Config{HealthGateBlocks: 10, HealthGateTimeout: 5 * time.Minute, HealthGateOnFailure: cosmovisor.HealthGateRollback, Rollback: cosmovisor.RollbackBinary},
+			info: cosmovisor.UpgradeInfo{Name: "chain2", Height: 50},
+		},
+		"backup_command": {
+			cfg:  cosmovisor.Config{DataBackup: cosmovisor.DataBackupArchive, DataBackupDir: "/mnt/backups", DataBackupExclude: []string{"wasm/cache/**", "snapshots"}, BackupKeepRecent: 2, BackupMaxAge: 720 * time.Hour, Rollback: cosmovisor.RollbackFull, RollbackAttempts: 3, UpgradesKeepRecent: 3, BackupCommand: "zfs snapshot tank/node@{{.Name}}-{{.Height}}"},
+			info: cosmovisor.UpgradeInfo{Name: "chain2", Height: 50},
+		},
+		"detect_output": {
+			cfg:  cosmovisor.Config{UpgradeDetection: cosmovisor.DetectOutput},
+			info: cosmovisor.UpgradeInfo{Name: "chain2", Height: 50},
+		},
+		"detect_file": {
+			cfg:  cosmovisor.Config{UpgradeDetection: cosmovisor.DetectFile, PollInterval: time.Second, PollJitter: 200 * time.Millisecond},
+			info: cosmovisor.UpgradeInfo{Name: "chain2", Height: 50},
+		},
+		"detect_conflict": {
+			cfg:  cosmovisor.Config{UpgradeSources: []string{cosmovisor.SourceChain, cosmovisor.SourceFile}, PlanAPI: "http://localhost:1317"},
+			info: cosmovisor.UpgradeInfo{Name: "chain2", Height: 50},
+		},
+		"detect_chain": {
+			cfg:  cosmovisor.Config{UpgradeDetection: cosmovisor.DetectChain, PlanAPI: "http://localhost:1317"},
+			info: cosmovisor.UpgradeInfo{Name: "chain2", Height: 50},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home := copyTestData(t, "export")
+			cfg := tc.cfg
+			cfg.Home = home
+			cfg.Name = "dummyd"
+			if cfg.PostUpgradeHook != "" {
+				// relative to the home, which only exists now
+				cfg.PostUpgradeHook = filepath.Join(home, cfg.PostUpgradeHook)
+				require.NoError(t, os.MkdirAll(cfg.PostUpgradeHook, 0755))
+				for name, mode := range map[string]os.FileMode{"10-labels": 0755, "20-notify": 0755, "README": 0644} {
+					require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.PostUpgradeHook, name), []byte("#!/bin/sh\n"), mode))
+				}
+			}
+
+			for _, point := range tc.hookDirs {
+				dir := filepath.Join(cfg.HooksDir(), point+".d")
+				require.NoError(t, os.MkdirAll(dir, 0755))
+				require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "10-"+point), []byte("#!/bin/sh\n"), 0755))
+			}
+
+			// the temporary home is replaced before formatting, so columns line up the same way
+			lines := cosmovisor.Explain(&cfg, &tc.info)
+			for i := range lines {
+				lines[i].Decision = strings.ReplaceAll(lines[i].Decision, home, "$DAEMON_HOME")
+			}
+			var buf bytes.Buffer
+			require.NoError(t, cosmovisor.WriteExplanation(&buf, lines))
+			got := buf.String()
+
+			golden := filepath.Join("testdata", "explain", name+".golden")
+			if *updateGolden {
+				require.NoError(t, ioutil.WriteFile(golden, []byte(got), 0644))
+			}
+			want, err := ioutil.ReadFile(golden)
+			require.NoError(t, err)
+			require.Equal(t, string(want), got)
+
+			// explaining must not change the layout, not even create the current link
+			_, err = os.Lstat(filepath.Join(cfg.Root(), "current"))
+			require.True(t, os.IsNotExist(err))
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package cosmovisor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	backupsDir       = "backups"
+	exportDocument   = "export.json"
+	exportRecordFile = "export-record.json"
+
+	// DefaultExportCommand is the arguments passed to the old binary for a pre-switch export
+	DefaultExportCommand = "export --home {{.Home}} --height {{.Height}} --output-document {{.Output}}"
+	// defaultExportTimeout is generous, exporting a large state can take a long time
+	defaultExportTimeout = time.Hour
+)
+
+// ExportPolicy decides what happens to the upgrade if the pre-switch export fails
+type ExportPolicy string
+
+const (
+	// ExportPolicyWarn logs the failure and continues with the upgrade
+	ExportPolicyWarn ExportPolicy = "warn"
+	// ExportPolicyAbort fails the upgrade, leaving the old binary in place
+	ExportPolicyAbort ExportPolicy = "abort"
+)
+
+// ExportRecord is written next to the export document once an export succeeded
+type ExportRecord struct {
+	Type       string    `json:"type"`
+	Upgrade    string    `json:"upgrade"`
+	Binary     string    `json:"binary"`
+	Height     int64     `json:"height"`
+	Path       string    `json:"path"`
+	SHA256     string    `json:"sha256"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// exportTemplateData is available to the export command template
+type exportTemplateData struct {
+	Home   string
+	Name   string
+	Height int64
+	Output string
+}
+
+// BackupDir is the directory keeping everything saved before the named upgrade
+func (cfg *Config) BackupDir(upgradeName string) string {
+	return filepath.Join(cfg.StateDir(), backupsDir, url.PathEscape(upgradeName))
+}
+
+// wantsExport returns true if the config or the plan info ask for a pre-switch export
+func (cfg *Config) wantsExport(info *UpgradeInfo) bool {
+	if cfg.PreUpgradeExport {
+		return true
+	}
+	config, _ := parseUpgradeConfig(info)
+	return config.Export
+}
+
+// ExportState runs the export command of the old binary against the stopped node's data,
+// writing the document to BackupDir. oldBin must be the binary that ran before the upgrade.
+func ExportState(cfg *Config, info *UpgradeInfo, oldBin string) (*ExportRecord, error) {
+	data := cfg.exportTemplateData(info)
+	args, err := cfg.exportArgs(data)
+	if err != nil {
+		return nil, err
+	}
+	height, output := data.Height, data.Output
+
+	dir := cfg.BackupDir(info.Name)
+	if err := cfg.fs().mkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating backup dir: %w", err)
+	}
+
+	timeout := cfg.exportTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	logger.Infof("exporting state with %s %s", oldBin, strings.Join(args, " "))
+	if err := injectFaultContext(ctx, "export.run"); err != nil && ctx.Err() == nil {
+		return nil, err
+	}
+	out, err := cfg.daemonCommand(ctx, oldBin, args...).CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("export didn't finish within %s", timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w: %s", oldBin, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	hash, err := sha256File(output)
+	if err != nil {
+		return nil, fmt.Errorf("export document missing: %w", err)
+	}
+	record := &ExportRecord{
+		Type:       "export",
+		Upgrade:    info.Name,
+		Binary:     oldBin,
+		Height:     height,
+		Path:       output,
+		SHA256:     hash,
+		ExportedAt: NowUTC(),
+	}
+	bz, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return record, cfg.fs().writeFile(filepath.Join(dir, exportRecordFile), bz, 0644)
+}
+
+// exportTemplateData resolves the values available to the export command for the upgrade
+func (cfg *Config) exportTemplateData(info *UpgradeInfo) exportTemplateData {
+	// the last block committed by the old binary is the one before the upgrade height
+	height := info.Height - 1
+	if info.Height == 0 {
+		height = -1
+	}
+	return exportTemplateData{
+		Home:   cfg.Home,
+		Name:   info.Name,
+		Height: height,
+		Output: filepath.Join(cfg.BackupDir(info.Name), exportDocument),
+	}
+}
+
+// exportTimeout is the configured export timeout or the default
+func (cfg *Config) exportTimeout() time.Duration {
+	if cfg.ExportTimeout <= 0 {
+		return defaultExportTimeout
+	}
+	return cfg.ExportTimeout
+}
+
+// exportArgs renders the configured export command template
+func (cfg *Config) exportArgs(data exportTemplateData) ([]string, error) {
+	command := cfg.ExportCommand
+	if command == "" {
+		command = DefaultExportCommand
+	}
+	return renderCommand("export", command, data)
+}
+
+// parseExportPolicy validates the value of DAEMON_PRE_UPGRADE_EXPORT_POLICY
+func parseExportPolicy(s string) (ExportPolicy, error) {
+	switch p := ExportPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return ExportPolicyWarn, nil
+	case ExportPolicyWarn, ExportPolicyAbort:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown export policy %q, must be %s or %s", s, ExportPolicyWarn, ExportPolicyAbort)
+	}
+}
@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package cosmovisor_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/cosmos/cosmos-sdk/cosmovisor"
+)
+
+type exportTestSuite struct {
+	suite.Suite
+}
+
+func TestExportTestSuite(t *testing.T) {
+	suite.Run(t, new(exportTestSuite))
+}
+
+func (s *exportTestSuite) TestExportBeforeSwitch() {
+	home := copyTestData(s.T(), "export")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", PreUpgradeExport: true}
+
+	info := &cosmovisor.UpgradeInfo{Name: "chain2", Height: 50}
+	s.Require().NoError(cosmovisor.DoUpgrade(cfg, info))
+
+	currentBin, err := cfg.CurrentBin()
+	s.Require().NoError(err)
+	s.Require().Equal(cfg.UpgradeBin("chain2"), currentBin)
+
+	// the export was done by the old binary at the last height it committed
+	doc := filepath.Join(cfg.BackupDir("chain2"), "export.json")
+	bz, err := ioutil.ReadFile(doc)
+	s.Require().NoError(err)
+	s.Require().Equal(`{"exported_by":"genesis","height":"49"}`+"\n", string(bz))
+
+	bz, err = ioutil.ReadFile(filepath.Join(cfg.BackupDir("chain2"), "export-record.json"))
+	s.Require().NoError(err)
+	var record cosmovisor.ExportRecord
+	s.Require().NoError(json.Unmarshal(bz, &record))
+	s.Require().Equal("export", record.Type)
+	s.Require().Equal(cfg.GenesisBin(), record.Binary)
+	s.Require().Equal(doc, record.Path)
+	s.Require().Equal(int64(49), record.Height)
+	// sha256 of the deterministic document written by the fixture
+	s.Require().Equal("b752f7d2b0819f5a8bcf256e9088db609885d86a7921b63be9fa8e91f7a54fb0", record.SHA256)
+}
+
+func (s *exportTestSuite) TestExportRequestedByPlan() {
+	home := copyTestData(s.T(), "export")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+
+	s.Require().NoError(cosmovisor.DoUpgrade(cfg, &cosmovisor.UpgradeInfo{Name: "chain2", Height: 50, Info: `{"export":true}`}))
+	_, err := os.Stat(filepath.Join(cfg.BackupDir("chain2"), "export.json"))
+	s.Require().NoError(err)
+}
+
+func (s *exportTestSuite) TestNoExportByDefault() {
+	home := copyTestData(s.T(), "export")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+
+	s.Require().NoError(cosmovisor.DoUpgrade(cfg, &cosmovisor.UpgradeInfo{Name: "chain2", Height: 50, Info: "{}"}))
+	_, err := os.Stat(cfg.BackupDir("chain2"))
+	s.Require().True(os.IsNotExist(err))
+}
+
+func (s *exportTestSuite) TestFailedExportPolicy() {
+	cases := map[string]struct {
+		policy    cosmovisor.ExportPolicy
+		expectErr bool
+	}{
+		"warn continues the upgrade": {policy: cosmovisor.ExportPolicyWarn},
+		"default is warn":            {},
+		"abort keeps the old binary": {policy: cosmovisor.ExportPolicyAbort, expectErr: true},
+	}
+
+	for name, tc := range cases {
+		s.Run(name, func() {
+			home := copyTestData(s.T(), "export")
+			cfg := &cosmovisor.Config{
+				Home:             home,
+				Name:             "dummyd",
+				PreUpgradeExport: true,
+				// the fixture rejects unknown flags
+				ExportCommand: "export --bogus {{.Height}}",
+				ExportPolicy:  tc.policy,
+			}
+
+			err := cosmovisor.DoUpgrade(cfg, &cosmovisor.UpgradeInfo{Name: "chain2", Height: 50})
+			currentBin, cerr := cfg.CurrentBin()
+			s.Require().NoError(cerr)
+			if tc.expectErr {
+				s.Require().Error(err)
+				s.Require().Contains(err.Error(), "unknown flag: --bogus")
+				s.Require().Equal(cfg.GenesisBin(), currentBin)
+			} else {
+				s.Require().NoError(err)
+				s.Require().Equal(cfg.UpgradeBin("chain2"), currentBin)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+//go:build cosmovisor_faults
+// +build cosmovisor_faults
+
+package cosmovisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The cosmovisor_faults build tag turns the fault points of the supervision pipeline into
+// failures configured in COSMOVISOR_FAULTS, for chaos testing. It must never be used for
+// production builds.
+
+// FaultsEnv is the environment variable holding the faults to inject
+const FaultsEnv = "COSMOVISOR_FAULTS"
+
+// ErrInjectedFault is the error returned by fault points with the error action
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultAction is what happens when a fault point is triggered
+type FaultAction string
+
+const (
+	// FaultError makes the fault point return ErrInjectedFault
+	FaultError FaultAction = "error"
+	// FaultPanic panics at the fault point
+	FaultPanic FaultAction = "panic"
+	// FaultHang blocks at the fault point, for a duration or until its context is done
+	FaultHang FaultAction = "hang"
+)
+
+// FaultSpec is one fault: <point>[@<hit>]=<action>[:<duration>]
+type FaultSpec struct {
+	Point string
+	// Hit is the hit of the point that fails, starting at 1. Zero fails every hit.
+	Hit    int
+	Action FaultAction
+	// Hang is how long the hang action blocks, zero blocks until the context is done
+	Hang time.Duration
+}
+
+var faults struct {
+	sync.Mutex
+	specs map[string]FaultSpec
+	hits  map[string]int
+}
+
+func init() {
+	if err := SetFaults(os.Getenv(FaultsEnv)); err != nil {
+		logger.Errorf("invalid %s: %v", FaultsEnv, err)
+		os.Exit(2)
+	}
+}
+
+// ParseFaults parses a semicolon separated list of faults, e.g.
+// "download.fetch=error;switch.rename@2=panic;export.run=hang:10s"
+func ParseFaults(s string) ([]FaultSpec, error) {
+	var specs []FaultSpec
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		eq := strings.Index(part, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("fault %q: expected <point>[@<hit>]=<action>", part)
+		}
+		spec := FaultSpec{Point: part[:eq]}
+		if at := strings.Index(spec.Point, "@"); at >= 0 {
+			hit, err := strconv.Atoi(spec.Point[at+1:])
+			if err != nil || hit < 1 {
+				return nil, fmt.Errorf("fault %q: hit must be a positive number", part)
+			}
+			spec.Point, spec.Hit = spec.Point[:at], hit
+		}
+		action := part[eq+1:]
+		if colon := strings.Index(action, ":"); colon >= 0 {
+			d, err := time.ParseDuration(action[colon+1:])
+			if err != nil {
+				return nil, fmt.Errorf("fault %q: %w", part, err)
+			}
+			action, spec.Hang = action[:colon], d
+		}
+		spec.Action = FaultAction(action)
+		switch spec.Action {
+		case FaultError, FaultPanic:
+			if spec.Hang != 0 {
+				return nil, fmt.Errorf("fault %q: only hang takes a duration", part)
+			}
+		case FaultHang:
+		default:
+			return nil, fmt.Errorf("fault %q: unknown action %q, must be error, panic or hang", part, action)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// SetFaults replaces the injected faults and resets the hit counts
+func SetFaults(s string) error {
+	specs, err := ParseFaults(s)
+	if err != nil {
+		return err
+	}
+	faults.Lock()
+	defer faults.Unlock()
+	faults.specs = make(map[string]FaultSpec, len(specs))
+	for _, spec := range specs {
+		faults.specs[spec.Point] = spec
+	}
+	faults.hits = map[string]int{}
+	return nil
+}
+
+// FaultHits returns how often the fault point was reached since the faults were set
+func FaultHits(point string) int {
+	faults.Lock()
+	defer faults.Unlock()
+	return faults.hits[point]
+}
+
+func injectFault(point string) error {
+	return injectFaultContext(context.Background(), point)
+}
+
+func injectFaultContext(ctx context.Context, point string) error {
+	faults.Lock()
+	faults.hits[point]++
+	hit := faults.hits[point]
+	spec, ok := faults.specs[point]
+	faults.Unlock()
+	if !ok || (spec.Hit != 0 && spec.Hit != hit) {
+		return nil
+	}
+
+	logger.Warnf("injecting fault at %s (hit %d): %s", point, hit, spec.Action)
+	switch spec.Action {
+	case FaultPanic:
+		panic(fmt.Sprintf("injected fault at %s", point))
+	case FaultHang:
+		var timeout <-chan time.Time
+		if spec.Hang > 0 {
+			timeout = time.After(spec.Hang)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return nil
+		}
+	default:
+		return fmt.Errorf("%w at %s", ErrInjectedFault, point)
+	}
+}
+
+// faultReader returns r, a stream of size bytes of which the first offset were read
+// before, with the fault point hit once the stream passes 90% of them. The read stopping
+// there returns its error, so a download can be cut off mid-stream. A stream of unknown size
+// or resumed beyond that never hits it.
+func faultReader(point string, r io.Reader, offset, size int64) io.Reader {
+	at := size * 9 / 10
+	if size <= 0 || offset >= at {
+		return r
+	}
+	return &faultStream{r: r, point: point, pos: offset, at: at}
+}
+
+type faultStream struct {
+	r     io.Reader
+	point string
+	pos   int64
+	at    int64
+	hit   bool
+}
+
+func (s *faultStream) Read(p []byte) (int, error) {
+	if !s.hit && int64(len(p)) > s.at-s.pos {
+		p = p[:s.at-s.pos]
+	}
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	if !s.hit && s.pos >= s.at {
+		s.hit = true
+		if ferr := injectFault(s.point); ferr != nil {
+			return n, ferr
+		}
+	}
+	return n, err
+}
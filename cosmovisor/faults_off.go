@@ -0,0 +1,18 @@
+//go:build !cosmovisor_faults
+// +build !cosmovisor_faults
+
+package cosmovisor
+
+import (
+	"context"
+	"io"
+)
+
+// Without the cosmovisor_faults build tag, fault points are empty functions the compiler
+// inlines away.
+
+func injectFault(string) error { return nil }
+
+func injectFaultContext(context.Context, string) error { return nil }
+
+func faultReader(_ string, r io.Reader, _, _ int64) io.Reader { return r }
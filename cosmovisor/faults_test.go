@@ -0,0 +1,45 @@
+//go:build cosmovisor_faults
+// +build cosmovisor_faults
+
+package cosmovisor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFaults(t *testing.T) {
+	specs, err := ParseFaults("download.fetch=error; switch.rename@2=panic;export.run=hang:10s;hotfix.smoke=hang")
+	require.NoError(t, err)
+	require.Equal(t, []FaultSpec{
+		{Point: "download.fetch", Action: FaultError},
+		{Point: "switch.rename", Hit: 2, Action: FaultPanic},
+		{Point: "export.run", Action: FaultHang, Hang: 10 * time.Second},
+		{Point: "hotfix.smoke", Action: FaultHang},
+	}, specs)
+
+	for _, invalid := range []string{"download.fetch", "a=explode", "a@0=error", "a@x=error", "a=hang:soon", "a=error:1s"} {
+		_, err := ParseFaults(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestInjectFault(t *testing.T) {
+	require.NoError(t, SetFaults("a@2=error;b=panic;c=hang"))
+	defer SetFaults("")
+
+	require.NoError(t, injectFault("a"))
+	require.True(t, errors.Is(injectFault("a"), ErrInjectedFault))
+	require.NoError(t, injectFault("a"))
+	require.Equal(t, 3, FaultHits("a"))
+
+	require.Panics(t, func() { _ = injectFault("b") })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, injectFaultContext(ctx, "c"))
+}
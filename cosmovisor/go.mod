@@ -3,7 +3,19 @@ module github.com/cosmos/cosmos-sdk/cosmovisor
 go 1.14
 
 require (
+	github.com/aws/aws-sdk-go v1.15.78
+	github.com/bgentry/go-netrc v0.0.0-20140422174119-9fd32a8b3d3d
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/golang/snappy v0.0.3-0.20201103224600-674baa8c7fc3 // indirect
 	github.com/hashicorp/go-getter v1.4.1
+	github.com/hashicorp/go-version v1.1.0
+	github.com/klauspost/compress v1.10.3
 	github.com/otiai10/copy v1.2.0
-	github.com/stretchr/testify v1.6.1
+	github.com/pelletier/go-toml v1.9.3
+	github.com/stretchr/testify v1.7.0
+	github.com/syndtr/goleveldb v1.0.1-0.20200815110645-5c35d600f0ca
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 )
@@ -0,0 +1,50 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HaltMode decides what cosmovisor does once an upgrade is applied, instead of launching
+// the new binary, so that an operator checks the node before its first start
+type HaltMode string
+
+const (
+	// HaltNone launches the new binary as DAEMON_RESTART_AFTER_UPGRADE says
+	HaltNone HaltMode = "none"
+	// HaltExit exits with ExitCodeHalted, which service managers don't restart on
+	HaltExit HaltMode = "exit"
+	// HaltPause pauses the supervision, the new binary is launched once it is resumed
+	HaltPause HaltMode = "pause"
+)
+
+// ExitCodeHalted is the exit code of cosmovisor halted after an upgrade by HaltExit
+// (EX_TEMPFAIL)
+const ExitCodeHalted = 75
+
+// parseHaltMode validates the value of DAEMON_HALT_AFTER_UPGRADE
+func parseHaltMode(s string) (HaltMode, error) {
+	switch m := HaltMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case "", "false":
+		return HaltNone, nil
+	case HaltNone, HaltExit, HaltPause:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown halt mode %q, must be %s, %s or %s", s, HaltNone, HaltExit, HaltPause)
+	}
+}
+
+// haltMode returns HaltAfterUpgrade, HaltNone if unset
+func (cfg *Config) haltMode() HaltMode {
+	return HaltMode(orDefault(string(cfg.HaltAfterUpgrade), string(HaltNone)))
+}
+
+// HaltedError is returned by Supervise halted after an upgrade by HaltExit
+type HaltedError struct {
+	// Bin is the binary of the upgrade, launched the next time cosmovisor starts
+	Bin string
+}
+
+func (e *HaltedError) Error() string {
+	return fmt.Sprintf("halted after the upgrade as DAEMON_HALT_AFTER_UPGRADE=%s, start cosmovisor again to launch %s", HaltExit, e.Bin)
+}
@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package cosmovisor_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/cosmos-sdk/cosmovisor"
+)
+
+func TestHaltAfterUpgrade(t *testing.T) {
+	home := copyTestData(t, "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", RestartAfterUpgrade: true, HaltAfterUpgrade: cosmovisor.HaltExit}
+	var stdout, stderr bytes.Buffer
+	err := cosmovisor.Supervise(cfg, []string{"foo"}, &stdout, &stderr)
+	var halted *cosmovisor.HaltedError
+	require.True(t, errors.As(err, &halted), "%v", err)
+	require.Equal(t, cfg.UpgradeBin("chain2"), halted.Bin)
+	require.Equal(t, cosmovisor.ExitCodeHalted, cosmovisor.ExitCode(err))
+	require.Equal(t, "Genesis foo\nUPGRADE \"chain2\" NEEDED at height: 49: {}\n", stdout.String())
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.UpgradeBin("chain2"), bin)
+}
+
+func TestHaltAfterUpgradePaused(t *testing.T) {
+	home := copyTestData(t, "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", HaltAfterUpgrade: cosmovisor.HaltPause, AdminSocket: filepath.Join(t.TempDir(), "admin.sock")}
+	stop, err := cosmovisor.ServeAdmin(cfg)
+	require.NoError(t, err)
+	defer stop()
+	client := cosmovisor.NewAdminClient(cfg.AdminSocket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	supervised := make(chan error, 1)
+	var stdout, stderr bytes.Buffer
+	go func() { supervised <- cosmovisor.SuperviseContext(ctx, cfg, []string{"foo"}, &stdout, &stderr) }()
+	waitFor(t, "the pause after the upgrade", func() bool {
+		status, err := client.Status()
+		return err == nil && status.Paused
+	})
+	status, err := client.Status()
+	require.NoError(t, err)
+	require.Equal(t, "chain2", status.Upgrade)
+	require.NotNil(t, status.Pause)
+
+	// the new binary is only launched once resumed, even without DAEMON_RESTART_AFTER_UPGRADE
+	require.NoError(t, client.Resume())
+	select {
+	case err := <-supervised:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the new binary wasn't launched")
+	}
+	require.Contains(t, stdout.String(), "Chain 2 is live!")
+}
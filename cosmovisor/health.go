@@ -0,0 +1,106 @@
+package cosmovisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// health is whether this process supervises a running daemon, served on HealthAddr
+var health = &healthState{}
+
+// healthState tracks the daemon of this process and the error supervision stopped with
+type healthState struct {
+	mutex   sync.Mutex
+	running bool
+	// fatal is the error supervision ended with, the daemon won't be started again
+	fatal error
+	// degraded is why the running node serves stale data, e.g. it lags behind its peers
+	degraded string
+}
+
+// supervising forgets the error an earlier supervision stopped with
+func (h *healthState) supervising() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.fatal = nil
+}
+
+func (h *healthState) childStarted() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.running = true
+}
+
+func (h *healthState) childExited() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.running = false
+}
+
+// stopped records the error supervision ends with and returns it
+func (h *healthState) stopped(err error) error {
+	if err != nil {
+		h.mutex.Lock()
+		h.fatal = err
+		h.mutex.Unlock()
+	}
+	return err
+}
+
+// degrade marks the running node as degraded for reason, or as healthy again if it is
+// empty
+func (h *healthState) degrade(reason string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.degraded = reason
+}
+
+// check returns why the node shouldn't get traffic, nil if it is healthy
+func (h *healthState) check() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	switch {
+	case h.fatal != nil:
+		return fmt.Errorf("supervision stopped: %w", h.fatal)
+	case !h.running:
+		return fmt.Errorf("the daemon isn't running")
+	case h.degraded != "":
+		return fmt.Errorf("degraded: %s", h.degraded)
+	}
+	return nil
+}
+
+// HealthHandler answers 200 while the daemon runs and 503 otherwise, e.g. while it is
+// stopped for an upgrade, waits for a restart or after cosmovisor gave up on it
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := health.check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// StatusHandler serves the status of the home of cfg as JSON, as `cosmovisor status -o json`
+// prints it
+func StatusHandler(cfg *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		status, err := GetStatus(cfg)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(status)
+	})
+}
@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthHandler(t *testing.T) {
+	saved := health
+	health = &healthState{}
+	defer func() { health = saved }()
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return rec
+	}
+	rec := get()
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "the daemon isn't running\n", rec.Body.String())
+
+	health.childStarted()
+	rec = get()
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "ok\n", rec.Body.String())
+
+	// stopped for an upgrade
+	health.childExited()
+	require.Equal(t, http.StatusServiceUnavailable, get().Code)
+
+	health.childStarted()
+	require.NoError(t, health.stopped(nil))
+	require.Equal(t, http.StatusOK, get().Code)
+	err := health.stopped(errors.New("giving up after 3 restarts in a row"))
+	require.Error(t, err)
+	rec = get()
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "supervision stopped: giving up after 3 restarts in a row\n", rec.Body.String())
+
+	health.supervising()
+	require.Equal(t, http.StatusOK, get().Code)
+}
+
+func TestStatusHandler(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	cfg.recordUpgrade(&UpgradeInfo{Name: "chain2", Height: 49}, cfg.GenesisBin())
+
+	rec := httptest.NewRecorder()
+	StatusHandler(cfg).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var status Status
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	require.Equal(t, cfg.GenesisBin(), status.Binary)
+	require.Equal(t, "chain2", status.LastUpgrade.Name)
+	require.False(t, status.PlanPending)
+}
+
+func TestServeHTTPSharedAddress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", MetricsAddr: addr, HealthAddr: addr}
+	stop, err := ServeHTTP(cfg)
+	require.NoError(t, err)
+	defer stop()
+	for path, code := range map[string]int{"/metrics": http.StatusOK, "/status": http.StatusOK, "/healthz": http.StatusServiceUnavailable} {
+		resp, err := http.Get("http://" + addr + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, code, resp.StatusCode, path)
+	}
+}
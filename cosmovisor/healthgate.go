@@ -0,0 +1,191 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultHealthGateTimeout is how long after its launch the new binary may take to commit
+	// the blocks of the health gate
+	defaultHealthGateTimeout = 10 * time.Minute
+	// healthGatePoll is how often the health gate counts the blocks
+	healthGatePoll = time.Second
+
+	// EventUpgradeHealthy is sent once the new binary committed the blocks of the health gate
+	EventUpgradeHealthy = "upgrade_healthy"
+	// EventUpgradeUnhealthy is sent when the new binary didn't commit the blocks of the health
+	// gate in time, or logged a consensus failure
+	EventUpgradeUnhealthy = "upgrade_unhealthy"
+)
+
+// HealthGateFailure is what cosmovisor does with an upgrade whose binary failed the health gate
+type HealthGateFailure string
+
+const (
+	// HealthGateAlert records and reports the failure, the node is left running
+	HealthGateAlert HealthGateFailure = "alert"
+	// HealthGateHalt also stops the daemon, and cosmovisor exits
+	HealthGateHalt HealthGateFailure = "halt"
+	// HealthGateRollback also rolls the upgrade back as DAEMON_ROLLBACK says
+	HealthGateRollback HealthGateFailure = "rollback"
+)
+
+// UpgradeHealth is whether the binary of an upgrade made blocks after the switch
+type UpgradeHealth struct {
+	// Healthy is set if the binary committed the blocks of the health gate in time
+	Healthy bool `json:"healthy"`
+	// Blocks is how many blocks the binary committed, Height the last of them
+	Blocks int64 `json:"blocks"`
+	Height int64 `json:"height,omitempty"`
+	// Reason is why the binary failed the health gate
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// UnhealthyUpgradeError is the failure of an upgrade whose binary failed the health gate
+type UnhealthyUpgradeError struct {
+	Upgrade string
+	Reason  string
+}
+
+func (e *UnhealthyUpgradeError) Error() string {
+	return fmt.Sprintf("upgrade %q isn't healthy: %s", e.Upgrade, e.Reason)
+}
+
+// parseHealthGateFailure validates the value of DAEMON_HEALTH_GATE_ON_FAILURE
+func parseHealthGateFailure(s string) (HealthGateFailure, error) {
+	switch f := HealthGateFailure(strings.ToLower(strings.TrimSpace(s))); f {
+	case "":
+		return HealthGateAlert, nil
+	case HealthGateAlert, HealthGateHalt, HealthGateRollback:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown health gate failure %q, must be %s, %s or %s", s, HealthGateAlert, HealthGateHalt, HealthGateRollback)
+	}
+}
+
+func (cfg *Config) healthGateTimeout() time.Duration {
+	if cfg.HealthGateTimeout <= 0 {
+		return defaultHealthGateTimeout
+	}
+	return cfg.HealthGateTimeout
+}
+
+// healthGateOnFailure is what a failed health gate does, an alert by default
+func (cfg *Config) healthGateOnFailure() HealthGateFailure {
+	return HealthGateFailure(orDefault(string(cfg.HealthGateOnFailure), string(HealthGateAlert)))
+}
+
+// pendingHealthGate returns the upgrade switched to last if bin is its binary and the
+// health gate didn't decide about it yet, nil otherwise
+func (cfg *Config) pendingHealthGate(bin string) *AppliedUpgrade {
+	if cfg.HealthGateBlocks <= 0 {
+		return nil
+	}
+	applied, err := cfg.LastUpgrade()
+	if err != nil || applied == nil || applied.Health != nil || bin != cfg.UpgradeBin(applied.Name) {
+		return nil
+	}
+	return applied
+}
+
+// watchHealthGate counts the blocks the new binary commits from the height of the upgrade,
+// as seen in its output and, with LivenessRPC set, on the RPC, until there are
+// HealthGateBlocks of them or done is closed. The binary fails the gate if it logs a
+// consensus failure, or once HealthGateTimeout passed since its launch: a binary that exits
+// meanwhile gets a new timeout at its next launch.
+func (cfg *Config) watchHealthGate(control *launchControl, applied *AppliedUpgrade, blocks *blockWatch, done <-chan struct{}) {
+	timeout := cfg.healthGateTimeout()
+	deadline := NowUTC().Add(timeout)
+	var client *http.Client
+	if cfg.LivenessRPC != "" {
+		client = &http.Client{Timeout: nodeAPITimeout}
+	}
+	// the first block of the new binary is at the height of the upgrade, or the first one
+	// seen if the height is unknown
+	base := applied.Height - 1
+	ticker := time.NewTicker(healthGatePoll)
+	defer ticker.Stop()
+	for {
+		if client != nil {
+			if height, err := NodeHeight(client, cfg.LivenessRPC); err == nil {
+				blocks.committed(height, NowUTC())
+			}
+		}
+		height, _ := blocks.last()
+		if base < 0 && height > 0 {
+			base = height - 1
+		}
+		var committed int64
+		if height > base && base >= 0 {
+			committed = height - base
+		}
+		health := &UpgradeHealth{Blocks: committed, Height: height}
+		switch {
+		case committed >= int64(cfg.HealthGateBlocks):
+			health.Healthy = true
+		case blocks.consensusFailure() != "":
+			health.Reason = "the new binary logged a consensus failure: " + blocks.consensusFailure()
+		case NowUTC().After(deadline):
+			health.Reason = fmt.Sprintf("the new binary committed %d of %d blocks within %s of its launch", committed, cfg.HealthGateBlocks, timeout)
+		}
+		if health.Healthy || health.Reason != "" {
+			health.At = NowUTC()
+			cfg.recordHealth(applied, health)
+			if !health.Healthy {
+				cfg.upgradeUnhealthy(control, applied, health.Reason)
+			}
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordHealth records the outcome of the health gate with the applied upgrade and in the
+// history, and reports a passed gate
+func (cfg *Config) recordHealth(applied *AppliedUpgrade, health *UpgradeHealth) {
+	applied.Health = health
+	if err := cfg.updateLastUpgrade(applied.Name, func(a *AppliedUpgrade) { a.Health = health }); err != nil {
+		logger.Warnf("recording the health of upgrade %q: %v", applied.Name, err)
+	}
+	cfg.updateUpgradeHistory(applied.Name, func(e *HistoryEntry) { e.Health = health })
+	if !health.Healthy {
+		metrics.upgradeUnhealthy()
+		return
+	}
+	msg := fmt.Sprintf("upgrade %q is healthy, the new binary committed %d blocks up to height %d", applied.Name, health.Blocks, health.Height)
+	logger.Infof("%s", msg)
+	notify(cfg, Event{ID: fmt.Sprintf("%s/%s/%d", EventUpgradeHealthy, applied.Name, applied.AppliedAt.Unix()), Type: EventUpgradeHealthy,
+		Upgrade: applied.Name, Height: health.Height, Message: msg})
+}
+
+// upgradeUnhealthy reports the upgrade whose binary failed the health gate and, unless the
+// policy is an alert, stops the daemon still running for the halt or the rollback
+func (cfg *Config) upgradeUnhealthy(control *launchControl, applied *AppliedUpgrade, reason string) {
+	unhealthy := &UnhealthyUpgradeError{Upgrade: applied.Name, Reason: reason}
+	logger.Errorf("%v", unhealthy)
+	notify(cfg, Event{ID: fmt.Sprintf("%s/%s/%d", EventUpgradeUnhealthy, applied.Name, applied.AppliedAt.Unix()), Type: EventUpgradeUnhealthy,
+		Upgrade: applied.Name, Height: applied.Height, Message: unhealthy.Error(),
+		Fields: map[string]string{"reason": reason, "on_failure": string(cfg.healthGateOnFailure())}})
+	if cfg.healthGateOnFailure() == HealthGateAlert || control == nil {
+		return
+	}
+	if err := control.stopForRestart(unhealthy); err != nil {
+		logger.Warnf("not stopping the daemon of upgrade %q: %v", applied.Name, err)
+	}
+}
+
+// healthStatus describes the outcome of the health gate of an upgrade
+func healthStatus(h *UpgradeHealth) string {
+	if h.Healthy {
+		return fmt.Sprintf("healthy, %d blocks committed up to height %d", h.Blocks, h.Height)
+	}
+	return "UNHEALTHY: " + h.Reason
+}
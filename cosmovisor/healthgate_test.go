@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHealthGateFailure(t *testing.T) {
+	for in, want := range map[string]HealthGateFailure{"": HealthGateAlert, "alert": HealthGateAlert, "HALT": HealthGateHalt, " rollback ": HealthGateRollback} {
+		got, err := parseHealthGateFailure(in)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+	_, err := parseHealthGateFailure("restart")
+	require.EqualError(t, err, `unknown health gate failure "restart", must be alert, halt or rollback`)
+}
+
+func TestWatchHealthGate(t *testing.T) {
+	cases := map[string]struct {
+		height  int64
+		output  []string
+		verdict *UpgradeHealth
+	}{
+		"healthy": {
+			height:  100,
+			output:  []string{"INF committed state height=100 module=state", "INF committed state height=101 module=state", "INF committed state height=102 module=state"},
+			verdict: &UpgradeHealth{Healthy: true, Blocks: 3, Height: 102},
+		},
+		"unknown height": {
+			// counted from the first block seen
+			output:  []string{"INF committed state height=209 module=state"},
+			verdict: &UpgradeHealth{Blocks: 1, Height: 209, Reason: "the new binary committed 1 of 3 blocks"},
+		},
+		"too few blocks": {
+			height:  100,
+			output:  []string{"INF committed state height=100 module=state"},
+			verdict: &UpgradeHealth{Blocks: 1, Height: 100, Reason: "the new binary committed 1 of 3 blocks within 50ms of its launch"},
+		},
+		"consensus failure": {
+			height:  100,
+			output:  []string{`E[2022-01-02|15:04:05.000] CONSENSUS FAILURE!!! err="wrong Block.Header.AppHash" module=consensus`},
+			verdict: &UpgradeHealth{Reason: "the new binary logged a consensus failure: "},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Home: t.TempDir(), Name: "dummyd", HealthGateBlocks: 3, HealthGateTimeout: 50 * time.Millisecond}
+			applied := &AppliedUpgrade{Name: "v2", Height: tc.height, AppliedAt: NowUTC()}
+			require.NoError(t, cfg.writeStateFile(lastUpgradeFile, applied))
+			cfg.recordHistory(HistoryEntry{Kind: HistoryUpgrade, Name: "v2", Height: tc.height, At: applied.AppliedAt})
+			blocks := &blockWatch{cfg: cfg}
+			for _, line := range tc.output {
+				blocks.scan([]byte(line))
+			}
+			require.NotNil(t, cfg.pendingHealthGate(cfg.UpgradeBin("v2")))
+
+			done := make(chan struct{})
+			time.AfterFunc(2*time.Second, func() { close(done) })
+			cfg.watchHealthGate(nil, applied, blocks, done)
+			recorded, err := cfg.LastUpgrade()
+			require.NoError(t, err)
+			require.NotNil(t, recorded.Health)
+			require.Equal(t, tc.verdict.Healthy, recorded.Health.Healthy)
+			require.Equal(t, tc.verdict.Blocks, recorded.Health.Blocks)
+			require.Equal(t, tc.verdict.Height, recorded.Health.Height)
+			require.Contains(t, recorded.Health.Reason, tc.verdict.Reason)
+			history, err := cfg.UpgradeHistory()
+			require.NoError(t, err)
+			require.Equal(t, recorded.Health, history[0].Health)
+			// the gate decides once
+			require.Nil(t, cfg.pendingHealthGate(cfg.UpgradeBin("v2")))
+		})
+	}
+}
+
+func TestHealthGateFailure(t *testing.T) {
+	cases := map[string]struct {
+		onFailure HealthGateFailure
+		rollback  RollbackPolicy
+		current   func(cfg *Config) string
+	}{
+		"halt":     {onFailure: HealthGateHalt, current: func(cfg *Config) string { return cfg.UpgradeBin("chain2") }},
+		"rollback": {onFailure: HealthGateRollback, rollback: RollbackBinary, current: func(cfg *Config) string { return cfg.GenesisBin() }},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Home: validateHome(t), Name: "dummyd", RestartAfterUpgrade: true, RestartAfterFailure: true, Rollback: tc.rollback,
+				HealthGateBlocks: 5, HealthGateTimeout: time.Second, HealthGateOnFailure: tc.onFailure}
+			// the new binary commits the block of the upgrade and the next, then stalls
+			script := "#!/bin/sh\n[ \"$1\" = pre-upgrade ] && exit 0\necho 'INF committed state height=49 module=state'\necho 'INF committed state height=50 module=state'\nexec sleep 30\n"
+			require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("chain2"), []byte(script), 0755))
+
+			err := Supervise(cfg, nil, ioutil.Discard, ioutil.Discard)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), fmt.Sprintf(`upgrade "chain2" isn't healthy: the new binary committed 2 of 5 blocks within %s of its launch`, time.Second))
+			if tc.onFailure == HealthGateRollback {
+				var rolledBack *RolledBackError
+				require.True(t, errors.As(err, &rolledBack), "%v", err)
+			} else {
+				var unhealthy *UnhealthyUpgradeError
+				require.True(t, errors.As(err, &unhealthy), "%v", err)
+			}
+			bin, err := cfg.CurrentBin()
+			require.NoError(t, err)
+			require.Equal(t, tc.current(cfg), bin)
+			status, err := GetStatus(cfg)
+			require.NoError(t, err)
+			require.False(t, status.LastUpgrade.Health.Healthy)
+		})
+	}
+}
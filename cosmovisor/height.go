@@ -0,0 +1,372 @@
+package cosmovisor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dataDir                = "data"
+	upgradeInfoFile        = "upgrade-info.json"
+	blockstoreDB           = "blockstore.db"
+	privValidatorStateFile = "priv_validator_state.json"
+
+	// planAheadMargin is how far a plan may be above the local height before the state is
+	// assumed to be restored from a snapshot older than the plan file
+	planAheadMargin = 100000
+	// mtimeSlack allows for the coarse clock of file timestamps, and for filesystems storing
+	// them in seconds, when comparing them with the time the daemon was launched
+	mtimeSlack = 2 * time.Second
+)
+
+// LocalHeight is the last height the node committed, read from its data directory
+type LocalHeight struct {
+	Height int64
+	// Source is the file the height was read from
+	Source string
+}
+
+// DataDir is the data directory of the node, where the app writes its plan file
+func (cfg *Config) DataDir() string {
+	return filepath.Join(cfg.Home, dataDir)
+}
+
+// ProbeLocalHeight reads the latest committed height from the block store or, failing
+// that, the last height signed in priv_validator_state.json. It is best-effort and only
+// reads: the node may be running.
+func (cfg *Config) ProbeLocalHeight() (*LocalHeight, error) {
+	height, err := readBlockstoreHeight(cfg.DataDir())
+	if err == nil {
+		return &LocalHeight{Height: height, Source: filepath.Join(cfg.DataDir(), blockstoreDB)}, nil
+	}
+	bz, perr := readFileInDir(cfg.Home, filepath.Join(dataDir, privValidatorStateFile))
+	if perr != nil {
+		return nil, fmt.Errorf("block store: %v; %s: %w", err, privValidatorStateFile, perr)
+	}
+	height, perr = parseJSONHeight(bz, "height")
+	if perr != nil {
+		return nil, fmt.Errorf("block store: %v; %s: %w", err, privValidatorStateFile, perr)
+	}
+	return &LocalHeight{Height: height, Source: filepath.Join(cfg.DataDir(), privValidatorStateFile)}, nil
+}
+
+// parseJSONHeight reads the named field of a JSON object as a height, tendermint writes
+// int64s as strings
+func parseJSONHeight(bz []byte, field string) (int64, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(bz, &doc); err != nil {
+		return 0, err
+	}
+	raw, ok := doc[field]
+	if !ok {
+		return 0, fmt.Errorf("no %s", field)
+	}
+	height, err := strconv.ParseInt(strings.Trim(string(raw), `"`), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %s", field, raw)
+	}
+	return height, nil
+}
+
+// PlanFile reads the upgrade plan the app wrote to its data directory, nil if there is none
+func (cfg *Config) PlanFile() (*UpgradeInfo, error) {
+	bz, err := cfg.readPlanFile()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parsePlanFile(bz)
+}
+
+// ReadPlanFile reads a plan file at path, e.g. an upgrade-info.json copied from another node
+func ReadPlanFile(path string) (*UpgradeInfo, error) {
+	bz, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePlanFile(bz)
+}
+
+// planFileFields are the fields of the plan file: v0.44 writes the name and height, later
+// versions the whole plan. The signature is added by operators, see verifyPlanSignature.
+var planFileFields = map[string]bool{"name": true, "height": true, "info": true, "time": true, "upgraded_client_state": true, "signature": true}
+
+// maxPlanSnippet is how much of an invalid plan file is quoted in the error
+const maxPlanSnippet = 200
+
+// parsePlanFile parses the content of the plan file. A plan without a valid name and a
+// positive height, or with fields the SDK doesn't write, is refused, rather than switching
+// to an upgrade directory that can't exist.
+func parsePlanFile(bz []byte) (*UpgradeInfo, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(bz, &fields); err != nil {
+		return nil, planFileError(bz, "invalid JSON: %v", err)
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !planFileFields[key] {
+			return nil, planFileError(bz, "unknown field %q", key)
+		}
+	}
+
+	var info UpgradeInfo
+	raw, ok := fields["name"]
+	if !ok {
+		return nil, planFileError(bz, "name is required")
+	}
+	if err := json.Unmarshal(raw, &info.Name); err != nil {
+		return nil, planFileError(bz, "name must be a string, not %s", raw)
+	}
+	if err := ValidateUpgradeName(info.Name); err != nil {
+		return nil, planFileError(bz, "%v", err)
+	}
+	if _, ok := fields["height"]; !ok {
+		return nil, planFileError(bz, "height is required")
+	}
+	height, err := parseJSONHeight(bz, "height")
+	if err != nil {
+		return nil, planFileError(bz, "%v", err)
+	}
+	if height <= 0 {
+		return nil, planFileError(bz, "height must be positive, not %d", height)
+	}
+	info.Height = height
+	if raw, ok := fields["info"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &info.Info); err != nil {
+			return nil, planFileError(bz, "info must be a string, not %s", raw)
+		}
+	}
+	return &info, nil
+}
+
+// planFileError describes a problem of the plan file, quoting its content
+func planFileError(bz []byte, format string, args ...interface{}) error {
+	snippet := strings.Join(strings.Fields(string(bz)), " ")
+	if len(snippet) > maxPlanSnippet {
+		snippet = snippet[:maxPlanSnippet] + "..."
+	}
+	return fmt.Errorf("%s: %s in %q", upgradeInfoFile, fmt.Sprintf(format, args...), snippet)
+}
+
+// PlanAction is what happens at startup with the plan file
+type PlanAction string
+
+const (
+	// PlanActionNone: there is no plan, or it was applied already
+	PlanActionNone PlanAction = "none"
+	// PlanActionPending: the plan is ahead, the old binary starts and halts at its height
+	PlanActionPending PlanAction = "pending"
+	// PlanActionAhead: the plan is far ahead, the state was restored from an older snapshot.
+	// The old binary starts normally.
+	PlanActionAhead PlanAction = "ahead"
+	// PlanActionSkip: the plan is one DAEMON_SKIP_UPGRADES skips, the daemon starts with
+	// its height in --unsafe-skip-upgrades
+	PlanActionSkip PlanAction = "skip"
+	// PlanActionApply: the node halted at the plan height or is past it, or the plan isn't
+	// applied and the height is unknown. The upgrade is applied before the daemon starts.
+	PlanActionApply PlanAction = "apply"
+)
+
+// PlanCheck is the startup decision about the plan file, cross-checked with the node's
+// own height
+type PlanCheck struct {
+	// Plan is the plan file, nil if there is none
+	Plan *UpgradeInfo
+	// Local is the height of the node, nil if it couldn't be read
+	Local *LocalHeight
+	// HeightErr is why Local couldn't be read
+	HeightErr error
+	Action    PlanAction
+	// Conflicts contradict the applied upgrades, e.g. after restoring an old snapshot
+	// under a newer binary. They need the operator in strict mode.
+	Conflicts []string
+}
+
+// CheckPlanHeight decides what to do with the plan file at startup. Only reading, it is
+// also used to explain the decision.
+func (cfg *Config) CheckPlanHeight() (*PlanCheck, error) {
+	plan, err := cfg.PlanFile()
+	if err != nil {
+		return nil, err
+	}
+	check := &PlanCheck{Plan: plan, Action: PlanActionNone}
+	applied := plan != nil && cfg.planApplied(plan)
+	local, err := cfg.ProbeLocalHeight()
+	if err != nil {
+		check.HeightErr = err
+		// the app writes the plan file when it halts for the upgrade, so a plan that isn't
+		// applied was missed, e.g. because the host rebooted at the upgrade height
+		switch {
+		case plan != nil && cfg.skipsUpgrade(plan):
+			check.Action = PlanActionSkip
+		case plan != nil && !applied:
+			check.Action = PlanActionApply
+		}
+		return check, nil
+	}
+	check.Local = local
+
+	if plan != nil {
+		// the app halts at the plan height with the block before it committed
+		switch {
+		case applied && plan.Height > local.Height+1:
+			check.Conflicts = append(check.Conflicts, fmt.Sprintf(
+				"upgrade %q at height %d is applied, but the node is at height %d (%s): was an older snapshot restored?",
+				plan.Name, plan.Height, local.Height, local.Source))
+		case applied:
+		case cfg.skipsUpgrade(plan):
+			check.Action = PlanActionSkip
+		case plan.Height <= local.Height+1:
+			check.Action = PlanActionApply
+		case plan.Height > local.Height+planAheadMargin:
+			check.Action = PlanActionAhead
+		default:
+			check.Action = PlanActionPending
+		}
+	}
+
+	// queued plans moved to applied must not be ahead of the node either
+	entries, _ := ioutil.ReadDir(cfg.appliedQueueDir())
+	for _, e := range entries {
+		bz, err := ioutil.ReadFile(filepath.Join(cfg.appliedQueueDir(), e.Name()))
+		if err != nil {
+			continue
+		}
+		var applied QueuedPlan
+		if json.Unmarshal(bz, &applied) != nil || applied.Height <= local.Height+1 {
+			continue
+		}
+		check.Conflicts = append(check.Conflicts, fmt.Sprintf(
+			"queued upgrade %q at height %d was applied (%s), but the node is at height %d (%s)",
+			applied.Name, applied.Height, e.Name(), local.Height, local.Source))
+	}
+	return check, nil
+}
+
+// planApplied tells whether the upgrade of the plan was applied: it is the current one, or
+// the history last records switching to it, e.g. before plans queued after it were applied
+// in the same downtime, or it was consumed from the queue
+func (cfg *Config) planApplied(plan *UpgradeInfo) bool {
+	if bin, _ := cfg.resolveCurrentBin(); bin == cfg.UpgradeBin(plan.Name) {
+		return true
+	}
+	same := func(name string, height int64) bool {
+		return name == plan.Name && (height == 0 || plan.Height <= 0 || height == plan.Height)
+	}
+	history, _ := cfg.UpgradeHistory()
+	for i := len(history) - 1; i >= 0; i-- {
+		if e := history[i]; same(e.Name, e.Height) && (e.Kind == HistoryUpgrade || e.Kind == HistoryRollback) {
+			return e.Kind == HistoryUpgrade
+		}
+	}
+	entries, _ := ioutil.ReadDir(cfg.appliedQueueDir())
+	for _, e := range entries {
+		var queued QueuedPlan
+		bz, err := ioutil.ReadFile(filepath.Join(cfg.appliedQueueDir(), e.Name()))
+		if err == nil && json.Unmarshal(bz, &queued) == nil && same(queued.Name, queued.Height) {
+			return true
+		}
+	}
+	return false
+}
+
+// stalePlan returns why a plan written to the plan file while the daemon runs can't be the
+// daemon halting for it, "" if it can. Such a plan was applied already, or came with a
+// restored snapshot. The plan height is compared with the node's height, which is the
+// plan height or the one before it when the app halts. If that can't be read, a file last
+// modified before the daemon was launched is taken to be a leftover.
+func (cfg *Config) stalePlan(plan *UpgradeInfo, modified, launched time.Time) string {
+	if bin, _ := cfg.resolveCurrentBin(); bin == cfg.UpgradeBin(plan.Name) {
+		return "it is the current upgrade"
+	}
+	if last, _ := cfg.LastUpgrade(); last != nil && last.Name == plan.Name {
+		return fmt.Sprintf("it was applied at %s", last.AppliedAt.Format(time.RFC3339))
+	}
+	if cfg.planApplied(plan) {
+		return "it was applied before the current upgrade"
+	}
+	local, err := cfg.ProbeLocalHeight()
+	if err != nil {
+		if !modified.IsZero() && modified.Before(launched.Add(-mtimeSlack)) {
+			return fmt.Sprintf("it was last modified at %s, before the daemon started", modified.UTC().Format(time.RFC3339))
+		}
+		return ""
+	}
+	switch {
+	case plan.Height <= 0:
+	case local.Height > plan.Height:
+		return fmt.Sprintf("the node is at height %d (%s), past the plan height %d", local.Height, local.Source, plan.Height)
+	case plan.Height > local.Height+1:
+		return fmt.Sprintf("the node is at height %d (%s), below the plan height %d", local.Height, local.Source, plan.Height)
+	}
+	return ""
+}
+
+// StartupPlanCheck cross-checks the plan file with the node's height before the daemon
+// starts. A plan at or below the height is applied right away. Conflicts with the applied
+// upgrades are logged, in strict mode they stop cosmovisor until the operator fixes them.
+// An upgrade cosmovisor was stopped in is resumed first.
+func StartupPlanCheck(cfg *Config) error {
+	if err := cfg.resumeUpgrade(); err != nil {
+		return err
+	}
+	check, err := cfg.CheckPlanHeight()
+	if err != nil {
+		return fmt.Errorf("checking %s: %w", upgradeInfoFile, err)
+	}
+	for _, conflict := range check.Conflicts {
+		logger.Warnf("%s", conflict)
+	}
+	if len(check.Conflicts) > 0 && cfg.StrictHeightCheck {
+		return fmt.Errorf("the node's height contradicts the applied upgrades, fix the layout or the data directory "+
+			"(or unset DAEMON_STRICT_HEIGHT_CHECK) before starting: %s", strings.Join(check.Conflicts, "; "))
+	}
+
+	plan := check.Plan
+	switch check.Action {
+	case PlanActionSkip:
+		logger.Warnf("skipping upgrade %q at height %d as DAEMON_SKIP_UPGRADES asks, the daemon starts with %s",
+			plan.Name, plan.Height, skipUpgradesFlag)
+	case PlanActionAhead:
+		logger.Infof("upgrade %q at height %d is far ahead of the node at height %d (%s), starting the current binary",
+			plan.Name, plan.Height, check.Local.Height, check.Local.Source)
+	case PlanActionApply:
+		if err := cfg.checkPlanSignature(plan); err != nil {
+			return err
+		}
+		if check.Local == nil {
+			logger.Warnf("upgrade %q at height %d isn't applied and the node's height can't be read (%v), "+
+				"the node halted for it while cosmovisor wasn't watching: upgrading before starting", plan.Name, plan.Height, check.HeightErr)
+		} else {
+			logger.Infof("node at height %d (%s) reached upgrade %q at height %d, upgrading before starting",
+				check.Local.Height, check.Local.Source, plan.Name, plan.Height)
+		}
+		timings := NewUpgradeTimings(plan.Name)
+		err := doUpgrade(cfg, plan, timings)
+		timings.EndAfterRestart(err)
+		var self *SelfUpgradedError
+		if err = cfg.upgradeCosmovisor(err); errors.As(err, &self) {
+			return err
+		}
+		notifyUpgrade(cfg, plan.Name, err)
+		if err != nil {
+			return fmt.Errorf("upgrading to %q before starting: %w", plan.Name, err)
+		}
+		return cfg.applyQueue(plan)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+)
+
+// heightHome is a copy of the validate fixture with the data directory of a height scenario:
+// old-snapshot is at height 100, new-snapshot at height 5000, both with a plan at height 500
+func heightHome(t *testing.T, scenario string) *Config {
+	home := validateHome(t)
+	if scenario != "" {
+		require.NoError(t, copy.Copy(filepath.Join("testdata", "height", scenario), home))
+	}
+	return &Config{Home: home, Name: "dummyd"}
+}
+
+func TestProbeLocalHeight(t *testing.T) {
+	cfg := heightHome(t, "new-snapshot")
+	local, err := cfg.ProbeLocalHeight()
+	require.NoError(t, err)
+	require.Equal(t, int64(5000), local.Height)
+
+	// without the block store, the validator state is the fallback
+	require.NoError(t, os.RemoveAll(filepath.Join(cfg.DataDir(), blockstoreDB)))
+	local, err = cfg.ProbeLocalHeight()
+	require.NoError(t, err)
+	require.Equal(t, int64(5000), local.Height)
+	require.Equal(t, filepath.Join(cfg.DataDir(), privValidatorStateFile), local.Source)
+
+	require.NoError(t, os.Remove(filepath.Join(cfg.DataDir(), privValidatorStateFile)))
+	_, err = cfg.ProbeLocalHeight()
+	require.Error(t, err)
+}
+
+func TestCheckPlanHeight(t *testing.T) {
+	cases := map[string]struct {
+		scenario  string
+		plan      string
+		current   string
+		action    PlanAction
+		conflicts int
+	}{
+		"no plan file": {
+			action: PlanActionNone,
+		},
+		"no height": {
+			plan:   `{"name": "chain2", "height": 500}`,
+			action: PlanActionApply,
+		},
+		"no height, plan applied": {
+			plan:    `{"name": "chain2", "height": 500}`,
+			current: "chain2",
+			action:  PlanActionNone,
+		},
+		"halted at the plan height": {
+			scenario: "old-snapshot",
+			plan:     `{"name": "chain2", "height": 101}`,
+			action:   PlanActionApply,
+		},
+		"plan a block ahead": {
+			scenario: "old-snapshot",
+			plan:     `{"name": "chain2", "height": 102}`,
+			action:   PlanActionPending,
+		},
+		"plan ahead": {
+			scenario: "old-snapshot",
+			action:   PlanActionPending,
+		},
+		"plan far ahead": {
+			scenario: "old-snapshot",
+			plan:     `{"name": "chain2", "height": 200000}`,
+			action:   PlanActionAhead,
+		},
+		"plan reached": {
+			scenario: "new-snapshot",
+			action:   PlanActionApply,
+		},
+		"plan applied": {
+			scenario: "new-snapshot",
+			current:  "chain2",
+			action:   PlanActionNone,
+		},
+		"old snapshot under the applied upgrade": {
+			scenario:  "old-snapshot",
+			current:   "chain2",
+			action:    PlanActionNone,
+			conflicts: 1,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := heightHome(t, tc.scenario)
+			if tc.plan != "" {
+				require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+				require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), upgradeInfoFile), []byte(tc.plan), 0644))
+			}
+			if tc.current != "" {
+				require.NoError(t, cfg.SetCurrentUpgrade(tc.current))
+			}
+			check, err := cfg.CheckPlanHeight()
+			require.NoError(t, err)
+			require.Equal(t, tc.action, check.Action)
+			require.Len(t, check.Conflicts, tc.conflicts)
+		})
+	}
+}
+
+func TestCheckPlanHeightAppliedQueue(t *testing.T) {
+	cfg := heightHome(t, "old-snapshot")
+	require.NoError(t, os.MkdirAll(cfg.appliedQueueDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.appliedQueueDir(), "1-chain3.json"), []byte(`{"name": "chain3", "height": 800}`), 0644))
+
+	check, err := cfg.CheckPlanHeight()
+	require.NoError(t, err)
+	require.Equal(t, PlanActionPending, check.Action)
+	require.Len(t, check.Conflicts, 1)
+	require.Contains(t, check.Conflicts[0], `queued upgrade "chain3" at height 800`)
+}
+
+func TestStartupPlanCheckAfterQueue(t *testing.T) {
+	// the node halted for chain2, and chain3 is queued to follow it in the same downtime
+	cfg := heightHome(t, "new-snapshot")
+	require.NoError(t, os.MkdirAll(cfg.QueueDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.QueueDir(), "1-chain2.json"), []byte(`{"name": "chain2", "height": 500}`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.QueueDir(), "2-chain3.json"), []byte(`{"name": "chain3", "height": 500}`), 0644))
+	require.NoError(t, StartupPlanCheck(cfg))
+	require.Equal(t, cfg.UpgradeBin("chain3"), mustCurrentBin(t, cfg))
+
+	// the plan file still names chain2, which was applied before chain3: nothing is switched
+	// back on the next start
+	check, err := cfg.CheckPlanHeight()
+	require.NoError(t, err)
+	require.Equal(t, PlanActionNone, check.Action)
+	require.NoError(t, StartupPlanCheck(cfg))
+	require.Equal(t, cfg.UpgradeBin("chain3"), mustCurrentBin(t, cfg))
+}
+
+func TestParsePlanFile(t *testing.T) {
+	cases := map[string]struct {
+		content string
+		expect  UpgradeInfo
+		isErr   string
+	}{
+		"name and height": {content: `{"name": "chain2", "height": 49}`, expect: UpgradeInfo{Name: "chain2", Height: 49}},
+		"full plan": {
+			content: `{"name": "chain2", "height": "49", "info": "{}", "time": "0001-01-01T00:00:00Z", "upgraded_client_state": null}`,
+			expect:  UpgradeInfo{Name: "chain2", Height: 49, Info: "{}"},
+		},
+		"not json":       {content: `{"name": "chain2",`, isErr: `invalid JSON`},
+		"no name":        {content: `{"height": 49}`, isErr: `name is required in "{\"height\": 49}"`},
+		"empty name":     {content: `{"name": " ", "height": 49}`, isErr: "upgrade name is empty"},
+		"dot name":       {content: `{"name": "..", "height": 49}`, isErr: `invalid upgrade name ".."`},
+		"number name":    {content: `{"name": 2, "height": 49}`, isErr: "name must be a string, not 2"},
+		"no height":      {content: `{"name": "chain2"}`, isErr: "height is required"},
+		"zero height":    {content: `{"name": "chain2", "height": 0}`, isErr: "height must be positive, not 0"},
+		"invalid height": {content: `{"name": "chain2", "height": "soon"}`, isErr: `invalid height "soon"`},
+		"unknown field":  {content: `{"name": "chain2", "height": 49, "hieght": 50}`, isErr: `unknown field "hieght"`},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			plan, err := parsePlanFile([]byte(tc.content))
+			if tc.isErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.isErr)
+				require.Contains(t, err.Error(), upgradeInfoFile)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, *plan)
+		})
+	}
+
+	// long files are cut in the error
+	_, err := parsePlanFile([]byte(`{"name": "chain2", "info": "` + strings.Repeat("x", 1000) + `"}`))
+	require.Error(t, err)
+	require.Less(t, len(err.Error()), 2*maxPlanSnippet)
+}
+
+func TestStalePlan(t *testing.T) {
+	launched := time.Now()
+	cases := map[string]struct {
+		scenario string
+		plan     UpgradeInfo
+		current  string
+		last     string
+		modified time.Time
+		stale    string
+	}{
+		"halting":           {scenario: "new-snapshot", plan: UpgradeInfo{Name: "chain3", Height: 5001}},
+		"halted":            {scenario: "new-snapshot", plan: UpgradeInfo{Name: "chain3", Height: 5000}},
+		"current":           {scenario: "new-snapshot", plan: UpgradeInfo{Name: "chain2", Height: 5001}, current: "chain2", stale: "current upgrade"},
+		"applied before":    {scenario: "new-snapshot", plan: UpgradeInfo{Name: "chain2", Height: 5001}, last: "chain2", stale: "it was applied at"},
+		"passed":            {scenario: "new-snapshot", plan: UpgradeInfo{Name: "chain3", Height: 500}, stale: "past the plan height 500"},
+		"not reached":       {scenario: "old-snapshot", plan: UpgradeInfo{Name: "chain3", Height: 500}, stale: "below the plan height 500"},
+		"no height":         {scenario: "new-snapshot", plan: UpgradeInfo{Name: "chain3"}},
+		"written now":       {plan: UpgradeInfo{Name: "chain3", Height: 500}, modified: launched.Add(time.Second)},
+		"written at launch": {plan: UpgradeInfo{Name: "chain3", Height: 500}, modified: launched.Add(-10 * time.Millisecond)},
+		"written earlier":   {plan: UpgradeInfo{Name: "chain3", Height: 500}, modified: launched.Add(-time.Hour), stale: "before the daemon started"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := heightHome(t, tc.scenario)
+			if tc.current != "" {
+				require.NoError(t, cfg.SetCurrentUpgrade(tc.current))
+			}
+			if tc.last != "" {
+				cfg.recordUpgrade(&UpgradeInfo{Name: tc.last}, cfg.GenesisBin())
+			}
+			stale := cfg.stalePlan(&tc.plan, tc.modified, launched)
+			if tc.stale == "" {
+				require.Empty(t, stale)
+			} else {
+				require.Contains(t, stale, tc.stale)
+			}
+		})
+	}
+}
+
+func TestStartupPlanCheck(t *testing.T) {
+	// a snapshot newer than the plan: the upgrade is applied before the daemon starts
+	cfg := heightHome(t, "new-snapshot")
+	require.NoError(t, StartupPlanCheck(cfg))
+	require.Equal(t, cfg.UpgradeBin("chain2"), mustCurrentBin(t, cfg))
+	require.NoError(t, StartupPlanCheck(cfg))
+
+	// an older snapshot under the applied upgrade is only logged, unless strict
+	cfg = heightHome(t, "old-snapshot")
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	require.NoError(t, StartupPlanCheck(cfg))
+	cfg.StrictHeightCheck = true
+	err := StartupPlanCheck(cfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "was an older snapshot restored?")
+	require.Equal(t, cfg.UpgradeBin("chain2"), mustCurrentBin(t, cfg))
+
+	// the host rebooted at the upgrade height: the plan isn't applied, the height unknown
+	cfg = heightHome(t, "")
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), upgradeInfoFile), []byte(`{"name": "chain2", "height": 500}`), 0644))
+	require.NoError(t, StartupPlanCheck(cfg))
+	require.Equal(t, cfg.UpgradeBin("chain2"), mustCurrentBin(t, cfg))
+
+	// a broken plan file stops cosmovisor
+	cfg = heightHome(t, "old-snapshot")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), upgradeInfoFile), []byte(`{"height": 500}`), 0644))
+	require.Error(t, StartupPlanCheck(cfg))
+}
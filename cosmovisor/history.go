@@ -0,0 +1,134 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// historyFile lists every change of the binary cosmovisor made, in the state directory
+const historyFile = "upgrades.json"
+
+// Kinds of history entries
+const (
+	HistoryUpgrade  = "upgrade"
+	HistoryHotfix   = "hotfix"
+	HistoryRollback = "rollback"
+)
+
+// HistoryEntry is a change of the binary cosmovisor made: an upgrade switched to, a hotfix
+// applied or an upgrade rolled back
+type HistoryEntry struct {
+	Kind string `json:"kind"`
+	// Name is the upgrade, empty for a hotfix of the genesis binary
+	Name   string    `json:"name,omitempty"`
+	Height int64     `json:"height,omitempty"`
+	At     time.Time `json:"at"`
+	// Binary is the binary that runs from then on, SHA256 its hash
+	Binary string `json:"binary"`
+	SHA256 string `json:"sha256,omitempty"`
+	// From is the binary that ran before, for a hotfix where it was preserved, FromSHA256
+	// its hash
+	From       string `json:"from,omitempty"`
+	FromSHA256 string `json:"from_sha256,omitempty"`
+	// Backup is the data backup taken before an upgrade, or restored by a rollback
+	Backup       string `json:"backup,omitempty"`
+	Export       string `json:"export,omitempty"`
+	ExportSHA256 string `json:"export_sha256,omitempty"`
+	// Downtime is the timeline of an upgrade, recorded once its binary committed a block
+	Downtime *UpgradeDowntime `json:"downtime,omitempty"`
+	// Verification is whether the chain applied an upgrade, with DAEMON_VERIFY_UPGRADE
+	Verification *UpgradeVerification `json:"verification,omitempty"`
+	// Health is whether the binary of an upgrade passed the health gate, with
+	// DAEMON_HEALTH_GATE_BLOCKS
+	Health *UpgradeHealth `json:"health,omitempty"`
+	// BackupStats is how the data backup before an upgrade went
+	BackupStats *BackupStats `json:"backup_stats,omitempty"`
+}
+
+// UpgradeHistory returns the upgrades, hotfixes and rollbacks cosmovisor applied to the
+// node, oldest first
+func (cfg *Config) UpgradeHistory() ([]HistoryEntry, error) {
+	history := []HistoryEntry{}
+	if _, err := cfg.readStateFile(historyFile, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// recordHistory appends the entry to the history. The change was made either way, so a
+// failure is only logged.
+func (cfg *Config) recordHistory(entry HistoryEntry) {
+	history, err := cfg.UpgradeHistory()
+	if err == nil {
+		err = cfg.writeStateFile(historyFile, append(history, entry))
+	}
+	if err != nil {
+		logger.Warnf("recording %s %q in the history: %v", entry.Kind, entry.Name, err)
+	}
+}
+
+// recordUpgradeHistory records the upgrade that was just switched to, with what the
+// phases before the switch produced
+func (cfg *Config) recordUpgradeHistory(plan *UpgradePlan, timings *UpgradeTimings) {
+	cfg.recordHistory(HistoryEntry{
+		Kind:         HistoryUpgrade,
+		Name:         plan.Info.Name,
+		Height:       plan.Info.Height,
+		At:           NowUTC(),
+		Binary:       plan.NewBin,
+		SHA256:       timings.attribute("switch", "binary_sha256"),
+		Backup:       timings.attribute("data-backup", "path"),
+		BackupStats:  backupStatsOf(timings.phase("data-backup")),
+		Export:       timings.attribute("export", "path"),
+		ExportSHA256: timings.attribute("export", "sha256"),
+	})
+}
+
+// updateUpgradeHistory changes the last entry of the named upgrade in the history, if
+// there is one. A failure is only logged.
+func (cfg *Config) updateUpgradeHistory(name string, update func(*HistoryEntry)) {
+	history, err := cfg.UpgradeHistory()
+	for i := len(history) - 1; err == nil && i >= 0; i-- {
+		if history[i].Kind == HistoryUpgrade && history[i].Name == name {
+			update(&history[i])
+			err = cfg.writeStateFile(historyFile, history)
+			break
+		}
+	}
+	if err != nil {
+		logger.Warnf("recording upgrade %q in the history: %v", name, err)
+	}
+}
+
+// WriteHistory prints the history as aligned columns, the newest last
+func WriteHistory(w io.Writer, history []HistoryEntry) error {
+	if len(history) == 0 {
+		_, err := fmt.Fprintln(w, "no upgrades applied yet")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "TIME\tKIND\tNAME\tHEIGHT\tDOWNTIME\tHEALTH\tSHA256\tBACKUP\n")
+	for _, e := range history {
+		height := "-"
+		if e.Height > 0 {
+			height = strconv.FormatInt(e.Height, 10)
+		}
+		downtime := "-"
+		if e.Downtime != nil {
+			downtime = e.Downtime.Downtime().Round(time.Second).String()
+		}
+		health := "-"
+		if e.Health != nil {
+			health = "unhealthy"
+			if e.Health.Healthy {
+				health = "healthy"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.At.Format(time.RFC3339), e.Kind, orDefault(e.Name, "genesis"),
+			height, downtime, health, orDefault(e.SHA256, "-"), orDefault(e.Backup, "-"))
+	}
+	return tw.Flush()
+}
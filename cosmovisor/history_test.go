@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgradeHistory(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", DataBackup: DataBackupArchive, DataBackupName: "{{.Name}}"}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	history, err := cfg.UpgradeHistory()
+	require.NoError(t, err)
+	require.Empty(t, history)
+
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49}))
+	cfg.DataBackup = DataBackupNone
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain3"}))
+	history, err = cfg.UpgradeHistory()
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	hash, err := sha256File(cfg.UpgradeBin("chain2"))
+	require.NoError(t, err)
+	require.NotNil(t, history[0].BackupStats)
+	require.Equal(t, DataBackupArchive, history[0].BackupStats.Mode)
+	require.Equal(t, HistoryEntry{Kind: HistoryUpgrade, Name: "chain2", Height: 49, At: history[0].At, Binary: cfg.UpgradeBin("chain2"),
+		SHA256: hash, Backup: filepath.Join(cfg.StateDir(), "backups", "chain2.tar.zst"), BackupStats: history[0].BackupStats}, history[0])
+	require.Equal(t, "chain3", history[1].Name)
+	require.Empty(t, history[1].Backup)
+	require.Nil(t, history[1].BackupStats)
+	require.False(t, history[1].At.Before(history[0].At))
+}
+
+func TestWriteHistory(t *testing.T) {
+	at := time.Date(2022, 1, 2, 15, 4, 5, 0, time.UTC)
+	var buf bytes.Buffer
+	require.NoError(t, WriteHistory(&buf, nil))
+	require.Equal(t, "no upgrades applied yet\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, WriteHistory(&buf, []HistoryEntry{
+		{Kind: HistoryUpgrade, Name: "v2", Height: 1200, At: at, SHA256: "abcd", Backup: "/mnt/backups/v2.tar.zst",
+			Downtime: &UpgradeDowntime{StoppedAt: at, FirstBlockAt: at.Add(93*time.Second + 400*time.Millisecond)}, Health: &UpgradeHealth{Healthy: true, Blocks: 10}},
+		{Kind: HistoryHotfix, At: at.Add(time.Hour), SHA256: "ef01"},
+		{Kind: HistoryRollback, Name: "v2", Height: 1200, At: at.Add(2 * time.Hour)},
+	}))
+	require.Equal(t, `TIME                  KIND      NAME     HEIGHT  DOWNTIME  HEALTH   SHA256  BACKUP
+2022-01-02T15:04:05Z  upgrade   v2       1200    1m33s     healthy  abcd    /mnt/backups/v2.tar.zst
+2022-01-02T16:04:05Z  hotfix    genesis  -       -         -        ef01    -
+2022-01-02T17:04:05Z  rollback  v2       1200    -         -        -       -
+`, buf.String())
+}
@@ -0,0 +1,51 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// homeFlag is the flag of the Cosmos SDK commands naming the node's home
+const homeFlag = "--home"
+
+// argsHome returns the home args give the daemon with --home, empty if they don't
+func argsHome(args []string) string {
+	for i, arg := range args {
+		switch {
+		case arg == "--":
+			return ""
+		case arg == homeFlag && i+1 < len(args):
+			return args[i+1]
+		case strings.HasPrefix(arg, homeFlag+"="):
+			return strings.TrimPrefix(arg, homeFlag+"=")
+		}
+	}
+	return ""
+}
+
+// withHome returns args with --home DAEMON_HOME appended if InjectHome is set and args
+// don't name the home already. Args naming another home are refused then, the daemon
+// would run against a node whose binaries and backups cosmovisor doesn't manage.
+func (cfg *Config) withHome(args []string) ([]string, error) {
+	if !cfg.InjectHome {
+		return args, nil
+	}
+	home := argsHome(args)
+	if home == "" {
+		// flags go before --, the arguments after it are passed on as they are
+		end := len(args)
+		for i, arg := range args {
+			if arg == "--" {
+				end = i
+				break
+			}
+		}
+		withHome := append(append([]string(nil), args[:end]...), homeFlag, cfg.Home)
+		return append(withHome, args[end:]...), nil
+	}
+	if abs, err := filepath.Abs(home); err != nil || abs != filepath.Clean(cfg.Home) {
+		return nil, fmt.Errorf("the daemon arguments set %s %s, but DAEMON_HOME is %s", homeFlag, home, cfg.Home)
+	}
+	return args, nil
+}
@@ -0,0 +1,40 @@
+package cosmovisor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithHome(t *testing.T) {
+	cfg := &Config{Home: "/var/lib/gaia"}
+	args, err := cfg.withHome([]string{"start"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"start"}, args)
+
+	cfg.InjectHome = true
+	cases := map[string]struct {
+		args []string
+		want []string
+		err  string
+	}{
+		"appended":      {args: []string{"start", "--x-crisis-skip-assert-invariants"}, want: []string{"start", "--x-crisis-skip-assert-invariants", "--home", "/var/lib/gaia"}},
+		"same home":     {args: []string{"start", "--home", "/var/lib/gaia/"}, want: []string{"start", "--home", "/var/lib/gaia/"}},
+		"same home =":   {args: []string{"start", "--home=/var/lib/gaia"}, want: []string{"start", "--home=/var/lib/gaia"}},
+		"after --":      {args: []string{"start", "--", "--home", "/tmp"}, want: []string{"start", "--home", "/var/lib/gaia", "--", "--home", "/tmp"}},
+		"other home":    {args: []string{"start", "--home", "/root/.gaia"}, err: "the daemon arguments set --home /root/.gaia, but DAEMON_HOME is /var/lib/gaia"},
+		"other home =":  {args: []string{"--home=/root/.gaia", "start"}, err: "the daemon arguments set --home /root/.gaia, but DAEMON_HOME is /var/lib/gaia"},
+		"relative home": {args: []string{"start", "--home", "gaia"}, err: "the daemon arguments set --home gaia, but DAEMON_HOME is /var/lib/gaia"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			args, err := cfg.withHome(tc.args)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, args)
+		})
+	}
+}
@@ -0,0 +1,468 @@
+package cosmovisor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	// homeRequestTimeout bounds each request to the cosmovisor of a home
+	homeRequestTimeout = 5 * time.Second
+	// homeSocketName is the socket the cosmovisor of a home serves its status on
+	homeSocketName = "status.sock"
+	// maxSocketPath is the longest path of a unix socket on all platforms, sun_path of macOS
+	maxSocketPath = 103
+)
+
+// SupervisedHome is one node supervised by RunHomes
+type SupervisedHome struct {
+	// Home and Name are the DAEMON_HOME and DAEMON_NAME of the node
+	Home string `toml:"home"`
+	Name string `toml:"name"`
+	// Args are the arguments of the daemon, start if empty
+	Args []string `toml:"args"`
+	// Env are extra KEY=value variables of its cosmovisor, e.g. DAEMON_DATA_BACKUP=archive
+	Env []string `toml:"env"`
+}
+
+// HomesConfig lists the nodes RunHomes supervises and where their status is served
+type HomesConfig struct {
+	// MetricsAddr serves the metrics of all nodes, each sample labeled with its daemon and
+	// home, off if empty
+	MetricsAddr string `toml:"metrics_addr"`
+	// HealthAddr serves /healthz, healthy while all nodes are, and /status of all nodes,
+	// off if empty
+	HealthAddr string           `toml:"health_addr"`
+	Homes      []SupervisedHome `toml:"home"`
+}
+
+// homeOwnedEnv are the variables RunHomes sets for the cosmovisor of each home
+var homeOwnedEnv = []string{"DAEMON_HOME", "DAEMON_NAME", "DAEMON_METRICS_ADDR", "DAEMON_HEALTH_ADDR", InitEnv}
+
+// LoadHomesConfig reads the nodes to supervise from the TOML file at path
+func LoadHomesConfig(path string) (*HomesConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var hc HomesConfig
+	if err := toml.NewDecoder(f).Strict(true).Decode(&hc); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	if err := hc.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return &hc, nil
+}
+
+// Validate returns an error if the homes can't be supervised together
+func (hc *HomesConfig) Validate() error {
+	if len(hc.Homes) == 0 {
+		return errors.New("no home to supervise, add a [[home]] table")
+	}
+	for _, addr := range []string{hc.MetricsAddr, hc.HealthAddr} {
+		if addr == "" {
+			continue
+		}
+		if err := validHTTPAddr(addr); err != nil {
+			return fmt.Errorf("invalid address %q: %w", addr, err)
+		}
+	}
+	seen := map[string]bool{}
+	for i, h := range hc.Homes {
+		switch {
+		case h.Home == "" || h.Name == "":
+			return fmt.Errorf("home %d needs both home and name", i+1)
+		case !filepath.IsAbs(h.Home):
+			return fmt.Errorf("home %d: %s is not an absolute path", i+1, h.Home)
+		}
+		// the home lock would stop the second one, but only once it started
+		root := filepath.Clean(h.Home)
+		if seen[root] {
+			return fmt.Errorf("home %s is listed twice", h.Home)
+		}
+		seen[root] = true
+		for _, kv := range h.Env {
+			key := strings.SplitN(kv, "=", 2)[0]
+			if !strings.Contains(kv, "=") {
+				return fmt.Errorf("home %s: env %q must be KEY=value", h.Home, kv)
+			}
+			for _, owned := range homeOwnedEnv {
+				if key == owned {
+					return fmt.Errorf("home %s: %s can't be set in env, it is set for each home", h.Home, key)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// homeProcess is the cosmovisor supervising one home for RunHomes
+type homeProcess struct {
+	SupervisedHome
+	// addr is the unix socket its metrics, health and status are served on
+	addr   string
+	client *http.Client
+	base   string
+
+	cmd            *exec.Cmd
+	stdout, stderr *lineWriter
+	err            error
+}
+
+// socketDir creates the directory of the socket the cosmovisor of the home serves its
+// metrics, health and status on, in the directory of the temporary files of the home as
+// DAEMON_STATE_DIR and DAEMON_TMP_DIR in the environment place it
+func (p *homeProcess) socketDir() (string, error) {
+	cfg := &Config{Home: p.Home, Name: p.Name}
+	for _, kv := range p.env() {
+		kv := strings.SplitN(kv, "=", 2)
+		switch kv[0] {
+		case "DAEMON_STATE_DIR":
+			cfg.StatePath = kv[1]
+		case "DAEMON_TMP_DIR":
+			cfg.TmpDir = kv[1]
+		case "DAEMON_WRITABLE_ROOT":
+			cfg.WritableRoot = kv[1]
+		}
+	}
+	cfg.DetectImmutableLayout()
+	dir, err := cfg.fs().scratchDir("", "run-homes-")
+	if err != nil {
+		return "", err
+	}
+	// bind fails on a path longer than sun_path, tell why up front
+	if path := filepath.Join(dir, homeSocketName); len(path) > maxSocketPath {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("socket path %s is longer than %d bytes, set DAEMON_TMP_DIR to a shorter directory", path, maxSocketPath)
+	}
+	return dir, nil
+}
+
+// env is the environment of the cosmovisor of the home: the one of this process without
+// the variables of another home, the env of the home, and its own variables
+func (p *homeProcess) env() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		owned := false
+		for _, key := range append(homeOwnedEnv, "DAEMON_ADMIN_SOCKET") {
+			owned = owned || strings.HasPrefix(kv, key+"=")
+		}
+		if !owned {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, p.Env...)
+	// a process is an init for all of them already, if any
+	return append(env, "DAEMON_HOME="+p.Home, "DAEMON_NAME="+p.Name,
+		"DAEMON_METRICS_ADDR="+p.addr, "DAEMON_HEALTH_ADDR="+p.addr, InitEnv+"="+string(InitOff))
+}
+
+// RunHomes supervises several nodes at once, e.g. a provider chain and its consumer chain:
+// it runs `exe run` for each home, so every node has its own watcher, restart loop and
+// backups, relays the signals it receives to all of them, and writes their output with
+// their DAEMON_NAME in front of every line. The metrics, the health and the status of
+// all nodes are served on the addresses of hc. It returns once all of them exited, with
+// the first error. When ctx is done, all are stopped.
+func RunHomes(ctx context.Context, exe string, hc *HomesConfig, stdout, stderr io.Writer) error {
+	if err := hc.Validate(); err != nil {
+		return err
+	}
+	// the lines of the nodes are never spliced together
+	outs := &combinedOutput{w: stdout}
+	errs := outs
+	if !SameWriter(stdout, stderr) {
+		errs = &combinedOutput{w: stderr}
+	}
+	sigs := make(chan os.Signal, len(hc.Homes))
+	signal.Notify(sigs, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT}, append(forwardedSignals, reloadTriggers...)...)...)
+	defer signal.Stop(sigs)
+
+	procs := make([]*homeProcess, len(hc.Homes))
+	for i, h := range hc.Homes {
+		p := &homeProcess{SupervisedHome: h, stdout: &lineWriter{out: outs}, stderr: &lineWriter{out: errs}}
+		sockets, err := p.socketDir()
+		if err != nil {
+			return fmt.Errorf("home %s: %w", h.Home, err)
+		}
+		defer os.RemoveAll(sockets)
+		p.addr = unixAddrPrefix + filepath.Join(sockets, homeSocketName)
+		p.client, p.base = httpClient(p.addr, homeRequestTimeout)
+		args := h.Args
+		if len(args) == 0 {
+			args = []string{"start"}
+		}
+		p.cmd = exec.Command(exe, append([]string{"run"}, args...)...)
+		p.cmd.Env = p.env()
+		p.cmd.Stdout, p.cmd.Stderr = labelOutput(p.stdout, h.Name), labelOutput(p.stderr, h.Name)
+		p.cmd.SysProcAttr = daemonProcAttr()
+		procs[i] = p
+	}
+	if hc.MetricsAddr != "" || hc.HealthAddr != "" {
+		stop, err := serveHomes(hc, procs)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	exited := make(chan *homeProcess, len(procs))
+	for i, p := range procs {
+		p := p
+		if err := p.cmd.Start(); err != nil {
+			for _, started := range procs[:i] {
+				_ = started.cmd.Process.Kill()
+				<-exited
+			}
+			return fmt.Errorf("starting cosmovisor for %s: %w", p.Home, err)
+		}
+		logger.Infof("supervising %s in %s (pid %d)", p.Name, p.Home, p.cmd.Process.Pid)
+		goGuarded(nil, func() {
+			p.err = p.cmd.Wait()
+			_ = p.stdout.Flush()
+			_ = p.stderr.Flush()
+			exited <- p
+		})
+	}
+
+	running := map[*homeProcess]bool{}
+	for _, p := range procs {
+		running[p] = true
+	}
+	relay := func(sig os.Signal) {
+		for p := range running {
+			if err := signalProcess(p.cmd.Process, sig); err != nil {
+				logger.Warnf("forwarding %s to the cosmovisor of %s: %v", sig, p.Home, err)
+			}
+		}
+	}
+	done := ctx.Done()
+	var first error
+	for len(running) > 0 {
+		select {
+		case sig := <-sigs:
+			relay(sig)
+		case <-done:
+			relay(syscall.SIGTERM)
+			done = nil
+		case p := <-exited:
+			delete(running, p)
+			if p.err == nil {
+				logger.Infof("the cosmovisor of %s exited", p.Home)
+				continue
+			}
+			if ExitCode(homeExitError(p.err)) == ExitCodeUpgraded {
+				logger.Infof("the cosmovisor of %s exited after an upgrade", p.Home)
+				continue
+			}
+			err := fmt.Errorf("cosmovisor of %s: %w", p.Home, homeExitError(p.err))
+			logger.Errorf("%v, %d of %d homes still supervised", err, len(running), len(procs))
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// homeExitError is the error of the cosmovisor of a home that exited with err, with its
+// exit code for ExitCode
+func homeExitError(err error) error {
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		return err
+	}
+	code := exit.ExitCode()
+	if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		code = 128 + int(status.Signal())
+	}
+	return &InitExitError{Code: code}
+}
+
+// get requests path from the cosmovisor of the home
+func (p *homeProcess) get(path string) (int, []byte, error) {
+	resp, err := p.client.Get(p.base + path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+// serveHomes serves the metrics, the health and the status of the homes on the addresses
+// of hc, until stop is called
+func serveHomes(hc *HomesConfig, procs []*homeProcess) (stop func(), err error) {
+	muxes := map[string]*http.ServeMux{}
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+	if hc.MetricsAddr != "" {
+		mux(hc.MetricsAddr).Handle("/metrics", homesMetricsHandler(procs))
+	}
+	if hc.HealthAddr != "" {
+		mux(hc.HealthAddr).Handle("/healthz", homesHealthHandler(procs))
+		mux(hc.HealthAddr).Handle("/status", homesStatusHandler(procs))
+	}
+	return serveMuxes(nil, muxes)
+}
+
+// homesMetricsHandler serves the metrics of all homes, those of a cosmovisor that doesn't
+// answer are left out
+func homesMetricsHandler(procs []*homeProcess) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var expositions, labels []string
+		for _, p := range procs {
+			code, body, err := p.get("/metrics")
+			if err != nil || code != http.StatusOK {
+				continue
+			}
+			expositions = append(expositions, string(body))
+			labels = append(labels, fmt.Sprintf("daemon=%q,home=%q", p.Name, p.Home))
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = mergeMetrics(w, expositions, labels)
+	})
+}
+
+// homesHealthHandler answers 200 while the daemons of all homes run, 503 listing the
+// unhealthy ones otherwise
+func homesHealthHandler(procs []*homeProcess) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var problems []string
+		for _, p := range procs {
+			code, body, err := p.get("/healthz")
+			switch {
+			case err != nil:
+				problems = append(problems, fmt.Sprintf("%s: cosmovisor isn't answering: %v", p.Home, err))
+			case code != http.StatusOK:
+				problems = append(problems, fmt.Sprintf("%s: %s", p.Home, strings.TrimSpace(string(body))))
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if len(problems) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// HomeStatus is the status of one home supervised by RunHomes
+type HomeStatus struct {
+	Home string `json:"home"`
+	Name string `json:"name"`
+	// Status is the status its cosmovisor serves, as `cosmovisor status -o json` prints it
+	Status json.RawMessage `json:"status,omitempty"`
+	// Error is why the status couldn't be read
+	Error string `json:"error,omitempty"`
+}
+
+// homesStatusHandler serves the status of all homes as JSON
+func homesStatusHandler(procs []*homeProcess) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		statuses := make([]HomeStatus, len(procs))
+		for i, p := range procs {
+			statuses[i] = HomeStatus{Home: p.Home, Name: p.Name}
+			code, body, err := p.get("/status")
+			switch {
+			case err != nil:
+				statuses[i].Error = err.Error()
+			case code != http.StatusOK || !json.Valid(body):
+				statuses[i].Error = fmt.Sprintf("status %d: %s", code, strings.TrimSpace(string(body)))
+			default:
+				statuses[i].Status = body
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(map[string][]HomeStatus{"homes": statuses})
+	})
+}
+
+// mergeMetrics writes the metrics of several processes as one exposition in the Prometheus
+// text format. The samples of expositions[i] get the labels[i], like daemon="gaiad", and
+// the samples of a metric are written together under its HELP and TYPE.
+func mergeMetrics(w io.Writer, expositions, labels []string) error {
+	type family struct {
+		header  []string
+		samples []string
+	}
+	var order []string
+	families := map[string]*family{}
+	get := func(name string) *family {
+		f := families[name]
+		if f == nil {
+			f = &family{}
+			families[name] = f
+			order = append(order, name)
+		}
+		return f
+	}
+	for i, text := range expositions {
+		for _, line := range strings.Split(text, "\n") {
+			if line == "" {
+				continue
+			}
+			if strings.HasPrefix(line, "#") {
+				fields := strings.Fields(line)
+				if len(fields) < 3 {
+					continue
+				}
+				f := get(fields[2])
+				known := false
+				for _, h := range f.header {
+					known = known || h == line
+				}
+				if !known {
+					f.header = append(f.header, line)
+				}
+				continue
+			}
+			end := strings.IndexAny(line, "{ ")
+			if end < 0 {
+				continue
+			}
+			name, rest := line[:end], line[end:]
+			if strings.HasPrefix(rest, "{") {
+				rest = "{" + labels[i] + "," + rest[1:]
+			} else {
+				rest = "{" + labels[i] + "}" + rest
+			}
+			f := get(name)
+			f.samples = append(f.samples, name+rest)
+		}
+	}
+	var buf strings.Builder
+	for _, name := range order {
+		f := families[name]
+		for _, line := range append(f.header, f.samples...) {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
@@ -0,0 +1,193 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadHomesConfig(t *testing.T) {
+	dir := t.TempDir()
+	load := func(content string) (*HomesConfig, error) {
+		path := filepath.Join(dir, "homes.toml")
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0o644))
+		hc, err := LoadHomesConfig(path)
+		if err != nil {
+			return nil, errors.New(strings.TrimPrefix(err.Error(), "invalid "+path+": "))
+		}
+		return hc, nil
+	}
+
+	hc, err := load(`metrics_addr = "localhost:26660"
+health_addr = "unix:/run/cosmovisor.sock"
+
+[[home]]
+home = "/var/lib/provider"
+name = "providerd"
+
+[[home]]
+home = "/var/lib/consumer"
+name = "consumerd"
+args = ["start", "--x-crisis-skip-assert-invariants"]
+env = ["DAEMON_DATA_BACKUP=archive"]
+`)
+	require.NoError(t, err)
+	require.Equal(t, &HomesConfig{MetricsAddr: "localhost:26660", HealthAddr: "unix:/run/cosmovisor.sock", Homes: []SupervisedHome{
+		{Home: "/var/lib/provider", Name: "providerd"},
+		{Home: "/var/lib/consumer", Name: "consumerd", Args: []string{"start", "--x-crisis-skip-assert-invariants"}, Env: []string{"DAEMON_DATA_BACKUP=archive"}},
+	}}, hc)
+
+	cases := map[string]struct {
+		content string
+		err     string
+	}{
+		"no home":      {``, "no home to supervise, add a [[home]] table"},
+		"relative":     {"[[home]]\nhome = \"node\"\nname = \"gaiad\"\n", "home 1: node is not an absolute path"},
+		"no name":      {"[[home]]\nhome = \"/node\"\n", "home 1 needs both home and name"},
+		"twice":        {"[[home]]\nhome = \"/node\"\nname = \"gaiad\"\n[[home]]\nhome = \"/node/\"\nname = \"gaiad\"\n", "home /node/ is listed twice"},
+		"owned env":    {"[[home]]\nhome = \"/node\"\nname = \"gaiad\"\nenv = [\"DAEMON_HOME=/other\"]\n", "home /node: DAEMON_HOME can't be set in env, it is set for each home"},
+		"invalid env":  {"[[home]]\nhome = \"/node\"\nname = \"gaiad\"\nenv = [\"PORT\"]\n", `home /node: env "PORT" must be KEY=value`},
+		"invalid addr": {"metrics_addr = \"unix:run.sock\"\n[[home]]\nhome = \"/node\"\nname = \"gaiad\"\n", `invalid address "unix:run.sock": the path of a unix socket must be absolute`},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := load(tc.content)
+			require.EqualError(t, err, tc.err)
+		})
+	}
+
+	_, err = load("[[home]]\nhome = \"/node\"\nname = \"gaiad\"\nhoem = \"/other\"\n")
+	require.Error(t, err)
+}
+
+func TestMergeMetrics(t *testing.T) {
+	provider := `# HELP cosmovisor_restarts_total Restarts of the daemon.
+# TYPE cosmovisor_restarts_total counter
+cosmovisor_restarts_total 2
+# HELP cosmovisor_upgrade_info The last upgrade.
+# TYPE cosmovisor_upgrade_info gauge
+cosmovisor_upgrade_info{name="v2"} 1
+`
+	consumer := `# HELP cosmovisor_restarts_total Restarts of the daemon.
+# TYPE cosmovisor_restarts_total counter
+cosmovisor_restarts_total 0
+`
+	var out bytes.Buffer
+	require.NoError(t, mergeMetrics(&out, []string{provider, consumer}, []string{`daemon="providerd"`, `daemon="consumerd"`}))
+	require.Equal(t, `# HELP cosmovisor_restarts_total Restarts of the daemon.
+# TYPE cosmovisor_restarts_total counter
+cosmovisor_restarts_total{daemon="providerd"} 2
+cosmovisor_restarts_total{daemon="consumerd"} 0
+# HELP cosmovisor_upgrade_info The last upgrade.
+# TYPE cosmovisor_upgrade_info gauge
+cosmovisor_upgrade_info{daemon="providerd",name="v2"} 1
+`, out.String())
+}
+
+func TestHomesHandlers(t *testing.T) {
+	dir := t.TempDir()
+	// stands in for the cosmovisor of a home, serving on its socket
+	serve := func(i int, healthy bool) *homeProcess {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "# TYPE cosmovisor_daemon_up gauge\ncosmovisor_daemon_up %d\n", map[bool]int{true: 1}[healthy])
+		})
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			if !healthy {
+				http.Error(w, "daemon is not running", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})
+		mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"running":%t}`, healthy)
+		})
+		addr := unixAddrPrefix + filepath.Join(dir, fmt.Sprintf("%d.sock", i))
+		l, err := listenHTTP(fsGuard{}, addr)
+		require.NoError(t, err)
+		t.Cleanup(serveHTTP(nil, l, mux))
+		p := &homeProcess{SupervisedHome: SupervisedHome{Home: fmt.Sprintf("/node%d", i), Name: fmt.Sprintf("node%dd", i)}, addr: addr}
+		p.client, p.base = httpClient(addr, homeRequestTimeout)
+		return p
+	}
+	procs := []*homeProcess{serve(1, true), serve(2, false)}
+	get := func(h http.Handler) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec
+	}
+
+	rec := get(homesMetricsHandler(procs))
+	require.Equal(t, `# TYPE cosmovisor_daemon_up gauge
+cosmovisor_daemon_up{daemon="node1d",home="/node1"} 1
+cosmovisor_daemon_up{daemon="node2d",home="/node2"} 0
+`, rec.Body.String())
+
+	rec = get(homesHealthHandler(procs))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "/node2: daemon is not running\n", rec.Body.String())
+	require.Equal(t, http.StatusOK, get(homesHealthHandler(procs[:1])).Code)
+
+	gone := &homeProcess{SupervisedHome: SupervisedHome{Home: "/gone", Name: "goned"}}
+	gone.client, gone.base = httpClient(unixAddrPrefix+filepath.Join(dir, "gone.sock"), homeRequestTimeout)
+	rec = get(homesStatusHandler(append(procs, gone)))
+	require.Contains(t, rec.Body.String(), `"home": "/node1",
+      "name": "node1d",
+      "status": {
+        "running": true
+      }`)
+	require.Contains(t, rec.Body.String(), `"status": {
+        "running": false
+      }`)
+	require.Contains(t, rec.Body.String(), `"home": "/gone",
+      "name": "goned",
+      "error": `)
+}
+
+func TestRunHomes(t *testing.T) {
+	dir := t.TempDir()
+	// stands in for cosmovisor, the second home fails
+	exe := filepath.Join(dir, "cosmovisor")
+	require.NoError(t, ioutil.WriteFile(exe, []byte(`#!/bin/sh
+echo "$*" in $DAEMON_HOME, $DAEMON_INIT, $EXTRA
+printf partial
+[ "$DAEMON_NAME" = consumerd ] && exit 3
+exit 0
+`), 0o755))
+	os.Setenv("DAEMON_HOME", "/elsewhere")
+	defer os.Unsetenv("DAEMON_HOME")
+	provider, consumer := filepath.Join(dir, "provider"), filepath.Join(dir, "consumer")
+	hc := &HomesConfig{Homes: []SupervisedHome{
+		{Home: provider, Name: "providerd", Env: []string{"EXTRA=yes"}},
+		{Home: consumer, Name: "consumerd", Args: []string{"start", "--trace"}},
+	}}
+	var out bytes.Buffer
+	err := RunHomes(context.Background(), exe, hc, &out, &out)
+	require.EqualError(t, err, "cosmovisor of "+consumer+": supervisor exited with code 3")
+	require.Equal(t, 3, ExitCode(err))
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.ElementsMatch(t, []string{
+		"providerd | run start in " + provider + ", false, yes",
+		"providerd | partial",
+		"consumerd | run start --trace in " + consumer + ", false,",
+		"consumerd | partial",
+	}, lines)
+
+	// the sockets of the homes were kept in their temporary directories, and are gone
+	for _, home := range []string{provider, consumer} {
+		entries, err := ioutil.ReadDir(filepath.Join(home, "cosmovisor", tmpDirName))
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	}
+}
@@ -0,0 +1,122 @@
+package cosmovisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPostUpgradeHookTimeout bounds each post-upgrade hook, the new binary waits for them
+const defaultPostUpgradeHookTimeout = 5 * time.Minute
+
+// postUpgradeHooks lists the hooks at path: the file itself, or the executables in the
+// directory in name order. Hidden files and subdirectories are ignored, the other files
+// that aren't executable are returned as skipped.
+func postUpgradeHooks(path string) (hooks, skipped []string, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !info.IsDir() {
+		if info.Mode()&0111 == 0 {
+			return nil, nil, fmt.Errorf("%s is not executable", path)
+		}
+		return []string{path}, nil, nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		name := filepath.Join(path, e.Name())
+		switch {
+		case strings.HasPrefix(e.Name(), "."), e.IsDir():
+		case e.Mode().IsRegular() && e.Mode()&0111 == 0:
+			skipped = append(skipped, name)
+		default:
+			hooks = append(hooks, name)
+		}
+	}
+	return hooks, skipped, nil
+}
+
+// postUpgradeHookTimeout is the configured hook timeout or the default
+func (cfg *Config) postUpgradeHookTimeout() time.Duration {
+	if cfg.PostUpgradeHookTimeout <= 0 {
+		return defaultPostUpgradeHookTimeout
+	}
+	return cfg.PostUpgradeHookTimeout
+}
+
+// upgradeEnv describes the upgrade to the commands run along with it: the backup command
+// and the hooks
+func (cfg *Config) upgradeEnv(plan *UpgradePlan) []string {
+	return append(environ(),
+		"DAEMON_HOME="+cfg.Home,
+		"DAEMON_NAME="+daemonNameOf(plan.NewBin),
+		"COSMOVISOR_DATA_DIR="+cfg.DataDir(),
+		"COSMOVISOR_UPGRADE_NAME="+plan.Info.Name,
+		"COSMOVISOR_UPGRADE_HEIGHT="+strconv.FormatInt(plan.Info.Height, 10),
+		"COSMOVISOR_UPGRADE_DIR="+cfg.UpgradeDir(plan.Info.Name),
+		"COSMOVISOR_OLD_BIN="+plan.OldBin,
+		"COSMOVISOR_NEW_BIN="+plan.NewBin,
+	)
+}
+
+// runPostUpgradeHooks runs the post-upgrade hooks once the current link points to the new
+// binary, before it is started. The switch is done: a hook that fails or times out is
+// logged and the next one runs.
+func (cfg *Config) runPostUpgradeHooks(plan *UpgradePlan, timings *UpgradeTimings) {
+	if cfg.PostUpgradeHook == "" {
+		return
+	}
+	phase := timings.Phase("post-upgrade")
+	hooks, skipped, err := postUpgradeHooks(cfg.PostUpgradeHook)
+	if err != nil {
+		err = fmt.Errorf("post-upgrade hook: %w", err)
+		logger.Warnf("not running %v", err)
+		phase.End(err)
+		return
+	}
+	for _, hook := range skipped {
+		logger.Warnf("skipping post-upgrade hook %s: not executable", hook)
+	}
+	env := cfg.upgradeEnv(plan)
+	var failed []string
+	for _, hook := range hooks {
+		if err := runHook(HookPostUpgrade, hook, env, cfg.postUpgradeHookTimeout()); err != nil {
+			logger.Errorf("post-upgrade hook %s failed: %v", hook, err)
+			failed = append(failed, filepath.Base(hook))
+		}
+	}
+	phase.Set("hooks", strconv.Itoa(len(hooks)))
+	if len(failed) > 0 {
+		phase.End(fmt.Errorf("post-upgrade hooks failed: %s", strings.Join(failed, ", ")))
+		return
+	}
+	phase.End(nil)
+}
+
+// runHook runs one hook of the hook point with env, logging its output
+func runHook(point, hook string, env []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	logger.Infof("running %s hook %s", point, hook)
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if output := strings.TrimSpace(string(out)); output != "" {
+		logger.Infof("%s: %s", hook, output)
+	}
+	if ctx.Err() != nil {
+		return errors.New("didn't finish within " + timeout.String())
+	}
+	return err
+}
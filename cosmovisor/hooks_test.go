@@ -0,0 +1,66 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunPostUpgradeHooks(t *testing.T) {
+	home := t.TempDir()
+	hooks := filepath.Join(home, "hooks.d")
+	out := filepath.Join(home, "ran")
+	require.NoError(t, os.MkdirAll(hooks, 0755))
+	write := func(name, script string, mode os.FileMode) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(hooks, name), []byte("#!/bin/sh\n"+script+"\n"), mode))
+	}
+	write("10-env", `echo "10 $COSMOVISOR_UPGRADE_NAME $COSMOVISOR_UPGRADE_HEIGHT $COSMOVISOR_NEW_BIN" >> `+out, 0755)
+	write("20-fails", "echo 20 >> "+out+"; exit 1", 0755)
+	write("30-hangs", "echo 30 >> "+out+"; exec sleep 10", 0755)
+	write("40-last", "echo 40 >> "+out, 0755)
+	write("README", "echo readme >> "+out, 0644)
+	write(".hidden", "echo hidden >> "+out, 0755)
+
+	cfg := &Config{Home: home, Name: "dummyd", PostUpgradeHook: hooks, PostUpgradeHookTimeout: 200 * time.Millisecond}
+	plan := &UpgradePlan{Info: &UpgradeInfo{Name: "chain2", Height: 49}, NewBin: cfg.UpgradeBin("chain2")}
+	timings := NewUpgradeTimings("chain2")
+	cfg.runPostUpgradeHooks(plan, timings)
+
+	// a failed or hanging hook doesn't stop the others
+	ran, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "10 chain2 49 "+cfg.UpgradeBin("chain2")+"\n20\n30\n40\n", string(ran))
+
+	// a single script
+	require.NoError(t, os.Remove(out))
+	cfg.PostUpgradeHook = filepath.Join(hooks, "40-last")
+	cfg.runPostUpgradeHooks(plan, timings)
+	ran, err = ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "40\n", string(ran))
+}
+
+func TestPostUpgradeHooks(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b"), nil, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a"), nil, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "notes"), nil, 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "old"), 0755))
+
+	hooks, skipped, err := postUpgradeHooks(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}, hooks)
+	require.Equal(t, []string{filepath.Join(dir, "notes")}, skipped)
+
+	_, _, err = postUpgradeHooks(filepath.Join(dir, "notes"))
+	require.EqualError(t, err, filepath.Join(dir, "notes")+" is not executable")
+	_, _, err = postUpgradeHooks(filepath.Join(dir, "missing"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,191 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	// hooksDir is the directory in the cosmovisor directory holding a directory of scripts
+	// per hook point
+	hooksDir = "hooks"
+	// hooksKey is the table of the config file with the policies of the hook points
+	hooksKey = "hooks"
+	// defaultHookTimeout bounds each hook of the hooks directory
+	defaultHookTimeout = 5 * time.Minute
+)
+
+// The hook points, each run the scripts of its directory in the hooks directory
+const (
+	// HookPreUpgrade runs before anything of an upgrade touches the node, after the preflight
+	HookPreUpgrade = "pre-upgrade"
+	// HookPreBackup runs before the node is backed up, for an upgrade or on schedule
+	HookPreBackup = "pre-backup"
+	// HookPostUpgrade runs once the current link points to the new binary
+	HookPostUpgrade = "post-upgrade"
+	// HookPostStart runs once the daemon started, alongside it
+	HookPostStart = "post-start"
+	// HookOnCrash runs when the daemon died on its own, before it is restarted
+	HookOnCrash = "on-crash"
+)
+
+// hookPoints are the hook points in the order they run around an upgrade
+var hookPoints = []string{HookPreUpgrade, HookPreBackup, HookPostUpgrade, HookPostStart, HookOnCrash}
+
+// HookFailure is what a failed hook does to the hooks after it and to the step it runs for
+type HookFailure string
+
+const (
+	// HookContinue logs the failed hook and runs the next one
+	HookContinue HookFailure = "continue"
+	// HookAbort skips the hooks after the failed one and fails the step, if the step can
+	// fail: the upgrade for pre-upgrade, the backup for pre-backup
+	HookAbort HookFailure = "abort"
+)
+
+// HookPolicy tunes the hooks of one hook point, set in the hooks table of the config file
+type HookPolicy struct {
+	// Timeout bounds each hook, five minutes if zero
+	Timeout time.Duration
+	// OnFailure is abort for pre-upgrade and pre-backup and continue for the others if empty
+	OnFailure HookFailure
+}
+
+// HookError is the failure of a hook with the abort policy
+type HookError struct {
+	Point string
+	Hook  string
+	Err   error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s hook %s failed: %v", e.Point, e.Hook, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// HooksDir is the directory holding the directory of scripts of each hook point, e.g.
+// hooks/pre-upgrade.d
+func (cfg *Config) HooksDir() string {
+	return filepath.Join(cfg.Root(), hooksDir)
+}
+
+// hookDir is the directory of the scripts of the hook point
+func (cfg *Config) hookDir(point string) string {
+	return filepath.Join(cfg.HooksDir(), point+".d")
+}
+
+// hookPolicy is the policy of the hook point, with the defaults filled in
+func (cfg *Config) hookPolicy(point string) HookPolicy {
+	policy := cfg.Hooks[point]
+	if policy.Timeout <= 0 {
+		policy.Timeout = defaultHookTimeout
+	}
+	if policy.OnFailure == "" {
+		policy.OnFailure = HookContinue
+		if point == HookPreUpgrade || point == HookPreBackup {
+			policy.OnFailure = HookAbort
+		}
+	}
+	return policy
+}
+
+// readHookPolicies reads the hooks table of the config file, a table per hook point
+func readHookPolicies(tree *toml.Tree) (map[string]HookPolicy, error) {
+	table, ok := tree.Get(hooksKey).(*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a table, declared with [%s.<hook point>]", hooksKey, hooksKey)
+	}
+	known := map[string]bool{}
+	for _, point := range hookPoints {
+		known[point] = true
+	}
+	policies := map[string]HookPolicy{}
+	for _, point := range table.Keys() {
+		if !known[point] {
+			return nil, fmt.Errorf("unknown hook point %q, must be one of %v", point, hookPoints)
+		}
+		settings, ok := table.Get(point).(*toml.Tree)
+		if !ok {
+			return nil, fmt.Errorf("%s.%s must be a table", hooksKey, point)
+		}
+		var policy HookPolicy
+		for _, key := range settings.Keys() {
+			value := settings.Get(key)
+			switch key {
+			case "timeout":
+				d, err := parseGraceDuration(fmt.Sprint(value))
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s.%s.timeout: %w", hooksKey, point, err)
+				}
+				policy.Timeout = d
+			case "on_failure":
+				switch failure := HookFailure(fmt.Sprint(value)); failure {
+				case HookContinue, HookAbort:
+					policy.OnFailure = failure
+				default:
+					return nil, fmt.Errorf("invalid %s.%s.on_failure %q, must be %s or %s", hooksKey, point, value, HookContinue, HookAbort)
+				}
+			default:
+				return nil, fmt.Errorf("unknown setting %q of %s.%s", key, hooksKey, point)
+			}
+		}
+		policies[point] = policy
+	}
+	return policies, nil
+}
+
+// daemonHookEnv describes the daemon run by bin to the hooks run along with it
+func (cfg *Config) daemonHookEnv(bin string) []string {
+	return append(environ(),
+		"DAEMON_HOME="+cfg.Home,
+		"DAEMON_NAME="+daemonNameOf(bin),
+		"COSMOVISOR_DATA_DIR="+cfg.DataDir(),
+		"COSMOVISOR_BIN="+bin,
+		"COSMOVISOR_UPGRADE_NAME="+cfg.upgradeOf(bin),
+	)
+}
+
+// runHooks runs the executables in the directory of the hook point in name order, with env
+// and the hook point in COSMOVISOR_HOOK. A missing directory has no hooks. A hook that
+// fails or times out is logged; with the abort policy the hooks after it are skipped and
+// a HookError is returned.
+func (cfg *Config) runHooks(point string, env []string) error {
+	dir := cfg.hookDir(point)
+	hooks, skipped, err := postUpgradeHooks(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	policy := cfg.hookPolicy(point)
+	if err != nil {
+		logger.Warnf("not running the %s hooks: %v", point, err)
+		if policy.OnFailure == HookAbort {
+			return &HookError{Point: point, Hook: dir, Err: err}
+		}
+		return nil
+	}
+	for _, hook := range skipped {
+		logger.Warnf("skipping %s hook %s: not executable", point, hook)
+	}
+	env = append(env, "COSMOVISOR_HOOK="+point)
+	for i, hook := range hooks {
+		err := runHook(point, hook, env, policy.Timeout)
+		if err == nil {
+			continue
+		}
+		logger.Errorf("%s hook %s failed: %v", point, hook, err)
+		if policy.OnFailure == HookAbort {
+			if rest := len(hooks) - i - 1; rest > 0 {
+				logger.Warnf("skipping the %d %s hooks after it", rest, point)
+			}
+			return &HookError{Point: point, Hook: hook, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunHooks(t *testing.T) {
+	cases := map[string]struct {
+		policy HookPolicy
+		// ran are the hooks that ran, in order
+		ran  string
+		fail string
+	}{
+		"continue": {policy: HookPolicy{Timeout: 200 * time.Millisecond, OnFailure: HookContinue}, ran: "10 pre-backup chain2\n20\n30\n40\n"},
+		"abort":    {policy: HookPolicy{Timeout: 200 * time.Millisecond, OnFailure: HookAbort}, ran: "10 pre-backup chain2\n20\n", fail: "20-fails"},
+		// pre-backup hooks abort by default
+		"default": {ran: "10 pre-backup chain2\n20\n", fail: "20-fails"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home := t.TempDir()
+			cfg := &Config{Home: home, Name: "dummyd", Hooks: map[string]HookPolicy{HookPreBackup: tc.policy}}
+			dir := cfg.hookDir(HookPreBackup)
+			out := filepath.Join(home, "ran")
+			require.NoError(t, os.MkdirAll(dir, 0755))
+			write := func(name, script string, mode os.FileMode) {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), mode))
+			}
+			write("10-env", `echo "10 $COSMOVISOR_HOOK $COSMOVISOR_UPGRADE_NAME" >> `+out, 0755)
+			write("20-fails", "echo 20 >> "+out+"; exit 1", 0755)
+			write("30-hangs", "echo 30 >> "+out+"; exec sleep 10", 0755)
+			write("40-last", "echo 40 >> "+out, 0755)
+			write("README", "echo readme >> "+out, 0644)
+
+			plan := &UpgradePlan{Info: &UpgradeInfo{Name: "chain2", Height: 49}, NewBin: cfg.UpgradeBin("chain2")}
+			err := cfg.runHooks(HookPreBackup, cfg.upgradeEnv(plan))
+			if tc.fail != "" {
+				var hookErr *HookError
+				require.True(t, errors.As(err, &hookErr))
+				require.Equal(t, HookPreBackup, hookErr.Point)
+				require.Equal(t, filepath.Join(dir, tc.fail), hookErr.Hook)
+			} else {
+				require.NoError(t, err)
+			}
+			ran, err := ioutil.ReadFile(out)
+			require.NoError(t, err)
+			require.Equal(t, tc.ran, string(ran))
+		})
+	}
+
+	// no directory, no hooks
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	require.NoError(t, cfg.runHooks(HookPreUpgrade, nil))
+}
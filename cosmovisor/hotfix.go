@@ -0,0 +1,357 @@
+package cosmovisor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	hotfixDir        = "hotfix"
+	hotfixDescriptor = "hotfix.json"
+	hotfixAppliedDir = "applied"
+
+	// hotfixPollInterval is how often the hotfix directory is checked while the child runs
+	hotfixPollInterval = 5 * time.Second
+	// hotfixSmokeTimeout bounds the `<bin> version` call run against the replaced binary
+	hotfixSmokeTimeout = 30 * time.Second
+
+	// hotfixBackupName stands for the upgrade in the names and records of the backups made
+	// before a hotfix, e.g. data-backup-hotfix-1200-20220102T030000Z.tar.zst
+	hotfixBackupName = "hotfix"
+)
+
+// Hotfix describes an emergency replacement of the binary in the current version directory.
+// It is read from $DAEMON_HOME/cosmovisor/hotfix/hotfix.json and the new binary is expected
+// next to it (named after Binary, or DAEMON_NAME if empty).
+type Hotfix struct {
+	// Binary is the file name of the replacement binary inside the hotfix directory
+	Binary string `json:"binary,omitempty"`
+	// BaseSHA256 is the hash of the binary the hotfix must be applied to
+	BaseSHA256 string `json:"base_sha256"`
+	// SHA256 is the expected hash of the replacement binary, optional
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// HotfixRejectedError is returned by ApplyHotfix for a hotfix binary that failed the smoke
+// test. The previous binary was put back and the descriptor moved out of the way already.
+type HotfixRejectedError struct {
+	Err error
+}
+
+func (e *HotfixRejectedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HotfixRejectedError) Unwrap() error {
+	return e.Err
+}
+
+// HotfixRecord is written to hotfix/applied/ once a hotfix was applied
+type HotfixRecord struct {
+	Type      string    `json:"type"`
+	Path      string    `json:"path"`
+	OldSHA256 string    `json:"old_sha256"`
+	NewSHA256 string    `json:"new_sha256"`
+	Replaced  string    `json:"replaced"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// HotfixDir is the drop-in directory for emergency binary replacements
+func (cfg *Config) HotfixDir() string {
+	return filepath.Join(cfg.Root(), hotfixDir)
+}
+
+// PendingHotfix returns the hotfix waiting in the drop-in directory, or nil if there is none
+func (cfg *Config) PendingHotfix() (*Hotfix, error) {
+	// the drop-in directory is written by other processes, so symlinks in it are not followed
+	bz, err := readFileInDir(cfg.Root(), filepath.Join(hotfixDir, hotfixDescriptor))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading hotfix descriptor: %w", err)
+	}
+
+	var hf Hotfix
+	if err := json.Unmarshal(bz, &hf); err != nil {
+		return nil, fmt.Errorf("parsing hotfix descriptor: %w", err)
+	}
+	if hf.Binary == "" {
+		hf.Binary = cfg.DaemonName()
+	}
+	if hf.BaseSHA256 == "" {
+		return nil, errors.New("hotfix descriptor must contain base_sha256")
+	}
+	if filepath.Base(hf.Binary) != hf.Binary {
+		return nil, fmt.Errorf("hotfix binary %q must be a file name in %s", hf.Binary, cfg.HotfixDir())
+	}
+	return &hf, nil
+}
+
+// Validate checks the hotfix applies to the binary at path and, if a hash is given, that the
+// replacement binary is the one described
+func (hf *Hotfix) Validate(cfg *Config, path string) error {
+	base, err := sha256File(path)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(base, hf.BaseSHA256) {
+		return fmt.Errorf("hotfix base hash %s doesn't match current binary %s (%s)", hf.BaseSHA256, path, base)
+	}
+
+	f, err := hf.openBinary(cfg)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = hf.checkBinary(f)
+	return err
+}
+
+// openBinary opens the replacement binary without following symlinks in the drop-in directory
+func (hf *Hotfix) openBinary(cfg *Config) (*os.File, error) {
+	return openInDir(cfg.Root(), filepath.Join(hotfixDir, hf.Binary))
+}
+
+// checkBinary validates the opened replacement binary and returns its hash
+func (hf *Hotfix) checkBinary(f *os.File) (string, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if err := checkBinary(fi); err != nil {
+		return "", err
+	}
+	got, err := sha256Reader(f)
+	if err != nil {
+		return "", fmt.Errorf("hashing %s: %w", f.Name(), err)
+	}
+	if hf.SHA256 != "" && !strings.EqualFold(got, hf.SHA256) {
+		return "", fmt.Errorf("hotfix binary hash %s doesn't match descriptor %s", got, hf.SHA256)
+	}
+	return got, nil
+}
+
+// ApplyHotfix replaces the binary inside the current version directory with the hotfix binary.
+// The current symlink is left untouched and the old binary is preserved as <bin>.replaced-<ts>.
+// The node is backed up first, as before an upgrade. If the replaced binary fails the smoke
+// test, the old binary is put back and the hotfix rejected. Once the hotfix binary is in place, failing to archive the
+// descriptor only logs a warning: the hotfix is applied.
+func ApplyHotfix(cfg *Config, hf *Hotfix) (*HotfixRecord, error) {
+	bin, err := cfg.CurrentBin()
+	if err != nil {
+		return nil, err
+	}
+	if err := hf.Validate(cfg, bin); err != nil {
+		return nil, err
+	}
+
+	oldHash, err := sha256File(bin)
+	if err != nil {
+		return nil, err
+	}
+	// hash and copy the same open file, so it can't be swapped in between
+	newBin, err := hf.openBinary(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer newBin.Close()
+	newHash, err := hf.checkBinary(newBin)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := newBin.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := cfg.backupBeforeHotfix(bin); err != nil {
+		return nil, withExitCode(ExitCodeBackup, err)
+	}
+
+	fs := cfg.fs()
+	now := NowUTC()
+	replaced := fmt.Sprintf("%s.replaced-%s", bin, FormatTimestamp(now))
+
+	// stage the new binary next to the old one, so the final rename stays on one filesystem
+	staged := bin + ".hotfix"
+	if err := copyTo(fs, newBin, staged); err != nil {
+		return nil, fmt.Errorf("staging hotfix binary: %w", err)
+	}
+	if err := cfg.normalizeStaged(fs, staged, staged); err != nil {
+		fs.remove(staged)
+		return nil, err
+	}
+	if err := injectFault("hotfix.apply"); err != nil {
+		fs.remove(staged)
+		return nil, fmt.Errorf("preserving replaced binary: %w", err)
+	}
+	if err := fs.rename(bin, replaced); err != nil {
+		fs.remove(staged)
+		return nil, fmt.Errorf("preserving replaced binary: %w", err)
+	}
+	if err := fs.rename(staged, bin); err != nil {
+		_ = fs.rename(replaced, bin)
+		return nil, fmt.Errorf("installing hotfix binary: %w", err)
+	}
+
+	if err := smokeTest(cfg, bin); err != nil {
+		_ = fs.rename(replaced, bin)
+		// the hotfix is broken, it must not be applied again on the next start
+		err = fmt.Errorf("hotfix binary failed smoke test, restored previous binary: %w", err)
+		cfg.rejectHotfix(err)
+		return nil, &HotfixRejectedError{Err: err}
+	}
+
+	record := &HotfixRecord{
+		Type:      "hotfix",
+		Path:      bin,
+		OldSHA256: oldHash,
+		NewSHA256: newHash,
+		Replaced:  replaced,
+		AppliedAt: now,
+	}
+	cfg.recordHistory(HistoryEntry{Kind: HistoryHotfix, Name: cfg.upgradeOf(bin), At: now, Binary: bin, SHA256: newHash,
+		From: replaced, FromSHA256: oldHash})
+	cfg.pruneDataBackups()
+	if err := cfg.archiveHotfix(hf, record); err != nil {
+		logger.Warnf("archiving applied hotfix, remove %s by hand so it isn't applied again: %v", cfg.HotfixDir(), err)
+	}
+	return record, nil
+}
+
+// backupBeforeHotfix backs up the stopped node as before an upgrade, with the backups of
+// backupBeforeSwitch. The backup is named after the height the node stopped at, 0 if it
+// can't be read.
+func (cfg *Config) backupBeforeHotfix(bin string) error {
+	info := &UpgradeInfo{Name: hotfixBackupName}
+	if local, err := cfg.ProbeLocalHeight(); err == nil {
+		info.Height = local.Height
+	} else {
+		logger.Warnf("reading the height of the node for the backup: %v", err)
+	}
+	plan := &UpgradePlan{Info: info, OldBin: bin, NewBin: bin}
+	// the timings are never ended, a hotfix isn't exported as an upgrade trace
+	return cfg.backupBeforeSwitch(plan, NewUpgradeTimings(hotfixBackupName))
+}
+
+// archiveHotfix stores the record of an applied hotfix and clears the drop-in directory
+func (cfg *Config) archiveHotfix(hf *Hotfix, record *HotfixRecord) error {
+	fs := cfg.fs()
+	dir := filepath.Join(cfg.HotfixDir(), hotfixAppliedDir)
+	if err := fs.mkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	bz, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := FormatTimestamp(record.AppliedAt) + ".json"
+	if err := fs.writeFile(filepath.Join(dir, name), bz, 0644); err != nil {
+		return err
+	}
+	if err := fs.remove(filepath.Join(cfg.HotfixDir(), hf.Binary)); err != nil {
+		return err
+	}
+	return fs.remove(filepath.Join(cfg.HotfixDir(), hotfixDescriptor))
+}
+
+// rejectHotfix moves an invalid descriptor out of the way, so it is not picked up again
+func (cfg *Config) rejectHotfix(reason error) {
+	logger.Warnf("rejecting hotfix: %v", reason)
+	notify(cfg, NewEvent(EventHotfixRejected, "", fmt.Sprintf("rejected hotfix: %v", reason)))
+	desc := filepath.Join(cfg.HotfixDir(), hotfixDescriptor)
+	if err := cfg.fs().rename(desc, desc+".rejected"); err != nil {
+		logger.Warnf("moving rejected hotfix descriptor: %v", err)
+	}
+}
+
+// watchHotfix polls the hotfix directory until a valid hotfix for bin shows up or done is closed.
+// Invalid hotfixes are rejected and don't interrupt the child.
+func (cfg *Config) watchHotfix(bin string, done <-chan struct{}) *Hotfix {
+	ticker := time.NewTicker(hotfixPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+
+		hf, err := cfg.PendingHotfix()
+		if err != nil {
+			cfg.rejectHotfix(err)
+			continue
+		}
+		if hf == nil {
+			continue
+		}
+		if err := hf.Validate(cfg, bin); err != nil {
+			cfg.rejectHotfix(err)
+			continue
+		}
+		return hf
+	}
+}
+
+// smokeTest runs `<bin> version` and fails if it doesn't exit cleanly in time
+func smokeTest(cfg *Config, bin string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hotfixSmokeTimeout)
+	defer cancel()
+	if err := injectFaultContext(ctx, "hotfix.smoke"); err != nil {
+		return fmt.Errorf("%s version: %w", bin, err)
+	}
+	out, err := cfg.daemonCommand(ctx, bin, "version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s version: %w: %s", bin, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// sha256File returns the hex encoded sha256 hash of the file at path
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash, err := sha256Reader(f)
+	if err != nil {
+		return "", fmt.Errorf("hashing %s: %w", path, err)
+	}
+	return hash, nil
+}
+
+// sha256Reader returns the hex encoded sha256 hash of everything read from r
+func sha256Reader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyTo copies in to a new file dst, replacing dst if it exists. A symlink planted at dst is
+// replaced, not written through.
+func copyTo(fs fsGuard, in io.Reader, dst string) error {
+	if err := fs.remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := fs.openFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
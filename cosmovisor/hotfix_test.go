@@ -0,0 +1,251 @@
+//go:build linux
+// +build linux
+
+package cosmovisor_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/cosmos/cosmos-sdk/cosmovisor"
+)
+
+type hotfixTestSuite struct {
+	suite.Suite
+}
+
+func TestHotfixTestSuite(t *testing.T) {
+	suite.Run(t, new(hotfixTestSuite))
+}
+
+const hotfixScript = "#!/bin/sh\n\necho Patched $@\n"
+
+func (s *hotfixTestSuite) TestApplyHotfix() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	s.Require().NoError(cfg.SetCurrentUpgrade("chain2"))
+
+	bin := cfg.UpgradeBin("chain2")
+	original, err := ioutil.ReadFile(bin)
+	s.Require().NoError(err)
+
+	writeHotfix(s.T(), cfg, hotfixScript, fmt.Sprintf(`{"base_sha256": "%s", "sha256": "%s"}`, hashOf(original), hashOf([]byte(hotfixScript))))
+
+	hf, err := cfg.PendingHotfix()
+	s.Require().NoError(err)
+	s.Require().NotNil(hf)
+
+	record, err := cosmovisor.ApplyHotfix(cfg, hf)
+	s.Require().NoError(err)
+	s.Require().Equal("hotfix", record.Type)
+	s.Require().Equal(hashOf(original), record.OldSHA256)
+	s.Require().Equal(hashOf([]byte(hotfixScript)), record.NewSHA256)
+
+	// binary is replaced in place, the symlink still points to the same version
+	currentBin, err := cfg.CurrentBin()
+	s.Require().NoError(err)
+	s.Require().Equal(bin, currentBin)
+	replacedWith, err := ioutil.ReadFile(bin)
+	s.Require().NoError(err)
+	s.Require().Equal(hotfixScript, string(replacedWith))
+	s.Require().NoError(cosmovisor.EnsureBinary(bin))
+
+	// the old binary is preserved
+	preserved, err := ioutil.ReadFile(record.Replaced)
+	s.Require().NoError(err)
+	s.Require().Equal(original, preserved)
+	matches, err := filepath.Glob(bin + ".replaced-*")
+	s.Require().NoError(err)
+	s.Require().Equal([]string{record.Replaced}, matches)
+
+	// drop-in directory is cleared and the record archived
+	hf, err = cfg.PendingHotfix()
+	s.Require().NoError(err)
+	s.Require().Nil(hf)
+	archived, err := filepath.Glob(filepath.Join(cfg.HotfixDir(), "applied", "*.json"))
+	s.Require().NoError(err)
+	s.Require().Len(archived, 1)
+	history, err := cfg.UpgradeHistory()
+	s.Require().NoError(err)
+	s.Require().Equal([]cosmovisor.HistoryEntry{{Kind: cosmovisor.HistoryHotfix, Name: "chain2", At: record.AppliedAt,
+		Binary: bin, SHA256: record.NewSHA256, From: record.Replaced, FromSHA256: record.OldSHA256}}, history)
+}
+
+func (s *hotfixTestSuite) TestApplyHotfixWrongBase() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	s.Require().NoError(cfg.SetCurrentUpgrade("chain2"))
+
+	// hash of the chain3 binary, so this hotfix is meant for a different base
+	other, err := ioutil.ReadFile(cfg.UpgradeBin("chain3"))
+	s.Require().NoError(err)
+	writeHotfix(s.T(), cfg, hotfixScript, fmt.Sprintf(`{"base_sha256": "%s"}`, hashOf(other)+"00"))
+
+	hf, err := cfg.PendingHotfix()
+	s.Require().NoError(err)
+	_, err = cosmovisor.ApplyHotfix(cfg, hf)
+	s.Require().Error(err)
+
+	// nothing was touched
+	current, err := ioutil.ReadFile(cfg.UpgradeBin("chain2"))
+	s.Require().NoError(err)
+	s.Require().NotEqual(hotfixScript, string(current))
+	matches, err := filepath.Glob(cfg.UpgradeBin("chain2") + ".replaced-*")
+	s.Require().NoError(err)
+	s.Require().Empty(matches)
+}
+
+func (s *hotfixTestSuite) TestApplyHotfixFailedSmokeTest() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	s.Require().NoError(cfg.SetCurrentUpgrade("chain2"))
+
+	bin := cfg.UpgradeBin("chain2")
+	original, err := ioutil.ReadFile(bin)
+	s.Require().NoError(err)
+
+	broken := "#!/bin/sh\n\nexit 1\n"
+	writeHotfix(s.T(), cfg, broken, fmt.Sprintf(`{"base_sha256": "%s"}`, hashOf(original)))
+
+	hf, err := cfg.PendingHotfix()
+	s.Require().NoError(err)
+	_, err = cosmovisor.ApplyHotfix(cfg, hf)
+	var rejected *cosmovisor.HotfixRejectedError
+	s.Require().True(errors.As(err, &rejected), err)
+
+	// the previous binary is restored
+	current, err := ioutil.ReadFile(bin)
+	s.Require().NoError(err)
+	s.Require().Equal(original, current)
+
+	// and the hotfix isn't applied again
+	hf, err = cfg.PendingHotfix()
+	s.Require().NoError(err)
+	s.Require().Nil(hf)
+	s.Require().FileExists(filepath.Join(cfg.HotfixDir(), "hotfix.json.rejected"))
+}
+
+func (s *hotfixTestSuite) TestApplyHotfixBacksUp() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", DataBackup: cosmovisor.DataBackupArchive}
+	s.Require().NoError(cfg.SetCurrentUpgrade("chain2"))
+	s.Require().NoError(os.MkdirAll(cfg.DataDir(), 0755))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(cfg.DataDir(), "priv_validator_state.json"), []byte(`{"height":"48"}`), 0600))
+
+	original, err := ioutil.ReadFile(cfg.UpgradeBin("chain2"))
+	s.Require().NoError(err)
+	writeHotfix(s.T(), cfg, hotfixScript, fmt.Sprintf(`{"base_sha256": "%s"}`, hashOf(original)))
+
+	hf, err := cfg.PendingHotfix()
+	s.Require().NoError(err)
+	_, err = cosmovisor.ApplyHotfix(cfg, hf)
+	s.Require().NoError(err)
+
+	// the node was backed up before the binary was replaced
+	backups, err := cfg.DataBackups()
+	s.Require().NoError(err)
+	s.Require().Len(backups, 1)
+	s.Require().Equal("hotfix", backups[0].Upgrade)
+	s.Require().Equal(int64(48), backups[0].Height)
+	s.Require().FileExists(backups[0].Path)
+}
+
+func (s *hotfixTestSuite) TestApplyHotfixArchiveFails() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	s.Require().NoError(cfg.SetCurrentUpgrade("chain2"))
+
+	bin := cfg.UpgradeBin("chain2")
+	original, err := ioutil.ReadFile(bin)
+	s.Require().NoError(err)
+	writeHotfix(s.T(), cfg, hotfixScript, fmt.Sprintf(`{"base_sha256": "%s"}`, hashOf(original)))
+	// the record can't be archived where a file is in the way
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(cfg.HotfixDir(), "applied"), nil, 0644))
+
+	hf, err := cfg.PendingHotfix()
+	s.Require().NoError(err)
+	record, err := cosmovisor.ApplyHotfix(cfg, hf)
+	s.Require().NoError(err, "the hotfix binary is live")
+	s.Require().Equal(hashOf([]byte(hotfixScript)), record.NewSHA256)
+	current, err := ioutil.ReadFile(bin)
+	s.Require().NoError(err)
+	s.Require().Equal(hotfixScript, string(current))
+}
+
+func (s *hotfixTestSuite) TestPendingHotfixRequiresBase() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+
+	writeHotfix(s.T(), cfg, hotfixScript, `{"sha256": "abcd"}`)
+	_, err := cfg.PendingHotfix()
+	s.Require().Error(err)
+}
+
+func (s *hotfixTestSuite) TestHotfixSymlinksNotFollowed() {
+	cases := map[string]func(cfg *cosmovisor.Config, outside string){
+		"descriptor": func(cfg *cosmovisor.Config, outside string) {
+			desc := filepath.Join(cfg.HotfixDir(), "hotfix.json")
+			s.Require().NoError(os.Rename(desc, filepath.Join(outside, "hotfix.json")))
+			s.Require().NoError(os.Symlink(filepath.Join(outside, "hotfix.json"), desc))
+		},
+		"binary": func(cfg *cosmovisor.Config, outside string) {
+			bin := filepath.Join(cfg.HotfixDir(), cfg.Name)
+			s.Require().NoError(os.Rename(bin, filepath.Join(outside, cfg.Name)))
+			s.Require().NoError(os.Symlink(filepath.Join(outside, cfg.Name), bin))
+		},
+		"directory": func(cfg *cosmovisor.Config, outside string) {
+			s.Require().NoError(os.RemoveAll(outside))
+			s.Require().NoError(os.Rename(cfg.HotfixDir(), outside))
+			s.Require().NoError(os.Symlink(outside, cfg.HotfixDir()))
+		},
+	}
+
+	for name, plant := range cases {
+		s.Run(name, func() {
+			home := copyTestData(s.T(), "validate")
+			cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+			s.Require().NoError(cfg.SetCurrentUpgrade("chain2"))
+			bin := cfg.UpgradeBin("chain2")
+			original, err := ioutil.ReadFile(bin)
+			s.Require().NoError(err)
+
+			writeHotfix(s.T(), cfg, hotfixScript, fmt.Sprintf(`{"base_sha256": "%s"}`, hashOf(original)))
+			plant(cfg, s.T().TempDir())
+
+			// either the descriptor can't be read or the binary can't be applied
+			hf, err := cfg.PendingHotfix()
+			if err == nil {
+				_, err = cosmovisor.ApplyHotfix(cfg, hf)
+			}
+			s.Require().Error(err)
+			s.Require().Contains(err.Error(), "refusing to follow symlink")
+
+			current, err := ioutil.ReadFile(bin)
+			s.Require().NoError(err)
+			s.Require().Equal(original, current)
+		})
+	}
+}
+
+// writeHotfix places a hotfix binary with the given content and descriptor in the drop-in directory
+func writeHotfix(t *testing.T, cfg *cosmovisor.Config, script, descriptor string) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(cfg.HotfixDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.HotfixDir(), cfg.Name), []byte(script), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.HotfixDir(), "hotfix.json"), []byte(descriptor), 0644))
+}
+
+func hashOf(bz []byte) string {
+	h := sha256.Sum256(bz)
+	return hex.EncodeToString(h[:])
+}
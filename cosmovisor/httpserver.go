@@ -0,0 +1,117 @@
+package cosmovisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// unixAddrPrefix starts an address of MetricsAddr or HealthAddr that is a unix socket
+const unixAddrPrefix = "unix:"
+
+// validHTTPAddr returns an error if addr is neither a host:port nor unix: and an absolute path
+func validHTTPAddr(addr string) error {
+	if path := strings.TrimPrefix(addr, unixAddrPrefix); path != addr {
+		if !filepath.IsAbs(path) {
+			return errors.New("the path of a unix socket must be absolute")
+		}
+		return nil
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
+
+// listenHTTP listens on the address of MetricsAddr or HealthAddr
+func listenHTTP(fs fsGuard, addr string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, unixAddrPrefix)
+	if path == addr {
+		return net.Listen("tcp", addr)
+	}
+	// a socket left behind by a cosmovisor that is gone
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := fs.remove(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := fs.check("listen", path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// httpClient returns a client of the HTTP server on the address of MetricsAddr or HealthAddr,
+// and the base URL of the requests
+func httpClient(addr string, timeout time.Duration) (client *http.Client, base string) {
+	path := strings.TrimPrefix(addr, unixAddrPrefix)
+	if path == addr {
+		return &http.Client{Timeout: timeout}, "http://" + addr
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}, "http://unix"
+}
+
+// ServeHTTP serves the metrics on /metrics of MetricsAddr, and the health and the status on
+// /healthz and /status of HealthAddr, until stop is called. Both can share an address, and
+// either can be a unix socket. The metrics of the last upgrade start out with the upgrade
+// recorded in the home.
+func ServeHTTP(cfg *Config) (stop func(), err error) {
+	muxes := map[string]*http.ServeMux{}
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+	if cfg.MetricsAddr != "" {
+		cfg.loadLastUpgradeMetrics()
+		mux(cfg.MetricsAddr).Handle("/metrics", MetricsHandler())
+	}
+	if cfg.HealthAddr != "" {
+		mux(cfg.HealthAddr).Handle("/healthz", HealthHandler())
+		mux(cfg.HealthAddr).Handle("/status", StatusHandler(cfg))
+	}
+	return serveMuxes(cfg, muxes)
+}
+
+// serveMuxes serves each mux on its address in the background, until stop is called
+func serveMuxes(cfg *Config, muxes map[string]*http.ServeMux) (stop func(), err error) {
+	var stops []func()
+	stop = func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+	for addr, handler := range muxes {
+		l, err := listenHTTP(cfg.fs(), addr)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("serving on %s: %w", addr, err)
+		}
+		stops = append(stops, serveHTTP(cfg, l, handler))
+	}
+	return stop, nil
+}
+
+// serveHTTP serves handler on l in the background
+func serveHTTP(cfg *Config, l net.Listener, handler http.Handler) (stop func()) {
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	goGuarded(cfg, func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("serving on %s: %v", l.Addr(), err)
+		}
+	})
+	return func() { _ = srv.Close() }
+}
@@ -0,0 +1,93 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// InitLayout creates the cosmovisor directory of a new node: the genesis binary is copied
+// from bin to genesis/bin and the current link is pointed at it. Running it again with the
+// same binary changes nothing, a different genesis binary already in place is an error.
+func InitLayout(cfg *Config, bin string) error {
+	if err := cfg.validateNames(); err != nil {
+		return err
+	}
+	info, err := os.Stat(bin)
+	if err != nil {
+		return fmt.Errorf("cannot read the genesis binary: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("genesis binary %s is not a regular file", bin)
+	}
+	hash, err := sha256File(bin)
+	if err != nil {
+		return err
+	}
+
+	genesis := cfg.GenesisBin()
+	existing, err := sha256File(genesis)
+	switch {
+	case err == nil && existing == hash:
+		logger.Debugf("%s is in place already", genesis)
+	case err == nil:
+		return fmt.Errorf("%s exists already and differs from %s, remove it to initialize again", genesis, bin)
+	case !os.IsNotExist(err):
+		return err
+	default:
+		if err := installBinary(cfg.fs(), bin, hash, genesis); err != nil {
+			return fmt.Errorf("copying the genesis binary: %w", err)
+		}
+		if err := cfg.normalizeStaged(cfg.fs(), cfg.genesisPath(), genesis); err != nil {
+			return err
+		}
+		logger.Infof("copied %s to %s", bin, genesis)
+	}
+
+	// a node that was upgraded already keeps its current link
+	current, err := cfg.CurrentBin()
+	if err != nil {
+		return fmt.Errorf("creating the current link: %w", err)
+	}
+	if err := EnsureBinary(current); err != nil {
+		return fmt.Errorf("current binary: %w", err)
+	}
+	if reason := immutableReason(cfg.Root()); reason != "" {
+		logger.Infof("%s, cosmovisor will run with an immutable layout and keep its state in %s", reason, cfg.StateDir())
+	}
+	logger.Infof("initialized %s, the current binary is %s", cfg.Root(), current)
+	return nil
+}
+
+// installBinary copies the binary bin with the given hash to dst and makes it executable.
+// It is written under a temporary name first, so an interrupted copy is never taken for
+// the binary, and replaces dst only once complete.
+func installBinary(fs fsGuard, bin, hash, dst string) error {
+	if err := fs.mkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(bin)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	if err := copyTo(fs, in, tmp); err != nil {
+		fs.remove(tmp)
+		return err
+	}
+	copied, err := sha256File(tmp)
+	if err == nil && copied != hash {
+		err = fmt.Errorf("%s changed while it was copied", bin)
+	}
+	if err != nil {
+		fs.remove(tmp)
+		return err
+	}
+	// the daemon may run as another user than the one installing the binary
+	if err := markExecutable(fs, tmp); err != nil {
+		fs.remove(tmp)
+		return err
+	}
+	return fs.rename(tmp, dst)
+}
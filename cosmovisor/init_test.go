@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitLayout(t *testing.T) {
+	src := t.TempDir()
+	write := func(name, content string, mode os.FileMode) string {
+		path := filepath.Join(src, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), mode))
+		require.NoError(t, os.Chmod(path, mode))
+		return path
+	}
+	genesis := write("gaiad", "#!/bin/sh\necho genesis\n", 0755)
+	private := write("private", "#!/bin/sh\necho genesis\n", 0700)
+	other := write("other", "#!/bin/sh\necho other\n", 0755)
+
+	cases := map[string]struct {
+		noName bool
+		// before runs InitLayout first, with this binary
+		before string
+		bin    string
+		err    string
+	}{
+		"new home":         {bin: genesis},
+		"private binary":   {bin: private},
+		"again":            {before: genesis, bin: genesis},
+		"different binary": {before: genesis, bin: other, err: "exists already and differs from " + other},
+		"missing binary":   {bin: filepath.Join(src, "missing"), err: "cannot read the genesis binary"},
+		"directory":        {bin: src, err: "is not a regular file"},
+		"name not set":     {noName: true, bin: genesis, err: "DAEMON_NAME is not set"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Home: filepath.Join(t.TempDir(), "node"), Name: "gaiad"}
+			if tc.noName {
+				cfg.Name = ""
+			}
+			if tc.before != "" {
+				require.NoError(t, InitLayout(cfg, tc.before))
+			}
+			err := InitLayout(cfg, tc.bin)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, EnsureBinary(cfg.GenesisBin()))
+			want, err := ioutil.ReadFile(tc.bin)
+			require.NoError(t, err)
+			got, err := ioutil.ReadFile(cfg.GenesisBin())
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+			link, err := os.Readlink(filepath.Join(cfg.Root(), "current"))
+			require.NoError(t, err)
+			require.Equal(t, "genesis", link)
+			_, err = os.Stat(cfg.GenesisBin() + ".tmp")
+			require.True(t, os.IsNotExist(err))
+			require.NoError(t, cfg.Validate())
+		})
+	}
+}
+
+func TestInitLayoutKeepsUpgrade(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+
+	require.NoError(t, InitLayout(cfg, cfg.GenesisBin()))
+	current, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.UpgradeBin("chain2"), current)
+}
@@ -0,0 +1,55 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// InitMode decides if cosmovisor runs as the init process of a container
+type InitMode string
+
+const (
+	// InitAuto runs as init when cosmovisor is PID 1, e.g. the entrypoint of a container
+	InitAuto InitMode = "auto"
+	// InitOn always runs as init, e.g. to reap the orphans of the daemon outside a container
+	InitOn InitMode = "true"
+	// InitOff never runs as init, for containers with an init of their own like tini
+	InitOff InitMode = "false"
+)
+
+// InitEnv is the environment variable setting the init mode
+const InitEnv = "DAEMON_INIT"
+
+// parseInitMode validates the value of DAEMON_INIT
+func parseInitMode(s string) (InitMode, error) {
+	switch m := InitMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case "":
+		return InitAuto, nil
+	case InitAuto, InitOn, InitOff:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown init mode %q, must be %s, %s or %s", s, InitAuto, InitOn, InitOff)
+	}
+}
+
+// RunsAsInit returns true if cosmovisor runs the supervising cosmovisor under RunInit
+func (cfg *Config) RunsAsInit() bool {
+	switch cfg.Init {
+	case InitOn:
+		return true
+	case InitOff:
+		return false
+	}
+	return os.Getpid() == 1
+}
+
+// InitExitError is returned by RunInit when the process it ran exited with an error
+type InitExitError struct {
+	// Code is what the process exited with, 128 plus the signal number if a signal killed it
+	Code int
+}
+
+func (e *InitExitError) Error() string {
+	return fmt.Sprintf("supervisor exited with code %d", e.Code)
+}
@@ -0,0 +1,15 @@
+package cosmovisor
+
+import "syscall"
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER of prctl(2)
+const prSetChildSubreaper = 36
+
+// becomeSubreaper makes the orphans below cosmovisor its children rather than PID 1's, so
+// RunInit reaps them when cosmovisor isn't PID 1 itself
+func becomeSubreaper() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunInitReapsOrphans(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "orphan")
+	// the subshell exits right away, its sleep is orphaned and exits while the child runs
+	script := "(sleep 0.1 & echo $! > " + pidFile + ") ; sleep 0.5; exit 3"
+	err := RunInit([]string{"/bin/sh", "-c", script}, os.Environ())
+	var exit *InitExitError
+	require.ErrorAs(t, err, &exit)
+	require.Equal(t, 3, exit.Code)
+	require.Equal(t, 3, ExitCode(err))
+
+	bz, err := ioutil.ReadFile(pidFile)
+	require.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bz)))
+	require.NoError(t, err)
+	// a zombie keeps its /proc entry until it is reaped
+	_, err = os.Stat(filepath.Join("/proc", strconv.Itoa(pid)))
+	require.True(t, os.IsNotExist(err), "orphan %d was not reaped", pid)
+}
+
+func TestRunInitForwardsSignals(t *testing.T) {
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		// the test process stands in for init, which the orchestrator stops
+		_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	err := RunInit([]string{"/bin/sh", "-c", "trap 'exit 7' TERM; sleep 2 & wait"}, os.Environ())
+	require.Equal(t, 7, ExitCode(err))
+}
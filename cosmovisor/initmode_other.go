@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package cosmovisor
+
+// becomeSubreaper does nothing, only linux hands orphans to another process than PID 1
+func becomeSubreaper() error {
+	return nil
+}
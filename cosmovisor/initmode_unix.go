@@ -0,0 +1,84 @@
+//go:build !windows
+// +build !windows
+
+package cosmovisor
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// RunInit runs argv with env as the only child of cosmovisor, which does nothing but what
+// an init process has to: every signal is relayed to the child, and the zombies of the
+// processes orphaned below it, which the kernel hands to PID 1 (or on linux to a subreaper),
+// are reaped. It returns when the child exits, an InitExitError if it failed.
+func RunInit(argv, env []string) error {
+	if err := becomeSubreaper(); err != nil {
+		logger.Warnf("becoming a subreaper: %v, orphans are only reaped as PID 1", err)
+	}
+	// all signals are caught before the child starts, none of them may kill init
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs)
+	defer signal.Stop(sigs)
+
+	proc, err := os.StartProcess(argv[0], argv, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	if err != nil {
+		return err
+	}
+	defer proc.Release()
+	// the child may have exited before the first SIGCHLD could be delivered
+	if status, exited := reapZombies(proc.Pid); exited {
+		return initExit(status)
+	}
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGCHLD:
+			if status, exited := reapZombies(proc.Pid); exited {
+				return initExit(status)
+			}
+		case syscall.SIGURG:
+			// the go runtime preempts goroutines with it
+		default:
+			if err := proc.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				logger.Warnf("forwarding %s to supervisor: %v", sig, err)
+			}
+		}
+	}
+	return nil
+}
+
+// reapZombies waits for every child that exited, exited is true if pid is one of them
+func reapZombies(pid int) (status syscall.WaitStatus, exited bool) {
+	for {
+		var ws syscall.WaitStatus
+		reaped, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil || reaped <= 0 {
+			return status, exited
+		}
+		if reaped == pid {
+			status, exited = ws, true
+		} else {
+			logger.Debugf("reaped orphaned process %d", reaped)
+		}
+	}
+}
+
+// initExit is the error RunInit returns for the exit status of its child
+func initExit(status syscall.WaitStatus) error {
+	code := status.ExitStatus()
+	if status.Signaled() {
+		code = 128 + int(status.Signal())
+	}
+	if code == 0 {
+		return nil
+	}
+	return &InitExitError{Code: code}
+}
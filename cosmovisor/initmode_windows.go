@@ -0,0 +1,8 @@
+package cosmovisor
+
+import "errors"
+
+// RunInit is not supported, windows has neither zombies nor signals to relay
+func RunInit(argv, env []string) error {
+	return errors.New("DAEMON_INIT is not supported on windows")
+}
@@ -0,0 +1,523 @@
+package cosmovisor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// defaultIPFSGateway serves the ipfs:// downloads if DAEMON_IPFS_GATEWAY is unset
+const defaultIPFSGateway = "https://ipfs.io"
+
+// the multicodecs of the blocks making up a file
+const (
+	codecRaw   = 0x55
+	codecDagPB = 0x70
+)
+
+// the UnixFS node types, of the file and of the directories leading to it
+const (
+	unixfsRaw       = 0
+	unixfsDirectory = 1
+	unixfsFile      = 2
+	unixfsHAMTShard = 5
+)
+
+// maxBlockSize bounds the blocks read from a CAR, IPFS itself doesn't exchange blocks over 2MiB
+const maxBlockSize = 4 << 20
+
+// carV2Pragma starts the CARv2 files, which wrap a CARv1 file with an index
+var carV2Pragma = []byte{0xa1, 0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x02}
+
+// cid is a content identifier: the codec of a block and the multihash of its bytes
+type cid struct {
+	codec uint64
+	hash  *Checksum
+}
+
+// key identifies the block, whatever the version of the CID naming it
+func (c cid) key() string {
+	return c.hash.String()
+}
+
+// isIPFS returns true for the content-addressed ipfs://<cid>[/<path>] URLs
+func isIPFS(src string) bool {
+	return strings.HasPrefix(src, "ipfs://")
+}
+
+// ipfsGateway is the gateway the ipfs:// downloads are fetched from
+func (cfg *Config) ipfsGateway() string {
+	if cfg.IPFSGateway == "" {
+		return defaultIPFSGateway
+	}
+	return cfg.IPFSGateway
+}
+
+// ipfsURL is an ipfs://<cid>[/<path>][?filename=<name>] URL
+type ipfsURL struct {
+	root cid
+	// rootText is the CID as written in the URL, for the gateway
+	rootText string
+	// path is the file below root, empty if root is the file
+	path string
+	// name is the name of the file, its extension picks how it is unpacked
+	name string
+}
+
+// parseIPFSURL parses an ipfs:// URL. The file is named after its path, or after the
+// filename query parameter gateways use, e.g. ipfs://<cid>?filename=gaiad.tar.gz.
+func parseIPFSURL(src string) (ipfsURL, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return ipfsURL{}, fmt.Errorf("invalid IPFS URL %s: %w", src, err)
+	}
+	root, err := parseCID(u.Host)
+	if err != nil {
+		return ipfsURL{}, fmt.Errorf("invalid IPFS URL %s: %w", src, err)
+	}
+	p := strings.Trim(path.Clean("/"+u.Path), "/")
+	name := u.Query().Get("filename")
+	if name == "" && p != "" {
+		name = path.Base(p)
+	}
+	if name == "" {
+		name = "download"
+	}
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return ipfsURL{}, fmt.Errorf("invalid IPFS URL %s: invalid filename %q", src, name)
+	}
+	return ipfsURL{root: root, rootText: u.Host, path: p, name: name}, nil
+}
+
+// gatewayURL is where the gateway serves the blocks of the file and of the directories
+// leading to it, as a CAR
+func (u ipfsURL) gatewayURL(gateway string) string {
+	p := "/ipfs/" + u.rootText
+	if u.path != "" {
+		p += "/" + u.path
+	}
+	return strings.TrimSuffix(gateway, "/") + p + "?format=car"
+}
+
+// parseCID parses a CID in its text form: base58 for version 0 (Qm...), base32 for
+// version 1 (b...), the encodings ipfs prints
+func parseCID(s string) (cid, error) {
+	var raw []byte
+	var err error
+	switch {
+	case strings.HasPrefix(s, "Qm"):
+		raw, err = decodeBase58(s)
+	case strings.HasPrefix(s, "b"):
+		raw, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(s[1:]))
+	default:
+		return cid{}, fmt.Errorf("unsupported CID %q: must be base58 (Qm...) or base32 (b...)", s)
+	}
+	if err != nil {
+		return cid{}, fmt.Errorf("invalid CID %q: %w", s, err)
+	}
+	c, n, err := decodeCID(raw)
+	if err != nil {
+		return cid{}, fmt.Errorf("invalid CID %q: %w", s, err)
+	}
+	if n != len(raw) {
+		return cid{}, fmt.Errorf("invalid CID %q: trailing bytes", s)
+	}
+	return c, nil
+}
+
+// decodeCID reads the binary CID at the start of raw and returns how many bytes it has
+func decodeCID(raw []byte) (cid, int, error) {
+	// version 0 is the bare sha256 multihash of a dag-pb block
+	if len(raw) >= 2 && raw[0] == 0x12 && raw[1] == 0x20 {
+		hash, n, err := decodeMultihash(raw)
+		return cid{codec: codecDagPB, hash: hash}, n, err
+	}
+	version, n := binary.Uvarint(raw)
+	if n <= 0 || version != 1 {
+		return cid{}, 0, errors.New("unsupported CID version")
+	}
+	codec, m := binary.Uvarint(raw[n:])
+	if m <= 0 {
+		return cid{}, 0, errors.New("truncated codec")
+	}
+	hash, k, err := decodeMultihash(raw[n+m:])
+	if err != nil {
+		return cid{}, 0, err
+	}
+	return cid{codec: codec, hash: hash}, n + m + k, nil
+}
+
+// fetchIPFS downloads the file of an ipfs:// URL from the gateway with dl, as a CAR of its
+// blocks. Each block used is checked against its CID, starting from the root CID of the
+// URL, so the gateway can't serve anything but the file the URL names. The checksum is
+// verified too if there is one.
+func fetchIPFS(fs fsGuard, dl Downloader, gateway, src string, sum *Checksum) (string, func(), error) {
+	u, err := parseIPFSURL(src)
+	if err != nil {
+		return "", nil, noRetry{err}
+	}
+	if sum != nil && sum.algorithm.new == nil {
+		return "", nil, noRetry{fmt.Errorf("%s checksums can't verify IPFS downloads", sum.Algorithm())}
+	}
+	tmpDir, err := fs.tempDir("cosmovisor-download")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { fs.removeAll(tmpDir) }
+
+	carPath := filepath.Join(tmpDir, "blocks.car")
+	if err := dl.Download(u.gatewayURL(gateway), carPath); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	local := filepath.Join(tmpDir, u.name)
+	if err := extractCAR(fs, carPath, u, local); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("%s from %s: %w", src, gateway, err)
+	}
+	if sum != nil {
+		if err := verifyFile(local, sum); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("verifying %s: %w", src, err)
+		}
+	}
+	return local, cleanup, nil
+}
+
+// extractCAR writes the file of u, made up of the blocks of the CAR file, to dst
+func extractCAR(fs fsGuard, carPath string, u ipfsURL, dst string) error {
+	car, err := openCAR(carPath)
+	if err != nil {
+		return err
+	}
+	defer car.f.Close()
+	id, err := car.resolve(u.root, u.path)
+	if err != nil {
+		return err
+	}
+	f, err := fs.openFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := car.writeFile(w, id); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// carBlock is where the data of a block is in a CAR file
+type carBlock struct {
+	id     cid
+	offset int64
+	size   int
+}
+
+// carFile is a CARv1 file, the content addressable archive gateways serve blocks in
+type carFile struct {
+	f      *os.File
+	blocks map[string]carBlock
+}
+
+// countingReader tracks the offset of a buffered reader
+type countingReader struct {
+	r   *bufio.Reader
+	off int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.off += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.off++
+	}
+	return b, err
+}
+
+// openCAR indexes the blocks of a CAR file. Nothing is verified yet, the blocks are
+// checked as they are read.
+func openCAR(carPath string) (*carFile, error) {
+	f, err := os.Open(carPath)
+	if err != nil {
+		return nil, err
+	}
+	car := &carFile{f: f, blocks: map[string]carBlock{}}
+	if err := car.index(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading the CAR: %w", err)
+	}
+	return car, nil
+}
+
+// index reads the sections of the CAR: a header, then <varint length><CID><data> per block
+func (car *carFile) index() error {
+	r := &countingReader{r: bufio.NewReader(car.f)}
+	header, err := readSection(r)
+	if err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+	if bytes.Equal(header, carV2Pragma) {
+		return errors.New("CARv2 is not supported, the gateway must serve CARv1")
+	}
+	for {
+		start := r.off
+		section, err := readSection(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		id, n, err := decodeCID(section)
+		if err != nil {
+			return fmt.Errorf("block at offset %d: %w", start, err)
+		}
+		car.blocks[id.key()] = carBlock{id: id, offset: r.off - int64(len(section)-n), size: len(section) - n}
+	}
+}
+
+// readSection reads a section of a CAR file, io.EOF if there are no more
+func readSection(r *countingReader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxBlockSize {
+		return nil, fmt.Errorf("section of %d bytes exceeds %d", size, maxBlockSize)
+	}
+	section := make([]byte, size)
+	if _, err := io.ReadFull(r, section); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return section, nil
+}
+
+// block returns the data of the block named by id, checked against it
+func (car *carFile) block(id cid) ([]byte, error) {
+	b, ok := car.blocks[id.key()]
+	if !ok {
+		return nil, fmt.Errorf("block %s is missing", id.key())
+	}
+	data := make([]byte, b.size)
+	if _, err := car.f.ReadAt(data, b.offset); err != nil {
+		return nil, err
+	}
+	if err := id.hash.Verify(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("block %s: %w", id.key(), err)
+	}
+	return data, nil
+}
+
+// resolve follows the path from root through UnixFS directories
+func (car *carFile) resolve(root cid, p string) (cid, error) {
+	id := root
+	if p == "" {
+		return id, nil
+	}
+	for _, name := range strings.Split(p, "/") {
+		node, err := car.node(id)
+		if err != nil {
+			return cid{}, err
+		}
+		switch node.kind {
+		case unixfsDirectory:
+		case unixfsHAMTShard:
+			return cid{}, fmt.Errorf("looking up %s: sharded directories are not supported", name)
+		default:
+			return cid{}, fmt.Errorf("looking up %s: not a directory", name)
+		}
+		found := false
+		for _, link := range node.links {
+			if link.name == name {
+				id, found = link.id, true
+				break
+			}
+		}
+		if !found {
+			return cid{}, fmt.Errorf("%s not found", name)
+		}
+	}
+	return id, nil
+}
+
+// writeFile writes the file the DAG under id makes up to w: the data of each node,
+// followed by the data of its children in order
+func (car *carFile) writeFile(w io.Writer, id cid) error {
+	if id.codec == codecRaw {
+		data, err := car.block(id)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	node, err := car.node(id)
+	if err != nil {
+		return err
+	}
+	switch node.kind {
+	case unixfsRaw, unixfsFile:
+	case unixfsDirectory, unixfsHAMTShard:
+		return errors.New("the URL names a directory, it must name the file in it")
+	default:
+		return fmt.Errorf("unsupported UnixFS node type %d", node.kind)
+	}
+	if _, err := w.Write(node.data); err != nil {
+		return err
+	}
+	for _, link := range node.links {
+		if err := car.writeFile(w, link.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pbLink is a link of a dag-pb node
+type pbLink struct {
+	id   cid
+	name string
+}
+
+// pbNode is a dag-pb node, with its UnixFS type and data
+type pbNode struct {
+	kind  uint64
+	data  []byte
+	links []pbLink
+}
+
+// node reads the dag-pb block named by id
+func (car *carFile) node(id cid) (pbNode, error) {
+	if id.codec != codecDagPB {
+		return pbNode{}, fmt.Errorf("block %s: unsupported codec 0x%x", id.key(), id.codec)
+	}
+	data, err := car.block(id)
+	if err != nil {
+		return pbNode{}, err
+	}
+	node, err := decodePBNode(data)
+	if err != nil {
+		return pbNode{}, fmt.Errorf("block %s: %w", id.key(), err)
+	}
+	return node, nil
+}
+
+// decodePBNode decodes a dag-pb node: links (2) of a hash (1) and a name (2), and UnixFS
+// data (1) of a type (1) and file data (2)
+func decodePBNode(raw []byte) (pbNode, error) {
+	fields, err := protoFields(raw)
+	if err != nil {
+		return pbNode{}, err
+	}
+	var node pbNode
+	var unixfs []byte
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			unixfs = f.bytes
+		case 2:
+			linkFields, err := protoFields(f.bytes)
+			if err != nil {
+				return pbNode{}, err
+			}
+			var link pbLink
+			for _, lf := range linkFields {
+				switch lf.num {
+				case 1:
+					if link.id, _, err = decodeCID(lf.bytes); err != nil {
+						return pbNode{}, fmt.Errorf("link: %w", err)
+					}
+				case 2:
+					link.name = string(lf.bytes)
+				}
+			}
+			if link.id.hash == nil {
+				return pbNode{}, errors.New("link without hash")
+			}
+			node.links = append(node.links, link)
+		}
+	}
+	if unixfs == nil {
+		return pbNode{}, errors.New("not a UnixFS node")
+	}
+	fields, err = protoFields(unixfs)
+	if err != nil {
+		return pbNode{}, err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			node.kind = f.varint
+		case 2:
+			node.data = f.bytes
+		}
+	}
+	return node, nil
+}
+
+// protoField is a field of a protobuf message, varint or length-delimited
+type protoField struct {
+	num    uint64
+	varint uint64
+	bytes  []byte
+}
+
+// protoFields splits a protobuf message into its fields, skipping fixed-size ones
+func protoFields(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("truncated protobuf")
+		}
+		b = b[n:]
+		field := protoField{num: key >> 3}
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errors.New("truncated protobuf")
+			}
+			field.varint, b = v, b[n:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return nil, errors.New("truncated protobuf")
+			}
+			field.bytes, b = b[n:n+int(size)], b[n+int(size):]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return nil, errors.New("truncated protobuf")
+			}
+			b = b[size:]
+			continue
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
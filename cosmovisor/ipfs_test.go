@@ -0,0 +1,228 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+)
+
+// uvarint appends v as a varint to b
+func uvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+// protoBytes encodes a length-delimited protobuf field
+func protoBytes(num uint64, b []byte) []byte {
+	out := uvarint(nil, num<<3|2)
+	out = uvarint(out, uint64(len(b)))
+	return append(out, b...)
+}
+
+// protoVarint encodes a varint protobuf field
+func protoVarint(num, v uint64) []byte {
+	return uvarint(uvarint(nil, num<<3), v)
+}
+
+// testDAG builds the blocks of a CAR
+type testDAG struct {
+	blocks [][]byte
+}
+
+// add adds a block and returns its binary CID, version 0 for dag-pb if v0 is set
+func (d *testDAG) add(codec uint64, data []byte, v0 bool) []byte {
+	digest := sha256.Sum256(data)
+	id := append([]byte{0x12, 0x20}, digest[:]...)
+	if !v0 {
+		id = append(uvarint([]byte{0x01}, codec), id...)
+	}
+	d.blocks = append(d.blocks, append(append([]byte{}, id...), data...))
+	return id
+}
+
+// node adds a dag-pb node of the UnixFS type with data and named links
+func (d *testDAG) node(kind uint64, data []byte, names []string, links [][]byte, v0 bool) []byte {
+	var node []byte
+	for i, link := range links {
+		node = append(node, protoBytes(2, append(protoBytes(1, link), protoBytes(2, []byte(names[i]))...))...)
+	}
+	unixfs := protoVarint(1, kind)
+	if data != nil {
+		unixfs = append(unixfs, protoBytes(2, data)...)
+	}
+	node = append(node, protoBytes(1, unixfs)...)
+	return d.add(codecDagPB, node, v0)
+}
+
+// car encodes the blocks as a CARv1 file
+func (d *testDAG) car() []byte {
+	header := append([]byte{0xa2, 0x65}, "roots"...)
+	header = append(append(header, 0x80, 0x67), "version"...)
+	header = append(header, 0x01)
+	out := append(uvarint(nil, uint64(len(header))), header...)
+	for _, block := range d.blocks {
+		out = append(uvarint(out, uint64(len(block))), block...)
+	}
+	return out
+}
+
+// cidText formats a binary CID version 1 in base32
+func cidText(id []byte) string {
+	return "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(id))
+}
+
+// ipfsGateway serves car for every request and records the paths fetched
+func ipfsGateway(t *testing.T, car []byte, paths *[]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			*paths = append(*paths, r.URL.Path)
+		}
+		if r.URL.Query().Get("format") != "car" {
+			http.Error(w, "not a CAR request", http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(car)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestParseCID(t *testing.T) {
+	cases := map[string]struct {
+		cid   string
+		codec uint64
+		err   string
+	}{
+		"version 0":         {cid: "QmatYkNGZnELf8cAGdyJpUca2PyY4szai3RHyyWofNY1pY", codec: codecDagPB},
+		"version 1 dag-pb":  {cid: "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi", codec: codecDagPB},
+		"version 1 raw":     {cid: "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e", codec: codecRaw},
+		"unknown multibase": {cid: "zb2rhe5P4gXftAwvA4eXQ5HJwsER2owDyS9sKaQRRVQPn93bA", err: "must be base58 (Qm...) or base32 (b...)"},
+		"bad base32":        {cid: "b!!!", err: "invalid CID"},
+		"version 2":         {cid: cidText([]byte{0x02, 0x55, 0x12, 0x20}), err: "unsupported CID version"},
+		"trailing bytes":    {cid: cidText(append([]byte{0x01, 0x55, 0x12, 0x20}, make([]byte, 33)...)), err: "trailing bytes"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			c, err := parseCID(tc.cid)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.codec, c.codec)
+			require.Equal(t, "sha256", c.hash.Algorithm())
+		})
+	}
+}
+
+func TestFetchIPFS(t *testing.T) {
+	dag := &testDAG{}
+	hello := dag.add(codecRaw, []byte("hello "), false)
+	world := dag.add(codecRaw, []byte("world"), false)
+	file := dag.node(unixfsFile, nil, []string{"", ""}, [][]byte{hello, world}, true)
+	small := dag.node(unixfsFile, []byte("inline"), nil, nil, true)
+	dir := dag.node(unixfsDirectory, nil, []string{"autod", "small"}, [][]byte{file, small}, false)
+	var paths []string
+	gateway := ipfsGateway(t, dag.car(), &paths)
+
+	tampered := &testDAG{blocks: append([][]byte{}, dag.blocks...)}
+	tampered.blocks[0] = append(append([]byte{}, hello...), "HELLO "...)
+	tamperedGateway := ipfsGateway(t, tampered.car(), &paths)
+	missing := &testDAG{blocks: dag.blocks[1:]}
+	missingGateway := ipfsGateway(t, missing.car(), &paths)
+
+	helloWorld := sha256.Sum256([]byte("hello world"))
+	cases := map[string]struct {
+		url     string
+		gateway string
+		sum     string
+		name    string
+		content string
+		err     string
+	}{
+		"file in directory": {url: "ipfs://" + cidText(dir) + "/autod", name: "autod", content: "hello world"},
+		"inline data":       {url: "ipfs://" + cidText(dir) + "/small", name: "small", content: "inline"},
+		"raw block":         {url: "ipfs://" + cidText(world) + "?filename=world.txt", name: "world.txt", content: "world"},
+		"with checksum":     {url: "ipfs://" + cidText(dir) + "/autod", sum: "sha256:" + hex.EncodeToString(helloWorld[:]), name: "autod", content: "hello world"},
+		"checksum mismatch": {url: "ipfs://" + cidText(dir) + "/small", sum: "sha256:" + hex.EncodeToString(helloWorld[:]), err: "checksums did not match"},
+		"not found":         {url: "ipfs://" + cidText(dir) + "/gaiad", err: "gaiad not found"},
+		"directory":         {url: "ipfs://" + cidText(dir), err: "the URL names a directory"},
+		"below a file":      {url: "ipfs://" + cidText(dir) + "/autod/bin", err: "looking up bin: not a directory"},
+		"tampered block":    {url: "ipfs://" + cidText(dir) + "/autod", gateway: tamperedGateway.URL, err: "checksums did not match"},
+		"missing block":     {url: "ipfs://" + cidText(dir) + "/autod", gateway: missingGateway.URL, err: "is missing"},
+		"invalid CID":       {url: "ipfs://not-a-cid", err: "invalid IPFS URL"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			gw := gateway.URL
+			if tc.gateway != "" {
+				gw = tc.gateway
+			}
+			var sum *Checksum
+			if tc.sum != "" {
+				var err error
+				sum, err = ParseChecksum(tc.sum)
+				require.NoError(t, err)
+			}
+			local, cleanup, err := fetchIPFS(fsGuard{}, getterDownloader{}, gw, tc.url, sum)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			defer cleanup()
+			require.Equal(t, tc.name, filepath.Base(local))
+			bz, err := ioutil.ReadFile(local)
+			require.NoError(t, err)
+			require.Equal(t, tc.content, string(bz))
+		})
+	}
+	require.Contains(t, paths, "/ipfs/"+cidText(dir)+"/autod")
+}
+
+func TestDownloadBinaryFromIPFS(t *testing.T) {
+	script, err := ioutil.ReadFile(filepath.Join("testdata", "repo", "raw_binary", "autod"))
+	require.NoError(t, err)
+	dag := &testDAG{}
+	var chunks [][]byte
+	for rest := script; len(rest) > 0; {
+		n := 64
+		if n > len(rest) {
+			n = len(rest)
+		}
+		chunks = append(chunks, dag.add(codecRaw, rest[:n], false))
+		rest = rest[n:]
+	}
+	file := dag.node(unixfsFile, nil, make([]string, len(chunks)), chunks, false)
+	dir := dag.node(unixfsDirectory, nil, []string{"autod"}, [][]byte{file}, false)
+	var paths []string
+	gateway := ipfsGateway(t, dag.car(), &paths)
+
+	home := t.TempDir()
+	require.NoError(t, copy.Copy(filepath.Join("testdata", "download"), home))
+	// the CID is the checksum
+	cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, DownloadMustHaveChecksum: true, IPFSGateway: gateway.URL}
+	info := &UpgradeInfo{Name: "amazonas", Info: `{"binaries": {"any": "ipfs://` + cidText(dir) + `/autod"}}`}
+	require.NoError(t, DownloadBinary(cfg, info))
+	require.NoError(t, EnsureBinary(cfg.UpgradeBin("amazonas")))
+	bz, err := ioutil.ReadFile(cfg.UpgradeBin("amazonas"))
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(script, bz))
+	require.Equal(t, []string{"/ipfs/" + cidText(dir) + "/autod"}, paths)
+}
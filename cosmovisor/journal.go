@@ -0,0 +1,213 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// upgradeJournalFile records how far the upgrade being applied got, so an upgrade
+// cosmovisor was killed in is resumed as it starts again
+const upgradeJournalFile = "upgrade-journal.json"
+
+// EventUpgradeResumed is notified as an upgrade cosmovisor stopped in is resumed
+const EventUpgradeResumed = "upgrade_resumed"
+
+// UpgradeStep is a step of the upgrade pipeline, completed by the upgrade of a journal
+type UpgradeStep string
+
+// The steps in the order the pipeline completes them: the binary is downloaded before the
+// node is backed up, so a failed download doesn't cost a backup
+const (
+	StepDetected   UpgradeStep = "detected"
+	StepDownloaded UpgradeStep = "downloaded"
+	StepBackedUp   UpgradeStep = "backed_up"
+	StepSwitched   UpgradeStep = "switched"
+	StepRestarted  UpgradeStep = "restarted"
+)
+
+var upgradeSteps = []UpgradeStep{StepDetected, StepDownloaded, StepBackedUp, StepSwitched, StepRestarted}
+
+// reached returns true if the step is step or one after it
+func (s UpgradeStep) reached(step UpgradeStep) bool {
+	for _, st := range upgradeSteps {
+		if st == step {
+			return true
+		}
+		if st == s {
+			return false
+		}
+	}
+	return false
+}
+
+// UpgradeJournal is the upgrade being applied and the last step of it completed. It is
+// kept once the upgraded daemon was launched, at the restarted step, until the next upgrade.
+type UpgradeJournal struct {
+	Info   *UpgradeInfo `json:"info"`
+	OldBin string       `json:"old_binary"`
+	NewBin string       `json:"new_binary"`
+	Step   UpgradeStep  `json:"step"`
+	// Download is set if the binary is downloaded by the upgrade, into an upgrade dir that
+	// wasn't there before
+	Download bool `json:"download,omitempty"`
+	// Partial is the data backup being written, removed if the upgrade is resumed
+	Partial string `json:"partial,omitempty"`
+	// Backup is the data backup made for the upgrade, once backed up
+	Backup    string    `json:"backup,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// done returns true if the upgrade of the journal was applied and the daemon launched
+func (j *UpgradeJournal) done() bool {
+	return j.Step == StepRestarted
+}
+
+// UpgradeJournal returns the journal of the upgrade applied last, nil if there is none
+func (cfg *Config) UpgradeJournal() (*UpgradeJournal, error) {
+	var j UpgradeJournal
+	if ok, err := cfg.readStateFile(upgradeJournalFile, &j); !ok {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// writeJournal records the journal. The upgrade isn't held up for it, it only can't be
+// resumed, so a failure is only logged.
+func (cfg *Config) writeJournal(j *UpgradeJournal) {
+	j.UpdatedAt = NowUTC()
+	if err := cfg.writeStateFile(upgradeJournalFile, j); err != nil {
+		logger.Warnf("recording step %s of upgrade %q: %v", j.Step, j.Info.Name, err)
+	}
+}
+
+// startJournal starts the journal of the plan. The journal of an upgrade of the same binary
+// to the same upgrade that wasn't finished is kept, so the steps it completed are skipped.
+func (cfg *Config) startJournal(plan *UpgradePlan) *UpgradeJournal {
+	if j, err := cfg.UpgradeJournal(); err == nil && j != nil && !j.done() &&
+		j.Info.Name == plan.Info.Name && j.OldBin == plan.OldBin {
+		j.Partial = ""
+		cfg.writeJournal(j)
+		return j
+	}
+	j := &UpgradeJournal{Info: plan.Info, OldBin: plan.OldBin, NewBin: plan.NewBin, Step: StepDetected, Download: plan.Download, StartedAt: NowUTC()}
+	cfg.writeJournal(j)
+	return j
+}
+
+// advance records that the upgrade of the journal completed step
+func (cfg *Config) advance(j *UpgradeJournal, step UpgradeStep) {
+	if j == nil || j.Step.reached(step) {
+		return
+	}
+	j.Step = step
+	cfg.writeJournal(j)
+}
+
+// updateJournal applies update to the journal, if it is the named upgrade's and the upgrade
+// didn't complete step yet
+func (cfg *Config) updateJournal(name string, step UpgradeStep, update func(*UpgradeJournal)) {
+	j, err := cfg.UpgradeJournal()
+	if err != nil || j == nil || j.Info.Name != name || j.Step.reached(step) {
+		return
+	}
+	update(j)
+	cfg.writeJournal(j)
+}
+
+// clearJournal removes the journal of an upgrade that failed cleanly, it is started over
+// as any upgrade
+func (cfg *Config) clearJournal() {
+	if err := cfg.fs().remove(filepath.Join(cfg.StateDir(), upgradeJournalFile)); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("removing the upgrade journal: %v", err)
+	}
+}
+
+// journalRestarted records that the daemon was launched with bin, completing the upgrade of
+// the journal if bin is its binary
+func (cfg *Config) journalRestarted(bin string) {
+	j, err := cfg.UpgradeJournal()
+	if err != nil || j == nil || j.Step != StepSwitched || j.NewBin != bin {
+		return
+	}
+	cfg.advance(j, StepRestarted)
+}
+
+// resumeUpgrade resumes an upgrade cosmovisor was stopped in, as recorded in the journal.
+// What a step left half done is removed and the upgrade is applied from the last step
+// completed: an upgrade that switched already only has its switch recorded, the others are
+// applied again, skipping the download and the backup if they completed.
+func (cfg *Config) resumeUpgrade() error {
+	j, err := cfg.UpgradeJournal()
+	if err != nil {
+		return fmt.Errorf("reading the upgrade journal: %w", err)
+	}
+	if j == nil || j.done() {
+		return nil
+	}
+	current, _ := cfg.resolveCurrentBin()
+	switch {
+	case j.Step == StepSwitched && current == j.NewBin:
+		return cfg.finishResumedSwitch(j)
+	case j.Step == StepSwitched || current != j.OldBin:
+		logger.Warnf("upgrade %q was stopped at step %s, but current points to %s since: not resuming it", j.Info.Name, j.Step, current)
+		cfg.clearJournal()
+		return nil
+	}
+
+	fs := cfg.fs()
+	if j.Partial != "" {
+		if err := fs.removeAll(j.Partial); err != nil {
+			return fmt.Errorf("removing the partial data backup %s: %w", j.Partial, err)
+		}
+	}
+	if j.Step == StepDetected && j.Download {
+		if err := fs.removeAll(cfg.UpgradeDir(j.Info.Name)); err != nil {
+			return fmt.Errorf("removing the partial download of upgrade %q: %w", j.Info.Name, err)
+		}
+	}
+	notify(cfg, resumedEvent(j))
+	logger.Infof("cosmovisor stopped during upgrade %q, resuming it after step %s", j.Info.Name, j.Step)
+
+	timings := NewUpgradeTimings(j.Info.Name)
+	err = doUpgrade(cfg, j.Info, timings)
+	timings.EndAfterRestart(err)
+	var self *SelfUpgradedError
+	if err = cfg.upgradeCosmovisor(err); errors.As(err, &self) {
+		return err
+	}
+	notifyUpgrade(cfg, j.Info.Name, err)
+	if err != nil {
+		return fmt.Errorf("resuming upgrade %q: %w", j.Info.Name, err)
+	}
+	return cfg.applyQueue(j.Info)
+}
+
+// finishResumedSwitch records the switch of an upgrade cosmovisor was stopped in right after
+// it, unless it was recorded already
+func (cfg *Config) finishResumedSwitch(j *UpgradeJournal) error {
+	plan := &UpgradePlan{Info: j.Info, OldBin: j.OldBin, NewBin: j.NewBin, Download: j.Download}
+	if last, err := cfg.LastUpgrade(); err == nil && last != nil && last.Name == j.Info.Name {
+		logger.Infof("upgrade %q was switched to before cosmovisor stopped, launching its binary", j.Info.Name)
+		return nil
+	}
+	logger.Infof("upgrade %q was switched to before cosmovisor stopped, recording it", j.Info.Name)
+	notify(cfg, resumedEvent(j))
+	timings := NewUpgradeTimings(j.Info.Name)
+	timings.cfg = cfg
+	finishSwitch(cfg, plan, timings)
+	timings.EndAfterRestart(nil)
+	notifyUpgrade(cfg, j.Info.Name, nil)
+	return cfg.applyQueue(j.Info)
+}
+
+// resumedEvent is the event of resuming the upgrade of the journal
+func resumedEvent(j *UpgradeJournal) Event {
+	ev := NewEvent(EventUpgradeResumed, j.Info.Name, fmt.Sprintf("resuming upgrade %q after step %s", j.Info.Name, j.Step))
+	ev.Height = j.Info.Height
+	ev.Fields = map[string]string{"step": string(j.Step), "started_at": j.StartedAt.Format(time.RFC3339)}
+	return ev
+}
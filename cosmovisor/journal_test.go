@@ -0,0 +1,187 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+)
+
+// journalHome returns a home of validateHome whose data directory holds state.db, with the
+// data backups named after the upgrade
+func journalHome(t *testing.T) *Config {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", DataBackupName: "{{.Name}}"}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "state.db"), []byte("state"), 0644))
+	return cfg
+}
+
+func TestUpgradeJournal(t *testing.T) {
+	defer FlushUpgradeTraces(time.Second)
+	cfg := journalHome(t)
+	cfg.DataBackup = DataBackupArchive
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49}))
+
+	j, err := cfg.UpgradeJournal()
+	require.NoError(t, err)
+	require.NotNil(t, j)
+	require.Equal(t, StepSwitched, j.Step)
+	require.Equal(t, cfg.GenesisBin(), j.OldBin)
+	require.Equal(t, cfg.UpgradeBin("chain2"), j.NewBin)
+	require.Equal(t, filepath.Join(cfg.StateDir(), "backups", "chain2.tar.zst"), j.Backup)
+	require.Empty(t, j.Partial)
+
+	s, err := GetStatus(cfg)
+	require.NoError(t, err)
+	require.Equal(t, j.Info, s.Journal.Info)
+	var buf bytes.Buffer
+	require.NoError(t, WriteStatus(&buf, s))
+	require.Contains(t, buf.String(), `journal  upgrade "chain2" started`)
+	require.Contains(t, buf.String(), "completed step switched\n")
+
+	// only the launch of the new binary completes the upgrade
+	cfg.journalRestarted(cfg.GenesisBin())
+	j, err = cfg.UpgradeJournal()
+	require.NoError(t, err)
+	require.Equal(t, StepSwitched, j.Step)
+	cfg.journalRestarted(cfg.UpgradeBin("chain2"))
+	j, err = cfg.UpgradeJournal()
+	require.NoError(t, err)
+	require.Equal(t, StepRestarted, j.Step)
+	s, err = GetStatus(cfg)
+	require.NoError(t, err)
+	require.Nil(t, s.Journal)
+	// nothing to resume
+	require.NoError(t, cfg.resumeUpgrade())
+
+	// a failed upgrade leaves no journal
+	require.Error(t, DoUpgrade(cfg, &UpgradeInfo{Name: "nobin"}))
+	j, err = cfg.UpgradeJournal()
+	require.NoError(t, err)
+	require.Equal(t, "chain2", j.Info.Name)
+	cfg.PreflightVersion = "v0.0.0-none"
+	require.Error(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain3"}))
+	j, err = cfg.UpgradeJournal()
+	require.NoError(t, err)
+	require.Nil(t, j)
+}
+
+func TestUpgradeStepReached(t *testing.T) {
+	require.True(t, StepBackedUp.reached(StepDetected))
+	require.True(t, StepBackedUp.reached(StepBackedUp))
+	require.False(t, StepBackedUp.reached(StepSwitched))
+	require.True(t, StepRestarted.reached(StepSwitched))
+	require.False(t, StepDetected.reached(StepDownloaded))
+}
+
+func TestResumeUpgrade(t *testing.T) {
+	defer FlushUpgradeTraces(time.Second)
+	journal := func(cfg *Config, step UpgradeStep, update func(*UpgradeJournal)) {
+		j := &UpgradeJournal{Info: &UpgradeInfo{Name: "chain2", Height: 49}, OldBin: cfg.GenesisBin(), NewBin: cfg.UpgradeBin("chain2"),
+			Step: step, StartedAt: NowUTC()}
+		if update != nil {
+			update(j)
+		}
+		cfg.writeJournal(j)
+	}
+	requireApplied := func(t *testing.T, cfg *Config) {
+		bin, err := cfg.CurrentBin()
+		require.NoError(t, err)
+		require.Equal(t, cfg.UpgradeBin("chain2"), bin)
+		last, err := cfg.LastUpgrade()
+		require.NoError(t, err)
+		require.Equal(t, "chain2", last.Name)
+		j, err := cfg.UpgradeJournal()
+		require.NoError(t, err)
+		require.Equal(t, StepSwitched, j.Step)
+	}
+
+	t.Run("killed while backing up", func(t *testing.T) {
+		cfg := journalHome(t)
+		cfg.DataBackup = DataBackupArchive
+		partial := filepath.Join(cfg.StateDir(), "backups", "chain2.tar.zst.tmp")
+		require.NoError(t, os.MkdirAll(filepath.Dir(partial), 0755))
+		require.NoError(t, ioutil.WriteFile(partial, []byte("half"), 0644))
+		journal(cfg, StepDownloaded, func(j *UpgradeJournal) { j.Partial = partial })
+
+		require.NoError(t, cfg.resumeUpgrade())
+		requireApplied(t, cfg)
+		require.NoFileExists(t, partial)
+		backups, err := cfg.dataBackups()
+		require.NoError(t, err)
+		require.Len(t, backups, 1)
+	})
+
+	t.Run("killed after the backup", func(t *testing.T) {
+		cfg := journalHome(t)
+		cfg.DataBackup = DataBackupArchive
+		journal(cfg, StepBackedUp, func(j *UpgradeJournal) { j.Backup = "/backups/chain2.tar.zst" })
+
+		require.NoError(t, cfg.resumeUpgrade())
+		requireApplied(t, cfg)
+		backups, err := cfg.dataBackups()
+		require.NoError(t, err)
+		require.Empty(t, backups)
+		j, err := cfg.UpgradeJournal()
+		require.NoError(t, err)
+		require.Equal(t, "/backups/chain2.tar.zst", j.Backup)
+	})
+
+	t.Run("killed after the switch", func(t *testing.T) {
+		cfg := journalHome(t)
+		require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+		journal(cfg, StepSwitched, nil)
+
+		require.NoError(t, cfg.resumeUpgrade())
+		requireApplied(t, cfg)
+		history, err := cfg.UpgradeHistory()
+		require.NoError(t, err)
+		require.Len(t, history, 1)
+		// the switch is recorded once
+		require.NoError(t, cfg.resumeUpgrade())
+		history, err = cfg.UpgradeHistory()
+		require.NoError(t, err)
+		require.Len(t, history, 1)
+	})
+
+	t.Run("killed while downloading", func(t *testing.T) {
+		cfg := journalHome(t)
+		cfg.AllowDownloadBinaries = true
+		src := filepath.Join(t.TempDir(), "dummyd")
+		require.NoError(t, copy.Copy(cfg.GenesisBin(), src))
+		info := &UpgradeInfo{Name: "chain4", Info: fmt.Sprintf(`{"binaries":{"%s": "%s"}}`, OSArch(), src)}
+		require.NoError(t, os.MkdirAll(cfg.UpgradeDir("chain4"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.UpgradeDir("chain4"), "partial"), nil, 0644))
+		cfg.writeJournal(&UpgradeJournal{Info: info, OldBin: cfg.GenesisBin(), NewBin: cfg.UpgradeBin("chain4"), Step: StepDetected, Download: true})
+
+		require.NoError(t, cfg.resumeUpgrade())
+		bin, err := cfg.CurrentBin()
+		require.NoError(t, err)
+		require.Equal(t, cfg.UpgradeBin("chain4"), bin)
+		require.NoFileExists(t, filepath.Join(cfg.UpgradeDir("chain4"), "partial"))
+	})
+
+	t.Run("current moved since", func(t *testing.T) {
+		cfg := journalHome(t)
+		require.NoError(t, cfg.SetCurrentUpgrade("chain3"))
+		journal(cfg, StepBackedUp, nil)
+
+		require.NoError(t, cfg.resumeUpgrade())
+		bin, err := cfg.CurrentBin()
+		require.NoError(t, err)
+		require.Equal(t, cfg.UpgradeBin("chain3"), bin)
+		j, err := cfg.UpgradeJournal()
+		require.NoError(t, err)
+		require.Nil(t, j)
+	})
+}
@@ -0,0 +1,122 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// stateDirName is created below WritableRoot for the state of an immutable layout
+	stateDirName = "cosmovisor-state"
+	// currentPointerFile replaces the current link in an immutable layout
+	currentPointerFile = "current"
+)
+
+// DetectImmutableLayout sets Immutable if the cosmovisor directory can't be written, e.g.
+// because the binaries are baked into a read-only container image. It returns why, or ""
+// if the layout is writable. Nothing is written to find out.
+func (cfg *Config) DetectImmutableLayout() string {
+	reason := immutableReason(cfg.Root())
+	cfg.Immutable = reason != ""
+	return reason
+}
+
+// immutableReason explains why dir can't be written, or returns ""
+func immutableReason(dir string) string {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return ""
+	}
+	// root writes through missing permission bits, but an image marked read-only means it
+	if info.Mode().Perm()&0222 == 0 {
+		return fmt.Sprintf("%s has no write permission", dir)
+	}
+	if err := checkWritable(dir); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// StateDir is where cosmovisor writes its state: StatePath if set, else the cosmovisor
+// directory, or in an immutable layout a directory below WritableRoot (DAEMON_HOME by default)
+func (cfg *Config) StateDir() string {
+	if cfg.StatePath != "" {
+		return cfg.StatePath
+	}
+	if !cfg.Immutable {
+		return cfg.Root()
+	}
+	root := cfg.WritableRoot
+	if root == "" {
+		root = cfg.Home
+	}
+	return filepath.Join(root, stateDirName)
+}
+
+// currentPointer is the path of the file naming the current version in an immutable layout,
+// or in place of the current link where there are no links
+func (cfg *Config) currentPointer() string {
+	return filepath.Join(cfg.StateDir(), currentPointerFile)
+}
+
+// readCurrentPointer returns the binary named by the current pointer, ok is false if there
+// is no valid pointer
+func (cfg *Config) readCurrentPointer() (bin string, ok bool) {
+	bz, err := ioutil.ReadFile(cfg.currentPointer())
+	if err != nil {
+		return "", false
+	}
+	// the pointer holds the version directory relative to the cosmovisor directory,
+	// like the target of the current link
+	dir := filepath.Clean(strings.TrimSpace(string(bz)))
+	switch {
+	case dir == genesisDir:
+		return cfg.versionBin(cfg.genesisPath()), true
+	case filepath.Dir(dir) == upgradesDir:
+		return cfg.versionBin(filepath.Join(cfg.upgradesPath(), filepath.Base(dir))), true
+	}
+	return "", false
+}
+
+// isVersionDir returns whether dir is the genesis directory or an upgrade directory
+func (cfg *Config) isVersionDir(dir string) bool {
+	dir = filepath.Clean(dir)
+	return dir == cfg.genesisPath() || filepath.Dir(dir) == cfg.upgradesPath()
+}
+
+// writeCurrentPointer points the current pointer to the upgrade directory. The new pointer
+// is renamed over the old one, so a failure never leaves it empty.
+func (cfg *Config) writeCurrentPointer(upgradeDir string) error {
+	// the version directories may be moved out of the cosmovisor directory, the pointer
+	// names them as if they weren't
+	rel := filepath.Join(upgradesDir, filepath.Base(upgradeDir))
+	if filepath.Clean(upgradeDir) == cfg.genesisPath() {
+		rel = genesisDir
+	} else if !cfg.isVersionDir(upgradeDir) {
+		return fmt.Errorf("%s is not a version directory", upgradeDir)
+	}
+	fs := cfg.fs()
+	if err := fs.mkdirAll(cfg.StateDir(), 0755); err != nil {
+		return fmt.Errorf("creating state dir: %w", err)
+	}
+	pointer := cfg.currentPointer()
+	tmp := pointer + ".tmp"
+	if err := injectFault("switch.symlink"); err != nil {
+		return fmt.Errorf("writing current pointer: %w", err)
+	}
+	if err := fs.writeFile(tmp, []byte(rel+"\n"), 0644); err != nil {
+		return fmt.Errorf("writing current pointer: %w", err)
+	}
+	if err := injectFault("switch.rename"); err != nil {
+		fs.remove(tmp)
+		return fmt.Errorf("replacing current pointer: %w", err)
+	}
+	if err := fs.rename(tmp, pointer); err != nil {
+		fs.remove(tmp)
+		return fmt.Errorf("replacing current pointer: %w", err)
+	}
+	return nil
+}
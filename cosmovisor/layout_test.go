@@ -0,0 +1,189 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+)
+
+// immutableHome is a copy of the validate fixture, with the cosmovisor directory made
+// read-only like an image mounted without write access
+func immutableHome(t *testing.T, prepare func(cfg *Config)) *Config {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	if prepare != nil {
+		prepare(cfg)
+	}
+	setWritable(t, cfg.Root(), false)
+	t.Cleanup(func() { setWritable(t, cfg.Root(), true) })
+	return cfg
+}
+
+// setWritable adds or removes the write permission bits in the tree
+func setWritable(t *testing.T, dir string, writable bool) {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink != 0 {
+			return err
+		}
+		mode := info.Mode().Perm() &^ 0222
+		if writable {
+			mode |= 0200
+		}
+		return os.Chmod(path, mode)
+	})
+	require.NoError(t, err)
+}
+
+func TestDetectImmutableLayout(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	require.Equal(t, "", cfg.DetectImmutableLayout())
+	require.False(t, cfg.Immutable)
+	require.Equal(t, cfg.Root(), cfg.StateDir())
+
+	cfg = immutableHome(t, nil)
+	require.Contains(t, cfg.DetectImmutableLayout(), "no write permission")
+	require.True(t, cfg.Immutable)
+	require.Equal(t, filepath.Join(cfg.Home, stateDirName), cfg.StateDir())
+
+	writable := t.TempDir()
+	cfg.WritableRoot = writable
+	require.Equal(t, filepath.Join(writable, stateDirName), cfg.StateDir())
+	cfg.StatePath = filepath.Join(writable, "state")
+	require.Equal(t, cfg.StatePath, cfg.StateDir())
+}
+
+func TestImmutableLayoutSwitchesPointer(t *testing.T) {
+	cfg := immutableHome(t, nil)
+	cfg.DetectImmutableLayout()
+	before := treeHash(t, cfg.Root())
+
+	var stdout, stderr bytes.Buffer
+	upgraded, err := LaunchProcess(cfg, []string{"foo"}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.True(t, upgraded)
+
+	// the upgrade switched the relocated pointer, the image wasn't touched
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.UpgradeBin("chain2"), bin)
+	pointer, err := ioutil.ReadFile(filepath.Join(cfg.Home, stateDirName, currentPointerFile))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(upgradesDir, "chain2"), strings.TrimSpace(string(pointer)))
+	require.Equal(t, before, treeHash(t, cfg.Root()))
+
+	// the next start runs the upgrade from the image
+	stdout.Reset()
+	upgraded, err = LaunchProcess(cfg, []string{"bar"}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.False(t, upgraded)
+	require.Contains(t, stdout.String(), "Chain 2 is live!")
+}
+
+func TestImmutableLayoutMissingBinary(t *testing.T) {
+	cfg := immutableHome(t, nil)
+	cfg.DetectImmutableLayout()
+	cfg.AllowDownloadBinaries = true
+
+	// downloads can't add binaries to the image, the upgrade fails before anything is written
+	_, err := cfg.PlanUpgrade(&UpgradeInfo{Name: "missing", Info: `{"binaries": {"any": "https://example.com/bin"}}`})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "binary not present in the immutable layout")
+	_, err = os.Stat(cfg.StateDir())
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestImmutableLayoutQueue(t *testing.T) {
+	cfg := immutableHome(t, func(cfg *Config) {
+		require.NoError(t, os.MkdirAll(cfg.QueueDir(), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.QueueDir(), "1-chain2.json"), []byte(`{"name": "chain2", "height": 49}`), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.QueueDir(), "2-chain3.json"), []byte(`{"name": "chain3", "height": 49}`), 0644))
+	})
+	cfg.DetectImmutableLayout()
+	before := treeHash(t, cfg.Root())
+
+	require.NoError(t, cfg.applyQueue(&UpgradeInfo{Name: "chain2", Height: 49}))
+	require.Equal(t, cfg.UpgradeBin("chain3"), mustCurrentBin(t, cfg))
+
+	// the applied plans are recorded in the state dir and no longer queued
+	queue, err := cfg.UpgradeQueue()
+	require.NoError(t, err)
+	require.Empty(t, queue)
+	require.True(t, cfg.queueApplied("1-chain2.json"))
+	require.True(t, cfg.queueApplied("2-chain3.json"))
+	require.Equal(t, before, treeHash(t, cfg.Root()))
+}
+
+func mustCurrentBin(t *testing.T, cfg *Config) string {
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	return bin
+}
+
+func TestCurrentPointerWithoutLinks(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.GenesisBin(), bin)
+
+	// where no link can be created the switch replaces it by the pointer
+	require.NoError(t, cfg.pointCurrent(cfg.UpgradeDir("chain2"), errNoDirLinks))
+	info, err := os.Lstat(filepath.Join(cfg.Root(), currentLink))
+	require.NoError(t, err)
+	require.True(t, info.Mode().IsRegular())
+	bin, linked := cfg.resolveCurrentBin()
+	require.True(t, linked)
+	require.Equal(t, cfg.UpgradeBin("chain2"), bin)
+
+	// and a link replaces the pointer
+	require.NoError(t, cfg.setCurrent(filepath.Join(cfg.Root(), genesisDir)))
+	bin, err = cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.GenesisBin(), bin)
+}
+
+func TestMovedLayout(t *testing.T) {
+	home, bins, run := t.TempDir(), t.TempDir(), t.TempDir()
+	require.NoError(t, copy.Copy(filepath.Join("testdata", "validate", rootName), bins))
+	require.NoError(t, os.MkdirAll(filepath.Join(home, rootName), 0755))
+	cfg := &Config{Home: home, Name: "dummyd", GenesisDir: filepath.Join(bins, genesisDir),
+		UpgradesDir: filepath.Join(bins, upgradesDir), CurrentLink: filepath.Join(run, currentLink)}
+	// the binaries are read-only, the link lives elsewhere
+	setWritable(t, bins, false)
+	t.Cleanup(func() { setWritable(t, bins, true) })
+
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(bins, genesisDir, "bin", "dummyd"), bin)
+	_, err = os.Lstat(cfg.CurrentLink)
+	require.NoError(t, err)
+
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	bin, err = cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(bins, upgradesDir, "chain2", "bin", "dummyd"), bin)
+	problem, _ := cfg.currentProblem()
+	require.Empty(t, problem)
+	require.Equal(t, "chain2", cfg.upgradeOf(bin))
+
+	// the pointer names the version as if the directories weren't moved
+	cfg.Immutable = true
+	require.NoError(t, cfg.writeCurrentPointer(cfg.UpgradeDir("chain3")))
+	bz, err := ioutil.ReadFile(cfg.currentPointer())
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(upgradesDir, "chain3")+"\n", string(bz))
+	bin, linked := cfg.resolveCurrentBin()
+	require.True(t, linked)
+	require.Equal(t, cfg.UpgradeBin("chain3"), bin)
+	require.Error(t, cfg.writeCurrentPointer(home))
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package cosmovisor
+
+import (
+	"os"
+	"syscall"
+)
+
+// exeSuffix ends the name of the binaries
+const exeSuffix = ""
+
+// accessWrite is W_OK of access(2)
+const accessWrite = 0x2
+
+// checkWritable asks the kernel if dir may be written, which fails on read-only mounts
+func checkWritable(dir string) error {
+	if err := syscall.Access(dir, accessWrite); err != nil {
+		return &os.PathError{Op: "access", Path: dir, Err: err}
+	}
+	return nil
+}
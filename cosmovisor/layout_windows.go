@@ -0,0 +1,9 @@
+package cosmovisor
+
+// exeSuffix ends the name of the binaries, windows only runs files named .exe
+const exeSuffix = ".exe"
+
+// checkWritable has nothing to ask on windows, read-only directories show in the permission bits
+func checkWritable(string) error {
+	return nil
+}
@@ -0,0 +1,335 @@
+package cosmovisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLeaderTTL is how long the leader lease lasts without being renewed
+	defaultLeaderTTL = 15 * time.Second
+	// minLeaderTTL leaves room for a few renewals, and for the daemon to be killed before
+	// a lease that can't be renewed expires
+	minLeaderTTL = 3 * time.Second
+	// minConsulTTL is the shortest session TTL consul accepts
+	minConsulTTL = 10 * time.Second
+	// leaderReleaseTimeout bounds giving the lease up when the supervision ends
+	leaderReleaseTimeout = 5 * time.Second
+)
+
+// Event types of the leader election
+const (
+	EventLeaderElected = "leader_elected"
+	EventLeaderLost    = "leader_lost"
+)
+
+// ErrLeaseLost is returned by LeaderBackend.Renew when the lock is held by another node or
+// expired
+var ErrLeaseLost = errors.New("the leader lease is held by another node or expired")
+
+// errLeadershipLost is returned by LaunchProcessContext when the daemon was killed as this
+// node lost the leader lease, or wasn't launched as it doesn't hold it. It is an
+// errRestartRequested, the daemon is launched again once the lease is won back.
+var errLeadershipLost = fmt.Errorf("%w after the leader lease was lost", errRestartRequested)
+
+// LeaderBackend holds a lock with a time to live in a coordination service. Among the nodes
+// campaigning for the same lock, the one holding it runs the daemon.
+type LeaderBackend interface {
+	// Acquire takes the lock for id for ttl. It returns false if another node holds it.
+	Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error)
+	// Renew extends the lock id holds for another ttl, or returns ErrLeaseLost if id doesn't
+	// hold it anymore
+	Renew(ctx context.Context, id string, ttl time.Duration) error
+	// Release gives the lock up if id holds it
+	Release(ctx context.Context, id string) error
+}
+
+// leaderBackends open the built-in backends of DAEMON_LEADER_ELECTION by URL scheme
+var leaderBackends = map[string]func(u *url.URL) LeaderBackend{
+	"consul":       func(u *url.URL) LeaderBackend { return newConsulBackend(u, "http") },
+	"consul+https": func(u *url.URL) LeaderBackend { return newConsulBackend(u, "https") },
+	"etcd":         func(u *url.URL) LeaderBackend { return newEtcdBackend(u, "http") },
+	"etcd+https":   func(u *url.URL) LeaderBackend { return newEtcdBackend(u, "https") },
+	"redis":        func(u *url.URL) LeaderBackend { return newRedisBackend(u, false) },
+	"rediss":       func(u *url.URL) LeaderBackend { return newRedisBackend(u, true) },
+}
+
+// parseLeaderElection checks a DAEMON_LEADER_ELECTION URL, the backend and the lock key
+func parseLeaderElection(s string, ttl time.Duration) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := leaderBackends[u.Scheme]; !ok {
+		return nil, fmt.Errorf("unknown backend %q, must be consul, etcd or redis", u.Scheme)
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("must be <backend>://<host>:<port>/<lock key>")
+	}
+	if strings.HasPrefix(u.Scheme, "consul") && ttl < minConsulTTL {
+		return nil, fmt.Errorf("consul sessions need a DAEMON_LEADER_TTL of at least %s", minConsulTTL)
+	}
+	return u, nil
+}
+
+func (cfg *Config) leaderTTL() time.Duration {
+	if cfg.LeaderTTL <= 0 {
+		return defaultLeaderTTL
+	}
+	return cfg.LeaderTTL
+}
+
+// leaderID is the identity of this node in the election, the hostname unless LeaderID is set
+func (cfg *Config) leaderID() string {
+	if cfg.LeaderID != "" {
+		return cfg.LeaderID
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "cosmovisor"
+	}
+	return host
+}
+
+// wantsLeaderElection returns true if the daemon only runs on the elected leader
+func (cfg *Config) wantsLeaderElection() bool {
+	return cfg.LeaderBackend != nil || cfg.LeaderElection != ""
+}
+
+// leaderElectionRedacted is LeaderElection without the password of the backend
+func (cfg *Config) leaderElectionRedacted() string {
+	u, err := url.Parse(cfg.LeaderElection)
+	if err != nil || u.User == nil {
+		return cfg.LeaderElection
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// leaderBackend returns LeaderBackend, or else the built-in backend of LeaderElection
+func (cfg *Config) leaderBackend() (LeaderBackend, error) {
+	if cfg.LeaderBackend != nil {
+		return cfg.LeaderBackend, nil
+	}
+	u, err := parseLeaderElection(cfg.LeaderElection, cfg.leaderTTL())
+	if err != nil {
+		return nil, fmt.Errorf("invalid DAEMON_LEADER_ELECTION %q: %w", cfg.LeaderElection, err)
+	}
+	return leaderBackends[u.Scheme](u), nil
+}
+
+// leader is the standing of this node in the leader election, across the launches of the
+// daemon
+var leader = newLeaderState()
+
+type leaderState struct {
+	mutex sync.Mutex
+	// campaigning is set while the supervision takes part in an election
+	campaigning bool
+	elected     bool
+	// won is closed once the lease is held, lost once it is lost again
+	won  chan struct{}
+	lost chan struct{}
+}
+
+func newLeaderState() *leaderState {
+	return &leaderState{won: make(chan struct{}), lost: make(chan struct{})}
+}
+
+func (s *leaderState) setCampaigning(campaigning bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.campaigning = campaigning
+}
+
+// win marks the lease as held
+func (s *leaderState) win() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.elected {
+		s.elected = true
+		s.lost = make(chan struct{})
+		close(s.won)
+	}
+}
+
+// lose marks the lease as lost, a daemon running is killed
+func (s *leaderState) lose() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.elected {
+		s.elected = false
+		s.won = make(chan struct{})
+		close(s.lost)
+	}
+}
+
+// lease returns a channel closed once the lease this node holds is lost, nil if it takes
+// part in no election, or errLeadershipLost if it doesn't hold the lease
+func (s *leaderState) lease() (<-chan struct{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.campaigning {
+		return nil, nil
+	}
+	if !s.elected {
+		return nil, errLeadershipLost
+	}
+	return s.lost, nil
+}
+
+// await returns true once this node holds the lease, false if ctx is done or a stop signal
+// is received first
+func (s *leaderState) await(ctx context.Context, stops <-chan os.Signal) bool {
+	logged := false
+	for {
+		s.mutex.Lock()
+		leading, won := !s.campaigning || s.elected, s.won
+		s.mutex.Unlock()
+		if leading {
+			return true
+		}
+		if !logged {
+			logger.Infof("standing by, the daemon is launched once this node is elected leader")
+			logged = true
+		}
+		select {
+		case <-won:
+		case sig := <-stops:
+			logger.Infof("received %s while standing by, exiting", sig)
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// startCampaign takes part in the election of the node running the daemon until stop is
+// called, which gives the lease up
+func (cfg *Config) startCampaign() (stop func(), err error) {
+	backend, err := cfg.leaderBackend()
+	if err != nil {
+		return nil, err
+	}
+	leader.setCampaigning(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	goGuarded(cfg, func() {
+		defer close(done)
+		cfg.campaign(ctx, backend)
+	})
+	return func() {
+		cancel()
+		<-done
+		leader.setCampaigning(false)
+	}, nil
+}
+
+// campaign tries to take the lease, and renews it while it is held, until ctx is done.
+// Renewals that keep failing lose the lease a third of its TTL before the backend lets it
+// expire, so the daemon is killed before another node may launch its own.
+func (cfg *Config) campaign(ctx context.Context, backend LeaderBackend) {
+	id, ttl := cfg.leaderID(), cfg.leaderTTL()
+	interval := ttl / 3
+	failing := false
+	for {
+		attempt := StartStopwatch()
+		acquire, cancel := context.WithTimeout(ctx, interval)
+		won, err := backend.Acquire(acquire, id, ttl)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			if !failing {
+				logger.Warnf("campaigning for the leader lease: %v", err)
+			}
+			failing = true
+		case won:
+			failing = false
+			if cfg.holdLease(ctx, backend, id, ttl, attempt) {
+				return
+			}
+		default:
+			failing = false
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// holdLease keeps renewing the lease taken by the attempt started at acquired until it is
+// lost, false, or ctx is done, true, which releases it
+func (cfg *Config) holdLease(ctx context.Context, backend LeaderBackend, id string, ttl time.Duration, acquired Stopwatch) bool {
+	interval := ttl / 3
+	// the lease is valid for ttl-interval from the start of the last successful attempt
+	renewed, validFor := acquired, ttl-interval
+	leader.win()
+	metrics.leaderElected(true)
+	logger.Infof("elected leader as %s", id)
+	notify(cfg, NewEvent(EventLeaderElected, "", fmt.Sprintf("%s was elected leader", id)))
+
+	lose := func(reason string) bool {
+		leader.lose()
+		metrics.leaderElected(false)
+		logger.Warnf("lost the leader lease: %s", reason)
+		notify(cfg, NewEvent(EventLeaderLost, "", fmt.Sprintf("%s lost the leader lease: %s", id, reason)))
+		return false
+	}
+	for {
+		wait := validFor - renewed.Elapsed()
+		if wait > interval {
+			wait = interval
+		}
+		select {
+		case <-ctx.Done():
+			leader.lose()
+			metrics.leaderElected(false)
+			release, cancel := context.WithTimeout(context.Background(), leaderReleaseTimeout)
+			defer cancel()
+			if err := backend.Release(release, id); err != nil {
+				logger.Warnf("releasing the leader lease: %v", err)
+			}
+			return true
+		case <-time.After(wait):
+		}
+		left := validFor - renewed.Elapsed()
+		if left <= 0 {
+			return lose(fmt.Sprintf("not renewed within %s", validFor))
+		}
+		attempt := StartStopwatch()
+		renew, cancel := context.WithTimeout(ctx, left)
+		err := backend.Renew(renew, id, ttl)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			continue
+		case errors.Is(err, ErrLeaseLost):
+			return lose(err.Error())
+		case err != nil:
+			logger.Warnf("renewing the leader lease: %v", err)
+		default:
+			renewed = attempt
+		}
+	}
+}
+
+// fenceOnLeaseLoss kills the daemon once the lease is lost, until done is closed
+func fenceOnLeaseLoss(control *launchControl, lost <-chan struct{}, done <-chan struct{}) {
+	select {
+	case <-lost:
+		control.fence()
+	case <-done:
+	}
+}
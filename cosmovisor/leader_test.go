@@ -0,0 +1,372 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memoryBackend is a LeaderBackend in memory, renewals fail with renewErr if set
+type memoryBackend struct {
+	mutex    sync.Mutex
+	holder   string
+	renewErr error
+}
+
+func (b *memoryBackend) Acquire(_ context.Context, id string, _ time.Duration) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.holder != "" && b.holder != id {
+		return false, nil
+	}
+	b.holder = id
+	return true, nil
+}
+
+func (b *memoryBackend) Renew(_ context.Context, id string, _ time.Duration) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.renewErr != nil {
+		return b.renewErr
+	}
+	if b.holder != id {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (b *memoryBackend) Release(_ context.Context, id string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.holder == id {
+		b.holder = ""
+	}
+	return nil
+}
+
+func (b *memoryBackend) set(fn func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	fn()
+}
+
+func resetLeader(t *testing.T) {
+	saved := leader
+	leader = newLeaderState()
+	t.Cleanup(func() { leader = saved })
+}
+
+// awaitLeader fails the test unless this node is elected within a second
+func awaitLeader(t *testing.T) <-chan struct{} {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.True(t, leader.await(ctx, nil), "not elected")
+	lost, err := leader.lease()
+	require.NoError(t, err)
+	return lost
+}
+
+// requireLeaderMetric waits for the leader gauge to be set to v by the campaign
+func requireLeaderMetric(t *testing.T, v float64) {
+	require.Eventually(t, func() bool {
+		var leader float64
+		metrics.update(func() { leader = metrics.leader })
+		return leader == v
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestLeaderCampaign(t *testing.T) {
+	resetMetrics(t)
+	resetLeader(t)
+	backend := &memoryBackend{holder: "node2"}
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", LeaderBackend: backend, LeaderID: "node1", LeaderTTL: 300 * time.Millisecond}
+
+	_, err := leader.lease()
+	require.NoError(t, err, "no election, the daemon is always launched")
+	stop, err := cfg.startCampaign()
+	require.NoError(t, err)
+	_, err = leader.lease()
+	require.Equal(t, errLeadershipLost, err, "standing by while node2 is the leader")
+
+	backend.set(func() { backend.holder = "" })
+	lost := awaitLeader(t)
+	requireLeaderMetric(t, 1)
+
+	// another node took the lock over
+	backend.set(func() { backend.holder = "node2" })
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatal("the lost lease wasn't noticed")
+	}
+	requireLeaderMetric(t, 0)
+
+	backend.set(func() { backend.holder = "" })
+	awaitLeader(t)
+	stop()
+	require.Empty(t, backend.holder, "the lease is released once the supervision ends")
+	_, err = leader.lease()
+	require.NoError(t, err)
+}
+
+func TestLeaderRenewFailing(t *testing.T) {
+	resetMetrics(t)
+	resetLeader(t)
+	backend := &memoryBackend{}
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", LeaderBackend: backend, LeaderID: "node1", LeaderTTL: 300 * time.Millisecond}
+	stop, err := cfg.startCampaign()
+	require.NoError(t, err)
+	defer stop()
+	lost := awaitLeader(t)
+
+	// the backend can't be reached, the lease must be given up before it expires there
+	unreachable := time.Now()
+	backend.set(func() { backend.renewErr = errors.New("connection refused") })
+	select {
+	case <-lost:
+		require.True(t, time.Since(unreachable) < cfg.LeaderTTL, "lost after %s", time.Since(unreachable))
+	case <-time.After(time.Second):
+		t.Fatal("the lease wasn't given up")
+	}
+}
+
+func TestFenceOnLeaseLoss(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+	control := &launchControl{cfg: cfg, cmd: cmd}
+	lost, done := make(chan struct{}), make(chan struct{})
+	defer close(done)
+	go fenceOnLeaseLoss(control, lost, done)
+
+	close(lost)
+	require.Error(t, cmd.Wait())
+	require.Equal(t, errLeadershipLost, control.restartErr())
+}
+
+func TestParseLeaderElection(t *testing.T) {
+	for s, ok := range map[string]bool{
+		"consul://127.0.0.1:8500/cosmovisor/validator":        true,
+		"etcd+https://etcd:2379/cosmovisor/validator":         true,
+		"redis://:secret@127.0.0.1:6379/cosmovisor-validator": true,
+		"zookeeper://127.0.0.1:2181/validator":                false,
+		"redis://127.0.0.1:6379":                              false,
+		"etcd:///validator":                                   false,
+	} {
+		_, err := parseLeaderElection(s, defaultLeaderTTL)
+		require.Equal(t, ok, err == nil, "%s: %v", s, err)
+	}
+	_, err := parseLeaderElection("consul://127.0.0.1:8500/validator", 5*time.Second)
+	require.Error(t, err, "consul sessions last 10s at least")
+
+	cfg := &Config{LeaderElection: "redis://:secret@127.0.0.1:6379/validator"}
+	require.Equal(t, "redis://:xxxxx@127.0.0.1:6379/validator", cfg.leaderElectionRedacted())
+}
+
+// consulServer fakes the sessions and locks of consul
+func consulServer(t *testing.T) *httptest.Server {
+	var mutex sync.Mutex
+	sessions := map[string]bool{}
+	holder := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch path := r.URL.Path; {
+		case path == "/v1/session/create":
+			id := fmt.Sprintf("session-%d", len(sessions)+1)
+			sessions[id] = true
+			fmt.Fprintf(w, `{"ID":%q}`, id)
+		case strings.HasPrefix(path, "/v1/session/renew/"):
+			if !sessions[strings.TrimPrefix(path, "/v1/session/renew/")] {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, `[{}]`)
+		case strings.HasPrefix(path, "/v1/session/destroy/"):
+			id := strings.TrimPrefix(path, "/v1/session/destroy/")
+			delete(sessions, id)
+			if holder == id {
+				holder = ""
+			}
+			fmt.Fprint(w, "true")
+		case path == "/v1/kv/cosmovisor/validator":
+			if id := r.URL.Query().Get("acquire"); id != "" {
+				won := holder == "" || holder == id
+				if won {
+					holder = id
+				}
+				fmt.Fprint(w, won)
+			} else if id := r.URL.Query().Get("release"); holder == id {
+				holder = ""
+				fmt.Fprint(w, "true")
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// etcdServer fakes the leases and transactions of the etcd gateway
+func etcdServer(t *testing.T) *httptest.Server {
+	var mutex sync.Mutex
+	leases := map[string]bool{}
+	holder := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var body map[string]json.RawMessage
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		var id string
+		_ = json.Unmarshal(body["ID"], &id)
+		switch r.URL.Path {
+		case "/v3/lease/grant":
+			id = strconv.Itoa(len(leases) + 1)
+			leases[id] = true
+			fmt.Fprintf(w, `{"ID":%q,"TTL":"15"}`, id)
+		case "/v3/kv/txn":
+			var success []struct {
+				RequestPut struct {
+					Key, Lease string
+				} `json:"request_put"`
+			}
+			_ = json.Unmarshal(body["success"], &success)
+			key, _ := base64.StdEncoding.DecodeString(success[0].RequestPut.Key)
+			require.Equal(t, "cosmovisor/validator", string(key))
+			if holder != "" {
+				fmt.Fprint(w, `{"header":{}}`)
+				return
+			}
+			holder = success[0].RequestPut.Lease
+			fmt.Fprint(w, `{"header":{},"succeeded":true}`)
+		case "/v3/lease/keepalive":
+			if !leases[id] {
+				fmt.Fprintf(w, `{"result":{"ID":%q}}`, id)
+				return
+			}
+			fmt.Fprintf(w, `{"result":{"ID":%q,"TTL":"15"}}`, id)
+		case "/v3/lease/revoke":
+			delete(leases, id)
+			if holder == id {
+				holder = ""
+			}
+			fmt.Fprint(w, `{"header":{}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// redisServer fakes the commands of redis the backend sends, with the password secret
+func redisServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	var mutex sync.Mutex
+	keys := map[string]string{}
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			var n int
+			if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+				return
+			}
+			args := make([]string, n)
+			for i := range args {
+				var size int
+				if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+					return
+				}
+				bz := make([]byte, size+2)
+				if _, err := io.ReadFull(r, bz); err != nil {
+					return
+				}
+				args[i] = string(bz[:size])
+			}
+			mutex.Lock()
+			switch {
+			case args[0] == "AUTH" && args[1] == "secret":
+				fmt.Fprint(conn, "+OK\r\n")
+			case args[0] == "SET" && keys[args[1]] == "":
+				keys[args[1]] = args[2]
+				fmt.Fprint(conn, "+OK\r\n")
+			case args[0] == "SET":
+				fmt.Fprint(conn, "$-1\r\n")
+			case args[0] == "EVAL" && keys[args[3]] == args[4]:
+				if args[1] == redisReleaseScript {
+					delete(keys, args[3])
+				}
+				fmt.Fprint(conn, ":1\r\n")
+			case args[0] == "EVAL":
+				fmt.Fprint(conn, ":0\r\n")
+			default:
+				fmt.Fprint(conn, "-ERR unexpected command\r\n")
+			}
+			mutex.Unlock()
+		}
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestLeaderBackends(t *testing.T) {
+	consul, etcd := consulServer(t), etcdServer(t)
+	for name, election := range map[string]string{
+		"consul": "consul://" + strings.TrimPrefix(consul.URL, "http://") + "/cosmovisor/validator",
+		"etcd":   "etcd://" + strings.TrimPrefix(etcd.URL, "http://") + "/cosmovisor/validator",
+		"redis":  "redis://:secret@" + redisServer(t) + "/cosmovisor/validator",
+	} {
+		t.Run(name, func(t *testing.T) {
+			u, err := url.Parse(election)
+			require.NoError(t, err)
+			ctx := context.Background()
+			node1, node2 := leaderBackends[u.Scheme](u), leaderBackends[u.Scheme](u)
+
+			won, err := node1.Acquire(ctx, "node1", defaultLeaderTTL)
+			require.NoError(t, err)
+			require.True(t, won)
+			won, err = node2.Acquire(ctx, "node2", defaultLeaderTTL)
+			require.NoError(t, err)
+			require.False(t, won, "node1 holds the lock")
+			require.NoError(t, node1.Renew(ctx, "node1", defaultLeaderTTL))
+
+			require.NoError(t, node1.Release(ctx, "node1"))
+			won, err = node2.Acquire(ctx, "node2", defaultLeaderTTL)
+			require.NoError(t, err)
+			require.True(t, won, "node1 released the lock")
+			require.True(t, errors.Is(node1.Renew(ctx, "node1", defaultLeaderTTL), ErrLeaseLost))
+			require.NoError(t, node2.Renew(ctx, "node2", defaultLeaderTTL))
+		})
+	}
+}
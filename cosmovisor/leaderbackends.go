@@ -0,0 +1,362 @@
+package cosmovisor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leaderDialTimeout bounds connecting to a backend when the context has no deadline
+const leaderDialTimeout = 5 * time.Second
+
+// leaderKey is the lock key of a DAEMON_LEADER_ELECTION URL
+func leaderKey(u *url.URL) string {
+	return strings.Trim(u.Path, "/")
+}
+
+// consulBackend holds the lock with a consul session, the lock is released with it
+type consulBackend struct {
+	client *http.Client
+	base   string
+	key    string
+	token  string
+
+	mutex   sync.Mutex
+	session string
+}
+
+// newConsulBackend locks the key of consul://<host>:<port>/<key>, an ACL token may be given
+// as ?token=
+func newConsulBackend(u *url.URL, scheme string) *consulBackend {
+	return &consulBackend{
+		client: &http.Client{},
+		base:   scheme + "://" + u.Host,
+		key:    leaderKey(u),
+		token:  u.Query().Get("token"),
+	}
+}
+
+func (b *consulBackend) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	var created struct {
+		ID string `json:"ID"`
+	}
+	session := map[string]string{"Name": "cosmovisor " + id, "TTL": fmt.Sprintf("%ds", int(ttl.Seconds())), "Behavior": "release"}
+	if _, err := b.call(ctx, "/v1/session/create", session, &created); err != nil {
+		return false, err
+	}
+	var won bool
+	if _, err := b.call(ctx, "/v1/kv/"+b.key+"?acquire="+url.QueryEscape(created.ID), id, &won); err != nil || !won {
+		_, _ = b.call(ctx, "/v1/session/destroy/"+created.ID, nil, nil)
+		return false, err
+	}
+	b.mutex.Lock()
+	b.session = created.ID
+	b.mutex.Unlock()
+	return true, nil
+}
+
+func (b *consulBackend) Renew(ctx context.Context, id string, ttl time.Duration) error {
+	b.mutex.Lock()
+	session := b.session
+	b.mutex.Unlock()
+	if session == "" {
+		return ErrLeaseLost
+	}
+	status, err := b.call(ctx, "/v1/session/renew/"+session, nil, nil)
+	if status == http.StatusNotFound {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+func (b *consulBackend) Release(ctx context.Context, id string) error {
+	b.mutex.Lock()
+	session := b.session
+	b.session = ""
+	b.mutex.Unlock()
+	if session == "" {
+		return nil
+	}
+	if _, err := b.call(ctx, "/v1/kv/"+b.key+"?release="+url.QueryEscape(session), id, nil); err != nil {
+		return err
+	}
+	_, err := b.call(ctx, "/v1/session/destroy/"+session, nil, nil)
+	return err
+}
+
+// call PUTs body to the consul API, as JSON unless it is the string value of a key, and
+// decodes the answer into out
+func (b *consulBackend) call(ctx context.Context, path string, body, out interface{}) (int, error) {
+	var r io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		r = strings.NewReader(body)
+	default:
+		bz, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(bz)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, b.base+path, r)
+	if err != nil {
+		return 0, err
+	}
+	if b.token != "" {
+		req.Header.Set("X-Consul-Token", b.token)
+	}
+	return doLeaderRequest(b.client, req, out)
+}
+
+// etcdBackend holds the lock with a key attached to an etcd lease, through the JSON
+// gateway of the etcd v3 API
+type etcdBackend struct {
+	client *http.Client
+	base   string
+	key    string
+
+	mutex sync.Mutex
+	lease string
+}
+
+// newEtcdBackend locks the key of etcd://<host>:<port>/<key>
+func newEtcdBackend(u *url.URL, scheme string) *etcdBackend {
+	return &etcdBackend{client: &http.Client{}, base: scheme + "://" + u.Host, key: leaderKey(u)}
+}
+
+func (b *etcdBackend) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	var granted struct {
+		ID string `json:"ID"`
+	}
+	if err := b.call(ctx, "/v3/lease/grant", map[string]interface{}{"TTL": int64(ttl.Seconds())}, &granted); err != nil {
+		return false, err
+	}
+	key := base64.StdEncoding.EncodeToString([]byte(b.key))
+	txn := map[string]interface{}{
+		"compare": []map[string]string{{"key": key, "result": "EQUAL", "target": "CREATE", "create_revision": "0"}},
+		"success": []map[string]interface{}{{"request_put": map[string]string{
+			"key": key, "value": base64.StdEncoding.EncodeToString([]byte(id)), "lease": granted.ID,
+		}}},
+	}
+	var result struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := b.call(ctx, "/v3/kv/txn", txn, &result); err != nil || !result.Succeeded {
+		_ = b.call(ctx, "/v3/lease/revoke", map[string]string{"ID": granted.ID}, nil)
+		return false, err
+	}
+	b.mutex.Lock()
+	b.lease = granted.ID
+	b.mutex.Unlock()
+	return true, nil
+}
+
+func (b *etcdBackend) Renew(ctx context.Context, id string, ttl time.Duration) error {
+	b.mutex.Lock()
+	lease := b.lease
+	b.mutex.Unlock()
+	if lease == "" {
+		return ErrLeaseLost
+	}
+	var kept struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	if err := b.call(ctx, "/v3/lease/keepalive", map[string]string{"ID": lease}, &kept); err != nil {
+		return err
+	}
+	// an expired lease is kept alive with no TTL
+	if n, _ := strconv.ParseInt(kept.Result.TTL, 10, 64); n <= 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (b *etcdBackend) Release(ctx context.Context, id string) error {
+	b.mutex.Lock()
+	lease := b.lease
+	b.lease = ""
+	b.mutex.Unlock()
+	if lease == "" {
+		return nil
+	}
+	return b.call(ctx, "/v3/lease/revoke", map[string]string{"ID": lease}, nil)
+}
+
+// call POSTs body as JSON to the etcd gateway and decodes the answer into out
+func (b *etcdBackend) call(ctx context.Context, path string, body, out interface{}) error {
+	bz, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.base+path, bytes.NewReader(bz))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, err = doLeaderRequest(b.client, req, out)
+	return err
+}
+
+// doLeaderRequest sends req and decodes a successful JSON answer into out, it returns the
+// status code of the answer
+func doLeaderRequest(client *http.Client, req *http.Request, out interface{}) (int, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return resp.StatusCode, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.StatusCode, fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, err)
+	}
+	return resp.StatusCode, nil
+}
+
+const (
+	// redisRenewScript extends the lock only if it is still held by the caller
+	redisRenewScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+	// redisReleaseScript deletes the lock only if it is still held by the caller
+	redisReleaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+)
+
+// redisBackend holds the lock with a key expiring after the TTL, set to the id of the
+// leader. A single redis server decides, it isn't the Redlock algorithm.
+type redisBackend struct {
+	addr     string
+	tls      bool
+	username string
+	password string
+	key      string
+}
+
+// newRedisBackend locks the key of redis://[[user]:password@]<host>:<port>/<key>
+func newRedisBackend(u *url.URL, useTLS bool) *redisBackend {
+	b := &redisBackend{addr: u.Host, tls: useTLS, key: leaderKey(u)}
+	if u.User != nil {
+		b.username = u.User.Username()
+		b.password, _ = u.User.Password()
+	}
+	return b
+}
+
+func (b *redisBackend) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	reply, err := b.do(ctx, "SET", b.key, id, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return reply == "OK", err
+}
+
+func (b *redisBackend) Renew(ctx context.Context, id string, ttl time.Duration) error {
+	reply, err := b.do(ctx, "EVAL", redisRenewScript, "1", b.key, id, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return err
+	}
+	if reply != int64(1) {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (b *redisBackend) Release(ctx context.Context, id string) error {
+	_, err := b.do(ctx, "EVAL", redisReleaseScript, "1", b.key, id)
+	return err
+}
+
+// do runs a command on a connection of its own, after authenticating, and returns its
+// reply: a string, an int64, or nil
+func (b *redisBackend) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = NowUTC().Add(leaderDialTimeout)
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+	var conn net.Conn
+	var err error
+	if b.tls {
+		host, _, _ := net.SplitHostPort(b.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", b.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", b.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	if b.password != "" {
+		auth := []string{"AUTH", b.password}
+		if b.username != "" {
+			auth = []string{"AUTH", b.username, b.password}
+		}
+		if _, err := redisCommand(conn, r, auth...); err != nil {
+			return nil, err
+		}
+	}
+	return redisCommand(conn, r, args...)
+}
+
+// redisCommand writes a command in the redis protocol and reads its reply
+func redisCommand(w io.Writer, r *bufio.Reader, args ...string) (interface{}, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		bz := make([]byte, n+2)
+		if _, err := io.ReadFull(r, bz); err != nil {
+			return nil, err
+		}
+		return string(bz[:n]), nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply %q", line)
+}
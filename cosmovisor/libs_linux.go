@@ -0,0 +1,190 @@
+package cosmovisor
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// defaultLibraryDirs are searched by the dynamic linker after the configured directories.
+// The multiarch directories of debian are globbed, the triplet isn't always GOARCH.
+var defaultLibraryDirs = []string{
+	"/lib64", "/usr/lib64", "/lib", "/usr/lib", "/usr/local/lib",
+	"/lib/*-linux-gnu*", "/usr/lib/*-linux-gnu*",
+}
+
+// checkLibraries returns an error if the dynamic linker of the ELF binary at path, or a
+// shared library it needs, isn't on this host. The search follows the dynamic linker: the
+// RPATH and RUNPATH of the binary, LD_LIBRARY_PATH, the linker's configuration, its cache
+// and the default directories. A binary built against libwasmvm.so fails here instead of
+// with an exec error at the upgrade height.
+func checkLibraries(path string, bin *elf.File) error {
+	for _, prog := range bin.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		bz, err := ioutil.ReadAll(prog.Open())
+		if err != nil {
+			return fmt.Errorf("%s: reading the dynamic linker: %w", path, err)
+		}
+		interp := strings.TrimRight(string(bz), "\x00")
+		if _, err := os.Stat(interp); err != nil {
+			return fmt.Errorf("%s needs the dynamic linker %s, which isn't on this host", path, interp)
+		}
+	}
+	needed, err := bin.ImportedLibraries()
+	if err != nil || len(needed) == 0 {
+		// statically linked
+		return nil
+	}
+	rpath, _ := bin.DynString(elf.DT_RPATH)
+	runpath, _ := bin.DynString(elf.DT_RUNPATH)
+	origin := filepath.Dir(path)
+	if abs, err := filepath.Abs(origin); err == nil {
+		origin = abs
+	}
+
+	var dirs []string
+	// RPATH is ignored if the binary has a RUNPATH, and searched before LD_LIBRARY_PATH
+	if len(runpath) == 0 {
+		dirs = append(dirs, expandOrigin(rpath, origin)...)
+	}
+	dirs = append(dirs, filepath.SplitList(os.Getenv("LD_LIBRARY_PATH"))...)
+	dirs = append(dirs, expandOrigin(runpath, origin)...)
+	dirs = append(dirs, linkerConfDirs()...)
+	dirs = append(dirs, defaultLibraryDirs...)
+
+	missing := missingLibraries(needed, dirs)
+	if len(missing) > 0 {
+		cached := linkerCache()
+		var still []string
+		for _, lib := range missing {
+			if !cached[lib] {
+				still = append(still, lib)
+			}
+		}
+		missing = still
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s needs %s, which isn't found on this host (searched its RPATH/RUNPATH, LD_LIBRARY_PATH and the linker's paths)",
+			path, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// expandOrigin splits the RPATH or RUNPATH entries of a binary in origin and expands $ORIGIN
+func expandOrigin(entries []string, origin string) []string {
+	var dirs []string
+	for _, entry := range entries {
+		for _, dir := range filepath.SplitList(entry) {
+			dir = strings.Replace(dir, "${ORIGIN}", origin, -1)
+			dirs = append(dirs, strings.Replace(dir, "$ORIGIN", origin, -1))
+		}
+	}
+	return dirs
+}
+
+// missingLibraries returns the libraries of needed found in none of dirs. A directory may
+// be a glob, a library with a slash in its name is looked up as a path.
+func missingLibraries(needed, dirs []string) []string {
+	var missing []string
+	for _, lib := range needed {
+		if strings.Contains(lib, "/") {
+			if _, err := os.Stat(lib); err != nil {
+				missing = append(missing, lib)
+			}
+			continue
+		}
+		found := false
+		for _, dir := range dirs {
+			if dir == "" {
+				continue
+			}
+			if matches, _ := filepath.Glob(filepath.Join(dir, lib)); len(matches) > 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, lib)
+		}
+	}
+	return missing
+}
+
+// linkerConfDirs are the directories configured for the glibc linker in /etc/ld.so.conf,
+// and for the musl linker in /etc/ld-musl-*.path
+func linkerConfDirs() []string {
+	dirs := readLinkerConf("/etc/ld.so.conf", 0)
+	paths, _ := filepath.Glob("/etc/ld-musl-*.path")
+	for _, path := range paths {
+		bz, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, strings.FieldsFunc(string(bz), func(r rune) bool {
+			return r == ':' || r == '\n'
+		})...)
+	}
+	return dirs
+}
+
+// readLinkerConf reads the directories of an ld.so.conf, following its includes
+func readLinkerConf(path string, depth int) []string {
+	f, err := os.Open(path)
+	if err != nil || depth > 8 {
+		return nil
+	}
+	defer f.Close()
+	var dirs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0 || fields[0] == "hwcap":
+		case fields[0] == "include":
+			for _, pattern := range fields[1:] {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(path), pattern)
+				}
+				includes, _ := filepath.Glob(pattern)
+				for _, include := range includes {
+					dirs = append(dirs, readLinkerConf(include, depth+1)...)
+				}
+			}
+		default:
+			dirs = append(dirs, fields...)
+		}
+	}
+	return dirs
+}
+
+// linkerCache returns the libraries in the cache of the glibc linker, read with
+// `ldconfig -p`. It's empty if ldconfig isn't there, as on musl.
+func linkerCache() map[string]bool {
+	cached := map[string]bool{}
+	ldconfig, err := exec.LookPath("ldconfig")
+	if err != nil {
+		ldconfig = "/sbin/ldconfig"
+	}
+	out, err := exec.Command(ldconfig, "-p").Output()
+	if err != nil {
+		return cached
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// "	libc.so.6 (libc6,x86-64) => /lib/x86_64-linux-gnu/libc.so.6"
+		if fields := strings.Fields(line); len(fields) > 1 && strings.Contains(line, "=>") {
+			cached[fields[0]] = true
+		}
+	}
+	return cached
+}
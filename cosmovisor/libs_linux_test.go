@@ -0,0 +1,37 @@
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissingLibraries(t *testing.T) {
+	dir := t.TempDir()
+	multiarch := filepath.Join(dir, "x86_64-linux-gnu")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "libfoo.so.1"), nil, 0644))
+	require.NoError(t, os.MkdirAll(multiarch, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(multiarch, "libbar.so"), nil, 0644))
+
+	needed := []string{"libfoo.so.1", "libbar.so", "libwasmvm.x86_64.so", filepath.Join(dir, "libfoo.so.1")}
+	require.Equal(t, []string{"libbar.so", "libwasmvm.x86_64.so"}, missingLibraries(needed, []string{"", dir}))
+	require.Equal(t, []string{"libwasmvm.x86_64.so"}, missingLibraries(needed, []string{dir, filepath.Join(dir, "*-linux-gnu*")}))
+}
+
+func TestExpandOrigin(t *testing.T) {
+	require.Equal(t, []string{"/opt/bin/../lib", "/opt/bin/lib", "/usr/lib"},
+		expandOrigin([]string{"$ORIGIN/../lib:${ORIGIN}/lib", "/usr/lib"}, "/opt/bin"))
+}
+
+func TestReadLinkerConf(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "ld.so.conf")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "ld.so.conf.d"), 0755))
+	require.NoError(t, ioutil.WriteFile(conf, []byte("# comment\ninclude ld.so.conf.d/*.conf\n/opt/lib # trailing\nhwcap 0 nosegneg\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ld.so.conf.d", "wasmvm.conf"), []byte("/opt/wasmvm/lib\n"), 0644))
+
+	require.Equal(t, []string{"/opt/wasmvm/lib", "/opt/lib"}, readLinkerConf(conf, 0))
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package cosmovisor
+
+import "os"
+
+// linkDir creates link as a symlink to the directory dir
+func (g fsGuard) linkDir(dir, link string) error {
+	return g.symlink(dir, link)
+}
+
+// replaceLink renames the link tmp over link, which is atomic
+func (g fsGuard) replaceLink(tmp, link string) error {
+	return g.rename(tmp, link)
+}
+
+// readDirLink returns the directory link points to, an error if it isn't a symlink
+func readDirLink(link string) (string, error) {
+	info, err := os.Lstat(link)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: link, Err: errNotDirLink}
+	}
+	return os.Readlink(link)
+}
@@ -0,0 +1,65 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// linkDir creates link as a symlink to the directory dir. Creating symlinks takes a
+// privilege most accounts don't hold outside of developer mode, a directory junction is
+// made instead then, which any user may create on a local volume. A junction can't be
+// relative, it is made to the absolute path of a relative dir.
+func (g fsGuard) linkDir(dir, link string) error {
+	err := g.symlink(dir, link)
+	if err == nil || !errors.Is(err, syscall.ERROR_PRIVILEGE_NOT_HELD) {
+		return err
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(link), dir)
+	}
+	out, jerr := exec.Command("cmd", "/c", "mklink", "/J", link, dir).CombinedOutput()
+	if jerr != nil {
+		return fmt.Errorf("%w: %v, junction: %v %s", errNoDirLinks, err, jerr, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// replaceLink renames the link tmp over link. Windows can't rename over a directory, not
+// even a link to one, so the old link is removed first: readDirLink finds tmp if cosmovisor
+// dies in between.
+func (g fsGuard) replaceLink(tmp, link string) error {
+	if err := g.remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return g.rename(tmp, link)
+}
+
+// readDirLink returns the directory link points to, which is a symlink or a junction. A
+// missing link that replaceLink was about to replace by link.tmp is read from there.
+func readDirLink(link string) (string, error) {
+	dest, err := readLinkFile(link)
+	if os.IsNotExist(err) {
+		if dest, terr := readLinkFile(link + ".tmp"); terr == nil {
+			return dest, nil
+		}
+	}
+	return dest, err
+}
+
+// readLinkFile reads the symlink or junction at path
+func readLinkFile(path string) (string, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	// junctions are reported as irregular files since go 1.23
+	if info.Mode()&(os.ModeSymlink|os.ModeIrregular) == 0 {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: errNotDirLink}
+	}
+	return os.Readlink(path)
+}
@@ -0,0 +1,179 @@
+package cosmovisor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLivenessTimeout is how long the height may stand still before the node is
+	// restarted
+	defaultLivenessTimeout = 5 * time.Minute
+	// defaultLivenessMaxRestarts is how many restarts in a row may not get the node going
+	defaultLivenessMaxRestarts = 3
+	// livenessPolls is how often the height is polled within the timeout
+	livenessPolls = 10
+)
+
+// errRestartStalled is returned by LaunchProcessContext when the daemon was stopped as
+// its node stopped making blocks. It is an errRestartRequested.
+var errRestartStalled = fmt.Errorf("%w for a stalled node", errRestartRequested)
+
+// liveness counts the restarts of a stalled node across the launches of the daemon
+var liveness = &livenessState{}
+
+type livenessState struct {
+	mutex sync.Mutex
+	// restarts are the restarts since the node last made a block
+	restarts int
+}
+
+// restart counts a restart of the stalled node and returns true, or false once
+// budget restarts in a row didn't get it going
+func (s *livenessState) restart(budget int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.restarts >= budget {
+		return false
+	}
+	s.restarts++
+	return true
+}
+
+// progressed starts the count of restarts over once the node makes blocks again
+func (s *livenessState) progressed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.restarts = 0
+}
+
+func (cfg *Config) livenessTimeout() time.Duration {
+	if cfg.LivenessTimeout <= 0 {
+		return defaultLivenessTimeout
+	}
+	return cfg.LivenessTimeout
+}
+
+func (cfg *Config) livenessMaxRestarts() int {
+	if cfg.LivenessMaxRestarts <= 0 {
+		return defaultLivenessMaxRestarts
+	}
+	return cfg.LivenessMaxRestarts
+}
+
+// NodeHeight returns the latest block height the CometBFT RPC at url reports on /status
+func NodeHeight(client *http.Client, url string) (int64, error) {
+	info, err := NodeSyncInfo(client, url)
+	if err != nil {
+		return 0, err
+	}
+	return info.Height, nil
+}
+
+// NodeSync is the sync info of a node on its CometBFT RPC
+type NodeSync struct {
+	// Height is the latest block height of the node
+	Height int64
+	// CatchingUp is set while the node syncs blocks from its peers
+	CatchingUp bool
+}
+
+// NodeSyncInfo returns the sync info the CometBFT RPC at url reports on /status
+func NodeSyncInfo(client *http.Client, url string) (NodeSync, error) {
+	url = strings.TrimRight(url, "/") + "/status"
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	if err != nil {
+		return NodeSync{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return NodeSync{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return NodeSync{}, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var status struct {
+		Result struct {
+			SyncInfo struct {
+				LatestBlockHeight string `json:"latest_block_height"`
+				CatchingUp        bool   `json:"catching_up"`
+			} `json:"sync_info"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return NodeSync{}, fmt.Errorf("decoding %s: %w", url, err)
+	}
+	height, err := strconv.ParseInt(status.Result.SyncInfo.LatestBlockHeight, 10, 64)
+	if err != nil {
+		return NodeSync{}, fmt.Errorf("invalid latest block height %q: %w", status.Result.SyncInfo.LatestBlockHeight, err)
+	}
+	return NodeSync{Height: height, CatchingUp: status.Result.SyncInfo.CatchingUp}, nil
+}
+
+// watchLiveness polls the height of the node until done is closed, and restarts the
+// daemon once it stood still for LivenessTimeout. The timeout only runs once the RPC
+// answered, a node still loading its stores isn't stalled, but an RPC that stops
+// answering counts as a stall. A node halted for an upgrade, a paused supervision or a
+// spent restart budget only get a warning.
+func (cfg *Config) watchLiveness(control *launchControl, done <-chan struct{}) {
+	timeout := cfg.livenessTimeout()
+	client := &http.Client{Timeout: nodeAPITimeout}
+	ticker := time.NewTicker(timeout / livenessPolls)
+	defer ticker.Stop()
+	var height int64
+	var since Stopwatch
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		h, err := NodeHeight(client, cfg.LivenessRPC)
+		switch {
+		case err != nil:
+			logger.Debugf("polling the height of the node: %v", err)
+		case h > height:
+			if height > 0 {
+				liveness.progressed()
+			}
+			height, since = h, StartStopwatch()
+			continue
+		}
+		if !since.running() || since.Elapsed() < timeout {
+			continue
+		}
+		stalled := fmt.Sprintf("the node is stuck at height %d for %s", height, since.Elapsed().Round(time.Second))
+		if err != nil {
+			stalled += fmt.Sprintf(", its RPC fails: %v", err)
+		}
+		// the warnings repeat once per timeout
+		since = StartStopwatch()
+		if plan, perr := cfg.PlanFile(); perr == nil && plan != nil && plan.Height == height+1 {
+			logger.Warnf("%s, halted for upgrade %q", stalled, plan.Name)
+			continue
+		}
+		if admin.isPaused() {
+			logger.Warnf("%s, not restarting it while the supervision is paused", stalled)
+			continue
+		}
+		if !liveness.restart(cfg.livenessMaxRestarts()) {
+			logger.Errorf("%s, %d restarts didn't get it going, leaving it to the operator", stalled, cfg.livenessMaxRestarts())
+			notify(cfg, Event{ID: fmt.Sprintf("%s/%d/given-up", EventNodeStalled, height), Type: EventNodeStalled,
+				Message: fmt.Sprintf("%s, %d restarts didn't get it going", stalled, cfg.livenessMaxRestarts())})
+			continue
+		}
+		logger.Warnf("%s, restarting %s", stalled, control.cmd.Path)
+		notify(cfg, NewEvent(EventNodeStalled, "", stalled+", restarting the daemon"))
+		if err := control.requestLivenessRestart(); err != nil {
+			logger.Infof("not restarting %s: %v", control.cmd.Path, err)
+		}
+		return
+	}
+}
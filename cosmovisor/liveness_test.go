@@ -0,0 +1,97 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// statusServer serves a CometBFT /status with the height returned by height
+func statusServer(t *testing.T, height func() int64) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":-1,"result":{"sync_info":{"latest_block_height":"%d","catching_up":false}}}`, height())
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestNodeHeight(t *testing.T) {
+	srv := statusServer(t, func() int64 { return 4200 })
+	height, err := NodeHeight(srv.Client(), srv.URL+"/")
+	require.NoError(t, err)
+	require.Equal(t, int64(4200), height)
+
+	_, err = NodeHeight(srv.Client(), srv.URL+"/missing")
+	require.Error(t, err)
+}
+
+// startWatchLiveness runs watchLiveness for control, the returned stop waits for it to
+// return, so the test can restore liveness afterwards
+func startWatchLiveness(cfg *Config, control *launchControl) (stop func()) {
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		cfg.watchLiveness(control, done)
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+func TestWatchLiveness(t *testing.T) {
+	defer func(l *livenessState) { liveness = l }(liveness)
+	liveness = &livenessState{}
+	srv := statusServer(t, func() int64 { return 10 })
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", LivenessRPC: srv.URL, LivenessTimeout: 200 * time.Millisecond, LivenessMaxRestarts: 1}
+
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+	control := &launchControl{cfg: cfg, cmd: cmd}
+	defer startWatchLiveness(cfg, control)()
+
+	require.Error(t, cmd.Wait())
+	require.Equal(t, errRestartStalled, control.restartErr())
+
+	// the budget is spent, the node is left running
+	cmd = exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+	defer func() { _ = cmd.Process.Kill() }()
+	control = &launchControl{cfg: cfg, cmd: cmd}
+	stop := startWatchLiveness(cfg, control)
+	time.Sleep(700 * time.Millisecond)
+	stop()
+	require.False(t, control.restartRequested())
+}
+
+func TestWatchLivenessProgress(t *testing.T) {
+	defer func(l *livenessState) { liveness = l }(liveness)
+	liveness = &livenessState{restarts: 2}
+	var height int64
+	srv := statusServer(t, func() int64 { return atomic.AddInt64(&height, 1) })
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", LivenessRPC: srv.URL, LivenessTimeout: 100 * time.Millisecond}
+
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+	defer func() { _ = cmd.Process.Kill() }()
+	control := &launchControl{cfg: cfg, cmd: cmd}
+	stop := startWatchLiveness(cfg, control)
+	time.Sleep(400 * time.Millisecond)
+	stop()
+
+	require.False(t, control.restartRequested())
+	require.True(t, liveness.restart(1), "the node made blocks, the restarts start over")
+}
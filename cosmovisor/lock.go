@@ -0,0 +1,116 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// pidFile holds the process id of the cosmovisor supervising the home
+const pidFile = "cosmovisor.pid"
+
+// AlreadyRunningError is returned when another cosmovisor supervises the same home.
+// Two daemons running with the same keys would double-sign.
+type AlreadyRunningError struct {
+	Root string
+	// PID is the process id of the other cosmovisor, 0 if it is unknown
+	PID int
+}
+
+func (e *AlreadyRunningError) Error() string {
+	if e.PID > 0 {
+		return fmt.Sprintf("another cosmovisor (pid %d) is already running for %s, refusing to start a second daemon", e.PID, e.Root)
+	}
+	return fmt.Sprintf("another cosmovisor is already running for %s, refusing to start a second daemon", e.Root)
+}
+
+// errLocked is returned by lockDir when another process holds the lock
+var errLocked = errors.New("locked")
+
+// homeLock is the lock on a cosmovisor root held by this process
+type homeLock struct {
+	file *os.File
+	refs int
+}
+
+// homeLocks are the roots this process supervises. Supervise and the LaunchProcess calls
+// it makes share the lock, which a second flock by the same process would not allow.
+var homeLocks = struct {
+	sync.Mutex
+	held map[string]*homeLock
+}{held: map[string]*homeLock{}}
+
+// lockHome takes the lock making sure a single cosmovisor supervises the home and
+// writes the pid file. The returned unlock releases both.
+func (cfg *Config) lockHome() (unlock func(), err error) {
+	root := cfg.Root()
+	homeLocks.Lock()
+	defer homeLocks.Unlock()
+	if l := homeLocks.held[root]; l != nil {
+		l.refs++
+		return func() { cfg.unlockHome(root) }, nil
+	}
+
+	f, err := lockDir(root)
+	if err == errLocked {
+		return nil, &AlreadyRunningError{Root: root, PID: cfg.lockOwner()}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("locking %s: %w", root, err)
+	}
+	if err := cfg.writePIDFile(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("writing pid file: %w", err)
+	}
+	homeLocks.held[root] = &homeLock{file: f, refs: 1}
+	return func() { cfg.unlockHome(root) }, nil
+}
+
+func (cfg *Config) unlockHome(root string) {
+	homeLocks.Lock()
+	defer homeLocks.Unlock()
+	l := homeLocks.held[root]
+	if l == nil {
+		return
+	}
+	if l.refs--; l.refs > 0 {
+		return
+	}
+	delete(homeLocks.held, root)
+	// the pid file goes first, whoever takes the lock next writes their own
+	path := filepath.Join(cfg.StateDir(), pidFile)
+	if err := cfg.fs().remove(path); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("removing %s: %v", path, err)
+	}
+	l.file.Close()
+}
+
+func (cfg *Config) writePIDFile() error {
+	fs := cfg.fs()
+	if err := fs.mkdirAll(cfg.StateDir(), 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(cfg.StateDir(), pidFile)
+	if err := fs.writeFile(path+".tmp", []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return err
+	}
+	return fs.rename(path+".tmp", path)
+}
+
+// lockOwner returns the pid in the pid file, 0 if there is none
+func (cfg *Config) lockOwner() int {
+	bz, err := ioutil.ReadFile(filepath.Join(cfg.StateDir(), pidFile))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bz)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockHome(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	pidPath := filepath.Join(cfg.StateDir(), pidFile)
+
+	// Supervise and LaunchProcess share the lock of this process
+	unlock, err := cfg.lockHome()
+	require.NoError(t, err)
+	require.Equal(t, os.Getpid(), cfg.lockOwner())
+	again, err := cfg.lockHome()
+	require.NoError(t, err)
+	again()
+	require.FileExists(t, pidPath)
+	unlock()
+	require.NoFileExists(t, pidPath)
+
+	// another cosmovisor holds the lock
+	other, err := lockDir(cfg.Root())
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(pidPath, []byte("4242\n"), 0644))
+	_, err = LaunchProcess(cfg, []string{"version"}, ioutil.Discard, ioutil.Discard)
+	var running *AlreadyRunningError
+	require.True(t, errors.As(err, &running), err)
+	require.Equal(t, 4242, running.PID)
+	require.Contains(t, err.Error(), "another cosmovisor (pid 4242) is already running for "+cfg.Root())
+	require.Error(t, Supervise(cfg, []string{"version"}, ioutil.Discard, ioutil.Discard))
+
+	// a pid file left behind by a killed cosmovisor doesn't stand in the way
+	other.Close()
+	_, err = LaunchProcess(cfg, []string{"version"}, ioutil.Discard, ioutil.Discard)
+	require.NoError(t, err)
+	require.NoFileExists(t, pidPath)
+}
+
+func TestLockHomeImmutable(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", Immutable: true, WritableRoot: t.TempDir()}
+	require.NoError(t, os.Chmod(cfg.Root(), 0555))
+	t.Cleanup(func() { os.Chmod(cfg.Root(), 0755) })
+
+	unlock, err := cfg.lockHome()
+	require.NoError(t, err)
+	defer unlock()
+	require.FileExists(t, filepath.Join(cfg.WritableRoot, "cosmovisor-state", pidFile))
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package cosmovisor
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockDir takes an exclusive flock on dir, held until the returned file is closed. Locking
+// the directory rather than a file in it works on a read-only layout too.
+func lockDir(dir string) (*os.File, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLocked
+		}
+		return nil, &os.PathError{Op: "flock", Path: dir, Err: err}
+	}
+	return f, nil
+}
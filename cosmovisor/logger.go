@@ -0,0 +1,214 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// LogLevel is the least severe level cosmovisor logs at
+type LogLevel string
+
+const (
+	// LogDebug also logs the details only needed to follow what cosmovisor does
+	LogDebug LogLevel = "debug"
+	// LogInfo logs every step of the supervision, the default
+	LogInfo LogLevel = "info"
+	// LogWarn only logs the problems cosmovisor works around and the failures
+	LogWarn LogLevel = "warn"
+	// LogError only logs the failures an operator has to look into
+	LogError LogLevel = "error"
+)
+
+// LogFormat is how cosmovisor formats its log lines
+type LogFormat string
+
+const (
+	// LogText is one line per message, e.g. "2022-01-02T15:04:05Z INF [cosmovisor] message key=value"
+	LogText LogFormat = "text"
+	// LogJSON is one JSON object per message, with the fields level, time, module and message
+	LogJSON LogFormat = "json"
+)
+
+// logModule tells the lines cosmovisor logs apart from the output of the daemon
+const logModule = "cosmovisor"
+
+// logSeverity orders the levels, the abbreviations are those of the text format
+var logSeverity = map[LogLevel]struct {
+	rank   int
+	abbrev string
+}{
+	LogDebug: {0, "DBG"},
+	LogInfo:  {1, "INF"},
+	LogWarn:  {2, "WRN"},
+	LogError: {3, "ERR"},
+}
+
+// parseLogLevel validates the value of DAEMON_LOG_LEVEL
+func parseLogLevel(s string) (LogLevel, error) {
+	switch l := LogLevel(strings.ToLower(strings.TrimSpace(s))); l {
+	case "":
+		return LogInfo, nil
+	case LogDebug, LogInfo, LogWarn, LogError:
+		return l, nil
+	default:
+		return "", fmt.Errorf("unknown log level %q, must be %s, %s, %s or %s", s, LogDebug, LogInfo, LogWarn, LogError)
+	}
+}
+
+// parseLogFormat validates the value of DAEMON_LOG_FORMAT
+func parseLogFormat(s string) (LogFormat, error) {
+	switch f := LogFormat(strings.ToLower(strings.TrimSpace(s))); f {
+	case "":
+		return LogText, nil
+	case LogText, LogJSON:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown log format %q, must be %s or %s", s, LogText, LogJSON)
+	}
+}
+
+// logSink is where all loggers write, shared so the output can be configured once
+type logSink struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	level  LogLevel
+	format LogFormat
+}
+
+// logField is a key-value pair added to every line of a logger
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes leveled messages with the module field "cosmovisor" and its own fields.
+// Every line is a single write, so the output can be shared with other writers.
+type Logger struct {
+	sink   *logSink
+	fields []logField
+}
+
+// logger is the logger of the package, configured by SetLogOutput and ConfigureLogging
+var logger = &Logger{sink: &logSink{w: os.Stderr, level: LogInfo, format: LogText}}
+
+// Log returns the logger cosmovisor logs with, for programs that log next to it
+func Log() *Logger {
+	return logger
+}
+
+// SetLogOutput sets where cosmovisor logs, stderr by default
+func SetLogOutput(w io.Writer) {
+	logger.sink.mutex.Lock()
+	logger.sink.w = w
+	logger.sink.mutex.Unlock()
+}
+
+// ConfigureLogging applies the log level and format of the config
+func ConfigureLogging(cfg *Config) {
+	logger.sink.mutex.Lock()
+	defer logger.sink.mutex.Unlock()
+	logger.sink.level, logger.sink.format = LogInfo, LogText
+	if cfg.LogLevel != "" {
+		logger.sink.level = cfg.LogLevel
+	}
+	if cfg.LogFormat != "" {
+		logger.sink.format = cfg.LogFormat
+	}
+}
+
+// LogWriter returns a writer logging each line written to it as a message at info level,
+// e.g. for the standard logger of a program embedding cosmovisor
+func LogWriter() io.Writer {
+	return logLineWriter{logger}
+}
+
+type logLineWriter struct {
+	l *Logger
+}
+
+func (w logLineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.l.log(LogInfo, line)
+	}
+	return len(p), nil
+}
+
+// With returns a logger adding the field to every line
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]logField, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{sink: l.sink, fields: append(fields, logField{key, value})}
+}
+
+// Debugf logs a detail at debug level
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LogDebug, fmt.Sprintf(format, args...))
+}
+
+// Infof logs a step at info level
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LogInfo, fmt.Sprintf(format, args...))
+}
+
+// Warnf logs a problem at warn level
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LogWarn, fmt.Sprintf(format, args...))
+}
+
+// Errorf logs a failure at error level
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LogError, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) log(level LogLevel, msg string) {
+	s := l.sink
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if logSeverity[level].rank < logSeverity[s.level].rank {
+		return
+	}
+	var buf bytes.Buffer
+	now := formatLogTime(NowUTC())
+	if s.format == LogJSON {
+		fields := append([]logField{{"level", level}, {"time", now}, {"module", logModule}}, l.fields...)
+		buf.WriteByte('{')
+		for _, f := range append(fields, logField{"message", msg}) {
+			writeJSONField(&buf, f)
+		}
+		buf.Bytes()[buf.Len()-1] = '}'
+	} else {
+		fmt.Fprintf(&buf, "%s %s [%s] %s", now, logSeverity[level].abbrev, logModule, msg)
+		for _, f := range l.fields {
+			fmt.Fprintf(&buf, " %s=%s", f.key, textValue(f.value))
+		}
+	}
+	buf.WriteByte('\n')
+	_, _ = s.w.Write(buf.Bytes())
+}
+
+// writeJSONField writes `"key":value,`, a value that can't be marshaled as its string
+func writeJSONField(buf *bytes.Buffer, f logField) {
+	key, _ := json.Marshal(f.key)
+	value, err := json.Marshal(f.value)
+	if err != nil {
+		value, _ = json.Marshal(fmt.Sprint(f.value))
+	}
+	buf.Write(key)
+	buf.WriteByte(':')
+	buf.Write(value)
+	buf.WriteByte(',')
+}
+
+// textValue quotes a field value of the text format if it is empty or has spaces
+func textValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	cases := map[string]LogLevel{
+		"":       LogInfo,
+		"debug":  LogDebug,
+		" WARN ": LogWarn,
+		"error":  LogError,
+	}
+	for s, expected := range cases {
+		l, err := parseLogLevel(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, l, s)
+	}
+	_, err := parseLogLevel("trace")
+	require.EqualError(t, err, `unknown log level "trace", must be debug, info, warn or error`)
+
+	f, err := parseLogFormat("JSON")
+	require.NoError(t, err)
+	require.Equal(t, LogJSON, f)
+	_, err = parseLogFormat("logfmt")
+	require.EqualError(t, err, `unknown log format "logfmt", must be text or json`)
+}
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Logger{sink: &logSink{w: &buf, level: LogInfo, format: LogText}}
+	l.Debugf("not logged")
+	l.Infof("upgrading to %q", "v2")
+	l.With("upgrade", "v2").With("reason", "exit status 3").Warnf("failed")
+	require.Regexp(t, regexp.MustCompile(`^\S+Z INF \[cosmovisor\] upgrading to "v2"\n\S+Z WRN \[cosmovisor\] failed upgrade=v2 reason="exit status 3"\n$`), buf.String())
+
+	buf.Reset()
+	l.sink.level = LogError
+	l.Warnf("not logged")
+	l.Errorf("crashed")
+	require.Contains(t, buf.String(), " ERR [cosmovisor] crashed\n")
+	require.NotContains(t, buf.String(), "not logged")
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Logger{sink: &logSink{w: &buf, level: LogDebug, format: LogJSON}}
+	l.With("upgrade", "v2").With("attempt", 2).Debugf("line one\nline two")
+	require.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("\n")), "one line per message")
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	require.Equal(t, "debug", line["level"])
+	require.Equal(t, "cosmovisor", line["module"])
+	require.Equal(t, "v2", line["upgrade"])
+	require.Equal(t, float64(2), line["attempt"])
+	require.Equal(t, "line one\nline two", line["message"])
+	require.NotEmpty(t, line["time"])
+
+	buf.Reset()
+	_, err := logLineWriter{l}.Write([]byte("first\nsecond\n"))
+	require.NoError(t, err)
+	require.Equal(t, 2, bytes.Count(buf.Bytes(), []byte(`"level":"info"`)))
+}
@@ -0,0 +1,291 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronHorizon is how far ahead a cron expression is searched for its next time, long
+// enough for one that only matches on the 29th of February
+const cronHorizon = 5 * 366 * 24 * time.Hour
+
+// MaintenanceWindow is a time optional restarts of the daemon are made in: those scheduled
+// by RestartMaxUptime and those for MemoryRestart. Upgrades are never held back for it.
+type MaintenanceWindow struct {
+	// Daily is the time of the day of the window, if Cron isn't set
+	Daily *RestartWindow
+	// Cron is the cron expression, in UTC, of the times the window opens, Duration how long
+	// it stays open then
+	Cron     string
+	Duration time.Duration
+
+	schedule *cronSchedule
+}
+
+// MaintenanceWindows are the windows of DAEMON_MAINTENANCE_WINDOW, optional restarts are
+// made any time without them
+type MaintenanceWindows []*MaintenanceWindow
+
+// parseMaintenanceWindows parses DAEMON_MAINTENANCE_WINDOW, a ; separated list of daily
+// windows such as "02:00-04:00", and of cron expressions followed by a duration such as
+// "0 3 * * sat 2h". It returns nil for the empty string.
+func parseMaintenanceWindows(s string) (MaintenanceWindows, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var windows MaintenanceWindows
+	for _, part := range strings.Split(s, ";") {
+		w, err := parseMaintenanceWindow(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseMaintenanceWindow(s string) (*MaintenanceWindow, error) {
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 0:
+		return nil, fmt.Errorf("empty window")
+	case 6:
+	default:
+		daily, err := parseRestartWindow(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q must be a time range like 02:00-04:00, or a cron expression and a duration like \"0 3 * * sat 2h\"", s)
+		}
+		return &MaintenanceWindow{Daily: daily}, nil
+	}
+	expr := strings.Join(fields[:5], " ")
+	schedule, err := parseCron(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+	}
+	d, err := time.ParseDuration(fields[5])
+	if err != nil || d < time.Minute {
+		return nil, fmt.Errorf("invalid duration %q of %q, must be a minute or more", fields[5], s)
+	}
+	if _, ok := schedule.nextMatch(NowUTC()); !ok {
+		return nil, fmt.Errorf("cron expression %q never matches", expr)
+	}
+	return &MaintenanceWindow{Cron: expr, Duration: d, schedule: schedule}, nil
+}
+
+func (w *MaintenanceWindow) String() string {
+	if w.Daily != nil {
+		return w.Daily.String()
+	}
+	return w.Cron + " " + w.Duration.String()
+}
+
+func (ws MaintenanceWindows) String() string {
+	windows := make([]string, len(ws))
+	for i, w := range ws {
+		windows[i] = w.String()
+	}
+	return strings.Join(windows, "; ")
+}
+
+// next returns the first time at or after t within the window, false if there is none
+func (w *MaintenanceWindow) next(t time.Time) (time.Time, bool) {
+	if w.Daily != nil {
+		return w.Daily.next(t), true
+	}
+	t = t.UTC()
+	// t is within the window if it opened after t-Duration, the first opening from then
+	// on is either at or before t, or the next one
+	opens, ok := w.schedule.nextMatch(t.Add(-w.Duration).Add(time.Nanosecond))
+	if !ok {
+		return time.Time{}, false
+	}
+	if !opens.After(t) {
+		return t, true
+	}
+	return opens, true
+}
+
+// next returns the first time at or after t within one of the windows, t itself without
+// windows
+func (ws MaintenanceWindows) next(t time.Time) (time.Time, bool) {
+	if len(ws) == 0 {
+		return t, true
+	}
+	var first time.Time
+	found := false
+	for _, w := range ws {
+		if at, ok := w.next(t); ok && (!found || at.Before(first)) {
+			first, found = at, true
+		}
+	}
+	return first, found
+}
+
+// contains returns true if t is within one of the windows, or there are none
+func (ws MaintenanceWindows) contains(t time.Time) bool {
+	at, ok := ws.next(t)
+	return ok && at.Equal(t.UTC())
+}
+
+// maintenanceWindow is DAEMON_MAINTENANCE_WINDOW, "" for any time
+func (cfg *Config) maintenanceWindow() string {
+	return cfg.MaintenanceWindows.String()
+}
+
+// nextRestartTime returns the first time at or after t within both RestartWindow and the
+// maintenance windows, false if they don't overlap within a year
+func (cfg *Config) nextRestartTime(t time.Time) (time.Time, bool) {
+	limit := t.Add(366 * 24 * time.Hour)
+	for t.Before(limit) {
+		at, ok := cfg.MaintenanceWindows.next(cfg.RestartWindow.next(t))
+		if !ok {
+			return time.Time{}, false
+		}
+		if cfg.RestartWindow.next(at).Equal(at) {
+			return at, true
+		}
+		t = at
+	}
+	return time.Time{}, false
+}
+
+// cronSchedule is a parsed cron expression: minute, hour, day of the month, month and day
+// of the week
+type cronSchedule struct {
+	minute, hour, dom, month, dow []bool
+	// anyDom and anyDow are set for a * day of the month or of the week. As in cron, a
+	// day matches either of them if both are restricted.
+	anyDom, anyDow bool
+}
+
+var cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseCron parses a cron expression of five fields, each a *, a value, a range such as
+// 1-5 or a list of them, with an optional /step. Months and days of the week may be named.
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("must have 5 fields, has %d", len(fields))
+	}
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of the month: %w", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	// 7 is sunday too
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, fmt.Errorf("day of the week: %w", err)
+	}
+	c.dow[0] = c.dow[0] || c.dow[7]
+	c.anyDom = strings.HasPrefix(fields[2], "*")
+	c.anyDow = strings.HasPrefix(fields[4], "*")
+	return &c, nil
+}
+
+// parseCronField returns the values from min to max the field matches, indexed by value.
+// names, if any, name the values from min on.
+func parseCronField(field string, min, max int, names []string) ([]bool, error) {
+	matches := make([]bool, max+1)
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("invalid value %q, must be from %d to %d", s, min, max)
+		}
+		return n, nil
+	}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			step, part = n, part[:i]
+		}
+		from, to := min, max
+		switch i := strings.Index(part, "-"); {
+		case part == "*":
+		case i >= 0:
+			var err error
+			if from, err = value(part[:i]); err != nil {
+				return nil, err
+			}
+			if to, err = value(part[i+1:]); err != nil {
+				return nil, err
+			}
+			if from > to {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			n, err := value(part)
+			if err != nil {
+				return nil, err
+			}
+			from, to = n, n
+			if step > 1 {
+				to = max
+			}
+		}
+		for v := from; v <= to; v += step {
+			matches[v] = true
+		}
+	}
+	return matches, nil
+}
+
+// matchesDay returns true if the day of t matches the day of the month and of the week
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// nextMatch returns the first minute at or after t the schedule matches, false if there is
+// none within cronHorizon
+func (c *cronSchedule) nextMatch(t time.Time) (time.Time, bool) {
+	t = t.UTC()
+	if truncated := t.Truncate(time.Minute); !truncated.Equal(t) {
+		t = truncated.Add(time.Minute)
+	}
+	limit := t.Add(cronHorizon)
+	for t.Before(limit) {
+		switch {
+		case !c.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !c.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+		case !c.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
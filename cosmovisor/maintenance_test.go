@@ -0,0 +1,124 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMaintenanceWindows(t *testing.T) {
+	ws, err := parseMaintenanceWindows(" 02:00-04:00 ; 30 3 * * sat,sun 2h ")
+	require.NoError(t, err)
+	require.Len(t, ws, 2)
+	require.Equal(t, &RestartWindow{Start: 2 * time.Hour, End: 4 * time.Hour}, ws[0].Daily)
+	require.Equal(t, "30 3 * * sat,sun", ws[1].Cron)
+	require.Equal(t, 2*time.Hour, ws[1].Duration)
+	require.Equal(t, "02:00-04:00; 30 3 * * sat,sun 2h0m0s", ws.String())
+
+	ws, err = parseMaintenanceWindows("")
+	require.NoError(t, err)
+	require.Nil(t, ws)
+
+	for s, msg := range map[string]string{
+		"02:00":                   `"02:00" must be a time range like 02:00-04:00, or a cron expression and a duration like "0 3 * * sat 2h"`,
+		"02:00-04:00;":            "empty window",
+		"0 3 * * sat":             `"0 3 * * sat" must be a time range like 02:00-04:00, or a cron expression and a duration like "0 3 * * sat 2h"`,
+		"0 25 * * * 1h":           `invalid cron expression "0 25 * * *": hour: invalid value "25", must be from 0 to 23`,
+		"0 3 * foo * 1h":          `invalid cron expression "0 3 * foo *": month: invalid value "foo", must be from 1 to 12`,
+		"0 3 5-1 * * 1h":          `invalid cron expression "0 3 5-1 * *": day of the month: invalid range "5-1"`,
+		"*/0 3 * * * 1h":          `invalid cron expression "*/0 3 * * *": minute: invalid step "0"`,
+		"0 3 * * * 30s":           `invalid duration "30s" of "0 3 * * * 30s", must be a minute or more`,
+		"0 3 31 feb * 1h":         `cron expression "0 3 31 feb *" never matches`,
+		"0 3 * * mon-fri forever": `invalid duration "forever" of "0 3 * * mon-fri forever", must be a minute or more`,
+	} {
+		_, err := parseMaintenanceWindows(s)
+		require.EqualError(t, err, msg, s)
+	}
+}
+
+func TestCronNextMatch(t *testing.T) {
+	// a sunday
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	at := func(d, h, m int) time.Time {
+		return day.Add(time.Duration(d)*24*time.Hour + time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+	}
+	cases := map[string]struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		"same minute":      {expr: "0 3 * * *", from: at(0, 3, 0), want: at(0, 3, 0)},
+		"rounded up":       {expr: "* * * * *", from: at(0, 3, 0).Add(time.Second), want: at(0, 3, 1)},
+		"next day":         {expr: "0 3 * * *", from: at(0, 3, 1), want: at(1, 3, 0)},
+		"step":             {expr: "*/15 3 * * *", from: at(0, 3, 16), want: at(0, 3, 30)},
+		"day of the week":  {expr: "30 2 * * sat", from: at(0, 0, 0), want: at(6, 2, 30)},
+		"sunday as 7":      {expr: "0 0 * * 7", from: at(0, 0, 1), want: at(7, 0, 0)},
+		"either day":       {expr: "0 0 12 * mon", from: at(0, 0, 1), want: at(1, 0, 0)},
+		"day of the month": {expr: "0 0 12 * *", from: at(0, 0, 1), want: at(2, 0, 0)},
+		"month":            {expr: "0 0 1 jun *", from: at(0, 0, 0), want: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		"list and range":   {expr: "0 1,22-23 * * *", from: at(0, 2, 0), want: at(0, 22, 0)},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			c, err := parseCron(tc.expr)
+			require.NoError(t, err)
+			got, ok := c.nextMatch(tc.from)
+			require.True(t, ok)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestMaintenanceWindowsNext(t *testing.T) {
+	// a sunday
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	at := func(h, m int) time.Time { return day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute) }
+
+	ws, err := parseMaintenanceWindows("02:00-04:00; 0 23 * * sun 2h")
+	require.NoError(t, err)
+	next := func(from time.Time) time.Time {
+		at, ok := ws.next(from)
+		require.True(t, ok)
+		return at
+	}
+	require.Equal(t, at(2, 0), next(at(1, 0)))
+	require.Equal(t, at(3, 0), next(at(3, 0)))
+	require.Equal(t, at(23, 0), next(at(4, 0)))
+	// the cron window lasts past midnight, into monday
+	require.Equal(t, at(24, 30), next(at(24, 30)))
+	require.Equal(t, at(26, 0), next(at(25, 0)))
+	require.True(t, ws.contains(at(23, 59)))
+	require.False(t, ws.contains(at(12, 0)))
+
+	var anytime MaintenanceWindows
+	require.True(t, anytime.contains(at(12, 0)))
+}
+
+func TestNextRestartTime(t *testing.T) {
+	// a sunday
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	at := func(d, h, m int) time.Time {
+		return day.Add(time.Duration(d)*24*time.Hour + time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+	}
+	saturdays, err := parseMaintenanceWindows("0 3 * * sat 3h")
+	require.NoError(t, err)
+
+	cfg := &Config{RestartWindow: &RestartWindow{Start: 2 * time.Hour, End: 4 * time.Hour}, MaintenanceWindows: saturdays}
+	got, ok := cfg.nextRestartTime(at(0, 1, 0))
+	require.True(t, ok)
+	require.Equal(t, at(6, 3, 0), got)
+
+	cfg.RestartWindow = nil
+	got, ok = cfg.nextRestartTime(at(6, 5, 0))
+	require.True(t, ok)
+	require.Equal(t, at(6, 5, 0), got)
+
+	// a restart window the maintenance windows never overlap
+	cfg.RestartWindow = &RestartWindow{Start: 12 * time.Hour, End: 13 * time.Hour}
+	_, ok = cfg.nextRestartTime(at(0, 1, 0))
+	require.False(t, ok)
+}
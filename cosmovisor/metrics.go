@@ -0,0 +1,262 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metrics are the counters and gauges of this process, served on MetricsAddr and pushed to
+// MetricsPushURL
+var metrics = &metricSet{restarts: map[string]float64{}, backups: map[string]float64{}, pushes: make(chan struct{}, 1)}
+
+// Reasons a daemon is launched again, the reason label of cosmovisor_child_restarts_total
+const (
+	restartUpgrade = "upgrade"
+	restartFailure = "failure"
+	restartRequest = "request"
+	// restartSchedule is a restart after DAEMON_RESTART_MAX_UPTIME
+	restartSchedule = "schedule"
+	// restartBackup is a launch after a backup on DAEMON_BACKUP_SCHEDULE
+	restartBackup = "backup"
+	// restartLiveness is a restart of a node that stopped making blocks
+	restartLiveness = "liveness"
+	// restartMemory is a restart of a daemon above DAEMON_MEMORY_RESTART
+	restartMemory = "memory"
+	// restartLeader is a launch after the leader lease was lost and won back
+	restartLeader = "leader"
+)
+
+// metricSet holds the values of the metrics. Gauges about the last upgrade or backup keep
+// their value until the next one.
+type metricSet struct {
+	mutex             sync.Mutex
+	childUp           float64
+	restarts          map[string]float64
+	upgradesApplied   float64
+	upgradesFailed    float64
+	unverified        float64
+	unhealthy         float64
+	lastUpgradeTime   float64
+	lastUpgradeHeight float64
+	backupSeconds     float64
+	backupBytes       float64
+	backupDataBytes   float64
+	backupRatio       float64
+	restartSeconds    float64
+	downtimeSeconds   float64
+	planWatchErrors   float64
+	leader            float64
+	peerLagBlocks     float64
+	// backups counts the data backups by destination
+	backups map[string]float64
+	// phaseSeconds are the durations of the phases of the last upgrade
+	phaseSeconds map[string]float64
+	// upgradeStarted runs since the upgrade the daemon is restarted for was detected
+	upgradeStarted *Stopwatch
+	// pushes tells StartMetricsPush to push the metrics of a lifecycle event right away
+	pushes chan struct{}
+}
+
+func (m *metricSet) update(fn func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	fn()
+}
+
+// lifecycle is update for the changes of a lifecycle event, which are pushed right away
+func (m *metricSet) lifecycle(fn func()) {
+	m.update(fn)
+	select {
+	case m.pushes <- struct{}{}:
+	default:
+	}
+}
+
+// childStarted marks the daemon as running and, after an upgrade, records how long the
+// node was down
+func (m *metricSet) childStarted() {
+	m.lifecycle(func() {
+		m.childUp = 1
+		if m.upgradeStarted != nil {
+			m.restartSeconds = m.upgradeStarted.Elapsed().Seconds()
+			m.upgradeStarted = nil
+		}
+	})
+}
+
+func (m *metricSet) childExited() {
+	m.lifecycle(func() { m.childUp = 0 })
+}
+
+func (m *metricSet) childRestarted(reason string) {
+	m.lifecycle(func() { m.restarts[reason]++ })
+}
+
+// upgradeDetected starts the downtime of an upgrade, which ends when the daemon runs again
+func (m *metricSet) upgradeDetected(sw Stopwatch) {
+	m.update(func() { m.upgradeStarted = &sw })
+}
+
+// upgradeDowntime records the time from the last block before the last upgrade to the
+// first block after it
+func (m *metricSet) upgradeDowntime(d time.Duration) {
+	m.lifecycle(func() { m.downtimeSeconds = d.Seconds() })
+}
+
+func (m *metricSet) upgradeFailed() {
+	m.lifecycle(func() {
+		m.upgradesFailed++
+		m.upgradeStarted = nil
+	})
+}
+
+// upgradeUnverified counts an upgrade the chain didn't apply after the switch
+func (m *metricSet) upgradeUnverified() {
+	m.lifecycle(func() { m.unverified++ })
+}
+
+// upgradeUnhealthy counts an upgrade whose binary failed the health gate
+func (m *metricSet) upgradeUnhealthy() {
+	m.lifecycle(func() { m.unhealthy++ })
+}
+
+func (m *metricSet) upgradeApplied(applied *AppliedUpgrade) {
+	m.lifecycle(func() {
+		m.upgradesApplied++
+		m.setLastUpgrade(applied)
+	})
+}
+
+// setLastUpgrade sets the gauges of the last upgrade, the caller holds the mutex
+func (m *metricSet) setLastUpgrade(applied *AppliedUpgrade) {
+	m.lastUpgradeTime = float64(applied.AppliedAt.Unix())
+	m.lastUpgradeHeight = float64(applied.Height)
+}
+
+// loadLastUpgradeMetrics starts the metrics of the last upgrade out with the upgrade
+// recorded in the home
+func (cfg *Config) loadLastUpgradeMetrics() {
+	if applied, err := cfg.LastUpgrade(); err == nil && applied != nil {
+		metrics.update(func() { metrics.setLastUpgrade(applied) })
+	}
+}
+
+// dataBackedUp records the stats of a data backup
+func (m *metricSet) dataBackedUp(stats *BackupStats) {
+	m.update(func() {
+		m.backupSeconds = stats.DurationSeconds
+		m.backupBytes = float64(stats.Bytes)
+		m.backupDataBytes = float64(stats.DataBytes)
+		m.backupRatio = stats.CompressionRatio
+		m.backups[stats.Destination]++
+	})
+}
+
+// upgradePhases records the durations of the phases of the last upgrade
+func (m *metricSet) upgradePhases(t *UpgradeTimings) {
+	seconds := map[string]float64{}
+	for _, p := range t.Phases {
+		seconds[p.Name] += p.Duration.Seconds()
+	}
+	m.update(func() { m.phaseSeconds = seconds })
+}
+
+// leaderElected records whether this node holds the leader lease
+func (m *metricSet) leaderElected(elected bool) {
+	m.update(func() {
+		m.leader = 0
+		if elected {
+			m.leader = 1
+		}
+	})
+}
+
+// peerLagged records how many blocks the node is behind its reference nodes
+func (m *metricSet) peerLagged(blocks int64) {
+	m.update(func() { m.peerLagBlocks = float64(blocks) })
+}
+
+func (m *metricSet) planWatchFailed() {
+	m.update(func() { m.planWatchErrors++ })
+}
+
+// WriteMetrics writes the metrics of cosmovisor in the Prometheus text format
+func WriteMetrics(w io.Writer) error {
+	var buf bytes.Buffer
+	write := func(name, kind, help string, samples ...string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, s := range samples {
+			fmt.Fprintf(&buf, "%s%s\n", name, s)
+		}
+	}
+	value := func(v float64) string {
+		return " " + formatMetric(v)
+	}
+
+	m := metrics
+	m.mutex.Lock()
+	write("cosmovisor_build_info", "gauge", "The version of cosmovisor.", fmt.Sprintf("{version=%q} 1", Version))
+	write("cosmovisor_child_up", "gauge", "Whether the daemon is running.", value(m.childUp))
+	write("cosmovisor_child_restarts_total", "counter", "Launches of the daemon after an upgrade, a failure, a request, its maximum uptime, a scheduled backup, a stall, its memory use or a lost leader lease.",
+		`{reason="`+restartBackup+`"}`+value(m.restarts[restartBackup]), `{reason="`+restartFailure+`"}`+value(m.restarts[restartFailure]), `{reason="`+restartLeader+`"}`+value(m.restarts[restartLeader]),
+		`{reason="`+restartLiveness+`"}`+value(m.restarts[restartLiveness]),
+		`{reason="`+restartMemory+`"}`+value(m.restarts[restartMemory]), `{reason="`+restartRequest+`"}`+value(m.restarts[restartRequest]),
+		`{reason="`+restartSchedule+`"}`+value(m.restarts[restartSchedule]), `{reason="`+restartUpgrade+`"}`+value(m.restarts[restartUpgrade]))
+	write("cosmovisor_upgrades_applied_total", "counter", "Upgrades switched to.", value(m.upgradesApplied))
+	write("cosmovisor_upgrades_failed_total", "counter", "Upgrades that failed, leaving the old binary current.", value(m.upgradesFailed))
+	write("cosmovisor_upgrades_unverified_total", "counter", "Upgrades switched to that the chain didn't apply, with DAEMON_VERIFY_UPGRADE.", value(m.unverified))
+	write("cosmovisor_upgrades_unhealthy_total", "counter", "Upgrades whose binary failed the health gate, with DAEMON_HEALTH_GATE_BLOCKS.", value(m.unhealthy))
+	write("cosmovisor_last_upgrade_timestamp_seconds", "gauge", "When the last upgrade was switched to, in seconds since the epoch.", value(m.lastUpgradeTime))
+	write("cosmovisor_last_upgrade_height", "gauge", "The height of the last upgrade switched to.", value(m.lastUpgradeHeight))
+	write("cosmovisor_upgrade_restart_seconds", "gauge", "The time from detecting the last upgrade to running its binary.", value(m.restartSeconds))
+	write("cosmovisor_upgrade_downtime_seconds", "gauge", "The time from the last block before the last upgrade to the first block after it.", value(m.downtimeSeconds))
+	phases := make([]string, 0, len(m.phaseSeconds))
+	for phase := range m.phaseSeconds {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	for i, phase := range phases {
+		phases[i] = fmt.Sprintf("{phase=%q}", phase) + value(m.phaseSeconds[phase])
+	}
+	write("cosmovisor_upgrade_phase_seconds", "gauge", "The duration of each phase of the last upgrade.", phases...)
+	write("cosmovisor_data_backup_duration_seconds", "gauge", "The duration of the last data backup.", value(m.backupSeconds))
+	write("cosmovisor_data_backup_size_bytes", "gauge", "The size of the last data backup.", value(m.backupBytes))
+	write("cosmovisor_data_backup_data_bytes", "gauge", "The size of the files the last data backup backed up.", value(m.backupDataBytes))
+	write("cosmovisor_data_backup_compression_ratio", "gauge", "The size of the files the last data backup backed up by the size of the backup.", value(m.backupRatio))
+	destinations := make([]string, 0, len(m.backups))
+	for dest := range m.backups {
+		destinations = append(destinations, dest)
+	}
+	sort.Strings(destinations)
+	for i, dest := range destinations {
+		destinations[i] = fmt.Sprintf("{destination=%q}", dest) + value(m.backups[dest])
+	}
+	write("cosmovisor_data_backups_total", "counter", "Data backups made, by destination: local or the scheme of DAEMON_DATA_BACKUP_DEST.", destinations...)
+	write("cosmovisor_leader", "gauge", "Whether this node holds the leader lease, with DAEMON_LEADER_ELECTION.", value(m.leader))
+	write("cosmovisor_peer_lag_blocks", "gauge", "How many blocks the node is behind its reference nodes, with DAEMON_PEER_RPCS.", value(m.peerLagBlocks))
+	write("cosmovisor_plan_watch_errors_total", "counter", "Failures to watch or read the plan file of the daemon.", value(m.planWatchErrors))
+	m.mutex.Unlock()
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// formatMetric formats a sample value as Prometheus parses it
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// MetricsHandler serves the metrics of cosmovisor, for programs mounting it on their own
+// HTTP server
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = WriteMetrics(w)
+	})
+}
@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// resetMetrics starts the test from zero and restores the metrics of the package after it
+func resetMetrics(t *testing.T) {
+	saved := metrics
+	metrics = &metricSet{restarts: map[string]float64{}, backups: map[string]float64{}, pushes: make(chan struct{}, 1)}
+	t.Cleanup(func() { metrics = saved })
+}
+
+func TestMetrics(t *testing.T) {
+	resetMetrics(t)
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+
+	metrics.upgradeDetected(Stopwatch{start: time.Now().Add(-3 * time.Second)})
+	cfg.recordUpgrade(&UpgradeInfo{Name: "chain2", Height: 49}, cfg.GenesisBin())
+	metrics.childRestarted(restartUpgrade)
+	metrics.childStarted()
+	metrics.childRestarted(restartFailure)
+	metrics.childRestarted(restartFailure)
+	metrics.planWatchFailed()
+	metrics.upgradeFailed()
+
+	timings := NewUpgradeTimings("chain3")
+	phase := timings.Phase("data-backup")
+	phase.Set("mode", string(DataBackupArchive))
+	newBackupStats(DataBackupArchive, time.Second, []BackupFile{{Path: "a", Size: 3072}, {Path: "b", Size: 1024}}, 1024, backupDestLocal).annotate(phase)
+	phase.End(nil)
+	stats := backupStatsOf(phase)
+	require.Equal(t, &BackupStats{Mode: DataBackupArchive, DurationSeconds: phase.Duration.Seconds(), DataBytes: 4096, Bytes: 1024, CompressionRatio: 4, Destination: backupDestLocal}, stats)
+	metrics.dataBackedUp(stats)
+	timings.End(nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	stop := serveHTTP(cfg, l, MetricsHandler())
+	defer stop()
+	resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("Content-Type"), "text/plain; version=0.0.4")
+	bz, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	out := string(bz)
+
+	last, err := cfg.LastUpgrade()
+	require.NoError(t, err)
+	for _, line := range []string{
+		"# TYPE cosmovisor_child_restarts_total counter\n",
+		"cosmovisor_child_up 1\n",
+		`cosmovisor_child_restarts_total{reason="failure"} 2` + "\n",
+		`cosmovisor_child_restarts_total{reason="upgrade"} 1` + "\n",
+		"cosmovisor_upgrades_applied_total 1\n",
+		"cosmovisor_upgrades_failed_total 1\n",
+		"cosmovisor_last_upgrade_height 49\n",
+		"cosmovisor_last_upgrade_timestamp_seconds " + formatMetric(float64(last.AppliedAt.Unix())) + "\n",
+		"cosmovisor_data_backup_size_bytes 1024\n",
+		"cosmovisor_data_backup_data_bytes 4096\n",
+		"cosmovisor_data_backup_compression_ratio 4\n",
+		`cosmovisor_data_backups_total{destination="local"} 1` + "\n",
+		"cosmovisor_plan_watch_errors_total 1\n",
+		`cosmovisor_upgrade_phase_seconds{phase="data-backup"} ` + formatMetric(phase.Duration.Seconds()) + "\n",
+		`cosmovisor_build_info{version="` + Version + `"} 1` + "\n",
+	} {
+		require.Contains(t, out, line)
+	}
+	require.Regexp(t, `cosmovisor_upgrade_restart_seconds 3\.\d+\n`, out)
+	require.Regexp(t, `cosmovisor_data_backup_duration_seconds [0-9.e-]+\n`, out)
+
+	metrics.childExited()
+	require.Equal(t, float64(0), metrics.childUp)
+}
+
+func TestServeHTTPLastUpgrade(t *testing.T) {
+	resetMetrics(t)
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", MetricsAddr: "127.0.0.1:0"}
+	cfg.recordUpgrade(&UpgradeInfo{Name: "chain2", Height: 49}, cfg.GenesisBin())
+	// a new cosmovisor starts with no upgrade applied by itself
+	metrics = &metricSet{restarts: map[string]float64{}}
+
+	stop, err := ServeHTTP(cfg)
+	require.NoError(t, err)
+	stop()
+	require.Equal(t, float64(49), metrics.lastUpgradeHeight)
+	require.Equal(t, float64(0), metrics.upgradesApplied)
+
+	cfg.MetricsAddr = "127.0.0.1:-1"
+	_, err = ServeHTTP(cfg)
+	require.Error(t, err)
+}
@@ -0,0 +1,138 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultMetricsPushInterval is how often the metrics are pushed to MetricsPushURL
+	defaultMetricsPushInterval = 15 * time.Second
+	// metricsPushTimeout bounds each push
+	metricsPushTimeout = 10 * time.Second
+	// metricsPushJob is the job label of the pushed metrics
+	metricsPushJob = "cosmovisor"
+)
+
+// validPushURL returns an error if u isn't the http(s) URL of a Pushgateway
+func validPushURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%q must be an http:// or https:// URL", u)
+	}
+	return nil
+}
+
+// metricsPushInterval is how often the metrics are pushed
+func (cfg *Config) metricsPushInterval() time.Duration {
+	if cfg.MetricsPushInterval <= 0 {
+		return defaultMetricsPushInterval
+	}
+	return cfg.MetricsPushInterval
+}
+
+// metricsPushInstance is the instance label of the pushed metrics, the host name by default
+func (cfg *Config) metricsPushInstance() string {
+	if cfg.MetricsPushInstance != "" {
+		return cfg.MetricsPushInstance
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "localhost"
+	}
+	return host
+}
+
+// pushGroupURL is the URL of the group of the metrics of this node on the Pushgateway:
+// job, instance and daemon identify it
+func (cfg *Config) pushGroupURL() string {
+	u := strings.TrimRight(cfg.MetricsPushURL, "/") + "/metrics"
+	for _, label := range [][2]string{{"job", metricsPushJob}, {"instance", cfg.metricsPushInstance()}, {"daemon", cfg.Name}} {
+		u += pushLabelPath(label[0], label[1])
+	}
+	return u
+}
+
+// pushLabelPath encodes a label of the grouping key, in base64 if the value can't be a path
+// segment as it is
+func pushLabelPath(name, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		return "/" + name + "@base64/" + orDefault(base64.RawURLEncoding.EncodeToString([]byte(value)), "=")
+	}
+	return "/" + name + "/" + url.PathEscape(value)
+}
+
+// pushMetrics replaces the metrics of the group of this node on the Pushgateway with the
+// current ones
+func (cfg *Config) pushMetrics(client *http.Client) error {
+	var buf bytes.Buffer
+	if err := WriteMetrics(&buf); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, cfg.pushGroupURL(), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("the Pushgateway answered %s", resp.Status)
+	}
+	return nil
+}
+
+// StartMetricsPush pushes the metrics to MetricsPushURL every MetricsPushInterval and as soon
+// as the daemon starts, exits, restarts or is upgraded, for nodes Prometheus can't scrape.
+// The first failure in a row is logged. stop pushes the metrics one last time.
+func StartMetricsPush(cfg *Config) (stop func()) {
+	if cfg.MetricsAddr == "" {
+		cfg.loadLastUpgradeMetrics()
+	}
+	client := &http.Client{Timeout: metricsPushTimeout}
+	failing := false
+	push := func() {
+		err := cfg.pushMetrics(client)
+		switch {
+		case err != nil && !failing:
+			logger.Warnf("pushing the metrics to %s: %v", cfg.MetricsPushURL, err)
+		case err == nil && failing:
+			logger.Infof("pushing the metrics to %s again", cfg.MetricsPushURL)
+		}
+		failing = err != nil
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	goGuarded(cfg, func() {
+		defer close(stopped)
+		ticker := time.NewTicker(cfg.metricsPushInterval())
+		defer ticker.Stop()
+		for {
+			push()
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			case <-metrics.pushes:
+			}
+		}
+	})
+	return func() {
+		close(done)
+		<-stopped
+		push()
+	}
+}
@@ -0,0 +1,416 @@
+package cosmovisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	notificationsDir = "notifications"
+	sentLogFile      = "sent.json"
+
+	// defaultNotifyQueueLength is how many events a destination may fall behind before the
+	// oldest are dropped
+	defaultNotifyQueueLength = 100
+	// defaultNotifyInterval is the minimum time between two sends to a destination
+	defaultNotifyInterval = time.Second
+	// notifyAttempts is how often a failing send is tried before the event is given up
+	notifyAttempts = 3
+	// sentLogSize is the number of event ids remembered per destination
+	sentLogSize = 1000
+)
+
+// Event types sent to notifiers
+const (
+	EventUpgradeDetected   = "upgrade_detected"
+	EventUpgradeApplied    = "upgrade_applied"
+	EventUpgradeFailed     = "upgrade_failed"
+	EventUpgradeRolledBack = "upgrade_rolled_back"
+	EventHotfixApplied     = "hotfix_applied"
+	EventHotfixRejected    = "hotfix_rejected"
+	EventQueueConflict     = "queue_conflict"
+	EventCrash             = "crash"
+	EventNodeStalled       = "node_stalled"
+	EventDaemonFailed      = "daemon_failed"
+	EventsDropped          = "events_dropped"
+)
+
+// Event is a lifecycle event of cosmovisor. Events with the same ID are delivered at most
+// once to each destination, also across restarts of cosmovisor.
+type Event struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Upgrade string    `json:"upgrade,omitempty"`
+	Height  int64     `json:"height,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	// Fields are the details of the event for tools, e.g. the binary or the duration
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// eventSeq makes the IDs of NewEvent unique within the process
+var eventSeq uint64
+
+// NewEvent creates an event with a new ID, for events that never repeat
+func NewEvent(typ, upgrade, message string) Event {
+	now := NowUTC()
+	id := fmt.Sprintf("%s/%s/%s-%d", typ, upgrade, FormatTimestamp(now), atomic.AddUint64(&eventSeq, 1))
+	return Event{ID: id, Type: typ, Upgrade: upgrade, Message: message, Time: now}
+}
+
+// Notifier delivers events to one destination
+type Notifier interface {
+	// Destination names the destination, it must be unique and stable across restarts
+	Destination() string
+	Notify(Event) error
+}
+
+// NotifierOptions tune the delivery to one destination
+type NotifierOptions struct {
+	// QueueLength bounds the events waiting for the destination, the oldest are dropped first
+	QueueLength int
+	// Interval is the minimum time between two sends
+	Interval time.Duration
+}
+
+// Dispatcher is the single entry point for events. Each destination gets its own queue,
+// drained in order by one goroutine, so events never overtake each other or race with retries.
+type Dispatcher struct {
+	mutex   sync.Mutex
+	dests   []*destination
+	sent    *sentLog
+	pending sync.WaitGroup
+}
+
+// NewDispatcher creates a dispatcher remembering the sent events in sentFile.
+// Without a file, deduplication only holds until cosmovisor exits.
+func NewDispatcher(sentFile string) *Dispatcher {
+	return newDispatcher(sentFile, fsGuard{})
+}
+
+// newDispatcher is NewDispatcher, writing the sent log through the write guard
+func newDispatcher(sentFile string, fs fsGuard) *Dispatcher {
+	return &Dispatcher{sent: loadSentLog(sentFile, fs)}
+}
+
+// Register adds a notifier, which receives the events dispatched from now on
+func (d *Dispatcher) Register(n Notifier, opts NotifierOptions) {
+	if opts.QueueLength <= 0 {
+		opts.QueueLength = defaultNotifyQueueLength
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultNotifyInterval
+	}
+	dest := &destination{notifier: n, opts: opts, sent: d.sent, pending: &d.pending}
+	dest.wake = sync.NewCond(&dest.mutex)
+	d.mutex.Lock()
+	d.dests = append(d.dests, dest)
+	d.mutex.Unlock()
+	go dest.run()
+}
+
+// Unregister removes the notifier, which still receives the events queued for it
+func (d *Dispatcher) Unregister(n Notifier) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i, dest := range d.dests {
+		if dest.notifier != n {
+			continue
+		}
+		d.dests = append(d.dests[:i:i], d.dests[i+1:]...)
+		dest.mutex.Lock()
+		dest.closed = true
+		dest.wake.Signal()
+		dest.mutex.Unlock()
+		return
+	}
+}
+
+// Dispatch queues the event for every destination, it never blocks
+func (d *Dispatcher) Dispatch(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = NowUTC()
+	}
+	d.mutex.Lock()
+	dests := d.dests
+	d.mutex.Unlock()
+	for _, dest := range dests {
+		dest.enqueue(ev)
+	}
+}
+
+// Flush waits up to timeout for the queued events to be delivered
+func (d *Dispatcher) Flush(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		d.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// destination is the queue of one notifier
+type destination struct {
+	notifier Notifier
+	opts     NotifierOptions
+	sent     *sentLog
+	pending  *sync.WaitGroup
+
+	mutex   sync.Mutex
+	wake    *sync.Cond
+	queue   []Event
+	dropped int
+	last    Stopwatch
+	// closed ends the queue once it is drained
+	closed bool
+}
+
+func (q *destination) enqueue(ev Event) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.sent.has(q.notifier.Destination(), ev.ID) {
+		return
+	}
+	for _, queued := range q.queue {
+		if queued.ID == ev.ID {
+			return
+		}
+	}
+	q.pending.Add(1)
+	if len(q.queue) >= q.opts.QueueLength {
+		q.queue = q.queue[1:]
+		q.dropped++
+		q.pending.Done()
+	}
+	q.queue = append(q.queue, ev)
+	q.wake.Signal()
+}
+
+// next waits for the next event. Dropped events are reported before the events after them.
+// open is false once the queue is closed and drained.
+func (q *destination) next() (ev Event, queued, open bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.queue) == 0 {
+		if q.closed {
+			return Event{}, false, false
+		}
+		q.wake.Wait()
+	}
+	if q.dropped > 0 {
+		summary := NewEvent(EventsDropped, "", fmt.Sprintf("%d events dropped", q.dropped))
+		q.dropped = 0
+		return summary, false, true
+	}
+	ev = q.queue[0]
+	q.queue = q.queue[1:]
+	// record the event before sending it: a crash right after the send must not repeat it,
+	// and the same event dispatched again meanwhile is not queued twice
+	if err := q.sent.add(q.notifier.Destination(), ev.ID); err != nil {
+		logger.Warnf("recording notification %s: %v", ev.ID, err)
+	}
+	return ev, true, true
+}
+
+func (q *destination) run() {
+	for {
+		ev, queued, open := q.next()
+		if !open {
+			return
+		}
+		q.send(ev)
+		if queued {
+			q.pending.Done()
+		}
+	}
+}
+
+// send delivers the event at most once, retrying failures in place so order is kept
+func (q *destination) send(ev Event) {
+	dest := q.notifier.Destination()
+	for attempt := 1; ; attempt++ {
+		if wait := q.opts.Interval - q.last.Elapsed(); q.last.running() && wait > 0 {
+			time.Sleep(wait)
+		}
+		q.last = StartStopwatch()
+		err := q.deliver(ev)
+		if err == nil {
+			return
+		}
+		if attempt == notifyAttempts {
+			logger.Errorf("giving up notifying %s of %s: %v", dest, ev.ID, err)
+			return
+		}
+		logger.Warnf("notifying %s of %s: %v", dest, ev.ID, err)
+	}
+}
+
+// deliver calls the notifier, a panicking notifier must not take cosmovisor down
+func (q *destination) deliver(ev Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("notifier panicked: %v", r)
+		}
+	}()
+	return q.notifier.Notify(ev)
+}
+
+// sentLog remembers the ids of the events sent to each destination
+type sentLog struct {
+	mutex sync.Mutex
+	path  string
+	fs    fsGuard
+	ids   map[string][]string
+}
+
+func loadSentLog(path string, fs fsGuard) *sentLog {
+	l := &sentLog{path: path, fs: fs, ids: map[string][]string{}}
+	if path == "" {
+		return l
+	}
+	bz, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("reading sent notifications: %v", err)
+		}
+		return l
+	}
+	if err := json.Unmarshal(bz, &l.ids); err != nil {
+		logger.Warnf("reading sent notifications %s: %v", path, err)
+		l.ids = map[string][]string{}
+	}
+	return l
+}
+
+func (l *sentLog) has(dest, id string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, sent := range l.ids[dest] {
+		if sent == id {
+			return true
+		}
+	}
+	return false
+}
+
+// add records the id and persists the log
+func (l *sentLog) add(dest, id string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	ids := append(l.ids[dest], id)
+	if len(ids) > sentLogSize {
+		ids = ids[len(ids)-sentLogSize:]
+	}
+	l.ids[dest] = ids
+	if l.path == "" {
+		return nil
+	}
+
+	bz, err := json.Marshal(l.ids)
+	if err != nil {
+		return err
+	}
+	if err := l.fs.mkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := l.fs.writeFile(tmp, bz, 0644); err != nil {
+		return err
+	}
+	return l.fs.rename(tmp, l.path)
+}
+
+var notifications struct {
+	once       sync.Once
+	mutex      sync.Mutex
+	dispatcher *Dispatcher
+	notifiers  []registeredNotifier
+}
+
+type registeredNotifier struct {
+	notifier Notifier
+	opts     NotifierOptions
+}
+
+// RegisterNotifier adds a notifier for the events of this cosmovisor process, typically from
+// an init function. A notifier added after the first event receives the events from then on.
+func RegisterNotifier(n Notifier, opts NotifierOptions) {
+	notifications.mutex.Lock()
+	defer notifications.mutex.Unlock()
+	notifications.notifiers = append(notifications.notifiers, registeredNotifier{n, opts})
+	if notifications.dispatcher != nil {
+		notifications.dispatcher.Register(n, opts)
+	}
+}
+
+// UnregisterNotifier removes a notifier added with RegisterNotifier. The events already
+// queued for it are still delivered.
+func UnregisterNotifier(n Notifier) {
+	notifications.mutex.Lock()
+	defer notifications.mutex.Unlock()
+	for i, r := range notifications.notifiers {
+		if r.notifier == n {
+			notifications.notifiers = append(notifications.notifiers[:i:i], notifications.notifiers[i+1:]...)
+			break
+		}
+	}
+	if notifications.dispatcher != nil {
+		notifications.dispatcher.Unregister(n)
+	}
+}
+
+// notify records the event and dispatches it to the registered notifiers. The dispatcher
+// is created on the first event, remembering sent events in the home of cfg.
+func notify(cfg *Config, ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = NowUTC()
+	}
+	recordEvent(cfg, ev)
+	notifications.once.Do(func() {
+		var path string
+		if cfg != nil {
+			path = filepath.Join(cfg.StateDir(), notificationsDir, sentLogFile)
+		}
+		d := newDispatcher(path, cfg.fs())
+		notifications.mutex.Lock()
+		for _, r := range notifications.notifiers {
+			d.Register(r.notifier, r.opts)
+		}
+		notifications.dispatcher = d
+		notifications.mutex.Unlock()
+	})
+	notifications.mutex.Lock()
+	d := notifications.dispatcher
+	notifications.mutex.Unlock()
+	d.Dispatch(ev)
+}
+
+// notifyUpgrade sends the outcome of an upgrade
+func notifyUpgrade(cfg *Config, name string, err error) {
+	if err != nil {
+		notify(cfg, Event{ID: EventUpgradeFailed + "/" + name, Type: EventUpgradeFailed, Upgrade: name,
+			Message: fmt.Sprintf("upgrade %q failed: %v", name, err)})
+		return
+	}
+	notify(cfg, Event{ID: EventUpgradeApplied + "/" + name, Type: EventUpgradeApplied, Upgrade: name,
+		Message: fmt.Sprintf("upgrade %q applied", name)})
+}
+
+// FlushNotifications waits up to timeout for the events sent so far to be delivered
+func FlushNotifications(timeout time.Duration) {
+	notifications.mutex.Lock()
+	d := notifications.dispatcher
+	notifications.mutex.Unlock()
+	if d != nil {
+		d.Flush(timeout)
+	}
+}
@@ -0,0 +1,191 @@
+package cosmovisor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingNotifier records the events it receives, optionally failing or blocking first
+type recordingNotifier struct {
+	mutex    sync.Mutex
+	received []Event
+	// failures fails the first attempts of the event with this id
+	failID   string
+	failures int
+	// gate blocks the first send until it is closed
+	gate chan struct{}
+	once sync.Once
+}
+
+func (n *recordingNotifier) Destination() string { return "recorder" }
+
+func (n *recordingNotifier) Notify(ev Event) error {
+	if n.gate != nil {
+		n.once.Do(func() { <-n.gate })
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if ev.ID == n.failID && n.failures > 0 {
+		n.failures--
+		return errors.New("temporary failure")
+	}
+	n.received = append(n.received, ev)
+	return nil
+}
+
+func (n *recordingNotifier) ids() []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	var ids []string
+	for _, ev := range n.received {
+		if ev.Type == EventsDropped {
+			ids = append(ids, ev.Message)
+		} else {
+			ids = append(ids, ev.ID)
+		}
+	}
+	return ids
+}
+
+func burst(from, to int) (events []Event, ids []string) {
+	for i := from; i < to; i++ {
+		id := fmt.Sprintf("event-%d", i)
+		events = append(events, Event{ID: id, Type: EventUpgradeDetected})
+		ids = append(ids, id)
+	}
+	return events, ids
+}
+
+func TestDispatcherKeepsOrder(t *testing.T) {
+	d := NewDispatcher("")
+	n := &recordingNotifier{failID: "event-3", failures: 2}
+	d.Register(n, NotifierOptions{Interval: time.Nanosecond})
+
+	events, ids := burst(0, 50)
+	var wg sync.WaitGroup
+	for _, ev := range events {
+		d.Dispatch(ev)
+		// the same event dispatched concurrently, e.g. by a retry, is sent once
+		wg.Add(1)
+		go func(ev Event) {
+			defer wg.Done()
+			d.Dispatch(ev)
+		}(ev)
+		wg.Wait()
+	}
+	d.Flush(5 * time.Second)
+	require.Equal(t, ids, n.ids())
+}
+
+func TestDispatcherDedupAcrossRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sentFile := filepath.Join(dir, "notifications", "sent.json")
+
+	first := &recordingNotifier{}
+	d := NewDispatcher(sentFile)
+	d.Register(first, NotifierOptions{Interval: time.Nanosecond})
+	events, ids := burst(0, 3)
+	for _, ev := range events {
+		d.Dispatch(ev)
+	}
+	d.Flush(5 * time.Second)
+	require.Equal(t, ids, first.ids())
+
+	// cosmovisor restarted and fires the same events again, plus a new one
+	second := &recordingNotifier{}
+	d = NewDispatcher(sentFile)
+	d.Register(second, NotifierOptions{Interval: time.Nanosecond})
+	events, _ = burst(0, 4)
+	for _, ev := range events {
+		d.Dispatch(ev)
+	}
+	d.Flush(5 * time.Second)
+	require.Equal(t, []string{"event-3"}, second.ids())
+}
+
+func TestDispatcherDropsOldest(t *testing.T) {
+	d := NewDispatcher("")
+	n := &recordingNotifier{gate: make(chan struct{})}
+	d.Register(n, NotifierOptions{QueueLength: 5, Interval: time.Nanosecond})
+
+	// the first event is taken and blocks in the notifier, then 20 more arrive
+	events, _ := burst(0, 21)
+	d.Dispatch(events[0])
+	require.Eventually(t, func() bool {
+		q := d.dests[0]
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		return len(q.queue) == 0
+	}, time.Second, time.Millisecond)
+	for _, ev := range events[1:] {
+		d.Dispatch(ev)
+	}
+	close(n.gate)
+	d.Flush(5 * time.Second)
+
+	_, kept := burst(16, 21)
+	require.Equal(t, append([]string{"event-0", "15 events dropped"}, kept...), n.ids())
+}
+
+func TestDispatcherRateLimit(t *testing.T) {
+	d := NewDispatcher("")
+	n := &recordingNotifier{}
+	d.Register(n, NotifierOptions{Interval: 20 * time.Millisecond})
+
+	start := time.Now()
+	events, ids := burst(0, 5)
+	for _, ev := range events {
+		d.Dispatch(ev)
+	}
+	d.Flush(5 * time.Second)
+	require.Equal(t, ids, n.ids())
+	require.True(t, time.Since(start) >= 80*time.Millisecond, "sent within %s", time.Since(start))
+}
+
+func TestDispatcherUnregister(t *testing.T) {
+	d := NewDispatcher("")
+	n := &recordingNotifier{gate: make(chan struct{})}
+	d.Register(n, NotifierOptions{Interval: time.Nanosecond})
+
+	// the events queued before the notifier is removed are still delivered
+	events, ids := burst(0, 3)
+	for _, ev := range events {
+		d.Dispatch(ev)
+	}
+	d.Unregister(n)
+	d.Dispatch(Event{ID: "event-3", Type: EventUpgradeDetected})
+	close(n.gate)
+	d.Flush(5 * time.Second)
+	require.Equal(t, ids, n.ids())
+	require.Empty(t, d.dests)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var received Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		if received.Type == EventCrash {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	w := NewWebhookNotifier(server.URL)
+	require.NoError(t, w.Notify(Event{ID: "upgrade_applied/chain2", Type: EventUpgradeApplied, Upgrade: "chain2"}))
+	require.Equal(t, "chain2", received.Upgrade)
+	require.Error(t, w.Notify(NewEvent(EventCrash, "", "boom")))
+}
@@ -0,0 +1,213 @@
+//go:build otel
+// +build otel
+
+package cosmovisor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The otel build tag exports every upgrade as a trace via OTLP/HTTP (JSON encoding), if an
+// endpoint is configured with the standard OTEL_EXPORTER_OTLP_* environment variables.
+func init() {
+	endpoint := otlpTracesEndpoint()
+	if endpoint == "" {
+		return
+	}
+	RegisterUpgradeTraceExporter(newOTLPTraceExporter(endpoint))
+}
+
+// newOTLPTraceExporter creates the tracer provider lazily, on the first finished upgrade
+func newOTLPTraceExporter(endpoint string) UpgradeTraceExporter {
+	var (
+		once     sync.Once
+		provider *sdktrace.TracerProvider
+	)
+	return func(t *UpgradeTimings) {
+		once.Do(func() {
+			exporter := &otlpJSONExporter{
+				endpoint: endpoint,
+				headers:  parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")),
+				client:   &http.Client{Timeout: otlpTimeout()},
+			}
+			provider = sdktrace.NewTracerProvider(
+				sdktrace.WithSyncer(exporter),
+				sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(rootName))),
+			)
+		})
+		exportUpgradeSpans(context.Background(), provider.Tracer(rootName), t)
+	}
+}
+
+// exportUpgradeSpans emits a span for the upgrade with a child span for every phase
+func exportUpgradeSpans(ctx context.Context, tracer trace.Tracer, t *UpgradeTimings) {
+	ctx, root := tracer.Start(ctx, "upgrade",
+		trace.WithTimestamp(t.Start),
+		trace.WithAttributes(attribute.String("upgrade.name", t.Name)),
+	)
+	for _, p := range t.Phases {
+		_, span := tracer.Start(ctx, p.Name, trace.WithTimestamp(p.Start))
+		for k, v := range p.Attributes {
+			span.SetAttributes(attribute.String(k, v))
+		}
+		endSpan(span, p.Err, p.Start.Add(p.Duration))
+	}
+	endSpan(root, t.Err, t.Start.Add(t.Duration))
+}
+
+func endSpan(span trace.Span, err error, end time.Time) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// otlpTracesEndpoint returns the URL traces are posted to, or "" if none is configured
+func otlpTracesEndpoint() string {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// otlpTimeout reads OTEL_EXPORTER_OTLP_TIMEOUT (milliseconds), defaulting to 10s
+func otlpTimeout() time.Duration {
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_TRACES_TIMEOUT", "OTEL_EXPORTER_OTLP_TIMEOUT"} {
+		if ms, err := strconv.Atoi(os.Getenv(name)); err == nil && ms > 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+	}
+	return 10 * time.Second
+}
+
+// parseOTLPHeaders parses the comma separated key=value list of OTEL_EXPORTER_OTLP_HEADERS
+func parseOTLPHeaders(s string) map[string]string {
+	headers := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) != "" {
+			headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return headers
+}
+
+// otlpJSONExporter posts spans to an OTLP/HTTP endpoint using the JSON encoding.
+// It avoids pulling the gRPC based OTLP exporters into cosmovisor's dependencies.
+type otlpJSONExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+var _ sdktrace.SpanExporter = (*otlpJSONExporter)(nil)
+
+type otlpKeyValue struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string            `json:"traceId"`
+	SpanID            string            `json:"spanId"`
+	ParentSpanID      string            `json:"parentSpanId,omitempty"`
+	Name              string            `json:"name"`
+	Kind              int               `json:"kind"`
+	StartTimeUnixNano string            `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string            `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue    `json:"attributes,omitempty"`
+	Status            map[string]string `json:"status,omitempty"`
+}
+
+// ExportSpans implements sdktrace.SpanExporter
+func (e *otlpJSONExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	var resourceAttrs []otlpKeyValue
+	if res := spans[0].Resource(); res != nil {
+		resourceAttrs = otlpAttributes(res.Attributes())
+	}
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           span.SpanContext().TraceID().String(),
+			SpanID:            span.SpanContext().SpanID().String(),
+			Name:              span.Name(),
+			Kind:              int(span.SpanKind()),
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime().UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime().UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes()),
+		}
+		if span.Parent().IsValid() {
+			s.ParentSpanID = span.Parent().SpanID().String()
+		}
+		if span.Status().Code == codes.Error {
+			// STATUS_CODE_ERROR
+			s.Status = map[string]string{"code": "2", "message": span.Status().Description}
+		}
+		encoded = append(encoded, s)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource":   map[string]interface{}{"attributes": resourceAttrs},
+			"scopeSpans": []interface{}{map[string]interface{}{"spans": encoded}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("exporting spans: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("exporting spans: %s returned %s", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// Shutdown implements sdktrace.SpanExporter
+func (e *otlpJSONExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func otlpAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	res := make([]otlpKeyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		res = append(res, otlpKeyValue{Key: string(kv.Key), Value: map[string]string{"stringValue": kv.Value.Emit()}})
+	}
+	return res
+}
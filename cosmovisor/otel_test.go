@@ -0,0 +1,113 @@
+//go:build otel
+// +build otel
+
+package cosmovisor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestExportUpgradeSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	// simulate an upgrade that had to download its binary
+	timings := NewUpgradeTimings("chain2")
+	stop := timings.Phase("stop")
+	stop.End(nil)
+	download := timings.Phase("download")
+	download.Set("bytes", "1234")
+	download.End(nil)
+	sw := timings.Phase("switch")
+	sw.Set("binary_sha256", "abcd")
+	sw.End(errors.New("creating current symlink: boom"))
+	timings.Duration = time.Second
+	timings.Err = sw.Err
+
+	exportUpgradeSpans(context.Background(), provider.Tracer("test"), timings)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 4)
+
+	byName := map[string]tracetest.SpanStub{}
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	root := byName["upgrade"]
+	require.Contains(t, root.Attributes, attribute.String("upgrade.name", "chain2"))
+	require.Equal(t, codes.Error, root.Status.Code)
+	require.Equal(t, timings.Start, root.StartTime)
+	require.Equal(t, timings.Start.Add(time.Second), root.EndTime)
+
+	for _, name := range []string{"stop", "download", "switch"} {
+		span, ok := byName[name]
+		require.True(t, ok, name)
+		require.Equal(t, root.SpanContext.SpanID(), span.Parent.SpanID(), name)
+		require.Equal(t, root.SpanContext.TraceID(), span.SpanContext.TraceID(), name)
+	}
+	require.Contains(t, byName["download"].Attributes, attribute.String("bytes", "1234"))
+	require.Contains(t, byName["switch"].Attributes, attribute.String("binary_sha256", "abcd"))
+	require.Equal(t, codes.Error, byName["switch"].Status.Code)
+	require.Equal(t, codes.Unset, byName["stop"].Status.Code)
+}
+
+func TestOTLPJSONExporter(t *testing.T) {
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/traces", r.URL.Path)
+		require.Equal(t, "secret", r.Header.Get("Api-Key"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer server.Close()
+
+	exporter := &otlpJSONExporter{
+		endpoint: server.URL + "/v1/traces",
+		headers:  parseOTLPHeaders("Api-Key=secret"),
+		client:   server.Client(),
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	_, span := provider.Tracer("test").Start(context.Background(), "switch")
+	span.End()
+
+	require.NotNil(t, received)
+	spans := received["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	require.Len(t, spans, 1)
+	require.Equal(t, "switch", spans[0].(map[string]interface{})["name"])
+}
+
+func TestOTLPTracesEndpoint(t *testing.T) {
+	setenv := func(key, value string) {
+		old, ok := os.LookupEnv(key)
+		require.NoError(t, os.Setenv(key, value))
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+
+	setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	require.Equal(t, "", otlpTracesEndpoint())
+
+	setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318/")
+	require.Equal(t, "http://collector:4318/v1/traces", otlpTracesEndpoint())
+
+	setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://tempo:4318/custom")
+	require.Equal(t, "http://tempo:4318/custom", otlpTracesEndpoint())
+}
@@ -0,0 +1,323 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// outputChunkSize is the size of a single read from the child's pipe
+	outputChunkSize = 32 * 1024
+	// defaultConsumerCapacity is the number of chunks a consumer may fall behind before
+	// chunks are dropped for it. Together with outputChunkSize this bounds the memory
+	// held for a consumer to 8 MiB per stream.
+	defaultConsumerCapacity = 256
+	// outputDrainTimeout bounds how long the scanners may take to finish the child's
+	// output once it has exited
+	outputDrainTimeout = 5 * time.Second
+	// partialLineTimeout is how long combined output holds back the start of a line
+	// (like a prompt) before writing it without the rest
+	partialLineTimeout = 100 * time.Millisecond
+)
+
+// OutputStream reads one output pipe of the child in a single goroutine. Every chunk is
+// written synchronously to the primary writer (the console), which keeps the same
+// backpressure as a plain io.Copy, and then offered to each consumer through a bounded
+// buffer. Consumers that fall behind lose chunks instead of stalling the child's pipe,
+// unless they mark a chunk as critical.
+//
+// Chunks offered to consumers end on a line break (unless a single line exceeds the chunk
+// size), so a dropped chunk never takes half a line with it.
+type OutputStream struct {
+	src     io.Reader
+	primary io.Writer
+
+	mutex     sync.Mutex
+	consumers []*OutputConsumer
+	started   bool
+}
+
+// NewOutputStream creates a stream copying src to primary. Consumers must be subscribed
+// before Run is called.
+func NewOutputStream(src io.Reader, primary io.Writer) *OutputStream {
+	return &OutputStream{src: src, primary: primary}
+}
+
+// Subscribe adds a consumer that can fall behind by up to capacity chunks. If critical is
+// set, chunks it returns true for are never dropped: offering them waits until the
+// consumer has room again.
+func (s *OutputStream) Subscribe(name string, capacity int, critical func([]byte) bool) *OutputConsumer {
+	if capacity <= 0 {
+		capacity = defaultConsumerCapacity
+	}
+	c := &OutputConsumer{name: name, chunks: make(chan outputChunk, capacity), critical: critical}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.started {
+		panic("cannot subscribe to a running output stream")
+	}
+	s.consumers = append(s.consumers, c)
+	return c
+}
+
+// Run copies the source until it is exhausted, then closes all consumers.
+// It returns the first read error other than io.EOF.
+func (s *OutputStream) Run() error {
+	s.mutex.Lock()
+	s.started = true
+	consumers := s.consumers
+	s.mutex.Unlock()
+
+	defer func() {
+		// a line held back by combined output is written before the stream counts as done
+		if s.primary != nil {
+			_ = flushOutput(s.primary)
+		}
+		for _, c := range consumers {
+			close(c.chunks)
+		}
+	}()
+
+	// partial is the beginning of a line not yet handed to the consumers
+	var partial []byte
+	for {
+		// every chunk gets a fresh buffer, as consumers keep it after it is handed over
+		buf := make([]byte, len(partial), outputChunkSize)
+		copy(buf, partial)
+		n, err := s.src.Read(buf[len(partial):cap(buf)])
+		if n > 0 {
+			read := buf[len(partial) : len(partial)+n]
+			if s.primary != nil {
+				// the console is the source of truth, a failing console must not stop the consumers
+				_, _ = s.primary.Write(read)
+			}
+
+			buf = buf[:len(partial)+n]
+			cut := bytes.LastIndexByte(buf, '\n') + 1
+			if cut == 0 && len(buf) == cap(buf) {
+				// a single line longer than the chunk, hand it over in pieces
+				cut = len(buf)
+			}
+			partial = append([]byte(nil), buf[cut:]...)
+			if cut > 0 {
+				for _, c := range consumers {
+					c.offer(buf[:cut])
+				}
+			}
+		}
+		if err != nil {
+			if len(partial) > 0 {
+				for _, c := range consumers {
+					c.offer(partial)
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// OutputConsumer is an io.Reader receiving the chunks of an OutputStream
+type OutputConsumer struct {
+	name     string
+	chunks   chan outputChunk
+	critical func([]byte) bool
+
+	// current is the remainder of the chunk being read
+	current []byte
+	// open is set by the producer when the last delivered chunk ended in the middle of a line
+	open bool
+	// gap is set by the producer when a chunk was dropped after an open line
+	gap bool
+	// dropped counts bytes that were dropped because the consumer fell behind
+	dropped uint64
+}
+
+type outputChunk struct {
+	data     []byte
+	afterGap bool
+}
+
+// offer hands the chunk to the consumer, or drops it if its buffer is full and the chunk
+// isn't critical. It is only called from the stream's reader goroutine.
+func (c *OutputConsumer) offer(data []byte) {
+	chunk := outputChunk{data: data, afterGap: c.gap}
+	select {
+	case c.chunks <- chunk:
+		c.delivered(data)
+		return
+	default:
+	}
+
+	if c.critical != nil && c.critical(data) {
+		c.chunks <- chunk
+		c.delivered(data)
+		return
+	}
+	atomic.AddUint64(&c.dropped, uint64(len(data)))
+	c.gap = c.gap || c.open
+}
+
+func (c *OutputConsumer) delivered(data []byte) {
+	c.gap = false
+	c.open = data[len(data)-1] != '\n'
+}
+
+// Name returns the name given on Subscribe
+func (c *OutputConsumer) Name() string {
+	return c.name
+}
+
+// Dropped returns the number of bytes this consumer missed because it fell behind
+func (c *OutputConsumer) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Read implements io.Reader. It returns io.EOF once the stream ended and all buffered
+// chunks were read.
+func (c *OutputConsumer) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(c.current) == 0 {
+		chunk, ok := <-c.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		c.current = chunk.data
+		// after a gap, make sure the open line before it isn't glued to the data after it
+		if chunk.afterGap {
+			p[0] = '\n'
+			n := copy(p[1:], c.current)
+			c.current = c.current[n:]
+			return n + 1, nil
+		}
+	}
+	n := copy(p, c.current)
+	c.current = c.current[n:]
+	return n, nil
+}
+
+// SameWriter returns true if stdout and stderr end up in the same place: the same writer
+// passed twice, or files (like the console or a log file with 2>&1) that are the same.
+func SameWriter(stdout, stderr io.Writer) bool {
+	if stdout == nil || stderr == nil {
+		return false
+	}
+	if t := reflect.TypeOf(stdout); t == reflect.TypeOf(stderr) && t.Comparable() && stdout == stderr {
+		return true
+	}
+	fout, ok := stdout.(*os.File)
+	if !ok {
+		return false
+	}
+	ferr, ok := stderr.(*os.File)
+	if !ok {
+		return false
+	}
+	iout, err := fout.Stat()
+	if err != nil {
+		return false
+	}
+	ierr, err := ferr.Stat()
+	return err == nil && os.SameFile(iout, ierr)
+}
+
+// CombineOutput returns the writers for the child's stdout and stderr when both go to w.
+// Each writes whole lines only, so lines of the two streams are never spliced together.
+// The start of a line is held back until its end arrives, for at most partialLineTimeout.
+// When a stream is flushed at its end, its unterminated last line is ended with a line break.
+func CombineOutput(w io.Writer) (stdout, stderr io.Writer) {
+	out := &combinedOutput{w: w}
+	return &lineWriter{out: out}, &lineWriter{out: out}
+}
+
+// combinedOutput serializes the lines of several streams into one writer
+type combinedOutput struct {
+	mutex sync.Mutex
+	w     io.Writer
+	// openBy is the stream whose line was written without its end, if any
+	openBy *lineWriter
+}
+
+// write writes p for the stream, terminate ends the stream's line if it is left open
+func (c *combinedOutput) write(from *lineWriter, p []byte, terminate bool) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(p) > 0 {
+		if _, err := c.w.Write(p); err != nil {
+			return err
+		}
+		c.openBy = nil
+		if p[len(p)-1] != '\n' {
+			c.openBy = from
+		}
+	}
+	if terminate && c.openBy == from {
+		c.openBy = nil
+		_, err := c.w.Write([]byte{'\n'})
+		return err
+	}
+	return nil
+}
+
+// lineWriter is one stream of a combinedOutput
+type lineWriter struct {
+	out *combinedOutput
+
+	mutex   sync.Mutex
+	pending []byte
+	timer   *time.Timer
+}
+
+// Write passes on the complete lines in p and keeps the rest until its line is complete.
+// A line longer than a chunk is passed on in pieces, as the output streams do.
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.pending = append(l.pending, p...)
+	cut := bytes.LastIndexByte(l.pending, '\n') + 1
+	if len(l.pending)-cut >= outputChunkSize {
+		cut = len(l.pending)
+	}
+	var err error
+	if cut > 0 {
+		err = l.out.write(l, l.pending[:cut], false)
+		l.pending = append([]byte(nil), l.pending[cut:]...)
+	}
+
+	switch {
+	case len(l.pending) == 0 && l.timer != nil:
+		l.timer.Stop()
+		l.timer = nil
+	case len(l.pending) > 0 && l.timer == nil:
+		l.timer = time.AfterFunc(partialLineTimeout, func() { _ = l.flush(false) })
+	}
+	return len(p), err
+}
+
+// Flush is called once the stream ended, it writes and terminates the line held back
+func (l *lineWriter) Flush() error {
+	return l.flush(true)
+}
+
+func (l *lineWriter) flush(terminate bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	err := l.out.write(l, l.pending, terminate)
+	l.pending = nil
+	return err
+}
@@ -0,0 +1,299 @@
+package cosmovisor_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/cosmos-sdk/cosmovisor"
+)
+
+func TestOutputStreamDeliversAll(t *testing.T) {
+	input := strings.Repeat("some log line\n", 10000)
+	var console bytes.Buffer
+	stream := cosmovisor.NewOutputStream(strings.NewReader(input), &console)
+	consumer := stream.Subscribe("test", 0, nil)
+
+	received := make(chan string)
+	go func() {
+		bz, err := ioutil.ReadAll(consumer)
+		require.NoError(t, err)
+		received <- string(bz)
+	}()
+
+	require.NoError(t, stream.Run())
+	require.Equal(t, input, console.String())
+	require.Equal(t, input, <-received)
+	require.Zero(t, consumer.Dropped())
+}
+
+func TestOutputStreamCriticalChunks(t *testing.T) {
+	input := strings.Repeat("noise\n", 100000) + "UPGRADE \"chain2\" NEEDED at height: 49: {}\n" + strings.Repeat("noise\n", 100000)
+	stream := cosmovisor.NewOutputStream(strings.NewReader(input), nil)
+	consumer := stream.Subscribe("scanner", 1, cosmovisor.MayContainUpgrade)
+
+	found := make(chan *cosmovisor.UpgradeInfo)
+	go func() {
+		// a scanner much slower than the stream
+		scan := bufio.NewScanner(consumer)
+		var info *cosmovisor.UpgradeInfo
+		for scan.Scan() {
+			time.Sleep(time.Microsecond)
+			if strings.HasPrefix(scan.Text(), "UPGRADE") {
+				info = &cosmovisor.UpgradeInfo{Name: "chain2"}
+			}
+		}
+		found <- info
+	}()
+
+	require.NoError(t, stream.Run())
+	require.NotNil(t, <-found)
+	require.NotZero(t, consumer.Dropped())
+}
+
+func TestOutputStreamSlowConsumerDrops(t *testing.T) {
+	// 8 MiB of output, a consumer that never reads must not block the stream
+	input := bytes.Repeat([]byte("0123456789abcdef"), 512*1024)
+	var console bytes.Buffer
+	stream := cosmovisor.NewOutputStream(bytes.NewReader(input), &console)
+	stalled := stream.Subscribe("stalled", 1, nil)
+
+	require.NoError(t, stream.Run())
+	require.Equal(t, input, console.Bytes())
+	require.NotZero(t, stalled.Dropped())
+
+	// what was buffered is still readable and the reader sees the end of the stream
+	bz, err := ioutil.ReadAll(stalled)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(input)), uint64(len(bz))+stalled.Dropped())
+}
+
+func TestOutputStreamGapStartsNewLine(t *testing.T) {
+	// a line longer than a chunk, whose first part is buffered and read, then the rest of it
+	// is dropped, then the next line
+	long := strings.Repeat("x", 40*1024)
+	src := &steppedReader{
+		chunks:  []string{long[:32*1024], long[32*1024:] + "\n", "UPGRADE \"next\" NEEDED at height: 1: \n"},
+		pauseAt: 2,
+		reached: make(chan struct{}),
+		proceed: make(chan struct{}),
+	}
+	stream := cosmovisor.NewOutputStream(src, nil)
+	consumer := stream.Subscribe("scanner", 1, nil)
+
+	done := make(chan error)
+	go func() { done <- stream.Run() }()
+
+	// the first two chunks were offered, read the first one to make room
+	<-src.reached
+	buf := make([]byte, 64*1024)
+	n, err := consumer.Read(buf)
+	require.NoError(t, err)
+	close(src.proceed)
+	require.NoError(t, <-done)
+
+	rest, err := ioutil.ReadAll(consumer)
+	require.NoError(t, err)
+	scan := bufio.NewScanner(io.MultiReader(bytes.NewReader(buf[:n]), bytes.NewReader(rest)))
+	scan.Buffer(make([]byte, 64*1024), 64*1024)
+	var lines []string
+	for scan.Scan() {
+		lines = append(lines, scan.Text())
+	}
+	require.NoError(t, scan.Err())
+	require.Equal(t, uint64(8*1024+1), consumer.Dropped())
+	require.Equal(t, []string{long[:32*1024], "UPGRADE \"next\" NEEDED at height: 1: "}, lines)
+}
+
+func TestCombinedOutputKeepsLinesWhole(t *testing.T) {
+	var console bytes.Buffer
+	stdout, stderr := cosmovisor.CombineOutput(&console)
+
+	// each line is written in pieces, the two writers race for the console
+	write := func(w io.WriteCloser, origin string, lines int, last string) {
+		for i := 0; i < lines; i++ {
+			for _, piece := range []string{origin, fmt.Sprintf("-%d-", i), strings.Repeat(origin[:1], i%50), "\n"} {
+				_, err := io.WriteString(w, piece)
+				require.NoError(t, err)
+				runtime.Gosched()
+			}
+		}
+		// an unterminated line at the end of the stream
+		_, err := io.WriteString(w, last)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+
+	outr, outw := io.Pipe()
+	errr, errw := io.Pipe()
+	outStream := cosmovisor.NewOutputStream(outr, stdout)
+	errStream := cosmovisor.NewOutputStream(errr, stderr)
+	outTranscript := outStream.Subscribe("out transcript", 0, nil)
+	errTranscript := errStream.Subscribe("err transcript", 0, nil)
+
+	var wg sync.WaitGroup
+	transcripts := make([][]byte, 2)
+	for i, c := range []*cosmovisor.OutputConsumer{outTranscript, errTranscript} {
+		i, c := i, c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bz, err := ioutil.ReadAll(c)
+			require.NoError(t, err)
+			transcripts[i] = bz
+		}()
+	}
+	// stdout ends long before stderr
+	go write(outw, "out", 100, "out-end")
+	go write(errw, "err", 1000, "err-end")
+	for _, stream := range []*cosmovisor.OutputStream{outStream, errStream} {
+		stream := stream
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, stream.Run())
+		}()
+	}
+	wg.Wait()
+
+	expect := func(origin string, lines int) []string {
+		var expected []string
+		for i := 0; i < lines; i++ {
+			expected = append(expected, fmt.Sprintf("%s-%d-%s", origin, i, strings.Repeat(origin[:1], i%50)))
+		}
+		return append(expected, origin+"-end")
+	}
+	byOrigin := map[string][]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(console.String(), "\n"), "\n") {
+		origin := line[:3]
+		require.Contains(t, []string{"out", "err"}, origin, "line %q was spliced", line)
+		byOrigin[origin] = append(byOrigin[origin], line)
+	}
+	require.Equal(t, expect("out", 100), byOrigin["out"])
+	require.Equal(t, expect("err", 1000), byOrigin["err"])
+
+	// the transcripts only see their own stream
+	require.Equal(t, strings.Join(expect("out", 100), "\n"), string(transcripts[0]))
+	require.Equal(t, strings.Join(expect("err", 1000), "\n"), string(transcripts[1]))
+}
+
+func TestCombinedOutputWritesPrompts(t *testing.T) {
+	console := &lockedBuffer{}
+	stdout, _ := cosmovisor.CombineOutput(console)
+
+	// a prompt never gets the end of its line, it is written anyway
+	_, err := io.WriteString(stdout, "Enter passphrase: ")
+	require.NoError(t, err)
+	require.Empty(t, console.String())
+	require.Eventually(t, func() bool {
+		return console.String() == "Enter passphrase: "
+	}, time.Second, 10*time.Millisecond)
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestSameWriter(t *testing.T) {
+	var a, b bytes.Buffer
+	require.True(t, cosmovisor.SameWriter(&a, &a))
+	require.False(t, cosmovisor.SameWriter(&a, &b))
+	require.False(t, cosmovisor.SameWriter(&a, nil))
+
+	dir, err := ioutil.TempDir("", "samewriter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	open := func(name string) *os.File {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		return f
+	}
+	// like a log file receiving both streams with 2>&1
+	f1, f2, other := open("log"), open("log"), open("other")
+	defer f1.Close()
+	defer f2.Close()
+	defer other.Close()
+	require.True(t, cosmovisor.SameWriter(f1, f2))
+	require.False(t, cosmovisor.SameWriter(f1, other))
+}
+
+// steppedReader returns one chunk per Read and pauses before returning chunk pauseAt
+type steppedReader struct {
+	chunks  []string
+	pauseAt int
+	reached chan struct{}
+	proceed chan struct{}
+	read    int
+}
+
+func (r *steppedReader) Read(p []byte) (int, error) {
+	if r.read == len(r.chunks) {
+		return 0, io.EOF
+	}
+	if r.read == r.pauseAt {
+		close(r.reached)
+		<-r.proceed
+	}
+	n := copy(p, r.chunks[r.read])
+	r.read++
+	return n, nil
+}
+
+// benchmarkInput is 100 MiB of log lines
+func benchmarkInput() []byte {
+	return bytes.Repeat([]byte("I[2021-07-22|10:04:05.000] executed block height=1234 module=state num_valid_txs=0\n"), 100*1024*1024/84)
+}
+
+func BenchmarkRawCopy(b *testing.B) {
+	input := benchmarkInput()
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// hide bytes.Reader's WriterTo, so this measures actual reads like from a pipe
+		_, _ = io.Copy(ioutil.Discard, struct{ io.Reader }{bytes.NewReader(input)})
+	}
+}
+
+func BenchmarkOutputStreamWithScanner(b *testing.B) {
+	input := benchmarkInput()
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream := cosmovisor.NewOutputStream(bytes.NewReader(input), ioutil.Discard)
+		consumer := stream.Subscribe("scanner", 0, cosmovisor.MayContainUpgrade)
+		done := make(chan struct{})
+		go func() {
+			_, _ = cosmovisor.WaitForUpdate(bufio.NewScanner(consumer))
+			// keep draining like LaunchProcess does while the child is stopped
+			_, _ = io.Copy(ioutil.Discard, consumer)
+			close(done)
+		}()
+		_ = stream.Run()
+		<-done
+	}
+}
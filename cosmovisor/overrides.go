@@ -0,0 +1,133 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// overridesFile in a version directory holds the LaunchOverrides of its binary
+const overridesFile = "overrides.json"
+
+// LaunchOverrides are arguments and environment variables added whenever the binary of one
+// version directory is launched, e.g. a flag a new version requires or a one-time
+// --x-crisis-skip-assert-invariants. They are read from overrides.json next to bin, in
+// upgrades/<name> or in genesis, so the launch command doesn't change at the upgrade.
+type LaunchOverrides struct {
+	// Binary is the file name of the binary in bin, for an upgrade that renamed the daemon,
+	// DAEMON_NAME if empty
+	Binary string `json:"binary,omitempty"`
+	// Args are appended to the arguments of the daemon
+	Args []string `json:"args,omitempty"`
+	// Env are KEY=value variables set for the daemon, replacing those of cosmovisor
+	Env []string `json:"env,omitempty"`
+}
+
+// readOverrides reads the overrides of the version directory dir, nil if it has none
+func readOverrides(dir string) (*LaunchOverrides, error) {
+	path := filepath.Join(dir, overridesFile)
+	bz, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var o LaunchOverrides
+	dec := json.NewDecoder(bytes.NewReader(bz))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&o); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	for _, kv := range o.Env {
+		if strings.IndexByte(kv, '=') <= 0 {
+			return nil, fmt.Errorf("invalid %s: env %q must be KEY=value", path, kv)
+		}
+	}
+	if o.Binary != "" {
+		if err := validateBinaryName(o.Binary); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", path, err)
+		}
+	}
+	return &o, nil
+}
+
+// binOverrides reads the overrides of the version directory of bin
+func binOverrides(bin string) (*LaunchOverrides, error) {
+	return readOverrides(filepath.Dir(filepath.Dir(bin)))
+}
+
+// withExtraArgs returns args with ExtraArgs added, before -- as the arguments after it are
+// passed on as they are
+func (cfg *Config) withExtraArgs(args []string) []string {
+	if len(cfg.ExtraArgs) == 0 {
+		return args
+	}
+	end := len(args)
+	for i, arg := range args {
+		if arg == "--" {
+			end = i
+			break
+		}
+	}
+	withExtra := append(append([]string(nil), args[:end]...), cfg.ExtraArgs...)
+	return append(withExtra, args[end:]...)
+}
+
+// apply returns args and env with the overrides added, env nil stands for the environment
+// of cosmovisor
+func (o *LaunchOverrides) apply(args, env []string) ([]string, []string) {
+	if o == nil {
+		return args, env
+	}
+	args = append(append([]string(nil), args...), o.Args...)
+	if len(o.Env) == 0 {
+		return args, env
+	}
+	if env == nil {
+		env = environ()
+	}
+	return args, mergeEnv(env, o.Env)
+}
+
+// String describes the overrides for the logs, without the values of the variables
+func (o *LaunchOverrides) String() string {
+	var parts []string
+	if o.Binary != "" {
+		parts = append(parts, "binary "+o.Binary)
+	}
+	if len(o.Args) > 0 {
+		parts = append(parts, "arguments "+strings.Join(o.Args, " "))
+	}
+	if len(o.Env) > 0 {
+		keys := make([]string, len(o.Env))
+		for i, kv := range o.Env {
+			keys[i] = strings.SplitN(kv, "=", 2)[0]
+		}
+		parts = append(parts, "variables "+strings.Join(keys, ", "))
+	}
+	if len(parts) == 0 {
+		return "nothing"
+	}
+	return strings.Join(parts, " and ")
+}
+
+// mergeEnv returns env with the KEY=value variables of extra, which replace the variables
+// of env with the same key. Only the first of duplicate keys counts for most programs.
+func mergeEnv(env, extra []string) []string {
+	replaced := map[string]bool{}
+	for _, kv := range extra {
+		replaced[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+	merged := make([]string, 0, len(env)+len(extra))
+	for _, kv := range env {
+		if !replaced[strings.SplitN(kv, "=", 2)[0]] {
+			merged = append(merged, kv)
+		}
+	}
+	return append(merged, extra...)
+}
@@ -0,0 +1,56 @@
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOverrides(t *testing.T) {
+	dir := t.TempDir()
+	o, err := readOverrides(dir)
+	require.NoError(t, err)
+	require.Nil(t, o)
+	args, env := o.apply([]string{"start"}, nil)
+	require.Equal(t, []string{"start"}, args)
+	require.Nil(t, env)
+
+	write := func(content string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, overridesFile), []byte(content), 0o644))
+	}
+	write(`{"args": ["--x-crisis-skip-assert-invariants"], "env": ["GOGC=50", "NODE_TAG=v2"]}`)
+	o, err = readOverrides(dir)
+	require.NoError(t, err)
+	require.Equal(t, &LaunchOverrides{Args: []string{"--x-crisis-skip-assert-invariants"}, Env: []string{"GOGC=50", "NODE_TAG=v2"}}, o)
+	require.Equal(t, "arguments --x-crisis-skip-assert-invariants and variables GOGC, NODE_TAG", o.String())
+	args, env = o.apply([]string{"start"}, []string{"HOME=/root", "GOGC=100"})
+	require.Equal(t, []string{"start", "--x-crisis-skip-assert-invariants"}, args)
+	require.Equal(t, []string{"HOME=/root", "GOGC=50", "NODE_TAG=v2"}, env)
+
+	write(`{"env": ["GOGC"]}`)
+	_, err = readOverrides(dir)
+	require.EqualError(t, err, "invalid "+filepath.Join(dir, overridesFile)+`: env "GOGC" must be KEY=value`)
+	write(`{"arguments": []}`)
+	_, err = readOverrides(dir)
+	require.EqualError(t, err, "invalid "+filepath.Join(dir, overridesFile)+`: json: unknown field "arguments"`)
+}
+
+func TestWithExtraArgs(t *testing.T) {
+	cases := map[string]struct {
+		extra []string
+		args  []string
+		want  []string
+	}{
+		"none":      {args: []string{"start"}, want: []string{"start"}},
+		"appended":  {extra: []string{"--log_format", "json"}, args: []string{"start", "--trace"}, want: []string{"start", "--trace", "--log_format", "json"}},
+		"before --": {extra: []string{"--metrics"}, args: []string{"start", "--", "raw"}, want: []string{"start", "--metrics", "--", "raw"}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{ExtraArgs: tc.extra}
+			require.Equal(t, tc.want, cfg.withExtraArgs(tc.args))
+		})
+	}
+}
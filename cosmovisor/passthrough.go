@@ -0,0 +1,93 @@
+package cosmovisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// defaultSupervisedCommands are the daemon commands cosmovisor supervises, the node itself
+var defaultSupervisedCommands = []string{"start"}
+
+func (cfg *Config) supervisedCommands() []string {
+	if len(cfg.SupervisedCommands) == 0 {
+		return defaultSupervisedCommands
+	}
+	return cfg.SupervisedCommands
+}
+
+// Supervises returns true if the daemon run with args is supervised, false if it is a
+// short-lived command like query or tx that Passthrough runs. The daemon is supervised if
+// one of the arguments is a command of SupervisedCommands, so flags before the command
+// don't matter.
+func (cfg *Config) Supervises(args []string) bool {
+	for _, command := range cfg.supervisedCommands() {
+		if command == "*" {
+			return true
+		}
+		for _, arg := range args {
+			if arg == command {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Passthrough runs the current binary with args and the stdio of cosmovisor, and returns
+// once it exits. Nothing else happens: no upgrade is watched for or applied, no lock is
+// taken and nothing is written, so cosmovisor can stand in for the binary on the command
+// line while another cosmovisor supervises the node. Stop signals are relayed to the binary.
+func Passthrough(cfg *Config, args []string, stdout, stderr io.Writer) error {
+	bin, _ := cfg.resolveCurrentBin()
+	if err := EnsureBinary(bin); err != nil {
+		return withExitCode(ExitCodeBinaryMissing, fmt.Errorf("current binary invalid: %w", err))
+	}
+	args, err := cfg.withHome(args)
+	if err != nil {
+		return err
+	}
+	cmd := cfg.daemonCommand(context.Background(), bin, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = childStdin(), stdout, stderr
+	logger.Debugf("passing %v through to %s", args, bin)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigs)
+	done := make(chan struct{})
+	defer close(done)
+	go forwardSignals(cmd, sigs, done)
+	err = cmd.Wait()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		return err
+	}
+	return &PassthroughExitError{Bin: bin, Code: exitStatus(exit)}
+}
+
+// exitStatus is the exit code of the process, or 128 plus the signal that killed it as
+// shells report it
+func exitStatus(exit *exec.ExitError) int {
+	if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exit.ExitCode()
+}
+
+// PassthroughExitError is returned by Passthrough when the binary failed. The binary
+// reported why already, cosmovisor only exits with its code.
+type PassthroughExitError struct {
+	Bin  string
+	Code int
+}
+
+func (e *PassthroughExitError) Error() string {
+	return fmt.Sprintf("%s exited with code %d", e.Bin, e.Code)
+}
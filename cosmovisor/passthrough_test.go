@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSupervises(t *testing.T) {
+	cases := map[string]struct {
+		commands []string
+		args     []string
+		want     bool
+	}{
+		"start":            {args: []string{"start"}, want: true},
+		"flags first":      {args: []string{"--home", "/var/lib/gaia", "start", "--x-crisis-skip-assert-invariants"}, want: true},
+		"query":            {args: []string{"query", "bank", "balances", "cosmos1..."}},
+		"no command":       {},
+		"export":           {args: []string{"export", "--height", "100"}},
+		"other commands":   {commands: []string{"start", "start-node"}, args: []string{"start-node"}, want: true},
+		"start not listed": {commands: []string{"start-node"}, args: []string{"start"}},
+		"everything":       {commands: []string{"*"}, args: []string{"tx", "bank", "send"}, want: true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{SupervisedCommands: tc.commands}
+			require.Equal(t, tc.want, cfg.Supervises(tc.args))
+		})
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", InjectHome: true}
+	script := "#!/bin/sh\necho \"$@\"\necho failing >&2\nexit 3\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+	// the plan the node halted at isn't applied
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "upgrade-info.json"), []byte(`{"name":"chain2","height":49}`), 0644))
+
+	before, err := ioutil.ReadDir(cfg.Root())
+	require.NoError(t, err)
+
+	var stdout, stderr bytes.Buffer
+	err = Passthrough(cfg, []string{"query", "bank", "balances"}, &stdout, &stderr)
+	var exit *PassthroughExitError
+	require.True(t, errors.As(err, &exit), "%v", err)
+	require.Equal(t, 3, exit.Code)
+	require.Equal(t, 3, ExitCode(err))
+	require.Equal(t, "query bank balances --home "+home+"\n", stdout.String())
+	require.Equal(t, "failing\n", stderr.String())
+
+	bin, linked := cfg.resolveCurrentBin()
+	require.False(t, linked, "the current link isn't created")
+	require.Equal(t, cfg.GenesisBin(), bin)
+	after, err := ioutil.ReadDir(cfg.Root())
+	require.NoError(t, err)
+	require.Equal(t, len(before), len(after), "nothing is written")
+}
@@ -0,0 +1,119 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// pauseStateFile records that the supervision of a running cosmovisor is paused
+const pauseStateFile = "paused.json"
+
+// PauseState is the pause of the supervision of a running cosmovisor process. While
+// paused, the upgrades the daemon reaches aren't applied and the daemon isn't launched
+// again once it exits.
+type PauseState struct {
+	// PID is the process id of cosmovisor
+	PID   int       `json:"pid"`
+	Since time.Time `json:"since"`
+	// Deferred is the upgrade the daemon reached while paused, applied once resumed
+	Deferred *UpgradeInfo `json:"deferred,omitempty"`
+}
+
+// parsePauseSignal validates the value of DAEMON_PAUSE_SIGNAL, one of the signals
+// forwarded to the daemon otherwise. Nothing pauses on a signal if it is empty.
+func parsePauseSignal(s string) (syscall.Signal, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	sig, err := parseSignal(s)
+	if err != nil {
+		return 0, err
+	}
+	names := make([]string, len(forwardedSignals))
+	for i, forwarded := range forwardedSignals {
+		if forwarded == sig {
+			return sig, nil
+		}
+		names[i] = signalName(forwarded)
+	}
+	if len(names) == 0 {
+		return 0, fmt.Errorf("no signal can pause the supervision here, use the admin API")
+	}
+	return 0, fmt.Errorf("%s can't pause the supervision, must be %s", signalName(sig), strings.Join(names, " or "))
+}
+
+// forwarded are the signals relayed to the daemon as they are, all forwardedSignals but
+// the pause signal
+func (cfg *Config) forwarded() []os.Signal {
+	var sigs []os.Signal
+	for _, sig := range forwardedSignals {
+		if sig != cfg.PauseSignal {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// writePauseState records the pause for the status, or removes the record if state is nil.
+// The supervision works without it, so a failure is only logged.
+func (cfg *Config) writePauseState(state *PauseState) {
+	if state == nil {
+		path := filepath.Join(cfg.StateDir(), pauseStateFile)
+		if err := cfg.fs().remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("removing %s: %v", path, err)
+		}
+		return
+	}
+	if err := cfg.writeStateFile(pauseStateFile, state); err != nil {
+		logger.Warnf("recording the pause: %v", err)
+	}
+}
+
+// PauseState returns the pause of the cosmovisor process supervising the home, nil if it
+// isn't paused. A pause left behind by a cosmovisor that was killed is ignored.
+func (cfg *Config) PauseState() (*PauseState, error) {
+	var state PauseState
+	if ok, err := cfg.readStateFile(pauseStateFile, &state); !ok {
+		return nil, err
+	}
+	if !processAlive(state.PID) {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+// watchPauseSignal pauses the supervision on the pause signal and resumes it on the next
+// one, until the returned function is called
+func (cfg *Config) watchPauseSignal() (stop func()) {
+	if cfg.PauseSignal == 0 {
+		return func() {}
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, cfg.PauseSignal)
+	done := make(chan struct{})
+	goGuarded(cfg, func() {
+		for {
+			select {
+			case sig := <-sigs:
+				paused := !admin.isPaused()
+				admin.setPaused(cfg, paused)
+				if paused {
+					logger.Infof("supervision paused on %s, send it again to resume", signalName(sig))
+				} else {
+					logger.Infof("supervision resumed on %s", signalName(sig))
+				}
+			case <-done:
+				return
+			}
+		}
+	})
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePauseSignal(t *testing.T) {
+	cases := map[string]struct {
+		value  string
+		expect syscall.Signal
+		err    string
+	}{
+		"none":      {},
+		"name":      {value: "USR1", expect: syscall.SIGUSR1},
+		"number":    {value: "1", expect: syscall.SIGHUP},
+		"stop":      {value: "SIGTERM", err: "SIGTERM can't pause the supervision, must be SIGHUP or SIGUSR1"},
+		"reload":    {value: "SIGUSR2", err: "SIGUSR2 can't pause the supervision, must be SIGHUP or SIGUSR1"},
+		"not known": {value: "SIGFOO", err: "unknown signal"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			sig, err := parsePauseSignal(tc.value)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, sig)
+		})
+	}
+
+	require.Equal(t, []os.Signal{syscall.SIGHUP, syscall.SIGUSR1}, (&Config{}).forwarded())
+	require.Equal(t, []os.Signal{syscall.SIGHUP}, (&Config{PauseSignal: syscall.SIGUSR1}).forwarded())
+}
+
+func TestDeferUpgrade(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "gaiad"}
+	a := &adminControl{resumed: make(chan struct{})}
+	info := &UpgradeInfo{Name: "v2", Height: 100}
+	require.False(t, a.deferUpgrade(cfg, info))
+
+	require.True(t, a.setPaused(cfg, true))
+	require.False(t, a.setPaused(cfg, true))
+	state, err := cfg.PauseState()
+	require.NoError(t, err)
+	require.Equal(t, os.Getpid(), state.PID)
+	require.Nil(t, state.Deferred)
+
+	require.True(t, a.deferUpgrade(cfg, info))
+	state, err = cfg.PauseState()
+	require.NoError(t, err)
+	require.Equal(t, info, state.Deferred)
+
+	// no daemon is running, the upgrade is left for the next launch
+	require.True(t, a.setPaused(cfg, false))
+	state, err = cfg.PauseState()
+	require.NoError(t, err)
+	require.Nil(t, state)
+	require.Equal(t, info, a.takeDeferred())
+	require.Nil(t, a.takeDeferred())
+}
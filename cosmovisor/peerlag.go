@@ -0,0 +1,139 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPeerLagBlocks is how many blocks the node may be behind its reference nodes
+	defaultPeerLagBlocks = 20
+	// defaultPeerLagPeriod is how long the node must be behind before it is reported
+	defaultPeerLagPeriod = 5 * time.Minute
+	// peerLagPolls is how often the heights are polled within the period
+	peerLagPolls = 10
+
+	// EventNodeLagging is sent once the node stayed behind its reference nodes for
+	// DAEMON_PEER_LAG_PERIOD
+	EventNodeLagging = "node_lagging"
+	// EventNodeCaughtUp is sent once a lagging node caught up with its reference nodes
+	EventNodeCaughtUp = "node_caught_up"
+)
+
+// peerLag is whether the node lags behind its reference nodes, kept across the launches of
+// the daemon
+var peerLag = &peerLagState{}
+
+type peerLagState struct {
+	mutex sync.Mutex
+	// behind is when the lag went above the threshold, zero while it is below
+	behind Stopwatch
+	// lagging is set once the lag stayed above the threshold for the period
+	lagging bool
+}
+
+// observe records a lag of the node and returns whether it is lagging, and whether that
+// changed with this lag
+func (s *peerLagState) observe(lag, threshold int64, period time.Duration) (lagging, changed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case lag <= threshold:
+		s.behind = Stopwatch{}
+		changed, s.lagging = s.lagging, false
+	case !s.behind.running():
+		s.behind = StartStopwatch()
+	case !s.lagging && s.behind.Elapsed() >= period:
+		s.lagging, changed = true, true
+	}
+	return s.lagging, changed
+}
+
+func (cfg *Config) peerLagBlocks() int64 {
+	if cfg.PeerLagBlocks <= 0 {
+		return defaultPeerLagBlocks
+	}
+	return cfg.PeerLagBlocks
+}
+
+func (cfg *Config) peerLagPeriod() time.Duration {
+	if cfg.PeerLagPeriod <= 0 {
+		return defaultPeerLagPeriod
+	}
+	return cfg.PeerLagPeriod
+}
+
+// referenceHeight returns the median of the heights the reference nodes at rpcs report,
+// so one node ahead on a fork or behind itself doesn't skew it. Nodes that don't answer
+// are left out, it fails if none answers.
+func referenceHeight(client *http.Client, rpcs []string) (int64, error) {
+	var heights []int64
+	var lastErr error
+	for _, rpc := range rpcs {
+		height, err := NodeHeight(client, rpc)
+		if err != nil {
+			logger.Debugf("polling the height of reference node %s: %v", rpc, err)
+			lastErr = err
+			continue
+		}
+		heights = append(heights, height)
+	}
+	if len(heights) == 0 {
+		return 0, fmt.Errorf("none of the %d reference nodes answered, the last one: %w", len(rpcs), lastErr)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights[(len(heights)-1)/2], nil
+}
+
+// watchPeerLag compares the height of the node with the height of its reference nodes
+// until done is closed. Once the node stayed more than PeerLagBlocks behind for
+// PeerLagPeriod, it is reported and /healthz answers it as degraded until it caught up.
+// Polls where the node or all the reference nodes don't answer are skipped, a node that
+// doesn't answer is the business of the liveness monitor.
+func (cfg *Config) watchPeerLag(done <-chan struct{}) {
+	period, threshold := cfg.peerLagPeriod(), cfg.peerLagBlocks()
+	client := &http.Client{Timeout: nodeAPITimeout}
+	ticker := time.NewTicker(period / peerLagPolls)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		local, err := NodeHeight(client, cfg.nodeRPC())
+		if err != nil {
+			logger.Debugf("polling the height of the node: %v", err)
+			continue
+		}
+		reference, err := referenceHeight(client, cfg.PeerRPCs)
+		if err != nil {
+			logger.Debugf("polling the height of the reference nodes: %v", err)
+			continue
+		}
+		lag := reference - local
+		if lag < 0 {
+			lag = 0
+		}
+		metrics.peerLagged(lag)
+		lagging, changed := peerLag.observe(lag, threshold, period)
+		switch {
+		case !changed:
+		case lagging:
+			behind := fmt.Sprintf("the node is %d blocks behind its reference nodes for %s, at height %d of %d", lag, period, local, reference)
+			logger.Warnf("%s", behind)
+			health.degrade(behind)
+			notify(cfg, Event{ID: fmt.Sprintf("%s/%d", EventNodeLagging, local), Type: EventNodeLagging, Height: local, Message: behind,
+				Fields: map[string]string{"lag": strconv.FormatInt(lag, 10), "reference_height": strconv.FormatInt(reference, 10)}})
+		default:
+			caughtUp := fmt.Sprintf("the node caught up with its reference nodes at height %d", local)
+			logger.Infof("%s", caughtUp)
+			health.degrade("")
+			notify(cfg, Event{ID: fmt.Sprintf("%s/%d", EventNodeCaughtUp, local), Type: EventNodeCaughtUp, Height: local, Message: caughtUp})
+		}
+	}
+}
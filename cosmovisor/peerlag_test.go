@@ -0,0 +1,89 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReferenceHeight(t *testing.T) {
+	up := func(height int64) string { return statusServer(t, func() int64 { return height }).URL }
+	down := statusServer(t, func() int64 { return 0 }).URL + "/missing"
+
+	cases := map[string]struct {
+		rpcs   []string
+		height int64
+		err    string
+	}{
+		"one":         {rpcs: []string{up(100)}, height: 100},
+		"median":      {rpcs: []string{up(100), up(5000), up(98)}, height: 100},
+		"even":        {rpcs: []string{up(100), up(98)}, height: 98},
+		"one is down": {rpcs: []string{down, up(100)}, height: 100},
+		"all down":    {rpcs: []string{down, down}, err: "none of the 2 reference nodes answered"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			height, err := referenceHeight(http.DefaultClient, tc.rpcs)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.height, height)
+		})
+	}
+}
+
+func TestWatchPeerLag(t *testing.T) {
+	defer func(p *peerLagState, h *healthState) { peerLag, health = p, h }(peerLag, health)
+	peerLag, health = &peerLagState{}, &healthState{running: true}
+	local := int64(10)
+	node := statusServer(t, func() int64 { return atomic.LoadInt64(&local) })
+	peer := statusServer(t, func() int64 { return 100 })
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", LivenessRPC: node.URL, PeerRPCs: []string{peer.URL},
+		PeerLagPeriod: 200 * time.Millisecond}
+
+	done := make(chan struct{})
+	defer close(done)
+	go cfg.watchPeerLag(done)
+	require.Eventually(t, func() bool { return health.check() != nil }, 2*time.Second, 10*time.Millisecond)
+	require.EqualError(t, health.check(), "degraded: the node is 90 blocks behind its reference nodes for 200ms, at height 10 of 100")
+
+	// within the threshold
+	atomic.StoreInt64(&local, 85)
+	require.Eventually(t, func() bool { return health.check() == nil }, 2*time.Second, 10*time.Millisecond)
+	events, _, err := ReadEvents(cfg)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, EventNodeLagging, events[0].Type)
+	require.Equal(t, "90", events[0].Fields["lag"])
+	require.Equal(t, EventNodeCaughtUp, events[1].Type)
+}
+
+func TestPeerLagObserve(t *testing.T) {
+	s := &peerLagState{}
+	lagging, changed := s.observe(50, 20, 0)
+	require.False(t, lagging)
+	require.False(t, changed)
+	// a short lag isn't reported
+	lagging, changed = s.observe(5, 20, 0)
+	require.False(t, lagging)
+	require.False(t, changed)
+	s.observe(50, 20, 0)
+	lagging, changed = s.observe(50, 20, 0)
+	require.True(t, lagging)
+	require.True(t, changed)
+	lagging, changed = s.observe(50, 20, 0)
+	require.True(t, lagging)
+	require.False(t, changed)
+	lagging, changed = s.observe(20, 20, 0)
+	require.False(t, lagging)
+	require.True(t, changed)
+}
@@ -0,0 +1,196 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// owner is the user and group the files staged for the daemon are given, and the daemon is
+// launched as when it drops privileges
+type owner struct {
+	uid, gid int
+	// groups are the supplementary groups of the user, none if the group was named
+	groups []uint32
+}
+
+// lookupOwner resolves DAEMON_RUN_AS, user or user:group, as names or ids. Without a group,
+// the primary group of the user is used, with the other groups of the user.
+func lookupOwner(spec string) (owner, error) {
+	name, group := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, group = spec[:i], spec[i+1:]
+	}
+	if name == "" {
+		return owner{}, fmt.Errorf("%q names no user", spec)
+	}
+
+	var o owner
+	u, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		u, err = user.LookupId(name)
+	}
+	switch {
+	case err == nil:
+		if o.uid, err = strconv.Atoi(u.Uid); err != nil {
+			return owner{}, fmt.Errorf("user %s has the id %q", name, u.Uid)
+		}
+		if group == "" {
+			group = u.Gid
+			o.groups = supplementaryGroups(u)
+		}
+	case isNumeric(name):
+		// a container image may have no entry for the user
+		o.uid, _ = strconv.Atoi(name)
+		if group == "" {
+			return owner{}, fmt.Errorf("user %s is unknown, name its group with %s:<group>", name, name)
+		}
+	default:
+		return owner{}, fmt.Errorf("unknown user %s", name)
+	}
+
+	if isNumeric(group) {
+		o.gid, _ = strconv.Atoi(group)
+		return o, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return owner{}, fmt.Errorf("unknown group %s", group)
+	}
+	if o.gid, err = strconv.Atoi(g.Gid); err != nil {
+		return owner{}, fmt.Errorf("group %s has the id %q", group, g.Gid)
+	}
+	return o, nil
+}
+
+// supplementaryGroups returns the ids of the groups of u, none if they can't be read
+func supplementaryGroups(u *user.User) []uint32 {
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil
+	}
+	groups := make([]uint32, 0, len(ids))
+	for _, id := range ids {
+		if gid, err := strconv.ParseUint(id, 10, 32); err == nil {
+			groups = append(groups, uint32(gid))
+		}
+	}
+	return groups
+}
+
+func isNumeric(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 31)
+	return err == nil
+}
+
+// stagedOwner returns the owner of the files staged for the daemon, false if they are left
+// as they are: only root gives files away, and only with RunAs set
+func (cfg *Config) stagedOwner() (owner, bool) {
+	if cfg.RunAs == "" || os.Geteuid() != 0 {
+		return owner{}, false
+	}
+	o, err := lookupOwner(cfg.RunAs)
+	if err != nil {
+		logger.Warnf("invalid DAEMON_RUN_AS: %v", err)
+		return owner{}, false
+	}
+	return o, true
+}
+
+// daemonOwner returns the user the daemon is launched as, false if it runs as cosmovisor
+// does: only root drops privileges, and only with DropPrivileges set
+func (cfg *Config) daemonOwner() (owner, bool) {
+	if !cfg.DropPrivileges {
+		return owner{}, false
+	}
+	return cfg.stagedOwner()
+}
+
+// giveToDaemon gives the tree at path, written by cosmovisor for the daemon to write to, to
+// the user the daemon is launched as
+func (cfg *Config) giveToDaemon(fs fsGuard, path string) error {
+	o, ok := cfg.daemonOwner()
+	if !ok {
+		return nil
+	}
+	err := filepath.Walk(path, func(p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return fs.lchown(p, o.uid, o.gid)
+	})
+	if err != nil {
+		return fmt.Errorf("giving %s to the daemon: %w", path, err)
+	}
+	return nil
+}
+
+// normalizeStaged makes what was just staged at path, the directory of an upgrade or a
+// binary, usable by the daemon, whoever staged it: the binary executable, the directories
+// searchable, nothing writable by every user, and everything owned by RunAs when cosmovisor
+// runs as root. A binary the daemon can't run otherwise only fails at the upgrade height.
+func (cfg *Config) normalizeStaged(fs fsGuard, path, bin string) error {
+	if err := markExecutable(fs, bin); err != nil {
+		return err
+	}
+	o, chown := cfg.stagedOwner()
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink != 0 {
+			return err
+		}
+		mode := info.Mode().Perm() &^ 0002
+		if info.IsDir() {
+			mode |= 0555
+		}
+		if mode != info.Mode().Perm() {
+			if err := fs.chmod(p, mode|info.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+				return err
+			}
+		}
+		if chown {
+			return fs.lchown(p, o.uid, o.gid)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("normalizing the permissions of %s: %w", path, err)
+	}
+	return checkNotWorldWritable(filepath.Dir(path))
+}
+
+// checkNotWorldWritable fails for a directory every user of the host may write to, unless
+// it has the sticky bit like /tmp: anyone could replace the binaries below it
+func checkNotWorldWritable(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0002 != 0 && info.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("%s is writable by every user, anyone on the host can replace the binaries below it", dir)
+	}
+	return nil
+}
+
+// worldWritableUpgrades returns the problems of the directories holding the binaries
+// that every user may write to
+func (cfg *Config) worldWritableUpgrades() []error {
+	var errs []error
+	dirs := []string{filepath.Join(cfg.genesisPath(), "bin"), cfg.upgradesPath()}
+	if entries, err := ioutil.ReadDir(cfg.upgradesPath()); err == nil {
+		for _, e := range entries {
+			if e.IsDir() {
+				dirs = append(dirs, filepath.Join(cfg.upgradesPath(), e.Name()), filepath.Join(cfg.upgradesPath(), e.Name(), "bin"))
+			}
+		}
+	}
+	for _, dir := range dirs {
+		if err := checkNotWorldWritable(dir); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
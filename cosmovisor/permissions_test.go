@@ -0,0 +1,156 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupOwner(t *testing.T) {
+	cases := map[string]struct {
+		spec string
+		uid  int
+		gid  int
+		err  string
+	}{
+		"name":                   {spec: "root", uid: 0, gid: 0},
+		"name and group":         {spec: "root:root", uid: 0, gid: 0},
+		"ids":                    {spec: "0:0", uid: 0, gid: 0},
+		"unknown id with group":  {spec: "12345:23456", uid: 12345, gid: 23456},
+		"unknown id":             {spec: "12345", err: "name its group with 12345:<group>"},
+		"unknown name":           {spec: "no-such-user", err: "unknown user no-such-user"},
+		"unknown group":          {spec: "root:no-such-group", err: "unknown group no-such-group"},
+		"group without user":     {spec: ":root", err: "names no user"},
+		"negative id with group": {spec: "-1:0", err: "unknown user -1"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			o, err := lookupOwner(tc.spec)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, []int{tc.uid, tc.gid}, []int{o.uid, o.gid})
+		})
+	}
+	// the groups of a user are kept unless a group is named
+	o, err := lookupOwner("root")
+	require.NoError(t, err)
+	require.Contains(t, o.groups, uint32(0))
+	o, err = lookupOwner("root:root")
+	require.NoError(t, err)
+	require.Empty(t, o.groups)
+}
+
+func TestNormalizeStaged(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", RunAs: "12345:23456"}
+	dir := cfg.UpgradeDir("chain2")
+	// as unpacked from a careless archive, by root
+	require.NoError(t, os.Chmod(cfg.UpgradeBin("chain2"), 0600))
+	require.NoError(t, os.Chmod(filepath.Join(dir, "bin"), 0777))
+	lib := filepath.Join(dir, "lib", "libwasmvm.so")
+	require.NoError(t, os.MkdirAll(filepath.Dir(lib), 0700))
+	require.NoError(t, ioutil.WriteFile(lib, []byte("lib"), 0666))
+	require.NoError(t, os.Chmod(lib, 0666))
+
+	require.NoError(t, cfg.normalizeStaged(cfg.fs(), dir, cfg.UpgradeBin("chain2")))
+	require.NoError(t, EnsureBinary(cfg.UpgradeBin("chain2")))
+	modes := map[string]os.FileMode{
+		cfg.UpgradeBin("chain2"):  0711,
+		filepath.Join(dir, "bin"): 0775,
+		filepath.Dir(lib):         0755,
+		lib:                       0664,
+	}
+	for path, mode := range modes {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, mode, info.Mode().Perm(), path)
+		if os.Geteuid() == 0 {
+			stat := info.Sys().(*syscall.Stat_t)
+			require.Equal(t, []uint32{12345, 23456}, []uint32{stat.Uid, stat.Gid}, path)
+		}
+	}
+	require.Empty(t, cfg.worldWritableUpgrades())
+
+	// a directory anyone can write to is refused
+	require.NoError(t, os.Chmod(cfg.upgradesPath(), 0777))
+	defer os.Chmod(cfg.upgradesPath(), 0755)
+	err := cfg.normalizeStaged(cfg.fs(), dir, cfg.UpgradeBin("chain2"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is writable by every user")
+	require.Len(t, cfg.worldWritableUpgrades(), 1)
+	// unless it has the sticky bit, like /tmp
+	require.NoError(t, os.Chmod(cfg.upgradesPath(), 0777|os.ModeSticky))
+	require.NoError(t, cfg.normalizeStaged(cfg.fs(), dir, cfg.UpgradeBin("chain2")))
+}
+
+func TestAddUpgradeGivesBinaryAway(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("only root gives files away")
+	}
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", RunAs: "12345:23456"}
+
+	_, err := AddUpgrade(cfg, "v2", cfg.UpgradeBin("chain2"), AddUpgradeOptions{})
+	require.NoError(t, err)
+	for _, path := range []string{cfg.UpgradeDir("v2"), cfg.UpgradeBin("v2")} {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		stat := info.Sys().(*syscall.Stat_t)
+		require.Equal(t, []uint32{12345, 23456}, []uint32{stat.Uid, stat.Gid}, path)
+	}
+}
+
+func TestDropPrivileges(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("only root drops privileges")
+	}
+	home := validateHome(t)
+	// the user must reach the binary
+	for _, dir := range []string{filepath.Dir(home), home} {
+		require.NoError(t, os.Chmod(dir, 0755))
+	}
+	cfg := &Config{Home: home, Name: "dummyd", RunAs: "12345:23456", DropPrivileges: true}
+	script := "#!/bin/sh\necho \"$(id -u):$(id -g):$(id -G)\"\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	// the binary runs as RunAs, without the groups of root
+	out, err := cfg.daemonCommand(context.Background(), cfg.GenesisBin()).Output()
+	require.NoError(t, err)
+	require.Equal(t, "12345:23456:23456\n", string(out))
+	cfg.DropPrivileges = false
+	out, err = cfg.daemonCommand(context.Background(), cfg.GenesisBin()).Output()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(out), "0:0:"), string(out))
+	cfg.DropPrivileges = true
+
+	// the doctor sees the daemon can't write the data directory of root
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0700))
+	var check *DoctorCheck
+	for _, c := range Doctor(cfg).Checks {
+		if c.Check == "privileges" {
+			check = c
+		}
+	}
+	require.NotNil(t, check)
+	require.Equal(t, CheckFail, check.Status)
+	require.Contains(t, check.Result, "the daemon runs as 12345:23456 (uid 12345), but "+cfg.DataDir()+" is owned by uid 0")
+
+	require.NoError(t, cfg.giveToDaemon(cfg.fs(), cfg.DataDir()))
+	info, err := os.Stat(cfg.DataDir())
+	require.NoError(t, err)
+	stat := info.Sys().(*syscall.Stat_t)
+	require.Equal(t, []uint32{12345, 23456}, []uint32{stat.Uid, stat.Gid})
+}
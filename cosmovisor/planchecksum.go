@@ -0,0 +1,67 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"os"
+)
+
+// EventPlanChecksumMismatch is sent when the binary of an upgrade doesn't match the
+// checksum the plan lists for it
+const EventPlanChecksumMismatch = "plan_checksum_mismatch"
+
+// verifyFile hashes the file at path and compares the digest with sum
+func verifyFile(path string, sum *Checksum) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return sum.Verify(f)
+}
+
+// upgradeConfig returns the upgrade config of the plan, downloaded or inline, nil if the
+// plan info holds none
+func (plan *UpgradePlan) upgradeConfig() *UpgradeConfig {
+	if plan.Config != nil {
+		return plan.Config
+	}
+	if config, ok := parseUpgradeConfig(plan.Info); ok {
+		return &config
+	}
+	return nil
+}
+
+// verifyPlanChecksum checks the new binary against the checksum the plan lists for the
+// platform, if it does, recorded as the plan-checksum phase. Governance voted on the plan,
+// so a staged binary or one a mirror served that doesn't match it is refused, unless
+// UnsafeSkipPlanChecksum is set.
+func (cfg *Config) verifyPlanChecksum(plan *UpgradePlan, timings *UpgradeTimings) error {
+	config := plan.upgradeConfig()
+	if config == nil || len(config.Checksums) == 0 {
+		return nil
+	}
+	phase := timings.Phase("plan-checksum")
+	sum, err := config.BinaryChecksum(OSArch())
+	if err == nil && sum == nil {
+		logger.Warnf("the plan of upgrade %q lists checksums, but none for %s", plan.Info.Name, OSArch())
+		phase.End(nil)
+		return nil
+	}
+	if err == nil {
+		phase.Set("checksum", sum.String())
+		err = verifyFile(plan.NewBin, sum)
+	}
+	if err != nil && cfg.UnsafeSkipPlanChecksum {
+		logger.Warnf("switching to %s anyway, DAEMON_UNSAFE_SKIP_PLAN_CHECKSUM is set: %v", plan.NewBin, err)
+		phase.Set("skipped", "true")
+		err = nil
+	}
+	if err != nil {
+		err = fmt.Errorf("%s doesn't match the plan of upgrade %q: %w", plan.NewBin, plan.Info.Name, err)
+		ev := NewEvent(EventPlanChecksumMismatch, plan.Info.Name, err.Error())
+		ev.Height = plan.Info.Height
+		notify(cfg, ev)
+	}
+	phase.End(err)
+	return err
+}
@@ -0,0 +1,382 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// LaunchConfig is how cosmovisor launches a binary: its path, its hash and its arguments
+// after the overrides
+type LaunchConfig struct {
+	Binary string `json:"binary"`
+	// Source is where the binary comes from: the current link, staged or downloaded
+	Source string   `json:"source"`
+	SHA256 string   `json:"sha256,omitempty"`
+	Size   int64    `json:"size,omitempty"`
+	Args   []string `json:"args,omitempty"`
+	// Overrides describes the overrides.json of the version directory, if any
+	Overrides string `json:"overrides,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// EnvChange is an environment variable of the daemon the upgrade adds, removes or changes,
+// with the values of secrets left out
+type EnvChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+	// Change is added, removed or changed
+	Change string `json:"change"`
+}
+
+// PlannedHook are the hooks of a hook point the upgrade runs
+type PlannedHook struct {
+	Point string `json:"point"`
+	// Source is the hook directory, or DAEMON_POST_UPGRADE_HOOK
+	Source  string   `json:"source"`
+	Hooks   []string `json:"hooks,omitempty"`
+	Skipped []string `json:"skipped,omitempty"`
+	// Note says why no hook runs, if none does
+	Note string `json:"note,omitempty"`
+}
+
+// PlannedBackup is the backup a backup backend takes before the switch
+type PlannedBackup struct {
+	Backend string `json:"backend"`
+	// Destination is the path, URL or command of the backup
+	Destination string `json:"destination"`
+	// Bytes is the estimated size of the backup, -1 if it isn't known
+	Bytes int64  `json:"bytes"`
+	Note  string `json:"note,omitempty"`
+}
+
+// DiskImpact is the space the upgrade takes in a directory
+type DiskImpact struct {
+	Dir string `json:"dir"`
+	// Bytes is the estimated space taken, -1 if it isn't known
+	Bytes int64 `json:"bytes"`
+	// Free is the space available in the directory, -1 if it isn't known
+	Free int64  `json:"free"`
+	Note string `json:"note,omitempty"`
+}
+
+// UpgradeDiff is the outcome of DiffUpgrade
+type UpgradeDiff struct {
+	Upgrade *UpgradeInfo `json:"upgrade"`
+	// Error is set if the upgrade can't be planned, nothing else is then
+	Error   string          `json:"error,omitempty"`
+	Old     *LaunchConfig   `json:"old,omitempty"`
+	New     *LaunchConfig   `json:"new,omitempty"`
+	Env     []EnvChange     `json:"env"`
+	Hooks   []PlannedHook   `json:"hooks"`
+	Backups []PlannedBackup `json:"backups"`
+	Disk    []DiskImpact    `json:"disk"`
+}
+
+// DiffUpgrade shows what changes when the upgrade described by info applies: the binary
+// launched before and after, with args, the arguments the daemon is started with, and the
+// environment after the overrides of each version directory, the hooks that run, the
+// backups taken and the space they take. Nothing is downloaded or changed.
+func DiffUpgrade(cfg *Config, info *UpgradeInfo, args []string) *UpgradeDiff {
+	d := &UpgradeDiff{Upgrade: info}
+	plan, err := cfg.PlanUpgrade(info)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	var oldEnv, newEnv []string
+	d.Old, oldEnv = cfg.diffLaunch(plan.OldBin, "current", args)
+	source := "staged"
+	if plan.Download {
+		source = "downloaded from " + explainSource(cfg, info)
+	}
+	d.New, newEnv = cfg.diffLaunch(plan.NewBin, source, args)
+	d.Env = diffEnv(oldEnv, newEnv)
+	d.Hooks = cfg.plannedHooks()
+	d.Backups = cfg.plannedBackups(plan)
+	d.Disk = cfg.diskImpact(plan, d.Backups)
+	return d
+}
+
+// diffLaunch describes the launch of bin with args as the daemon would be started, and
+// returns the environment it gets
+func (cfg *Config) diffLaunch(bin, source string, args []string) (*LaunchConfig, []string) {
+	l := &LaunchConfig{Binary: bin, Source: source}
+	if fi, err := os.Stat(bin); err == nil {
+		l.Size = fi.Size()
+		if l.SHA256, err = sha256File(bin); err != nil {
+			l.Error = err.Error()
+		}
+	}
+	overrides, err := binOverrides(bin)
+	if err != nil {
+		l.Error = err.Error()
+	}
+	if overrides != nil {
+		l.Overrides = overrides.String()
+	}
+	args, env := overrides.apply(cfg.withExtraArgs(args), cfg.daemonEnv())
+	if args, err = cfg.withHome(args); err != nil {
+		l.Error = err.Error()
+	}
+	l.Args = cfg.withSkipUpgrades(args)
+	if env == nil {
+		env = environ()
+	}
+	return l, env
+}
+
+// diffEnv lists the variables that differ between the environments, sorted by name. The
+// first of duplicate keys counts.
+func diffEnv(old, new []string) []EnvChange {
+	values := func(env []string) map[string]string {
+		m := make(map[string]string, len(env))
+		for _, kv := range env {
+			kv := strings.SplitN(kv, "=", 2)
+			if _, ok := m[kv[0]]; !ok && len(kv) == 2 {
+				m[kv[0]] = kv[1]
+			}
+		}
+		return m
+	}
+	oldValues, newValues := values(old), values(new)
+	changes := []EnvChange{}
+	for name, v := range oldValues {
+		nv, ok := newValues[name]
+		switch {
+		case !ok:
+			changes = append(changes, EnvChange{Name: name, Old: redactEnvValue(name, v), Change: "removed"})
+		case nv != v:
+			changes = append(changes, EnvChange{Name: name, Old: redactEnvValue(name, v), New: redactEnvValue(name, nv), Change: "changed"})
+		}
+	}
+	for name, v := range newValues {
+		if _, ok := oldValues[name]; !ok {
+			changes = append(changes, EnvChange{Name: name, New: redactEnvValue(name, v), Change: "added"})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+// plannedHooks lists the hooks the upgrade runs, in the order it runs them
+func (cfg *Config) plannedHooks() []PlannedHook {
+	hooks := []PlannedHook{}
+	add := func(point, path string) {
+		h := PlannedHook{Point: point, Source: path}
+		found, skipped, err := postUpgradeHooks(path)
+		switch {
+		case os.IsNotExist(err) && path == cfg.hookDir(point):
+			return
+		case err != nil:
+			h.Note = err.Error()
+		case len(found) == 0 && len(skipped) == 0:
+			return
+		case point == HookPreBackup && len(cfg.backupBackendKeys()) == 0:
+			h.Note = "nothing is backed up"
+		default:
+			h.Hooks = found
+		}
+		h.Skipped = skipped
+		hooks = append(hooks, h)
+	}
+	add(HookPreUpgrade, cfg.hookDir(HookPreUpgrade))
+	add(HookPreBackup, cfg.hookDir(HookPreBackup))
+	if cfg.PostUpgradeHook != "" {
+		add(HookPostUpgrade, cfg.PostUpgradeHook)
+	}
+	add(HookPostUpgrade, cfg.hookDir(HookPostUpgrade))
+	return hooks
+}
+
+// plannedBackups lists the backups the backup backends take before the switch, with the
+// size of the data backups as the space check measures it
+func (cfg *Config) plannedBackups(plan *UpgradePlan) []PlannedBackup {
+	backups := []PlannedBackup{}
+	for _, key := range cfg.backupBackendKeys() {
+		b := PlannedBackup{Backend: key, Bytes: -1}
+		switch {
+		case key == BackendCommand:
+			args, err := cfg.backupArgs(plan.Info)
+			if err != nil {
+				b.Note = err.Error()
+			}
+			b.Destination = strings.Join(args, " ")
+		case isDataBackend(key):
+			mode := cfg.backendMode(key)
+			name, err := cfg.dataBackupFileName(plan.Info, "<time>", mode)
+			if err != nil {
+				b.Note = err.Error()
+				break
+			}
+			b.Destination = filepath.Join(cfg.dataBackupDir(), name)
+			if key == BackendRemote {
+				b.Destination = strings.TrimSuffix(redactURL(cfg.DataBackupDest), "/") + "/" + name
+			}
+			b.Bytes, b.Note = cfg.dataBackupSize(mode)
+		default:
+			backend, err := cfg.backupBackend(key)
+			if err != nil {
+				b.Note = err.Error()
+				break
+			}
+			b.Destination = backend.Name()
+		}
+		backups = append(backups, b)
+	}
+	return backups
+}
+
+// dataBackupSize measures what a data backup of mode holds, -1 and why if it can't be
+func (cfg *Config) dataBackupSize(mode DataBackup) (int64, string) {
+	leftOut := cfg.excludedFromDataBackup
+	if mode == DataBackupSnapshot {
+		height, err := latestSnapshot(cfg.snapshotsDir())
+		switch {
+		case err != nil && cfg.DataBackupSnapshotCommand != "":
+			return -1, "the snapshot is taken with the old binary, its size isn't known yet"
+		case err != nil:
+			return -1, err.Error()
+		}
+		leftOut = cfg.snapshotSkip(height)
+	}
+	size, err := treeSize(cfg.DataDir(), leftOut)
+	if err != nil {
+		return -1, fmt.Sprintf("measuring the data directory: %v", err)
+	}
+	return size, ""
+}
+
+// diskImpact adds up the space the upgrade takes per directory: the local data backups,
+// the download of the binary and the state export
+func (cfg *Config) diskImpact(plan *UpgradePlan, backups []PlannedBackup) []DiskImpact {
+	disk := []DiskImpact{}
+	add := func(dir string, bytes int64, note string) {
+		for i := range disk {
+			if disk[i].Dir != dir {
+				continue
+			}
+			if disk[i].Bytes < 0 || bytes < 0 {
+				disk[i].Bytes = -1
+			} else {
+				disk[i].Bytes += bytes
+			}
+			return
+		}
+		disk = append(disk, DiskImpact{Dir: dir, Bytes: bytes, Free: diffFreeSpace(dir), Note: note})
+	}
+	for _, b := range backups {
+		if isDataBackend(b.Backend) && b.Backend != BackendRemote && b.Destination != "" {
+			add(filepath.Dir(b.Destination), b.Bytes, "the data backup")
+		}
+	}
+	if plan.Download {
+		add(filepath.Dir(cfg.UpgradeDir(plan.Info.Name)), -1, "the download of the binary")
+	}
+	if plan.Export {
+		add(cfg.BackupDir(plan.Info.Name), -1, "the state export with the old binary")
+	}
+	return disk
+}
+
+// diffFreeSpace is the free space in dir, or in its closest existing parent as the backup
+// directory is only created by the backup, -1 if it can't be read
+func diffFreeSpace(dir string) int64 {
+	for {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		return -1
+	}
+	return int64(free)
+}
+
+// WriteUpgradeDiff prints the diff as aligned columns
+func WriteUpgradeDiff(w io.Writer, d *UpgradeDiff) error {
+	if d.Error != "" {
+		_, err := fmt.Fprintf(w, "upgrade %q can't be applied: %s\n", d.Upgrade.Name, d.Error)
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, l := range []struct {
+		which string
+		*LaunchConfig
+	}{{"old", d.Old}, {"new", d.New}} {
+		binary := l.Binary + " (" + l.Source
+		if l.SHA256 != "" {
+			binary += fmt.Sprintf(", sha256 %s, %s", l.SHA256, formatBytes(l.Size))
+		}
+		fmt.Fprintf(tw, "binary\t%s\t%s)\n", l.which, binary)
+		fmt.Fprintf(tw, "args\t%s\t%s\n", l.which, strings.Join(l.Args, " "))
+		if l.Overrides != "" {
+			fmt.Fprintf(tw, "overrides\t%s\t%s\n", l.which, l.Overrides)
+		}
+		if l.Error != "" {
+			fmt.Fprintf(tw, "error\t%s\t%s\n", l.which, l.Error)
+		}
+	}
+	if len(d.Env) == 0 {
+		fmt.Fprintf(tw, "env\t\tunchanged\n")
+	}
+	for _, e := range d.Env {
+		switch e.Change {
+		case "added":
+			fmt.Fprintf(tw, "env\t%s\t%s=%s\n", e.Change, e.Name, e.New)
+		case "removed":
+			fmt.Fprintf(tw, "env\t%s\t%s=%s\n", e.Change, e.Name, e.Old)
+		default:
+			fmt.Fprintf(tw, "env\t%s\t%s=%s, was %s\n", e.Change, e.Name, e.New, e.Old)
+		}
+	}
+	if len(d.Hooks) == 0 {
+		fmt.Fprintf(tw, "hooks\t\tnone\n")
+	}
+	for _, h := range d.Hooks {
+		switch {
+		case h.Note != "":
+			fmt.Fprintf(tw, "hooks\t%s\tnone from %s: %s\n", h.Point, h.Source, h.Note)
+		default:
+			fmt.Fprintf(tw, "hooks\t%s\t%s\n", h.Point, strings.Join(h.Hooks, ", "))
+		}
+		if len(h.Skipped) > 0 {
+			fmt.Fprintf(tw, "hooks\t%s\tskipped, not executable: %s\n", h.Point, strings.Join(h.Skipped, ", "))
+		}
+	}
+	if len(d.Backups) == 0 {
+		fmt.Fprintf(tw, "backup\t\tnone\n")
+	}
+	for _, b := range d.Backups {
+		detail := b.Destination
+		if b.Bytes >= 0 {
+			detail += ", about " + formatBytes(b.Bytes)
+		}
+		if b.Note != "" {
+			detail += ", " + b.Note
+		}
+		fmt.Fprintf(tw, "backup\t%s\t%s\n", b.Backend, strings.TrimPrefix(detail, ", "))
+	}
+	if len(d.Disk) == 0 {
+		fmt.Fprintf(tw, "disk\t\tno local space needed\n")
+	}
+	for _, i := range d.Disk {
+		taken := "an unknown size"
+		if i.Bytes >= 0 {
+			taken = formatBytes(i.Bytes)
+		}
+		free := "free space unknown"
+		if i.Free >= 0 {
+			free = formatBytes(i.Free) + " free"
+		}
+		fmt.Fprintf(tw, "disk\t\t%s in %s for %s, %s\n", taken, i.Dir, i.Note, free)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,93 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffUpgrade(t *testing.T) {
+	withFreeSpace(t, 1<<30)
+	setenv(t, "PLAN_KEEP", "same")
+	cfg := journalHome(t)
+	cfg.DataBackup = DataBackupArchive
+	cfg.BackupCommand = "zfs snapshot tank/node@{{.Name}}"
+	cfg.PostUpgradeHook = filepath.Join(cfg.Home, "missing-hook")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.UpgradeDir("chain2"), overridesFile),
+		[]byte(`{"args":["--x-crisis-skip-assert-invariants"],"env":["PLAN_KEEP=other","API_TOKEN=hunter2"]}`), 0644))
+	dir := cfg.hookDir(HookPreUpgrade)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "10-check"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("notes\n"), 0644))
+
+	d := DiffUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49}, []string{"start"})
+	require.Empty(t, d.Error)
+	require.Equal(t, cfg.GenesisBin(), d.Old.Binary)
+	require.Equal(t, []string{"start"}, d.Old.Args)
+	require.Empty(t, d.Old.Overrides)
+	hash, err := sha256File(cfg.UpgradeBin("chain2"))
+	require.NoError(t, err)
+	require.Equal(t, LaunchConfig{
+		Binary:    cfg.UpgradeBin("chain2"),
+		Source:    "staged",
+		SHA256:    hash,
+		Size:      d.New.Size,
+		Args:      []string{"start", "--x-crisis-skip-assert-invariants"},
+		Overrides: "arguments --x-crisis-skip-assert-invariants and variables PLAN_KEEP, API_TOKEN",
+	}, *d.New)
+	require.Equal(t, []EnvChange{
+		{Name: "API_TOKEN", New: "xxxxx", Change: "added"},
+		{Name: "PLAN_KEEP", Old: "same", New: "other", Change: "changed"},
+	}, d.Env)
+
+	require.Len(t, d.Hooks, 2)
+	require.Equal(t, PlannedHook{Point: HookPreUpgrade, Source: dir, Hooks: []string{filepath.Join(dir, "10-check")}, Skipped: []string{filepath.Join(dir, "README")}}, d.Hooks[0])
+	require.Equal(t, HookPostUpgrade, d.Hooks[1].Point)
+	require.Contains(t, d.Hooks[1].Note, "no such file or directory")
+
+	backupDir := filepath.Join(cfg.StateDir(), "backups")
+	require.Equal(t, []PlannedBackup{
+		{Backend: BackendArchive, Destination: filepath.Join(backupDir, "chain2.tar.zst"), Bytes: 5},
+		{Backend: BackendCommand, Destination: "zfs snapshot tank/node@chain2", Bytes: -1},
+	}, d.Backups)
+	require.Equal(t, []DiskImpact{{Dir: backupDir, Bytes: 5, Free: 1 << 30, Note: "the data backup"}}, d.Disk)
+
+	var out bytes.Buffer
+	require.NoError(t, WriteUpgradeDiff(&out, d))
+	require.Contains(t, out.String(), "args       new           start --x-crisis-skip-assert-invariants\n")
+	require.Contains(t, out.String(), "env        changed       PLAN_KEEP=other, was same\n")
+	require.Contains(t, out.String(), "backup     archive       "+filepath.Join(backupDir, "chain2.tar.zst")+", about 5 B\n")
+	require.Contains(t, out.String(), "disk                     5 B in "+backupDir+" for the data backup, 1.0 GiB free\n")
+	require.NotContains(t, out.String(), "hunter2")
+
+	// nothing is planned for an upgrade that can't be applied
+	d = DiffUpgrade(cfg, &UpgradeInfo{Name: "chain9"}, []string{"start"})
+	require.Contains(t, d.Error, "downloading disabled")
+	require.Nil(t, d.New)
+	out.Reset()
+	require.NoError(t, WriteUpgradeDiff(&out, d))
+	require.Contains(t, out.String(), `upgrade "chain9" can't be applied: `)
+}
+
+func TestDiffUpgradeDownload(t *testing.T) {
+	cfg := journalHome(t)
+	cfg.AllowDownloadBinaries = true
+	cfg.DataBackup = DataBackupArchive
+	cfg.DataBackupDest = "s3://user:secret@bucket/backups"
+	d := DiffUpgrade(cfg, &UpgradeInfo{Name: "chain9", Info: `{"binaries":{"any":"https://example.com/chain9"}}`}, []string{"start"})
+	require.Empty(t, d.Error)
+	require.Equal(t, cfg.UpgradeBin("chain9"), d.New.Binary)
+	require.Contains(t, d.New.Source, "downloaded from ")
+	require.Empty(t, d.New.SHA256)
+	require.Equal(t, []PlannedBackup{{Backend: BackendRemote, Destination: "s3://user:xxxxx@bucket/backups/chain9.tar.zst", Bytes: 5}}, d.Backups)
+	require.Len(t, d.Disk, 1)
+	require.Equal(t, filepath.Join(cfg.Root(), "upgrades"), d.Disk[0].Dir)
+	require.Equal(t, int64(-1), d.Disk[0].Bytes)
+}
@@ -0,0 +1,127 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// planSignatureExt is the extension of the detached signature of the plan file, next to it
+const planSignatureExt = ".sig"
+
+// EventPlanSignatureInvalid is sent when the plan file isn't signed by one of
+// DAEMON_PLAN_PUBKEYS, and cosmovisor doesn't act on it
+const EventPlanSignatureInvalid = "plan_signature_invalid"
+
+// errPlanUnsigned is returned for a plan file without a signature when DAEMON_PLAN_PUBKEYS
+// is set
+var errPlanUnsigned = errors.New("the plan file has no signature, neither " + upgradeInfoFile + planSignatureExt + " nor a signature field")
+
+// parsePlanPubKeys parses DAEMON_PLAN_PUBKEYS, a comma separated list of keys as
+// DAEMON_BINARY_PUBKEY takes them
+func parsePlanPubKeys(s string) ([]SignatureKey, error) {
+	var keys []SignatureKey
+	for _, value := range strings.Split(s, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		key, err := LoadSignatureKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", len(keys)+1, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// planPubKeys lists the keys of DAEMON_PLAN_PUBKEYS for the settings
+func (cfg *Config) planPubKeys() string {
+	keys := make([]string, len(cfg.PlanPubKeys))
+	for i, key := range cfg.PlanPubKeys {
+		keys[i] = key.String()
+	}
+	return strings.Join(keys, ", ")
+}
+
+// planSignedMessage is what a plan is signed as, unless the signature is of the plan file
+// itself: its name, height and info, one per line. It doesn't depend on how the app
+// formats the file, so a plan can be signed before the app writes it.
+func planSignedMessage(plan *UpgradeInfo) []byte {
+	return []byte(plan.Name + "\n" + strconv.FormatInt(plan.Height, 10) + "\n" + plan.Info)
+}
+
+// verifyPlanSignature checks that the plan file, with content bz and the plan parsed from
+// it, is signed by one of PlanPubKeys: by the detached signature next to it, of the file or
+// of planSignedMessage, or else by its signature field, of planSignedMessage. Without keys
+// nothing is checked.
+func (cfg *Config) verifyPlanSignature(bz []byte, plan *UpgradeInfo) error {
+	if len(cfg.PlanPubKeys) == 0 {
+		return nil
+	}
+	// the data directory is written by the app, don't follow symlinks
+	sig, err := readFileInDir(cfg.Home, filepath.Join(dataDir, upgradeInfoFile+planSignatureExt))
+	switch {
+	case err == nil:
+		return cfg.verifyPlan(sig, bz, planSignedMessage(plan))
+	case !os.IsNotExist(err):
+		return fmt.Errorf("reading the signature of the plan file: %w", err)
+	}
+	var fields struct {
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(bz, &fields); err != nil || fields.Signature == "" {
+		return errPlanUnsigned
+	}
+	return cfg.verifyPlan([]byte(fields.Signature), planSignedMessage(plan))
+}
+
+// verifyPlan returns nil if sig is a signature of one of the messages by one of PlanPubKeys
+func (cfg *Config) verifyPlan(sig []byte, messages ...[]byte) error {
+	var problems []string
+	for _, key := range cfg.PlanPubKeys {
+		for _, msg := range messages {
+			err := key.Verify(bytes.NewReader(msg), sig)
+			if err == nil {
+				logger.Infof("the plan file is signed by %s", key)
+				return nil
+			}
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	return fmt.Errorf("the plan file isn't signed by any of DAEMON_PLAN_PUBKEYS: %s", strings.Join(problems, "; "))
+}
+
+// checkPlanSignature verifies the signature of the plan file before the plan read from it
+// is applied at startup
+func (cfg *Config) checkPlanSignature(plan *UpgradeInfo) error {
+	if len(cfg.PlanPubKeys) == 0 {
+		return nil
+	}
+	bz, err := cfg.readPlanFile()
+	if err == nil {
+		err = cfg.verifyPlanSignature(bz, plan)
+	}
+	if err != nil {
+		cfg.rejectPlan(bz, plan, err)
+		return fmt.Errorf("refusing upgrade %q at height %d before starting: %w", plan.Name, plan.Height, err)
+	}
+	return nil
+}
+
+// rejectPlan notifies that the plan file with content bz was refused for err. The event id
+// holds the hash of the content, so a file is reported once.
+func (cfg *Config) rejectPlan(bz []byte, plan *UpgradeInfo, err error) {
+	sum := sha256.Sum256(bz)
+	ev := NewEvent(EventPlanSignatureInvalid, plan.Name, fmt.Sprintf("refusing upgrade %q: %v", plan.Name, err))
+	ev.ID = EventPlanSignatureInvalid + "/" + hex.EncodeToString(sum[:])
+	ev.Height = plan.Height
+	notify(cfg, ev)
+}
@@ -0,0 +1,130 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// inlineKey is the minisign key of m as DAEMON_PLAN_PUBKEYS takes it inline
+func inlineKey(m minisigner) string {
+	lines := strings.Split(strings.TrimSpace(m.publicKey()), "\n")
+	return lines[len(lines)-1]
+}
+
+func TestParsePlanPubKeys(t *testing.T) {
+	operator, governance := newMinisigner(t), newMinisigner(t)
+	keys, err := parsePlanPubKeys(inlineKey(operator) + ", " + inlineKey(governance))
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, "minisign key 0807060504030201, minisign key 0807060504030201", (&Config{PlanPubKeys: keys}).planPubKeys())
+
+	keys, err = parsePlanPubKeys("")
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	_, err = parsePlanPubKeys(inlineKey(operator) + ",RWnotakey")
+	require.EqualError(t, err, "key 2: invalid minisign public key")
+}
+
+func TestVerifyPlanSignature(t *testing.T) {
+	operator, governance, other := newMinisigner(t), newMinisigner(t), newMinisigner(t)
+	keys, err := parsePlanPubKeys(inlineKey(operator) + "," + inlineKey(governance))
+	require.NoError(t, err)
+
+	plan := &UpgradeInfo{Name: "chain2", Height: 500, Info: `{"binaries":{}}`}
+	content, err := json.Marshal(plan)
+	require.NoError(t, err)
+	withField := func(sig []byte) []byte {
+		bz, err := json.Marshal(map[string]interface{}{"name": plan.Name, "height": plan.Height, "info": plan.Info, "signature": string(sig)})
+		require.NoError(t, err)
+		return bz
+	}
+	tampered := &UpgradeInfo{Name: "chain2", Height: 499, Info: plan.Info}
+
+	cases := map[string]struct {
+		noKeys   bool
+		content  []byte
+		detached []byte
+		err      string
+	}{
+		"no keys":              {noKeys: true, content: content},
+		"unsigned":             {content: content, err: "the plan file has no signature"},
+		"detached of the file": {content: content, detached: operator.sign(content, false)},
+		"detached of the plan": {content: []byte("{\n  \"name\": \"chain2\",\n  \"height\": \"500\",\n  \"info\": \"{\\\"binaries\\\":{}}\"\n}"), detached: governance.sign(planSignedMessage(plan), true)},
+		"signature field":      {content: withField(governance.sign(planSignedMessage(plan), false))},
+		"another key":          {content: content, detached: other.sign(content, false), err: "the plan file isn't signed by any of DAEMON_PLAN_PUBKEYS"},
+		"another plan":         {content: withField(operator.sign(planSignedMessage(tampered), false)), err: "minisign signature doesn't match"},
+		"invalid signature":    {content: content, detached: []byte("signed"), err: "invalid minisign signature file"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+			if !tc.noKeys {
+				cfg.PlanPubKeys = keys
+			}
+			require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+			require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), upgradeInfoFile), tc.content, 0644))
+			if tc.detached != nil {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), upgradeInfoFile+planSignatureExt), tc.detached, 0644))
+			}
+			parsed, err := parsePlanFile(tc.content)
+			require.NoError(t, err)
+			require.Equal(t, plan, parsed)
+
+			err = cfg.verifyPlanSignature(tc.content, parsed)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestUnsignedPlanRefused(t *testing.T) {
+	defer FlushUpgradeTraces(time.Second)
+	operator := newMinisigner(t)
+	keys, err := parsePlanPubKeys(inlineKey(operator))
+	require.NoError(t, err)
+	content := []byte(`{"name": "chain2", "height": 500}`)
+	write := func(cfg *Config, sig []byte) {
+		require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), upgradeInfoFile), content, 0644))
+		if sig != nil {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), upgradeInfoFile+planSignatureExt), sig, 0644))
+		}
+	}
+
+	// the watcher ignores the plan
+	cfg := heightHome(t, "")
+	cfg.PlanPubKeys = keys
+	write(cfg, nil)
+	require.Nil(t, cfg.newPlan(&planSeen{launched: time.Now().Add(-time.Minute)}))
+	write(cfg, operator.sign(content, false))
+	plan := cfg.newPlan(&planSeen{launched: time.Now().Add(-time.Minute)})
+	require.NotNil(t, plan)
+	require.Equal(t, "chain2", plan.Name)
+
+	// and so does the startup check
+	cfg = heightHome(t, "")
+	cfg.PlanPubKeys = keys
+	write(cfg, nil)
+	err = StartupPlanCheck(cfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `refusing upgrade "chain2" at height 500 before starting: the plan file has no signature`)
+	require.Equal(t, cfg.GenesisBin(), mustCurrentBin(t, cfg))
+	write(cfg, operator.sign(content, false))
+	require.NoError(t, StartupPlanCheck(cfg))
+	require.Equal(t, cfg.UpgradeBin("chain2"), mustCurrentBin(t, cfg))
+}
@@ -0,0 +1,207 @@
+package cosmovisor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPredownloadBlocks is how far ahead of the upgrade height the binary is downloaded
+	defaultPredownloadBlocks = 1000
+	// predownloadPollInterval is how often the node is asked for its upgrade plan
+	predownloadPollInterval = 30 * time.Second
+	// nodeAPITimeout bounds a single query to the node
+	nodeAPITimeout = 10 * time.Second
+)
+
+// upgradeDirMutex serializes the downloads into the upgrade dirs, so an upgrade firing
+// while its binary is being pre-downloaded waits for that download instead of racing it
+var upgradeDirMutex sync.Mutex
+
+// NodeAPI queries the REST API (the gRPC gateway) of the supervised node
+type NodeAPI struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewNodeAPI creates a client of the REST API at url, e.g. http://localhost:1317
+func NewNodeAPI(url string) *NodeAPI {
+	return &NodeAPI{URL: strings.TrimRight(url, "/"), Client: &http.Client{Timeout: nodeAPITimeout}}
+}
+
+// CurrentPlan returns the upgrade plan x/upgrade has scheduled, or nil if there is none
+func (a *NodeAPI) CurrentPlan() (*UpgradeInfo, error) {
+	var resp struct {
+		Plan *struct {
+			Name   string `json:"name"`
+			Height string `json:"height"`
+			Info   string `json:"info"`
+		} `json:"plan"`
+	}
+	if err := a.get("/cosmos/upgrade/v1beta1/current_plan", &resp); err != nil {
+		return nil, err
+	}
+	if resp.Plan == nil || resp.Plan.Name == "" {
+		return nil, nil
+	}
+	info := &UpgradeInfo{Name: resp.Plan.Name, Info: resp.Plan.Info}
+	if resp.Plan.Height != "" {
+		height, err := strconv.ParseInt(resp.Plan.Height, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid height of plan %q: %w", resp.Plan.Name, err)
+		}
+		info.Height = height
+	}
+	return info, nil
+}
+
+// AppliedPlan returns the height x/upgrade applied the named upgrade at, 0 if it didn't
+func (a *NodeAPI) AppliedPlan(name string) (int64, error) {
+	var resp struct {
+		Height string `json:"height"`
+	}
+	if err := a.get("/cosmos/upgrade/v1beta1/applied_plan/"+url.PathEscape(name), &resp); err != nil {
+		return 0, err
+	}
+	height, err := strconv.ParseInt(resp.Height, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid height %q of applied plan %q: %w", resp.Height, name, err)
+	}
+	return height, nil
+}
+
+// LatestHeight returns the height of the node's latest block
+func (a *NodeAPI) LatestHeight() (int64, error) {
+	var resp struct {
+		Block struct {
+			Header struct {
+				Height string `json:"height"`
+			} `json:"header"`
+		} `json:"block"`
+	}
+	if err := a.get("/cosmos/base/tendermint/v1beta1/blocks/latest", &resp); err != nil {
+		return 0, err
+	}
+	height, err := strconv.ParseInt(resp.Block.Header.Height, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid latest block height %q: %w", resp.Block.Header.Height, err)
+	}
+	return height, nil
+}
+
+// get decodes the JSON response of the API at path into v, any response other than 2xx
+// is an error
+func (a *NodeAPI) get(path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, a.URL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", a.URL+path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding %s: %w", a.URL+path, err)
+	}
+	return nil
+}
+
+// predownloadBlocks is how many blocks ahead of the upgrade height the binary is downloaded
+func (cfg *Config) predownloadBlocks() int64 {
+	if cfg.PredownloadBlocks <= 0 {
+		return defaultPredownloadBlocks
+	}
+	return cfg.PredownloadBlocks
+}
+
+// wantsPredownload returns true if binaries are downloaded while the daemon runs
+func (cfg *Config) wantsPredownload() bool {
+	return cfg.actionsAPI() != "" && cfg.downloadAction() != nil
+}
+
+// downloadAction is the download among the actions before an upgrade, nil if there is none
+func (cfg *Config) downloadAction() *HeightAction {
+	for _, a := range cfg.heightActions() {
+		if a.Action == ActionDownload {
+			return &a
+		}
+	}
+	return nil
+}
+
+// Predownload downloads and verifies the binary of an upgrade before it fires, so the
+// restart doesn't wait for it. The preflight check, if enabled, runs on the binary in place
+// or, before it is installed, on the download.
+func Predownload(cfg *Config, info *UpgradeInfo) (bool, error) {
+	return predownload(cfg, info, cfg.wantsPreflight())
+}
+
+// predownload is Predownload, running the preflight check if preflight is set
+func predownload(cfg *Config, info *UpgradeInfo, preflight bool) (bool, error) {
+	upgradeDirMutex.Lock()
+	defer upgradeDirMutex.Unlock()
+
+	plan, err := cfg.PlanUpgrade(info)
+	if err != nil {
+		return false, err
+	}
+	if plan.Download {
+		if err := downloadUpgrade(cfg, plan); err != nil {
+			return false, err
+		}
+	}
+	// a binary that can't run is reported while the old binary still runs
+	if preflight && !plan.preflighted {
+		if err := cfg.preflight(info, plan.NewBin); err != nil {
+			return plan.Download, fmt.Errorf("preflight: %w", err)
+		}
+	}
+	return plan.Download, nil
+}
+
+// watchPlan asks the node for its upgrade plan every predownloadPollInterval and runs
+// the actions before the upgrade once they are due, until done is closed
+func (cfg *Config) watchPlan(api *NodeAPI, done <-chan struct{}) {
+	ticker := time.NewTicker(predownloadPollInterval)
+	defer ticker.Stop()
+	ran := &planActions{}
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if err := cfg.checkPlan(api, ran); err != nil {
+			logger.Warnf("actions before the upgrade: %v", err)
+		}
+	}
+}
+
+// checkPlan runs the actions before the upgrade of the node's plan that are due and
+// weren't run for it yet, see runHeightActions
+func (cfg *Config) checkPlan(api *NodeAPI, ran *planActions) error {
+	info, err := api.CurrentPlan()
+	if err != nil || info == nil || cfg.skipsUpgrade(info) {
+		return err
+	}
+	var remaining int64
+	if info.Height > 0 {
+		height, err := api.LatestHeight()
+		if err != nil {
+			return err
+		}
+		remaining = info.Height - height
+	}
+	return cfg.runHeightActions(info, remaining, ran)
+}
@@ -0,0 +1,143 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+)
+
+// nodeServer serves the plan and the latest height the way the gRPC gateway does
+func nodeServer(t *testing.T, plan string, height int64) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cosmos/upgrade/v1beta1/current_plan":
+			fmt.Fprintf(w, `{"plan": %s}`, plan)
+		case "/cosmos/base/tendermint/v1beta1/blocks/latest":
+			fmt.Fprintf(w, `{"block_id": {}, "block": {"header": {"chain_id": "test", "height": "%d"}}}`, height)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCheckPlan(t *testing.T) {
+	raw, err := filepath.Abs(filepath.Join("testdata", "repo", "raw_binary", "autod"))
+	require.NoError(t, err)
+	info := fmt.Sprintf(`{\"binaries\": {\"any\": \"%s?checksum=sha256:e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d\"}}`, raw)
+	plan := fmt.Sprintf(`{"name": "amazonas", "height": "5000", "info": "%s"}`, info)
+
+	cases := map[string]struct {
+		plan       string
+		height     int64
+		finished   string
+		downloaded bool
+		err        string
+	}{
+		"no plan":       {plan: "null", height: 4500},
+		"far ahead":     {plan: plan, height: 3999},
+		"within blocks": {plan: plan, height: 4000, downloaded: true},
+		"past height":   {plan: plan, height: 5000, downloaded: true},
+		"finished":      {plan: plan, height: 4500, finished: "amazonas"},
+		"by time":       {plan: fmt.Sprintf(`{"name": "amazonas", "time": "2021-06-01T00:00:00Z", "height": "0", "info": "%s"}`, info), downloaded: true},
+		"bad checksum": {
+			plan:   `{"name": "amazonas", "height": "5000", "info": "{\"binaries\": {\"any\": \"https://example.com/autod?checksum=sha256:abc\"}}"}`,
+			height: 4500,
+			err:    `upgrade "amazonas": cannot download binary`,
+		},
+		"bad height": {plan: `{"name": "amazonas", "height": "soon"}`, err: `invalid height of plan "amazonas"`},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home := t.TempDir()
+			require.NoError(t, copy.Copy(filepath.Join("testdata", "download"), home))
+			server := nodeServer(t, tc.plan, tc.height)
+			cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, PredownloadAPI: server.URL, PredownloadBlocks: 1000}
+			api := NewNodeAPI(server.URL + "/")
+
+			ran := &planActions{}
+			if tc.finished != "" {
+				ran = &planActions{name: tc.finished, done: map[string]bool{ActionDownload: true}}
+			}
+			err := cfg.checkPlan(api, ran)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				// the next check starts over
+				_, err = os.Stat(cfg.UpgradeDir("amazonas"))
+				require.True(t, os.IsNotExist(err))
+				return
+			}
+			require.NoError(t, err)
+			if !tc.downloaded {
+				require.False(t, ran.done[ActionDownload] && tc.finished == "")
+				_, err = os.Stat(cfg.UpgradeDir("amazonas"))
+				require.True(t, os.IsNotExist(err))
+				return
+			}
+			require.True(t, ran.done[ActionDownload])
+			require.NoError(t, EnsureBinary(cfg.UpgradeBin("amazonas")))
+
+			// checked again with the actions forgotten, the binary is in place already
+			ran = &planActions{}
+			require.NoError(t, cfg.checkPlan(api, ran))
+			require.True(t, ran.done[ActionDownload])
+		})
+	}
+}
+
+func TestUpgradeAfterPredownload(t *testing.T) {
+	home := t.TempDir()
+	require.NoError(t, copy.Copy(filepath.Join("testdata", "download"), home))
+	raw, err := filepath.Abs(filepath.Join("testdata", "repo", "raw_binary", "autod"))
+	require.NoError(t, err)
+	dl := &countingDownloader{}
+	cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, Downloader: dl}
+	info := &UpgradeInfo{Name: "amazonas", Height: 5000, Info: fmt.Sprintf(`{"binaries": {"any": "%s"}}`, raw)}
+
+	downloaded, err := Predownload(cfg, info)
+	require.NoError(t, err)
+	require.True(t, downloaded)
+
+	// the upgrade only switches to the binary already there
+	require.NoError(t, DoUpgrade(cfg, info))
+	require.Equal(t, 1, dl.count)
+	current, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.UpgradeBin("amazonas"), current)
+}
+
+// countingDownloader copies local files and counts the downloads
+type countingDownloader struct {
+	count int
+}
+
+func (d *countingDownloader) Download(src, dst string) error {
+	d.count++
+	return copy.Copy(src, dst)
+}
+
+func TestNodeAPIErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cosmos/upgrade/v1beta1/current_plan" {
+			http.Error(w, "not implemented", http.StatusNotImplemented)
+			return
+		}
+		fmt.Fprint(w, `{"block": {"header": {"height": ""}}}`)
+	}))
+	defer server.Close()
+	api := NewNodeAPI(server.URL)
+
+	_, err := api.CurrentPlan()
+	require.EqualError(t, err, server.URL+"/cosmos/upgrade/v1beta1/current_plan returned 501 Not Implemented")
+	_, err = api.LatestHeight()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid latest block height ""`)
+}
@@ -0,0 +1,86 @@
+package cosmovisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// defaultPreflightTimeout bounds `<daemon> version` run by the preflight check
+const defaultPreflightTimeout = 30 * time.Second
+
+// preflightTemplateData is what DAEMON_PREFLIGHT_VERSION can refer to
+type preflightTemplateData struct {
+	// Name is the name of the upgrade
+	Name string
+	// Height is the upgrade height, 0 for a plan scheduled by time
+	Height int64
+}
+
+// renderPreflightVersion renders the version expected from the binary of an upgrade
+func renderPreflightVersion(version string, data preflightTemplateData) (string, error) {
+	tmpl, err := template.New("preflight version").Parse(version)
+	if err != nil {
+		return "", fmt.Errorf("parsing the expected version: %w", err)
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("rendering the expected version: %w", err)
+	}
+	s := strings.TrimSpace(buf.String())
+	if s == "" {
+		return "", errors.New("the expected version is empty")
+	}
+	return s, nil
+}
+
+// wantsPreflight returns true if the binary of an upgrade is checked before the switch
+func (cfg *Config) wantsPreflight() bool {
+	return cfg.Preflight || cfg.PreflightVersion != ""
+}
+
+// preflightTimeout is the configured timeout of the preflight check, 30s by default
+func (cfg *Config) preflightTimeout() time.Duration {
+	if cfg.PreflightTimeout <= 0 {
+		return defaultPreflightTimeout
+	}
+	return cfg.PreflightTimeout
+}
+
+// preflight runs `<bin> version` for the upgrade and fails if it doesn't exit cleanly
+// within the timeout, or if its output doesn't contain the version expected by
+// PreflightVersion. A binary for another platform or a corrupted one fails here, before
+// anything is switched.
+func (cfg *Config) preflight(info *UpgradeInfo, bin string) error {
+	var expected string
+	if cfg.PreflightVersion != "" {
+		var err error
+		if expected, err = renderPreflightVersion(cfg.PreflightVersion, preflightTemplateData{Name: info.Name, Height: info.Height}); err != nil {
+			return err
+		}
+	}
+	timeout := cfg.preflightTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := injectFaultContext(ctx, "upgrade.preflight"); err != nil {
+		return fmt.Errorf("%s version: %w", bin, err)
+	}
+	out, err := cfg.daemonCommand(ctx, bin, "version").CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("%s version didn't exit within %s", bin, timeout)
+	case errors.Is(err, syscall.ENOEXEC):
+		return fmt.Errorf("%s doesn't run on %s: %w", bin, OSArch(), err)
+	case err != nil:
+		return fmt.Errorf("%s version: %w: %s", bin, err, output)
+	case expected != "" && !strings.Contains(output, expected):
+		return fmt.Errorf("%s version reports %q, DAEMON_PREFLIGHT_VERSION expects %q", bin, output, expected)
+	}
+	logger.Infof("preflight of %s passed: %s", bin, output)
+	return nil
+}
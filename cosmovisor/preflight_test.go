@@ -0,0 +1,59 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreflight(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0o755))
+		return path
+	}
+	good := write("good", "#!/bin/sh\necho v2.1.0-rc1\n")
+	failing := write("failing", "#!/bin/sh\necho 'libwasmvm.so: cannot open shared object file' >&2\nexit 127\n")
+	hanging := write("hanging", "#!/bin/sh\nexec sleep 5\n")
+	// neither a script nor a binary of this platform
+	foreign := write("foreign", "\x00\x01\x02\x03garbage")
+	info := &UpgradeInfo{Name: "v2.1.0", Height: 100}
+
+	cfg := &Config{Name: "gaiad"}
+	require.NoError(t, cfg.preflight(info, good))
+
+	err := cfg.preflight(info, failing)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exit status 127: libwasmvm.so: cannot open shared object file")
+
+	err = cfg.preflight(info, foreign)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "doesn't run on "+OSArch())
+
+	cfg.PreflightTimeout = 100 * time.Millisecond
+	require.EqualError(t, cfg.preflight(info, hanging), hanging+" version didn't exit within 100ms")
+
+	cfg.PreflightVersion = "{{.Name}}"
+	require.NoError(t, cfg.preflight(info, good))
+	cfg.PreflightVersion = "{{.Name}}-rc2"
+	require.EqualError(t, cfg.preflight(info, good), good+` version reports "v2.1.0-rc1", DAEMON_PREFLIGHT_VERSION expects "v2.1.0-rc2"`)
+}
+
+func TestRenderPreflightVersion(t *testing.T) {
+	version, err := renderPreflightVersion("commit: {{.Name}}", preflightTemplateData{Name: "abc123"})
+	require.NoError(t, err)
+	require.Equal(t, "commit: abc123", version)
+	_, err = renderPreflightVersion("{{.Name", preflightTemplateData{})
+	require.Error(t, err)
+	_, err = renderPreflightVersion("{{.Version}}", preflightTemplateData{})
+	require.Error(t, err)
+	_, err = renderPreflightVersion(" ", preflightTemplateData{})
+	require.EqualError(t, err, "the expected version is empty")
+}
@@ -0,0 +1,91 @@
+package cosmovisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// preUpgradeCommand is the command of the new binary run before switching to it
+	preUpgradeCommand = "pre-upgrade"
+	// preUpgradeRetryDelay is the wait before the pre-upgrade command is run again
+	preUpgradeRetryDelay = time.Second
+
+	// preUpgradeRetry is the exit code of a pre-upgrade command that may succeed if run again
+	preUpgradeRetry = 1
+	// preUpgradeFatal is the exit code of a pre-upgrade command that failed for good
+	preUpgradeFatal = 30
+)
+
+// errNoPreUpgrade is returned for binaries without a pre-upgrade command
+var errNoPreUpgrade = errors.New("the binary has no pre-upgrade command")
+
+// runPreUpgrade runs the pre-upgrade command of the new binary before the switch, so the app
+// can migrate its config or check the node is ready for it. Exit code 1 is retried up to
+// PreUpgradeMaxRetries times, any other failure fails the upgrade. A binary predating the
+// command exits with 1 too, but says so: the upgrade goes on without it.
+func (cfg *Config) runPreUpgrade(plan *UpgradePlan, timings *UpgradeTimings) error {
+	phase := timings.Phase("pre-upgrade")
+	attempts := cfg.PreUpgradeMaxRetries + 1
+	for attempt := 1; ; attempt++ {
+		phase.Set("attempts", strconv.Itoa(attempt))
+		code, err := preUpgradeOnce(cfg, plan.NewBin)
+		switch {
+		case err == nil:
+			phase.End(nil)
+			return nil
+		case errors.Is(err, errNoPreUpgrade):
+			logger.Warnf("upgrading to %q without pre-upgrade: %v", plan.Info.Name, err)
+			phase.End(nil)
+			return nil
+		case code == preUpgradeRetry && attempt < attempts:
+			logger.Warnf("pre-upgrade of %q failed (attempt %d of %d), retrying in %s: %v",
+				plan.Info.Name, attempt, attempts, preUpgradeRetryDelay, err)
+			time.Sleep(preUpgradeRetryDelay)
+			continue
+		case code == preUpgradeRetry:
+			err = fmt.Errorf("pre-upgrade failed %d times, DAEMON_PREUPGRADE_MAX_RETRIES is %d: %w",
+				attempt, cfg.PreUpgradeMaxRetries, err)
+		}
+		err = fmt.Errorf("pre-upgrade: %w", err)
+		phase.End(err)
+		return err
+	}
+}
+
+// preUpgradeOnce runs the pre-upgrade command of bin once and returns its exit code, -1 if
+// it didn't exit
+func preUpgradeOnce(cfg *Config, bin string) (int, error) {
+	if err := injectFault("preupgrade.run"); err != nil {
+		return preUpgradeRetry, err
+	}
+	// without arguments to contradict, the home is always set when asked for
+	args, _ := cfg.withHome([]string{preUpgradeCommand})
+	logger.Infof("running %s %s", bin, strings.Join(args, " "))
+	out, err := cfg.daemonCommand(context.Background(), bin, args...).CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if err == nil {
+		if output != "" {
+			logger.Infof("%s %s: %s", bin, preUpgradeCommand, output)
+		}
+		return 0, nil
+	}
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		return -1, err
+	}
+	code := exit.ExitCode()
+	// the message cobra exits with for an unknown command
+	if code == preUpgradeRetry && strings.Contains(output, fmt.Sprintf("unknown command %q", preUpgradeCommand)) {
+		return code, errNoPreUpgrade
+	}
+	if code == preUpgradeFatal {
+		return code, fmt.Errorf("%s %s exited with %d, failing the upgrade: %s", bin, preUpgradeCommand, code, output)
+	}
+	return code, fmt.Errorf("%s %s: %w: %s", bin, preUpgradeCommand, err, output)
+}
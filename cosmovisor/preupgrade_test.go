@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunPreUpgrade(t *testing.T) {
+	cases := map[string]struct {
+		// script runs as the pre-upgrade command, $runs is how often it ran before
+		script  string
+		retries int
+		runs    int
+		err     string
+	}{
+		"succeeds":        {script: "echo migrated", runs: 1},
+		"unknown command": {script: `echo 'Error: unknown command "pre-upgrade" for "dummyd"' >&2; exit 1`, runs: 1},
+		"retried":         {script: `[ "$runs" -ge 1 ] || exit 1`, retries: 2, runs: 2},
+		"retries used up": {script: "exit 1", retries: 1, runs: 2, err: "pre-upgrade failed 2 times"},
+		"fatal":           {script: "echo broken; exit 30", retries: 2, runs: 1, err: "exited with 30, failing the upgrade: broken"},
+		"other exit code": {script: "exit 2", retries: 2, runs: 1, err: "exit status 2"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			count := filepath.Join(dir, "runs")
+			bin := filepath.Join(dir, "dummyd")
+			script := fmt.Sprintf("#!/bin/sh\n[ \"$1\" = pre-upgrade ] || exit 3\nruns=$(cat %[1]s 2>/dev/null | wc -l)\necho run >> %[1]s\n%[2]s\n", count, tc.script)
+			require.NoError(t, ioutil.WriteFile(bin, []byte(script), 0755))
+
+			cfg := &Config{Home: dir, Name: "dummyd", PreUpgradeMaxRetries: tc.retries}
+			plan := &UpgradePlan{Info: &UpgradeInfo{Name: "chain2"}, NewBin: bin}
+			err := cfg.runPreUpgrade(plan, NewUpgradeTimings("chain2"))
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+			runs, err := ioutil.ReadFile(count)
+			require.NoError(t, err)
+			require.Equal(t, tc.runs, strings.Count(string(runs), "run"))
+		})
+	}
+}
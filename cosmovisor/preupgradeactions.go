@@ -0,0 +1,261 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Actions of DAEMON_PRE_UPGRADE_ACTIONS, run while the old binary still runs
+const (
+	// ActionDownload downloads and verifies the binary of the upgrade, as Predownload
+	ActionDownload = "download"
+	// ActionPreflight runs the preflight check on the binary of the upgrade, downloading it
+	// first if needed
+	ActionPreflight = "preflight"
+	// ActionNotify notifies upgrade_approaching
+	ActionNotify = "notify"
+	// ActionBackup copies the keys, the validator state and the config of the node
+	ActionBackup = "backup"
+)
+
+var preUpgradeActions = []string{ActionDownload, ActionPreflight, ActionNotify, ActionBackup}
+
+// Event types of the actions before an upgrade
+const (
+	EventUpgradeApproaching     = "upgrade_approaching"
+	EventPreUpgradeActionFailed = "pre_upgrade_action_failed"
+	EventCriticalFilesBackedUp  = "critical_files_backed_up"
+)
+
+// heightActionSteps are what the actions other than the download do, as explain shows them
+var heightActionSteps = map[string]string{
+	ActionPreflight: "run the preflight check on the binary of the upgrade while the daemon runs",
+	ActionNotify:    "notify " + EventUpgradeApproaching,
+	ActionBackup:    "copy the keys, the validator state and the config of the node to the backup directory of the upgrade",
+}
+
+// criticalFilesDir holds the copy of the critical files made by the backup action, in the
+// backup directory of the upgrade
+const criticalFilesDir = "critical-files"
+
+// criticalFiles are the small files of the node home the backup action copies
+var criticalFiles = append(append([]string{}, rehearsalLeftOut...),
+	filepath.Join("config", "app.toml"), filepath.Join("config", "client.toml"), filepath.Join("config", "config.toml"))
+
+// HeightAction is an action run once the node is within Blocks blocks of the height of
+// the upgrade x/upgrade planned
+type HeightAction struct {
+	Action string
+	Blocks int64
+}
+
+// String is the action as DAEMON_PRE_UPGRADE_ACTIONS takes it
+func (a HeightAction) String() string {
+	return a.Action + ":" + strconv.FormatInt(a.Blocks, 10)
+}
+
+// HeightActions are the actions of DAEMON_PRE_UPGRADE_ACTIONS
+type HeightActions []HeightAction
+
+// String lists the actions as DAEMON_PRE_UPGRADE_ACTIONS takes them
+func (l HeightActions) String() string {
+	actions := make([]string, len(l))
+	for i, a := range l {
+		actions[i] = a.String()
+	}
+	return strings.Join(actions, ",")
+}
+
+// parsePreUpgradeActions parses DAEMON_PRE_UPGRADE_ACTIONS, a comma separated list of
+// actions and the number of blocks before the upgrade height they are run at, e.g.
+// download:1000,preflight:500,notify:100,backup:20
+func parsePreUpgradeActions(s string) (HeightActions, error) {
+	var actions HeightActions
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not <action>:<blocks>", entry)
+		}
+		action := strings.TrimSpace(parts[0])
+		if !containsString(preUpgradeActions, action) {
+			return nil, fmt.Errorf("unknown action %q, must be one of %s", action, strings.Join(preUpgradeActions, ", "))
+		}
+		if seen[action] {
+			return nil, fmt.Errorf("action %q is listed twice", action)
+		}
+		seen[action] = true
+		blocks, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil || blocks < 1 {
+			return nil, fmt.Errorf("the blocks of action %q must be a positive number", action)
+		}
+		actions = append(actions, HeightAction{Action: action, Blocks: blocks})
+	}
+	return actions, nil
+}
+
+// actionsAPI is the REST API asked for the plan and the height the actions before an
+// upgrade count down to: DAEMON_PREDOWNLOAD_API, else DAEMON_PLAN_API
+func (cfg *Config) actionsAPI() string {
+	if cfg.PredownloadAPI != "" {
+		return cfg.PredownloadAPI
+	}
+	return cfg.PlanAPI
+}
+
+// canPredownload returns true if binaries can be downloaded while the daemon runs
+func (cfg *Config) canPredownload() bool {
+	return cfg.AllowDownloadBinaries && !cfg.Immutable && !cfg.ReadOnly
+}
+
+// heightActions are the actions run before an upgrade, the furthest from the upgrade
+// height first: PreUpgradeActions, with the download at PredownloadBlocks if
+// DAEMON_PREDOWNLOAD_API is set and they don't list one. The download is left out if
+// binaries can't be downloaded while the daemon runs.
+func (cfg *Config) heightActions() []HeightAction {
+	var actions []HeightAction
+	listed := false
+	for _, a := range cfg.PreUpgradeActions {
+		listed = listed || a.Action == ActionDownload
+		if a.Action != ActionDownload || cfg.canPredownload() {
+			actions = append(actions, a)
+		}
+	}
+	if !listed && cfg.PredownloadAPI != "" && cfg.canPredownload() {
+		actions = append(actions, HeightAction{Action: ActionDownload, Blocks: cfg.predownloadBlocks()})
+	}
+	// at the same height the binary is downloaded before it is checked
+	sort.SliceStable(actions, func(i, j int) bool {
+		if actions[i].Blocks != actions[j].Blocks {
+			return actions[i].Blocks > actions[j].Blocks
+		}
+		return actions[i].Action == ActionDownload && actions[j].Action != ActionDownload
+	})
+	return actions
+}
+
+// wantsHeightActions returns true if the routine running the actions before an upgrade
+// should run
+func (cfg *Config) wantsHeightActions() bool {
+	return cfg.actionsAPI() != "" && len(cfg.heightActions()) > 0
+}
+
+// planActions are the actions run for the plan of the node so far
+type planActions struct {
+	name string
+	done map[string]bool
+}
+
+// runHeightAction runs the action for the upgrade info, remaining blocks before its height
+func (cfg *Config) runHeightAction(action string, info *UpgradeInfo, remaining int64) error {
+	switch action {
+	case ActionDownload:
+		downloaded, err := Predownload(cfg, info)
+		if downloaded {
+			logger.Infof("pre-downloaded the binary of upgrade %q at height %d to %s", info.Name, info.Height, cfg.UpgradeBin(info.Name))
+		}
+		return err
+	case ActionPreflight:
+		if _, err := predownload(cfg, info, true); err != nil {
+			return err
+		}
+		logger.Infof("the binary of upgrade %q at height %d passed the preflight check", info.Name, info.Height)
+		return nil
+	case ActionNotify:
+		ev := Event{ID: fmt.Sprintf("%s/%s/%d", EventUpgradeApproaching, info.Name, info.Height), Type: EventUpgradeApproaching,
+			Upgrade: info.Name, Height: info.Height,
+			Message: fmt.Sprintf("upgrade %q is %d blocks away, at height %d", info.Name, remaining, info.Height),
+			Fields:  map[string]string{"blocks_left": strconv.FormatInt(remaining, 10)}}
+		notify(cfg, ev)
+		return nil
+	case ActionBackup:
+		return cfg.backupCriticalFiles(info)
+	}
+	return fmt.Errorf("unknown action %q", action)
+}
+
+// runHeightActions runs the actions due for the upgrade info, remaining blocks before its
+// height, that weren't run for it yet, recording them in ran. A plan scheduled by time has
+// no height to count down to: its binary is downloaded and checked right away, the other
+// actions are left out. An action that fails is notified once and tried again at the next
+// check, the actions after it still run.
+func (cfg *Config) runHeightActions(info *UpgradeInfo, remaining int64, ran *planActions) error {
+	if ran.name != info.Name {
+		*ran = planActions{name: info.Name, done: map[string]bool{}}
+	}
+	var failed []string
+	for _, a := range cfg.heightActions() {
+		if ran.done[a.Action] {
+			continue
+		}
+		if info.Height > 0 && remaining > a.Blocks {
+			continue
+		}
+		if info.Height <= 0 && (a.Action == ActionNotify || a.Action == ActionBackup) {
+			continue
+		}
+		if err := cfg.runHeightAction(a.Action, info, remaining); err != nil {
+			failed = append(failed, err.Error())
+			ev := Event{ID: fmt.Sprintf("%s/%s/%s", EventPreUpgradeActionFailed, info.Name, a.Action), Type: EventPreUpgradeActionFailed,
+				Upgrade: info.Name, Height: info.Height,
+				Message: fmt.Sprintf("%s before upgrade %q failed: %v", a.Action, info.Name, err),
+				Fields:  map[string]string{"action": a.Action, "error": err.Error()}}
+			notify(cfg, ev)
+			continue
+		}
+		ran.done[a.Action] = true
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("upgrade %q: %s", info.Name, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// backupCriticalFiles copies the keys, the validator state and the config of the node to
+// the backup directory of the upgrade, readable by the owner only. The copy of an earlier
+// backup is replaced, the files the node doesn't have are skipped.
+func (cfg *Config) backupCriticalFiles(info *UpgradeInfo) error {
+	fs := cfg.fs()
+	dir := filepath.Join(cfg.BackupDir(info.Name), criticalFilesDir)
+	var copied []string
+	for _, name := range criticalFiles {
+		bz, err := ioutil.ReadFile(filepath.Join(cfg.Home, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			err = copyCriticalFile(fs, bz, filepath.Join(dir, name))
+		}
+		if err != nil {
+			return fmt.Errorf("backing up %s: %w", name, err)
+		}
+		copied = append(copied, name)
+	}
+	logger.Infof("backed up %d critical files of the node to %s before upgrade %q", len(copied), dir, info.Name)
+	ev := NewEvent(EventCriticalFilesBackedUp, info.Name, fmt.Sprintf("backed up %s to %s", strings.Join(copied, ", "), dir))
+	ev.Height = info.Height
+	ev.Fields = map[string]string{"path": dir}
+	recordEvent(cfg, ev)
+	return nil
+}
+
+// copyCriticalFile writes bz to dst, readable by the owner only
+func copyCriticalFile(fs fsGuard, bz []byte, dst string) error {
+	if err := fs.mkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	if err := fs.writeFile(dst+".tmp", bz, 0600); err != nil {
+		return err
+	}
+	return fs.rename(dst+".tmp", dst)
+}
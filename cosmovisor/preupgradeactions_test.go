@@ -0,0 +1,111 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePreUpgradeActions(t *testing.T) {
+	cases := map[string]struct {
+		value   string
+		actions HeightActions
+		err     string
+	}{
+		"empty":        {value: ""},
+		"all":          {value: "download:1000, preflight:500,notify:100,backup:20", actions: HeightActions{{ActionDownload, 1000}, {ActionPreflight, 500}, {ActionNotify, 100}, {ActionBackup, 20}}},
+		"no blocks":    {value: "notify", err: `"notify" is not <action>:<blocks>`},
+		"zero blocks":  {value: "notify:0", err: `the blocks of action "notify" must be a positive number`},
+		"unknown":      {value: "restart:10", err: `unknown action "restart", must be one of download, preflight, notify, backup`},
+		"listed twice": {value: "notify:100,notify:10", err: `action "notify" is listed twice`},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			actions, err := parsePreUpgradeActions(tc.value)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.actions, actions)
+		})
+	}
+	require.Equal(t, "preflight:500,notify:100", HeightActions{{ActionPreflight, 500}, {ActionNotify, 100}}.String())
+}
+
+func TestHeightActions(t *testing.T) {
+	actions := HeightActions{{ActionNotify, 100}, {ActionPreflight, 1000}}
+	cfg := &Config{PredownloadAPI: "http://localhost:1317", AllowDownloadBinaries: true, PreUpgradeActions: actions}
+	// the download of DAEMON_PREDOWNLOAD_BLOCKS comes before the check at the same height
+	require.Equal(t, []HeightAction{{ActionDownload, 1000}, {ActionPreflight, 1000}, {ActionNotify, 100}}, cfg.heightActions())
+	require.True(t, cfg.wantsPredownload())
+
+	cfg.PreUpgradeActions = append(actions, HeightAction{ActionDownload, 50})
+	require.Equal(t, []HeightAction{{ActionPreflight, 1000}, {ActionNotify, 100}, {ActionDownload, 50}}, cfg.heightActions())
+
+	// without downloads only the other actions run, and only with an API to count down with
+	cfg = &Config{PlanAPI: "http://localhost:1317", PreUpgradeActions: cfg.PreUpgradeActions}
+	require.Equal(t, []HeightAction{{ActionPreflight, 1000}, {ActionNotify, 100}}, cfg.heightActions())
+	require.False(t, cfg.wantsPredownload())
+	require.True(t, cfg.wantsHeightActions())
+	cfg.PlanAPI = ""
+	require.False(t, cfg.wantsHeightActions())
+}
+
+func TestRunHeightActions(t *testing.T) {
+	cfg := journalHome(t)
+	cfg.PreUpgradeActions = HeightActions{{ActionPreflight, 500}, {ActionNotify, 100}, {ActionBackup, 20}}
+	cfg.PreflightVersion = "v9.9.9"
+	for name, content := range map[string]string{"config/priv_validator_key.json": "key", "config/config.toml": "moniker = \"node\"", "data/priv_validator_state.json": `{"height": "4990"}`} {
+		require.NoError(t, os.MkdirAll(filepath.Join(cfg.Home, filepath.Dir(name)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.Home, name), []byte(content), 0644))
+	}
+	info := &UpgradeInfo{Name: "chain2", Height: 5000}
+	ran := &planActions{}
+	events := func() []string {
+		evs, _, err := ReadEvents(cfg)
+		require.NoError(t, err)
+		var types []string
+		for _, ev := range evs {
+			types = append(types, ev.Type)
+		}
+		return types
+	}
+
+	// nothing is due yet
+	require.NoError(t, cfg.runHeightActions(info, 600, ran))
+	require.Empty(t, ran.done)
+
+	// the binary fails the preflight check, the notification still goes out
+	err := cfg.runHeightActions(info, 100, ran)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `upgrade "chain2": preflight: `)
+	require.Contains(t, err.Error(), `DAEMON_PREFLIGHT_VERSION expects "v9.9.9"`)
+	require.Equal(t, map[string]bool{ActionNotify: true}, ran.done)
+	require.Equal(t, []string{EventPreUpgradeActionFailed, EventUpgradeApproaching}, events())
+
+	// fixed, the check passes at the next poll, and the files are backed up at last
+	cfg.PreflightVersion = ""
+	require.NoError(t, cfg.runHeightActions(info, 10, ran))
+	require.Equal(t, map[string]bool{ActionPreflight: true, ActionNotify: true, ActionBackup: true}, ran.done)
+	require.Equal(t, []string{EventPreUpgradeActionFailed, EventUpgradeApproaching, EventCriticalFilesBackedUp}, events())
+	dir := filepath.Join(cfg.BackupDir("chain2"), criticalFilesDir)
+	bz, err := ioutil.ReadFile(filepath.Join(dir, "data", "priv_validator_state.json"))
+	require.NoError(t, err)
+	require.Equal(t, `{"height": "4990"}`, string(bz))
+	fi, err := os.Stat(filepath.Join(dir, "config", "priv_validator_key.json"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	require.NoFileExists(t, filepath.Join(dir, "config", "node_key.json"))
+
+	// a new plan starts over, a plan scheduled by time only has its binary checked
+	require.NoError(t, cfg.runHeightActions(&UpgradeInfo{Name: "chain3"}, 0, ran))
+	require.Equal(t, "chain3", ran.name)
+	require.Equal(t, map[string]bool{ActionPreflight: true}, ran.done)
+}
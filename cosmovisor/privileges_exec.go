@@ -0,0 +1,38 @@
+//go:build !windows && (!linux || go1.16)
+// +build !windows
+// +build !linux go1.16
+
+package cosmovisor
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// canDropCredential tells whether dropCredential works: the set*id calls of go 1.16 and
+// newer change the credentials of every thread on linux
+const canDropCredential = true
+
+// dropCredential switches cosmovisor itself to the user the daemon is launched as, for exec
+// mode where the daemon replaces it: groups first, then the group and the user, as root is
+// needed to change them
+func (cfg *Config) dropCredential() error {
+	o, ok := cfg.daemonOwner()
+	if !ok {
+		return nil
+	}
+	groups := make([]int, len(o.groups))
+	for i, g := range o.groups {
+		groups[i] = int(g)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setting the groups of %s: %w", cfg.RunAs, err)
+	}
+	if err := syscall.Setgid(o.gid); err != nil {
+		return fmt.Errorf("setting the group of %s: %w", cfg.RunAs, err)
+	}
+	if err := syscall.Setuid(o.uid); err != nil {
+		return fmt.Errorf("setting the user of %s: %w", cfg.RunAs, err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build linux && !go1.16
+// +build linux,!go1.16
+
+package cosmovisor
+
+import "errors"
+
+// canDropCredential tells whether dropCredential works: before go 1.16, the set*id calls
+// would change the credentials of the calling thread only and fail on linux
+const canDropCredential = false
+
+// dropCredential fails, exec mode refuses DAEMON_DROP_PRIVILEGES before getting here
+func (cfg *Config) dropCredential() error {
+	return errors.New("dropping privileges in exec mode needs cosmovisor built with go 1.16 or newer")
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package cosmovisor
+
+import "syscall"
+
+// withCredential sets the credentials of the user the daemon is launched as on attr, the
+// process attributes of a command running the daemon binary
+func (cfg *Config) withCredential(attr *syscall.SysProcAttr) *syscall.SysProcAttr {
+	o, ok := cfg.daemonOwner()
+	if !ok {
+		return attr
+	}
+	if attr == nil {
+		attr = &syscall.SysProcAttr{}
+	}
+	// setgroups runs with the groups given, so root's groups are dropped when there are none
+	attr.Credential = &syscall.Credential{Uid: uint32(o.uid), Gid: uint32(o.gid), Groups: o.groups}
+	return attr
+}
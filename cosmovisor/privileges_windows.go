@@ -0,0 +1,17 @@
+package cosmovisor
+
+import "syscall"
+
+// withCredential returns attr as it is, windows processes can't be started as another user
+// this way and DAEMON_DROP_PRIVILEGES is refused
+func (cfg *Config) withCredential(attr *syscall.SysProcAttr) *syscall.SysProcAttr {
+	return attr
+}
+
+// canDropCredential tells whether dropCredential works, there is nothing to drop on windows
+const canDropCredential = true
+
+// dropCredential does nothing, DAEMON_DROP_PRIVILEGES is refused on windows
+func (cfg *Config) dropCredential() error {
+	return nil
+}
@@ -2,83 +2,819 @@ package cosmovisor
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
+// ErrSupervising is returned by Supervise and LaunchProcess while another supervision runs in
+// this process
+var ErrSupervising = errors.New("cosmovisor supervises a daemon in this process already, run one process per home")
+
+// supervision guards the state of the process a supervision uses: its health, metrics and
+// log, the admin control, the leader standing and the restart slot. Those aren't kept per
+// Config, so a second supervision at the same time, even of another home, would take them
+// over.
+var supervision struct {
+	sync.Mutex
+	running bool
+}
+
+// startSupervision claims the state of the process for one supervision until end is called
+func startSupervision() (end func(), err error) {
+	supervision.Lock()
+	defer supervision.Unlock()
+	if supervision.running {
+		return nil, ErrSupervising
+	}
+	supervision.running = true
+	return func() {
+		supervision.Lock()
+		supervision.running = false
+		supervision.Unlock()
+	}, nil
+}
+
+// Supervise runs the daemon with LaunchProcess. If RestartAfterUpgrade is set, it launches
+// the new binary right after every successful upgrade or hotfix instead of returning an
+// UpgradedError, so no init system is needed to bring the node back; it does so anyway while
+// plans above the last upgrade are queued. If RestartAfterFailure is set, a daemon that died is launched
+// again too, waiting longer after each failure in a row. Only one Supervise or LaunchProcess
+// runs in a process at a time, any other returns ErrSupervising.
+func Supervise(cfg *Config, args []string, stdout, stderr io.Writer) error {
+	return SuperviseContext(context.Background(), cfg, args, stdout, stderr)
+}
+
+// SuperviseContext is Supervise, stopping the daemon when ctx is done. Nothing is
+// launched again once ctx is done.
+func SuperviseContext(ctx context.Context, cfg *Config, args []string, stdout, stderr io.Writer) error {
+	end, err := startSupervision()
+	if err != nil {
+		return err
+	}
+	defer end()
+	// the home stays locked between restarts, another cosmovisor can't slip in
+	if err := cfg.fs().check("launch", cfg.Root()); err != nil {
+		return err
+	}
+	unlock, err := cfg.lockHome()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	health.supervising()
+	defer startWatchdog(cfg)()
+	// each launch handles the stop signals while the daemon runs, a stop signal received
+	// in between ends the supervision
+	stops := make(chan os.Signal, 1)
+	signal.Notify(stops, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(stops)
+	stopping := false
+	stopRequested := func() bool {
+		select {
+		case <-stops:
+			stopping = true
+		default:
+		}
+		return stopping
+	}
+	defer cfg.watchPauseSignal()()
+	defer cfg.watchConfigFile()()
+	// the lease is held across the launches, an upgrade restart doesn't hand it over
+	if cfg.wantsLeaderElection() {
+		stop, err := cfg.startCampaign()
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	// a restart slot still held when the supervision ends is given up
+	defer restartSlot.releaseHeld()
+	self := runningSelf()
+	var backoff restartBackoff
+	var last error
+	for restarts := 1; ; restarts++ {
+		// a paused supervision lets the daemon run, but doesn't launch it again, and neither
+		// does a node that isn't the leader
+		if stopRequested() || !admin.waitResumed(ctx, stops) || !leader.await(ctx, stops) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return last
+		}
+		// a cosmovisor installed since is run while the daemon is stopped anyway
+		if restarts > 1 {
+			if err := self.replaced(cfg); err != nil {
+				return health.stopped(err)
+			}
+		}
+		if deferred := admin.takeDeferred(); deferred != nil {
+			logger.Infof("applying upgrade %q, reached while the supervision was paused", deferred.Name)
+			if err := StartupPlanCheck(cfg); err != nil {
+				return health.stopped(err)
+			}
+		}
+		started := StartStopwatch()
+		upgraded, err := launchProcess(ctx, cfg, args, stdout, stderr)
+		last = err
+		if ctx.Err() != nil {
+			return err
+		}
+		if errors.Is(err, errRestartRequested) {
+			backoff.reset()
+			switch {
+			case errors.Is(err, errRestartScheduled):
+				metrics.childRestarted(restartSchedule)
+			case errors.Is(err, errBackupScheduled):
+				metrics.childRestarted(restartBackup)
+			case errors.Is(err, errRestartStalled):
+				metrics.childRestarted(restartLiveness)
+			case errors.Is(err, errRestartMemory):
+				metrics.childRestarted(restartMemory)
+			case errors.Is(err, errLeadershipLost):
+				metrics.childRestarted(restartLeader)
+			default:
+				metrics.childRestarted(restartRequest)
+			}
+			continue
+		}
+		// while paused, neither a failure nor an exit of the daemon counts, it is launched
+		// again once resumed
+		if admin.isPaused() && !upgraded && !stopRequested() {
+			if err != nil {
+				logger.Warnf("the daemon failed while the supervision is paused: %v", err)
+			} else {
+				logger.Infof("the daemon exited while the supervision is paused")
+			}
+			backoff.reset()
+			continue
+		}
+		// a halt leaves the first start of the new binary to an operator
+		if upgraded && err == nil {
+			switch cfg.haltMode() {
+			case HaltExit:
+				bin, _ := cfg.CurrentBin()
+				return health.stopped(&HaltedError{Bin: bin})
+			case HaltPause:
+				admin.setPaused(cfg, true)
+				logger.Infof("supervision paused after the upgrade, the new binary is launched once it is resumed")
+				backoff.reset()
+				continue
+			}
+		}
+		// sources disagreeing about the upgrade halt the node for an operator
+		var conflict *UpgradeConflictError
+		if errors.As(err, &conflict) {
+			return health.stopped(err)
+		}
+		// an upgrade failing its health gate halts the node for an operator
+		var unhealthy *UnhealthyUpgradeError
+		if errors.As(err, &unhealthy) && cfg.healthGateOnFailure() == HealthGateHalt {
+			return health.stopped(err)
+		}
+		// a binary failing right after its upgrade is rolled back and nothing is restarted
+		if rerr := cfg.rollbackAfterFailure(err); rerr != nil {
+			return health.stopped(rerr)
+		}
+		bin, _ := cfg.CurrentBin()
+		// a node going through several queued upgrades, e.g. syncing from genesis, is
+		// launched again until it reached the last of them
+		var next *QueuedPlan
+		if upgraded && err == nil {
+			next = cfg.nextQueued()
+		}
+		switch {
+		case cfg.ShouldRestart(upgraded, err):
+			backoff.reset()
+			metrics.childRestarted(restartUpgrade)
+			logger.Infof("restarting %s after the upgrade (restart %d)", bin, restarts)
+		case next != nil:
+			backoff.reset()
+			metrics.childRestarted(restartUpgrade)
+			logger.Infof("launching %s to reach queued upgrade %q at height %d (restart %d)", bin, next.Name, next.Height, restarts)
+		case cfg.ShouldRestartAfterFailure(err):
+			delay, ok := backoff.next(cfg, started.Elapsed())
+			if !ok {
+				notifyDaemonFailed(cfg, bin, err)
+				return health.stopped(fmt.Errorf("giving up after %d restarts in a row: %w", cfg.restartAttempts(), err))
+			}
+			logger.Warnf("%s failed: %v, restarting in %s (attempt %d of %d)", bin, err, delay, backoff.failures, cfg.restartAttempts())
+			metrics.childRestarted(restartFailure)
+			select {
+			case <-time.After(delay):
+			case <-stops:
+				return err
+			case <-ctx.Done():
+				return err
+			}
+		default:
+			notifyDaemonFailed(cfg, bin, err)
+			// the service manager launches the new binary, as the unit of init-service does
+			if upgraded && err == nil {
+				return &UpgradedError{Bin: bin}
+			}
+			return health.stopped(err)
+		}
+	}
+}
+
 // LaunchProcess runs a subprocess and returns when the subprocess exits,
-// either when it dies, or *after* a successful upgrade.
+// either when it dies, or *after* a successful upgrade or hotfix. It returns ErrSupervising
+// while Supervise or another LaunchProcess runs in the process.
 func LaunchProcess(cfg *Config, args []string, stdout, stderr io.Writer) (bool, error) {
+	return LaunchProcessContext(context.Background(), cfg, args, stdout, stderr)
+}
+
+// LaunchProcessContext is LaunchProcess, stopping the daemon when ctx is done as if
+// cosmovisor received a stop signal: the daemon gets the stop signal and an upgrade it
+// reached already is finished, as the termination grace period allows.
+func LaunchProcessContext(ctx context.Context, cfg *Config, args []string, stdout, stderr io.Writer) (bool, error) {
+	end, err := startSupervision()
+	if err != nil {
+		return false, err
+	}
+	defer end()
+	return launchProcess(ctx, cfg, args, stdout, stderr)
+}
+
+// launchProcess is LaunchProcessContext within a supervision started already
+func launchProcess(ctx context.Context, cfg *Config, args []string, stdout, stderr io.Writer) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	// supervising writes the layout, inspection must never start a second supervisor
+	if err := cfg.fs().check("launch", cfg.Root()); err != nil {
+		return false, err
+	}
+	unlock, err := cfg.lockHome()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	if err := cfg.checkRolledBack(); err != nil {
+		return false, err
+	}
+	if err := cfg.checkValidatorState(); err != nil {
+		return false, err
+	}
+	// a node that lost the lease since must not launch the daemon
+	lost, err := leader.lease()
+	if err != nil {
+		return false, err
+	}
+	if err := RepairCurrent(cfg); err != nil {
+		return false, err
+	}
 	bin, err := cfg.CurrentBin()
 	if err != nil {
-		return false, fmt.Errorf("error creating symlink to genesis: %w", err)
+		return false, withExitCode(ExitCodeBinaryMissing, fmt.Errorf("error creating symlink to genesis: %w", err))
 	}
 
 	if err := EnsureBinary(bin); err != nil {
-		return false, fmt.Errorf("current binary invalid: %w", err)
+		return false, withExitCode(ExitCodeBinaryMissing, fmt.Errorf("current binary invalid: %w", err))
+	}
+	overrides, err := binOverrides(bin)
+	if err != nil {
+		return false, err
+	}
+	if overrides != nil {
+		logger.Infof("launching %s with the %s of %s", bin, overrides, overridesFile)
+	}
+	args, env := overrides.apply(cfg.withExtraArgs(args), cfg.daemonEnv())
+	if args, err = cfg.withHome(args); err != nil {
+		return false, err
+	}
+	args = cfg.withSkipUpgrades(args)
+
+	setPhase("launching " + bin)
+	// a hotfix dropped in while cosmovisor wasn't running is applied before starting.
+	// An immutable layout can't be patched in place, fixes ship as a new image.
+	if cfg.Immutable {
+		if hf, _ := cfg.PendingHotfix(); hf != nil {
+			logger.Warnf("ignoring hotfix in %s: binaries can't be replaced in an immutable layout", cfg.HotfixDir())
+		}
+	} else if hf, err := cfg.PendingHotfix(); err != nil {
+		cfg.rejectHotfix(err)
+	} else if hf != nil {
+		if record, err := ApplyHotfix(cfg, hf); err != nil {
+			// a hotfix failing the smoke test was rejected already
+			if !errors.As(err, new(*HotfixRejectedError)) {
+				cfg.rejectHotfix(err)
+			}
+		} else {
+			logger.Infof("applied hotfix to %s: %s -> %s", record.Path, record.OldSHA256, record.NewSHA256)
+			notify(cfg, Event{ID: EventHotfixApplied + "/" + record.NewSHA256, Type: EventHotfixApplied,
+				Message: fmt.Sprintf("applied hotfix to %s: %s -> %s", record.Path, record.OldSHA256, record.NewSHA256)})
+		}
+	}
+
+	if err := injectFault("launch.start"); err != nil {
+		return false, fmt.Errorf("launching process %s: %w", bin, err)
+	}
+	// the sidecars write to the console, never to the daemon's output file
+	consoleOut, consoleErr := stdout, stderr
+	if SameWriter(stdout, stderr) {
+		// both streams end up in the same place, don't let their lines get spliced together
+		stdout, stderr = CombineOutput(stdout)
+	}
+	stdout, stderr, closeOutput, err := cfg.childOutput(bin, stdout, stderr)
+	if err != nil {
+		return false, fmt.Errorf("opening the output file: %w", err)
+	}
+	defer closeOutput()
+
+	// the daemon is moved to its cgroup as soon as it started
+	var cgroup string
+	if cfg.wantsLimits() {
+		if cgroup, err = cfg.setupCgroup(); err != nil {
+			return false, fmt.Errorf("limiting the resources of %s: %w", bin, err)
+		}
 	}
 
 	cmd := exec.Command(bin, args...)
-	outpipe, err := cmd.StdoutPipe()
+	cmd.Env = env
+	cmd.Dir = cfg.workDir()
+	cmd.SysProcAttr = cfg.withCredential(daemonProcAttr())
+	// use our own pipes rather than cmd.StdoutPipe, as cmd.Wait closes those before the
+	// output the child wrote just before exiting is read
+	outpipe, outw, err := os.Pipe()
 	if err != nil {
 		return false, err
 	}
-
-	errpipe, err := cmd.StderrPipe()
+	defer outpipe.Close()
+	errpipe, errw, err := os.Pipe()
 	if err != nil {
+		outw.Close()
 		return false, err
 	}
+	defer errpipe.Close()
+	cmd.Stdout = outw
+	cmd.Stderr = errw
+	cmd.Stdin = childStdin()
 
-	scanOut := bufio.NewScanner(io.TeeReader(outpipe, stdout))
-	scanErr := bufio.NewScanner(io.TeeReader(errpipe, stderr))
-	// set scanner's buffer size to cfg.LogBufferSize, and ensure larger than bufio.MaxScanTokenSize otherwise fallback to bufio.MaxScanTokenSize
-	var maxCapacity int
-	if cfg.LogBufferSize < bufio.MaxScanTokenSize {
-		maxCapacity = bufio.MaxScanTokenSize
-	} else {
-		maxCapacity = cfg.LogBufferSize
-	}
-	bufOut := make([]byte, maxCapacity)
-	bufErr := make([]byte, maxCapacity)
-	scanOut.Buffer(bufOut, maxCapacity)
-	scanErr.Buffer(bufErr, maxCapacity)
+	// each pipe is read by a single goroutine, the scanners must not be able to stall the child
+	outStream := NewOutputStream(outpipe, stdout)
+	// the end of stderr usually tells why a daemon died, it is added to the error
+	errTail := &outputTail{max: failureOutputLines}
+	errStream := NewOutputStream(errpipe, teeOutput(stderr, errTail))
+	outScan := outStream.Subscribe("stdout scanner", defaultConsumerCapacity, MayContainUpgrade)
+	errScan := errStream.Subscribe("stderr scanner", defaultConsumerCapacity, MayContainUpgrade)
+	defer logDropped(outScan, errScan)
+
+	scanOut := bufio.NewScanner(outScan)
+	scanErr := bufio.NewScanner(errScan)
+	// the buffers grow up to the size as long lines come by, longer ones are skipped
+	maxCapacity := cfg.ScanBufferSize()
+	scanOut.Buffer(make([]byte, bufio.MaxScanTokenSize), maxCapacity)
+	scanErr.Buffer(make([]byte, bufio.MaxScanTokenSize), maxCapacity)
+	scanOut.Split(skipLongLines("stdout", maxCapacity))
+	scanErr.Split(skipLongLines("stderr", maxCapacity))
 
-	if err := cmd.Start(); err != nil {
+	// the plan file is taken as it was before the child could write it
+	seenPlan := cfg.seePlanFile()
+	err = cmd.Start()
+	// only the child holds the write ends now, the streams see EOF once it exits
+	outw.Close()
+	errw.Close()
+	if err != nil {
 		return false, fmt.Errorf("launching process %s %s: %w", bin, strings.Join(args, " "), err)
 	}
+	if cgroup != "" {
+		if err := joinCgroup(cfg.fs(), cgroup, cmd.Process.Pid); err != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			return false, fmt.Errorf("limiting the resources of %s: %w", bin, err)
+		}
+	}
+	started := StartStopwatch()
+	setRunningChild(cmd)
+	defer setRunningChild(nil)
+	metrics.childStarted()
+	upgradeRelaunched()
+	health.childStarted()
+	systemdReady(bin)
+	cfg.writeRunState(cmd.Process.Pid, bin)
+	defer cfg.clearRunState(cmd.Process.Pid)
+	cfg.journalRestarted(bin)
+	setPhase("running " + bin)
+	launched := NewEvent(EventDaemonStarted, "", fmt.Sprintf("launched %s with pid %d", bin, cmd.Process.Pid))
+	launched.Fields = map[string]string{"binary": bin, "pid": strconv.Itoa(cmd.Process.Pid), "args": strings.Join(args, " ")}
+	recordEvent(cfg, launched)
+	// the post-start hooks run alongside the daemon, they can't hold it up
+	goGuarded(cfg, func() {
+		_ = cfg.runHooks(HookPostStart, append(cfg.daemonHookEnv(bin), "COSMOVISOR_PID="+strconv.Itoa(cmd.Process.Pid)))
+	})
 
+	shutdown := shutdownState{cfg: cfg}
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGQUIT, syscall.SIGTERM)
-	go func() {
-		sig := <-sigs
-		if err := cmd.Process.Signal(sig); err != nil {
-			log.Fatal(err)
-		}
+	done := make(chan struct{})
+	signal.Notify(sigs, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	defer func() {
+		signal.Stop(sigs)
+		close(done)
 	}()
+	goGuarded(cfg, func() {
+		select {
+		case sig := <-sigs:
+			shutdown.begin(cfg, cmd, "received "+sig.String(), sig)
+		case <-ctx.Done():
+			shutdown.begin(cfg, cmd, ctx.Err().Error(), cfg.stopSignal())
+		case <-done:
+		}
+	})
+
+	// SIGUSR2 asks for the daemon to reload its config
+	var reload reloadState
+	reloads := make(chan os.Signal, 1)
+	if len(reloadTriggers) > 0 {
+		signal.Notify(reloads, reloadTriggers...)
+		defer signal.Stop(reloads)
+	}
+	goGuarded(cfg, func() { reload.run(cfg, cmd, reloads, done) })
+
+	// other signals are meant for the daemon
+	forwards := make(chan os.Signal, 1)
+	if sigs := cfg.forwarded(); len(sigs) > 0 {
+		signal.Notify(forwards, sigs...)
+		defer signal.Stop(forwards)
+	}
+	goGuarded(cfg, func() { forwardSignals(cmd, forwards, done) })
+
+	// the sidecars run as long as this daemon, they start again with the next binary
+	sidecars := cfg.startSidecars(consoleOut, consoleErr)
+	defer sidecars.stop()
+
+	// the output is relayed once the signal handlers are in place, so whoever reacts to it
+	// can't signal cosmovisor too early
+	goGuarded(cfg, func() { runOutputStream(outStream) })
+	goGuarded(cfg, func() { runOutputStream(errStream) })
+
+	hotfixes := make(chan *Hotfix, 1)
+	if !cfg.Immutable {
+		goGuarded(cfg, func() {
+			if hf := cfg.watchHotfix(bin, done); hf != nil {
+				hotfixes <- hf
+				logger.Infof("hotfix found in %s, stopping %s", cfg.HotfixDir(), bin)
+				_ = signalProcess(cmd.Process, cfg.stopSignal())
+			}
+		})
+	}
+
+	// the blocks tell the downtime of an upgrade, from the last block of the old binary to
+	// the first block of the new one
+	blocks := cfg.watchBlocks(bin, done)
+	// a slot taken for the restart is held until the daemon launched again is back
+	if cfg.wantsRestartCoordination() {
+		goGuarded(cfg, func() { cfg.settleRestart(blocks, done) })
+	}
+
+	// the app also writes the plan to its data directory before it halts, the chain may be
+	// polled for its plan, and the admin API may force a staged upgrade
+	requests := make(chan *UpgradeInfo, 1)
+	control := &launchControl{cfg: cfg, cmd: cmd, plans: requests}
+	defer admin.attach(control)()
+	sources := []UpgradeSource{
+		outputSource{stream: "stdout", scan: scanOut, match: cfg.scansOutput(), blocks: blocks},
+		outputSource{stream: "stderr", scan: scanErr, match: cfg.scansOutput(), blocks: blocks},
+		adminSource{requests: requests},
+	}
+	if cfg.watchesPlanFile() {
+		sources = append(sources, planFileSource{cfg: cfg, seen: seenPlan})
+	}
+	if cfg.watchesChainPlan() {
+		sources = append(sources, chainPlanSource{cfg: cfg, api: NewNodeAPI(cfg.PlanAPI)})
+	}
+	sources = append(sources, cfg.registeredSources()...)
+
+	if lost != nil {
+		goGuarded(cfg, func() { fenceOnLeaseLoss(control, lost, done) })
+	}
+	if cfg.RestartMaxUptime > 0 {
+		goGuarded(cfg, func() { cfg.scheduleRestart(control, started, done) })
+	}
+	if cfg.wantsRestartCoordination() {
+		goGuarded(cfg, func() { cfg.watchSelfUpgrade(control, started.Started(), done) })
+	}
+	if cfg.wantsScheduledBackup() {
+		goGuarded(cfg, func() { cfg.scheduleBackup(control, done) })
+	}
+
+	if cfg.LivenessRPC != "" {
+		goGuarded(cfg, func() { cfg.watchLiveness(control, done) })
+	}
+	if len(cfg.PeerRPCs) > 0 {
+		goGuarded(cfg, func() { cfg.watchPeerLag(done) })
+	}
+	if cfg.MemoryRestart > 0 {
+		goGuarded(cfg, func() { cfg.watchMemory(control, done) })
+	}
+	if cfg.wantsSignerPause() {
+		goGuarded(cfg, func() { cfg.resumeSignerWhenCaughtUp(done) })
+	}
+	if cfg.ValidatorStateCheck {
+		goGuarded(cfg, func() { cfg.watchValidatorState(control, done) })
+	}
+	if applied := cfg.pendingVerification(bin); applied != nil {
+		goGuarded(cfg, func() { cfg.watchVerification(control, applied, blocks, done) })
+	}
+	if applied := cfg.pendingHealthGate(bin); applied != nil {
+		goGuarded(cfg, func() { cfg.watchHealthGate(control, applied, blocks, done) })
+	}
+
+	if cfg.wantsHeightActions() {
+		api := NewNodeAPI(cfg.actionsAPI())
+		goGuarded(cfg, func() { cfg.watchPlan(api, done) })
+	}
 
-	// three ways to exit - command ends, find regexp in scanOut, find regexp in scanErr
-	upgradeInfo, err := WaitForUpgradeOrExit(cmd, scanOut, scanErr)
+	// the daemon exits by itself, or is stopped for the first upgrade a source reports
+	upgradeInfo, err := newUpgradePipeline(cfg, cmd, shutdown.markUpgrading, sources...).run()
+	sidecars.stop()
+	stoppedAt := shutdown.stoppedAt()
+	timings := shutdown.upgradeStopped()
+	metrics.childExited()
+	health.childExited()
+	exited := NewEvent(EventDaemonExited, "", fmt.Sprintf("%s exited", bin))
+	exited.Fields = map[string]string{"binary": bin, "pid": strconv.Itoa(cmd.Process.Pid)}
 	if err != nil {
+		exited.Message = fmt.Sprintf("%s exited: %v", bin, err)
+		exited.Fields["error"] = err.Error()
+	}
+	if upgradeInfo != nil {
+		exited.Upgrade, exited.Height = upgradeInfo.Name, upgradeInfo.Height
+	}
+	recordEvent(cfg, exited)
+	if upgradeInfo == nil {
+		select {
+		case hf := <-hotfixes:
+			// the child was stopped by us, so its exit error is expected
+			record, err := ApplyHotfix(cfg, hf)
+			if errors.As(err, new(*HotfixRejectedError)) {
+				// the previous binary is back in place and launched again
+				return !shutdown.stopRequested(), nil
+			}
+			if err != nil {
+				return false, fmt.Errorf("applying hotfix: %w", err)
+			}
+			logger.Infof("applied hotfix to %s: %s -> %s", record.Path, record.OldSHA256, record.NewSHA256)
+			notify(cfg, Event{ID: EventHotfixApplied + "/" + record.NewSHA256, Type: EventHotfixApplied,
+				Message: fmt.Sprintf("applied hotfix to %s: %s -> %s", record.Path, record.OldSHA256, record.NewSHA256)})
+			return !shutdown.stopRequested(), nil
+		default:
+		}
+		if control.restartRequested() && !shutdown.stopRequested() {
+			cause := control.restartErr()
+			if errors.Is(cause, errBackupScheduled) {
+				// the node is launched again even if the backup failed, it is only routine
+				logger.Infof("%s stopped for the scheduled backup", bin)
+				if err := cfg.runScheduledBackup(bin); err != nil {
+					logger.Errorf("scheduled backup failed: %v", err)
+				}
+				return false, cause
+			}
+			logger.Infof("%s stopped for the requested restart", bin)
+			return false, cause
+		}
+	}
+	if err != nil {
+		stopped := shutdown.stopRequested()
+		if since, ok := reload.failedReload(); ok && !stopped {
+			logger.Errorf("reload failed, %s exited %s after the reload signal", bin, since)
+			err = fmt.Errorf("exited %s after reload: %w", since, err)
+		}
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			exitErr := &ChildExitError{Err: err, Stopped: stopped}
+			if !stopped {
+				exitErr.Output = errTail.Lines()
+				// the on-crash hooks run before the daemon may be restarted
+				_ = cfg.runHooks(HookOnCrash, append(cfg.daemonHookEnv(bin),
+					"COSMOVISOR_EXIT_CODE="+strconv.Itoa(exitStatus(exit)), "COSMOVISOR_ERROR="+err.Error()))
+			}
+			return false, exitErr
+		}
 		return false, err
 	}
 
+	if upgradeInfo != nil && cfg.skipsUpgrade(upgradeInfo) {
+		// the app halted for an upgrade skipped by name, it is told the height this time
+		if err := cfg.skipUpgrade(upgradeInfo); err != nil {
+			return false, err
+		}
+		logger.Warnf("skipping upgrade %q at height %d as DAEMON_SKIP_UPGRADES asks, launching %s again with %s",
+			upgradeInfo.Name, upgradeInfo.Height, bin, skipUpgradesFlag)
+		if shutdown.stopRequested() {
+			return false, nil
+		}
+		return false, errRestartRequested
+	}
 	if upgradeInfo != nil {
-		return true, DoUpgrade(cfg, upgradeInfo)
+		notify(cfg, Event{ID: fmt.Sprintf("%s/%s/%d", EventUpgradeDetected, upgradeInfo.Name, upgradeInfo.Height), Type: EventUpgradeDetected,
+			Upgrade: upgradeInfo.Name, Height: upgradeInfo.Height, Message: fmt.Sprintf("upgrade %q detected at height %d", upgradeInfo.Name, upgradeInfo.Height)})
+		if shutdown.shouldSkipUpgrade() {
+			logger.Warnf("shutdown budget too small, not applying upgrade %q before exit", upgradeInfo.Name)
+			return false, nil
+		}
+		if timings == nil {
+			timings = NewUpgradeTimings(upgradeInfo.Name)
+		}
+		metrics.upgradeDetected(timings.sw)
+		if halted, ok := cfg.planWrittenAt(upgradeInfo, seenPlan.launched); ok {
+			timings.Detected(halted)
+		}
+		systemdReloading(upgradeInfo.Name)
+		err = doUpgrade(cfg, upgradeInfo, timings)
+		// the upgrade is applied by the new cosmovisor, as it starts
+		var self *SelfUpgradedError
+		if err = cfg.upgradeCosmovisor(err); errors.As(err, &self) {
+			timings.End(err)
+			return false, err
+		}
+		if shutdown.stopRequested() {
+			timings.End(err)
+		} else {
+			timings.EndAfterRestart(err)
+		}
+		if err != nil {
+			metrics.upgradeFailed()
+		}
+		notifyUpgrade(cfg, upgradeInfo.Name, err)
+		if err == nil {
+			cfg.startDowntime(upgradeInfo, blocks, stoppedAt)
+			// queued plans chained to this one are applied in the same downtime
+			err = cfg.applyQueue(upgradeInfo)
+		}
+		// don't ask for a restart if we are being stopped anyway
+		return !shutdown.stopRequested(), err
 	}
 
 	return false, nil
 }
 
+// childStdin is cosmovisor's stdin, inherited by the daemon so it can prompt for a keyring
+// passphrase. It is nil, which is /dev/null for the daemon, if cosmovisor was started with
+// its stdin closed.
+func childStdin() io.Reader {
+	if _, err := os.Stdin.Stat(); err != nil {
+		return nil
+	}
+	return os.Stdin
+}
+
+// forwardSignals relays the signals received to the daemon until done is closed
+func forwardSignals(cmd *exec.Cmd, sigs <-chan os.Signal, done <-chan struct{}) {
+	for {
+		select {
+		case sig := <-sigs:
+			if err := signalProcess(cmd.Process, sig); err != nil {
+				logger.Warnf("forwarding %s to child: %v", sig, err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// runOutputStream runs the stream until the child's pipe is closed
+func runOutputStream(s *OutputStream) {
+	if err := s.Run(); err != nil && !errors.Is(err, os.ErrClosed) {
+		logger.Warnf("reading child output: %v", err)
+	}
+}
+
+// logDropped reports consumers that fell behind the child's output
+func logDropped(consumers ...*OutputConsumer) {
+	for _, c := range consumers {
+		if dropped := c.Dropped(); dropped > 0 {
+			logger.Warnf("%s fell behind and dropped %d bytes of output", c.Name(), dropped)
+		}
+	}
+}
+
+// shutdownState tracks whether cosmovisor was asked to stop while an upgrade may be in flight
+type shutdownState struct {
+	// cfg is the home the upgrade is recorded in
+	cfg         *Config
+	mutex       sync.Mutex
+	stopping    bool
+	upgrading   bool
+	skipUpgrade bool
+	// signaled is when the stop signal was forwarded, kill escalates to SIGKILL at the end of
+	// the child's share of the budget
+	signaled Stopwatch
+	kill     *time.Timer
+
+	// timings of the upgrade in flight, starting with the stop phase
+	timings   *UpgradeTimings
+	stopPhase *PhaseTiming
+	// stopped is when the child was stopped for the upgrade in flight
+	stopped time.Time
+}
+
+// begin forwards the stop signal to the child and, if a termination grace period is
+// configured, escalates to SIGKILL once the child's share of the budget is used up
+func (s *shutdownState) begin(cfg *Config, cmd *exec.Cmd, reason string, sig os.Signal) {
+	s.mutex.Lock()
+	budget := cfg.ShutdownBudget(s.upgrading)
+	s.stopping = true
+	s.skipUpgrade = budget.SkipUpgrade
+	s.signaled = StartStopwatch()
+	if budget.ChildWindow > 0 {
+		s.kill = time.AfterFunc(budget.ChildWindow, func() {
+			_ = cmd.Process.Kill()
+		})
+	}
+	s.mutex.Unlock()
+	setPhase("stopping")
+
+	logger.Infof("%s, shutting down (%s)", reason, budget)
+	if cfg.StopSignal != 0 {
+		sig = cfg.StopSignal
+	}
+	// the child may already be gone if the signal arrives while upgrading
+	if err := signalProcess(cmd.Process, sig); err != nil {
+		logger.Warnf("forwarding %s to child: %v", sig, err)
+	}
+}
+
+// markUpgrading records that an upgrade was detected and the child is being stopped for it
+func (s *shutdownState) markUpgrading(info *UpgradeInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.upgrading {
+		return
+	}
+	s.upgrading = true
+	s.stopped = NowUTC()
+	s.timings = NewUpgradeTimings(info.Name)
+	s.timings.cfg = s.cfg
+	s.stopPhase = s.timings.Phase("stop")
+	if s.stopping {
+		s.rebudget(info)
+	}
+}
+
+// rebudget splits the budget again for an upgrade detected after the stop signal: the margin
+// is kept back from the child's share, counted from the signal, or the policy applies
+func (s *shutdownState) rebudget(info *UpgradeInfo) {
+	budget := s.cfg.ShutdownBudget(true)
+	s.skipUpgrade = budget.SkipUpgrade
+	if s.kill != nil {
+		left := budget.ChildWindow - s.signaled.Elapsed()
+		if left < 0 {
+			left = 0
+		}
+		s.kill.Reset(left)
+	}
+	logger.Infof("upgrade %q detected while shutting down (%s)", info.Name, budget)
+}
+
+// upgradeStopped ends the stop phase of the upgrade in flight and returns its timings, if any
+func (s *shutdownState) upgradeStopped() *UpgradeTimings {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopPhase != nil {
+		s.stopPhase.End(nil)
+	}
+	return s.timings
+}
+
+// stoppedAt returns when the child was stopped for the upgrade in flight, now if it exited
+// on its own
+func (s *shutdownState) stoppedAt() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped.IsZero() {
+		return NowUTC()
+	}
+	return s.stopped
+}
+
+// stopRequested returns true once a stop signal was received
+func (s *shutdownState) stopRequested() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stopping
+}
+
+// shouldSkipUpgrade returns true if a shutdown decided that the upgrade must not be applied
+func (s *shutdownState) shouldSkipUpgrade() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.skipUpgrade
+}
+
 // WaitResult is used to wrap feedback on cmd state with some mutex logic.
-// This is needed as multiple go-routines can affect this - two read pipes that can trigger upgrade
-// As well as the command, which can fail
+// This is needed as multiple go-routines can affect this - the upgrade sources, e.g. the two
+// read pipes, that can trigger upgrade. As well as the command, which can fail
 type WaitResult struct {
 	// both err and info may be updated from several go-routines
 	// access is wrapped by mutex and should only be done through methods
@@ -107,12 +843,27 @@ func (u *WaitResult) SetError(myErr error) {
 // SetUpgrade sets first non-nil upgrade info, ensure error is then nil
 // pass in a command to shutdown on successful upgrade
 func (u *WaitResult) SetUpgrade(up *UpgradeInfo) {
+	u.setUpgrade(up)
+}
+
+// replaceUpgrade replaces the upgrade set, when sources conflict
+func (u *WaitResult) replaceUpgrade(up *UpgradeInfo) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.info = up
+	u.err = nil
+}
+
+// setUpgrade is SetUpgrade, returning true if up was set
+func (u *WaitResult) setUpgrade(up *UpgradeInfo) bool {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
 	if u.info == nil && up != nil {
 		u.info = up
 		u.err = nil
+		return true
 	}
+	return false
 }
 
 // WaitForUpgradeOrExit listens to both output streams of the process, as well as the process state itself
@@ -123,31 +874,8 @@ func (u *WaitResult) SetUpgrade(up *UpgradeInfo) {
 // It returns (nil, nil) if the process exited normally without triggering an upgrade. This is very unlikely
 // to happened with "start" but may happened with short-lived commands like `gaiad export ...`
 func WaitForUpgradeOrExit(cmd *exec.Cmd, scanOut, scanErr *bufio.Scanner) (*UpgradeInfo, error) {
-	var res WaitResult
-
-	waitScan := func(scan *bufio.Scanner) {
-		upgrade, err := WaitForUpdate(scan)
-		if err != nil {
-			res.SetError(err)
-		} else if upgrade != nil {
-			res.SetUpgrade(upgrade)
-			// now we need to kill the process
-			_ = cmd.Process.Kill()
-		}
-	}
-
-	// wait for the scanners, which can trigger upgrade and kill cmd
-	go waitScan(scanOut)
-	go waitScan(scanErr)
-
-	// if the command exits normally (eg. short command like `gaiad version`), just return (nil, nil)
-	// we often get broken read pipes if it runs too fast.
-	// if we had upgrade info, we would have killed it, and thus got a non-nil error code
-	err := cmd.Wait()
-	if err == nil {
-		return nil, nil
-	}
-	// this will set the error code if it wasn't killed due to upgrade
-	res.SetError(err)
-	return res.AsResult()
+	return newUpgradePipeline(nil, cmd, nil,
+		outputSource{stream: "stdout", scan: scanOut, match: true},
+		outputSource{stream: "stderr", scan: scanErr, match: true},
+	).run()
 }
@@ -1,10 +1,24 @@
+//go:build linux
 // +build linux
 
 package cosmovisor_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 
@@ -19,6 +33,47 @@ func TestProcessTestSuite(t *testing.T) {
 	suite.Run(t, new(processTestSuite))
 }
 
+// TestLaunchProcessLongLines skips output lines longer than the scan buffer, the upgrade
+// line after them is still detected
+func (s *processTestSuite) TestLaunchProcessLongLines() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", UpgradeDetection: cosmovisor.DetectOutput, LogBufferSize: 128 * 1024}
+	script := "#!/bin/sh\nhead -c 300000 /dev/zero | tr '\\0' x\necho\necho 'UPGRADE \"chain2\" NEEDED at height: 49: {}'\nsleep 1\n"
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	var stdout bytes.Buffer
+	doUpgrade, err := cosmovisor.LaunchProcess(cfg, nil, &stdout, ioutil.Discard)
+	s.Require().NoError(err)
+	s.Require().True(doUpgrade)
+	// the console still gets the whole line
+	s.Require().Equal(300000+1+len("UPGRADE \"chain2\" NEEDED at height: 49: {}\n"), stdout.Len())
+	currentBin, err := cfg.CurrentBin()
+	s.Require().NoError(err)
+	s.Require().Equal(cfg.UpgradeBin("chain2"), currentBin)
+}
+
+// TestSuperviseFailureOutput adds the end of the stderr of a daemon that died to the error
+// and to the notification
+func (s *processTestSuite) TestSuperviseFailureOutput() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	script := "#!/bin/sh\nfor i in $(seq 1 30); do echo \"line $i\" >&2; done\nexit 3\n"
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	err := cosmovisor.Supervise(cfg, nil, ioutil.Discard, ioutil.Discard)
+	s.Require().Error(err)
+	s.Require().True(strings.HasPrefix(err.Error(), "exit status 3, the last lines of its stderr:\n  line 11\n"), err.Error())
+	s.Require().True(strings.HasSuffix(err.Error(), "\n  line 30"), err.Error())
+	s.Require().Equal(3, cosmovisor.ExitCode(err))
+
+	events, _, rerr := cosmovisor.ReadEvents(cfg)
+	s.Require().NoError(rerr)
+	last := events[len(events)-1]
+	s.Require().Equal(cosmovisor.EventDaemonFailed, last.Type)
+	s.Require().Equal("exit status 3", last.Fields["error"])
+	s.Require().True(strings.HasSuffix(last.Fields["output"], "line 29\nline 30"))
+}
+
 // TestLaunchProcess will try running the script a few times and watch upgrades work properly
 // and args are passed through
 func (s *processTestSuite) TestLaunchProcess() {
@@ -44,6 +99,11 @@ func (s *processTestSuite) TestLaunchProcess() {
 	currentBin, err = cfg.CurrentBin()
 	s.Require().NoError(err)
 	s.Require().Equal(cfg.UpgradeBin("chain2"), currentBin)
+	last, err := cfg.LastUpgrade()
+	s.Require().NoError(err)
+	s.Require().Equal("chain2", last.Name)
+	s.Require().Equal(int64(49), last.Height)
+	s.Require().Equal(cfg.GenesisBin(), last.From)
 	args = []string{"second", "run", "--verbose"}
 	stdout.Reset()
 	stderr.Reset()
@@ -57,6 +117,287 @@ func (s *processTestSuite) TestLaunchProcess() {
 	s.Require().Equal(cfg.UpgradeBin("chain2"), currentBin)
 }
 
+// TestLaunchProcessOverrides adds the arguments of overrides.json to the launches of the
+// upgrade only
+func (s *processTestSuite) TestLaunchProcessOverrides() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(cfg.UpgradeDir("chain2"), "overrides.json"),
+		[]byte(`{"args": ["--x-crisis-skip-assert-invariants"], "env": ["CHAIN2_ONLY=1"]}`), 0o644))
+
+	var stdout, stderr bytes.Buffer
+	doUpgrade, err := cosmovisor.LaunchProcess(cfg, []string{"foo"}, &stdout, &stderr)
+	s.Require().NoError(err)
+	s.Require().True(doUpgrade)
+	s.Require().Equal("Genesis foo\nUPGRADE \"chain2\" NEEDED at height: 49: {}\n", stdout.String())
+
+	stdout.Reset()
+	doUpgrade, err = cosmovisor.LaunchProcess(cfg, []string{"second", "run"}, &stdout, &stderr)
+	s.Require().NoError(err)
+	s.Require().False(doUpgrade)
+	s.Require().Equal("Chain 2 is live!\nArgs: second run --x-crisis-skip-assert-invariants\nFinished successfully\n", stdout.String())
+
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(cfg.UpgradeDir("chain2"), "overrides.json"), []byte(`{"flags": ["--trace"]}`), 0o644))
+	_, err = cosmovisor.LaunchProcess(cfg, []string{"second", "run"}, &stdout, &stderr)
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), `unknown field "flags"`)
+}
+
+// TestLaunchProcessExtraArgs adds DAEMON_EXTRA_ARGS to every launch, before the arguments of
+// the overrides
+func (s *processTestSuite) TestLaunchProcessExtraArgs() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", ExtraArgs: []string{"--log_format", "json"}}
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(cfg.UpgradeDir("chain2"), "overrides.json"),
+		[]byte(`{"args": ["--x-crisis-skip-assert-invariants"]}`), 0o644))
+
+	var stdout, stderr bytes.Buffer
+	doUpgrade, err := cosmovisor.LaunchProcess(cfg, []string{"foo"}, &stdout, &stderr)
+	s.Require().NoError(err)
+	s.Require().True(doUpgrade)
+	s.Require().Equal("Genesis foo --log_format json\nUPGRADE \"chain2\" NEEDED at height: 49: {}\n", stdout.String())
+
+	stdout.Reset()
+	_, err = cosmovisor.LaunchProcess(cfg, []string{"second", "run"}, &stdout, &stderr)
+	s.Require().NoError(err)
+	s.Require().Equal("Chain 2 is live!\nArgs: second run --log_format json --x-crisis-skip-assert-invariants\nFinished successfully\n", stdout.String())
+}
+
+// TestLaunchProcessOutputFile prefixes the output and appends it to the output file as well
+func (s *processTestSuite) TestLaunchProcessOutputFile() {
+	home := copyTestData(s.T(), "validate")
+	file := filepath.Join(home, "daemon.log")
+	s.Require().NoError(ioutil.WriteFile(file, []byte("earlier run\n"), 0644))
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", OutputPrefix: true, OutputFile: file}
+
+	var stdout, stderr bytes.Buffer
+	_, err := cosmovisor.LaunchProcess(cfg, []string{"foo"}, &stdout, &stderr)
+	s.Require().NoError(err)
+	stamp := `\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}Z`
+	s.Require().Regexp(regexp.MustCompile(`^`+stamp+` stdout \| Genesis foo\n`+stamp+` stdout \| UPGRADE "chain2" NEEDED at height: 49: \{\}\n$`), stdout.String())
+	s.Require().Empty(stderr.String())
+	bz, err := ioutil.ReadFile(file)
+	s.Require().NoError(err)
+	s.Require().Equal("earlier run\n"+stdout.String(), string(bz))
+
+	cfg.OutputFile = filepath.Join(home, "missing", "daemon.log")
+	_, err = cosmovisor.LaunchProcess(cfg, nil, &stdout, &stderr)
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), "opening the output file")
+}
+
+// TestLaunchProcessWorkDir runs the daemon in its home, wherever cosmovisor was started from
+func (s *processTestSuite) TestLaunchProcessWorkDir() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte("#!/bin/sh\npwd\n"), 0755))
+
+	var stdout bytes.Buffer
+	_, err := cosmovisor.LaunchProcess(cfg, nil, &stdout, ioutil.Discard)
+	s.Require().NoError(err)
+	s.Require().Equal(home+"\n", stdout.String())
+
+	cfg.WorkDir = filepath.Join(home, "cosmovisor")
+	stdout.Reset()
+	_, err = cosmovisor.LaunchProcess(cfg, nil, &stdout, ioutil.Discard)
+	s.Require().NoError(err)
+	s.Require().Equal(cfg.WorkDir+"\n", stdout.String())
+}
+
+// TestLaunchProcessHooks runs the hooks of the hooks directory around the launch and the upgrade
+func (s *processTestSuite) TestLaunchProcessHooks() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	out := filepath.Join(home, "hooks.out")
+	hook := func(point, script string) {
+		dir := filepath.Join(cfg.HooksDir(), point+".d")
+		s.Require().NoError(os.MkdirAll(dir, 0755))
+		s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "10-"+point), []byte("#!/bin/sh\n"+script+"\n"), 0755))
+	}
+	hook(cosmovisor.HookPostStart, `echo "$COSMOVISOR_HOOK $COSMOVISOR_BIN" >> `+out)
+	hook(cosmovisor.HookOnCrash, `echo "$COSMOVISOR_HOOK $COSMOVISOR_EXIT_CODE" >> `+out)
+
+	// a crash runs the on-crash hooks once the post-start hooks ran
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte("#!/bin/sh\nsleep 1\nexit 3\n"), 0755))
+	_, err := cosmovisor.LaunchProcess(cfg, nil, ioutil.Discard, ioutil.Discard)
+	s.Require().Error(err)
+	ran, err := ioutil.ReadFile(out)
+	s.Require().NoError(err)
+	s.Require().Equal("post-start "+cfg.GenesisBin()+"\non-crash 3\n", string(ran))
+
+	// a failed pre-upgrade hook fails the upgrade before the switch
+	hook(cosmovisor.HookPreUpgrade, "exit 1")
+	plan := filepath.Join(cfg.DataDir(), "upgrade-info.json")
+	s.Require().NoError(os.MkdirAll(cfg.DataDir(), 0755))
+	script := fmt.Sprintf("#!/bin/sh\necho '{\"name\":\"chain2\",\"height\":49}' > %s\nexec sleep 10\n", plan)
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+	_, err = cosmovisor.LaunchProcess(cfg, nil, ioutil.Discard, ioutil.Discard)
+	var hookErr *cosmovisor.HookError
+	s.Require().True(errors.As(err, &hookErr), "%v", err)
+	s.Require().Equal(cosmovisor.HookPreUpgrade, hookErr.Point)
+	currentBin, err := cfg.CurrentBin()
+	s.Require().NoError(err)
+	s.Require().Equal(cfg.GenesisBin(), currentBin)
+}
+
+// TestLaunchProcessPlanFile upgrades once the app writes its plan file, without logging the upgrade
+func (s *processTestSuite) TestLaunchProcessPlanFile() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	plan := filepath.Join(cfg.DataDir(), "upgrade-info.json")
+	s.Require().NoError(os.MkdirAll(cfg.DataDir(), 0755))
+	script := fmt.Sprintf("#!/bin/sh\necho Genesis\necho '{\"name\":\"chain2\",\"height\":49}' > %s\nexec sleep 10\n", plan)
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	start := time.Now()
+	var stdout bytes.Buffer
+	doUpgrade, err := cosmovisor.LaunchProcess(cfg, nil, &stdout, ioutil.Discard)
+	s.Require().NoError(err)
+	s.Require().True(doUpgrade)
+	s.Require().Less(int64(time.Since(start)), int64(5*time.Second))
+	s.Require().Equal("Genesis\n", stdout.String())
+	currentBin, err := cfg.CurrentBin()
+	s.Require().NoError(err)
+	s.Require().Equal(cfg.UpgradeBin("chain2"), currentBin)
+}
+
+// TestLaunchProcessUpgradeDetection only upgrades for the source of the detection mode
+func (s *processTestSuite) TestLaunchProcessUpgradeDetection() {
+	// the genesis binary prints the upgrade line
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", UpgradeDetection: cosmovisor.DetectFile}
+	var stdout bytes.Buffer
+	doUpgrade, err := cosmovisor.LaunchProcess(cfg, nil, &stdout, ioutil.Discard)
+	s.Require().NoError(err)
+	s.Require().False(doUpgrade)
+	s.Require().Contains(stdout.String(), "Never should be printed!!!")
+
+	home = copyTestData(s.T(), "validate")
+	cfg = &cosmovisor.Config{Home: home, Name: "dummyd", UpgradeDetection: cosmovisor.DetectOutput}
+	plan := filepath.Join(cfg.DataDir(), "upgrade-info.json")
+	s.Require().NoError(os.MkdirAll(cfg.DataDir(), 0755))
+	script := fmt.Sprintf("#!/bin/sh\necho '{\"name\":\"chain2\",\"height\":49}' > %s\nsleep 1\n", plan)
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+	doUpgrade, err = cosmovisor.LaunchProcess(cfg, nil, ioutil.Discard, ioutil.Discard)
+	s.Require().NoError(err)
+	s.Require().False(doUpgrade)
+	currentBin, err := cfg.CurrentBin()
+	s.Require().NoError(err)
+	s.Require().Equal(cfg.GenesisBin(), currentBin)
+}
+
+// TestSupervise runs the genesis binary and, once upgraded, the new one in the same call
+func (s *processTestSuite) TestSupervise() {
+	for _, restart := range []bool{true, false} {
+		home := copyTestData(s.T(), "validate")
+		cfg := &cosmovisor.Config{Home: home, Name: "dummyd", RestartAfterUpgrade: restart}
+
+		var stdout, stderr bytes.Buffer
+		err := cosmovisor.Supervise(cfg, []string{"foo", "bar"}, &stdout, &stderr)
+		if restart {
+			s.Require().NoError(err)
+		} else {
+			var upgraded *cosmovisor.UpgradedError
+			s.Require().ErrorAs(err, &upgraded)
+			s.Require().Equal(cfg.UpgradeBin("chain2"), upgraded.Bin)
+			s.Require().Equal(cosmovisor.ExitCodeUpgraded, cosmovisor.ExitCode(err))
+		}
+		s.Require().Equal("", stderr.String())
+		expect := "Genesis foo bar\nUPGRADE \"chain2\" NEEDED at height: 49: {}\n"
+		if restart {
+			expect += "Chain 2 is live!\nArgs: foo bar\nFinished successfully\n"
+		}
+		s.Require().Equal(expect, stdout.String())
+
+		currentBin, err := cfg.CurrentBin()
+		s.Require().NoError(err)
+		s.Require().Equal(cfg.UpgradeBin("chain2"), currentBin)
+	}
+}
+
+// TestLaunchProcessStopsForUpgrade sends SIGTERM to the daemon that reached an upgrade and
+// only kills it if it doesn't exit within the grace period
+func (s *processTestSuite) TestLaunchProcessStopsForUpgrade() {
+	cases := map[string]struct {
+		stop   syscall.Signal
+		trap   string
+		output string
+	}{
+		"exits on SIGINT":     {stop: syscall.SIGINT, trap: "echo flushed; exit 0", output: "flushed\n"},
+		"exits on SIGTERM":    {trap: "echo flushed; exit 0", output: "flushed\n"},
+		"fails on SIGTERM":    {trap: "echo flushed; exit 1", output: "flushed\n"},
+		"ignores SIGTERM":     {trap: "echo ignored", output: "ignored\n"},
+		"default disposition": {},
+	}
+	for name, tc := range cases {
+		s.Run(name, func() {
+			home := copyTestData(s.T(), "validate")
+			cfg := &cosmovisor.Config{Home: home, Name: "dummyd", ShutdownGrace: 500 * time.Millisecond, StopSignal: tc.stop}
+			script := "#!/bin/sh\n"
+			if tc.trap != "" {
+				// only the stop signal is trapped, any other one would end the script
+				trapped := "TERM"
+				if tc.stop == syscall.SIGINT {
+					trapped = "INT"
+				}
+				script += fmt.Sprintf("trap '%s' %s\n", tc.trap, trapped)
+			}
+			script += "echo 'UPGRADE \"chain2\" NEEDED at height: 49: {}'\n"
+			// wait returns when a trapped signal arrives, the sleeps don't hold the pipes
+			script += "sleep 3 >/dev/null 2>&1 &\nwait\nsleep 3 >/dev/null 2>&1 &\nwait\necho Never should be printed!!!\n"
+			s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+			var stdout, stderr bytes.Buffer
+			start := time.Now()
+			upgraded, err := cosmovisor.LaunchProcess(cfg, nil, &stdout, &stderr)
+			s.Require().NoError(err)
+			s.Require().True(upgraded)
+			s.Require().Less(int64(time.Since(start)), int64(3*time.Second))
+			s.Require().Equal("UPGRADE \"chain2\" NEEDED at height: 49: {}\n"+tc.output, stdout.String())
+
+			currentBin, err := cfg.CurrentBin()
+			s.Require().NoError(err)
+			s.Require().Equal(cfg.UpgradeBin("chain2"), currentBin)
+		})
+	}
+}
+
+// TestSuperviseAfterFailure restarts a daemon that dies, until it succeeds or the attempts run out
+func (s *processTestSuite) TestSuperviseAfterFailure() {
+	cases := map[string]struct {
+		failures int
+		restart  bool
+		err      string
+		runs     string
+	}{
+		"recovers":        {failures: 2, restart: true, runs: "run\nrun\nrun\n"},
+		"gives up":        {failures: 4, restart: true, err: "giving up after 2 restarts in a row: exit status 3", runs: "run\nrun\nrun\n"},
+		"restart not set": {failures: 2, err: "exit status 3", runs: "run\n"},
+	}
+	for name, tc := range cases {
+		s.Run(name, func() {
+			home := copyTestData(s.T(), "validate")
+			cfg := &cosmovisor.Config{Home: home, Name: "dummyd", RestartAfterFailure: tc.restart, RestartDelay: time.Millisecond, RestartMaxAttempts: 2}
+			runs := filepath.Join(home, "runs")
+			// the daemon fails until it ran more than tc.failures times
+			script := fmt.Sprintf("#!/bin/sh\necho run >> %s\nif [ $(wc -l < %s) -le %d ]; then exit 3; fi\necho Finished successfully\n", runs, runs, tc.failures)
+			s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+			var stdout, stderr bytes.Buffer
+			err := cosmovisor.Supervise(cfg, nil, &stdout, &stderr)
+			bz, rerr := ioutil.ReadFile(runs)
+			s.Require().NoError(rerr)
+			s.Require().Equal(tc.runs, string(bz))
+			if tc.err != "" {
+				s.Require().EqualError(err, tc.err)
+				return
+			}
+			s.Require().NoError(err)
+			s.Require().Equal("Finished successfully\n", stdout.String())
+		})
+	}
+}
+
 // TestLaunchProcess will try running the script a few times and watch upgrades work properly
 // and args are passed through
 func (s *processTestSuite) TestLaunchProcessWithDownloads() {
@@ -112,3 +453,349 @@ func (s *processTestSuite) TestLaunchProcessWithDownloads() {
 	s.Require().NoError(err)
 	s.Require().Equal(cfg.UpgradeBin("chain3"), currentBin)
 }
+
+// TestLaunchProcessChattyOutput floods the output pipe while the upgrade fires and makes
+// sure neither the scanners nor the console deadlock and memory stays bounded
+func (s *processTestSuite) TestLaunchProcessChattyOutput() {
+	if testing.Short() {
+		s.T().Skip("soak test")
+	}
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	script := `#!/bin/sh
+yes "chatty debug line with some padding to look like a real log entry of a node" | head -n 500000
+echo 'UPGRADE "chain2" NEEDED at height: 49: {}'
+yes "still talking while being stopped" | head -n 500000
+sleep 5
+`
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	type result struct {
+		doUpgrade bool
+		err       error
+	}
+	done := make(chan result)
+	var stdout countingWriter
+	go func() {
+		doUpgrade, err := cosmovisor.LaunchProcess(cfg, nil, &stdout, ioutil.Discard)
+		done <- result{doUpgrade, err}
+	}()
+
+	select {
+	case res := <-done:
+		s.Require().NoError(res.err)
+		s.Require().True(res.doUpgrade)
+	case <-time.After(time.Minute):
+		s.T().Fatal("deadlock: LaunchProcess didn't return")
+	}
+	s.Require().True(atomic.LoadInt64(&stdout.n) > 500000*50, "console got %d bytes", atomic.LoadInt64(&stdout.n))
+
+	currentBin, err := cfg.CurrentBin()
+	s.Require().NoError(err)
+	s.Require().Equal(cfg.UpgradeBin("chain2"), currentBin)
+
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	// two streams with one scanner each may hold at most 2 * 8 MiB
+	s.Require().Less(int64(after.HeapInuse)-int64(before.HeapInuse), int64(64<<20))
+}
+
+const reloadScript = `#!/bin/sh
+trap 'echo got HUP' HUP
+echo ready
+i=0
+while [ $i -lt 20 ]; do
+  sleep 0.1
+  i=$((i+1))
+done
+echo done
+`
+
+// TestLaunchProcessReload delivers the reload signal on SIGUSR2 and keeps the daemon running
+func (s *processTestSuite) TestLaunchProcessReload() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(reloadScript), 0755))
+
+	stdout := newWaitingWriter("ready")
+	go func() {
+		<-stdout.seen
+		s.NoError(syscall.Kill(os.Getpid(), syscall.SIGUSR2))
+	}()
+	doUpgrade, err := cosmovisor.LaunchProcess(cfg, nil, stdout, ioutil.Discard)
+	s.Require().NoError(err)
+	s.Require().False(doUpgrade)
+	s.Require().Equal("ready\ngot HUP\ndone\n", stdout.String())
+}
+
+// TestLaunchProcessForwardsSignals relays the signals meant for the daemon as they are
+func (s *processTestSuite) TestLaunchProcessForwardsSignals() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	script := strings.Replace(reloadScript, "trap 'echo got HUP' HUP", "trap 'echo got HUP' HUP\ntrap 'echo got USR1' USR1", 1)
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	stdout := newWaitingWriter("ready")
+	go func() {
+		<-stdout.seen
+		s.NoError(syscall.Kill(os.Getpid(), syscall.SIGHUP))
+		time.Sleep(300 * time.Millisecond)
+		s.NoError(syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+	}()
+	doUpgrade, err := cosmovisor.LaunchProcess(cfg, nil, stdout, ioutil.Discard)
+	s.Require().NoError(err)
+	s.Require().False(doUpgrade)
+	s.Require().Equal("ready\ngot HUP\ngot USR1\ndone\n", stdout.String())
+}
+
+// TestLaunchProcessInterrupted stops the daemon on SIGINT like on SIGTERM
+func (s *processTestSuite) TestLaunchProcessInterrupted() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", RestartAfterFailure: true}
+	script := strings.Replace(reloadScript, "trap 'echo got HUP' HUP", "trap 'echo got INT; exit 130' INT", 1)
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	stdout := newWaitingWriter("ready")
+	go func() {
+		<-stdout.seen
+		s.NoError(syscall.Kill(os.Getpid(), syscall.SIGINT))
+	}()
+	doUpgrade, err := cosmovisor.LaunchProcess(cfg, nil, stdout, ioutil.Discard)
+	s.Require().Error(err)
+	s.Require().False(doUpgrade)
+	// stopped on request, so not restarted either
+	s.Require().False(cfg.ShouldRestartAfterFailure(err))
+	s.Require().Equal("ready\ngot INT\n", stdout.String())
+}
+
+// TestLaunchProcessStdin passes cosmovisor's stdin to the daemon, e.g. for a passphrase prompt
+func (s *processTestSuite) TestLaunchProcessStdin() {
+	cases := map[string]struct {
+		input  string
+		closed bool
+		output string
+	}{
+		"passphrase":   {input: "secret\n", output: "got secret\n"},
+		"eof":          {output: "eof\n"},
+		"stdin closed": {closed: true, output: "eof\n"},
+	}
+	for name, tc := range cases {
+		s.Run(name, func() {
+			home := copyTestData(s.T(), "validate")
+			cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+			script := "#!/bin/sh\nif read line; then echo got $line; else echo eof; fi\n"
+			s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+			r, w, err := os.Pipe()
+			s.Require().NoError(err)
+			defer r.Close()
+			_, err = w.WriteString(tc.input)
+			s.Require().NoError(err)
+			s.Require().NoError(w.Close())
+			if tc.closed {
+				s.Require().NoError(r.Close())
+			}
+			stdin := os.Stdin
+			os.Stdin = r
+			defer func() { os.Stdin = stdin }()
+
+			var stdout bytes.Buffer
+			doUpgrade, err := cosmovisor.LaunchProcess(cfg, nil, &stdout, ioutil.Discard)
+			s.Require().NoError(err)
+			s.Require().False(doUpgrade)
+			s.Require().Equal(tc.output, stdout.String())
+		})
+	}
+}
+
+// TestLaunchProcessContext stops the daemon when the context is done
+func (s *processTestSuite) TestLaunchProcessContext() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", RestartAfterFailure: true}
+	script := strings.Replace(reloadScript, "trap 'echo got HUP' HUP", "trap 'echo got TERM; exit 143' TERM", 1)
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stdout := newWaitingWriter("ready")
+	go func() {
+		<-stdout.seen
+		cancel()
+	}()
+	doUpgrade, err := cosmovisor.LaunchProcessContext(ctx, cfg, nil, stdout, ioutil.Discard)
+	s.Require().Error(err)
+	s.Require().False(doUpgrade)
+	s.Require().False(cfg.ShouldRestartAfterFailure(err))
+	s.Require().Equal("ready\ngot TERM\n", stdout.String())
+
+	// nothing is launched with a context that is done
+	_, err = cosmovisor.LaunchProcessContext(ctx, cfg, nil, ioutil.Discard, ioutil.Discard)
+	s.Require().Equal(context.Canceled, err)
+}
+
+// TestLaunchProcessRunState records the running daemon for the status, until it exits
+func (s *processTestSuite) TestLaunchProcessRunState() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	script := strings.Replace(reloadScript, "trap 'echo got HUP' HUP", "trap 'echo got TERM; exit 143' TERM", 1)
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stdout := newWaitingWriter("ready")
+	running := make(chan *cosmovisor.Status, 1)
+	go func() {
+		<-stdout.seen
+		status, _ := cosmovisor.GetStatus(&cosmovisor.Config{Home: home, Name: "dummyd", ReadOnly: true})
+		running <- status
+		cancel()
+	}()
+	_, err := cosmovisor.LaunchProcessContext(ctx, cfg, nil, stdout, ioutil.Discard)
+	s.Require().Error(err)
+
+	status := <-running
+	s.Require().NotNil(status)
+	s.Require().NotNil(status.Running)
+	s.Require().Equal(os.Getpid(), status.Running.PID)
+	s.Require().NotZero(status.Running.DaemonPID)
+	s.Require().Equal(cfg.GenesisBin(), status.Running.Binary)
+
+	status, err = cosmovisor.GetStatus(cfg)
+	s.Require().NoError(err)
+	s.Require().Nil(status.Running)
+}
+
+// TestSuperviseContext doesn't wait out the restart delay once the context is done
+func (s *processTestSuite) TestSuperviseContext() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", RestartAfterFailure: true, RestartDelay: time.Hour}
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte("#!/bin/sh\nexit 3\n"), 0755))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := cosmovisor.SuperviseContext(ctx, cfg, nil, ioutil.Discard, ioutil.Discard)
+	s.Require().EqualError(err, "exit status 3")
+	s.Require().Less(int64(time.Since(start)), int64(5*time.Second))
+}
+
+// TestLaunchProcessFailedReload reports a daemon exiting right after the reload signal
+func (s *processTestSuite) TestLaunchProcessFailedReload() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", ReloadSignal: syscall.SIGUSR1}
+	script := strings.Replace(reloadScript, "trap 'echo got HUP' HUP", "trap 'echo bye; exit 3' USR1", 1)
+	s.Require().NoError(ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	stdout := newWaitingWriter("ready")
+	go func() {
+		<-stdout.seen
+		s.NoError(syscall.Kill(os.Getpid(), syscall.SIGUSR2))
+	}()
+	doUpgrade, err := cosmovisor.LaunchProcess(cfg, nil, stdout, ioutil.Discard)
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), "after reload")
+	s.Require().False(doUpgrade)
+	s.Require().Equal("ready\nbye\n", stdout.String())
+}
+
+// waitingWriter buffers everything written to it and closes seen once the marker was written
+type waitingWriter struct {
+	mutex  sync.Mutex
+	buf    bytes.Buffer
+	marker string
+	seen   chan struct{}
+}
+
+func newWaitingWriter(marker string) *waitingWriter {
+	return &waitingWriter{marker: marker, seen: make(chan struct{})}
+}
+
+func (w *waitingWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	found := strings.Contains(w.buf.String(), w.marker)
+	n, err := w.buf.Write(p)
+	if !found && strings.Contains(w.buf.String(), w.marker) {
+		close(w.seen)
+	}
+	return n, err
+}
+
+func (w *waitingWriter) String() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.buf.String()
+}
+
+// countingWriter discards everything written to it, counting the bytes
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&w.n, int64(len(p)))
+	return len(p), nil
+}
+
+// queuePlans writes the plan files into the queue directory
+func (s *processTestSuite) queuePlans(cfg *cosmovisor.Config, plans map[string]string) {
+	s.Require().NoError(os.MkdirAll(cfg.QueueDir(), 0755))
+	for name, plan := range plans {
+		s.Require().NoError(ioutil.WriteFile(filepath.Join(cfg.QueueDir(), name), []byte(plan), 0644))
+	}
+}
+
+func (s *processTestSuite) TestLaunchProcessQueuedPlans() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	s.queuePlans(cfg, map[string]string{
+		"1-chain2.json": `{"name": "chain2", "height": 49}`,
+		"2-chain3.json": `{"name": "chain3", "height": 50, "chain_immediately": true}`,
+	})
+
+	var stdout, stderr bytes.Buffer
+	doUpgrade, err := cosmovisor.LaunchProcess(cfg, []string{"foo"}, &stdout, &stderr)
+	s.Require().NoError(err)
+	s.Require().True(doUpgrade)
+
+	// the app halted for chain2, chain3 was applied before relaunching
+	currentBin, err := cfg.CurrentBin()
+	s.Require().NoError(err)
+	s.Require().Equal(cfg.UpgradeBin("chain3"), currentBin)
+
+	queue, err := cfg.UpgradeQueue()
+	s.Require().NoError(err)
+	s.Require().Empty(queue)
+	for _, name := range []string{"1-chain2.json", "2-chain3.json"} {
+		_, err := os.Stat(filepath.Join(cfg.QueueDir(), "applied", name))
+		s.Require().NoError(err)
+	}
+}
+
+func (s *processTestSuite) TestLaunchProcessConflictingQueue() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	s.queuePlans(cfg, map[string]string{
+		"1-chain3.json": `{"name": "chain3", "height": 49}`,
+	})
+
+	var stdout, stderr bytes.Buffer
+	doUpgrade, err := cosmovisor.LaunchProcess(cfg, []string{"foo"}, &stdout, &stderr)
+	s.Require().NoError(err)
+	s.Require().True(doUpgrade)
+
+	// the app's plan wins, the queue is left as it was
+	currentBin, err := cfg.CurrentBin()
+	s.Require().NoError(err)
+	s.Require().Equal(cfg.UpgradeBin("chain2"), currentBin)
+
+	queue, err := cfg.UpgradeQueue()
+	s.Require().NoError(err)
+	s.Require().Len(queue, 1)
+	s.Require().Equal("chain3", queue[0].Name)
+}
@@ -0,0 +1,95 @@
+package cosmovisor
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// PruneUpgrades removes the directories of the upgrades applied before the keep most recent
+// ones, as recorded in the upgrade history. The directory current points to and the one of
+// the binary that ran before the last upgrade, which a rollback needs, are never removed,
+// nor are upgrades that weren't applied yet. With dryRun nothing is removed. It returns the
+// directories pruned, oldest upgrade first.
+func PruneUpgrades(cfg *Config, keep int, dryRun bool) ([]string, error) {
+	if keep < 1 {
+		return nil, errors.New("at least the most recent upgrade must be kept")
+	}
+	if cfg.Immutable {
+		return nil, errors.New("upgrade directories can't be removed from an immutable layout, they ship with the image")
+	}
+	upgradeDirMutex.Lock()
+	defer upgradeDirMutex.Unlock()
+	return cfg.pruneUpgrades(keep, dryRun)
+}
+
+// pruneUpgrades is PruneUpgrades, the caller holds upgradeDirMutex
+func (cfg *Config) pruneUpgrades(keep int, dryRun bool) ([]string, error) {
+	dirs, err := cfg.upgradesToPrune(keep)
+	if err != nil || dryRun {
+		return dirs, err
+	}
+	fs := cfg.fs()
+	for i, dir := range dirs {
+		logger.Infof("removing upgrade directory %s", dir)
+		if err := fs.removeAll(dir); err != nil {
+			return dirs[:i], err
+		}
+	}
+	return dirs, nil
+}
+
+// upgradesToPrune returns the directories PruneUpgrades removes
+func (cfg *Config) upgradesToPrune(keep int) ([]string, error) {
+	history, err := cfg.UpgradeHistory()
+	if err != nil {
+		return nil, err
+	}
+	// the upgrades applied, the most recent first
+	var applied []string
+	seen := map[string]bool{}
+	for i := len(history) - 1; i >= 0; i-- {
+		if e := history[i]; e.Kind == HistoryUpgrade && !seen[e.Name] {
+			seen[e.Name] = true
+			applied = append(applied, e.Name)
+		}
+	}
+	if len(applied) <= keep {
+		return nil, nil
+	}
+
+	bin, _ := cfg.resolveCurrentBin()
+	kept := map[string]bool{filepath.Dir(filepath.Dir(bin)): true}
+	last, err := cfg.LastUpgrade()
+	if err != nil {
+		return nil, err
+	}
+	if last != nil && last.From != "" {
+		kept[filepath.Dir(filepath.Dir(last.From))] = true
+	}
+	var dirs []string
+	for i := len(applied) - 1; i >= keep; i-- {
+		dir := cfg.UpgradeDir(applied[i])
+		if kept[dir] {
+			continue
+		}
+		if _, err := os.Lstat(dir); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// pruneUpgradesAfterSwitch removes the old upgrade directories as UpgradesKeepRecent says.
+// The upgrade is done, so a failure is only logged.
+func (cfg *Config) pruneUpgradesAfterSwitch() {
+	if cfg.UpgradesKeepRecent <= 0 || cfg.Immutable {
+		return
+	}
+	if _, err := cfg.pruneUpgrades(cfg.UpgradesKeepRecent, false); err != nil {
+		logger.Warnf("pruning upgrade directories: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"os"
+	"testing"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+)
+
+// applyUpgrades switches to each upgrade in turn, creating its directory from chain3
+func applyUpgrades(t *testing.T, cfg *Config, names ...string) {
+	for _, name := range names {
+		if _, err := os.Stat(cfg.UpgradeDir(name)); os.IsNotExist(err) {
+			require.NoError(t, copy.Copy(cfg.UpgradeDir("chain3"), cfg.UpgradeDir(name)))
+		}
+		require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: name}))
+	}
+}
+
+func TestPruneUpgrades(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	applyUpgrades(t, cfg, "chain2", "v3", "v4", "v5")
+
+	dirs, err := PruneUpgrades(cfg, 2, true)
+	require.NoError(t, err)
+	// v4 ran before the last upgrade, a rollback needs it
+	require.Equal(t, []string{cfg.UpgradeDir("chain2"), cfg.UpgradeDir("v3")}, dirs)
+	require.DirExists(t, cfg.UpgradeDir("chain2"))
+
+	dirs, err = PruneUpgrades(cfg, 1, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{cfg.UpgradeDir("chain2"), cfg.UpgradeDir("v3")}, dirs)
+	for _, name := range []string{"chain2", "v3"} {
+		require.NoDirExists(t, cfg.UpgradeDir(name))
+	}
+	// chain3, nobin and noexec were never applied, so they aren't pruned
+	for _, name := range []string{"v4", "v5", "chain3", "nobin", "noexec"} {
+		require.DirExists(t, cfg.UpgradeDir(name))
+	}
+
+	dirs, err = PruneUpgrades(cfg, 1, false)
+	require.NoError(t, err)
+	require.Empty(t, dirs)
+	_, err = PruneUpgrades(cfg, 0, false)
+	require.EqualError(t, err, "at least the most recent upgrade must be kept")
+}
+
+func TestPruneUpgradesKeepsCurrent(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	applyUpgrades(t, cfg, "chain2", "v3", "v4")
+	// rolled back by hand to chain2
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+
+	dirs, err := PruneUpgrades(cfg, 1, false)
+	require.NoError(t, err)
+	require.Empty(t, dirs, "chain2 is current, v3 ran before v4")
+}
+
+func TestPruneUpgradesAfterSwitch(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", UpgradesKeepRecent: 2}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	applyUpgrades(t, cfg, "chain2", "v3", "v4", "v5")
+
+	for _, name := range []string{"chain2", "v3"} {
+		require.NoDirExists(t, cfg.UpgradeDir(name))
+	}
+	require.DirExists(t, cfg.UpgradeDir("v4"))
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.UpgradeBin("v5"), bin)
+}
+
+func TestPruneUpgradesImmutable(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", Immutable: true}
+	_, err := PruneUpgrades(cfg, 1, false)
+	require.EqualError(t, err, "upgrade directories can't be removed from an immutable layout, they ship with the image")
+}
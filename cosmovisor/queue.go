@@ -0,0 +1,235 @@
+package cosmovisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+const (
+	queueDir        = "queue"
+	queueAppliedDir = "applied"
+)
+
+// queueFileRegex matches numbered plan files, e.g. 1-v2.json or 002.json
+var queueFileRegex = regexp.MustCompile(`^(\d+)(-[^/]*)?\.json$`)
+
+// QueuedPlan is a plan delivered ahead of time in the queue directory, for migrations
+// shipped as several upgrades applied back-to-back
+type QueuedPlan struct {
+	Name   string `json:"name"`
+	Height int64  `json:"height"`
+	Info   string `json:"info,omitempty"`
+	// ChainImmediately applies the plan right after the previous one, whatever its height
+	ChainImmediately bool `json:"chain_immediately,omitempty"`
+
+	// File is the name of the plan file in the queue directory
+	File string `json:"-"`
+	seq  int
+}
+
+// QueueDir is the directory holding queued plan files
+func (cfg *Config) QueueDir() string {
+	return filepath.Join(cfg.Root(), queueDir)
+}
+
+// UpgradeQueue reads and validates the queued plans, in the order they are applied.
+// It returns an empty queue if there is no queue directory.
+func (cfg *Config) UpgradeQueue() ([]*QueuedPlan, error) {
+	entries, err := ioutil.ReadDir(cfg.QueueDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var queue []*QueuedPlan
+	for _, e := range entries {
+		if e.IsDir() && e.Name() == queueAppliedDir {
+			continue
+		}
+		// an immutable queue can't be emptied, applied plans are only recorded in the state dir
+		if cfg.Immutable && cfg.queueApplied(e.Name()) {
+			continue
+		}
+		m := queueFileRegex.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("%s: queued plans must be named <number>-<name>.json", e.Name())
+		}
+		seq, _ := strconv.Atoi(m[1])
+
+		// queued plans are delivered by other processes, don't follow symlinks
+		bz, err := readFileInDir(cfg.Root(), filepath.Join(queueDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var plan QueuedPlan
+		if err := json.Unmarshal(bz, &plan); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		plan.File, plan.seq = e.Name(), seq
+		if plan.Name == "" {
+			return nil, fmt.Errorf("%s: name is required", e.Name())
+		}
+		if plan.Height <= 0 {
+			return nil, fmt.Errorf("%s: height must be positive", e.Name())
+		}
+		queue = append(queue, &plan)
+	}
+
+	sort.Slice(queue, func(i, j int) bool { return queue[i].seq < queue[j].seq })
+	names := map[string]string{}
+	for i, plan := range queue {
+		if i > 0 && queue[i-1].seq == plan.seq {
+			return nil, fmt.Errorf("%s and %s have the same number", queue[i-1].File, plan.File)
+		}
+		if i > 0 && queue[i-1].Height > plan.Height {
+			return nil, fmt.Errorf("%s is queued after %s but has a lower height", plan.File, queue[i-1].File)
+		}
+		if other, ok := names[plan.Name]; ok {
+			return nil, fmt.Errorf("%s and %s both queue upgrade %q", other, plan.File, plan.Name)
+		}
+		names[plan.Name] = plan.File
+	}
+	return queue, nil
+}
+
+// UpgradeInfo converts the queued plan into the info of a detected upgrade
+func (p *QueuedPlan) UpgradeInfo() *UpgradeInfo {
+	return &UpgradeInfo{Name: p.Name, Height: p.Height, Info: p.Info}
+}
+
+// matches returns true if the upgrade the app halted for is this plan
+func (p *QueuedPlan) matches(info *UpgradeInfo) bool {
+	return p.Name == info.Name && (info.Height == 0 || info.Height == p.Height)
+}
+
+// queueChain decides which queued plans follow the upgrade the app halted for. The head
+// must match that upgrade, it is consumed, and the plans chained after it are returned.
+// If the head doesn't match, the queue conflicts with the app's plan and is left alone.
+func queueChain(queue []*QueuedPlan, info *UpgradeInfo) (head *QueuedPlan, chain []*QueuedPlan, err error) {
+	if len(queue) == 0 {
+		return nil, nil, nil
+	}
+	head = queue[0]
+	if !head.matches(info) {
+		return nil, nil, fmt.Errorf("queue head %s (%q at height %d) conflicts with the upgrade %q at height %d the app halted for",
+			head.File, head.Name, head.Height, info.Name, info.Height)
+	}
+	for _, next := range queue[1:] {
+		if next.Height != head.Height && !next.ChainImmediately {
+			break
+		}
+		chain = append(chain, next)
+	}
+	return head, chain, nil
+}
+
+// applyQueue runs after the upgrade the app halted for was applied. It consumes the matching
+// queue head and applies the plans chained after it before the daemon is launched again.
+// The app's plan always wins, a conflicting queue is only reported.
+func (cfg *Config) applyQueue(info *UpgradeInfo) error {
+	queue, err := cfg.UpgradeQueue()
+	if err != nil {
+		logger.Warnf("not applying queued upgrades: %v", err)
+		return nil
+	}
+	head, chain, err := queueChain(queue, info)
+	if err != nil {
+		logger.Infof("ignoring upgrade queue, the app's plan wins: %v", err)
+		notify(cfg, Event{ID: fmt.Sprintf("%s/%s/%s", EventQueueConflict, queue[0].File, info.Name), Type: EventQueueConflict,
+			Upgrade: info.Name, Message: err.Error()})
+		return nil
+	}
+	if head == nil {
+		return nil
+	}
+	if err := cfg.consumeQueued(head); err != nil {
+		return err
+	}
+
+	for _, next := range chain {
+		logger.Infof("applying queued upgrade %q from %s", next.Name, next.File)
+		timings := NewUpgradeTimings(next.Name)
+		err := doUpgrade(cfg, next.UpgradeInfo(), timings)
+		timings.End(err)
+		notifyUpgrade(cfg, next.Name, err)
+		if err != nil {
+			return fmt.Errorf("applying queued upgrade %s: %w", next.File, err)
+		}
+		if err := cfg.consumeQueued(next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queuedAfter returns the first plan left in the queue once the upgrade at info and the plans
+// chained to it are applied, if it is above its height: the daemon has to run again to reach it
+func queuedAfter(queue []*QueuedPlan, info *UpgradeInfo) *QueuedPlan {
+	rest := queue
+	if head, chain, err := queueChain(queue, info); err == nil && head != nil {
+		rest = queue[1+len(chain):]
+	}
+	for _, next := range rest {
+		if next.Height > info.Height {
+			return next
+		}
+	}
+	return nil
+}
+
+// nextQueued returns the queued plan the daemon has to run again to reach after the last
+// upgrade, nil if there is none or the queue can't be read
+func (cfg *Config) nextQueued() *QueuedPlan {
+	applied, err := cfg.LastUpgrade()
+	if err != nil || applied == nil {
+		return nil
+	}
+	queue, err := cfg.UpgradeQueue()
+	if err != nil {
+		return nil
+	}
+	return queuedAfter(queue, &UpgradeInfo{Name: applied.Name, Height: applied.Height})
+}
+
+// appliedQueueDir keeps the applied plans
+func (cfg *Config) appliedQueueDir() string {
+	return filepath.Join(cfg.StateDir(), queueDir, queueAppliedDir)
+}
+
+// queueApplied returns true if the plan file was applied already
+func (cfg *Config) queueApplied(file string) bool {
+	_, err := os.Stat(filepath.Join(cfg.appliedQueueDir(), file))
+	return err == nil
+}
+
+// consumeQueued moves an applied plan out of the queue, or copies it to the applied plans
+// if the queue is part of an immutable layout
+func (cfg *Config) consumeQueued(p *QueuedPlan) error {
+	fs := cfg.fs()
+	dir := cfg.appliedQueueDir()
+	if err := fs.mkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if cfg.Immutable {
+		bz, err := readFileInDir(cfg.Root(), filepath.Join(queueDir, p.File))
+		if err != nil {
+			return fmt.Errorf("recording applied plan: %w", err)
+		}
+		if err := fs.writeFile(filepath.Join(dir, p.File), bz, 0644); err != nil {
+			return fmt.Errorf("recording applied plan: %w", err)
+		}
+		return nil
+	}
+	if err := fs.rename(filepath.Join(cfg.QueueDir(), p.File), filepath.Join(dir, p.File)); err != nil {
+		return fmt.Errorf("removing applied plan from the queue: %w", err)
+	}
+	return nil
+}
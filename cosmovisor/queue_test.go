@@ -0,0 +1,119 @@
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgradeQueue(t *testing.T) {
+	cases := map[string]struct {
+		files  map[string]string
+		err    string
+		expect []string
+	}{
+		"no queue": {},
+		"ordered by number": {
+			files: map[string]string{
+				"10-c.json": `{"name": "c", "height": 20}`,
+				"2-b.json":  `{"name": "b", "height": 10}`,
+				"1.json":    `{"name": "a", "height": 10}`,
+			},
+			expect: []string{"a", "b", "c"},
+		},
+		"unnumbered file": {
+			files: map[string]string{"next.json": `{"name": "a", "height": 10}`},
+			err:   "must be named",
+		},
+		"missing height": {
+			files: map[string]string{"1-a.json": `{"name": "a"}`},
+			err:   "height must be positive",
+		},
+		"same number": {
+			files: map[string]string{
+				"1-a.json":  `{"name": "a", "height": 10}`,
+				"01-b.json": `{"name": "b", "height": 10}`,
+			},
+			err: "same number",
+		},
+		"decreasing height": {
+			files: map[string]string{
+				"1-a.json": `{"name": "a", "height": 20}`,
+				"2-b.json": `{"name": "b", "height": 10}`,
+			},
+			err: "lower height",
+		},
+		"duplicate name": {
+			files: map[string]string{
+				"1-a.json": `{"name": "a", "height": 10}`,
+				"2-a.json": `{"name": "a", "height": 20}`,
+			},
+			err: `both queue upgrade "a"`,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := ioutil.TempDir("", "queue")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			cfg := &Config{Home: home, Name: "dummyd"}
+			if tc.files != nil {
+				require.NoError(t, os.MkdirAll(cfg.QueueDir(), 0755))
+			}
+			for file, plan := range tc.files {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.QueueDir(), file), []byte(plan), 0644))
+			}
+
+			queue, err := cfg.UpgradeQueue()
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			var names []string
+			for _, plan := range queue {
+				names = append(names, plan.Name)
+			}
+			require.Equal(t, tc.expect, names)
+		})
+	}
+}
+
+func TestQueueChain(t *testing.T) {
+	queue := []*QueuedPlan{
+		{Name: "a", Height: 10, File: "1-a.json"},
+		{Name: "b", Height: 10, File: "2-b.json"},
+		{Name: "c", Height: 11, ChainImmediately: true, File: "3-c.json"},
+		{Name: "d", Height: 20, File: "4-d.json"},
+	}
+
+	head, chain, err := queueChain(queue, &UpgradeInfo{Name: "a", Height: 10})
+	require.NoError(t, err)
+	require.Equal(t, "a", head.Name)
+	require.Equal(t, []*QueuedPlan{queue[1], queue[2]}, chain)
+
+	_, _, err = queueChain(queue, &UpgradeInfo{Name: "a", Height: 12})
+	require.Error(t, err)
+	_, _, err = queueChain(queue, &UpgradeInfo{Name: "b", Height: 10})
+	require.Error(t, err)
+}
+
+func TestQueuedAfter(t *testing.T) {
+	queue := []*QueuedPlan{
+		{Name: "a", Height: 10, File: "1-a.json"},
+		{Name: "b", Height: 10, File: "2-b.json"},
+		{Name: "d", Height: 20, File: "3-d.json"},
+	}
+	// the plan chained to the head is applied in the same downtime, d needs another run
+	require.Equal(t, queue[2], queuedAfter(queue, &UpgradeInfo{Name: "a", Height: 10}))
+	// once a and b were consumed
+	require.Equal(t, queue[2], queuedAfter(queue[2:], &UpgradeInfo{Name: "b", Height: 10}))
+	require.Nil(t, queuedAfter(nil, &UpgradeInfo{Name: "d", Height: 20}))
+	// a plan below the upgrade applied can't be reached anymore
+	require.Nil(t, queuedAfter(queue[2:], &UpgradeInfo{Name: "e", Height: 30}))
+}
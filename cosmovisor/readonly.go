@@ -0,0 +1,151 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// ErrReadOnly is returned for writes attempted with a read-only config
+var ErrReadOnly = errors.New("cosmovisor is in read-only mode")
+
+// panicOnReadOnlyWrite makes a refused write panic instead of returning ErrReadOnly.
+// Tests set it, so an inspection path that starts writing can't go unnoticed.
+var panicOnReadOnlyWrite = false
+
+// fsGuard performs the filesystem writes of the package. A read-only guard refuses all of
+// them, so inspection commands can run against the home of a node supervised by another
+// cosmovisor process.
+type fsGuard struct {
+	readOnly bool
+	// tmpDir holds scratch directories, the system default if empty
+	tmpDir string
+}
+
+// fs returns the guard for writes on behalf of cfg, writes without a config are allowed
+func (cfg *Config) fs() fsGuard {
+	if cfg == nil {
+		return fsGuard{}
+	}
+	g := fsGuard{readOnly: cfg.ReadOnly}
+	if cfg.Home != "" || cfg.TmpDir != "" {
+		g.tmpDir = cfg.tmpPath()
+	}
+	return g
+}
+
+// check returns ErrReadOnly, wrapped in a PathError, if the guard is read-only
+func (g fsGuard) check(op, path string) error {
+	if !g.readOnly {
+		return nil
+	}
+	err := &os.PathError{Op: op, Path: path, Err: ErrReadOnly}
+	if panicOnReadOnlyWrite {
+		panic(err)
+	}
+	return err
+}
+
+func (g fsGuard) mkdirAll(path string, perm os.FileMode) error {
+	if err := g.check("mkdir", path); err != nil {
+		return err
+	}
+	return os.MkdirAll(path, perm)
+}
+
+func (g fsGuard) writeFile(path string, data []byte, perm os.FileMode) error {
+	if err := g.check("write", path); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, perm)
+}
+
+// openFile opens the file for writing
+func (g fsGuard) openFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	if err := g.check("open", path); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, flag, perm)
+}
+
+func (g fsGuard) rename(oldpath, newpath string) error {
+	if err := g.check("rename", oldpath); err != nil {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+func (g fsGuard) remove(path string) error {
+	if err := g.check("remove", path); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (g fsGuard) removeAll(path string) error {
+	if err := g.check("remove", path); err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+func (g fsGuard) symlink(oldname, newname string) error {
+	if err := g.check("symlink", newname); err != nil {
+		return err
+	}
+	return os.Symlink(oldname, newname)
+}
+
+func (g fsGuard) lchown(path string, uid, gid int) error {
+	if err := g.check("chown", path); err != nil {
+		return err
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+func (g fsGuard) chmod(path string, mode os.FileMode) error {
+	if err := g.check("chmod", path); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+// mkdirTemp creates a new directory in dir, see ioutil.TempDir
+func (g fsGuard) mkdirTemp(dir, pattern string) (string, error) {
+	if err := g.check("mkdir", dir); err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(dir, pattern)
+}
+
+// tempDir creates a scratch directory, in the home unless DAEMON_TMP_DIR moves it. It is
+// refused all the same: read-only callers must not download either.
+func (g fsGuard) tempDir(pattern string) (string, error) {
+	dir := g.tmpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if err := g.mkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return g.mkdirTemp(dir, pattern)
+}
+
+// scratchDir creates a scratch directory in dir, the directory of the temporary files if
+// empty. It is the one write a read-only guard allows: inspection commands such as
+// simulate-upgrade work on a copy of the home in it, through a config of its own that isn't
+// read-only. It belongs to the caller, who removes it. It fails rather than write outside of
+// the home if the directory can't be created.
+func (g fsGuard) scratchDir(dir, pattern string) (string, error) {
+	if dir == "" {
+		dir = g.tmpDir
+	}
+	if dir == "" {
+		return "", errors.New("no directory for temporary files, set DAEMON_TMP_DIR")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("creating a scratch directory in %s, set DAEMON_TMP_DIR to a writable directory: %w", dir, err)
+	}
+	return ioutil.TempDir(dir, pattern)
+}
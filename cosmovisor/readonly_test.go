@@ -0,0 +1,192 @@
+package cosmovisor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	// an inspection path that writes must fail its test, not be reported as an error
+	panicOnReadOnlyWrite = true
+}
+
+// readOnlyHome is a copy of the validate fixture with every kind of state inspection reads:
+// no current link yet, a queue, a pending hotfix and a crash report
+func readOnlyHome(t *testing.T) *Config {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", PreUpgradeExport: true, AllowDownloadBinaries: true}
+
+	write := func(path, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	write(filepath.Join(cfg.QueueDir(), "1-chain2.json"), `{"name": "chain2", "height": 49}`)
+	write(filepath.Join(cfg.QueueDir(), "2-chain3.json"), `{"name": "chain3", "height": 49}`)
+	base, err := sha256File(cfg.GenesisBin())
+	require.NoError(t, err)
+	write(filepath.Join(cfg.HotfixDir(), "dummyd"), "#!/bin/sh\necho Patched\n")
+	require.NoError(t, os.Chmod(filepath.Join(cfg.HotfixDir(), "dummyd"), 0755))
+	write(filepath.Join(cfg.HotfixDir(), hotfixDescriptor), fmt.Sprintf(`{"base_sha256": "%s"}`, base))
+	write(filepath.Join(cfg.Root(), crashesDir, "20210101T000000Z.txt"), "cosmovisor crash report\n")
+	return cfg
+}
+
+// treeHash hashes names, modes, link targets, contents and modification times below dir
+func treeHash(t *testing.T, dir string) string {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		fmt.Fprintf(h, "%s %s %d\n", rel, info.Mode(), info.ModTime().UnixNano())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "-> %s\n", target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestReadOnlyInspection(t *testing.T) {
+	inspections := map[string]func(t *testing.T, cfg *Config){
+		"current binary": func(t *testing.T, cfg *Config) {
+			bin, err := cfg.CurrentBin()
+			require.NoError(t, err)
+			require.Equal(t, cfg.GenesisBin(), bin)
+		},
+		"explain": func(t *testing.T, cfg *Config) {
+			lines := Explain(cfg, &UpgradeInfo{Name: "chain2", Height: 49})
+			require.NotEmpty(t, lines)
+			require.NoError(t, WriteExplanation(ioutil.Discard, lines))
+		},
+		"explain download": func(t *testing.T, cfg *Config) {
+			require.NotEmpty(t, Explain(cfg, &UpgradeInfo{Name: "missing", Info: `{"binaries": {"any": "https://example.com/bin"}}`}))
+		},
+		"plan upgrade": func(t *testing.T, cfg *Config) {
+			plan, err := cfg.PlanUpgrade(&UpgradeInfo{Name: "chain2", Height: 49})
+			require.NoError(t, err)
+			require.True(t, plan.Export)
+		},
+		"upgrade queue": func(t *testing.T, cfg *Config) {
+			queue, err := cfg.UpgradeQueue()
+			require.NoError(t, err)
+			require.Len(t, queue, 2)
+		},
+		"pending hotfix": func(t *testing.T, cfg *Config) {
+			hf, err := cfg.PendingHotfix()
+			require.NoError(t, err)
+			require.NotNil(t, hf)
+			bin, err := cfg.CurrentBin()
+			require.NoError(t, err)
+			require.NoError(t, hf.Validate(cfg, bin))
+		},
+		"crash reports": func(t *testing.T, cfg *Config) {
+			reports, err := cfg.CrashReports()
+			require.NoError(t, err)
+			require.Len(t, reports, 1)
+		},
+		"status": func(t *testing.T, cfg *Config) {
+			s, err := GetStatus(cfg)
+			require.NoError(t, err)
+			require.NoError(t, WriteStatus(ioutil.Discard, s))
+		},
+		"upgrade history": func(t *testing.T, cfg *Config) {
+			history, err := cfg.UpgradeHistory()
+			require.NoError(t, err)
+			require.NoError(t, WriteHistory(ioutil.Discard, history))
+		},
+		"check setup": func(t *testing.T, cfg *Config) {
+			require.NoError(t, cfg.CheckSetup())
+		},
+		"shutdown budget": func(t *testing.T, cfg *Config) {
+			require.NotEmpty(t, cfg.ShutdownBudget(true).String())
+		},
+	}
+
+	for name, inspect := range inspections {
+		t.Run(name, func(t *testing.T) {
+			cfg := readOnlyHome(t)
+			cfg.ReadOnly = true
+			before := treeHash(t, cfg.Home)
+			inspect(t, cfg)
+			require.Equal(t, before, treeHash(t, cfg.Home), "inspection changed the home")
+		})
+	}
+}
+
+func TestReadOnlyRefusesWrites(t *testing.T) {
+	writes := map[string]func(cfg *Config) error{
+		"launch": func(cfg *Config) error {
+			_, err := LaunchProcess(cfg, nil, ioutil.Discard, ioutil.Discard)
+			return err
+		},
+		"switch": func(cfg *Config) error {
+			return cfg.SetCurrentUpgrade("chain2")
+		},
+		"download": func(cfg *Config) error {
+			return DownloadBinary(cfg, &UpgradeInfo{Name: "missing", Info: `{"binaries": {"any": "https://example.com/bin"}}`})
+		},
+		"hotfix": func(cfg *Config) error {
+			hf, err := cfg.PendingHotfix()
+			if err != nil {
+				return err
+			}
+			_, err = ApplyHotfix(cfg, hf)
+			return err
+		},
+		"export": func(cfg *Config) error {
+			_, err := ExportState(cfg, &UpgradeInfo{Name: "chain2", Height: 49}, cfg.GenesisBin())
+			return err
+		},
+		"queue": func(cfg *Config) error {
+			return cfg.consumeQueued(&QueuedPlan{File: "1-chain2.json"})
+		},
+		"socket": func(cfg *Config) error {
+			_, err := listenHTTP(cfg.fs(), unixAddrPrefix+filepath.Join(cfg.Root(), "metrics.sock"))
+			return err
+		},
+	}
+
+	for name, write := range writes {
+		t.Run(name, func(t *testing.T) {
+			cfg := readOnlyHome(t)
+			cfg.ReadOnly = true
+			before := treeHash(t, cfg.Home)
+
+			// production code gets an error
+			panicOnReadOnlyWrite = false
+			err := write(cfg)
+			panicOnReadOnlyWrite = true
+			require.True(t, errors.Is(err, ErrReadOnly), "%v", err)
+
+			// tests get a panic
+			require.Panics(t, func() { _ = write(cfg) })
+			require.Equal(t, before, treeHash(t, cfg.Home), "refused write changed the home")
+		})
+	}
+}
@@ -0,0 +1,381 @@
+package cosmovisor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/otiai10/copy"
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	// defaultRehearsalTimeout is how long the new binary runs against the copy if it neither
+	// commits a block nor exits
+	defaultRehearsalTimeout = 2 * time.Minute
+	// rehearsalOutputLines is how much of the output of the new binary a rehearsal keeps
+	rehearsalOutputLines = 20
+	// rehearsalDrainTimeout is how long the output is read once the new binary exited
+	rehearsalDrainTimeout = time.Second
+	// rehearsalMaxLine is the longest line of output scanned for a committed block
+	rehearsalMaxLine = 1 << 20
+)
+
+// rehearsalLeftOut are the files of the node home the copy leaves out: the binary generates
+// its own, so the copy can neither sign as the validator nor pose as the node
+var rehearsalLeftOut = []string{
+	filepath.Join("config", "priv_validator_key.json"),
+	filepath.Join("config", "node_key.json"),
+	filepath.Join(dataDir, privValidatorStateFile),
+}
+
+// rehearsalKeyFiles are the settings of config.toml naming the files of rehearsalLeftOut
+var rehearsalKeyFiles = []string{"priv_validator_key_file", "priv_validator_state_file", "node_key_file"}
+
+// RehearseOptions are the optional arguments of Rehearse
+type RehearseOptions struct {
+	// Backup is the data backup the rehearsal runs against, a copy of the data directory
+	// if empty
+	Backup string
+	// Dir is where the scratch home is created, the temporary directory if empty
+	Dir string
+	// Timeout is how long the new binary runs if it neither commits a block nor exits,
+	// defaultRehearsalTimeout if 0
+	Timeout time.Duration
+	// Keep leaves the scratch home in place
+	Keep bool
+	// Args are appended to the arguments of start
+	Args []string
+}
+
+// Rehearsal is the outcome of Rehearse
+type Rehearsal struct {
+	Upgrade *UpgradeInfo      `json:"upgrade"`
+	Steps   []*SimulationStep `json:"steps"`
+	// Home is the scratch home, empty once it was removed
+	Home string `json:"home,omitempty"`
+	// Output is the end of the output of the new binary
+	Output []string `json:"output,omitempty"`
+}
+
+// Failed returns the first step that failed, nil if none did
+func (r *Rehearsal) Failed() *SimulationStep {
+	for _, step := range r.Steps {
+		if step.Failed {
+			return step
+		}
+	}
+	return nil
+}
+
+// Rehearse runs the new binary of the upgrade described by info against a copy of the
+// node, in a scratch home: the config and the data directory (or a data backup) are copied
+// there without the keys of the node, the pre-upgrade command is run, then start, listening
+// on localhost only and without peers, until it commits a block, exits, or the timeout
+// passes. The live node is left alone, but copying its data directory needs it stopped.
+func Rehearse(cfg *Config, info *UpgradeInfo, opts RehearseOptions) *Rehearsal {
+	r := &Rehearsal{Upgrade: info}
+	add := func(step string, err error, format string, args ...interface{}) {
+		result := fmt.Sprintf(format, args...)
+		if err != nil {
+			result = err.Error()
+		}
+		r.Steps = append(r.Steps, &SimulationStep{Step: step, Result: result, Failed: err != nil})
+	}
+
+	plan, err := cfg.PlanUpgrade(info)
+	if err != nil {
+		add("plan", err, "")
+		return r
+	}
+	var scratch string
+	scratch, err = cfg.fs().scratchDir(opts.Dir, "cosmovisor-rehearse-")
+	if err != nil {
+		add("plan", err, "")
+		return r
+	}
+	sim := cfg.scratchConfig(scratch)
+	if opts.Keep {
+		r.Home = scratch
+	} else {
+		defer sim.fs().removeAll(scratch)
+	}
+	if !cfg.Immutable {
+		if err := sim.followReference(plan); err != nil {
+			add("plan", err, "")
+			return r
+		}
+	}
+	add("plan", nil, "upgrade %q, scratch home %s", info.Name, scratch)
+
+	bin, source, err := scratchBinary(cfg, sim, plan)
+	add("binary", err, "%s", source)
+	if err != nil {
+		return r
+	}
+
+	copied, err := cfg.copyForRehearsal(sim, info.Name, opts.Backup)
+	if err == nil {
+		// the copy is written by the binary as it would write the home
+		err = sim.giveToDaemon(sim.fs(), scratch)
+	}
+	add("copy", err, "%s", copied)
+	if err != nil {
+		return r
+	}
+
+	// the home of the copy is given to the binary, whatever DAEMON_INJECT_HOME says
+	sim.InjectHome = true
+	if _, err := preUpgradeOnce(sim, bin); errors.Is(err, errNoPreUpgrade) {
+		add("pre-upgrade", nil, "%v", err)
+	} else {
+		add("pre-upgrade", err, "%s %s passed", bin, preUpgradeCommand)
+		if err != nil {
+			return r
+		}
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultRehearsalTimeout
+	}
+	result, err := sim.rehearseStart(bin, opts.Args, timeout, r)
+	add("start", err, "%s", result)
+	return r
+}
+
+// copyForRehearsal copies the config and the data directory of the node, or the data
+// backup at backup, to the home of sim, and tells what it copied and whether the node had
+// halted for the upgrade name
+func (cfg *Config) copyForRehearsal(sim *Config, name, backup string) (string, error) {
+	if err := checkRehearsalKeyFiles(cfg.Home); err != nil {
+		return "", err
+	}
+	leftOut := func(path string) bool {
+		for _, f := range rehearsalLeftOut {
+			if path == filepath.Join(cfg.Home, f) {
+				return true
+			}
+		}
+		return false
+	}
+	if err := copy.Copy(filepath.Join(cfg.Home, "config"), filepath.Join(sim.Home, "config"), copy.Options{
+		Skip: func(path string) (bool, error) { return leftOut(path), nil },
+	}); err != nil {
+		return "", fmt.Errorf("copying the config: %w", err)
+	}
+
+	var copied string
+	if backup != "" {
+		manifest, err := VerifyDataBackup(backup)
+		if err != nil {
+			return "", err
+		}
+		if manifest.Snapshot != 0 {
+			return "", fmt.Errorf("%s holds the state sync snapshot at height %d, not the data directory", backup, manifest.Snapshot)
+		}
+		if err := unpackDataBackup(sim.fs(), backup, sim.DataDir()); err != nil {
+			return "", fmt.Errorf("unpacking %s: %w", backup, err)
+		}
+		if err := sim.fs().remove(filepath.Join(sim.DataDir(), privValidatorStateFile)); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		copied = fmt.Sprintf("unpacked the backup of upgrade %q from %s", manifest.Upgrade, backup)
+	} else {
+		// a database copied while it is written to may not open
+		var state RunState
+		if ok, err := cfg.readStateFile(runStateFile, &state); err != nil {
+			return "", err
+		} else if ok && processAlive(state.DaemonPID) {
+			return "", fmt.Errorf("the daemon (pid %d) is running, stop it or rehearse against a data backup", state.DaemonPID)
+		}
+		skip := func(path string) bool { return cfg.excludedFromDataBackup(path) || leftOut(path) }
+		size, err := treeSize(cfg.DataDir(), skip)
+		if err != nil {
+			return "", fmt.Errorf("measuring the data directory: %w", err)
+		}
+		if free, err := freeSpace(sim.Home); err == nil && uint64(size) > free {
+			return "", fmt.Errorf("not enough space in %s for a copy of the data directory: %s free, it holds %s",
+				sim.Home, formatBytes(int64(free)), formatBytes(size))
+		}
+		err = copy.Copy(cfg.DataDir(), sim.DataDir(), copy.Options{
+			Skip: func(path string) (bool, error) { return skip(path), nil },
+		})
+		if err != nil {
+			return "", fmt.Errorf("copying the data directory: %w", err)
+		}
+		copied = fmt.Sprintf("copied %s of %s", formatBytes(size), cfg.DataDir())
+	}
+
+	// the store upgrades of the plan are only loaded at its height
+	if halted, err := ReadPlanFile(filepath.Join(sim.DataDir(), upgradeInfoFile)); err == nil && halted.Name == name {
+		return fmt.Sprintf("%s, halted at height %d for the upgrade", copied, halted.Height), nil
+	}
+	return copied + ", not halted for the upgrade: the startup is rehearsed, the migrations only run at its height", nil
+}
+
+// checkRehearsalKeyFiles fails if config.toml of home moves the keys of the node out of
+// the home: the copy of the config would use them
+func checkRehearsalKeyFiles(home string) error {
+	path := filepath.Join(home, "config", "config.toml")
+	tree, err := toml.LoadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, key := range rehearsalKeyFiles {
+		if file, _ := tree.Get(key).(string); filepath.IsAbs(file) {
+			return fmt.Errorf("%s of %s is %s, outside the home: the copy would use the keys of the node", key, path, file)
+		}
+	}
+	return nil
+}
+
+// rehearseStart runs start of bin against the copy until it commits a block, exits, or
+// timeout passes, keeps the end of its output in r, and tells how it went
+func (cfg *Config) rehearseStart(bin string, extra []string, timeout time.Duration, r *Rehearsal) (string, error) {
+	args, err := rehearsalArgs(cfg.Home)
+	if err != nil {
+		return "", err
+	}
+	args = append(args, extra...)
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	defer pr.Close()
+	cmd := cfg.daemonCommand(context.Background(), bin, args...)
+	cmd.Stdout, cmd.Stderr = pw, pw
+	logger.Infof("running %s %s", bin, strings.Join(args, " "))
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		return "", err
+	}
+	started := StartStopwatch()
+
+	committed := make(chan int64, 1)
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		scanner := bufio.NewScanner(pr)
+		scanner.Buffer(make([]byte, 64*1024), rehearsalMaxLine)
+		scanner.Split(skipLongLines("rehearsal", rehearsalMaxLine))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if r.Output = append(r.Output, line); len(r.Output) > rehearsalOutputLines {
+				r.Output = r.Output[1:]
+			}
+			if m := blockCommitRegex.FindStringSubmatch(line); m != nil {
+				if height, err := strconv.ParseInt(m[1]+m[2], 10, 64); err == nil {
+					select {
+					case committed <- height:
+					default:
+					}
+				}
+			}
+		}
+		_, _ = io.Copy(ioutil.Discard, pr)
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	// the output is read through before the outcome is told, but a child the binary left
+	// behind may hold the pipe open
+	drain := func() {
+		select {
+		case <-scanned:
+		case <-time.After(rehearsalDrainTimeout):
+			pr.Close()
+			<-scanned
+		}
+	}
+	stop := func() {
+		cfg.stopForUpgrade(cmd)
+		<-exited
+		drain()
+	}
+
+	select {
+	case height := <-committed:
+		stop()
+		return fmt.Sprintf("committed block %d %s after the start", height, started.Elapsed().Round(time.Millisecond)), nil
+	case err := <-exited:
+		drain()
+		ran := started.Elapsed().Round(time.Millisecond)
+		if err == nil {
+			return "", fmt.Errorf("%s %s exited after %s", bin, args[0], ran)
+		}
+		return "", fmt.Errorf("%s %s failed after %s: %w", bin, args[0], ran, err)
+	case <-time.After(timeout):
+		stop()
+		return fmt.Sprintf("ran for %s without failing, no block was committed without peers", timeout), nil
+	}
+}
+
+// rehearsalArgs are the arguments of start against the copy at home: listening on localhost
+// only, without peers, a remote signer, the API nor gRPC
+func rehearsalArgs(home string) ([]string, error) {
+	p2p, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	rpc, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"start", homeFlag, home,
+		"--p2p.laddr", "tcp://" + p2p, "--p2p.seeds=", "--p2p.persistent_peers=", "--p2p.pex=false",
+		"--rpc.laddr", "tcp://" + rpc, "--rpc.pprof_laddr=", "--priv_validator_laddr=",
+		"--api.enable=false", "--grpc.enable=false", "--grpc-web.enable=false",
+	}, nil
+}
+
+// freePort returns a localhost address nothing listens on
+func freePort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// WriteRehearsal prints the steps of the rehearsal as aligned columns, then the end of the
+// output of the new binary
+func WriteRehearsal(w io.Writer, r *Rehearsal) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, step := range r.Steps {
+		outcome := "ok"
+		if step.Failed {
+			outcome = "FAILED"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", step.Step, outcome, step.Result)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if r.Home != "" {
+		fmt.Fprintf(w, "\nthe scratch home is kept at %s\n", r.Home)
+	}
+	if len(r.Output) > 0 {
+		fmt.Fprintf(w, "\nthe new binary printed last:\n")
+		for _, line := range r.Output {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+	return nil
+}
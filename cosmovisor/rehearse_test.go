@@ -0,0 +1,181 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rehearsalScript starts by telling what the copy at its home holds, then runs start
+const rehearsalScript = `#!/bin/sh
+case "$1" in
+pre-upgrade) %s ;;
+start)
+	echo "args: $*"
+	[ -e "$3/config/priv_validator_key.json" ] && echo "key copied"
+	[ -e "$3/data/priv_validator_state.json" ] && echo "sign state copied"
+	echo "state: $(cat "$3/data/state.db/000001.ldb")"
+	%s ;;
+esac
+`
+
+// writeRehearsalHome writes the config and the data of a node halted for upgrade v2 to the
+// home of cfg, and stages the script for v2 with the pre-upgrade and start commands
+func writeRehearsalHome(t *testing.T, cfg *Config, preUpgrade, start string) {
+	files := map[string]string{
+		"config/config.toml":             "moniker = \"node\"\n",
+		"config/priv_validator_key.json": "{}",
+		"config/node_key.json":           "{}",
+		"data/state.db/000001.ldb":       "state",
+		"data/priv_validator_state.json": "{}",
+		"data/upgrade-info.json":         `{"name":"v2","height":100}`,
+		"data/snapshots/100/1/0":         "chunk",
+	}
+	for name, content := range files {
+		path := filepath.Join(cfg.Home, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		if _, err := os.Stat(path); err != nil {
+			require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+		}
+	}
+	require.NoError(t, os.MkdirAll(filepath.Dir(cfg.UpgradeBin("v2")), 0755))
+	script := strings.Replace(strings.Replace(rehearsalScript, "%s", preUpgrade, 1), "%s", start, 1)
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("v2"), []byte(script), 0755))
+}
+
+func TestRehearse(t *testing.T) {
+	cases := map[string]struct {
+		preUpgrade string
+		start      string
+		failed     string
+		result     string
+		output     string
+	}{
+		"commits a block": {
+			preUpgrade: "exit 0",
+			start:      "echo 'INF committed state app_hash=B2 height=100 module=state'; sleep 30",
+			result:     "committed block 100",
+		},
+		"runs until the timeout": {
+			preUpgrade: "exit 0",
+			start:      "sleep 30",
+			result:     "ran for 300ms without failing",
+		},
+		"migration panics": {
+			preUpgrade: "exit 0",
+			start:      "echo 'panic: migrating the bank store failed'; exit 2",
+			failed:     "start",
+			result:     "failed after",
+			output:     "panic: migrating the bank store failed",
+		},
+		"exits": {
+			preUpgrade: "exit 0",
+			start:      "exit 0",
+			failed:     "start",
+			result:     "exited after",
+		},
+		"no pre-upgrade": {
+			preUpgrade: `echo 'Error: unknown command "pre-upgrade" for "dummyd"'; exit 1`,
+			start:      "sleep 30",
+			result:     "ran for",
+		},
+		"pre-upgrade fails": {
+			preUpgrade: "echo 'config can not be migrated'; exit 30",
+			start:      "sleep 30",
+			failed:     "pre-upgrade",
+			result:     "config can not be migrated",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Home: t.TempDir(), Name: "dummy", DataBackupExclude: []string{"snapshots"}}
+			writeRehearsalHome(t, cfg, tc.preUpgrade, tc.start)
+
+			r := Rehearse(cfg, &UpgradeInfo{Name: "v2"}, RehearseOptions{Timeout: 300 * time.Millisecond})
+			step := r.Steps[len(r.Steps)-1]
+			require.Contains(t, step.Result, tc.result)
+			if tc.failed != "" {
+				require.Equal(t, tc.failed, r.Failed().Step)
+			} else {
+				require.Nil(t, r.Failed(), "%+v", r.Failed())
+			}
+			require.Empty(t, r.Home)
+			require.Contains(t, r.Steps[2].Result, "of "+cfg.DataDir()+", halted at height 100 for the upgrade")
+			if tc.output != "" {
+				require.Contains(t, r.Output, tc.output)
+			}
+			if tc.failed != "pre-upgrade" {
+				require.Contains(t, r.Output, "state: state")
+				require.NotContains(t, r.Output, "key copied")
+				require.NotContains(t, r.Output, "sign state copied")
+				require.Contains(t, r.Output[0], "--p2p.seeds= --p2p.persistent_peers=")
+			}
+			// the live node is left alone
+			bz, err := ioutil.ReadFile(filepath.Join(cfg.DataDir(), "state.db", "000001.ldb"))
+			require.NoError(t, err)
+			require.Equal(t, "state", string(bz))
+			entries, err := ioutil.ReadDir(cfg.tmpPath())
+			require.NoError(t, err)
+			require.Empty(t, entries)
+		})
+	}
+}
+
+func TestRehearseBackup(t *testing.T) {
+	cfg, path := makeDataBackup(t, DataBackupArchive)
+	writeRehearsalHome(t, cfg, "exit 0", "sleep 30")
+	// the node went on after the backup
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "state.db", "000001.ldb"), []byte("upgraded"), 0644))
+	require.NoError(t, cfg.writeStateFile(runStateFile, RunState{PID: 0, DaemonPID: os.Getpid()}))
+
+	dir := t.TempDir()
+	r := Rehearse(cfg, &UpgradeInfo{Name: "v2"}, RehearseOptions{Backup: path, Dir: dir, Timeout: 100 * time.Millisecond, Keep: true})
+	require.Nil(t, r.Failed(), "%+v", r.Failed())
+	require.Contains(t, r.Steps[2].Result, `unpacked the backup of upgrade "v2"`)
+	require.Contains(t, r.Output, "state: state")
+	require.NotContains(t, r.Output, "sign state copied")
+	require.Equal(t, dir, filepath.Dir(r.Home))
+	require.DirExists(t, filepath.Join(r.Home, "data", "state.db"))
+}
+
+func TestRehearseRefuses(t *testing.T) {
+	cases := map[string]struct {
+		setup func(t *testing.T, cfg *Config)
+		err   string
+	}{
+		"running daemon": {
+			setup: func(t *testing.T, cfg *Config) {
+				require.NoError(t, cfg.writeStateFile(runStateFile, RunState{PID: 0, DaemonPID: os.Getpid()}))
+			},
+			err: "is running, stop it or rehearse against a data backup",
+		},
+		"key outside the home": {
+			setup: func(t *testing.T, cfg *Config) {
+				config := "priv_validator_key_file = \"/etc/node/priv_validator_key.json\"\n"
+				require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.Home, "config", "config.toml"), []byte(config), 0644))
+			},
+			err: "outside the home: the copy would use the keys of the node",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Home: t.TempDir(), Name: "dummy"}
+			writeRehearsalHome(t, cfg, "exit 0", "echo started")
+			tc.setup(t, cfg)
+
+			r := Rehearse(cfg, &UpgradeInfo{Name: "v2"}, RehearseOptions{})
+			require.NotNil(t, r.Failed())
+			require.Equal(t, "copy", r.Failed().Step)
+			require.Contains(t, r.Failed().Result, tc.err)
+			require.Empty(t, r.Output)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// RelinkedLink is a link Relink made relative
+type RelinkedLink struct {
+	Link string `json:"link"`
+	// From is the absolute target the link had, To the relative one it has now
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// linkTarget is the target of a link at link to the path dir: relative to the link if both
+// are in DAEMON_HOME, so the home can be moved or mounted at another path, absolute if
+// either is outside of it
+func (cfg *Config) linkTarget(dir, link string) string {
+	if !insideDir(cfg.Home, dir) || !insideDir(cfg.Home, link) {
+		return dir
+	}
+	rel, err := filepath.Rel(filepath.Dir(link), dir)
+	if err != nil {
+		return dir
+	}
+	return rel
+}
+
+// Relink makes the absolute links into DAEMON_HOME relative: the current link and the
+// symlinks in the version directories, such as a binary linked to the one of another
+// upgrade. from is the path the home had before it was moved, if any: links into it are
+// taken as links to the same path in DAEMON_HOME. Links out of the home are left as they
+// are. With dryRun nothing is changed. It returns the links made relative.
+func Relink(cfg *Config, from string, dryRun bool) ([]RelinkedLink, error) {
+	if cfg.Immutable {
+		return nil, errors.New("an immutable layout has no links, the current version is in the current pointer")
+	}
+	upgradeDirMutex.Lock()
+	defer upgradeDirMutex.Unlock()
+
+	links := []string{cfg.currentPath()}
+	for _, dir := range []string{cfg.genesisPath(), cfg.upgradesPath()} {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				links = append(links, path)
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("looking for links in %s: %w", dir, err)
+		}
+	}
+
+	var relinked []RelinkedLink
+	for _, link := range links {
+		r, ok, err := cfg.relinkTarget(link, from)
+		if err != nil {
+			return relinked, err
+		}
+		if !ok {
+			continue
+		}
+		if !dryRun {
+			if err := cfg.replaceSymlink(link, r.To); err != nil {
+				return relinked, fmt.Errorf("relinking %s: %w", link, err)
+			}
+		}
+		relinked = append(relinked, r)
+	}
+	return relinked, nil
+}
+
+// relinkTarget returns the relative target of the symlink at link, ok is false if it is
+// relative already, points out of the home, or isn't a symlink
+func (cfg *Config) relinkTarget(link, from string) (r RelinkedLink, ok bool, err error) {
+	info, err := os.Lstat(link)
+	if os.IsNotExist(err) {
+		return r, false, nil
+	}
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return r, false, err
+	}
+	target, err := os.Readlink(link)
+	if err != nil || !filepath.IsAbs(target) {
+		return r, false, err
+	}
+	dest := target
+	if from != "" && insideDir(from, target) {
+		rel, err := filepath.Rel(from, target)
+		if err != nil {
+			return r, false, err
+		}
+		dest = filepath.Join(cfg.Home, rel)
+	}
+	to := cfg.linkTarget(dest, link)
+	if filepath.IsAbs(to) {
+		return r, false, nil
+	}
+	return RelinkedLink{Link: link, From: target, To: to}, true, nil
+}
+
+// replaceSymlink points the symlink at link to target. The new link is renamed over the
+// old one, so a failure leaves the old link.
+func (cfg *Config) replaceSymlink(link, target string) error {
+	fs := cfg.fs()
+	tmp := link + ".tmp"
+	fs.remove(tmp)
+	if err := fs.symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := fs.replaceLink(tmp, link); err != nil {
+		fs.remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkTarget(t *testing.T) {
+	cfg := &Config{Home: "/home/node/.gaia"}
+	cases := map[string]struct {
+		dir, link, want string
+	}{
+		"upgrade":          {dir: "/home/node/.gaia/cosmovisor/upgrades/v2", link: "/home/node/.gaia/cosmovisor/current", want: "upgrades/v2"},
+		"genesis":          {dir: "/home/node/.gaia/cosmovisor/genesis", link: "/home/node/.gaia/cosmovisor/current", want: "genesis"},
+		"moved link":       {dir: "/home/node/.gaia/cosmovisor/genesis", link: "/home/node/.gaia/links/current", want: "../cosmovisor/genesis"},
+		"moved upgrades":   {dir: "/opt/gaia/upgrades/v2", link: "/home/node/.gaia/cosmovisor/current", want: "/opt/gaia/upgrades/v2"},
+		"link out of home": {dir: "/home/node/.gaia/cosmovisor/genesis", link: "/var/lib/gaia/current", want: "/home/node/.gaia/cosmovisor/genesis"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.want, cfg.linkTarget(tc.dir, tc.link))
+		})
+	}
+}
+
+func TestRelink(t *testing.T) {
+	old := validateHome(t)
+	oldCfg := &Config{Home: old, Name: "dummyd"}
+	current := filepath.Join(oldCfg.Root(), currentLink)
+	// absolute links, as older versions made them, and one out of the home
+	require.NoError(t, os.Symlink(oldCfg.UpgradeDir("chain2"), current))
+	require.NoError(t, os.Symlink(oldCfg.UpgradeBin("chain2"), filepath.Join(oldCfg.UpgradeDir("chain3"), "bin", "chain2d")))
+	require.NoError(t, os.Symlink("/usr/lib/libwasmvm.so", filepath.Join(oldCfg.UpgradeDir("chain3"), "libwasmvm.so")))
+
+	// the home is moved, its links still point into the old one
+	cfg := &Config{Home: filepath.Join(t.TempDir(), "moved"), Name: "dummyd"}
+	require.NoError(t, os.Rename(old, cfg.Home))
+	require.NoError(t, os.Mkdir(old, 0755))
+
+	links, err := Relink(cfg, old, true)
+	require.NoError(t, err)
+	require.Len(t, links, 2)
+	dest, err := os.Readlink(filepath.Join(cfg.Root(), currentLink))
+	require.NoError(t, err)
+	require.Equal(t, oldCfg.UpgradeDir("chain2"), dest)
+
+	links, err = Relink(cfg, old, false)
+	require.NoError(t, err)
+	require.Equal(t, []RelinkedLink{
+		{Link: filepath.Join(cfg.Root(), currentLink), From: oldCfg.UpgradeDir("chain2"), To: "upgrades/chain2"},
+		{Link: filepath.Join(cfg.UpgradeDir("chain3"), "bin", "chain2d"), From: oldCfg.UpgradeBin("chain2"), To: "../../chain2/bin/dummyd"},
+	}, links)
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.UpgradeBin("chain2"), bin)
+	require.NoError(t, EnsureBinary(filepath.Join(cfg.UpgradeDir("chain3"), "bin", "chain2d")))
+	dest, err = os.Readlink(filepath.Join(cfg.UpgradeDir("chain3"), "libwasmvm.so"))
+	require.NoError(t, err)
+	require.Equal(t, "/usr/lib/libwasmvm.so", dest)
+
+	// nothing is left to relink
+	links, err = Relink(cfg, old, false)
+	require.NoError(t, err)
+	require.Empty(t, links)
+
+	cfg.Immutable = true
+	_, err = Relink(cfg, "", false)
+	require.Error(t, err)
+}
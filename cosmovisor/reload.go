@@ -0,0 +1,105 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultReloadSignal = syscall.SIGHUP
+	// reloadWatchWindow is how long the daemon must survive a reload for it to count as successful
+	reloadWatchWindow = 10 * time.Second
+)
+
+// parseSignal accepts a signal name, with or without the SIG prefix, or its number
+func parseSignal(s string) (syscall.Signal, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signalNames[strings.TrimPrefix(s, "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+// signalName returns the SIG name of a known signal, or its description otherwise
+func signalName(sig os.Signal) string {
+	for name, known := range signalNames {
+		if known == sig {
+			return "SIG" + name
+		}
+	}
+	return sig.String()
+}
+
+// parseReloadSignal validates the value of DAEMON_RELOAD_SIGNAL. Stop signals are already
+// forwarded to the daemon and can't be used for reloading.
+func parseReloadSignal(s string) (syscall.Signal, error) {
+	if strings.TrimSpace(s) == "" {
+		return defaultReloadSignal, nil
+	}
+	sig, err := parseSignal(s)
+	if err != nil {
+		return 0, err
+	}
+	switch sig {
+	case syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGKILL:
+		return 0, fmt.Errorf("%s stops the daemon and can't be used to reload it", signalName(sig))
+	}
+	return sig, nil
+}
+
+// reloadState delivers reload requests to the daemon and remembers the last one, so an exit
+// shortly after can be attributed to it
+type reloadState struct {
+	mutex sync.Mutex
+	last  *Stopwatch
+}
+
+// run delivers the reload signal for every trigger received until done is closed
+func (r *reloadState) run(cfg *Config, cmd *exec.Cmd, triggers <-chan os.Signal, done <-chan struct{}) {
+	for {
+		select {
+		case sig := <-triggers:
+			r.deliver(cfg, cmd, sig)
+		case <-done:
+			return
+		}
+	}
+}
+
+func (r *reloadState) deliver(cfg *Config, cmd *exec.Cmd, trigger os.Signal) {
+	sig := cfg.ReloadSignal
+	if sig == 0 {
+		sig = defaultReloadSignal
+	}
+	logger.Infof("received %s, sending %s to reload the daemon", signalName(trigger), signalName(sig))
+	if err := signalProcess(cmd.Process, sig); err != nil {
+		logger.Warnf("sending %s to child: %v", signalName(sig), err)
+		return
+	}
+
+	sw := StartStopwatch()
+	r.mutex.Lock()
+	r.last = &sw
+	r.mutex.Unlock()
+}
+
+// failedReload returns how long after the last reload the daemon exited, if that was within
+// reloadWatchWindow
+func (r *reloadState) failedReload() (time.Duration, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.last == nil {
+		return 0, false
+	}
+	since := r.last.Elapsed()
+	return since, since < reloadWatchWindow
+}
@@ -0,0 +1,41 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReloadSignal(t *testing.T) {
+	cases := map[string]struct {
+		value  string
+		expect syscall.Signal
+		isErr  bool
+	}{
+		"default":     {expect: syscall.SIGHUP},
+		"name":        {value: "USR1", expect: syscall.SIGUSR1},
+		"sig prefix":  {value: "sigusr1", expect: syscall.SIGUSR1},
+		"number":      {value: "12", expect: syscall.Signal(12)},
+		"unknown":     {value: "SIGFOO", isErr: true},
+		"stop signal": {value: "SIGTERM", isErr: true},
+		"quit signal": {value: "QUIT", isErr: true},
+		"kill signal": {value: "9", isErr: true},
+		"negative":    {value: "-1", isErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			sig, err := parseReloadSignal(tc.value)
+			if tc.isErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, sig)
+		})
+	}
+}
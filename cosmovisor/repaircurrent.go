@@ -0,0 +1,117 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RepairCurrent checks that current names a version directory holding the daemon binary
+// before the daemon is launched, and repairs it if it doesn't: a link into an upgrade
+// directory that was deleted, one still pointing into the home a backup was restored from,
+// a home copied without its links, or a link lost after upgrades were applied. current is
+// pointed to the version the upgrade history switched to last, or to genesis with a warning
+// if the history has nothing usable. A new home without a link is left for CurrentBin.
+func RepairCurrent(cfg *Config) error {
+	problem, copied := cfg.currentProblem()
+	if problem == "" {
+		return nil
+	}
+	if cfg.ReadOnly {
+		return fmt.Errorf("%s, it can't be repaired in read-only mode", problem)
+	}
+	dir, reason, err := cfg.repairTarget()
+	if err != nil {
+		return fmt.Errorf("%s, and it can't be repaired: %w", problem, err)
+	}
+	link := cfg.currentPath()
+	// the copy is kept, but a link can't be renamed over it. An immutable layout only
+	// changes its current pointer.
+	if copied && !cfg.Immutable {
+		aside := fmt.Sprintf("%s.copied-%s", link, FormatTimestamp(NowUTC()))
+		if err := cfg.fs().rename(link, aside); err != nil {
+			return fmt.Errorf("%s, moving it aside: %w", problem, err)
+		}
+		logger.Warnf("moved the copied %s aside to %s", link, aside)
+	}
+	if err := cfg.setCurrent(dir); err != nil {
+		return fmt.Errorf("%s, repairing it: %w", problem, err)
+	}
+	logger.Warnf("%s, pointed it to %s: %s", problem, dir, reason)
+	return nil
+}
+
+// currentProblem returns what's wrong with current, "" if nothing is. copied is set if
+// current is a directory rather than a link to one.
+func (cfg *Config) currentProblem() (problem string, copied bool) {
+	link := cfg.currentPath()
+	bin, linked := cfg.resolveCurrentBin()
+	if linked {
+		dir := filepath.Dir(filepath.Dir(bin))
+		if _, err := os.Stat(bin); os.IsNotExist(err) {
+			return fmt.Sprintf("current points to %s, which doesn't exist", dir), false
+		}
+		if filepath.IsAbs(dir) && !strings.HasPrefix(dir, cfg.Root()+string(filepath.Separator)) && !cfg.isVersionDir(dir) {
+			return fmt.Sprintf("current points to %s, outside %s", dir, cfg.Root()), false
+		}
+		return "", false
+	}
+	info, err := os.Lstat(link)
+	switch {
+	case err == nil && info.IsDir():
+		return fmt.Sprintf("%s is a directory rather than a link to one, as if the home was copied without its links", link), true
+	case err == nil:
+		return fmt.Sprintf("%s doesn't name a version directory", link), false
+	}
+	// a new home gets its link to genesis when it's launched, only one that was upgraded
+	// lost it
+	if history, _ := cfg.UpgradeHistory(); len(history) > 0 {
+		return fmt.Sprintf("%s is missing", link), false
+	}
+	return "", false
+}
+
+// repairTarget returns the version directory current is repaired to, and why: the one
+// the newest entry of the upgrade history switched to if its binary is there, genesis
+// otherwise
+func (cfg *Config) repairTarget() (dir, reason string, err error) {
+	history, herr := cfg.UpgradeHistory()
+	if herr == nil && len(history) > 0 {
+		last := history[len(history)-1]
+		// the history may come from the home a backup was taken of, its paths are
+		// taken relative to the cosmovisor directory
+		if dir := cfg.versionDirOf(last.Binary); dir != "" {
+			if _, err := os.Stat(cfg.versionBin(dir)); err == nil {
+				return dir, fmt.Sprintf("the upgrade history switched to it last, by the %s at %s", last.Kind, FormatTimestamp(last.At)), nil
+			}
+		}
+		logger.Warnf("the upgrade history ends with %s %q, but %s is gone: falling back to genesis, "+
+			"the node may need that binary to run", last.Kind, last.Name, last.Binary)
+	} else if herr != nil {
+		logger.Warnf("falling back to genesis, the upgrade history can't be read: %v", herr)
+	}
+
+	if err := EnsureBinary(cfg.GenesisBin()); err != nil {
+		return "", "", fmt.Errorf("the genesis binary isn't usable: %w", err)
+	}
+	return cfg.genesisPath(), "the upgrade history names no other version", nil
+}
+
+// versionDirOf returns the version directory of this home holding bin, a binary of a
+// version directory of any home, or "" if bin isn't one
+func (cfg *Config) versionDirOf(bin string) string {
+	if filepath.Base(filepath.Dir(bin)) != "bin" {
+		return ""
+	}
+	dir := filepath.Dir(filepath.Dir(bin))
+	switch {
+	case cfg.isVersionDir(dir):
+		return dir
+	case filepath.Base(dir) == genesisDir && filepath.Base(filepath.Dir(dir)) == rootName:
+		return cfg.genesisPath()
+	case filepath.Base(filepath.Dir(dir)) == upgradesDir:
+		return filepath.Join(cfg.upgradesPath(), filepath.Base(dir))
+	}
+	return ""
+}
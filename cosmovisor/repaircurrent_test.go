@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepairCurrent(t *testing.T) {
+	setup := func(t *testing.T) *Config {
+		home := validateHome(t)
+		return &Config{Home: home, Name: "dummyd"}
+	}
+	// link returns the directory current points to, its link is relative
+	link := func(cfg *Config) string {
+		dest, err := os.Readlink(filepath.Join(cfg.Root(), currentLink))
+		require.NoError(t, err)
+		require.False(t, filepath.IsAbs(dest), dest)
+		return filepath.Join(cfg.Root(), dest)
+	}
+
+	t.Run("healthy", func(t *testing.T) {
+		cfg := setup(t)
+		require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+		require.NoError(t, RepairCurrent(cfg))
+		require.Equal(t, cfg.UpgradeDir("chain2"), link(cfg))
+	})
+
+	t.Run("new home", func(t *testing.T) {
+		cfg := setup(t)
+		require.NoError(t, RepairCurrent(cfg))
+		_, err := os.Lstat(filepath.Join(cfg.Root(), currentLink))
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("deleted upgrade directory", func(t *testing.T) {
+		cfg := setup(t)
+		require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2"}))
+		require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain3"}))
+		require.NoError(t, os.RemoveAll(cfg.UpgradeDir("chain3")))
+		problem, _ := cfg.currentProblem()
+		require.Contains(t, problem, "which doesn't exist")
+
+		// the history ends with the deleted upgrade, genesis is all that's left
+		require.NoError(t, RepairCurrent(cfg))
+		require.Equal(t, filepath.Join(cfg.Root(), genesisDir), link(cfg))
+	})
+
+	t.Run("restored from another home", func(t *testing.T) {
+		cfg := setup(t)
+		require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2"}))
+		restored := &Config{Home: t.TempDir(), Name: "dummyd"}
+		require.NoError(t, copy.Copy(cfg.Home, restored.Home))
+		require.Equal(t, restored.UpgradeDir("chain2"), link(restored))
+		problem, _ := restored.currentProblem()
+		require.Empty(t, problem)
+
+		// an absolute link, as older versions made
+		current := filepath.Join(restored.Root(), currentLink)
+		require.NoError(t, os.Remove(current))
+		require.NoError(t, os.Symlink(cfg.UpgradeDir("chain2"), current))
+		problem, _ = restored.currentProblem()
+		require.Contains(t, problem, "outside "+restored.Root())
+
+		require.NoError(t, RepairCurrent(restored))
+		require.Equal(t, restored.UpgradeDir("chain2"), link(restored))
+	})
+
+	t.Run("copied without links", func(t *testing.T) {
+		cfg := setup(t)
+		require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2"}))
+		current := filepath.Join(cfg.Root(), currentLink)
+		require.NoError(t, os.Remove(current))
+		require.NoError(t, copy.Copy(cfg.UpgradeDir("chain2"), current))
+
+		require.NoError(t, RepairCurrent(cfg))
+		require.Equal(t, cfg.UpgradeDir("chain2"), link(cfg))
+		copies, err := filepath.Glob(current + ".copied-*")
+		require.NoError(t, err)
+		require.Len(t, copies, 1)
+		_, err = os.Stat(filepath.Join(copies[0], "bin", "dummyd"))
+		require.NoError(t, err)
+	})
+
+	t.Run("link lost after an upgrade", func(t *testing.T) {
+		cfg := setup(t)
+		require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2"}))
+		require.NoError(t, os.Remove(filepath.Join(cfg.Root(), currentLink)))
+
+		require.NoError(t, RepairCurrent(cfg))
+		require.Equal(t, cfg.UpgradeDir("chain2"), link(cfg))
+	})
+
+	t.Run("no usable genesis", func(t *testing.T) {
+		cfg := setup(t)
+		require.NoError(t, os.Symlink(filepath.Join(cfg.Root(), "missing"), filepath.Join(cfg.Root(), currentLink)))
+		require.NoError(t, os.Chmod(cfg.GenesisBin(), 0644))
+		err := RepairCurrent(cfg)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "the genesis binary isn't usable")
+	})
+}
@@ -0,0 +1,93 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// memoryPollInterval is how often the RSS of the daemon is checked against MemoryRestart
+	memoryPollInterval = 10 * time.Second
+	// cpuPeriod is the period of cpu.max, in microseconds
+	cpuPeriod = 100000
+	// supervisorCgroup is the cgroup cosmovisor moves to, cgroups v2 only let a cgroup
+	// without processes pass controllers on to its children
+	supervisorCgroup = "supervisor"
+	// daemonCgroup is the cgroup the daemon runs in, with the limits
+	daemonCgroup = "daemon"
+)
+
+// errRestartMemory is returned by LaunchProcessContext when the daemon was stopped as its
+// RSS exceeded MemoryRestart. It is an errRestartRequested.
+var errRestartMemory = fmt.Errorf("%w for the memory of the daemon", errRestartRequested)
+
+// wantsLimits returns true if the daemon is launched in a cgroup of its own
+func (cfg *Config) wantsLimits() bool {
+	return cfg.MemoryLimit > 0 || cfg.CPULimit > 0
+}
+
+// cpuMax is the cpu.max of the daemon cgroup for CPULimit
+func (cfg *Config) cpuMax() string {
+	if cfg.CPULimit <= 0 {
+		return fmt.Sprintf("max %d", cpuPeriod)
+	}
+	return fmt.Sprintf("%d %d", int64(cfg.CPULimit*cpuPeriod), cpuPeriod)
+}
+
+// memoryMax is the memory.max of the daemon cgroup for MemoryLimit
+func (cfg *Config) memoryMax() string {
+	if cfg.MemoryLimit <= 0 {
+		return "max"
+	}
+	return fmt.Sprint(cfg.MemoryLimit)
+}
+
+// watchMemory restarts the daemon once its RSS exceeds MemoryRestart, until done is
+// closed. The restart stops it the way an upgrade does, rather than leaving it to be
+// killed for lack of memory in the middle of a block. A paused supervision wouldn't
+// launch it again, it is only warned about then. Outside of the maintenance windows the
+// restart waits for the next one, if the daemon still exceeds it then, and with
+// RestartCoordination for a restart slot of the fleet.
+func (cfg *Config) watchMemory(control *launchControl, done <-chan struct{}) {
+	ticker := time.NewTicker(memoryPollInterval)
+	defer ticker.Stop()
+	deferred := false
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		rss, err := processRSS(control.cmd.Process.Pid)
+		if err != nil {
+			logger.Warnf("not watching the memory of %s: %v", control.cmd.Path, err)
+			return
+		}
+		if rss <= cfg.MemoryRestart {
+			continue
+		}
+		exceeds := fmt.Sprintf("%s uses %s of memory, more than DAEMON_MEMORY_RESTART of %s",
+			control.cmd.Path, formatBytes(rss), formatBytes(cfg.MemoryRestart))
+		if admin.isPaused() {
+			logger.Warnf("%s, not restarting it while the supervision is paused", exceeds)
+			continue
+		}
+		if now := NowUTC(); !cfg.MaintenanceWindows.contains(now) {
+			if !deferred {
+				at, _ := cfg.MaintenanceWindows.next(now)
+				logger.Warnf("%s, restarting it in the maintenance window at %s", exceeds, at.Format(time.RFC3339))
+				deferred = true
+			}
+			continue
+		}
+		if !cfg.awaitRestartSlot("DAEMON_MEMORY_RESTART", done) {
+			return
+		}
+		logger.Warnf("%s, restarting it", exceeds)
+		if err := control.requestMemoryRestart(); err != nil {
+			logger.Infof("not restarting %s: %v", control.cmd.Path, err)
+			restartSlot.releaseHeld()
+		}
+		return
+	}
+}
@@ -0,0 +1,103 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultRestartDelay is the wait before restarting a daemon that died
+	defaultRestartDelay = time.Second
+	// maxRestartDelay caps the wait as it doubles with every restart in a row
+	maxRestartDelay = 5 * time.Minute
+	// defaultRestartAttempts is how many restarts in a row are tried before giving up
+	defaultRestartAttempts = 5
+	// restartStableAfter is how long the daemon must run for its next death to count as
+	// the first one again
+	restartStableAfter = 10 * time.Minute
+)
+
+// ChildExitError is returned by LaunchProcess when the daemon exited with an error, unless
+// it was stopped for an upgrade or a hotfix
+type ChildExitError struct {
+	Err error
+	// Stopped is set if cosmovisor was asked to stop and passed the stop signal on, otherwise
+	// the daemon died on its own
+	Stopped bool
+	// Output are the last lines the daemon wrote to stderr before it died on its own
+	Output []string
+}
+
+func (e *ChildExitError) Error() string {
+	if len(e.Output) == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v, the last lines of its stderr:\n  %s", e.Err, strings.Join(e.Output, "\n  "))
+}
+
+func (e *ChildExitError) Unwrap() error {
+	return e.Err
+}
+
+// ShouldRestartAfterFailure returns true if the daemon is launched again after
+// LaunchProcess returned err
+func (cfg *Config) ShouldRestartAfterFailure(err error) bool {
+	var exit *ChildExitError
+	return cfg.RestartAfterFailure && errors.As(err, &exit) && !exit.Stopped
+}
+
+// notifyDaemonFailed sends EventDaemonFailed when cosmovisor stops supervising bin after
+// it died on its own
+func notifyDaemonFailed(cfg *Config, bin string, err error) {
+	var exit *ChildExitError
+	if !errors.As(err, &exit) || exit.Stopped {
+		return
+	}
+	ev := NewEvent(EventDaemonFailed, "", fmt.Sprintf("%s died: %v", bin, err))
+	ev.Fields = map[string]string{"binary": bin, "error": exit.Err.Error()}
+	if len(exit.Output) > 0 {
+		ev.Fields["output"] = strings.Join(exit.Output, "\n")
+	}
+	notify(cfg, ev)
+}
+
+// restartDelay is the wait before the first restart after a failure
+func (cfg *Config) restartDelay() time.Duration {
+	if cfg.RestartDelay <= 0 {
+		return defaultRestartDelay
+	}
+	return cfg.RestartDelay
+}
+
+// restartAttempts is how many restarts in a row are tried before giving up
+func (cfg *Config) restartAttempts() int {
+	if cfg.RestartMaxAttempts <= 0 {
+		return defaultRestartAttempts
+	}
+	return cfg.RestartMaxAttempts
+}
+
+// restartBackoff tracks the restarts after failures in a row and their delay
+type restartBackoff struct {
+	failures int
+	delay    time.Duration
+}
+
+// next returns the wait before restarting a daemon which ran for ran, or false once it
+// failed more than attempts times in a row
+func (b *restartBackoff) next(cfg *Config, ran time.Duration) (time.Duration, bool) {
+	if b.failures == 0 || ran >= restartStableAfter {
+		b.failures, b.delay = 0, cfg.restartDelay()
+	} else if b.delay *= 2; b.delay > maxRestartDelay {
+		b.delay = maxRestartDelay
+	}
+	b.failures++
+	return b.delay, b.failures <= cfg.restartAttempts()
+}
+
+// reset forgets the failures, e.g. after an upgrade
+func (b *restartBackoff) reset() {
+	b.failures = 0
+}
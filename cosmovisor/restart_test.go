@@ -0,0 +1,64 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	cfg := &Config{RestartDelay: time.Minute, RestartMaxAttempts: 5}
+	var b restartBackoff
+	expect := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, maxRestartDelay, maxRestartDelay}
+	for i, want := range expect {
+		delay, ok := b.next(cfg, time.Second)
+		require.True(t, ok, "attempt %d", i+1)
+		require.Equal(t, want, delay, "attempt %d", i+1)
+	}
+	_, ok := b.next(cfg, time.Second)
+	require.False(t, ok)
+
+	// a daemon that ran for a while starts over
+	delay, ok := b.next(cfg, restartStableAfter)
+	require.True(t, ok)
+	require.Equal(t, time.Minute, delay)
+	require.Equal(t, 1, b.failures)
+
+	// so does one that was upgraded
+	b.next(cfg, time.Second)
+	b.reset()
+	delay, _ = b.next(cfg, time.Second)
+	require.Equal(t, time.Minute, delay)
+
+	// defaults
+	b = restartBackoff{}
+	delay, ok = b.next(&Config{}, 0)
+	require.True(t, ok)
+	require.Equal(t, defaultRestartDelay, delay)
+}
+
+func TestShouldRestartAfterFailure(t *testing.T) {
+	exit := &ChildExitError{Err: errors.New("exit status 1")}
+	require.True(t, (&Config{RestartAfterFailure: true}).ShouldRestartAfterFailure(exit))
+	require.True(t, (&Config{RestartAfterFailure: true}).ShouldRestartAfterFailure(fmt.Errorf("wrapped: %w", exit)))
+	require.False(t, (&Config{}).ShouldRestartAfterFailure(exit))
+	require.False(t, (&Config{RestartAfterFailure: true}).ShouldRestartAfterFailure(nil))
+	require.False(t, (&Config{RestartAfterFailure: true}).ShouldRestartAfterFailure(errors.New("cannot download binary")))
+}
+
+func TestChildExitErrorOutput(t *testing.T) {
+	tail := &outputTail{max: 3}
+	for _, chunk := range []string{"one\ntw", "o\nthree\n", "four\nfive"} {
+		_, err := tail.Write([]byte(chunk))
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"three", "four", "five"}, tail.Lines())
+
+	exit := &ChildExitError{Err: errors.New("exit status 2")}
+	require.EqualError(t, exit, "exit status 2")
+	exit.Output = []string{"panic: boom", "goroutine 1 [running]:"}
+	require.EqualError(t, exit, "exit status 2, the last lines of its stderr:\n  panic: boom\n  goroutine 1 [running]:")
+}
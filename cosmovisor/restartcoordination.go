@@ -0,0 +1,264 @@
+package cosmovisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRestartConcurrency is how many nodes of a fleet restart at once
+	defaultRestartConcurrency = 1
+	// defaultRestartSettle is how long a restart slot is held at most once the daemon was
+	// launched again, if it commits no block before
+	defaultRestartSettle = time.Minute
+	// selfUpgradePollInterval is how often a coordinated node checks whether `cosmovisor
+	// self-upgrade` replaced its binary
+	selfUpgradePollInterval = time.Minute
+)
+
+// Event types of the coordinated restarts
+const (
+	EventRestartSlotTaken    = "restart_slot_taken"
+	EventRestartSlotReleased = "restart_slot_released"
+)
+
+// parseRestartCoordination checks a DAEMON_RESTART_COORDINATION URL, the backend and the
+// key the slots are named after
+func parseRestartCoordination(s string, ttl time.Duration) (*url.URL, error) {
+	return parseLeaderElection(s, ttl)
+}
+
+// wantsRestartCoordination returns true if the optional restarts wait for a slot shared
+// with the other nodes of the fleet
+func (cfg *Config) wantsRestartCoordination() bool {
+	return len(cfg.RestartSlots) > 0 || cfg.RestartCoordination != ""
+}
+
+func (cfg *Config) restartConcurrency() int {
+	if len(cfg.RestartSlots) > 0 {
+		return len(cfg.RestartSlots)
+	}
+	if cfg.RestartConcurrency <= 0 {
+		return defaultRestartConcurrency
+	}
+	return cfg.RestartConcurrency
+}
+
+func (cfg *Config) restartSettle() time.Duration {
+	if cfg.RestartSettle <= 0 {
+		return defaultRestartSettle
+	}
+	return cfg.RestartSettle
+}
+
+// restartCoordinationRedacted is RestartCoordination without the password of the backend
+func (cfg *Config) restartCoordinationRedacted() string {
+	return (&Config{LeaderElection: cfg.RestartCoordination}).leaderElectionRedacted()
+}
+
+// restartSlots returns RestartSlots, or else a lock of the backend of RestartCoordination
+// per slot, its key followed by the number of the slot
+func (cfg *Config) restartSlots() ([]LeaderBackend, error) {
+	if len(cfg.RestartSlots) > 0 {
+		return cfg.RestartSlots, nil
+	}
+	u, err := parseRestartCoordination(cfg.RestartCoordination, cfg.leaderTTL())
+	if err != nil {
+		return nil, fmt.Errorf("invalid DAEMON_RESTART_COORDINATION %q: %w", cfg.RestartCoordination, err)
+	}
+	slots := make([]LeaderBackend, cfg.restartConcurrency())
+	for i := range slots {
+		slot := *u
+		slot.Path = path.Join(u.Path, strconv.Itoa(i+1))
+		slots[i] = leaderBackends[u.Scheme](&slot)
+	}
+	return slots, nil
+}
+
+// restartSlot is the slot this node holds for a coordinated restart, from before the daemon
+// is stopped until the daemon launched again settled
+var restartSlot = &heldSlot{}
+
+type heldSlot struct {
+	mutex   sync.Mutex
+	release func()
+}
+
+// hold records the release of the slot taken
+func (s *heldSlot) hold(release func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.release = release
+}
+
+// take returns the release of the slot held, nil if none is
+func (s *heldSlot) take() func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	release := s.release
+	s.release = nil
+	return release
+}
+
+// releaseHeld gives the slot held up, if any
+func (s *heldSlot) releaseHeld() {
+	if release := s.take(); release != nil {
+		release()
+	}
+}
+
+// awaitRestartSlot takes one of the restart slots of the fleet before an optional restart
+// for reason, trying every third of LeaderTTL while they are all held by other nodes. It
+// returns true at once without coordination, false if done is closed first. The slot is
+// held until the daemon launched again settled, see settleRestart.
+func (cfg *Config) awaitRestartSlot(reason string, done <-chan struct{}) bool {
+	if !cfg.wantsRestartCoordination() {
+		return true
+	}
+	slots, err := cfg.restartSlots()
+	if err != nil {
+		logger.Errorf("not restarting for %s: %v", reason, err)
+		return false
+	}
+	id, ttl := cfg.leaderID(), cfg.leaderTTL()
+	interval := ttl / 3
+	logged := false
+	for {
+		for i, slot := range slots {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			won, err := slot.Acquire(ctx, id, ttl)
+			cancel()
+			if err != nil {
+				logger.Warnf("taking restart slot %d: %v", i+1, err)
+				continue
+			}
+			if won {
+				cfg.holdRestartSlot(slot, i+1, reason)
+				return true
+			}
+		}
+		if !logged {
+			logger.Infof("restarting for %s once one of the %d restart slots of the fleet is free", reason, len(slots))
+			logged = true
+		}
+		select {
+		case <-done:
+			return false
+		case <-time.After(interval):
+		}
+	}
+}
+
+// holdRestartSlot renews the slot taken for reason until it is released
+func (cfg *Config) holdRestartSlot(slot LeaderBackend, n int, reason string) {
+	id, ttl := cfg.leaderID(), cfg.leaderTTL()
+	logger.Infof("took restart slot %d to restart for %s", n, reason)
+	ev := NewEvent(EventRestartSlotTaken, "", fmt.Sprintf("%s took restart slot %d to restart for %s", id, n, reason))
+	ev.Fields = map[string]string{"slot": strconv.Itoa(n), "reason": reason}
+	notify(cfg, ev)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	renewed := make(chan struct{})
+	goGuarded(cfg, func() {
+		defer close(renewed)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			renew, cancelRenew := context.WithTimeout(ctx, ttl/3)
+			err := slot.Renew(renew, id, ttl)
+			cancelRenew()
+			switch {
+			case ctx.Err() != nil:
+				return
+			case errors.Is(err, ErrLeaseLost):
+				logger.Warnf("lost restart slot %d: %v", n, err)
+				return
+			case err != nil:
+				logger.Warnf("renewing restart slot %d: %v", n, err)
+			}
+		}
+	})
+	restartSlot.hold(func() {
+		cancel()
+		<-renewed
+		release, cancelRelease := context.WithTimeout(context.Background(), leaderReleaseTimeout)
+		defer cancelRelease()
+		if err := slot.Release(release, id); err != nil {
+			logger.Warnf("releasing restart slot %d: %v", n, err)
+		}
+		logger.Infof("released restart slot %d", n)
+		recordEvent(cfg, NewEvent(EventRestartSlotReleased, "", fmt.Sprintf("%s released restart slot %d", id, n)))
+	})
+}
+
+// settleRestart releases the restart slot held, if any, once the daemon launched after the
+// restart committed a block, after RestartSettle at most, or once done is closed
+func (cfg *Config) settleRestart(blocks *blockWatch, done <-chan struct{}) {
+	release := restartSlot.take()
+	if release == nil {
+		return
+	}
+	defer release()
+	settled := time.NewTimer(cfg.restartSettle())
+	defer settled.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if height, _ := blocks.last(); height > 0 {
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-settled.C:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchSelfUpgrade restarts the daemon of a coordinated node once `cosmovisor self-upgrade`
+// replaced the cosmovisor binary since it was launched at started, in a maintenance window,
+// for the new cosmovisor to take over before it is launched again. Until done is closed.
+func (cfg *Config) watchSelfUpgrade(control *launchControl, started time.Time, done <-chan struct{}) {
+	self, err := selfExecutable()
+	if err != nil {
+		return
+	}
+	ticker := time.NewTicker(selfUpgradePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		record, err := cfg.RecordedSelfUpgrade()
+		if err != nil || record == nil || record.Path != self || !record.InstalledAt.After(started) {
+			continue
+		}
+		if now := NowUTC(); admin.isPaused() || !cfg.MaintenanceWindows.contains(now) {
+			continue
+		}
+		if !cfg.awaitRestartSlot("cosmovisor "+record.Version, done) {
+			return
+		}
+		logger.Infof("cosmovisor was replaced by %s, restarting %s for it to take over", record.Version, control.cmd.Path)
+		if err := control.requestRestart(); err != nil {
+			logger.Infof("not restarting %s: %v", control.cmd.Path, err)
+			restartSlot.releaseHeld()
+		}
+		return
+	}
+}
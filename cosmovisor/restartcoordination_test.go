@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func resetRestartSlot(t *testing.T) {
+	saved := restartSlot
+	restartSlot = &heldSlot{}
+	t.Cleanup(func() {
+		restartSlot.releaseHeld()
+		restartSlot = saved
+	})
+}
+
+func TestRestartSlots(t *testing.T) {
+	cfg := &Config{RestartCoordination: "redis://:secret@10.0.0.5:6379/gaia/sentries", RestartConcurrency: 3}
+	require.True(t, cfg.wantsRestartCoordination())
+	require.Equal(t, "redis://:xxxxx@10.0.0.5:6379/gaia/sentries", cfg.restartCoordinationRedacted())
+	slots, err := cfg.restartSlots()
+	require.NoError(t, err)
+	require.Len(t, slots, 3)
+	for i, key := range []string{"gaia/sentries/1", "gaia/sentries/2", "gaia/sentries/3"} {
+		require.Equal(t, key, slots[i].(*redisBackend).key)
+	}
+
+	cfg = &Config{RestartSlots: []LeaderBackend{&memoryBackend{}, &memoryBackend{}}}
+	require.Equal(t, 2, cfg.restartConcurrency())
+	require.Equal(t, defaultRestartSettle, cfg.restartSettle())
+	require.False(t, (&Config{}).wantsRestartCoordination())
+}
+
+func TestAwaitRestartSlot(t *testing.T) {
+	resetRestartSlot(t)
+	slot := &memoryBackend{}
+	node := func(id string) *Config {
+		return &Config{Home: t.TempDir(), Name: "dummyd", RestartSlots: []LeaderBackend{slot}, LeaderID: id, LeaderTTL: 300 * time.Millisecond}
+	}
+	node1, node2 := node("node1"), node("node2")
+
+	// without coordination a restart never waits
+	require.True(t, (&Config{}).awaitRestartSlot("test", nil))
+	require.Nil(t, restartSlot.take())
+
+	require.True(t, node1.awaitRestartSlot("test", nil))
+	slot.set(func() { require.Equal(t, "node1", slot.holder) })
+
+	// node2 waits for node1 to release it
+	done := make(chan struct{})
+	close(done)
+	require.False(t, node2.awaitRestartSlot("test", done), "gives up once done is closed")
+	release := restartSlot.take()
+	require.NotNil(t, release)
+	taken := make(chan bool)
+	go func() { taken <- node2.awaitRestartSlot("test", nil) }()
+	select {
+	case <-taken:
+		t.Fatal("node2 restarts while node1 holds the only slot")
+	case <-time.After(200 * time.Millisecond):
+	}
+	release()
+	select {
+	case ok := <-taken:
+		require.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("node2 didn't take the released slot")
+	}
+	slot.set(func() { require.Equal(t, "node2", slot.holder) })
+	restartSlot.releaseHeld()
+	slot.set(func() { require.Empty(t, slot.holder) })
+}
+
+func TestSettleRestart(t *testing.T) {
+	resetRestartSlot(t)
+	slot := &memoryBackend{}
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", RestartSlots: []LeaderBackend{slot}, LeaderID: "node1", RestartSettle: time.Hour}
+
+	// released by the first block of the daemon launched again
+	require.True(t, cfg.awaitRestartSlot("test", nil))
+	blocks := &blockWatch{cfg: cfg}
+	settled := make(chan struct{})
+	go func() {
+		defer close(settled)
+		cfg.settleRestart(blocks, nil)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	slot.set(func() { require.Equal(t, "node1", slot.holder) })
+	blocks.committed(10, NowUTC())
+	select {
+	case <-settled:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the slot wasn't released after the first block")
+	}
+	slot.set(func() { require.Empty(t, slot.holder) })
+
+	// or once RestartSettle elapsed
+	cfg.RestartSettle = 50 * time.Millisecond
+	require.True(t, cfg.awaitRestartSlot("test", nil))
+	cfg.settleRestart(&blockWatch{cfg: cfg}, nil)
+	slot.set(func() { require.Empty(t, slot.holder) })
+
+	// nothing to release without a slot
+	cfg.settleRestart(&blockWatch{cfg: cfg}, nil)
+}
+
+func TestScheduledRestartWaitsForSlot(t *testing.T) {
+	resetRestartSlot(t)
+	slot := &memoryBackend{holder: "node2"}
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+	defer cmd.Process.Kill() //nolint:errcheck
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", RestartMaxUptime: 10 * time.Millisecond,
+		RestartSlots: []LeaderBackend{slot}, LeaderID: "node1", LeaderTTL: 300 * time.Millisecond}
+	control := &launchControl{cfg: cfg, cmd: cmd}
+
+	done := make(chan struct{})
+	defer close(done)
+	go cfg.scheduleRestart(control, StartStopwatch(), done)
+	time.Sleep(300 * time.Millisecond)
+	require.False(t, control.restartRequested(), "restarted while node2 holds the slot")
+
+	slot.set(func() { slot.holder = "" })
+	require.Eventually(t, control.restartRequested, 2*time.Second, 20*time.Millisecond)
+	slot.set(func() { require.Equal(t, "node1", slot.holder) })
+}
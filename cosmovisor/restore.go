@@ -0,0 +1,218 @@
+package cosmovisor
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/otiai10/copy"
+)
+
+// RestoreOptions are the optional arguments of Restore
+type RestoreOptions struct {
+	// ResetCurrent points current back to the binary that ran before the upgrade the
+	// backup was taken for
+	ResetCurrent bool
+}
+
+// RestoreResult is what Restore changed
+type RestoreResult struct {
+	Manifest *BackupManifest
+	// Moved is where the data directory that was replaced was moved, empty if there was none
+	Moved string
+	// Current is the binary current points to after a reset, empty without one
+	Current string
+}
+
+// Restore replaces the data directory with the data backup at path, an archive or a copy.
+// It refuses while a cosmovisor or a daemon runs for the home, and if the backup doesn't
+// match its manifest. The data directory that is replaced is moved next to it rather than
+// removed.
+func Restore(cfg *Config, path string, opts RestoreOptions) (*RestoreResult, error) {
+	unlock, err := cfg.lockHome()
+	var running *AlreadyRunningError
+	if errors.As(err, &running) {
+		return nil, fmt.Errorf("%w, stop it before restoring a backup", err)
+	} else if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	// a daemon can outlive the cosmovisor that started it
+	var state RunState
+	if ok, err := cfg.readStateFile(runStateFile, &state); err != nil {
+		return nil, err
+	} else if ok && processAlive(state.DaemonPID) {
+		return nil, fmt.Errorf("the daemon (pid %d) is still running, stop it before restoring a backup", state.DaemonPID)
+	}
+
+	manifest, err := VerifyDataBackup(path)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Snapshot != 0 {
+		return nil, fmt.Errorf("%s holds the state sync snapshot at height %d, not the data directory: restore it with the snapshots commands of the application", path, manifest.Snapshot)
+	}
+	result := &RestoreResult{Manifest: manifest}
+	var currentDir string
+	if opts.ResetCurrent {
+		if currentDir, err = cfg.preUpgradeDir(manifest.Upgrade); err != nil {
+			return nil, err
+		}
+	}
+
+	fs := cfg.fs()
+	data := cfg.DataDir()
+	tmp := data + ".restore.tmp"
+	if err := fs.removeAll(tmp); err != nil {
+		return nil, err
+	}
+	logger.Infof("restoring %s from %s", data, path)
+	if err := unpackDataBackup(fs, path, tmp); err != nil {
+		_ = fs.removeAll(tmp)
+		return nil, err
+	}
+	if err := cfg.giveToDaemon(fs, tmp); err != nil {
+		_ = fs.removeAll(tmp)
+		return nil, err
+	}
+
+	if _, err := os.Lstat(data); err == nil {
+		result.Moved = data + ".before-restore-" + FormatTimestamp(NowUTC())
+		if err := fs.rename(data, result.Moved); err != nil {
+			_ = fs.removeAll(tmp)
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := fs.rename(tmp, data); err != nil {
+		if result.Moved != "" {
+			if rerr := fs.rename(result.Moved, data); rerr != nil {
+				logger.Errorf("moving %s back to %s: %v", result.Moved, data, rerr)
+			}
+		}
+		return nil, err
+	}
+
+	if currentDir != "" {
+		if err := cfg.setCurrent(currentDir); err != nil {
+			return result, fmt.Errorf("data restored, but resetting the current binary failed: %w", err)
+		}
+		result.Current = cfg.versionBin(currentDir)
+	}
+	return result, nil
+}
+
+// preUpgradeDir returns the version directory of the binary that ran before the named
+// upgrade, as recorded when cosmovisor switched to it
+func (cfg *Config) preUpgradeDir(upgrade string) (string, error) {
+	applied, err := cfg.LastUpgrade()
+	if err != nil {
+		return "", err
+	}
+	if applied == nil || applied.Name != upgrade || applied.From == "" {
+		return "", fmt.Errorf("the binary that ran before upgrade %q is unknown, it wasn't the last upgrade", upgrade)
+	}
+	dir := filepath.Dir(filepath.Dir(applied.From))
+	if !cfg.isVersionDir(dir) {
+		return "", fmt.Errorf("%s, the binary that ran before upgrade %q, is not in %s or %s", applied.From, upgrade, cfg.genesisPath(), cfg.upgradesPath())
+	}
+	if err := EnsureBinary(applied.From); err != nil {
+		return "", fmt.Errorf("the binary that ran before upgrade %q: %w", upgrade, err)
+	}
+	return dir, nil
+}
+
+// unpackDataBackup writes the data backup at path, an archive or a copy, to the new
+// directory dst
+func unpackDataBackup(fs fsGuard, path, dst string) error {
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return extractDataArchive(fs, path, dst)
+	}
+	// copy writes on its own, so refuse it up front
+	if err := fs.check("restore", dst); err != nil {
+		return err
+	}
+	return copy.Copy(path, dst)
+}
+
+// extractDataArchive unpacks the data backup archive at path to the directory dst, which
+// takes the place of the data directory the archive unpacks to. Entries escaping dst or
+// going through a symlink of the archive are refused.
+func extractDataArchive(fs fsGuard, path, dst string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	if err := fs.mkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	links := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		parts := strings.SplitN(strings.TrimSuffix(hdr.Name, "/"), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		elems, err := splitInDir(filepath.FromSlash(parts[1]))
+		if err != nil {
+			return fmt.Errorf("%s in %s: %w", hdr.Name, path, err)
+		}
+		for i := 1; i < len(elems); i++ {
+			if links[filepath.Join(elems[:i]...)] {
+				return fmt.Errorf("%s in %s: %w", hdr.Name, path, errSymlinkNotFollowed)
+			}
+		}
+		rel := filepath.Join(elems...)
+		target := filepath.Join(dst, rel)
+		mode := hdr.FileInfo().Mode().Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = fs.mkdirAll(target, mode|0700)
+		case tar.TypeSymlink:
+			links[rel] = true
+			if err = fs.mkdirAll(filepath.Dir(target), 0755); err == nil {
+				err = fs.symlink(hdr.Linkname, target)
+			}
+		case tar.TypeReg:
+			if err = fs.mkdirAll(filepath.Dir(target), 0755); err == nil {
+				err = extractFile(fs, tr, target, mode)
+			}
+		default:
+			logger.Warnf("not restoring %s: unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return fmt.Errorf("restoring %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// extractFile writes r to the new file path
+func extractFile(fs fsGuard, r io.Reader, path string, mode os.FileMode) error {
+	out, err := fs.openFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestore(t *testing.T) {
+	for _, mode := range []DataBackup{DataBackupArchive, DataBackupCopy} {
+		t.Run(string(mode), func(t *testing.T) {
+			cfg, path := makeDataBackup(t, mode)
+			data := cfg.DataDir()
+			require.NoError(t, ioutil.WriteFile(filepath.Join(data, "state.db", "000001.ldb"), []byte("upgraded"), 0644))
+			require.NoError(t, ioutil.WriteFile(filepath.Join(data, "state.db", "000002.ldb"), []byte("new"), 0644))
+
+			result, err := Restore(cfg, path, RestoreOptions{})
+			require.NoError(t, err)
+			require.Equal(t, "v2", result.Manifest.Upgrade)
+			require.Empty(t, result.Current)
+			files, err := treeFiles(data)
+			require.NoError(t, err)
+			require.Equal(t, result.Manifest.Files, files)
+			info, err := os.Stat(filepath.Join(data, "priv_validator_state.json"))
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+			// the data that was replaced is kept
+			require.Equal(t, filepath.Dir(data), filepath.Dir(result.Moved))
+			bz, err := ioutil.ReadFile(filepath.Join(result.Moved, "state.db", "000002.ldb"))
+			require.NoError(t, err)
+			require.Equal(t, "new", string(bz))
+			require.NoFileExists(t, data+".restore.tmp")
+		})
+	}
+}
+
+func TestRestoreRefuses(t *testing.T) {
+	cfg, path := makeDataBackup(t, DataBackupArchive)
+	require.NoError(t, os.MkdirAll(cfg.Root(), 0755))
+	untouched := func() {
+		t.Helper()
+		matches, err := filepath.Glob(cfg.DataDir() + ".*")
+		require.NoError(t, err)
+		require.Empty(t, matches)
+	}
+
+	// another cosmovisor supervises the home
+	other, err := lockDir(cfg.Root())
+	require.NoError(t, err)
+	_, err = Restore(cfg, path, RestoreOptions{})
+	var running *AlreadyRunningError
+	require.True(t, errors.As(err, &running), "%v", err)
+	require.Contains(t, err.Error(), "stop it before restoring a backup")
+	other.Close()
+	untouched()
+
+	// the daemon outlived the cosmovisor that started it
+	require.NoError(t, cfg.writeStateFile(runStateFile, RunState{PID: 0, DaemonPID: os.Getpid()}))
+	_, err = Restore(cfg, path, RestoreOptions{})
+	require.EqualError(t, err, "the daemon (pid "+strconv.Itoa(os.Getpid())+") is still running, stop it before restoring a backup")
+	require.NoError(t, os.Remove(filepath.Join(cfg.StateDir(), runStateFile)))
+	untouched()
+
+	// the backup doesn't match its manifest
+	manifest, err := ReadBackupManifest(path)
+	require.NoError(t, err)
+	manifest.Files[0].Link = "elsewhere"
+	require.NoError(t, cfg.writeManifest(path, manifest))
+	_, err = Restore(cfg, path, RestoreOptions{})
+	var mismatch *BackupMismatch
+	require.True(t, errors.As(err, &mismatch), "%v", err)
+	untouched()
+}
+
+func TestRestoreResetCurrent(t *testing.T) {
+	cfg, path := makeDataBackup(t, DataBackupCopy)
+	for _, bin := range []string{cfg.GenesisBin(), cfg.UpgradeBin("v2")} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(bin), 0755))
+		require.NoError(t, ioutil.WriteFile(bin, []byte("#!/bin/sh\n"), 0755))
+	}
+
+	// nothing records what ran before v2
+	_, err := Restore(cfg, path, RestoreOptions{ResetCurrent: true})
+	require.EqualError(t, err, `the binary that ran before upgrade "v2" is unknown, it wasn't the last upgrade`)
+
+	require.NoError(t, cfg.SetCurrentUpgrade("v2"))
+	cfg.recordUpgrade(&UpgradeInfo{Name: "v2", Height: 100}, cfg.GenesisBin())
+	result, err := Restore(cfg, path, RestoreOptions{ResetCurrent: true})
+	require.NoError(t, err)
+	require.Equal(t, cfg.GenesisBin(), result.Current)
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.GenesisBin(), bin)
+
+	// a recorded binary outside the cosmovisor directory isn't trusted
+	cfg.recordUpgrade(&UpgradeInfo{Name: "v2", Height: 100}, "/usr/bin/dummyd")
+	_, err = Restore(cfg, path, RestoreOptions{ResetCurrent: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "/usr/bin/dummyd, the binary that ran before upgrade \"v2\", is not in ")
+}
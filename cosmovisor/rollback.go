@@ -0,0 +1,219 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RollbackPolicy decides what happens when the binary of an upgrade fails right after the switch
+type RollbackPolicy string
+
+const (
+	// RollbackOff leaves the upgrade in place, the failure is handled like any other
+	RollbackOff RollbackPolicy = "off"
+	// RollbackBinary points current back to the binary that ran before the upgrade
+	RollbackBinary RollbackPolicy = "binary"
+	// RollbackFull also restores the data backup taken for the upgrade
+	RollbackFull RollbackPolicy = "full"
+)
+
+const (
+	// rollbackFile records a rollback, cosmovisor refuses to start while it is there
+	rollbackFile = "rollback.json"
+	// defaultRollbackWindow is how long after the switch a failure counts against the upgrade
+	defaultRollbackWindow = 2 * time.Minute
+	// defaultRollbackAttempts is how many failures in the window roll the upgrade back
+	defaultRollbackAttempts = 1
+)
+
+// RollbackRecord is an upgrade that was rolled back because its binary failed
+type RollbackRecord struct {
+	Upgrade string `json:"upgrade"`
+	Height  int64  `json:"height,omitempty"`
+	// Reason is the failure of the upgraded binary
+	Reason string `json:"reason"`
+	// Binary is the binary current points to again
+	Binary string `json:"binary"`
+	// Backup is the data backup that was restored, empty if the data was left alone
+	Backup string `json:"backup,omitempty"`
+	// Moved is where the data directory replaced by the backup was moved
+	Moved        string    `json:"moved,omitempty"`
+	RolledBackAt time.Time `json:"rolled_back_at"`
+}
+
+// RolledBackError is returned once an upgrade was rolled back, and by every launch after
+// that until the record is removed. The old binary would only halt at the upgrade height
+// again, so cosmovisor stops until an operator looked into it.
+type RolledBackError struct {
+	Record RollbackRecord
+	// Path is the record, removing it allows cosmovisor to start again
+	Path string
+}
+
+func (e *RolledBackError) Error() string {
+	r := e.Record
+	msg := fmt.Sprintf("upgrade %q was rolled back at %s after its binary failed: %s; current is %s again", r.Upgrade, r.RolledBackAt.Format(time.RFC3339), r.Reason, r.Binary)
+	if r.Backup != "" {
+		msg += fmt.Sprintf(", the data was restored from %s", r.Backup)
+	}
+	return msg + fmt.Sprintf(". Fix the upgrade, then remove %s to start again", e.Path)
+}
+
+// parseRollbackPolicy validates the value of DAEMON_ROLLBACK
+func parseRollbackPolicy(s string) (RollbackPolicy, error) {
+	switch p := RollbackPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return RollbackOff, nil
+	case RollbackOff, RollbackBinary, RollbackFull:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown rollback policy %q, must be %s, %s or %s", s, RollbackOff, RollbackBinary, RollbackFull)
+	}
+}
+
+// rollback is the configured rollback policy, off by default
+func (cfg *Config) rollback() RollbackPolicy {
+	if cfg.Rollback == "" {
+		return RollbackOff
+	}
+	return cfg.Rollback
+}
+
+// rollbackWindow is how long after the switch a failure counts against the upgrade
+func (cfg *Config) rollbackWindow() time.Duration {
+	if cfg.RollbackWindow <= 0 {
+		return defaultRollbackWindow
+	}
+	return cfg.RollbackWindow
+}
+
+// rollbackAttempts is how many failures in the window roll the upgrade back
+func (cfg *Config) rollbackAttempts() int {
+	if cfg.RollbackAttempts <= 0 {
+		return defaultRollbackAttempts
+	}
+	return cfg.RollbackAttempts
+}
+
+// checkRolledBack returns a *RolledBackError if an upgrade was rolled back and the record
+// is still there
+func (cfg *Config) checkRolledBack() error {
+	var record RollbackRecord
+	if ok, err := cfg.readStateFile(rollbackFile, &record); !ok {
+		return err
+	}
+	return &RolledBackError{Record: record, Path: filepath.Join(cfg.StateDir(), rollbackFile)}
+}
+
+// rollbackAfterFailure counts a failure of the daemon against the upgrade switched to last,
+// if it is still current and the failure came within the rollback window. Once the
+// failures reach the attempts, or for an *UnverifiedUpgradeError or an
+// *UnhealthyUpgradeError of the rollback policy, the upgrade is rolled back and a
+// *RolledBackError returned. It returns nil if the failure doesn't call for a
+// rollback.
+func (cfg *Config) rollbackAfterFailure(failure error) error {
+	// the upgrade the chain didn't apply is rolled back right away, whenever it was found out
+	var unverified *UnverifiedUpgradeError
+	if errors.As(failure, &unverified) && cfg.rollback() != RollbackOff {
+		applied, err := cfg.LastUpgrade()
+		if err != nil || applied == nil || applied.Name != unverified.Upgrade {
+			return nil
+		}
+		return cfg.rollBack(applied, failure)
+	}
+	var unhealthy *UnhealthyUpgradeError
+	if errors.As(failure, &unhealthy) && cfg.healthGateOnFailure() == HealthGateRollback && cfg.rollback() != RollbackOff {
+		applied, err := cfg.LastUpgrade()
+		if err != nil || applied == nil || applied.Name != unhealthy.Upgrade {
+			return nil
+		}
+		return cfg.rollBack(applied, failure)
+	}
+	var exit *ChildExitError
+	if cfg.rollback() == RollbackOff || !errors.As(failure, &exit) || exit.Stopped {
+		return nil
+	}
+	// the switch may have been made by an earlier cosmovisor, so the window is wall-clock time
+	applied, err := cfg.LastUpgrade()
+	if err != nil || applied == nil || NowUTC().Sub(applied.AppliedAt) > cfg.rollbackWindow() {
+		return nil
+	}
+	if bin, _ := cfg.resolveCurrentBin(); bin != cfg.UpgradeBin(applied.Name) {
+		return nil
+	}
+	applied.Failures++
+	if applied.Failures < cfg.rollbackAttempts() {
+		ulog := logger.With("upgrade", applied.Name)
+		ulog.Warnf("the binary of upgrade %q failed %d of %d times since the switch: %v", applied.Name, applied.Failures, cfg.rollbackAttempts(), failure)
+		if err := cfg.writeStateFile(lastUpgradeFile, applied); err != nil {
+			ulog.Warnf("recording the failure of upgrade %q: %v", applied.Name, err)
+		}
+		return nil
+	}
+	return cfg.rollBack(applied, failure)
+}
+
+// rollBack points current back to the binary that ran before the applied upgrade and, with
+// the full policy, restores the data backup taken for it. The rollback is recorded, so
+// cosmovisor doesn't start again on its own.
+func (cfg *Config) rollBack(applied *AppliedUpgrade, failure error) error {
+	ulog := logger.With("upgrade", applied.Name)
+	var unverified *UnverifiedUpgradeError
+	var unhealthy *UnhealthyUpgradeError
+	if errors.As(failure, &unverified) || errors.As(failure, &unhealthy) {
+		ulog.Errorf("ROLLING BACK upgrade %q: %v", applied.Name, failure)
+	} else {
+		ulog.Errorf("ROLLING BACK upgrade %q: its binary failed %d times within %s of the switch: %v", applied.Name, applied.Failures, cfg.rollbackWindow(), failure)
+	}
+	record := RollbackRecord{Upgrade: applied.Name, Height: applied.Height, Reason: failure.Error()}
+	if cfg.rollback() == RollbackFull {
+		backup, err := cfg.upgradeDataBackup(applied.Name)
+		if err != nil {
+			return fmt.Errorf("rolling back upgrade %q: %w", applied.Name, err)
+		}
+		result, err := Restore(cfg, backup, RestoreOptions{ResetCurrent: true})
+		if err != nil {
+			return fmt.Errorf("rolling back upgrade %q: %w", applied.Name, err)
+		}
+		record.Binary, record.Backup, record.Moved = result.Current, backup, result.Moved
+	} else {
+		dir, err := cfg.preUpgradeDir(applied.Name)
+		if err == nil {
+			err = cfg.setCurrent(dir)
+		}
+		if err != nil {
+			return fmt.Errorf("rolling back upgrade %q: %w", applied.Name, err)
+		}
+		record.Binary = cfg.versionBin(dir)
+	}
+	record.RolledBackAt = NowUTC()
+	recordSwitch(cfg, applied.Name, applied.Height, cfg.UpgradeBin(applied.Name), record.Binary, "rollback")
+	if err := cfg.writeStateFile(rollbackFile, record); err != nil {
+		ulog.Warnf("recording the rollback of upgrade %q: %v", applied.Name, err)
+	}
+	cfg.recordHistory(HistoryEntry{Kind: HistoryRollback, Name: applied.Name, Height: applied.Height, At: record.RolledBackAt, Binary: record.Binary, Backup: record.Backup})
+	rolledBack := &RolledBackError{Record: record, Path: filepath.Join(cfg.StateDir(), rollbackFile)}
+	notify(cfg, Event{ID: fmt.Sprintf("%s/%s/%d", EventUpgradeRolledBack, applied.Name, record.RolledBackAt.Unix()), Type: EventUpgradeRolledBack, Upgrade: applied.Name, Message: rolledBack.Error()})
+	return rolledBack
+}
+
+// upgradeDataBackup returns the newest data backup taken for the named upgrade
+func (cfg *Config) upgradeDataBackup(upgrade string) (string, error) {
+	backups, err := cfg.dataBackups()
+	if err != nil {
+		return "", err
+	}
+	for i := len(backups) - 1; i >= 0; i-- {
+		if backups[i].Upgrade != upgrade {
+			continue
+		}
+		if isRemoteBackup(backups[i].Path) {
+			return "", fmt.Errorf("the data backup of upgrade %q was streamed to %s, it can't be restored in place", upgrade, backups[i].Path)
+		}
+		return backups[i].Path, nil
+	}
+	return "", fmt.Errorf("no data backup was taken for upgrade %q", upgrade)
+}
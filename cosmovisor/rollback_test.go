@@ -0,0 +1,129 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRollbackPolicy(t *testing.T) {
+	cases := map[string]RollbackPolicy{
+		"":       RollbackOff,
+		"off":    RollbackOff,
+		"Binary": RollbackBinary,
+		" full ": RollbackFull,
+	}
+	for s, expected := range cases {
+		p, err := parseRollbackPolicy(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, p, s)
+	}
+	_, err := parseRollbackPolicy("data")
+	require.EqualError(t, err, `unknown rollback policy "data", must be off, binary or full`)
+}
+
+// superviseFailingUpgrade upgrades the genesis binary of cfg, a home of validateHome, to
+// chain2, whose binary appends a line to runs and fails, and returns the error of Supervise
+func superviseFailingUpgrade(t *testing.T, cfg *Config) (runs string, err error) {
+	runs = filepath.Join(cfg.Home, "runs")
+	script := fmt.Sprintf("#!/bin/sh\n[ \"$1\" = pre-upgrade ] && exit 0\necho run >> %s\necho after > %s\nexit 3\n", runs, filepath.Join(cfg.DataDir(), "state"))
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("chain2"), []byte(script), 0755))
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "state"), []byte("before\n"), 0644))
+	return runs, Supervise(cfg, nil, ioutil.Discard, ioutil.Discard)
+}
+
+func TestRollbackBinary(t *testing.T) {
+	cfg := &Config{Home: validateHome(t), Name: "dummyd", RestartAfterUpgrade: true, RestartAfterFailure: true,
+		RestartDelay: time.Millisecond, Rollback: RollbackBinary, RollbackAttempts: 2}
+	runs, err := superviseFailingUpgrade(t, cfg)
+	var rolledBack *RolledBackError
+	require.True(t, errors.As(err, &rolledBack), "%v", err)
+	require.Equal(t, "chain2", rolledBack.Record.Upgrade)
+	require.Equal(t, cfg.GenesisBin(), rolledBack.Record.Binary)
+	require.Equal(t, "exit status 3", rolledBack.Record.Reason)
+	require.Empty(t, rolledBack.Record.Backup)
+	require.Equal(t, ExitCodeFailure, ExitCode(err))
+	bz, err := ioutil.ReadFile(runs)
+	require.NoError(t, err)
+	require.Equal(t, "run\nrun\n", string(bz))
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.GenesisBin(), bin)
+	// the data is left alone
+	bz, err = ioutil.ReadFile(filepath.Join(cfg.DataDir(), "state"))
+	require.NoError(t, err)
+	require.Equal(t, "after\n", string(bz))
+
+	// nothing runs until the record is removed
+	status, err := GetStatus(cfg)
+	require.NoError(t, err)
+	require.Equal(t, &rolledBack.Record, status.RolledBack)
+	err = Supervise(cfg, nil, ioutil.Discard, ioutil.Discard)
+	require.True(t, errors.As(err, &rolledBack), "%v", err)
+	require.Contains(t, err.Error(), "Fix the upgrade, then remove "+filepath.Join(cfg.StateDir(), rollbackFile)+" to start again")
+	bz, err = ioutil.ReadFile(runs)
+	require.NoError(t, err)
+	require.Equal(t, "run\nrun\n", string(bz))
+}
+
+func TestRollbackFull(t *testing.T) {
+	cfg := &Config{Home: validateHome(t), Name: "dummyd", RestartAfterUpgrade: true, Rollback: RollbackFull, DataBackup: DataBackupCopy}
+	_, err := superviseFailingUpgrade(t, cfg)
+	var rolledBack *RolledBackError
+	require.True(t, errors.As(err, &rolledBack), "%v", err)
+	require.Equal(t, cfg.GenesisBin(), rolledBack.Record.Binary)
+	backup, err := cfg.upgradeDataBackup("chain2")
+	require.NoError(t, err)
+	require.Equal(t, backup, rolledBack.Record.Backup)
+	require.Contains(t, rolledBack.Error(), ", the data was restored from "+backup)
+
+	bz, err := ioutil.ReadFile(filepath.Join(cfg.DataDir(), "state"))
+	require.NoError(t, err)
+	require.Equal(t, "before\n", string(bz))
+	bz, err = ioutil.ReadFile(filepath.Join(rolledBack.Record.Moved, "state"))
+	require.NoError(t, err)
+	require.Equal(t, "after\n", string(bz))
+
+	history, err := cfg.UpgradeHistory()
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, HistoryEntry{Kind: HistoryRollback, Name: "chain2", Height: 49, At: rolledBack.Record.RolledBackAt,
+		Binary: cfg.GenesisBin(), Backup: backup}, history[1])
+}
+
+func TestRollbackAfterFailureIgnored(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd", Rollback: RollbackBinary}
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	failed := &ChildExitError{Err: errors.New("exit status 3")}
+
+	// no upgrade applied yet
+	require.NoError(t, cfg.rollbackAfterFailure(failed))
+
+	cfg.recordUpgrade(&UpgradeInfo{Name: "chain2", Height: 49}, cfg.GenesisBin())
+	require.NoError(t, cfg.rollbackAfterFailure(&ChildExitError{Err: failed.Err, Stopped: true}))
+	require.NoError(t, cfg.rollbackAfterFailure(errors.New("cannot download binary")))
+	require.NoError(t, (&Config{Home: home, Name: "dummyd"}).rollbackAfterFailure(failed))
+	// another binary is current since
+	require.NoError(t, cfg.SetCurrentUpgrade("chain3"))
+	require.NoError(t, cfg.rollbackAfterFailure(failed))
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	// the binary ran longer than the window
+	cfg.RollbackWindow = time.Nanosecond
+	require.NoError(t, cfg.rollbackAfterFailure(failed))
+
+	applied, err := cfg.LastUpgrade()
+	require.NoError(t, err)
+	require.Zero(t, applied.Failures)
+	require.NoError(t, cfg.checkRolledBack())
+}
@@ -0,0 +1,249 @@
+package cosmovisor
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedSuffix is added to the name of a rotated output file once it is compressed
+const rotatedSuffix = ".gz"
+
+// rotatingFile appends to the output file and rotates it once it would grow beyond
+// OutputRotateSize or a new OutputRotateInterval started since it was last written. A rotated file keeps the name of the
+// output file with the time of the rotation appended, e.g. gaiad.log.20220102T150405Z.
+// Compressing and removing old rotated files runs in the background, so it never holds up
+// the daemon's output.
+type rotatingFile struct {
+	cfg  *Config
+	path string
+
+	mutex sync.Mutex
+	f     *os.File
+	size  int64
+	// written is when the file was last written, which decides the interval it belongs to
+	written time.Time
+
+	// mill compresses and removes rotated files, one run at a time
+	mill sync.Mutex
+	wg   sync.WaitGroup
+}
+
+// openOutputFile opens OutputFile for appending, rotating it as the config says
+func (cfg *Config) openOutputFile() (io.WriteCloser, error) {
+	r := &rotatingFile{cfg: cfg, path: cfg.OutputFile}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := r.cfg.fs().openFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.written = f, info.Size(), info.ModTime()
+	if r.size == 0 {
+		r.written = NowUTC()
+	}
+	return nil
+}
+
+// Write appends p, after rotating the file if p would take it beyond the size limit or p
+// is the first write of a new interval
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	now := NowUTC()
+	if r.dueForRotation(now, len(p)) {
+		if err := r.rotate(now); err != nil {
+			logger.Warnf("rotating %s: %v", r.path, err)
+		}
+	}
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	r.written = now
+	return n, err
+}
+
+func (r *rotatingFile) dueForRotation(now time.Time, n int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if max := r.cfg.OutputRotateSize; max > 0 && r.size+int64(n) > max {
+		return true
+	}
+	interval := r.cfg.OutputRotateInterval
+	return interval > 0 && !now.Truncate(interval).Equal(r.written.Truncate(interval))
+}
+
+// rotate moves the file aside and starts a new one, the caller holds the mutex
+func (r *rotatingFile) rotate(now time.Time) error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+	rotated := r.path + "." + FormatTimestamp(now)
+	for i := 1; rotatedExists(rotated); i++ {
+		// rotated more than once within a second
+		rotated = r.path + "." + FormatTimestamp(now) + "-" + strconv.Itoa(i)
+	}
+	fs := r.cfg.fs()
+	if err := fs.rename(r.path, rotated); err != nil {
+		// keep appending to the file rather than losing output
+		if oerr := r.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.wg.Add(1)
+	goGuarded(r.cfg, func() {
+		defer r.wg.Done()
+		r.millRotated(rotated)
+	})
+	return nil
+}
+
+// millRotated compresses the file just rotated and removes the rotated files beyond the
+// ones to keep. Failures only cost disk space, so they are logged.
+func (r *rotatingFile) millRotated(rotated string) {
+	r.mill.Lock()
+	defer r.mill.Unlock()
+	if r.cfg.OutputCompress {
+		if err := compressFile(r.cfg.fs(), rotated); err != nil {
+			logger.Warnf("compressing %s: %v", rotated, err)
+		}
+	}
+	r.pruneRotated()
+}
+
+// pruneRotated removes the rotated files beyond OutputKeepRecent and those rotated longer
+// than OutputMaxAge ago
+func (r *rotatingFile) pruneRotated() {
+	keep, maxAge := r.cfg.OutputKeepRecent, r.cfg.OutputMaxAge
+	if keep <= 0 && maxAge <= 0 {
+		return
+	}
+	rotated, err := rotatedFiles(r.path)
+	if err != nil {
+		logger.Warnf("not pruning rotated output files: %v", err)
+		return
+	}
+	now := NowUTC()
+	for i, f := range rotated {
+		if keep > 0 && i >= keep || maxAge > 0 && now.Sub(f.at) > maxAge {
+			logger.Infof("removing rotated output file %s", f.path)
+			if err := r.cfg.fs().remove(f.path); err != nil {
+				logger.Warnf("removing rotated output file %s: %v", f.path, err)
+			}
+		}
+	}
+}
+
+// rotatedFile is a file a rotation moved aside
+type rotatedFile struct {
+	path string
+	at   time.Time
+}
+
+// rotatedFiles returns the rotated files of the output file at path, the newest first
+func rotatedFiles(path string) ([]rotatedFile, error) {
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(path) + "."
+	var rotated []rotatedFile
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Mode().IsRegular() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), rotatedSuffix)
+		if i := strings.IndexByte(stamp, '-'); i >= 0 {
+			stamp = stamp[:i]
+		}
+		at, err := time.Parse(TimestampFormat, stamp)
+		if err != nil {
+			continue
+		}
+		rotated = append(rotated, rotatedFile{path: filepath.Join(filepath.Dir(path), name), at: at})
+	}
+	sort.SliceStable(rotated, func(i, j int) bool { return rotated[i].at.After(rotated[j].at) })
+	return rotated, nil
+}
+
+// rotatedExists returns true if a rotated file, compressed or not, has the name already
+func rotatedExists(path string) bool {
+	for _, p := range []string{path, path + rotatedSuffix} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressFile replaces path with a gzip compressed copy, path.gz
+func compressFile(fs fsGuard, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := path + rotatedSuffix + ".tmp"
+	dst, err := fs.openFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fs.rename(tmp, path+rotatedSuffix)
+	}
+	if err != nil {
+		_ = fs.remove(tmp)
+		return err
+	}
+	return fs.remove(path)
+}
+
+// Close closes the file, after the compression of the files rotated last finished
+func (r *rotatingFile) Close() error {
+	r.mutex.Lock()
+	var err error
+	if r.f != nil {
+		err = r.f.Close()
+		r.f = nil
+	}
+	r.mutex.Unlock()
+	r.wg.Wait()
+	return err
+}
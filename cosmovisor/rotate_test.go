@@ -0,0 +1,114 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeLines writes n lines of 10 bytes each
+func writeLines(t *testing.T, w interface{ Write([]byte) (int, error) }, n int) {
+	for i := 0; i < n; i++ {
+		_, err := w.Write([]byte("123456789\n"))
+		require.NoError(t, err)
+	}
+}
+
+func TestRotateBySize(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{OutputFile: filepath.Join(dir, "daemon.log"), OutputRotateSize: 25, OutputKeepRecent: 2}
+	f, err := cfg.openOutputFile()
+	require.NoError(t, err)
+	// 8 lines, 2 per file
+	writeLines(t, f, 8)
+	require.NoError(t, f.Close())
+
+	bz, err := ioutil.ReadFile(cfg.OutputFile)
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("123456789\n", 2), string(bz))
+	rotated, err := rotatedFiles(cfg.OutputFile)
+	require.NoError(t, err)
+	require.Len(t, rotated, 2, "the oldest rotated file was removed")
+	for _, r := range rotated {
+		bz, err := ioutil.ReadFile(r.path)
+		require.NoError(t, err)
+		require.Equal(t, strings.Repeat("123456789\n", 2), string(bz))
+		require.True(t, strings.HasPrefix(filepath.Base(r.path), "daemon.log."+FormatTimestamp(r.at)), r.path)
+	}
+}
+
+func TestRotateCompress(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{OutputFile: filepath.Join(dir, "daemon.log"), OutputRotateSize: 15, OutputCompress: true}
+	f, err := cfg.openOutputFile()
+	require.NoError(t, err)
+	writeLines(t, f, 2)
+	require.NoError(t, f.Close())
+
+	rotated, err := rotatedFiles(cfg.OutputFile)
+	require.NoError(t, err)
+	require.Len(t, rotated, 1)
+	require.True(t, strings.HasSuffix(rotated[0].path, ".gz"), rotated[0].path)
+	gz, err := os.Open(rotated[0].path)
+	require.NoError(t, err)
+	defer gz.Close()
+	zr, err := gzip.NewReader(gz)
+	require.NoError(t, err)
+	bz, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, "123456789\n", string(bz))
+	require.NoFileExists(t, strings.TrimSuffix(rotated[0].path, ".gz"))
+}
+
+func TestRotateByInterval(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{OutputFile: filepath.Join(dir, "daemon.log"), OutputRotateInterval: 24 * time.Hour}
+	require.NoError(t, ioutil.WriteFile(cfg.OutputFile, []byte("yesterday\n"), 0644))
+	yesterday := NowUTC().Add(-24 * time.Hour)
+	require.NoError(t, os.Chtimes(cfg.OutputFile, yesterday, yesterday))
+
+	f, err := cfg.openOutputFile()
+	require.NoError(t, err)
+	writeLines(t, f, 2)
+	require.NoError(t, f.Close())
+
+	bz, err := ioutil.ReadFile(cfg.OutputFile)
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("123456789\n", 2), string(bz), "only the first write of the day rotates")
+	rotated, err := rotatedFiles(cfg.OutputFile)
+	require.NoError(t, err)
+	require.Len(t, rotated, 1)
+	bz, err = ioutil.ReadFile(rotated[0].path)
+	require.NoError(t, err)
+	require.Equal(t, "yesterday\n", string(bz))
+}
+
+func TestRotateMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{OutputFile: filepath.Join(dir, "daemon.log"), OutputRotateSize: 15, OutputMaxAge: time.Hour}
+	old := cfg.OutputFile + "." + FormatTimestamp(NowUTC().Add(-2*time.Hour)) + ".gz"
+	unrelated := filepath.Join(dir, "daemon.log.backup")
+	for _, path := range []string{old, unrelated} {
+		require.NoError(t, ioutil.WriteFile(path, nil, 0644))
+	}
+
+	f, err := cfg.openOutputFile()
+	require.NoError(t, err)
+	writeLines(t, f, 2)
+	require.NoError(t, f.Close())
+
+	require.NoFileExists(t, old)
+	require.FileExists(t, unrelated)
+	rotated, err := rotatedFiles(cfg.OutputFile)
+	require.NoError(t, err)
+	require.Len(t, rotated, 1)
+}
@@ -0,0 +1,103 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runLogSuffix ends the name of a run log, before the compression suffix
+const runLogSuffix = ".log"
+
+// runLogMill compresses and removes run logs, one run at a time
+var runLogMill sync.Mutex
+
+// openRunLog creates the file in OutputDir the output of the launch of bin goes to, named
+// by the time of the launch and the upgrade the binary belongs to, e.g.
+// 20220102T150405Z-v2.log or 20220102T150405Z-genesis.log. The run logs of earlier
+// launches are compressed and pruned in the background.
+func (cfg *Config) openRunLog(bin string) (*os.File, error) {
+	fs := cfg.fs()
+	if err := fs.mkdirAll(cfg.OutputDir, 0755); err != nil {
+		return nil, err
+	}
+	version := cfg.upgradeOf(bin)
+	if version == "" {
+		version = "genesis"
+	}
+	name := FormatTimestamp(NowUTC()) + "-" + url.PathEscape(version)
+	path := filepath.Join(cfg.OutputDir, name+runLogSuffix)
+	for i := 1; ; i++ {
+		f, err := fs.openFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		switch {
+		case err == nil:
+			goGuarded(cfg, func() { cfg.millRunLogs(path) })
+			return f, nil
+		case !os.IsExist(err):
+			return nil, err
+		}
+		// launched more than once within a second
+		path = filepath.Join(cfg.OutputDir, fmt.Sprintf("%s-%d%s", name, i, runLogSuffix))
+	}
+}
+
+// millRunLogs compresses the run logs of the launches before the one logging to current,
+// with OutputCompress, and removes those beyond OutputKeepRecent and older than
+// OutputMaxAge. Failures only cost disk space, so they are logged.
+func (cfg *Config) millRunLogs(current string) {
+	runLogMill.Lock()
+	defer runLogMill.Unlock()
+	logs, err := runLogs(cfg.OutputDir)
+	if err != nil {
+		logger.Warnf("not pruning the run logs: %v", err)
+		return
+	}
+	keep, maxAge, now := cfg.OutputKeepRecent, cfg.OutputMaxAge, NowUTC()
+	for i, f := range logs {
+		switch {
+		case f.path == current:
+		case keep > 0 && i >= keep || maxAge > 0 && now.Sub(f.at) > maxAge:
+			logger.Infof("removing run log %s", f.path)
+			if err := cfg.fs().remove(f.path); err != nil {
+				logger.Warnf("removing run log %s: %v", f.path, err)
+			}
+		case cfg.OutputCompress && strings.HasSuffix(f.path, runLogSuffix):
+			if err := compressFile(cfg.fs(), f.path); err != nil {
+				logger.Warnf("compressing %s: %v", f.path, err)
+			}
+		}
+	}
+}
+
+// runLogs returns the run logs in dir, compressed or not, the newest first. Only files
+// named like a run log are returned.
+func runLogs(dir string) ([]rotatedFile, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var logs []rotatedFile
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Mode().IsRegular() || !strings.HasSuffix(strings.TrimSuffix(name, rotatedSuffix), runLogSuffix) {
+			continue
+		}
+		i := strings.IndexByte(name, '-')
+		if i < 0 {
+			continue
+		}
+		at, err := time.Parse(TimestampFormat, name[:i])
+		if err != nil {
+			continue
+		}
+		logs = append(logs, rotatedFile{path: filepath.Join(dir, name), at: at})
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].at.After(logs[j].at) })
+	return logs, nil
+}
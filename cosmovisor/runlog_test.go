@@ -0,0 +1,66 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunLog(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", OutputDir: filepath.Join(t.TempDir(), "runs"), OutputKeepRecent: 2, OutputCompress: true}
+	require.NoError(t, os.MkdirAll(cfg.OutputDir, 0755))
+	for _, name := range []string{"20200101T000000Z-genesis.log", "20210101T000000Z-v1.log", "notes.txt"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.OutputDir, name), []byte("earlier run\n"), 0644))
+	}
+
+	var console bytes.Buffer
+	stdout, stderr, closeFile, err := cfg.childOutput(cfg.UpgradeBin("v2"), &console, &console)
+	require.NoError(t, err)
+	_, err = stdout.Write([]byte("out\n"))
+	require.NoError(t, err)
+	_, err = stderr.Write([]byte("err\n"))
+	require.NoError(t, err)
+	closeFile()
+	require.Equal(t, "out\nerr\n", console.String())
+
+	// the earlier run logs are milled in the background
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(cfg.OutputDir, "20210101T000000Z-v1.log.gz"))
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+	runLogMill.Lock()
+	defer runLogMill.Unlock()
+	logs, err := runLogs(cfg.OutputDir)
+	require.NoError(t, err)
+	require.Len(t, logs, 2, "the oldest run log was removed")
+	require.Regexp(t, regexp.MustCompile(`^\d{8}T\d{6}Z-v2\.log$`), filepath.Base(logs[0].path))
+	bz, err := ioutil.ReadFile(logs[0].path)
+	require.NoError(t, err)
+	require.Equal(t, "out\nerr\n", string(bz))
+	require.FileExists(t, filepath.Join(cfg.OutputDir, "notes.txt"))
+}
+
+func TestRunLogNames(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", OutputDir: t.TempDir()}
+	var names []string
+	for _, bin := range []string{cfg.GenesisBin(), cfg.GenesisBin(), cfg.UpgradeBin("v2/hotfix")} {
+		f, err := cfg.openRunLog(bin)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		names = append(names, filepath.Base(f.Name()))
+	}
+	require.Regexp(t, regexp.MustCompile(`^\d{8}T\d{6}Z-genesis\.log$`), names[0])
+	// launched again within the second
+	require.Regexp(t, regexp.MustCompile(`^\d{8}T\d{6}Z-genesis(-1)?\.log$`), names[1])
+	require.NotEqual(t, names[0], names[1])
+	require.Regexp(t, regexp.MustCompile(`^\d{8}T\d{6}Z-v2%2Fhotfix\.log$`), names[2])
+}
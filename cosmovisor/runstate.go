@@ -0,0 +1,150 @@
+package cosmovisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// runStateFile describes the running daemon while cosmovisor supervises it
+	runStateFile = "run.json"
+	// lastUpgradeFile records the upgrade cosmovisor switched to last
+	lastUpgradeFile = "last-upgrade.json"
+)
+
+// RunState is the daemon a cosmovisor process is supervising right now
+type RunState struct {
+	// PID is the process id of cosmovisor
+	PID int `json:"pid"`
+	// DaemonPID is the process id of the daemon
+	DaemonPID int       `json:"daemon_pid"`
+	Binary    string    `json:"binary"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// AppliedUpgrade is the upgrade cosmovisor switched to last
+type AppliedUpgrade struct {
+	Name   string `json:"name"`
+	Height int64  `json:"height,omitempty"`
+	// From is the binary that ran before the upgrade
+	From      string    `json:"from"`
+	AppliedAt time.Time `json:"applied_at"`
+	// Failures counts the failures of the upgraded binary within the rollback window
+	Failures int `json:"failures,omitempty"`
+	// Verification is whether the chain applied the upgrade, once DAEMON_VERIFY_UPGRADE
+	// found out
+	Verification *UpgradeVerification `json:"verification,omitempty"`
+	// Health is whether the new binary passed the health gate, once
+	// DAEMON_HEALTH_GATE_BLOCKS decided
+	Health *UpgradeHealth `json:"health,omitempty"`
+}
+
+// lastUpgradeMutex serializes the updates of the applied upgrade, the verification and the
+// health gate record theirs while the daemon runs
+var lastUpgradeMutex sync.Mutex
+
+// writeRunState records the daemon that was just started. Status works without it, so a
+// failure is only logged.
+func (cfg *Config) writeRunState(daemonPID int, bin string) {
+	state := RunState{PID: os.Getpid(), DaemonPID: daemonPID, Binary: bin, StartedAt: NowUTC()}
+	if err := cfg.writeStateFile(runStateFile, state); err != nil {
+		logger.Warnf("recording the running daemon: %v", err)
+	}
+}
+
+// clearRunState removes the run state once the daemon exited, unless another daemon
+// was recorded since
+func (cfg *Config) clearRunState(daemonPID int) {
+	path := filepath.Join(cfg.StateDir(), runStateFile)
+	var state RunState
+	if bz, err := ioutil.ReadFile(path); err != nil || json.Unmarshal(bz, &state) != nil || state.DaemonPID != daemonPID {
+		return
+	}
+	if err := cfg.fs().remove(path); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("removing %s: %v", path, err)
+	}
+}
+
+// RunState returns the daemon supervised by a cosmovisor process right now, or nil if no
+// cosmovisor process is running for this home. A state left behind by a cosmovisor that
+// was killed is ignored.
+func (cfg *Config) RunState() (*RunState, error) {
+	var state RunState
+	if ok, err := cfg.readStateFile(runStateFile, &state); !ok {
+		return nil, err
+	}
+	if !processAlive(state.PID) || !processAlive(state.DaemonPID) {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+// recordUpgrade records the upgrade that was just switched to
+func (cfg *Config) recordUpgrade(info *UpgradeInfo, oldBin string) {
+	applied := AppliedUpgrade{Name: info.Name, Height: info.Height, From: oldBin, AppliedAt: NowUTC()}
+	metrics.upgradeApplied(&applied)
+	if err := cfg.writeStateFile(lastUpgradeFile, applied); err != nil {
+		logger.Warnf("recording upgrade %q: %v", info.Name, err)
+	}
+}
+
+// LastUpgrade returns the upgrade cosmovisor switched to last, nil if there was none yet
+func (cfg *Config) LastUpgrade() (*AppliedUpgrade, error) {
+	var applied AppliedUpgrade
+	if ok, err := cfg.readStateFile(lastUpgradeFile, &applied); !ok {
+		return nil, err
+	}
+	return &applied, nil
+}
+
+// updateLastUpgrade applies update to the recorded applied upgrade, if it is still the
+// named upgrade
+func (cfg *Config) updateLastUpgrade(name string, update func(*AppliedUpgrade)) error {
+	lastUpgradeMutex.Lock()
+	defer lastUpgradeMutex.Unlock()
+	applied, err := cfg.LastUpgrade()
+	if err != nil || applied == nil || applied.Name != name {
+		return err
+	}
+	update(applied)
+	return cfg.writeStateFile(lastUpgradeFile, applied)
+}
+
+// writeStateFile replaces the named file in the state directory with v as JSON
+func (cfg *Config) writeStateFile(name string, v interface{}) error {
+	bz, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fs := cfg.fs()
+	if err := fs.mkdirAll(cfg.StateDir(), 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(cfg.StateDir(), name)
+	if err := fs.writeFile(path+".tmp", bz, 0644); err != nil {
+		return err
+	}
+	return fs.rename(path+".tmp", path)
+}
+
+// readStateFile reads the named file in the state directory into v, ok is false if it
+// doesn't exist
+func (cfg *Config) readStateFile(name string, v interface{}) (ok bool, err error) {
+	path := filepath.Join(cfg.StateDir(), name)
+	bz, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(bz, v); err != nil {
+		return false, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunState(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	state, err := cfg.RunState()
+	require.NoError(t, err)
+	require.Nil(t, state)
+
+	cfg.writeRunState(os.Getpid(), cfg.GenesisBin())
+	state, err = cfg.RunState()
+	require.NoError(t, err)
+	require.Equal(t, os.Getpid(), state.PID)
+	require.Equal(t, cfg.GenesisBin(), state.Binary)
+
+	// another daemon was recorded since
+	cfg.clearRunState(os.Getpid() + 1)
+	state, err = cfg.RunState()
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	cfg.clearRunState(os.Getpid())
+	state, err = cfg.RunState()
+	require.NoError(t, err)
+	require.Nil(t, state)
+
+	// left behind by a daemon that is gone
+	exited := exec.Command("true")
+	require.NoError(t, exited.Run())
+	cfg.writeRunState(exited.Process.Pid, cfg.GenesisBin())
+	state, err = cfg.RunState()
+	require.NoError(t, err)
+	require.Nil(t, state)
+}
+
+func TestLastUpgrade(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	last, err := cfg.LastUpgrade()
+	require.NoError(t, err)
+	require.Nil(t, last)
+
+	cfg.recordUpgrade(&UpgradeInfo{Name: "chain2", Height: 49}, cfg.GenesisBin())
+	cfg.recordUpgrade(&UpgradeInfo{Name: "chain3", Height: 120}, cfg.UpgradeBin("chain2"))
+	last, err = cfg.LastUpgrade()
+	require.NoError(t, err)
+	require.Equal(t, "chain3", last.Name)
+	require.Equal(t, int64(120), last.Height)
+	require.Equal(t, cfg.UpgradeBin("chain2"), last.From)
+	require.False(t, last.AppliedAt.IsZero())
+
+	// the state lives below the writable root in an immutable layout
+	cfg.Immutable, cfg.WritableRoot = true, t.TempDir()
+	last, err = cfg.LastUpgrade()
+	require.NoError(t, err)
+	require.Nil(t, last)
+}
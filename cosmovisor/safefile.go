@@ -0,0 +1,61 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errSymlinkNotFollowed is returned when a path inside a trusted directory traverses a symlink
+var errSymlinkNotFollowed = errors.New("refusing to follow symlink")
+
+// errNotRegularFile is returned when a path inside a trusted directory is a FIFO, a device or
+// another file that isn't a regular file
+var errNotRegularFile = errors.New("not a regular file")
+
+// splitInDir cleans rel and splits it into its components. rel must stay inside the directory
+// it is relative to.
+func splitInDir(rel string) ([]string, error) {
+	rel = filepath.Clean(rel)
+	if filepath.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%s is not a path inside the directory", rel)
+	}
+	return strings.Split(rel, string(filepath.Separator)), nil
+}
+
+// insideDir returns true if path is dir or inside it. Both are compared as given, symlinks
+// aren't resolved.
+func insideDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// readFileInDir reads the file at rel inside dir with openInDir
+func readFileInDir(dir, rel string) ([]byte, error) {
+	f, err := openInDir(dir, rel)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// statInDir returns the file info of the regular file at rel inside dir, without following symlinks
+func statInDir(dir, rel string) (os.FileInfo, error) {
+	f, err := openInDir(dir, rel)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: %w", filepath.Join(dir, rel), errNotRegularFile)
+	}
+	return info, nil
+}
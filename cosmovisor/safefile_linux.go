@@ -0,0 +1,66 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// openInDir opens the file at rel inside dir for reading without following a symlink in any
+// component of rel. dir itself is trusted and may be a symlink. Each component is opened
+// relative to the descriptor of its parent, so a directory swapped for a symlink after it
+// was checked can't redirect the open. The file must be a regular file: it is opened without
+// blocking, so a FIFO planted in its place is rejected rather than waited on.
+func openInDir(dir, rel string) (*os.File, error) {
+	parts, err := splitInDir(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	path := dir
+	for i, part := range parts {
+		flags := syscall.O_RDONLY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+		if i < len(parts)-1 {
+			flags |= syscall.O_DIRECTORY
+		} else {
+			flags |= syscall.O_NONBLOCK
+		}
+		path = filepath.Join(path, part)
+		next, err := syscall.Openat(fd, part, flags, 0)
+		syscall.Close(fd)
+		if err != nil {
+			return nil, openInDirError(path, err)
+		}
+		fd = next
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("%s: %w", path, errNotRegularFile)
+	}
+	if err := syscall.SetNonblock(fd, false); err != nil {
+		syscall.Close(fd)
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// openInDirError explains a failed open, O_NOFOLLOW reports a symlink as ELOOP (last
+// component) or ENOTDIR (directory component)
+func openInDirError(path string, err error) error {
+	if err == syscall.ELOOP || err == syscall.ENOTDIR {
+		if fi, lerr := os.Lstat(path); lerr == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s: %w", path, errSymlinkNotFollowed)
+		}
+	}
+	return &os.PathError{Op: "open", Path: path, Err: err}
+}
@@ -0,0 +1,52 @@
+//go:build !linux
+// +build !linux
+
+package cosmovisor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// openInDir opens the file at rel inside dir for reading without following a symlink in any
+// component of rel. dir itself is trusted and may be a symlink. Without openat, every
+// component is checked with Lstat and the opened file is compared to the checked one, which
+// detects, but can't entirely prevent, a swap of a parent directory in between. The file
+// must be a regular file.
+func openInDir(dir, rel string) (*os.File, error) {
+	parts, err := splitInDir(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	path := dir
+	var last os.FileInfo
+	for _, part := range parts {
+		path = filepath.Join(path, part)
+		if last, err = os.Lstat(path); err != nil {
+			return nil, err
+		}
+		if last.Mode()&os.ModeSymlink != 0 {
+			return nil, fmt.Errorf("%s: %w", path, errSymlinkNotFollowed)
+		}
+	}
+	if !last.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: %w", path, errNotRegularFile)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	opened, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !os.SameFile(last, opened) {
+		f.Close()
+		return nil, fmt.Errorf("%s changed while it was opened: %w", path, errSymlinkNotFollowed)
+	}
+	return f, nil
+}
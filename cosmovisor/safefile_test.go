@@ -0,0 +1,88 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFileInDir(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", "plan.json"), []byte("inside"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(outside, "plan.json"), []byte("outside"), 0644))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "plan.json"), filepath.Join(dir, "sub", "link.json")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "linkdir")))
+	require.NoError(t, syscall.Mkfifo(filepath.Join(dir, "sub", "fifo.json"), 0644))
+
+	cases := map[string]struct {
+		rel        string
+		expect     string
+		symlinkErr bool
+		notRegular bool
+		notExist   bool
+		isErr      bool
+	}{
+		"regular file":         {rel: "sub/plan.json", expect: "inside"},
+		"symlinked file":       {rel: "sub/link.json", symlinkErr: true},
+		"symlinked directory":  {rel: "linkdir/plan.json", symlinkErr: true},
+		"missing file":         {rel: "sub/missing.json", notExist: true},
+		"fifo":                 {rel: "sub/fifo.json", notRegular: true},
+		"directory":            {rel: "sub", notRegular: true},
+		"escaping the dir":     {rel: "../plan.json", isErr: true},
+		"cleaned inside":       {rel: "sub/../sub/plan.json", expect: "inside"},
+		"absolute path":        {rel: filepath.Join(outside, "plan.json"), isErr: true},
+		"the directory itself": {rel: ".", isErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			bz, err := readFileInDir(dir, tc.rel)
+			switch {
+			case tc.symlinkErr:
+				require.True(t, errors.Is(err, errSymlinkNotFollowed), "%v", err)
+			case tc.notRegular:
+				require.True(t, errors.Is(err, errNotRegularFile), "%v", err)
+			case tc.notExist:
+				require.True(t, os.IsNotExist(err), "%v", err)
+			case tc.isErr:
+				require.Error(t, err)
+			default:
+				require.NoError(t, err)
+				require.Equal(t, tc.expect, string(bz))
+			}
+		})
+	}
+}
+
+func TestStatInDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "plan.json"), []byte("plan"), 0644))
+	require.NoError(t, syscall.Mkfifo(filepath.Join(dir, "fifo.json"), 0644))
+
+	info, err := statInDir(dir, "plan.json")
+	require.NoError(t, err)
+	require.Equal(t, int64(4), info.Size())
+	// a FIFO is rejected without waiting for a writer
+	_, err = statInDir(dir, "fifo.json")
+	require.True(t, errors.Is(err, errNotRegularFile), "%v", err)
+}
+
+func TestInsideDir(t *testing.T) {
+	require.True(t, insideDir("/node/data", "/node/data"))
+	require.True(t, insideDir("/node/data", "/node/data/backups"))
+	require.True(t, insideDir("/node/data", "/node/data/../data/backups/"))
+	require.False(t, insideDir("/node/data", "/node"))
+	require.False(t, insideDir("/node/data", "/node/data-backups"))
+	require.False(t, insideDir("/node/data", "/mnt/backups"))
+	require.False(t, insideDir("data", "/node/data"))
+}
@@ -2,9 +2,56 @@ package cosmovisor
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
+// UpgradeDetection is where cosmovisor learns that the daemon halted for an upgrade
+type UpgradeDetection string
+
+const (
+	// DetectBoth scans the output and watches the plan file, whichever reports the upgrade first
+	DetectBoth UpgradeDetection = "both"
+	// DetectOutput only scans the output for the upgrade line, for chains older than v0.44
+	// that don't write the plan file
+	DetectOutput UpgradeDetection = "output"
+	// DetectFile only watches the plan file, so nothing the daemon logs can trigger an upgrade
+	DetectFile UpgradeDetection = "file"
+	// DetectChain only polls the plan of x/upgrade on DAEMON_PLAN_API, for data directories
+	// on filesystems whose events can't be relied on
+	DetectChain UpgradeDetection = "chain"
+)
+
+// parseUpgradeDetection validates the value of DAEMON_UPGRADE_DETECTION
+func parseUpgradeDetection(s string) (UpgradeDetection, error) {
+	switch d := UpgradeDetection(strings.ToLower(strings.TrimSpace(s))); d {
+	case "":
+		return DetectBoth, nil
+	case DetectBoth, DetectOutput, DetectFile, DetectChain:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown upgrade detection %q, must be %s, %s, %s or %s", s, DetectBoth, DetectOutput, DetectFile, DetectChain)
+	}
+}
+
+// scansOutput returns true if the daemon's output is scanned for the upgrade line
+func (cfg *Config) scansOutput() bool {
+	return cfg == nil || (cfg.UpgradeDetection != DetectFile && cfg.UpgradeDetection != DetectChain)
+}
+
+// watchesPlanFile returns true if the plan file is watched while the daemon runs
+func (cfg *Config) watchesPlanFile() bool {
+	return cfg.UpgradeDetection != DetectOutput && cfg.UpgradeDetection != DetectChain
+}
+
+// watchesChainPlan returns true if the plan of the chain is polled while the daemon runs
+func (cfg *Config) watchesChainPlan() bool {
+	return cfg.PlanAPI != ""
+}
+
 // Trim off whitespace around the info - match least greedy, grab as much space on both sides
 // Defined here: https://github.com/cosmos/cosmos-sdk/blob/release/v0.38.2/x/upgrade/abci.go#L38
 //  fmt.Sprintf("UPGRADE \"%s\" NEEDED at %s: %s", plan.Name, plan.DueAt(), plan.Info)
@@ -16,10 +63,57 @@ import (
 //    return fmt.Sprintf("height: %d", p.Height)
 var upgradeRegex = regexp.MustCompile(`UPGRADE "(.*)" NEEDED at ((height): (\d+)|(time): (\S+)):\s+(\S*)`)
 
+// upgradeMarker is a cheap pre-check for output that may contain an upgrade line
+var upgradeMarker = []byte("UPGRADE")
+
+// MayContainUpgrade returns true if the chunk of output could contain an upgrade line.
+// Output consumers use it to never drop such a chunk.
+func MayContainUpgrade(chunk []byte) bool {
+	return bytes.Contains(chunk, upgradeMarker)
+}
+
+// skipLongLines is bufio.ScanLines for a scanner whose buffer holds up to size bytes. A
+// longer line, e.g. a JSON blob a module dumps, is skipped with a warning instead of
+// ending the scan with bufio.ErrTooLong: the output would no longer be read, and an upgrade
+// line after it would never be seen.
+func skipLongLines(stream string, size int) bufio.SplitFunc {
+	var skipping bool
+	var skipped int
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if skipping {
+			// the rest of the long line
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				return len(data), nil, nil
+			}
+			skipping = false
+			return i + 1, nil, nil
+		}
+		if atEOF || len(data) < size || bytes.IndexByte(data, '\n') >= 0 {
+			return bufio.ScanLines(data, atEOF)
+		}
+		skipping = true
+		skipped++
+		switch {
+		case MayContainUpgrade(data):
+			logger.Errorf("skipped a line of the daemon's %s longer than %d bytes that may announce an upgrade, "+
+				"raise DAEMON_LOG_BUFFER_SIZE if the upgrade isn't detected: %.80q", stream, size, data)
+		case skipped == 1:
+			logger.Warnf("skipping the lines of the daemon's %s longer than DAEMON_LOG_BUFFER_SIZE, %d bytes: %.80q",
+				stream, size, data)
+		default:
+			logger.Debugf("skipped %d lines of the daemon's %s longer than %d bytes", skipped, stream, size)
+		}
+		return len(data), nil, nil
+	}
+}
+
 // UpgradeInfo is the details from the regexp
 type UpgradeInfo struct {
-	Name string
-	Info string
+	Name string `json:"name"`
+	Info string `json:"info,omitempty"`
+	// Height is the upgrade height, zero if the plan is scheduled by time
+	Height int64 `json:"height"`
 }
 
 // WaitForUpdate will listen to the scanner until a line matches upgradeRegexp.
@@ -28,15 +122,25 @@ type UpgradeInfo struct {
 // It returns (nil, nil) if the input closed without ever matching the regexp
 func WaitForUpdate(scanner *bufio.Scanner) (*UpgradeInfo, error) {
 	for scanner.Scan() {
-		line := scanner.Text()
-		if upgradeRegex.MatchString(line) {
-			subs := upgradeRegex.FindStringSubmatch(line)
-			info := UpgradeInfo{
-				Name: subs[1],
-				Info: subs[7],
-			}
-			return &info, nil
+		if info := parseUpgradeLine(scanner.Text()); info != nil {
+			return info, nil
 		}
 	}
 	return nil, scanner.Err()
 }
+
+// parseUpgradeLine returns the upgrade of a line matching upgradeRegexp, nil for other lines
+func parseUpgradeLine(line string) *UpgradeInfo {
+	subs := upgradeRegex.FindStringSubmatch(line)
+	if subs == nil {
+		return nil
+	}
+	info := UpgradeInfo{
+		Name: subs[1],
+		Info: subs[7],
+	}
+	if subs[3] == "height" {
+		info.Height, _ = strconv.ParseInt(subs[4], 10, 64)
+	}
+	return &info
+}
@@ -0,0 +1,122 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// scheduledBackupName stands for the upgrade in the names and records of the backups made
+// on BackupSchedule, e.g. data-backup-scheduled-1200-20220102T030000Z.tar.zst
+const scheduledBackupName = "scheduled"
+
+// errBackupScheduled is returned by LaunchProcessContext when the daemon was stopped for a
+// backup on BackupSchedule and is to be launched again. It is an errRestartRequested.
+var errBackupScheduled = fmt.Errorf("%w for a scheduled backup", errRestartRequested)
+
+// BackupSchedule are the times of the day, in UTC, the node is backed up at, as offsets
+// from midnight in ascending order
+type BackupSchedule []time.Duration
+
+// parseBackupSchedule parses DAEMON_BACKUP_SCHEDULE, a comma separated list of times such
+// as "03:00,15:00". It returns nil for the empty string.
+func parseBackupSchedule(s string) (BackupSchedule, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var schedule BackupSchedule
+	seen := map[time.Duration]bool{}
+	for _, part := range strings.Split(s, ",") {
+		offset, err := parseTimeOfDay(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		// 24:00 is midnight of the next day, the same time as 00:00
+		offset %= 24 * time.Hour
+		if seen[offset] {
+			return nil, fmt.Errorf("%s is listed twice", strings.TrimSpace(part))
+		}
+		seen[offset] = true
+		schedule = append(schedule, offset)
+	}
+	sort.Slice(schedule, func(i, j int) bool { return schedule[i] < schedule[j] })
+	return schedule, nil
+}
+
+func (s BackupSchedule) String() string {
+	times := make([]string, len(s))
+	for i, offset := range s {
+		times[i] = fmt.Sprintf("%02d:%02d", int(offset.Hours()), int(offset.Minutes())%60)
+	}
+	return strings.Join(times, ",")
+}
+
+// next returns the first scheduled time after t
+func (s BackupSchedule) next(t time.Time) time.Time {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	for _, offset := range s {
+		if at := midnight.Add(offset); at.After(t) {
+			return at
+		}
+	}
+	return midnight.Add(24 * time.Hour).Add(s[0])
+}
+
+// wantsScheduledBackup returns true if the node is backed up on a schedule
+func (cfg *Config) wantsScheduledBackup() bool {
+	return len(cfg.BackupSchedule) > 0
+}
+
+// scheduleBackup stops the daemon for a backup at the next time of BackupSchedule. A
+// backup due while the supervision is paused or the daemon is stopped for an upgrade is
+// skipped, the upgrade makes its own. With RestartCoordination, the daemon is stopped once
+// a restart slot of the fleet is free. It returns once done is closed.
+func (cfg *Config) scheduleBackup(control *launchControl, done <-chan struct{}) {
+	for {
+		at := cfg.BackupSchedule.next(NowUTC())
+		logger.Debugf("backing up the node at %s", at.Format(time.RFC3339))
+		timer := time.NewTimer(at.Sub(NowUTC()))
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if admin.isPaused() {
+			logger.Warnf("skipping the backup scheduled at %s: the supervision is paused", at.Format(time.RFC3339))
+			continue
+		}
+		if !cfg.awaitRestartSlot("the backup scheduled at "+at.Format(time.RFC3339), done) {
+			return
+		}
+		logger.Infof("stopping %s for the backup scheduled at %s", control.cmd.Path, at.Format(time.RFC3339))
+		if err := control.requestScheduledBackup(); err != nil {
+			logger.Infof("skipping the backup scheduled at %s: %v", at.Format(time.RFC3339), err)
+			restartSlot.releaseHeld()
+			continue
+		}
+		return
+	}
+}
+
+// runScheduledBackup backs up the stopped node as before an upgrade, with the data backup
+// and the backup command, then prunes the data backups. The backup is named after the
+// height the node stopped at, 0 if it can't be read.
+func (cfg *Config) runScheduledBackup(bin string) error {
+	setPhase("scheduled backup")
+	info := &UpgradeInfo{Name: scheduledBackupName}
+	if local, err := cfg.ProbeLocalHeight(); err == nil {
+		info.Height = local.Height
+	} else {
+		logger.Warnf("reading the height of the node for the backup: %v", err)
+	}
+	plan := &UpgradePlan{Info: info, OldBin: bin, NewBin: bin}
+	// the timings are never ended, a backup isn't exported as an upgrade trace
+	if err := cfg.backupBeforeSwitch(plan, NewUpgradeTimings(scheduledBackupName)); err != nil {
+		return err
+	}
+	cfg.pruneDataBackups()
+	return nil
+}
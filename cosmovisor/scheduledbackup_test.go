@@ -0,0 +1,93 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBackupSchedule(t *testing.T) {
+	s, err := parseBackupSchedule(" 15:30, 03:00 ")
+	require.NoError(t, err)
+	require.Equal(t, BackupSchedule{3 * time.Hour, 15*time.Hour + 30*time.Minute}, s)
+	require.Equal(t, "03:00,15:30", s.String())
+
+	s, err = parseBackupSchedule("24:00")
+	require.NoError(t, err)
+	require.Equal(t, BackupSchedule{0}, s)
+
+	s, err = parseBackupSchedule("")
+	require.NoError(t, err)
+	require.Nil(t, s)
+
+	_, err = parseBackupSchedule("03:00,03:00")
+	require.EqualError(t, err, "03:00 is listed twice")
+	for _, s := range []string{"3", "03:00,", "25:00", "daily"} {
+		_, err := parseBackupSchedule(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestBackupScheduleNext(t *testing.T) {
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	at := func(h, m int) time.Time { return day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute) }
+
+	s := BackupSchedule{3 * time.Hour, 15 * time.Hour}
+	require.Equal(t, at(3, 0), s.next(at(1, 0)))
+	// a backup just made isn't due again
+	require.Equal(t, at(15, 0), s.next(at(3, 0)))
+	require.Equal(t, at(27, 0), s.next(at(15, 0)))
+	require.Equal(t, at(27, 0), s.next(at(23, 59)))
+	require.Equal(t, at(3, 0), s.next(at(1, 0).In(time.FixedZone("UTC+2", 2*60*60))))
+}
+
+func TestRunScheduledBackup(t *testing.T) {
+	home := validateHome(t)
+	out := filepath.Join(home, "backups.txt")
+	script := filepath.Join(home, "backup.sh")
+	require.NoError(t, ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$COSMOVISOR_UPGRADE_NAME $@\" >> "+out+"\n"), 0755))
+	cfg := &Config{Home: home, Name: "dummyd", DataBackup: DataBackupArchive, BackupKeepRecent: 1, BackupCommand: script + " {{.Height}}"}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "priv_validator_state.json"), []byte(`{"height":"48"}`), 0600))
+
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.NoError(t, cfg.runScheduledBackup(bin))
+	require.NoError(t, cfg.runScheduledBackup(bin))
+	paths, err := filepath.Glob(filepath.Join(cfg.StateDir(), "backups", "data-backup-scheduled-48-*.tar.zst"))
+	require.NoError(t, err)
+	require.Len(t, paths, 1, "the first backup is pruned")
+	require.Equal(t, `{"height":"48"}`, readArchive(t, paths[0])["data/priv_validator_state.json"])
+	backups, err := cfg.dataBackups()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	require.NotNil(t, backups[0].Stats)
+	require.Equal(t, DataBackupRecord{Upgrade: scheduledBackupName, Height: 48, Path: paths[0], CreatedAt: backups[0].CreatedAt, Stats: backups[0].Stats}, backups[0])
+	ran, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "scheduled 48\nscheduled 48\n", string(ran))
+
+	// the current binary is left alone
+	current, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, bin, current)
+}
+
+func TestRequestScheduledBackup(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+	control := &launchControl{cfg: &Config{Home: t.TempDir(), Name: "dummyd"}, cmd: cmd}
+	require.NoError(t, control.requestScheduledBackup())
+	require.Error(t, cmd.Wait())
+	require.Equal(t, errBackupScheduled, control.restartErr())
+	require.True(t, errors.Is(control.restartErr(), errRestartRequested))
+}
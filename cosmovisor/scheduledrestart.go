@@ -0,0 +1,138 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pausedRestartRetry is how often a scheduled restart is tried again while the supervision
+// is paused
+const pausedRestartRetry = time.Minute
+
+// errRestartScheduled is returned by LaunchProcessContext when the daemon was stopped for
+// the restart scheduled by RestartMaxUptime. It is an errRestartRequested.
+var errRestartScheduled = fmt.Errorf("scheduled %w", errRestartRequested)
+
+// RestartWindow is the time of the day, in UTC, scheduled restarts are made in. It wraps
+// around midnight if it ends before it starts.
+type RestartWindow struct {
+	// Start and End are the offsets of the window from midnight
+	Start, End time.Duration
+}
+
+// parseRestartWindow parses DAEMON_RESTART_WINDOW, e.g. "02:00-04:30". It returns nil for
+// the empty string, restarts are made any time then.
+func parseRestartWindow(s string) (*RestartWindow, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%q must be a time range like 02:00-04:00", s)
+	}
+	var w RestartWindow
+	for i, bound := range []*time.Duration{&w.Start, &w.End} {
+		offset, err := parseTimeOfDay(strings.TrimSpace(parts[i]))
+		if err != nil {
+			return nil, err
+		}
+		*bound = offset
+	}
+	if w.Start == w.End {
+		return nil, fmt.Errorf("%q is empty", s)
+	}
+	return &w, nil
+}
+
+// parseTimeOfDay parses HH:MM into the offset from midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %q, must be HH:MM", s)
+	}
+	hours, herr := strconv.Atoi(parts[0])
+	minutes, merr := strconv.Atoi(parts[1])
+	if herr != nil || merr != nil || hours < 0 || hours > 24 || minutes < 0 || minutes > 59 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("invalid time %q, must be HH:MM", s)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+func (w *RestartWindow) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return format(w.Start) + "-" + format(w.End)
+}
+
+// restartWindow is DAEMON_RESTART_WINDOW, "" for any time
+func (cfg *Config) restartWindow() string {
+	if cfg.RestartWindow == nil {
+		return ""
+	}
+	return cfg.RestartWindow.String()
+}
+
+// next returns the first time at or after t within the window, t itself without a window
+func (w *RestartWindow) next(t time.Time) time.Time {
+	if w == nil {
+		return t
+	}
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	offset := t.Sub(midnight)
+	inside := offset >= w.Start && offset < w.End
+	if w.Start > w.End {
+		inside = offset >= w.Start || offset < w.End
+	}
+	switch {
+	case inside:
+		return t
+	case offset < w.Start:
+		return midnight.Add(w.Start)
+	default:
+		return midnight.Add(24 * time.Hour).Add(w.Start)
+	}
+}
+
+// scheduleRestart stops the daemon started at started for a restart once it ran for
+// RestartMaxUptime, at the first time within RestartWindow and the maintenance windows. A
+// paused supervision wouldn't launch it again, so the restart is tried again every minute
+// of the window until the supervision is resumed. With RestartCoordination, it waits for a
+// restart slot of the fleet too. It returns once done is closed.
+func (cfg *Config) scheduleRestart(control *launchControl, started Stopwatch, done <-chan struct{}) {
+	at, ok := cfg.nextRestartTime(started.Started().Add(cfg.RestartMaxUptime))
+	if !ok {
+		logger.Warnf("not restarting %s, DAEMON_RESTART_WINDOW and DAEMON_MAINTENANCE_WINDOW don't overlap", control.cmd.Path)
+		return
+	}
+	logger.Debugf("restarting %s at %s", control.cmd.Path, at.Format(time.RFC3339))
+	for {
+		timer := time.NewTimer(at.Sub(NowUTC()))
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if admin.isPaused() {
+			if at, ok = cfg.nextRestartTime(NowUTC().Add(pausedRestartRetry)); !ok {
+				return
+			}
+			continue
+		}
+		if !cfg.awaitRestartSlot("DAEMON_RESTART_MAX_UPTIME", done) {
+			return
+		}
+		logger.Infof("%s ran for %s, restarting it as DAEMON_RESTART_MAX_UPTIME asks",
+			control.cmd.Path, started.Elapsed().Round(time.Second))
+		if err := control.requestScheduledRestart(); err != nil {
+			logger.Infof("not restarting %s: %v", control.cmd.Path, err)
+			restartSlot.releaseHeld()
+		}
+		return
+	}
+}
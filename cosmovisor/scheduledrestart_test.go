@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRestartWindow(t *testing.T) {
+	w, err := parseRestartWindow(" 02:00 - 04:30 ")
+	require.NoError(t, err)
+	require.Equal(t, &RestartWindow{Start: 2 * time.Hour, End: 4*time.Hour + 30*time.Minute}, w)
+	require.Equal(t, "02:00-04:30", w.String())
+
+	w, err = parseRestartWindow("")
+	require.NoError(t, err)
+	require.Nil(t, w)
+
+	for _, s := range []string{"02:00", "2-4", "02:00-02:00", "02:60-03:00", "24:01-01:00", "a:00-01:00"} {
+		_, err := parseRestartWindow(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestRestartWindowNext(t *testing.T) {
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	at := func(h, m int) time.Time { return day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute) }
+
+	night := &RestartWindow{Start: 2 * time.Hour, End: 4 * time.Hour}
+	require.Equal(t, at(2, 0), night.next(at(1, 0)))
+	require.Equal(t, at(3, 15), night.next(at(3, 15)))
+	require.Equal(t, at(26, 0), night.next(at(4, 0)))
+	require.Equal(t, at(26, 0), night.next(at(13, 0)))
+
+	wrapping := &RestartWindow{Start: 23 * time.Hour, End: time.Hour}
+	require.Equal(t, at(0, 30), wrapping.next(at(0, 30)))
+	require.Equal(t, at(23, 0), wrapping.next(at(1, 0)))
+	require.Equal(t, at(23, 45), wrapping.next(at(23, 45)))
+
+	var anytime *RestartWindow
+	require.Equal(t, at(13, 0), anytime.next(at(13, 0)))
+}
+
+func TestScheduleRestart(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", RestartMaxUptime: 50 * time.Millisecond}
+	control := &launchControl{cfg: cfg, cmd: cmd}
+
+	done := make(chan struct{})
+	defer close(done)
+	go cfg.scheduleRestart(control, StartStopwatch(), done)
+
+	require.Error(t, cmd.Wait())
+	require.True(t, control.restartRequested())
+	require.Equal(t, errRestartScheduled, control.restartErr())
+
+	// a restart requested through the admin API isn't scheduled
+	other := &launchControl{cfg: cfg, cmd: exec.Command("true")}
+	require.NoError(t, other.cmd.Start())
+	require.NoError(t, other.requestRestart())
+	require.Equal(t, errRestartRequested, other.restartErr())
+}
@@ -0,0 +1,112 @@
+package cosmovisor
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdNotify sends the state to the service manager, as sd_notify(3) does. It does nothing
+// unless cosmovisor runs as a systemd service of Type=notify, which sets NOTIFY_SOCKET.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// an abstract socket is given with a leading @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notifySystemd is sdNotify for the lifecycle of the daemon, a failure is only logged
+func notifySystemd(state string) {
+	if err := sdNotify(state); err != nil {
+		logger.Warnf("notifying systemd: %v", err)
+	}
+}
+
+// systemdReady tells systemd the daemon is running, at the first launch and again after
+// every upgrade and restart
+func systemdReady(bin string) {
+	notifySystemd("READY=1\nSTATUS=running " + bin)
+}
+
+// systemdReloading tells systemd the daemon is stopped to switch to the upgrade
+func systemdReloading(upgrade string) {
+	notifySystemd("RELOADING=1\nSTATUS=applying upgrade " + strconv.Quote(upgrade))
+}
+
+// watchdogInterval returns how often systemd expects WATCHDOG=1, zero if its watchdog is
+// off or meant for another process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startWatchdog pings the systemd watchdog at half its interval until stop is called, as
+// long as watchdogAlive holds
+func startWatchdog(cfg *Config) (stop func()) {
+	interval := watchdogInterval()
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	goGuarded(cfg, func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		missed := 0
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := watchdogAlive(); err != nil {
+				// a daemon that just exited is noticed by the next tick
+				if missed++; missed == 2 {
+					logger.Warnf("not pinging the systemd watchdog: %v", err)
+				}
+				continue
+			}
+			missed = 0
+			notifySystemd("WATCHDOG=1")
+		}
+	})
+	return func() { close(done) }
+}
+
+// watchdogAlive returns why the supervision is wedged, nil if it isn't: the daemon
+// cosmovisor believes to be running must be alive. Between two launches, while upgrading or
+// waiting to restart, the supervision is making progress on its own.
+func watchdogAlive() error {
+	health.mutex.Lock()
+	running, fatal := health.running, health.fatal
+	health.mutex.Unlock()
+	if fatal != nil {
+		return fatal
+	}
+	if !running {
+		return nil
+	}
+	if cmd := child(); cmd == nil || cmd.Process == nil || !processAlive(cmd.Process.Pid) {
+		return errors.New("the daemon exited, but cosmovisor didn't notice")
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// listenNotify serves NOTIFY_SOCKET for the test and returns the states received
+func listenNotify(t *testing.T) <-chan string {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	setenv(t, "NOTIFY_SOCKET", path)
+	states := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			states <- string(buf[:n])
+		}
+	}()
+	return states
+}
+
+// nextState returns the next state received, failing the test if none comes
+func nextState(t *testing.T, states <-chan string) string {
+	select {
+	case s := <-states:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("no state sent to NOTIFY_SOCKET")
+		return ""
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	setenv(t, "NOTIFY_SOCKET", "")
+	require.NoError(t, sdNotify("READY=1"), "outside of systemd")
+
+	states := listenNotify(t)
+	require.NoError(t, sdNotify("READY=1"))
+	require.Equal(t, "READY=1", nextState(t, states))
+
+	setenv(t, "NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	require.Error(t, sdNotify("READY=1"))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	setenv(t, "WATCHDOG_USEC", "")
+	require.Zero(t, watchdogInterval())
+	setenv(t, "WATCHDOG_USEC", "30000000")
+	setenv(t, "WATCHDOG_PID", "")
+	require.Equal(t, 30*time.Second, watchdogInterval())
+	setenv(t, "WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	require.Equal(t, 30*time.Second, watchdogInterval())
+	setenv(t, "WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	require.Zero(t, watchdogInterval(), "meant for another process")
+}
+
+func TestWatchdog(t *testing.T) {
+	saved := health
+	health = &healthState{}
+	defer func() { health = saved }()
+	states := listenNotify(t)
+	setenv(t, "WATCHDOG_USEC", "20000")
+	setenv(t, "WATCHDOG_PID", "")
+
+	stop := startWatchdog(&Config{})
+	require.Equal(t, "WATCHDOG=1", nextState(t, states), "pinged between launches")
+
+	// the daemon is gone, but cosmovisor still believes it runs
+	health.childStarted()
+	require.Error(t, watchdogAlive())
+	time.Sleep(50 * time.Millisecond)
+	for len(states) > 0 {
+		<-states
+	}
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, states, "no pings while wedged")
+
+	health.childExited()
+	require.Equal(t, "WATCHDOG=1", nextState(t, states))
+	stop()
+}
+
+func TestLaunchProcessNotifiesSystemd(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	states := listenNotify(t)
+
+	var stdout, stderr bytes.Buffer
+	upgraded, err := LaunchProcess(cfg, []string{"foo"}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.True(t, upgraded)
+	require.Equal(t, "READY=1\nSTATUS=running "+cfg.GenesisBin(), nextState(t, states))
+	require.Equal(t, "RELOADING=1\nSTATUS=applying upgrade \"chain2\"", nextState(t, states))
+
+	_, err = LaunchProcess(cfg, []string{"foo"}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(nextState(t, states), "READY=1\nSTATUS=running "+cfg.UpgradeBin("chain2")))
+}
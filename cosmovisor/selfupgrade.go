@@ -0,0 +1,304 @@
+package cosmovisor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-getter"
+	"github.com/hashicorp/go-version"
+	"github.com/otiai10/copy"
+)
+
+const (
+	// selfUpgradeFile records the last replacement of the cosmovisor binary
+	selfUpgradeFile = "self-upgrade.json"
+	// selfUpgradeProbeTimeout bounds the version command run with a new cosmovisor binary
+	selfUpgradeProbeTimeout = 30 * time.Second
+	// previousSelfSuffix is appended to the path of the replaced cosmovisor binary
+	previousSelfSuffix = ".previous"
+)
+
+// EventSelfUpgraded is sent when cosmovisor replaced its own binary
+const EventSelfUpgraded = "cosmovisor_upgraded"
+
+// SelfUpgradeOptions is what SelfUpgrade installs
+type SelfUpgradeOptions struct {
+	// Source is the URL of the new binary, or of an archive holding it, with a checksum
+	Source string
+	// Required is the oldest version the new binary may report, if set
+	Required string
+	// Upgrade is the upgrade that asked for a newer cosmovisor, if any
+	Upgrade string
+}
+
+// SelfUpgradeRecord is the last replacement of the cosmovisor binary
+type SelfUpgradeRecord struct {
+	Path        string    `json:"path"`
+	Previous    string    `json:"previous"`
+	FromVersion string    `json:"from_version"`
+	Version     string    `json:"version"`
+	SHA256      string    `json:"sha256"`
+	Source      string    `json:"source"`
+	Upgrade     string    `json:"upgrade,omitempty"`
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// SelfUpgradedError is returned once cosmovisor replaced its own binary while the daemon
+// is stopped: the caller is expected to clean up and run the new binary in its place with
+// ExecSelf
+type SelfUpgradedError struct {
+	Record *SelfUpgradeRecord
+	// Reason is why the new binary runs now
+	Reason string
+}
+
+func (e *SelfUpgradedError) Error() string {
+	return fmt.Sprintf("cosmovisor %s installed to %s, %s", e.Record.Version, e.Record.Path, e.Reason)
+}
+
+// MinVersionError is returned for an upgrade whose plan requires a newer cosmovisor
+type MinVersionError struct {
+	Upgrade  string
+	Required string
+	// Config is the upgrade config of the plan, which may list the cosmovisor binaries
+	Config UpgradeConfig
+	Err    error
+}
+
+func (e *MinVersionError) Error() string {
+	return fmt.Sprintf("cannot apply upgrade %q: %v", e.Upgrade, e.Err)
+}
+
+func (e *MinVersionError) Unwrap() error { return e.Err }
+
+// selfExecutable returns the path of the running cosmovisor, symlinks resolved. Tests
+// replace it, so they don't replace the test binary.
+var selfExecutable = func() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// SelfUpgrade downloads a cosmovisor binary, verifies its checksum and that it runs, and
+// replaces the cosmovisor binary with it. The replaced binary is kept next to it with the
+// .previous suffix. A source without a checksum is refused: whoever controls it would
+// control the supervisor of the node. The running process isn't changed, see ExecSelf.
+func SelfUpgrade(cfg *Config, opts SelfUpgradeOptions) (*SelfUpgradeRecord, error) {
+	path, err := selfExecutable()
+	if err != nil {
+		return nil, fmt.Errorf("locating cosmovisor: %w", err)
+	}
+	fs := cfg.fs()
+	if err := fs.check("self-upgrade", path); err != nil {
+		return nil, err
+	}
+	src, sum, err := splitChecksum(opts.Source)
+	if err != nil {
+		return nil, err
+	}
+	if sum == nil {
+		return nil, fmt.Errorf("%w: %s has none, cosmovisor never replaces itself with an unverified binary", errChecksumRequired, opts.Source)
+	}
+
+	logger.Infof("downloading cosmovisor from %s, verifying %s checksum %s", src, sum.Algorithm(), sum)
+	local, cleanup, err := fetchVerified(fs, cfg.downloader(), src, sum)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	dir, err := fs.tempDir("cosmovisor-self-upgrade")
+	if err != nil {
+		return nil, err
+	}
+	defer fs.removeAll(dir)
+	bin := filepath.Join(dir, "cosmovisor")
+	if err := unpackSelf(local, dir, bin); err != nil {
+		return nil, err
+	}
+	if err := markExecutable(fs, bin); err != nil {
+		return nil, err
+	}
+	newVersion, err := probeSelfVersion(bin)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Required != "" {
+		if err := checkSelfVersion(newVersion, opts.Required); err != nil {
+			return nil, err
+		}
+	}
+	hash, err := sha256File(bin)
+	if err != nil {
+		return nil, err
+	}
+
+	// the new binary is copied next to the old one, so both renames stay on one filesystem
+	staged := path + ".new"
+	if err := fs.check("self-upgrade", staged); err != nil {
+		return nil, err
+	}
+	if err := copy.Copy(bin, staged); err != nil {
+		return nil, fmt.Errorf("staging the new cosmovisor: %w", err)
+	}
+	previous := path + previousSelfSuffix
+	if err := fs.rename(path, previous); err != nil {
+		fs.remove(staged)
+		return nil, fmt.Errorf("keeping the previous cosmovisor: %w", err)
+	}
+	if err := fs.rename(staged, path); err != nil {
+		if rerr := fs.rename(previous, path); rerr != nil {
+			logger.Errorf("restoring the previous cosmovisor to %s: %v", path, rerr)
+		}
+		fs.remove(staged)
+		return nil, fmt.Errorf("installing the new cosmovisor: %w", err)
+	}
+
+	record := &SelfUpgradeRecord{Path: path, Previous: previous, FromVersion: Version, Version: newVersion, SHA256: hash,
+		Source: src, Upgrade: opts.Upgrade, InstalledAt: NowUTC()}
+	if err := cfg.writeStateFile(selfUpgradeFile, record); err != nil {
+		logger.Warnf("recording the cosmovisor upgrade: %v", err)
+	}
+	logger.Infof("installed cosmovisor %s (sha256 %s) to %s, the previous binary is kept as %s", newVersion, hash, path, previous)
+	ev := NewEvent(EventSelfUpgraded, opts.Upgrade, fmt.Sprintf("cosmovisor upgraded from %s to %s", Version, newVersion))
+	ev.Fields = map[string]string{"path": path, "version": newVersion, "sha256": hash}
+	notify(cfg, ev)
+	return record, nil
+}
+
+// unpackSelf copies the download to bin, or if it is an archive, unpacks it in dir and
+// takes the cosmovisor binary from it
+func unpackSelf(local, dir, bin string) error {
+	err := getWith(copyingGetters(), bin, local, getter.ClientModeFile)
+	if err == nil {
+		return nil
+	}
+	unpacked := filepath.Join(dir, "unpacked")
+	if err := getWith(copyingGetters(), unpacked, local, getter.ClientModeAny); err != nil {
+		return err
+	}
+	return locateBinary(unpacked, bin, "", "cosmovisor")
+}
+
+// probeSelfVersion runs the version command of a cosmovisor binary and returns the
+// version it reports. The environment of the node is left out, only the binary is checked.
+func probeSelfVersion(bin string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), selfUpgradeProbeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, bin, "version")
+	for _, kv := range environ() {
+		if !strings.HasPrefix(kv, "DAEMON_") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	// without a config, the command fails after printing the version of cosmovisor
+	out, err := cmd.CombinedOutput()
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if v := strings.TrimPrefix(scanner.Text(), "cosmovisor version: "); v != scanner.Text() {
+			return strings.TrimSpace(v), nil
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("the new cosmovisor doesn't run: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return "", fmt.Errorf("the new cosmovisor doesn't report its version: %s", strings.TrimSpace(string(out)))
+}
+
+// checkSelfVersion returns an error if the version of a new cosmovisor is older than required
+func checkSelfVersion(v, required string) error {
+	min, err := version.NewVersion(required)
+	if err != nil {
+		return fmt.Errorf("cosmovisor %q is required, which is not a valid version: %w", required, err)
+	}
+	got, err := version.NewVersion(v)
+	if err != nil {
+		return fmt.Errorf("the new cosmovisor reports version %q, which can't be compared to the required %s", v, required)
+	}
+	if got.LessThan(min) {
+		return fmt.Errorf("the new cosmovisor is %s, cosmovisor %s or newer is required", v, required)
+	}
+	return nil
+}
+
+// upgradeCosmovisor installs the cosmovisor binary the plan lists for the platform when
+// the upgrade failed for requiring a newer cosmovisor and SelfUpgrade is set. It returns a
+// *SelfUpgradedError once it is installed, for the new cosmovisor to apply the upgrade,
+// and err otherwise.
+func (cfg *Config) upgradeCosmovisor(err error) error {
+	var old *MinVersionError
+	if !cfg.SelfUpgrade || !errors.As(err, &old) {
+		return err
+	}
+	src, ok := old.Config.CosmovisorURL(OSArch())
+	if !ok {
+		logger.Warnf("upgrade %q requires cosmovisor %s, but its plan lists no cosmovisor binary for %s", old.Upgrade, old.Required, OSArch())
+		return err
+	}
+	record, serr := SelfUpgrade(cfg, SelfUpgradeOptions{Source: src, Required: old.Required, Upgrade: old.Upgrade})
+	if serr != nil {
+		return fmt.Errorf("%w, and installing it failed: %v", err, serr)
+	}
+	return &SelfUpgradedError{Record: record, Reason: fmt.Sprintf("upgrade %q requires it", old.Upgrade)}
+}
+
+// RecordedSelfUpgrade returns the last replacement of the cosmovisor binary, nil if there
+// was none
+func (cfg *Config) RecordedSelfUpgrade() (*SelfUpgradeRecord, error) {
+	var record SelfUpgradeRecord
+	if ok, err := cfg.readStateFile(selfUpgradeFile, &record); !ok {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// selfBinary is the cosmovisor binary as it was when the supervision started
+type selfBinary struct {
+	path string
+	info os.FileInfo
+}
+
+// runningSelf records the cosmovisor binary, nil if it can't be located
+func runningSelf() *selfBinary {
+	path, err := selfExecutable()
+	if err != nil {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	return &selfBinary{path: path, info: info}
+}
+
+// replaced returns a *SelfUpgradedError if `cosmovisor self-upgrade` replaced the binary
+// since the supervision started, so the new one takes over before the daemon is launched
+// again instead of on the next restart of the service
+func (s *selfBinary) replaced(cfg *Config) error {
+	if s == nil {
+		return nil
+	}
+	record, err := cfg.RecordedSelfUpgrade()
+	if err != nil || record == nil || record.Path != s.path {
+		return nil
+	}
+	if info, err := os.Stat(s.path); err != nil || os.SameFile(info, s.info) {
+		return nil
+	}
+	return &SelfUpgradedError{Record: record, Reason: "taking over before the daemon is launched again"}
+}
+
+// ExecSelf replaces the process by the cosmovisor binary at path, with args. On windows
+// it fails, the service manager is expected to start cosmovisor again.
+func ExecSelf(path string, args []string) error {
+	return execBinary(path, args, environ())
+}
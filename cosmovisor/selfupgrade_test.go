@@ -0,0 +1,102 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSelf installs a cosmovisor binary the tests replace instead of the test binary
+func fakeSelf(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "cosmovisor")
+	require.NoError(t, ioutil.WriteFile(path, []byte("#!/bin/sh\necho 'cosmovisor version: v0.1.0'\n"), 0755))
+	old := selfExecutable
+	selfExecutable = func() (string, error) { return path, nil }
+	t.Cleanup(func() { selfExecutable = old })
+	return path
+}
+
+// newSelfRelease writes a cosmovisor binary reporting version and returns its URL with
+// its checksum
+func newSelfRelease(t *testing.T, version string) string {
+	bz := []byte(fmt.Sprintf("#!/bin/sh\necho 'cosmovisor version: %s'\necho 'DAEMON_HOME not set' >&2\nexit 3\n", version))
+	path := filepath.Join(t.TempDir(), "cosmovisor-"+version)
+	require.NoError(t, ioutil.WriteFile(path, bz, 0644))
+	return fmt.Sprintf("%s?checksum=sha256:%x", path, sha256.Sum256(bz))
+}
+
+func TestSelfUpgrade(t *testing.T) {
+	path := fakeSelf(t)
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	release := newSelfRelease(t, "v0.3.0")
+
+	_, err := SelfUpgrade(cfg, SelfUpgradeOptions{Source: filepath.Join(t.TempDir(), "cosmovisor")})
+	require.True(t, errors.Is(err, errChecksumRequired), "%v", err)
+	_, err = SelfUpgrade(cfg, SelfUpgradeOptions{Source: release, Required: "v0.4.0"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "the new cosmovisor is v0.3.0, cosmovisor v0.4.0 or newer is required")
+	version, err := probeSelfVersion(path)
+	require.NoError(t, err)
+	require.Equal(t, "v0.1.0", version, "nothing was replaced")
+
+	record, err := SelfUpgrade(cfg, SelfUpgradeOptions{Source: release, Required: "v0.3.0"})
+	require.NoError(t, err)
+	require.Equal(t, "v0.3.0", record.Version)
+	require.Equal(t, path+previousSelfSuffix, record.Previous)
+	version, err = probeSelfVersion(path)
+	require.NoError(t, err)
+	require.Equal(t, "v0.3.0", version)
+	version, err = probeSelfVersion(record.Previous)
+	require.NoError(t, err)
+	require.Equal(t, "v0.1.0", version)
+	recorded, err := cfg.RecordedSelfUpgrade()
+	require.NoError(t, err)
+	require.Equal(t, record.SHA256, recorded.SHA256)
+}
+
+func TestUpgradeCosmovisor(t *testing.T) {
+	path := fakeSelf(t)
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	required := &MinVersionError{Upgrade: "chain2", Required: "v0.3.0", Err: errors.New("too old"),
+		Config: UpgradeConfig{CosmovisorBinaries: map[string]string{OSArch(): newSelfRelease(t, "v0.3.0")}}}
+
+	// the operator didn't ask for it
+	require.Equal(t, required, cfg.upgradeCosmovisor(required))
+
+	cfg.SelfUpgrade = true
+	var self *SelfUpgradedError
+	err := cfg.upgradeCosmovisor(fmt.Errorf("upgrading: %w", required))
+	require.True(t, errors.As(err, &self), "%v", err)
+	require.Equal(t, path, self.Record.Path)
+	require.Equal(t, "chain2", self.Record.Upgrade)
+
+	// a binary older than the plan requires isn't installed
+	required.Config.CosmovisorBinaries[OSArch()] = newSelfRelease(t, "v0.2.0")
+	err = cfg.upgradeCosmovisor(required)
+	require.False(t, errors.As(err, &self))
+	require.True(t, errors.Is(err, required))
+}
+
+func TestSelfReplaced(t *testing.T) {
+	fakeSelf(t)
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	self := runningSelf()
+	require.NotNil(t, self)
+	require.NoError(t, self.replaced(cfg))
+
+	_, err := SelfUpgrade(cfg, SelfUpgradeOptions{Source: newSelfRelease(t, "v0.3.0")})
+	require.NoError(t, err)
+	var replaced *SelfUpgradedError
+	require.True(t, errors.As(self.replaced(cfg), &replaced))
+	require.Equal(t, "v0.3.0", replaced.Record.Version)
+	// the new cosmovisor starts over
+	require.NoError(t, runningSelf().replaced(cfg))
+}
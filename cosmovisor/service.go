@@ -0,0 +1,151 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ServiceOptions are what a service definition needs beyond the config
+type ServiceOptions struct {
+	// Executable is the absolute path of cosmovisor
+	Executable string
+	// Args are passed on to the daemon, after `run`
+	Args []string
+	// User runs the service, root if empty
+	User string
+	// Env are the DAEMON_* variables as KEY=VALUE, DAEMON_HOME is added if missing
+	Env []string
+	// Watchdog is the systemd watchdog interval, off if zero
+	Watchdog time.Duration
+}
+
+// serviceEnv returns the variables of the service, sorted, with DAEMON_HOME
+func (cfg *Config) serviceEnv(env []string) []string {
+	vars := append([]string{}, env...)
+	hasHome := false
+	for _, kv := range vars {
+		hasHome = hasHome || strings.HasPrefix(kv, "DAEMON_HOME=")
+	}
+	if !hasHome {
+		vars = append(vars, "DAEMON_HOME="+cfg.Home)
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+// WriteSystemdUnit writes a systemd unit running cosmovisor with the config: Type=notify,
+// restarted by systemd when cosmovisor exits, except for an invalid configuration or
+// invocation which a restart can't fix.
+func WriteSystemdUnit(w io.Writer, cfg *Config, opts ServiceOptions) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=%s node supervised by cosmovisor\n", cfg.Name)
+	fmt.Fprintf(&b, "After=network-online.target\n")
+	fmt.Fprintf(&b, "Wants=network-online.target\n\n")
+
+	fmt.Fprintf(&b, "[Service]\n")
+	fmt.Fprintf(&b, "Type=notify\n")
+	fmt.Fprintf(&b, "NotifyAccess=main\n")
+	if opts.User != "" {
+		fmt.Fprintf(&b, "User=%s\n", opts.User)
+	}
+	for _, kv := range cfg.serviceEnv(opts.Env) {
+		fmt.Fprintf(&b, "Environment=%s\n", systemdQuote(kv))
+	}
+	// ExecStart also expands $VARIABLES
+	exec := []string{systemdQuote(strings.Replace(opts.Executable, "$", "$$", -1)), "run"}
+	for _, arg := range opts.Args {
+		exec = append(exec, systemdQuote(strings.Replace(arg, "$", "$$", -1)))
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(exec, " "))
+	if cfg.RestartAfterUpgrade {
+		fmt.Fprintf(&b, "Restart=on-failure\n")
+	} else {
+		fmt.Fprintf(&b, "# cosmovisor exits after an upgrade, systemd starts the new binary\n")
+		fmt.Fprintf(&b, "Restart=always\n")
+	}
+	fmt.Fprintf(&b, "RestartSec=3\n")
+	fmt.Fprintf(&b, "RestartPreventExitStatus=%d %d %d\n", ExitCodeUsage, ExitCodeHalted, ExitCodeConfig)
+	if opts.Watchdog > 0 {
+		fmt.Fprintf(&b, "WatchdogSec=%d\n", ceilSeconds(opts.Watchdog))
+	}
+	if cfg.TerminationGrace > 0 {
+		fmt.Fprintf(&b, "TimeoutStopSec=%d\n", ceilSeconds(cfg.TerminationGrace))
+	}
+	if cfg.wantsLimits() {
+		fmt.Fprintf(&b, "# cosmovisor launches the daemon in a cgroup of its own, with its limits\n")
+		fmt.Fprintf(&b, "Delegate=yes\n")
+	}
+	fmt.Fprintf(&b, "LimitNOFILE=65535\n")
+	fmt.Fprintf(&b, "StandardOutput=journal\n")
+	fmt.Fprintf(&b, "StandardError=journal\n")
+	fmt.Fprintf(&b, "SyslogIdentifier=%s\n\n", cfg.Name)
+
+	fmt.Fprintf(&b, "[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=multi-user.target\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ceilSeconds rounds d up to whole seconds, as service managers take them
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// systemdQuote quotes s for a unit file if needed, keeping % from being expanded
+func systemdQuote(s string) string {
+	s = strings.Replace(s, "%", "%%", -1)
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// WriteOpenRCScript writes an OpenRC init script running cosmovisor with the config under
+// supervise-daemon, which respawns it like the systemd unit does
+func WriteOpenRCScript(w io.Writer, cfg *Config, opts ServiceOptions) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/sbin/openrc-run\n\n")
+	fmt.Fprintf(&b, "description=%s\n", shellQuote(cfg.Name+" node supervised by cosmovisor"))
+	fmt.Fprintf(&b, "supervisor=supervise-daemon\n")
+	fmt.Fprintf(&b, "command=%s\n", shellQuote(opts.Executable))
+	args := []string{"run"}
+	for _, arg := range opts.Args {
+		args = append(args, shellQuote(arg))
+	}
+	fmt.Fprintf(&b, "command_args=%s\n", shellQuote(strings.Join(args, " ")))
+	if opts.User != "" {
+		fmt.Fprintf(&b, "command_user=%s\n", shellQuote(opts.User))
+	}
+	fmt.Fprintf(&b, "output_log=%s\n", shellQuote("/var/log/"+cfg.Name+".log"))
+	fmt.Fprintf(&b, "error_log=%s\n", shellQuote("/var/log/"+cfg.Name+".log"))
+	if !cfg.RestartAfterUpgrade {
+		fmt.Fprintf(&b, "# cosmovisor exits after an upgrade, supervise-daemon starts the new binary\n")
+	}
+	fmt.Fprintf(&b, "respawn_delay=3\n")
+	fmt.Fprintf(&b, "respawn_max=0\n")
+	if cfg.TerminationGrace > 0 {
+		fmt.Fprintf(&b, "retry=%s\n", shellQuote(fmt.Sprintf("TERM/%d/KILL/5", ceilSeconds(cfg.TerminationGrace))))
+	}
+	fmt.Fprintf(&b, "\n")
+	for _, kv := range cfg.serviceEnv(opts.Env) {
+		i := strings.IndexByte(kv, '=')
+		fmt.Fprintf(&b, "export %s=%s\n", kv[:i], shellQuote(kv[i+1:]))
+	}
+	fmt.Fprintf(&b, "\ndepend() {\n\tneed net\n}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// shellQuote quotes s for a POSIX shell if needed
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=@,+", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
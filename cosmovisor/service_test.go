@@ -0,0 +1,76 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSystemdUnit(t *testing.T) {
+	cfg := &Config{Home: "/home/node/.gaia", Name: "gaiad", RestartAfterUpgrade: true, TerminationGrace: 90 * time.Second}
+	opts := ServiceOptions{
+		Executable: "/usr/local/bin/cosmovisor",
+		Args:       []string{"start", "--moniker", "50% of $HOME"},
+		User:       "node",
+		Env:        []string{"DAEMON_NAME=gaiad", "DAEMON_HOME=/home/node/.gaia", "DAEMON_BACKUP_CMD=zfs snapshot tank/gaia@$DAEMON_UPGRADE"},
+		Watchdog:   1500 * time.Millisecond,
+	}
+	var b strings.Builder
+	require.NoError(t, WriteSystemdUnit(&b, cfg, opts))
+	unit := b.String()
+	for _, line := range []string{
+		"Type=notify\n",
+		"User=node\n",
+		`Environment="DAEMON_BACKUP_CMD=zfs snapshot tank/gaia@$DAEMON_UPGRADE"` + "\n" +
+			"Environment=DAEMON_HOME=/home/node/.gaia\nEnvironment=DAEMON_NAME=gaiad\n",
+		`ExecStart=/usr/local/bin/cosmovisor run start --moniker "50%% of $$HOME"` + "\n",
+		"Restart=on-failure\n",
+		"RestartPreventExitStatus=64 75 78\n",
+		"WatchdogSec=2\n",
+		"TimeoutStopSec=90\n",
+		"SyslogIdentifier=gaiad\n",
+	} {
+		require.Contains(t, unit, line)
+	}
+
+	cfg.RestartAfterUpgrade = false
+	b.Reset()
+	require.NoError(t, WriteSystemdUnit(&b, cfg, ServiceOptions{Executable: "/usr/local/bin/cosmovisor"}))
+	require.Contains(t, b.String(), "Restart=always\n")
+	require.Contains(t, b.String(), "Environment=DAEMON_HOME=/home/node/.gaia\n", "added if missing")
+	require.NotContains(t, b.String(), "WatchdogSec")
+	require.NotContains(t, b.String(), "Delegate")
+
+	cfg.MemoryLimit = 8 << 30
+	b.Reset()
+	require.NoError(t, WriteSystemdUnit(&b, cfg, ServiceOptions{Executable: "/usr/local/bin/cosmovisor"}))
+	require.Contains(t, b.String(), "Delegate=yes\n")
+}
+
+func TestWriteOpenRCScript(t *testing.T) {
+	cfg := &Config{Home: "/home/node/.gaia", Name: "gaiad", TerminationGrace: 30 * time.Second}
+	opts := ServiceOptions{
+		Executable: "/usr/local/bin/cosmovisor",
+		Args:       []string{"start", "--moniker", "bob's node"},
+		User:       "node",
+		Env:        []string{"DAEMON_NAME=gaiad"},
+	}
+	var b strings.Builder
+	require.NoError(t, WriteOpenRCScript(&b, cfg, opts))
+	script := b.String()
+	require.True(t, strings.HasPrefix(script, "#!/sbin/openrc-run\n"))
+	for _, line := range []string{
+		"command=/usr/local/bin/cosmovisor\n",
+		`command_args='run start --moniker '\''bob'\''\'\'''\''s node'\'''` + "\n",
+		"command_user=node\n",
+		"retry=TERM/30/KILL/5\n",
+		"export DAEMON_HOME=/home/node/.gaia\nexport DAEMON_NAME=gaiad\n",
+	} {
+		require.Contains(t, script, line)
+	}
+}
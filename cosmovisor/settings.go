@@ -0,0 +1,262 @@
+package cosmovisor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Setting is the value in effect for one environment variable read by GetConfigFromEnv
+type Setting struct {
+	Env   string `json:"env"`
+	Value string `json:"value"`
+	// Default is set if Value is what an unset variable amounts to
+	Default bool `json:"default"`
+}
+
+// Settings lists the environment variables of the config with the values in effect, so
+// an operator can see what the unset ones amount to
+func (cfg *Config) Settings() []Setting {
+	var settings []Setting
+	// def is nil for the required variables
+	add := func(env string, value, def interface{}) {
+		s := fmt.Sprint(value)
+		settings = append(settings, Setting{Env: env, Value: s, Default: def != nil && s == fmt.Sprint(def)})
+	}
+
+	add("DAEMON_HOME", cfg.Home, nil)
+	add("DAEMON_NAME", cfg.Name, nil)
+	add("DAEMON_ALLOW_DOWNLOAD_BINARIES", cfg.AllowDownloadBinaries, false)
+	add("DAEMON_DOWNLOAD_MUST_HAVE_CHECKSUM", cfg.DownloadMustHaveChecksum, false)
+	add("DAEMON_UNSAFE_SKIP_PLAN_CHECKSUM", cfg.UnsafeSkipPlanChecksum, false)
+	add("DAEMON_SELF_UPGRADE", cfg.SelfUpgrade, false)
+	pubkey := ""
+	if cfg.BinaryPubKey != nil {
+		pubkey = cfg.BinaryPubKey.String()
+	}
+	add("DAEMON_BINARY_PUBKEY", pubkey, "")
+	add("DAEMON_PLAN_PUBKEYS", cfg.planPubKeys(), "")
+	add("DAEMON_DOWNLOADER_CMD", cfg.DownloaderCommand, "")
+	add("DAEMON_DOWNLOAD_PROXY", orDefault(cfg.DownloadProxy, "from HTTP_PROXY and HTTPS_PROXY"), "from HTTP_PROXY and HTTPS_PROXY")
+	add("DAEMON_DOWNLOAD_CA_CERT", orDefault(cfg.DownloadCACert, "system roots"), "system roots")
+	add("DAEMON_DOWNLOAD_CLIENT_CERT", cfg.DownloadClientCert, "")
+	add("DAEMON_DOWNLOAD_CLIENT_KEY", cfg.DownloadClientKey, "")
+	add("DAEMON_UNSAFE_SKIP_TLS_VERIFY", cfg.UnsafeSkipTLSVerify, false)
+	add("DAEMON_IPFS_GATEWAY", cfg.ipfsGateway(), defaultIPFSGateway)
+	add("DAEMON_DOWNLOAD_ATTEMPTS", cfg.downloadAttempts(), defaultDownloadAttempts)
+	add("DAEMON_DOWNLOAD_BACKOFF", cfg.downloadBackoff(), defaultDownloadBackoff)
+	add("DAEMON_PREDOWNLOAD_API", cfg.PredownloadAPI, "")
+	add("DAEMON_PREDOWNLOAD_BLOCKS", cfg.predownloadBlocks(), defaultPredownloadBlocks)
+	add("DAEMON_PRE_UPGRADE_ACTIONS", cfg.PreUpgradeActions, "")
+	add("DAEMON_PLAN_API", cfg.PlanAPI, "")
+	add("DAEMON_LIVENESS_RPC", cfg.LivenessRPC, "")
+	add("DAEMON_LIVENESS_TIMEOUT", cfg.livenessTimeout(), defaultLivenessTimeout)
+	add("DAEMON_LIVENESS_MAX_RESTARTS", cfg.livenessMaxRestarts(), defaultLivenessMaxRestarts)
+	add("DAEMON_PEER_RPCS", strings.Join(cfg.PeerRPCs, ","), "")
+	add("DAEMON_PEER_LAG_BLOCKS", cfg.peerLagBlocks(), defaultPeerLagBlocks)
+	add("DAEMON_PEER_LAG_PERIOD", cfg.peerLagPeriod(), defaultPeerLagPeriod)
+	add("DAEMON_LEADER_ELECTION", cfg.leaderElectionRedacted(), "")
+	add("DAEMON_LEADER_ID", cfg.leaderID(), nil)
+	add("DAEMON_LEADER_TTL", cfg.leaderTTL(), defaultLeaderTTL)
+	add("DAEMON_RESTART_COORDINATION", cfg.restartCoordinationRedacted(), "")
+	add("DAEMON_RESTART_CONCURRENCY", cfg.restartConcurrency(), defaultRestartConcurrency)
+	add("DAEMON_RESTART_SETTLE", cfg.restartSettle(), defaultRestartSettle)
+
+	add("DAEMON_RESTART_AFTER_UPGRADE", cfg.RestartAfterUpgrade, false)
+	add("DAEMON_HALT_AFTER_UPGRADE", string(cfg.haltMode()), HaltNone)
+	add("DAEMON_RESTART_AFTER_FAILURE", cfg.RestartAfterFailure, false)
+	add("DAEMON_RESTART_DELAY", cfg.restartDelay(), defaultRestartDelay)
+	add("DAEMON_RESTART_MAX_ATTEMPTS", cfg.restartAttempts(), defaultRestartAttempts)
+	add("DAEMON_MEMORY_LIMIT", cfg.MemoryLimit/(1024*1024), int64(0))
+	add("DAEMON_CPU_LIMIT", cfg.CPULimit, float64(0))
+	add("DAEMON_MEMORY_RESTART", cfg.MemoryRestart/(1024*1024), int64(0))
+	add("DAEMON_RESTART_MAX_UPTIME", cfg.RestartMaxUptime, time.Duration(0))
+	add("DAEMON_RESTART_WINDOW", cfg.restartWindow(), "")
+	add("DAEMON_MAINTENANCE_WINDOW", cfg.maintenanceWindow(), "")
+	add("DAEMON_ROLLBACK", string(cfg.rollback()), RollbackOff)
+	add("DAEMON_ROLLBACK_WINDOW", cfg.rollbackWindow(), defaultRollbackWindow)
+	add("DAEMON_ROLLBACK_ATTEMPTS", cfg.rollbackAttempts(), defaultRollbackAttempts)
+	add("DAEMON_VERIFY_UPGRADE", cfg.VerifyUpgrade, false)
+	add("DAEMON_VERIFY_UPGRADE_TIMEOUT", cfg.verifyUpgradeTimeout(), defaultVerifyUpgradeTimeout)
+	add("DAEMON_HEALTH_GATE_BLOCKS", cfg.HealthGateBlocks, 0)
+	add("DAEMON_HEALTH_GATE_TIMEOUT", cfg.healthGateTimeout(), defaultHealthGateTimeout)
+	add("DAEMON_HEALTH_GATE_ON_FAILURE", string(cfg.healthGateOnFailure()), HealthGateAlert)
+	add("DAEMON_UPGRADE_DETECTION", orDefault(string(cfg.UpgradeDetection), string(DetectBoth)), DetectBoth)
+	add("DAEMON_UPGRADE_SOURCES", strings.Join(cfg.sourcePriority(), ","), strings.Join((&Config{}).sourcePriority(), ","))
+	add("DAEMON_UPGRADE_CONFLICT", cfg.upgradeConflict(), ConflictPriority)
+	add("DAEMON_POLL_INTERVAL", cfg.pollInterval(), defaultPollInterval)
+	add("DAEMON_POLL_JITTER", cfg.PollJitter, time.Duration(0))
+	add("DAEMON_LOG_BUFFER_SIZE", cfg.ScanBufferSize()/1024, bufio.MaxScanTokenSize/1024)
+
+	forward := "the signal cosmovisor received, or SIGTERM"
+	stop := forward
+	if cfg.StopSignal != 0 {
+		stop = signalName(cfg.StopSignal)
+	}
+	add("DAEMON_STOP_SIGNAL", stop, forward)
+	add("DAEMON_SHUTDOWN_GRACE", cfg.shutdownGrace(), defaultShutdownGrace)
+	grace := "unlimited"
+	if cfg.TerminationGrace > 0 {
+		grace = cfg.TerminationGrace.String()
+	}
+	add("DAEMON_TERMINATION_GRACE", grace, "unlimited")
+	margin := cfg.TerminationMargin
+	if margin <= 0 {
+		margin = defaultTerminationMargin
+	}
+	add("DAEMON_TERMINATION_GRACE_MARGIN", margin, defaultTerminationMargin)
+	add("DAEMON_TERMINATION_UPGRADE_POLICY", orDefault(string(cfg.TerminationUpgradePolicy), string(UpgradePolicySkip)), UpgradePolicySkip)
+	add("DAEMON_CHILD_ENV_ALLOW", orDefault(strings.Join(cfg.ChildEnvAllow, ","), "all"), "all")
+	reload := cfg.ReloadSignal
+	if reload == 0 {
+		reload = defaultReloadSignal
+	}
+	add("DAEMON_RELOAD_SIGNAL", signalName(reload), signalName(defaultReloadSignal))
+	pause := "none"
+	if cfg.PauseSignal != 0 {
+		pause = signalName(cfg.PauseSignal)
+	}
+	add("DAEMON_PAUSE_SIGNAL", pause, "none")
+	add("DAEMON_CRASH_CHILD_POLICY", orDefault(string(cfg.CrashChildPolicy), string(CrashChildStop)), CrashChildStop)
+	add(InitEnv, orDefault(string(cfg.Init), string(InitAuto)), InitAuto)
+
+	add("DAEMON_PRE_UPGRADE_EXPORT", cfg.PreUpgradeExport, false)
+	add("DAEMON_PRE_UPGRADE_EXPORT_COMMAND", orDefault(cfg.ExportCommand, DefaultExportCommand), DefaultExportCommand)
+	add("DAEMON_PRE_UPGRADE_EXPORT_TIMEOUT", cfg.exportTimeout(), defaultExportTimeout)
+	add("DAEMON_PRE_UPGRADE_EXPORT_POLICY", orDefault(string(cfg.ExportPolicy), string(ExportPolicyWarn)), ExportPolicyWarn)
+	add("DAEMON_PREFLIGHT", cfg.wantsPreflight(), false)
+	add("DAEMON_PREFLIGHT_TIMEOUT", cfg.preflightTimeout(), defaultPreflightTimeout)
+	add("DAEMON_PREFLIGHT_VERSION", cfg.PreflightVersion, "")
+	add("DAEMON_PREUPGRADE_MAX_RETRIES", cfg.PreUpgradeMaxRetries, 0)
+	add("DAEMON_DATA_BACKUP", string(cfg.dataBackup()), DataBackupNone)
+	add("DAEMON_DATA_BACKUP_NAME", cfg.dataBackupName(), defaultDataBackupName)
+	add("DAEMON_DATA_BACKUP_DIR", cfg.dataBackupDir(), filepath.Join(cfg.StateDir(), backupsDir))
+	add("DAEMON_DATA_BACKUP_DEST", cfg.DataBackupDest, "")
+	add("DAEMON_DATA_BACKUP_SNAPSHOT_CMD", cfg.DataBackupSnapshotCommand, "")
+	add("DAEMON_DATA_BACKUP_EXCLUDE", strings.Join(cfg.DataBackupExclude, ","), "")
+	add("DAEMON_DATA_BACKUP_SPACE_CHECK", string(cfg.spaceCheck()), SpaceCheckAbort)
+	keep := "all"
+	if cfg.BackupKeepRecent > 0 {
+		keep = strconv.Itoa(cfg.BackupKeepRecent)
+	}
+	add("DAEMON_BACKUP_KEEP_RECENT", keep, "all")
+	maxAge := "unlimited"
+	if cfg.BackupMaxAge > 0 {
+		maxAge = cfg.BackupMaxAge.String()
+	}
+	add("DAEMON_BACKUP_MAX_AGE", maxAge, "unlimited")
+	keepUpgrades := "all"
+	if cfg.UpgradesKeepRecent > 0 {
+		keepUpgrades = strconv.Itoa(cfg.UpgradesKeepRecent)
+	}
+	add("DAEMON_UPGRADES_KEEP_RECENT", keepUpgrades, "all")
+	add("DAEMON_BACKUP_CMD", cfg.BackupCommand, "")
+	add("DAEMON_BACKUP_BACKENDS", orDefault(strings.Join(cfg.BackupBackends, ","), defaultBackupBackends), defaultBackupBackends)
+	add("DAEMON_BACKUP_SCHEDULE", cfg.BackupSchedule.String(), "")
+	add("DAEMON_POST_UPGRADE_HOOK", cfg.PostUpgradeHook, "")
+	add("DAEMON_POST_UPGRADE_HOOK_TIMEOUT", cfg.postUpgradeHookTimeout(), defaultPostUpgradeHookTimeout)
+	add("DAEMON_SIGNER_PAUSE_CMD", cfg.SignerPauseCommand, "")
+	add("DAEMON_SIGNER_RESUME_CMD", cfg.SignerResumeCommand, "")
+	add("DAEMON_SIGNER_TIMEOUT", cfg.signerTimeout(), defaultSignerTimeout)
+
+	add("DAEMON_INJECT_HOME", cfg.InjectHome, false)
+	add("DAEMON_STRICT_HEIGHT_CHECK", cfg.StrictHeightCheck, false)
+	add("DAEMON_VALIDATOR_STATE_CHECK", cfg.ValidatorStateCheck, false)
+	add("DAEMON_SKIP_UPGRADES", cfg.SkipUpgrades.String(), "")
+	add("DAEMON_RUN_AS", cfg.RunAs, "")
+	add("DAEMON_DROP_PRIVILEGES", cfg.DropPrivileges, false)
+	add("DAEMON_WRITABLE_ROOT", orDefault(cfg.WritableRoot, cfg.Home), cfg.Home)
+	defaultState := *cfg
+	defaultState.StatePath = ""
+	add("DAEMON_STATE_DIR", cfg.StateDir(), defaultState.StateDir())
+	add("DAEMON_TMP_DIR", cfg.tmpPath(), filepath.Join(cfg.StateDir(), tmpDirName))
+	add("DAEMON_DOWNLOAD_STAGING_DIR", cfg.stagingPath(), cfg.tmpPath())
+	add("DAEMON_EXTRA_ARGS", strings.Join(cfg.ExtraArgs, " "), "")
+	add("DAEMON_SUPERVISED_COMMANDS", strings.Join(cfg.supervisedCommands(), ","), strings.Join(defaultSupervisedCommands, ","))
+	add("DAEMON_WORK_DIR", cfg.workDir(), cfg.Home)
+	add("DAEMON_GENESIS_DIR", cfg.genesisPath(), filepath.Join(cfg.Root(), genesisDir))
+	add("DAEMON_UPGRADES_DIR", cfg.upgradesPath(), filepath.Join(cfg.Root(), upgradesDir))
+	add("DAEMON_CURRENT_LINK", cfg.currentPath(), filepath.Join(cfg.Root(), currentLink))
+	add("DAEMON_NOTIFY_WEBHOOK", cfg.NotifyWebhook, "")
+	interval := cfg.NotifyInterval
+	if interval <= 0 {
+		interval = defaultNotifyInterval
+	}
+	add("DAEMON_NOTIFY_INTERVAL", interval, defaultNotifyInterval)
+	add("DAEMON_NOTIFY_SMTP", redactURL(cfg.NotifySMTP), "")
+	add("DAEMON_NOTIFY_EMAIL_FROM", cfg.NotifyEmailFrom, "")
+	add("DAEMON_NOTIFY_EMAIL_TO", strings.Join(cfg.NotifyEmailTo, ","), "")
+	add("DAEMON_NOTIFY_EMAIL_EVENTS", orDefault(strings.Join(cfg.NotifyEmailEvents, ","), "all"), "all")
+	add("DAEMON_NOTIFY_EMAIL_SUBJECT", orDefault(cfg.NotifyEmailSubject, defaultEmailSubject), defaultEmailSubject)
+	add("DAEMON_NOTIFY_EMAIL_TEMPLATE", cfg.NotifyEmailTemplate, "")
+	add("DAEMON_OUTPUT_PREFIX", cfg.OutputPrefix, false)
+	add("DAEMON_OUTPUT_FILE", cfg.OutputFile, "")
+	add("DAEMON_OUTPUT_DIR", cfg.OutputDir, "")
+	rotateSize, rotateInterval := "never", "never"
+	if cfg.OutputRotateSize > 0 {
+		rotateSize = strconv.FormatInt(cfg.OutputRotateSize/(1024*1024), 10)
+	}
+	if cfg.OutputRotateInterval > 0 {
+		rotateInterval = cfg.OutputRotateInterval.String()
+	}
+	add("DAEMON_OUTPUT_ROTATE_SIZE", rotateSize, "never")
+	add("DAEMON_OUTPUT_ROTATE_INTERVAL", rotateInterval, "never")
+	keepOutput, outputMaxAge := "all", "unlimited"
+	if cfg.OutputKeepRecent > 0 {
+		keepOutput = strconv.Itoa(cfg.OutputKeepRecent)
+	}
+	if cfg.OutputMaxAge > 0 {
+		outputMaxAge = cfg.OutputMaxAge.String()
+	}
+	add("DAEMON_OUTPUT_KEEP_RECENT", keepOutput, "all")
+	add("DAEMON_OUTPUT_MAX_AGE", outputMaxAge, "unlimited")
+	add("DAEMON_OUTPUT_COMPRESS", cfg.OutputCompress, false)
+	add("DAEMON_METRICS_ADDR", cfg.MetricsAddr, "")
+	add("DAEMON_METRICS_PUSH_URL", cfg.MetricsPushURL, "")
+	add("DAEMON_METRICS_PUSH_INTERVAL", cfg.metricsPushInterval(), defaultMetricsPushInterval)
+	// the default is the host name
+	add("DAEMON_METRICS_PUSH_INSTANCE", cfg.metricsPushInstance(), (&Config{}).metricsPushInstance())
+	add("DAEMON_HEALTH_ADDR", cfg.HealthAddr, "")
+	add("DAEMON_ADMIN_SOCKET", cfg.AdminSocket, "")
+	add("DAEMON_LOG_LEVEL", orDefault(string(cfg.LogLevel), string(LogInfo)), string(LogInfo))
+	add("DAEMON_LOG_FORMAT", orDefault(string(cfg.LogFormat), string(LogText)), string(LogText))
+	return settings
+}
+
+// WriteSettings prints the settings as aligned columns, marking the defaults
+func WriteSettings(w io.Writer, settings []Setting) error {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	for _, s := range settings {
+		mark := ""
+		if s.Default {
+			mark = "(default)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Env, s.Value, mark)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	// lines without a mark keep the padding of the value column
+	lines := bufio.NewScanner(&buf)
+	for lines.Scan() {
+		if _, err := fmt.Fprintln(w, strings.TrimRight(lines.Text(), " ")); err != nil {
+			return err
+		}
+	}
+	return lines.Err()
+}
+
+// orDefault returns value, or def if value is empty
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,61 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSettings(t *testing.T) {
+	cases := map[string]struct {
+		cfg       Config
+		env       string
+		value     string
+		isDefault bool
+	}{
+		"required":         {cfg: Config{Home: "/home/node"}, env: "DAEMON_HOME", value: "/home/node"},
+		"unset duration":   {env: "DAEMON_RESTART_DELAY", value: "1s", isDefault: true},
+		"set duration":     {cfg: Config{RestartDelay: 3 * time.Second}, env: "DAEMON_RESTART_DELAY", value: "3s"},
+		"set to default":   {cfg: Config{DownloadAttempts: 3}, env: "DAEMON_DOWNLOAD_ATTEMPTS", value: "3", isDefault: true},
+		"unset policy":     {env: "DAEMON_PRE_UPGRADE_EXPORT_POLICY", value: "warn", isDefault: true},
+		"set policy":       {cfg: Config{ExportPolicy: ExportPolicyAbort}, env: "DAEMON_PRE_UPGRADE_EXPORT_POLICY", value: "abort"},
+		"unset signal":     {env: "DAEMON_STOP_SIGNAL", value: "the signal cosmovisor received, or SIGTERM", isDefault: true},
+		"set signal":       {cfg: Config{StopSignal: syscall.SIGINT}, env: "DAEMON_STOP_SIGNAL", value: "SIGINT"},
+		"unlimited grace":  {env: "DAEMON_TERMINATION_GRACE", value: "unlimited", isDefault: true},
+		"writable root":    {cfg: Config{Home: "/home/node"}, env: "DAEMON_WRITABLE_ROOT", value: "/home/node", isDefault: true},
+		"state dir":        {cfg: Config{Home: "/home/node", StatePath: "/var/lib/node"}, env: "DAEMON_STATE_DIR", value: "/var/lib/node"},
+		"tmp dir":          {cfg: Config{Home: "/home/node", StatePath: "/var/lib/node"}, env: "DAEMON_TMP_DIR", value: "/var/lib/node/tmp", isDefault: true},
+		"data backup dir":  {cfg: Config{Home: "/home/node"}, env: "DAEMON_DATA_BACKUP_DIR", value: "/home/node/cosmovisor/backups", isDefault: true},
+		"detection":        {env: "DAEMON_UPGRADE_DETECTION", value: "both", isDefault: true},
+		"poll interval":    {cfg: Config{PollInterval: 2 * time.Second}, env: "DAEMON_POLL_INTERVAL", value: "2s"},
+		"unset jitter":     {env: "DAEMON_POLL_JITTER", value: "0s", isDefault: true},
+		"log buffer in KB": {cfg: Config{LogBufferSize: 256 * 1024}, env: "DAEMON_LOG_BUFFER_SIZE", value: "256"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			for _, s := range tc.cfg.Settings() {
+				if s.Env == tc.env {
+					require.Equal(t, Setting{Env: tc.env, Value: tc.value, Default: tc.isDefault}, s)
+					return
+				}
+			}
+			t.Fatalf("%s is not listed", tc.env)
+		})
+	}
+}
+
+func TestWriteSettings(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteSettings(&buf, []Setting{
+		{Env: "DAEMON_NAME", Value: "gaiad"},
+		{Env: "DAEMON_RESTART_DELAY", Value: "1s", Default: true},
+	}))
+	require.Equal(t, "DAEMON_NAME           gaiad\nDAEMON_RESTART_DELAY  1s     (default)\n", buf.String())
+	for _, line := range strings.Split(buf.String(), "\n") {
+		require.Equal(t, strings.TrimRight(line, " "), line)
+	}
+}
@@ -0,0 +1,107 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// SetupOptions are the choices of `cosmovisor setup` for a fresh host
+type SetupOptions struct {
+	// Genesis is the path of the genesis binary
+	Genesis string
+	// AllowDownloadBinaries lets cosmovisor download the binaries of the upgrades
+	AllowDownloadBinaries bool
+	// DataBackup is the data backup taken before the upgrades, none if empty
+	DataBackup string
+	// DataBackupDir holds the data backups, the backups directory of the state if empty
+	DataBackupDir string
+	// Unit is the path the systemd unit is written to, none is written if empty
+	Unit string
+	// Service are the options of the systemd unit, Env is left to the config file
+	Service ServiceOptions
+}
+
+// Setup takes a fresh host to a supervised node: it writes the config file with the name
+// and the choices of opts, creates the cosmovisor directory with the genesis binary, see
+// InitLayout, and writes the systemd unit. The choices are checked before anything is
+// written. Running it again with the same choices changes nothing, a config file or a unit
+// that differ already are an error rather than replaced.
+func Setup(cfg *Config, opts SetupOptions) error {
+	if err := cfg.validateNames(); err != nil {
+		return err
+	}
+	backup, err := parseDataBackup(opts.DataBackup)
+	if err != nil {
+		return fmt.Errorf("invalid data backup: %w", err)
+	}
+	if opts.DataBackupDir != "" && !filepath.IsAbs(opts.DataBackupDir) {
+		return errors.New("the data backup directory must be an absolute path")
+	}
+	if opts.DataBackupDir != "" && insideDir(cfg.DataDir(), opts.DataBackupDir) {
+		return errors.New("the data backup directory must not be inside the data directory")
+	}
+	if opts.Unit != "" && !filepath.IsAbs(opts.Unit) {
+		return errors.New("the path of the systemd unit must be absolute")
+	}
+	if opts.Unit != "" && opts.Service.Executable == "" {
+		return errors.New("the systemd unit needs the path of cosmovisor")
+	}
+
+	var file bytes.Buffer
+	fmt.Fprintf(&file, "%s = %s\n", configKey("DAEMON_NAME"), strconv.Quote(cfg.Name))
+	fmt.Fprintf(&file, "%s = %t\n", configKey("DAEMON_ALLOW_DOWNLOAD_BINARIES"), opts.AllowDownloadBinaries)
+	if backup != DataBackupNone {
+		fmt.Fprintf(&file, "%s = %s\n", configKey("DAEMON_DATA_BACKUP"), strconv.Quote(string(backup)))
+	}
+	if opts.DataBackupDir != "" {
+		fmt.Fprintf(&file, "%s = %s\n", configKey("DAEMON_DATA_BACKUP_DIR"), strconv.Quote(opts.DataBackupDir))
+	}
+	if err := writeSetupFile(cfg.fs(), cfg.ConfigFile(), file.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if err := InitLayout(cfg, opts.Genesis); err != nil {
+		return err
+	}
+
+	if opts.Unit == "" {
+		return nil
+	}
+	var unit bytes.Buffer
+	if err := WriteSystemdUnit(&unit, cfg, opts.Service); err != nil {
+		return err
+	}
+	return writeSetupFile(cfg.fs(), opts.Unit, unit.Bytes(), 0644)
+}
+
+// writeSetupFile writes bz to path unless it holds bz already. A path holding something
+// else is an error, the file has to be removed to set up again.
+func writeSetupFile(fs fsGuard, path string, bz []byte, perm os.FileMode) error {
+	existing, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil && bytes.Equal(existing, bz):
+		logger.Debugf("%s is in place already", path)
+		return nil
+	case err == nil:
+		return fmt.Errorf("%s exists already and differs from the setup, remove it to set up again", path)
+	case !os.IsNotExist(err):
+		return err
+	}
+	if err := fs.mkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := fs.writeFile(path+".tmp", bz, perm); err != nil {
+		fs.remove(path + ".tmp")
+		return err
+	}
+	if err := fs.rename(path+".tmp", path); err != nil {
+		return err
+	}
+	logger.Infof("wrote %s", path)
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetup(t *testing.T) {
+	genesis := filepath.Join(t.TempDir(), "dummyd")
+	require.NoError(t, ioutil.WriteFile(genesis, []byte("#!/bin/sh\necho dummyd $@\n"), 0755))
+	backups := t.TempDir()
+
+	cases := map[string]struct {
+		opts SetupOptions
+		file string
+		err  string
+	}{
+		"defaults": {opts: SetupOptions{Genesis: genesis}, file: "name = \"dummyd\"\nallow_download_binaries = false\n"},
+		"downloads and backups": {opts: SetupOptions{Genesis: genesis, AllowDownloadBinaries: true, DataBackup: "archive", DataBackupDir: backups},
+			file: "name = \"dummyd\"\nallow_download_binaries = true\ndata_backup = \"archive\"\ndata_backup_dir = \"" + backups + "\"\n"},
+		"unknown backup":      {opts: SetupOptions{Genesis: genesis, DataBackup: "tape"}, err: `unknown data backup "tape"`},
+		"relative backup dir": {opts: SetupOptions{Genesis: genesis, DataBackupDir: "backups"}, err: "must be an absolute path"},
+		"missing binary":      {opts: SetupOptions{Genesis: genesis + "-missing"}, err: "cannot read the genesis binary"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+			err := Setup(cfg, tc.opts)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				require.NoFileExists(t, cfg.GenesisBin())
+				return
+			}
+			require.NoError(t, err)
+			bz, err := ioutil.ReadFile(cfg.ConfigFile())
+			require.NoError(t, err)
+			require.Equal(t, tc.file, string(bz))
+			file, err := readConfigFile(cfg.ConfigFile())
+			require.NoError(t, err)
+			require.Equal(t, "dummyd", file.settings["DAEMON_NAME"])
+			current, err := cfg.CurrentBin()
+			require.NoError(t, err)
+			require.Equal(t, cfg.GenesisBin(), current)
+		})
+	}
+}
+
+func TestSetupUnit(t *testing.T) {
+	genesis := filepath.Join(t.TempDir(), "dummyd")
+	require.NoError(t, ioutil.WriteFile(genesis, []byte("#!/bin/sh\necho dummyd $@\n"), 0755))
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	unit := filepath.Join(t.TempDir(), "system", "dummyd.service")
+	opts := SetupOptions{Genesis: genesis, Unit: unit,
+		Service: ServiceOptions{Executable: "/usr/local/bin/cosmovisor", Args: []string{"start"}, User: "node"}}
+	require.NoError(t, Setup(cfg, opts))
+	bz, err := ioutil.ReadFile(unit)
+	require.NoError(t, err)
+	require.Contains(t, string(bz), "User=node\n")
+	require.Contains(t, string(bz), "DAEMON_HOME="+cfg.Home)
+	require.Contains(t, string(bz), "/usr/local/bin/cosmovisor run start")
+
+	// setting up again with the same choices changes nothing, other choices are refused
+	require.NoError(t, Setup(cfg, opts))
+	opts.AllowDownloadBinaries = true
+	err = Setup(cfg, opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exists already and differs from the setup")
+	require.NoError(t, os.Remove(cfg.ConfigFile()))
+	opts.Service.User = "validator"
+	err = Setup(cfg, opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), unit+" exists already")
+
+	opts.Unit = "dummyd.service"
+	require.EqualError(t, Setup(cfg, opts), "the path of the systemd unit must be absolute")
+}
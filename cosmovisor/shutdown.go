@@ -0,0 +1,187 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// UpgradePolicy decides what happens to in-flight upgrade work when the termination
+// budget is too small to cover both the child's shutdown and the upgrade itself
+type UpgradePolicy string
+
+const (
+	// UpgradePolicySkip gives the whole budget to the child and leaves the upgrade to be
+	// applied on the next start (the old binary will halt at the same height again)
+	UpgradePolicySkip UpgradePolicy = "skip"
+	// UpgradePolicyTruncate truncates the window the child gets to shut down, so that more
+	// of the budget is left for the upgrade
+	UpgradePolicyTruncate UpgradePolicy = "truncate"
+
+	// defaultTerminationMargin is kept back for upgrade work if no margin is configured
+	defaultTerminationMargin = 5 * time.Second
+	// minTruncatedChildWindow is the window a child truncated by UpgradePolicyTruncate still
+	// gets to flush its state, at most half of the budget
+	minTruncatedChildWindow = 2 * time.Second
+	// defaultShutdownGrace is how long the daemon gets to exit for an upgrade before SIGKILL
+	defaultShutdownGrace = 10 * time.Second
+)
+
+// ShutdownBudget is the outcome of splitting the orchestrator's termination grace period
+// between the child process and cosmovisor's own upgrade work
+type ShutdownBudget struct {
+	// ChildWindow is the time between sending the stop signal and SIGKILL.
+	// Zero means no escalation to SIGKILL, the child is given unlimited time.
+	ChildWindow time.Duration
+	// Reserved is what is left of the budget after the child's window, for the upgrade work.
+	// The upgrade isn't bounded by it: if it takes longer, the orchestrator kills cosmovisor
+	// halfway and the next start resumes the upgrade from its journal.
+	Reserved time.Duration
+	// SkipUpgrade is true if an in-flight upgrade must not be applied before exiting
+	SkipUpgrade bool
+}
+
+// String prints the budget in a form suitable for the shutdown log line
+func (b ShutdownBudget) String() string {
+	if b.ChildWindow == 0 {
+		return "child window: unlimited"
+	}
+	return fmt.Sprintf("child window: %s, left for upgrade: %s, skip upgrade: %t", b.ChildWindow, b.Reserved, b.SkipUpgrade)
+}
+
+// ShutdownBudget computes how much of the termination grace period the child gets.
+// If no grace period is configured, the child is never killed by cosmovisor.
+// If an upgrade is in flight, the margin is kept back for it, unless that would leave
+// the child without any time, in which case the UpgradePolicy decides: skip gives the child
+// the whole budget, truncate gives it minTruncatedChildWindow and the upgrade the rest.
+func (cfg *Config) ShutdownBudget(upgradeInFlight bool) ShutdownBudget {
+	grace := cfg.TerminationGrace
+	if grace <= 0 {
+		return ShutdownBudget{}
+	}
+	if !upgradeInFlight {
+		return ShutdownBudget{ChildWindow: grace}
+	}
+
+	margin := cfg.terminationMargin()
+	if margin < grace {
+		return ShutdownBudget{ChildWindow: grace - margin, Reserved: margin}
+	}
+
+	// the budget is clearly too small to stop the child and do the upgrade work
+	if cfg.TerminationUpgradePolicy == UpgradePolicyTruncate {
+		// the child still gets the time to flush its databases, a node killed right away
+		// may have to replay blocks or worse
+		child := minTruncatedChildWindow
+		if child > grace/2 {
+			child = grace / 2
+		}
+		return ShutdownBudget{ChildWindow: child, Reserved: grace - child}
+	}
+	return ShutdownBudget{ChildWindow: grace, SkipUpgrade: true}
+}
+
+// terminationMargin is the part of the termination grace period kept back for upgrade work
+func (cfg *Config) terminationMargin() time.Duration {
+	if cfg.TerminationMargin <= 0 {
+		return defaultTerminationMargin
+	}
+	return cfg.TerminationMargin
+}
+
+// parseGraceDuration accepts either a go duration ("30s") or a plain number of seconds,
+// which is what the kubernetes downward API and terminationGracePeriodSeconds provide
+func parseGraceDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if secs, err := strconv.Atoi(s); err == nil {
+		if secs < 0 {
+			return 0, fmt.Errorf("negative duration %q", s)
+		}
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %q", s)
+	}
+	return d, nil
+}
+
+// readGraceFile reads the termination grace period from a file, e.g. an annotation the
+// kubernetes downward API projects into the pod, in the format of parseGraceDuration
+func readGraceFile(path string) (time.Duration, error) {
+	bz, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return parseGraceDuration(string(bz))
+}
+
+// parseUpgradePolicy validates the value of DAEMON_TERMINATION_UPGRADE_POLICY
+func parseUpgradePolicy(s string) (UpgradePolicy, error) {
+	switch p := UpgradePolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return UpgradePolicySkip, nil
+	case UpgradePolicySkip, UpgradePolicyTruncate:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown upgrade policy %q, must be %s or %s", s, UpgradePolicySkip, UpgradePolicyTruncate)
+	}
+}
+
+// parseStopSignal validates the value of DAEMON_STOP_SIGNAL. Zero means the default: the
+// daemon gets SIGTERM, or the signal cosmovisor received when it is stopped itself.
+func parseStopSignal(s string) (syscall.Signal, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	sig, err := parseSignal(s)
+	if err != nil {
+		return 0, err
+	}
+	switch sig {
+	case syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT:
+		return sig, nil
+	}
+	return 0, fmt.Errorf("%s can't be used to stop the daemon, must be SIGTERM, SIGINT or SIGQUIT", signalName(sig))
+}
+
+// stopSignal is the signal asking the daemon to exit
+func (cfg *Config) stopSignal() syscall.Signal {
+	if cfg == nil || cfg.StopSignal == 0 {
+		return syscall.SIGTERM
+	}
+	return cfg.StopSignal
+}
+
+// shutdownGrace is the time between the stop signal and SIGKILL when stopping the daemon for an upgrade
+func (cfg *Config) shutdownGrace() time.Duration {
+	if cfg == nil || cfg.ShutdownGrace <= 0 {
+		return defaultShutdownGrace
+	}
+	return cfg.ShutdownGrace
+}
+
+// stopForUpgrade sends the stop signal to the daemon that reached an upgrade, so it can
+// flush its databases and priv_validator_state.json, and kills it if it is still running
+// after the shutdown grace period
+func (cfg *Config) stopForUpgrade(cmd *exec.Cmd) {
+	sig := cfg.stopSignal()
+	if err := signalProcess(cmd.Process, sig); err != nil {
+		_ = cmd.Process.Kill()
+		return
+	}
+	grace := cfg.shutdownGrace()
+	time.AfterFunc(grace, func() {
+		// fails if the daemon is gone already
+		if err := cmd.Process.Kill(); err == nil {
+			logger.Warnf("daemon didn't exit within %s of %s, killed it", grace, signalName(sig))
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package cosmovisor
+
+import (
+	"bufio"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownUpgradeDetectedLate(t *testing.T) {
+	start := func(t *testing.T, cfg *Config) (*shutdownState, *exec.Cmd) {
+		// the child ignores the stop signal, only SIGKILL ends it
+		cmd := exec.Command("sh", "-c", "trap '' TERM; echo ready; exec sleep 30")
+		out, err := cmd.StdoutPipe()
+		require.NoError(t, err)
+		require.NoError(t, cmd.Start())
+		t.Cleanup(func() { _ = cmd.Process.Kill() })
+		_, err = bufio.NewReader(out).ReadString('\n')
+		require.NoError(t, err)
+		s := &shutdownState{cfg: cfg}
+		s.begin(cfg, cmd, "test", syscall.SIGTERM)
+		return s, cmd
+	}
+
+	// the margin is taken from the child's share once the upgrade is known
+	cfg := &Config{TerminationGrace: 10 * time.Second, TerminationMargin: 9 * time.Second}
+	s, cmd := start(t, cfg)
+	sw := StartStopwatch()
+	s.markUpgrading(&UpgradeInfo{Name: "chain2"})
+	require.False(t, s.shouldSkipUpgrade())
+	require.Error(t, cmd.Wait())
+	require.Less(t, int64(sw.Elapsed()), int64(5*time.Second), "killed at the end of the child's new share")
+	require.Greater(t, int64(sw.Elapsed()), int64(500*time.Millisecond), "the child wasn't stopped by the signal")
+
+	// a budget without room for the upgrade skips it
+	cfg = &Config{TerminationGrace: 3 * time.Second}
+	s, _ = start(t, cfg)
+	require.False(t, s.shouldSkipUpgrade())
+	s.markUpgrading(&UpgradeInfo{Name: "chain2"})
+	require.True(t, s.shouldSkipUpgrade())
+}
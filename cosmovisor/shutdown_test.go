@@ -0,0 +1,159 @@
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownBudget(t *testing.T) {
+	cases := map[string]struct {
+		cfg       Config
+		upgrading bool
+		expect    ShutdownBudget
+	}{
+		"no grace configured": {
+			cfg:       Config{},
+			upgrading: true,
+			expect:    ShutdownBudget{},
+		},
+		"no upgrade in flight": {
+			cfg:    Config{TerminationGrace: 30 * time.Second, TerminationMargin: 10 * time.Second},
+			expect: ShutdownBudget{ChildWindow: 30 * time.Second},
+		},
+		"upgrade in flight with default margin": {
+			cfg:       Config{TerminationGrace: 30 * time.Second},
+			upgrading: true,
+			expect:    ShutdownBudget{ChildWindow: 25 * time.Second, Reserved: 5 * time.Second},
+		},
+		"upgrade in flight with custom margin": {
+			cfg:       Config{TerminationGrace: time.Minute, TerminationMargin: 20 * time.Second},
+			upgrading: true,
+			expect:    ShutdownBudget{ChildWindow: 40 * time.Second, Reserved: 20 * time.Second},
+		},
+		"budget too small skips upgrade": {
+			cfg:       Config{TerminationGrace: 5 * time.Second, TerminationMargin: 10 * time.Second},
+			upgrading: true,
+			expect:    ShutdownBudget{ChildWindow: 5 * time.Second, SkipUpgrade: true},
+		},
+		"budget too small truncates child": {
+			cfg: Config{
+				TerminationGrace:         5 * time.Second,
+				TerminationMargin:        10 * time.Second,
+				TerminationUpgradePolicy: UpgradePolicyTruncate,
+			},
+			upgrading: true,
+			expect:    ShutdownBudget{ChildWindow: 2 * time.Second, Reserved: 3 * time.Second},
+		},
+		"tiny budget truncates child to half": {
+			cfg: Config{
+				TerminationGrace:         time.Second,
+				TerminationUpgradePolicy: UpgradePolicyTruncate,
+			},
+			upgrading: true,
+			expect:    ShutdownBudget{ChildWindow: 500 * time.Millisecond, Reserved: 500 * time.Millisecond},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.expect, tc.cfg.ShutdownBudget(tc.upgrading))
+		})
+	}
+}
+
+func TestParseGraceDuration(t *testing.T) {
+	cases := map[string]struct {
+		input  string
+		expect time.Duration
+		isErr  bool
+	}{
+		"seconds":        {input: "30", expect: 30 * time.Second},
+		"duration":       {input: "1m30s", expect: 90 * time.Second},
+		"whitespace":     {input: " 10s ", expect: 10 * time.Second},
+		"negative":       {input: "-5", isErr: true},
+		"negative dur":   {input: "-5s", isErr: true},
+		"invalid string": {input: "soon", isErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			d, err := parseGraceDuration(tc.input)
+			if tc.isErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, d)
+		})
+	}
+}
+
+func TestTerminationGraceFile(t *testing.T) {
+	setenv(t, "DAEMON_HOME", validateHome(t))
+	setenv(t, "DAEMON_NAME", "dummyd")
+	file := filepath.Join(t.TempDir(), "grace")
+	require.NoError(t, ioutil.WriteFile(file, []byte("45\n"), 0644))
+	setenv(t, "DAEMON_TERMINATION_GRACE_FILE", file)
+	cfg, errs := configFromEnv()
+	require.Empty(t, errs)
+	require.Equal(t, 45*time.Second, cfg.TerminationGrace)
+
+	// the variable wins over the file
+	setenv(t, "DAEMON_TERMINATION_GRACE", "30s")
+	cfg, errs = configFromEnv()
+	require.Empty(t, errs)
+	require.Equal(t, 30*time.Second, cfg.TerminationGrace)
+
+	setenv(t, "DAEMON_TERMINATION_GRACE", "")
+	setenv(t, "DAEMON_TERMINATION_GRACE_FILE", filepath.Join(t.TempDir(), "missing"))
+	_, errs = configFromEnv()
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].Error(), "invalid DAEMON_TERMINATION_GRACE_FILE")
+}
+
+func TestParseUpgradePolicy(t *testing.T) {
+	p, err := parseUpgradePolicy("")
+	require.NoError(t, err)
+	require.Equal(t, UpgradePolicySkip, p)
+
+	p, err = parseUpgradePolicy("Truncate")
+	require.NoError(t, err)
+	require.Equal(t, UpgradePolicyTruncate, p)
+
+	_, err = parseUpgradePolicy("abort")
+	require.Error(t, err)
+}
+
+func TestParseStopSignal(t *testing.T) {
+	cases := map[string]struct {
+		value  string
+		expect syscall.Signal
+		err    string
+	}{
+		"default": {},
+		"name":    {value: "INT", expect: syscall.SIGINT},
+		"prefix":  {value: "sigquit", expect: syscall.SIGQUIT},
+		"number":  {value: "15", expect: syscall.SIGTERM},
+		"kill":    {value: "KILL", err: "SIGKILL can't be used to stop the daemon"},
+		"unknown": {value: "SIGFOO", err: `unknown signal "SIGFOO"`},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			sig, err := parseStopSignal(tc.value)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, sig)
+		})
+	}
+	require.Equal(t, syscall.SIGTERM, (&Config{}).stopSignal())
+	require.Equal(t, syscall.SIGINT, (&Config{StopSignal: syscall.SIGINT}).stopSignal())
+}
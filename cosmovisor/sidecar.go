@@ -0,0 +1,247 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// sidecarKey is the array of tables declaring the sidecars in the config file
+const sidecarKey = "sidecar"
+
+// Sidecar is an auxiliary process, like a price feeder or a relayer, that runs alongside
+// the daemon. It is started after every launch of the daemon, started again if it exits
+// while the daemon runs, and stopped once the daemon exited, so it is restarted around
+// upgrades too. Sidecars are declared in the config file.
+type Sidecar struct {
+	// Name tells the sidecar apart in the logs and in After
+	Name string `toml:"name"`
+	// Command is the program and its arguments
+	Command []string `toml:"command"`
+	// Env are extra KEY=value variables added to the environment of cosmovisor
+	Env []string `toml:"env"`
+	// After names the sidecars started before this one and stopped after it
+	After []string `toml:"after"`
+}
+
+// sidecarKeys are the keys a sidecar table may have
+var sidecarKeys = map[string]bool{"name": true, "command": true, "env": true, "after": true}
+
+// readSidecars reads the sidecar tables of the config file
+func readSidecars(tree *toml.Tree) ([]Sidecar, error) {
+	tables, ok := tree.Get(sidecarKey).([]*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("%s must be an array of tables, declared with [[%s]]", sidecarKey, sidecarKey)
+	}
+	sidecars := make([]Sidecar, len(tables))
+	for i, table := range tables {
+		for _, key := range table.Keys() {
+			if !sidecarKeys[key] {
+				return nil, fmt.Errorf("unknown setting %q of sidecar %d", key, i+1)
+			}
+		}
+		if err := table.Unmarshal(&sidecars[i]); err != nil {
+			return nil, fmt.Errorf("sidecar %d: %w", i+1, err)
+		}
+	}
+	return orderSidecars(sidecars)
+}
+
+// orderSidecars validates the sidecars and sorts them so every sidecar comes after the
+// ones it names in After, keeping the declared order otherwise
+func orderSidecars(sidecars []Sidecar) ([]Sidecar, error) {
+	byName := map[string]Sidecar{}
+	for i, sc := range sidecars {
+		if sc.Name == "" {
+			return nil, fmt.Errorf("sidecar %d has no name", i+1)
+		}
+		if _, dup := byName[sc.Name]; dup {
+			return nil, fmt.Errorf("sidecar %q is declared twice", sc.Name)
+		}
+		if len(sc.Command) == 0 || sc.Command[0] == "" {
+			return nil, fmt.Errorf("sidecar %q has no command", sc.Name)
+		}
+		for _, kv := range sc.Env {
+			if !strings.Contains(kv, "=") {
+				return nil, fmt.Errorf("sidecar %q: env %q must be KEY=value", sc.Name, kv)
+			}
+		}
+		byName[sc.Name] = sc
+	}
+	ordered := make([]Sidecar, 0, len(sidecars))
+	// a sidecar being visited is false, one placed is true
+	placed := map[string]bool{}
+	var place func(sc Sidecar, path []string) error
+	place = func(sc Sidecar, path []string) error {
+		if done, seen := placed[sc.Name]; seen {
+			if !done {
+				return fmt.Errorf("the sidecars depend on each other in a cycle: %s", strings.Join(append(path, sc.Name), " -> "))
+			}
+			return nil
+		}
+		placed[sc.Name] = false
+		for _, name := range sc.After {
+			dep, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("sidecar %q comes after %q, which isn't declared", sc.Name, name)
+			}
+			if err := place(dep, append(path, sc.Name)); err != nil {
+				return err
+			}
+		}
+		placed[sc.Name] = true
+		ordered = append(ordered, sc)
+		return nil
+	}
+	for _, sc := range sidecars {
+		if err := place(sc, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// sidecarGroup runs the sidecars during one launch of the daemon
+type sidecarGroup struct {
+	procs    []*sidecarProc
+	stopOnce sync.Once
+}
+
+// sidecarProc supervises one sidecar until it is stopped
+type sidecarProc struct {
+	Sidecar
+	cfg            *Config
+	stdout, stderr io.Writer
+
+	mutex   sync.Mutex
+	cmd     *exec.Cmd
+	exited  chan struct{}
+	stopped bool
+	// quit is closed by stop, done once run returned
+	quit chan struct{}
+	done chan struct{}
+}
+
+// startSidecars starts the sidecars in their order, their output is written to stdout and
+// stderr with their name in front of every line
+func (cfg *Config) startSidecars(stdout, stderr io.Writer) *sidecarGroup {
+	group := &sidecarGroup{}
+	for _, sc := range cfg.Sidecars {
+		p := &sidecarProc{Sidecar: sc, cfg: cfg, stdout: PrefixOutput(stdout, sc.Name), stderr: PrefixOutput(stderr, sc.Name),
+			quit: make(chan struct{}), done: make(chan struct{})}
+		group.procs = append(group.procs, p)
+		started := make(chan struct{})
+		goGuarded(cfg, func() { p.run(started) })
+		<-started
+	}
+	return group
+}
+
+// stop stops the sidecars in the reverse of their order, each one after the sidecars
+// depending on it exited
+func (g *sidecarGroup) stop() {
+	if g == nil {
+		return
+	}
+	g.stopOnce.Do(func() {
+		for i := len(g.procs) - 1; i >= 0; i-- {
+			g.procs[i].stop()
+		}
+	})
+}
+
+// run starts the sidecar and starts it again whenever it exits, until it is stopped.
+// started is closed once the first start was attempted.
+func (p *sidecarProc) run(started chan<- struct{}) {
+	defer close(p.done)
+	var backoff restartBackoff
+	for {
+		began := StartStopwatch()
+		err := p.start()
+		if started != nil {
+			close(started)
+			started = nil
+		}
+		if err == nil {
+			err = p.wait()
+		}
+		p.mutex.Lock()
+		stopped := p.stopped
+		p.mutex.Unlock()
+		if stopped {
+			return
+		}
+		// sidecars are started again for as long as the daemon runs, the attempts don't apply
+		delay, _ := backoff.next(p.cfg, began.Elapsed())
+		logger.Warnf("sidecar %q exited: %v, starting it again in %s", p.Name, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// start starts the sidecar process, unless it was stopped already
+func (p *sidecarProc) start() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stopped {
+		return errors.New("stopped")
+	}
+	cmd := exec.Command(p.Command[0], p.Command[1:]...)
+	cmd.Env = append(environ(), p.Env...)
+	cmd.Stdout = p.stdout
+	cmd.Stderr = p.stderr
+	cmd.SysProcAttr = daemonProcAttr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	logger.Infof("started sidecar %q (pid %d)", p.Name, cmd.Process.Pid)
+	p.cmd = cmd
+	p.exited = make(chan struct{})
+	return nil
+}
+
+// wait waits for the sidecar process to exit
+func (p *sidecarProc) wait() error {
+	p.mutex.Lock()
+	cmd, exited := p.cmd, p.exited
+	p.mutex.Unlock()
+	err := cmd.Wait()
+	close(exited)
+	return err
+}
+
+// stop sends the stop signal to the sidecar and waits for it to exit, killing it after
+// the shutdown grace period. A sidecar waiting to start again is not started anymore.
+func (p *sidecarProc) stop() {
+	p.mutex.Lock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.quit)
+	}
+	cmd, exited := p.cmd, p.exited
+	p.mutex.Unlock()
+	if cmd != nil {
+		select {
+		case <-exited:
+		default:
+			logger.Infof("stopping sidecar %q", p.Name)
+			_ = signalProcess(cmd.Process, p.cfg.stopSignal())
+			select {
+			case <-exited:
+			case <-time.After(p.cfg.shutdownGrace()):
+				logger.Warnf("sidecar %q didn't exit within %s, killing it", p.Name, p.cfg.shutdownGrace())
+				_ = cmd.Process.Kill()
+			}
+		}
+	}
+	<-p.done
+}
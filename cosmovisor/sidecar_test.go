@@ -0,0 +1,70 @@
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrderSidecars(t *testing.T) {
+	sc := func(name string, after ...string) Sidecar {
+		return Sidecar{Name: name, Command: []string{name}, After: after}
+	}
+	names := func(sidecars []Sidecar) []string {
+		var names []string
+		for _, sc := range sidecars {
+			names = append(names, sc.Name)
+		}
+		return names
+	}
+
+	ordered, err := orderSidecars([]Sidecar{sc("feeder", "oracle", "relayer"), sc("relayer"), sc("oracle", "relayer"), sc("exporter")})
+	require.NoError(t, err)
+	require.Equal(t, []string{"relayer", "oracle", "feeder", "exporter"}, names(ordered))
+
+	_, err = orderSidecars([]Sidecar{sc("a", "b"), sc("b", "c"), sc("c", "a")})
+	require.EqualError(t, err, "the sidecars depend on each other in a cycle: a -> b -> c -> a")
+	_, err = orderSidecars([]Sidecar{sc("a", "b")})
+	require.EqualError(t, err, `sidecar "a" comes after "b", which isn't declared`)
+	_, err = orderSidecars([]Sidecar{sc("a"), sc("a")})
+	require.EqualError(t, err, `sidecar "a" is declared twice`)
+	_, err = orderSidecars([]Sidecar{{Name: "a"}})
+	require.EqualError(t, err, `sidecar "a" has no command`)
+	_, err = orderSidecars([]Sidecar{{Name: "a", Command: []string{"a"}, Env: []string{"PORT"}}})
+	require.EqualError(t, err, `sidecar "a": env "PORT" must be KEY=value`)
+}
+
+func TestSidecars(t *testing.T) {
+	dir := t.TempDir()
+	events := filepath.Join(dir, "events")
+	// each sidecar records its starts and stops, the relayer exits right away once
+	script := func(name string) []string {
+		return []string{"/bin/sh", "-c", `echo start ` + name + ` >> ` + events + `
+trap 'echo stop ` + name + ` >> ` + events + `; exit 0' TERM
+if [ "$EXIT_ONCE" = 1 ] && [ ! -e ` + dir + `/exited ]; then touch ` + dir + `/exited; exit 1; fi
+while true; do sleep 0.05; done`}
+	}
+	cfg := &Config{RestartDelay: 10 * time.Millisecond, Sidecars: []Sidecar{
+		{Name: "relayer", Command: script("relayer"), Env: []string{"EXIT_ONCE=1"}},
+		{Name: "feeder", Command: script("feeder"), After: []string{"relayer"}},
+	}}
+	group := cfg.startSidecars(ioutil.Discard, ioutil.Discard)
+	// the relayer is started again after it exited
+	require.Eventually(t, func() bool {
+		bz, _ := ioutil.ReadFile(events)
+		return strings.Count(string(bz), "start") == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	group.stop()
+	group.stop()
+
+	bz, err := ioutil.ReadFile(events)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(bz)), "\n")
+	// the feeder stops before the relayer it comes after
+	require.Equal(t, []string{"stop feeder", "stop relayer"}, lines[len(lines)-2:])
+}
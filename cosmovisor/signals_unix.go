@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+package cosmovisor
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadTriggers ask cosmovisor to deliver the reload signal to the daemon
+var reloadTriggers = []os.Signal{syscall.SIGUSR2}
+
+// forwardedSignals are relayed to the daemon as they are, e.g. to reopen its log files
+var forwardedSignals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR1}
+
+// signalNames are the signals that can be configured by name
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"STOP":  syscall.SIGSTOP,
+	"CONT":  syscall.SIGCONT,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// daemonProcAttr are the process attributes of the daemon, the defaults
+func daemonProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// signalProcess sends the signal to the process
+func signalProcess(p *os.Process, sig os.Signal) error {
+	return p.Signal(sig)
+}
+
+// processAlive returns true if a process with the pid exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	// the process may belong to another user
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,63 @@
+package cosmovisor
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadTriggers is empty, there is no signal to ask for a reload on windows
+var reloadTriggers []os.Signal
+
+// forwardedSignals is empty, windows has no signals to relay besides the stop signals
+var forwardedSignals []os.Signal
+
+// signalNames are the signals that can be configured by name
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+// ctrlBreakEvent is CTRL_BREAK_EVENT of GenerateConsoleCtrlEvent
+const ctrlBreakEvent = 1
+
+var procGenerateConsoleCtrlEvent = syscall.NewLazyDLL("kernel32.dll").NewProc("GenerateConsoleCtrlEvent")
+
+// daemonProcAttr starts the daemon in a process group of its own, so a console control
+// event can be sent to it alone
+func daemonProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// signalProcess delivers the signal to the process as windows can. Only killing is
+// supported by os.Process, so the stop signals are sent as a Ctrl+Break to the process
+// group of the daemon, which go programs receive as os.Interrupt. Without a console to
+// send it through, the process is killed.
+func signalProcess(p *os.Process, sig os.Signal) error {
+	switch sig {
+	case syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT:
+		if ok, _, err := procGenerateConsoleCtrlEvent.Call(ctrlBreakEvent, uintptr(p.Pid)); ok == 0 {
+			logger.Warnf("sending Ctrl+Break to process %d: %v, killing it", p.Pid, err)
+			return p.Kill()
+		}
+		return nil
+	case syscall.SIGKILL:
+		return p.Kill()
+	}
+	return p.Signal(sig)
+}
+
+// processAlive returns true if a process with the pid exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,174 @@
+package cosmovisor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp"
+)
+
+// errSignatureRequired is returned for downloads without a signature when
+// DAEMON_BINARY_PUBKEY is set
+var errSignatureRequired = errors.New("a signature is required to download binaries")
+
+// SignatureKey verifies the detached signatures of downloaded artifacts
+type SignatureKey interface {
+	// Verify returns an error unless sig is a valid signature of the artifact by the key
+	Verify(artifact io.Reader, sig []byte) error
+	// String names the kind of key and its id, for the logs
+	String() string
+}
+
+// LoadSignatureKey reads the key of DAEMON_BINARY_PUBKEY: an absolute path to a minisign
+// public key or an OpenPGP public key (armored or binary), or a minisign key given inline
+func LoadSignatureKey(value string) (SignatureKey, error) {
+	bz := []byte(value)
+	if filepath.IsAbs(value) {
+		var err error
+		if bz, err = ioutil.ReadFile(value); err != nil {
+			return nil, err
+		}
+	}
+	return ParseSignatureKey(bz)
+}
+
+// ParseSignatureKey parses a minisign public key, with or without its comment line, or an
+// OpenPGP public key ring
+func ParseSignatureKey(bz []byte) (SignatureKey, error) {
+	text := strings.TrimSpace(string(bz))
+	switch {
+	case strings.HasPrefix(text, "-----BEGIN PGP"):
+		ring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(text))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OpenPGP key: %w", err)
+		}
+		return pgpKey{ring}, nil
+	case strings.HasPrefix(text, "untrusted comment:") || strings.HasPrefix(text, "RW"):
+		return parseMinisignKey(text)
+	}
+	ring, err := openpgp.ReadKeyRing(bytes.NewReader(bz))
+	if err != nil {
+		return nil, errors.New("neither a minisign nor an OpenPGP public key")
+	}
+	return pgpKey{ring}, nil
+}
+
+// pgpKey verifies OpenPGP detached signatures, armored or binary
+type pgpKey struct {
+	ring openpgp.EntityList
+}
+
+func (k pgpKey) Verify(artifact io.Reader, sig []byte) error {
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN PGP")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(k.ring, artifact, bytes.NewReader(sig))
+	} else {
+		_, err = openpgp.CheckDetachedSignature(k.ring, artifact, bytes.NewReader(sig))
+	}
+	return err
+}
+
+func (k pgpKey) String() string {
+	if len(k.ring) == 0 {
+		return "OpenPGP key"
+	}
+	return fmt.Sprintf("OpenPGP key %X", k.ring[0].PrimaryKey.Fingerprint)
+}
+
+const (
+	minisignKeyLen = 2 + 8 + ed25519.PublicKeySize
+	minisignSigLen = 2 + 8 + ed25519.SignatureSize
+)
+
+// minisignKey verifies minisign signatures, legacy (Ed) or of the blake2b-512 prehash (ED)
+type minisignKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// parseMinisignKey parses the base64 key, the last line of a minisign .pub file
+func parseMinisignKey(text string) (minisignKey, error) {
+	lines := strings.Split(text, "\n")
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[len(lines)-1]))
+	if err != nil || len(raw) != minisignKeyLen || string(raw[:2]) != "Ed" {
+		return minisignKey{}, errors.New("invalid minisign public key")
+	}
+	var k minisignKey
+	copy(k.id[:], raw[2:10])
+	k.key = ed25519.PublicKey(raw[10:])
+	return k, nil
+}
+
+// Verify checks a minisign signature file: the signature of the artifact, then the global
+// signature covering it and the trusted comment
+func (k minisignKey) Verify(artifact io.Reader, sig []byte) error {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(sig))
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("invalid minisign signature file")
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != minisignSigLen {
+		return errors.New("invalid minisign signature")
+	}
+	if !bytes.Equal(raw[2:10], k.id[:]) {
+		return fmt.Errorf("signed by minisign key %X, not %X", reverse(raw[2:10]), reverse(k.id[:]))
+	}
+
+	var message []byte
+	switch string(raw[:2]) {
+	case "ED":
+		h, _ := blake2b.New512(nil)
+		if _, err := io.Copy(h, artifact); err != nil {
+			return err
+		}
+		message = h.Sum(nil)
+	case "Ed":
+		if message, err = ioutil.ReadAll(artifact); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown minisign signature algorithm %q", raw[:2])
+	}
+	if !ed25519.Verify(k.key, message, raw[10:]) {
+		return errors.New("minisign signature doesn't match")
+	}
+
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return errors.New("invalid minisign global signature")
+	}
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	signed := append(append([]byte{}, raw[10:]...), trusted...)
+	if !ed25519.Verify(k.key, signed, global) {
+		return errors.New("minisign trusted comment doesn't match")
+	}
+	return nil
+}
+
+// String shows the key id the way minisign prints it
+func (k minisignKey) String() string {
+	return "minisign key " + strings.ToUpper(hex.EncodeToString(reverse(k.id[:])))
+}
+
+// reverse returns a reversed copy, minisign prints its little endian key ids backwards
+func reverse(bz []byte) []byte {
+	out := make([]byte, len(bz))
+	for i, b := range bz {
+		out[len(bz)-1-i] = b
+	}
+	return out
+}
@@ -0,0 +1,188 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// minisigner signs like minisign -S, with a fixed key id
+type minisigner struct {
+	id   []byte
+	priv ed25519.PrivateKey
+}
+
+func newMinisigner(t *testing.T) minisigner {
+	_, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	return minisigner{id: []byte{1, 2, 3, 4, 5, 6, 7, 8}, priv: priv}
+}
+
+// publicKey is the content of the .pub file
+func (m minisigner) publicKey() string {
+	raw := append(append([]byte("Ed"), m.id...), m.priv.Public().(ed25519.PublicKey)...)
+	return "untrusted comment: minisign public key 0807060504030201\n" + base64.StdEncoding.EncodeToString(raw) + "\n"
+}
+
+// sign returns the .minisig file, prehashed unless legacy
+func (m minisigner) sign(data []byte, legacy bool) []byte {
+	alg, message := "ED", data
+	if legacy {
+		alg = "Ed"
+	} else {
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	}
+	sig := ed25519.Sign(m.priv, message)
+	trusted := "timestamp:1609459200\tfile:autod"
+	global := ed25519.Sign(m.priv, append(append([]byte{}, sig...), trusted...))
+	raw := append(append([]byte(alg), m.id...), sig...)
+	return []byte(fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(raw), trusted, base64.StdEncoding.EncodeToString(global)))
+}
+
+func TestParseSignatureKey(t *testing.T) {
+	m := newMinisigner(t)
+	entity, err := openpgp.NewEntity("Release", "", "release@example.com", nil)
+	require.NoError(t, err)
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.Serialize(w))
+	require.NoError(t, w.Close())
+	var binary bytes.Buffer
+	require.NoError(t, entity.Serialize(&binary))
+
+	cases := map[string]struct {
+		key    []byte
+		expect string
+		err    string
+	}{
+		"minisign file":   {key: []byte(m.publicKey()), expect: "minisign key 0807060504030201"},
+		"minisign inline": {key: []byte(strings.Split(m.publicKey(), "\n")[1]), expect: "minisign key 0807060504030201"},
+		"armored OpenPGP": {key: armored.Bytes(), expect: fmt.Sprintf("OpenPGP key %X", entity.PrimaryKey.Fingerprint)},
+		"binary OpenPGP":  {key: binary.Bytes(), expect: fmt.Sprintf("OpenPGP key %X", entity.PrimaryKey.Fingerprint)},
+		"truncated":       {key: []byte(strings.Split(m.publicKey(), "\n")[1][:20]), err: "invalid minisign public key"},
+		"neither":         {key: []byte("not a key"), err: "neither a minisign nor an OpenPGP public key"},
+		"broken armor":    {key: []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nxx\n"), err: "invalid OpenPGP key"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			key, err := ParseSignatureKey(tc.key)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, key.String())
+		})
+	}
+}
+
+func TestMinisignVerify(t *testing.T) {
+	m := newMinisigner(t)
+	key, err := ParseSignatureKey([]byte(m.publicKey()))
+	require.NoError(t, err)
+	data := []byte("#!/bin/sh\necho Chain 2 is live!\n")
+
+	require.NoError(t, key.Verify(bytes.NewReader(data), m.sign(data, false)))
+	require.NoError(t, key.Verify(bytes.NewReader(data), m.sign(data, true)))
+
+	err = key.Verify(bytes.NewReader(append(data, '\n')), m.sign(data, false))
+	require.EqualError(t, err, "minisign signature doesn't match")
+
+	tampered := bytes.Replace(m.sign(data, false), []byte("file:autod"), []byte("file:other"), 1)
+	require.EqualError(t, key.Verify(bytes.NewReader(data), tampered), "minisign trusted comment doesn't match")
+
+	other := newMinisigner(t)
+	other.id = []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	err = key.Verify(bytes.NewReader(data), other.sign(data, false))
+	require.EqualError(t, err, "signed by minisign key 0102030405060708, not 0807060504030201")
+
+	require.Error(t, key.Verify(bytes.NewReader(data), []byte("garbage")))
+}
+
+func TestPGPVerify(t *testing.T) {
+	entity, err := openpgp.NewEntity("Release", "", "release@example.com", nil)
+	require.NoError(t, err)
+	key := pgpKey{openpgp.EntityList{entity}}
+	data := []byte("#!/bin/sh\necho Chain 2 is live!\n")
+
+	var armored, binary bytes.Buffer
+	require.NoError(t, openpgp.ArmoredDetachSign(&armored, entity, bytes.NewReader(data), nil))
+	require.NoError(t, openpgp.DetachSign(&binary, entity, bytes.NewReader(data), nil))
+	require.NoError(t, key.Verify(bytes.NewReader(data), armored.Bytes()))
+	require.NoError(t, key.Verify(bytes.NewReader(data), binary.Bytes()))
+	require.Error(t, key.Verify(bytes.NewReader(append(data, '\n')), armored.Bytes()))
+
+	stranger, err := openpgp.NewEntity("Stranger", "", "stranger@example.com", nil)
+	require.NoError(t, err)
+	var foreign bytes.Buffer
+	require.NoError(t, openpgp.ArmoredDetachSign(&foreign, stranger, bytes.NewReader(data), nil))
+	require.Error(t, key.Verify(bytes.NewReader(data), foreign.Bytes()))
+}
+
+func TestDownloadBinarySigned(t *testing.T) {
+	m := newMinisigner(t)
+	key, err := ParseSignatureKey([]byte(m.publicKey()))
+	require.NoError(t, err)
+	artifact, err := filepath.Abs(filepath.Join("testdata", "repo", "zip_directory", "autod.zip"))
+	require.NoError(t, err)
+	bz, err := ioutil.ReadFile(artifact)
+	require.NoError(t, err)
+	sigs := t.TempDir()
+	good := filepath.Join(sigs, "autod.zip.minisig")
+	require.NoError(t, ioutil.WriteFile(good, m.sign(bz, false), 0644))
+	bad := filepath.Join(sigs, "other.minisig")
+	require.NoError(t, ioutil.WriteFile(bad, m.sign([]byte("something else"), false), 0644))
+
+	cases := map[string]struct {
+		signatures string
+		checksum   string
+		err        string
+	}{
+		"signed":            {signatures: fmt.Sprintf(`{"%s": "%s"}`, OSArch(), good)},
+		"signed and summed": {signatures: fmt.Sprintf(`{"any": "%s"}`, good), checksum: "?checksum=sha256:3784e4574cad69b67e34d4ea4425eff140063a3870270a301d6bb24a098a27ae"},
+		"wrong checksum":    {signatures: fmt.Sprintf(`{"any": "%s"}`, good), checksum: "?checksum=sha256:73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906", err: "Checksums did not match"},
+		"signed for any":    {signatures: fmt.Sprintf(`{"any": "%s"}`, good)},
+		"no signature":      {signatures: `{"windows/amd64": "https://example.com/autod.zip.minisig"}`, err: "a signature is required"},
+		"wrong signature":   {signatures: fmt.Sprintf(`{"any": "%s"}`, bad), err: "minisign signature doesn't match"},
+		"missing signature": {signatures: fmt.Sprintf(`{"any": "%s"}`, filepath.Join(sigs, "missing")), err: "downloading signature"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home := t.TempDir()
+			require.NoError(t, copy.Copy(filepath.Join("testdata", "download"), home))
+			cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, BinaryPubKey: key}
+			info := &UpgradeInfo{
+				Name: "amazonas",
+				Info: fmt.Sprintf(`{"binaries": {"any": "%s%s"}, "signatures": %s}`, artifact, tc.checksum, tc.signatures),
+			}
+
+			err := DownloadBinary(cfg, info)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				// nothing was unpacked
+				_, err = os.Stat(cfg.UpgradeDir("amazonas"))
+				require.True(t, os.IsNotExist(err))
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, EnsureBinary(cfg.UpgradeBin("amazonas")))
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package cosmovisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// signerPauseFile records that the remote signer was paused for an upgrade, until the
+	// daemon caught up again
+	signerPauseFile = "signer-paused.json"
+	// defaultSignerTimeout bounds each signer command
+	defaultSignerTimeout = time.Minute
+	// signerPollInterval is how often the node is polled before the signer is resumed
+	signerPollInterval = 5 * time.Second
+	// signerResumeWarning is how long the node may take to catch up before the operator is
+	// warned that the signer is still paused
+	signerResumeWarning = 10 * time.Minute
+	// defaultNodeRPC is the CometBFT RPC of the node when DAEMON_LIVENESS_RPC isn't set
+	defaultNodeRPC = "http://localhost:26657"
+)
+
+// Event types of the remote signer coordination
+const (
+	EventSignerPaused  = "signer_paused"
+	EventSignerResumed = "signer_resumed"
+)
+
+// SignerPause is the upgrade a remote signer was paused for
+type SignerPause struct {
+	Upgrade  string    `json:"upgrade"`
+	Height   int64     `json:"height"`
+	PausedAt time.Time `json:"paused_at"`
+}
+
+// signerTemplateData is available to the signer command templates
+type signerTemplateData struct {
+	Home   string
+	Name   string
+	Height int64
+}
+
+// wantsSignerPause returns true if a remote signer is paused around upgrades
+func (cfg *Config) wantsSignerPause() bool {
+	return cfg.SignerPauseCommand != ""
+}
+
+func (cfg *Config) signerTimeout() time.Duration {
+	if cfg.SignerTimeout <= 0 {
+		return defaultSignerTimeout
+	}
+	return cfg.SignerTimeout
+}
+
+// nodeRPC is the CometBFT RPC polled for the node to catch up
+func (cfg *Config) nodeRPC() string {
+	if cfg.LivenessRPC != "" {
+		return cfg.LivenessRPC
+	}
+	return defaultNodeRPC
+}
+
+// PausedSigner returns the upgrade the remote signer is paused for, nil if it isn't
+func (cfg *Config) PausedSigner() (*SignerPause, error) {
+	var pause SignerPause
+	if ok, err := cfg.readStateFile(signerPauseFile, &pause); !ok {
+		return nil, err
+	}
+	return &pause, nil
+}
+
+// pauseSigner runs the signer pause command once the old binary stopped, recorded as the
+// signer-pause phase, so the signer doesn't sign for the node until the new binary caught
+// up. The pause is recorded first: a signer that may be paused is resumed after the next
+// launch even if the command failed. A failed pause fails the upgrade.
+func (cfg *Config) pauseSigner(info *UpgradeInfo, timings *UpgradeTimings) error {
+	if !cfg.wantsSignerPause() {
+		return nil
+	}
+	phase := timings.Phase("signer-pause")
+	err := cfg.writeStateFile(signerPauseFile, SignerPause{Upgrade: info.Name, Height: info.Height, PausedAt: NowUTC()})
+	if err == nil {
+		err = cfg.runSignerCommand("pause", cfg.SignerPauseCommand, info.Name, info.Height)
+	}
+	if err != nil {
+		err = fmt.Errorf("pausing the remote signer: %w", err)
+		phase.End(err)
+		return err
+	}
+	phase.End(nil)
+	logger.Infof("paused the remote signer for upgrade %q", info.Name)
+	ev := NewEvent(EventSignerPaused, info.Name, fmt.Sprintf("paused the remote signer for upgrade %q", info.Name))
+	ev.Height = info.Height
+	notify(cfg, ev)
+	return nil
+}
+
+// resumeSignerWhenCaughtUp resumes a paused remote signer once the node answers on its RPC,
+// isn't catching up and got back to the height it halted at, until done is closed. A failed
+// resume is retried, the node is left without its signer rather than risk a double sign.
+func (cfg *Config) resumeSignerWhenCaughtUp(done <-chan struct{}) {
+	pause, err := cfg.PausedSigner()
+	if err != nil {
+		logger.Errorf("not resuming the remote signer: %v", err)
+		return
+	}
+	if pause == nil {
+		return
+	}
+	client := &http.Client{Timeout: nodeAPITimeout}
+	ticker := time.NewTicker(signerPollInterval)
+	defer ticker.Stop()
+	warn := time.After(signerResumeWarning)
+	for {
+		select {
+		case <-done:
+			return
+		case <-warn:
+			msg := fmt.Sprintf("the remote signer is still paused for upgrade %q, the node didn't catch up within %s", pause.Upgrade, signerResumeWarning)
+			logger.Warnf("%s", msg)
+			notify(cfg, NewEvent(EventSignerPaused, pause.Upgrade, msg))
+		case <-ticker.C:
+			if cfg.resumeSigner(client, pause) {
+				return
+			}
+		}
+	}
+}
+
+// resumeSigner runs the signer resume command if the node caught up since the signer was
+// paused, and returns true once the signer is resumed
+func (cfg *Config) resumeSigner(client *http.Client, pause *SignerPause) bool {
+	node, err := NodeSyncInfo(client, cfg.nodeRPC())
+	if err != nil {
+		logger.Debugf("polling the node before resuming the remote signer: %v", err)
+		return false
+	}
+	// the node halted with the block before the upgrade height committed
+	if node.CatchingUp || node.Height < pause.Height-1 {
+		return false
+	}
+	if err := cfg.runSignerCommand("resume", cfg.SignerResumeCommand, pause.Upgrade, pause.Height); err != nil {
+		logger.Errorf("resuming the remote signer: %v", err)
+		return false
+	}
+	if err := cfg.fs().remove(filepath.Join(cfg.StateDir(), signerPauseFile)); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("removing %s: %v", signerPauseFile, err)
+	}
+	msg := fmt.Sprintf("resumed the remote signer, the node caught up at height %d", node.Height)
+	logger.Infof("%s", msg)
+	ev := NewEvent(EventSignerResumed, pause.Upgrade, msg)
+	ev.Height = node.Height
+	notify(cfg, ev)
+	return true
+}
+
+// runSignerCommand runs the signer pause or resume command of the upgrade, with the upgrade
+// in its environment
+func (cfg *Config) runSignerCommand(what, command, upgrade string, height int64) error {
+	args, err := renderCommand("signer "+what, command, signerTemplateData{Home: cfg.Home, Name: upgrade, Height: height})
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("empty signer %s command", what)
+	}
+	timeout := cfg.signerTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	logger.Infof("running signer %s command %s", what, strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(environ(),
+		"DAEMON_HOME="+cfg.Home,
+		"DAEMON_NAME="+cfg.DaemonName(),
+		"COSMOVISOR_UPGRADE_NAME="+upgrade,
+		"COSMOVISOR_UPGRADE_HEIGHT="+strconv.FormatInt(height, 10),
+	)
+	out, err := cmd.CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if ctx.Err() != nil {
+		return errors.New(strings.Join(args, " ") + " didn't finish within " + timeout.String())
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", strings.Join(args, " "), err, output)
+	}
+	if output != "" {
+		logger.Infof("%s: %s", args[0], output)
+	}
+	return nil
+}
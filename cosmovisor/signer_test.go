@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// signerScript writes a script appending its arguments and the upgrade of its environment
+// to the returned log, failing if fail exists next to it
+func signerScript(t *testing.T) (script, log string) {
+	dir := t.TempDir()
+	script, log = filepath.Join(dir, "signer"), filepath.Join(dir, "signer.log")
+	require.NoError(t, ioutil.WriteFile(script, []byte(fmt.Sprintf(`#!/bin/sh
+[ -e %s/fail ] && exit 1
+echo "$* $COSMOVISOR_UPGRADE_NAME" >> %s
+`, dir, log)), 0755))
+	return script, log
+}
+
+func TestPauseSigner(t *testing.T) {
+	script, log := signerScript(t)
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", SignerPauseCommand: script + " pause {{.Name}}@{{.Height}}", SignerResumeCommand: script + " resume"}
+	timings := NewUpgradeTimings("chain2")
+	require.NoError(t, cfg.pauseSigner(&UpgradeInfo{Name: "chain2", Height: 50}, timings))
+
+	bz, err := ioutil.ReadFile(log)
+	require.NoError(t, err)
+	require.Equal(t, "pause chain2@50 chain2\n", string(bz))
+	require.Equal(t, "signer-pause", timings.Phases[0].Name)
+	pause, err := cfg.PausedSigner()
+	require.NoError(t, err)
+	require.Equal(t, "chain2", pause.Upgrade)
+	require.Equal(t, int64(50), pause.Height)
+
+	// a failed pause fails the upgrade, the signer is resumed after the next launch anyway
+	require.NoError(t, ioutil.WriteFile(filepath.Join(filepath.Dir(script), "fail"), nil, 0644))
+	cfg = &Config{Home: t.TempDir(), Name: "dummyd", SignerPauseCommand: script, SignerResumeCommand: script}
+	require.Error(t, cfg.pauseSigner(&UpgradeInfo{Name: "chain3", Height: 80}, NewUpgradeTimings("chain3")))
+	pause, err = cfg.PausedSigner()
+	require.NoError(t, err)
+	require.Equal(t, "chain3", pause.Upgrade)
+}
+
+func TestResumeSigner(t *testing.T) {
+	script, log := signerScript(t)
+	var height int64 = 48
+	var catchingUp int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"result":{"sync_info":{"latest_block_height":"%d","catching_up":%t}}}`, atomic.LoadInt64(&height), atomic.LoadInt32(&catchingUp) == 1)
+	}))
+	defer srv.Close()
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", LivenessRPC: srv.URL, SignerPauseCommand: script + " pause", SignerResumeCommand: script + " resume {{.Height}}"}
+	require.NoError(t, cfg.writeStateFile(signerPauseFile, SignerPause{Upgrade: "chain2", Height: 50}))
+	pause, err := cfg.PausedSigner()
+	require.NoError(t, err)
+
+	require.False(t, cfg.resumeSigner(srv.Client(), pause), "the node is catching up")
+	atomic.StoreInt32(&catchingUp, 0)
+	require.False(t, cfg.resumeSigner(srv.Client(), pause), "the node is behind the height it halted at")
+	atomic.StoreInt64(&height, 49)
+	require.True(t, cfg.resumeSigner(srv.Client(), pause))
+
+	bz, err := ioutil.ReadFile(log)
+	require.NoError(t, err)
+	require.Equal(t, "resume 50 chain2\n", string(bz))
+	pause, err = cfg.PausedSigner()
+	require.NoError(t, err)
+	require.Nil(t, pause, "the signer isn't paused anymore")
+}
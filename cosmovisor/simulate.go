@@ -0,0 +1,195 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// SimulationStep is one step of the upgrade pipeline exercised by SimulateUpgrade
+type SimulationStep struct {
+	Step   string `json:"step"`
+	Result string `json:"result"`
+	// Failed is set if the step would fail the upgrade
+	Failed bool `json:"failed"`
+}
+
+// Simulation is the outcome of SimulateUpgrade
+type Simulation struct {
+	Upgrade *UpgradeInfo      `json:"upgrade"`
+	Steps   []*SimulationStep `json:"steps"`
+	// Plan is what the upgrade does once the daemon halts, as Explain describes it
+	Plan []Explanation `json:"plan"`
+}
+
+// Failed returns the first step that would fail the upgrade, nil if none would
+func (s *Simulation) Failed() *SimulationStep {
+	for _, step := range s.Steps {
+		if step.Failed {
+			return step
+		}
+	}
+	return nil
+}
+
+// SimulateUpgrade rehearses the upgrade described by info without touching the node: the
+// plan is checked, the binary is downloaded and verified in a scratch directory (or the
+// staged one is checked), and the room for the data backup is measured. Nothing in the
+// home is changed, so it can run on a standby node next to a running cosmovisor.
+func SimulateUpgrade(cfg *Config, info *UpgradeInfo) *Simulation {
+	s := &Simulation{Upgrade: info, Plan: Explain(cfg, info)}
+	add := func(step string, err error, format string, args ...interface{}) {
+		result := fmt.Sprintf(format, args...)
+		if err != nil {
+			result = err.Error()
+		}
+		s.Steps = append(s.Steps, &SimulationStep{Step: step, Result: result, Failed: err != nil})
+	}
+
+	plan, err := cfg.PlanUpgrade(info)
+	if err != nil {
+		add("plan", err, "")
+		return s
+	}
+	// downloads go to the same layout under a scratch directory, the home may be read-only
+	scratch, err := cfg.fs().scratchDir("", "cosmovisor-simulate-")
+	if err != nil {
+		add("plan", err, "")
+		return s
+	}
+	sim := cfg.scratchConfig(scratch)
+	defer sim.fs().removeAll(scratch)
+	// nothing is downloaded for an immutable layout
+	if !cfg.Immutable {
+		if err := sim.followReference(plan); err != nil {
+			add("plan", err, "")
+			return s
+		}
+	}
+	if plan.Config != nil {
+		add("plan", nil, "upgrade config read from %s", info.Info)
+	} else {
+		add("plan", nil, "upgrade %q can be applied", info.Name)
+	}
+
+	bin, source, err := scratchBinary(cfg, sim, plan)
+	add("binary", err, "%s", source)
+	if err != nil {
+		return s
+	}
+	if hash, err := sha256File(bin); err == nil {
+		add("binary", nil, "runs on %s, sha256 %s", OSArch(), hash)
+	}
+
+	if cfg.wantsPreflight() {
+		if err := cfg.preflight(info, bin); err != nil {
+			add("preflight", err, "")
+			return s
+		}
+		add("preflight", nil, "%s version passed", bin)
+	}
+
+	simulateBackupSpace(cfg, info, add)
+	return s
+}
+
+// scratchConfig is cfg with its home at scratch and writable, so the downloads of a
+// rehearsal go to the same layout there
+func (cfg *Config) scratchConfig(scratch string) *Config {
+	sim := *cfg
+	sim.Home, sim.ReadOnly, sim.Immutable, sim.WritableRoot, sim.StatePath, sim.WorkDir = scratch, false, false, "", "", ""
+	return &sim
+}
+
+// scratchBinary returns the binary of the planned upgrade, downloaded to the layout of sim
+// unless it is staged, and where it came from
+func scratchBinary(cfg, sim *Config, plan *UpgradePlan) (string, string, error) {
+	bin, source := plan.NewBin, "staged at "+plan.NewBin
+	if plan.Download {
+		bin, source = sim.UpgradeBin(plan.Info.Name), "downloaded from "+explainSource(cfg, plan.Info)
+		if err := downloadBinary(sim, plan.Info, plan.Config); err != nil {
+			return "", "", fmt.Errorf("cannot download binary: %w", err)
+		}
+	}
+	if err := EnsureBinary(bin); err != nil {
+		return "", "", fmt.Errorf("binary doesn't check out: %w", err)
+	}
+	return bin, source, nil
+}
+
+// simulateBackupSpace measures the room for the data backup as the upgrade will
+func simulateBackupSpace(cfg *Config, info *UpgradeInfo, add func(step string, err error, format string, args ...interface{})) {
+	if cfg.dataBackup() == DataBackupNone || cfg.spaceCheck() == SpaceCheckOff {
+		return
+	}
+	if cfg.DataBackupDest != "" {
+		add("backup", nil, "streamed to %s, no local space needed", cfg.DataBackupDest)
+		return
+	}
+	path, err := cfg.dataBackupPath(info, "<time>")
+	if err != nil {
+		add("backup", err, "")
+		return
+	}
+	leftOut := cfg.excludedFromDataBackup
+	if cfg.dataBackup() == DataBackupSnapshot {
+		height, err := latestSnapshot(cfg.snapshotsDir())
+		switch {
+		case err != nil && cfg.DataBackupSnapshotCommand != "":
+			add("backup", nil, "the snapshot is taken with the old binary, its size isn't known yet")
+			return
+		case err != nil:
+			add("backup", err, "")
+			return
+		}
+		leftOut = cfg.snapshotSkip(height)
+	}
+	size, err := treeSize(cfg.DataDir(), leftOut)
+	if err != nil {
+		add("backup", fmt.Errorf("measuring the data directory: %w", err), "")
+		return
+	}
+	// the backup directory is only created by the backup
+	dir := filepath.Dir(path)
+	for {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	free, err := freeSpace(dir)
+	switch {
+	case errors.Is(err, errFreeSpaceUnknown):
+		add("backup", nil, "the data directory holds %s, %v", formatBytes(size), err)
+	case err != nil:
+		add("backup", fmt.Errorf("reading the free space in %s: %w", dir, err), "")
+	case uint64(size) <= free:
+		add("backup", nil, "the data directory holds %s, %s free in %s", formatBytes(size), formatBytes(int64(free)), dir)
+	case cfg.spaceCheck() == SpaceCheckWarn:
+		add("backup", nil, "not enough space in %s: %s free, the data directory holds %s, the backup is tried anyway",
+			dir, formatBytes(int64(free)), formatBytes(size))
+	default:
+		add("backup", fmt.Errorf("not enough space in %s for the data backup: %s free, the data directory holds %s",
+			dir, formatBytes(int64(free)), formatBytes(size)), "")
+	}
+}
+
+// WriteSimulation prints the steps of the simulation as aligned columns, then the plan
+func WriteSimulation(w io.Writer, s *Simulation) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, step := range s.Steps {
+		outcome := "ok"
+		if step.Failed {
+			outcome = "FAILED"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", step.Step, outcome, step.Result)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nonce the daemon halts at the upgrade:\n")
+	return WriteExplanation(w, s.Plan)
+}
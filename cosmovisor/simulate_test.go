@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package cosmovisor_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/cosmos-sdk/cosmovisor"
+)
+
+func TestSimulateUpgrade(t *testing.T) {
+	home := copyTestData(t, "download")
+	cfg := &cosmovisor.Config{Home: home, Name: "autod", AllowDownloadBinaries: true, DownloadAttempts: 1, ReadOnly: true}
+	bin, err := filepath.Abs("./testdata/repo/raw_binary/autod")
+	require.NoError(t, err)
+	plan := func(checksum string) *cosmovisor.UpgradeInfo {
+		return &cosmovisor.UpgradeInfo{
+			Name:   "amazonas",
+			Height: 120,
+			Info:   fmt.Sprintf(`{"binaries":{"%s": "%s?checksum=sha256:%s"}}`, cosmovisor.OSArch(), bin, checksum),
+		}
+	}
+
+	// the binary is downloaded and verified, but nothing is left in the home
+	sim := cosmovisor.SimulateUpgrade(cfg, plan("e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d"))
+	require.Nil(t, sim.Failed())
+	require.Len(t, sim.Steps, 3)
+	require.Equal(t, "runs on "+cosmovisor.OSArch()+", sha256 e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d", sim.Steps[2].Result)
+	_, err = os.Stat(cfg.UpgradeDir("amazonas"))
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, cfg.GenesisBin(), mustCurrentBin(t, cfg))
+	var out bytes.Buffer
+	require.NoError(t, cosmovisor.WriteSimulation(&out, sim))
+	require.Contains(t, out.String(), "binary  ok  downloaded from ")
+	require.Contains(t, out.String(), "\nonce the daemon halts at the upgrade:\n")
+
+	sim = cosmovisor.SimulateUpgrade(cfg, plan("73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906"))
+	failed := sim.Failed()
+	require.NotNil(t, failed)
+	require.Equal(t, "binary", failed.Step)
+	require.Contains(t, failed.Result, "cannot download binary")
+
+	cfg.AllowDownloadBinaries = false
+	failed = cosmovisor.SimulateUpgrade(cfg, plan("")).Failed()
+	require.NotNil(t, failed)
+	require.Equal(t, "plan", failed.Step)
+}
@@ -0,0 +1,179 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// skipUpgradesFlag is the flag of `<daemon> start` listing the upgrade heights the app
+	// skips rather than halting for them
+	skipUpgradesFlag = "--unsafe-skip-upgrades"
+	// skippedFile records the upgrades skipped at the heights the app halted for them
+	skippedFile = "skipped-upgrades.json"
+	// startCommand is the daemon command taking skipUpgradesFlag
+	startCommand = "start"
+)
+
+// SkipUpgrades are the upgrades DAEMON_SKIP_UPGRADES tells cosmovisor to skip
+type SkipUpgrades struct {
+	// Names are skipped at whatever height the app halts for them
+	Names []string
+	// Heights are passed to the daemon with --unsafe-skip-upgrades, the app doesn't halt there
+	Heights []int64
+}
+
+// SkippedUpgrade is an upgrade skipped by name, at the height the app halted for it
+type SkippedUpgrade struct {
+	Name      string    `json:"name"`
+	Height    int64     `json:"height"`
+	SkippedAt time.Time `json:"skipped_at"`
+}
+
+// parseSkipUpgrades parses DAEMON_SKIP_UPGRADES, a comma separated list of upgrade names
+// and heights
+func parseSkipUpgrades(s string) (SkipUpgrades, error) {
+	var skip SkipUpgrades
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if height, err := strconv.ParseInt(entry, 10, 64); err == nil {
+			if height <= 0 {
+				return SkipUpgrades{}, fmt.Errorf("height must be positive, not %d", height)
+			}
+			skip.Heights = append(skip.Heights, height)
+			continue
+		}
+		if err := ValidateUpgradeName(entry); err != nil {
+			return SkipUpgrades{}, err
+		}
+		skip.Names = append(skip.Names, entry)
+	}
+	return skip, nil
+}
+
+// String lists the names and heights as DAEMON_SKIP_UPGRADES takes them
+func (s SkipUpgrades) String() string {
+	entries := append([]string(nil), s.Names...)
+	for _, height := range s.Heights {
+		entries = append(entries, strconv.FormatInt(height, 10))
+	}
+	return strings.Join(entries, ",")
+}
+
+// skipsUpgrade returns true if DAEMON_SKIP_UPGRADES names the upgrade or its height
+func (cfg *Config) skipsUpgrade(info *UpgradeInfo) bool {
+	for _, name := range cfg.SkipUpgrades.Names {
+		if name == info.Name {
+			return true
+		}
+	}
+	for _, height := range cfg.SkipUpgrades.Heights {
+		if info.Height > 0 && height == info.Height {
+			return true
+		}
+	}
+	return false
+}
+
+// skipHeights returns the heights the daemon is started to skip: the configured ones,
+// those the upgrades skipped by name were found at, and the height of the plan file if it
+// names one, as after a restart at the upgrade height
+func (cfg *Config) skipHeights() []int64 {
+	if len(cfg.SkipUpgrades.Names) == 0 && len(cfg.SkipUpgrades.Heights) == 0 {
+		return nil
+	}
+	seen := map[int64]bool{}
+	for _, height := range cfg.SkipUpgrades.Heights {
+		seen[height] = true
+	}
+	skipped, err := cfg.SkippedUpgrades()
+	if err != nil {
+		logger.Warnf("reading the skipped upgrades: %v", err)
+	}
+	for _, s := range skipped {
+		if cfg.skipsUpgrade(&UpgradeInfo{Name: s.Name}) {
+			seen[s.Height] = true
+		}
+	}
+	if plan, err := cfg.PlanFile(); err == nil && plan != nil && plan.Height > 0 && cfg.skipsUpgrade(plan) {
+		seen[plan.Height] = true
+	}
+	heights := make([]int64, 0, len(seen))
+	for height := range seen {
+		heights = append(heights, height)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights
+}
+
+// SkippedUpgrades returns the upgrades skipped by name, at the heights the app halted for
+// them
+func (cfg *Config) SkippedUpgrades() ([]SkippedUpgrade, error) {
+	skipped := []SkippedUpgrade{}
+	if _, err := cfg.readStateFile(skippedFile, &skipped); err != nil {
+		return nil, err
+	}
+	return skipped, nil
+}
+
+// skipUpgrade records the upgrade the app halted for as skipped, so the daemon is launched
+// again with its height. An upgrade scheduled by time can't be skipped, the app only takes
+// heights.
+func (cfg *Config) skipUpgrade(info *UpgradeInfo) error {
+	if info.Height <= 0 {
+		return fmt.Errorf("upgrade %q is scheduled by time, %s only skips upgrades by height", info.Name, skipUpgradesFlag)
+	}
+	skipped, err := cfg.SkippedUpgrades()
+	if err != nil {
+		return err
+	}
+	for _, s := range skipped {
+		if s.Name == info.Name && s.Height == info.Height {
+			return nil
+		}
+	}
+	skipped = append(skipped, SkippedUpgrade{Name: info.Name, Height: info.Height, SkippedAt: NowUTC()})
+	if err := cfg.writeStateFile(skippedFile, skipped); err != nil {
+		return fmt.Errorf("recording the skipped upgrade %q: %w", info.Name, err)
+	}
+	return nil
+}
+
+// withSkipUpgrades returns args with --unsafe-skip-upgrades and the heights to skip
+// appended, if args start the daemon. The app adds them to heights args skip already.
+func (cfg *Config) withSkipUpgrades(args []string) []string {
+	heights := cfg.skipHeights()
+	if len(heights) == 0 {
+		return args
+	}
+	// flags go before --, the arguments after it are passed on as they are
+	end := len(args)
+	start := false
+	for i, arg := range args {
+		if arg == "--" {
+			end = i
+			break
+		}
+		start = start || arg == startCommand
+	}
+	if !start {
+		return args
+	}
+	withSkip := append(append([]string(nil), args[:end]...), skipFlag(heights))
+	return append(withSkip, args[end:]...)
+}
+
+// skipFlag is --unsafe-skip-upgrades with the heights
+func skipFlag(heights []int64) string {
+	values := make([]string, len(heights))
+	for i, height := range heights {
+		values[i] = strconv.FormatInt(height, 10)
+	}
+	return skipUpgradesFlag + "=" + strings.Join(values, ",")
+}
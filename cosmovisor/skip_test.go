@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSkipUpgrades(t *testing.T) {
+	skip, err := parseSkipUpgrades(" v7 ,1200,,v8,1500 ")
+	require.NoError(t, err)
+	require.Equal(t, SkipUpgrades{Names: []string{"v7", "v8"}, Heights: []int64{1200, 1500}}, skip)
+	require.Equal(t, "v7,v8,1200,1500", skip.String())
+
+	skip, err = parseSkipUpgrades("")
+	require.NoError(t, err)
+	require.Equal(t, SkipUpgrades{}, skip)
+
+	_, err = parseSkipUpgrades("0")
+	require.EqualError(t, err, "height must be positive, not 0")
+	_, err = parseSkipUpgrades("v7,..")
+	require.EqualError(t, err, `invalid upgrade name ".."`)
+}
+
+func TestWithSkipUpgrades(t *testing.T) {
+	cfg := heightHome(t, "")
+	require.Equal(t, []string{"start"}, cfg.withSkipUpgrades([]string{"start"}))
+
+	cfg.SkipUpgrades = SkipUpgrades{Names: []string{"chain2"}, Heights: []int64{1500, 1200}}
+	require.Equal(t, []string{"start", "--unsafe-skip-upgrades=1200,1500"}, cfg.withSkipUpgrades([]string{"start"}))
+	require.Equal(t, []string{"--home", "/h", "start", "--unsafe-skip-upgrades=1200,1500", "--", "x"},
+		cfg.withSkipUpgrades([]string{"--home", "/h", "start", "--", "x"}))
+	// only start takes the flag
+	require.Equal(t, []string{"version"}, cfg.withSkipUpgrades([]string{"version"}))
+	require.Equal(t, []string{"version", "--", "start"}, cfg.withSkipUpgrades([]string{"version", "--", "start"}))
+
+	// the app halted for an upgrade skipped by name, its height comes from the plan file
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), upgradeInfoFile), []byte(`{"name": "chain2", "height": 900}`), 0644))
+	require.Equal(t, []int64{900, 1200, 1500}, cfg.skipHeights())
+
+	// and once recorded, from the state after the plan file is gone
+	require.NoError(t, cfg.skipUpgrade(&UpgradeInfo{Name: "chain2", Height: 900}))
+	require.NoError(t, cfg.skipUpgrade(&UpgradeInfo{Name: "chain2", Height: 900}))
+	require.NoError(t, os.Remove(filepath.Join(cfg.DataDir(), upgradeInfoFile)))
+	require.Equal(t, []int64{900, 1200, 1500}, cfg.skipHeights())
+	skipped, err := cfg.SkippedUpgrades()
+	require.NoError(t, err)
+	require.Len(t, skipped, 1)
+
+	// an upgrade no longer skipped is applied
+	cfg.SkipUpgrades.Names = nil
+	require.Equal(t, []int64{1200, 1500}, cfg.skipHeights())
+
+	err = cfg.skipUpgrade(&UpgradeInfo{Name: "chain3"})
+	require.EqualError(t, err, `upgrade "chain3" is scheduled by time, --unsafe-skip-upgrades only skips upgrades by height`)
+}
+
+func TestStartupPlanCheckSkips(t *testing.T) {
+	// the node reached the plan, but it is skipped
+	cfg := heightHome(t, "new-snapshot")
+	cfg.SkipUpgrades = SkipUpgrades{Names: []string{"chain2"}}
+	check, err := cfg.CheckPlanHeight()
+	require.NoError(t, err)
+	require.Equal(t, PlanActionSkip, check.Action)
+	require.NoError(t, StartupPlanCheck(cfg))
+	require.Equal(t, cfg.GenesisBin(), mustCurrentBin(t, cfg))
+	require.Equal(t, []string{"start", "--unsafe-skip-upgrades=500"}, cfg.withSkipUpgrades([]string{"start"}))
+
+	// skipped by height, with the height unknown
+	cfg = heightHome(t, "")
+	cfg.SkipUpgrades = SkipUpgrades{Heights: []int64{500}}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), upgradeInfoFile), []byte(`{"name": "chain2", "height": 500}`), 0644))
+	check, err = cfg.CheckPlanHeight()
+	require.NoError(t, err)
+	require.Equal(t, PlanActionSkip, check.Action)
+}
@@ -0,0 +1,118 @@
+package cosmovisor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// snapshotsDir holds the state sync snapshots of the application in the data directory
+	snapshotsDir = "snapshots"
+	// snapshotMetadata is the database listing the snapshots, needed to restore one
+	snapshotMetadata = "metadata.db"
+)
+
+// snapshotsDir is where the application keeps its state sync snapshots
+func (cfg *Config) snapshotsDir() string {
+	return filepath.Join(cfg.DataDir(), snapshotsDir)
+}
+
+// latestSnapshot returns the height of the newest state sync snapshot in dir. The
+// snapshot store keeps each one as <height>/<format>/<chunk>, next to the metadata
+// database; a height without chunks is left alone, it may be an aborted snapshot.
+func latestSnapshot(dir string) (int64, error) {
+	if _, err := os.Stat(filepath.Join(dir, snapshotMetadata)); err != nil {
+		return 0, fmt.Errorf("no state sync snapshots in %s, set snapshot-interval in app.toml: %w", dir, err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var latest int64
+	for _, entry := range entries {
+		height, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil || !entry.IsDir() || height <= latest {
+			continue
+		}
+		if hasChunks(filepath.Join(dir, entry.Name())) {
+			latest = height
+		}
+	}
+	if latest == 0 {
+		return 0, fmt.Errorf("no state sync snapshot in %s yet", dir)
+	}
+	return latest, nil
+}
+
+// hasChunks returns true if a format directory of the snapshot at dir holds chunks
+func hasChunks(dir string) bool {
+	formats, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, format := range formats {
+		if !format.IsDir() {
+			continue
+		}
+		if chunks, err := ioutil.ReadDir(filepath.Join(dir, format.Name())); err == nil && len(chunks) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotSkip returns true for the paths of the data directory that aren't part of the
+// snapshot at height or the snapshot metadata, so the backup unpacks into the data
+// directory as the snapshot store had it
+func (cfg *Config) snapshotSkip(height int64) func(string) bool {
+	keep := []string{
+		filepath.Join(snapshotsDir, snapshotMetadata),
+		filepath.Join(snapshotsDir, strconv.FormatInt(height, 10)),
+	}
+	return func(path string) bool {
+		rel, err := filepath.Rel(cfg.DataDir(), path)
+		if err != nil || rel == "." || rel == snapshotsDir {
+			return false
+		}
+		for _, k := range keep {
+			if rel == k || strings.HasPrefix(rel, k+string(filepath.Separator)) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// takeSnapshot runs DataBackupSnapshotCommand with the old binary of the plan, so the
+// snapshot backed up is of the height the node halted at rather than the last one the
+// snapshot interval made. It is bounded by the export timeout.
+func (cfg *Config) takeSnapshot(plan *UpgradePlan) error {
+	data := backupTemplateData{
+		Home:    cfg.Home,
+		DataDir: cfg.DataDir(),
+		Name:    plan.Info.Name,
+		Height:  plan.Info.Height,
+		Time:    FormatTimestamp(NowUTC()),
+	}
+	args, err := renderCommand("snapshot", cfg.DataBackupSnapshotCommand, data)
+	if err != nil {
+		return err
+	}
+	timeout := cfg.exportTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	logger.Infof("taking a state sync snapshot with %s %s", plan.OldBin, strings.Join(args, " "))
+	out, err := cfg.daemonCommand(ctx, plan.OldBin, args...).CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("the snapshot didn't finish within %s", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", plan.OldBin, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
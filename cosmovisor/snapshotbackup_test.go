@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeSnapshot adds the chunks of a snapshot at height to the snapshot store of cfg
+func writeSnapshot(t *testing.T, cfg *Config, height int64, chunks ...string) {
+	dir := filepath.Join(cfg.snapshotsDir(), fmt.Sprint(height), "3")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(cfg.snapshotsDir(), snapshotMetadata), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.snapshotsDir(), snapshotMetadata, "CURRENT"), []byte("MANIFEST-000001"), 0644))
+	for i, chunk := range chunks {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(i)), []byte(chunk), 0644))
+	}
+}
+
+func TestLatestSnapshot(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	_, err := latestSnapshot(cfg.snapshotsDir())
+	require.Error(t, err, "no snapshot store")
+
+	writeSnapshot(t, cfg, 900, "a")
+	writeSnapshot(t, cfg, 1200, "b", "c")
+	// an aborted snapshot has no chunks
+	writeSnapshot(t, cfg, 1500)
+	height, err := latestSnapshot(cfg.snapshotsDir())
+	require.NoError(t, err)
+	require.Equal(t, int64(1200), height)
+}
+
+func TestBackupDataSnapshot(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", DataBackup: DataBackupSnapshot, DataBackupName: "{{.Name}}"}
+	require.NoError(t, os.MkdirAll(filepath.Join(cfg.DataDir(), "blockstore.db"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "blockstore.db", "000001.log"), []byte("blocks"), 0644))
+	phase := NewUpgradeTimings("v2").Phase("data-backup")
+	require.Error(t, cfg.backupData(&UpgradeInfo{Name: "v2", Height: 1300}, phase), "there is no snapshot yet")
+
+	writeSnapshot(t, cfg, 900, "old")
+	writeSnapshot(t, cfg, 1200, "b", "c")
+	require.NoError(t, cfg.backupData(&UpgradeInfo{Name: "v2", Height: 1300}, phase))
+	require.Equal(t, "1200", phase.Attributes["snapshot_height"])
+	require.Empty(t, phase.Attributes["excluded"])
+
+	path := filepath.Join(cfg.StateDir(), backupsDir, "v2"+dataArchiveExt)
+	entries := readArchive(t, path)
+	require.Equal(t, "b", entries["data/snapshots/1200/3/0"])
+	require.Equal(t, "c", entries["data/snapshots/1200/3/1"])
+	require.Contains(t, entries, "data/snapshots/metadata.db/CURRENT")
+	require.NotContains(t, entries, "data/snapshots/900/3/0")
+	require.NotContains(t, entries, "data/blockstore.db/000001.log")
+
+	manifest, err := VerifyDataBackup(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(1200), manifest.Snapshot)
+	_, err = Restore(cfg, path, RestoreOptions{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "holds the state sync snapshot at height 1200")
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", DataBackup: DataBackupSnapshot, DataBackupName: "{{.Name}}",
+		DataBackupSnapshotCommand: "snapshots export --home {{.Home}} --height {{.Height}}"}
+	bin := filepath.Join(t.TempDir(), "dummyd")
+	// the old binary writes a snapshot at the height before the upgrade
+	require.NoError(t, ioutil.WriteFile(bin, []byte(`#!/bin/sh
+[ "$1 $2 $5 $6" = "snapshots export --height 1300" ] || exit 1
+dir="$4/data/snapshots"
+mkdir -p "$dir/metadata.db" "$dir/1299/3"
+echo halted > "$dir/1299/3/0"
+`), 0755))
+	writeSnapshot(t, cfg, 1200, "b")
+	timings := NewUpgradeTimings("v2")
+	require.NoError(t, cfg.backupBeforeSwitch(&UpgradePlan{Info: &UpgradeInfo{Name: "v2", Height: 1300}, OldBin: bin}, timings))
+	require.Equal(t, "1299", timings.Phases[0].Attributes["snapshot_height"])
+	entries := readArchive(t, filepath.Join(cfg.StateDir(), backupsDir, "v2"+dataArchiveExt))
+	require.Equal(t, "halted\n", entries["data/snapshots/1299/3/0"])
+
+	// a failed snapshot fails the upgrade
+	cfg.DataBackupSnapshotCommand = "snapshots dump"
+	require.Error(t, cfg.backupBeforeSwitch(&UpgradePlan{Info: &UpgradeInfo{Name: "v3", Height: 1400}, OldBin: bin}, NewUpgradeTimings("v3")))
+}
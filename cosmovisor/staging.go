@@ -0,0 +1,111 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/otiai10/copy"
+)
+
+// stagingPrefix starts the names of the staging directories of the downloads
+const stagingPrefix = "upgrade-"
+
+// stagingPath is the directory downloads are unpacked and verified in before they are
+// installed, DownloadStagingDir if set, else the directory of the temporary files
+func (cfg *Config) stagingPath() string {
+	if cfg.DownloadStagingDir != "" {
+		return cfg.DownloadStagingDir
+	}
+	return cfg.tmpPath()
+}
+
+// newStagingDir creates an empty directory to download upgrade name into. Those left by a
+// cosmovisor stopped while downloading it are removed first.
+func (cfg *Config) newStagingDir(fs fsGuard, name string) (string, error) {
+	dir := cfg.stagingPath()
+	if err := fs.mkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	pattern := stagingPrefix + name + "-"
+	if stale, err := filepath.Glob(filepath.Join(dir, pattern+"*")); err == nil {
+		for _, path := range stale {
+			logger.Infof("removing the partial download %s", path)
+			if err := fs.removeAll(path); err != nil {
+				logger.Warnf("removing the partial download %s: %v", path, err)
+			}
+		}
+	}
+	return fs.mkdirTemp(dir, pattern)
+}
+
+// installStaged moves the download verified in staging into the upgrade directory dir. The
+// binary at bin, relative to staging, is moved last, once the other files are in place and
+// the overrides name it, so the daemon is never launched from a partial download. Each file
+// is replaced at once, see installFile.
+func (cfg *Config) installStaged(fs fsGuard, staging, dir, bin, binaryName string) error {
+	if err := fs.mkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	if err := checkNotWorldWritable(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	o, chown := cfg.stagedOwner()
+	err := filepath.Walk(staging, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(staging, path)
+		if err != nil || rel == bin {
+			return err
+		}
+		dst := filepath.Join(dir, rel)
+		if !info.IsDir() {
+			return installFile(fs, path, dst)
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			return nil
+		}
+		if err := fs.mkdirAll(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if chown {
+			return fs.lchown(dst, o.uid, o.gid)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("installing the download into %s: %w", dir, err)
+	}
+	if binaryName != "" {
+		if err := cfg.writeBinaryName(dir, binaryName); err != nil {
+			return err
+		}
+	}
+	if err := installFile(fs, filepath.Join(staging, bin), filepath.Join(dir, bin)); err != nil {
+		return fmt.Errorf("installing the binary into %s: %w", dir, err)
+	}
+	return nil
+}
+
+// installFile moves the file src to dst with a rename, which replaces dst at once. If it
+// fails, as across file systems, src is copied next to dst first, and renamed over it.
+func installFile(fs fsGuard, src, dst string) error {
+	if err := fs.rename(src, dst); err == nil {
+		return nil
+	}
+	tmp := dst + ".tmp"
+	fs.removeAll(tmp)
+	if err := fs.check("copy", tmp); err != nil {
+		return err
+	}
+	if err := copy.Copy(src, tmp); err != nil {
+		fs.removeAll(tmp)
+		return err
+	}
+	if err := fs.rename(tmp, dst); err != nil {
+		fs.removeAll(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+)
+
+// stagingDownloader fails the test if the upgrade directory holds a binary while a download
+// is fetched
+type stagingDownloader struct {
+	recordingDownloader
+	t   *testing.T
+	cfg *Config
+}
+
+func (d *stagingDownloader) Download(src, dst string) error {
+	require.NoFileExists(d.t, d.cfg.UpgradeBin("amazonas"), "the binary is installed while it is downloaded")
+	require.False(d.t, insideDir(d.cfg.UpgradeDir("amazonas"), dst), "downloading into the upgrade directory")
+	return d.recordingDownloader.Download(src, dst)
+}
+
+func TestDownloadBinaryStaged(t *testing.T) {
+	raw, err := filepath.Abs(filepath.Join("testdata", "repo", "raw_binary", "autod"))
+	require.NoError(t, err)
+	sum := "?checksum=sha256:e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d"
+
+	cases := map[string]struct {
+		url       string
+		preflight string
+		err       string
+	}{
+		"installed":          {url: raw + sum},
+		"passes preflight":   {url: raw + sum, preflight: "Chain 2 is live"},
+		"fails preflight":    {url: raw + sum, preflight: "v9.9.9", err: `DAEMON_PREFLIGHT_VERSION expects "v9.9.9"`},
+		"checksum mismatch":  {url: raw + "?checksum=sha256:73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906", err: "checksum"},
+		"missing on mirrors": {url: filepath.Join(filepath.Dir(raw), "missing") + sum, err: "missing"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home := t.TempDir()
+			require.NoError(t, copy.Copy(filepath.Join("testdata", "download"), home))
+			cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, PreflightVersion: tc.preflight,
+				DownloadStagingDir: filepath.Join(t.TempDir(), "staging"), DownloadAttempts: 1}
+			cfg.Downloader = &stagingDownloader{t: t, cfg: cfg}
+			// a download left by a cosmovisor killed while fetching it
+			stale := filepath.Join(cfg.stagingPath(), stagingPrefix+"amazonas-123")
+			require.NoError(t, os.MkdirAll(filepath.Join(stale, "bin"), 0755))
+			info := &UpgradeInfo{Name: "amazonas", Info: fmt.Sprintf(`{"binaries": {"any": "%s"}}`, tc.url)}
+
+			err := DownloadBinary(cfg, info)
+			staged, rerr := ioutil.ReadDir(cfg.stagingPath())
+			require.NoError(t, rerr)
+			require.Empty(t, staged, "the staging directories are removed")
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				require.NoDirExists(t, cfg.UpgradeDir("amazonas"))
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, EnsureBinary(cfg.UpgradeBin("amazonas")))
+		})
+	}
+}
+
+func TestInstallStaged(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	staging := t.TempDir()
+	for path, content := range map[string]string{"bin/gaiad": "#!/bin/sh\n", "lib/libwasmvm.so": "lib", "README": "new"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(staging, filepath.Dir(path)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(staging, path), []byte(content), 0755))
+	}
+	// the upgrade directory was prepared with overrides and a file the download replaces
+	dir := cfg.UpgradeDir("v2")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, overridesFile), []byte(`{"args": ["--x-crisis-skip-assert-invariants"]}`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("old"), 0644))
+
+	require.NoError(t, cfg.installStaged(cfg.fs(), staging, dir, filepath.Join("bin", "gaiad"), "gaiad"))
+	for path, content := range map[string]string{"bin/gaiad": "#!/bin/sh\n", "lib/libwasmvm.so": "lib", "README": "new"} {
+		bz, err := ioutil.ReadFile(filepath.Join(dir, path))
+		require.NoError(t, err)
+		require.Equal(t, content, string(bz))
+		require.NoFileExists(t, filepath.Join(staging, path))
+	}
+	o, err := readOverrides(dir)
+	require.NoError(t, err)
+	require.Equal(t, &LaunchOverrides{Binary: "gaiad", Args: []string{"--x-crisis-skip-assert-invariants"}}, o)
+	require.NoError(t, EnsureBinary(filepath.Join(dir, "bin", "gaiad")))
+
+	// a world writable upgrades directory is refused before anything is installed
+	require.NoError(t, os.Chmod(filepath.Dir(dir), 0777))
+	require.Error(t, cfg.installStaged(cfg.fs(), t.TempDir(), cfg.UpgradeDir("v3"), filepath.Join("bin", "dummyd"), ""))
+	require.NoDirExists(t, cfg.UpgradeDir("v3"))
+}
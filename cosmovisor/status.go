@@ -0,0 +1,201 @@
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// Status is the state of a node's cosmovisor directory, read without changing anything
+type Status struct {
+	// Binary is the binary the daemon is started from
+	Binary string `json:"binary"`
+	// Upgrade names the upgrade Binary belongs to, empty for the genesis binary
+	Upgrade string `json:"upgrade,omitempty"`
+	// Linked is false if there is no current link yet and Binary is the genesis binary
+	Linked bool `json:"linked"`
+	// Running is the daemon a cosmovisor process supervises right now, nil if none does
+	Running *RunState `json:"running,omitempty"`
+	// UptimeSeconds is how long the running daemon has been up
+	UptimeSeconds int64 `json:"uptime_seconds,omitempty"`
+	// Pause is the pause of the supervision, nil if it isn't paused
+	Pause *PauseState `json:"pause,omitempty"`
+	// LastUpgrade is the upgrade cosmovisor switched to last
+	LastUpgrade *AppliedUpgrade `json:"last_upgrade,omitempty"`
+	// RolledBack is the upgrade rolled back last, set while cosmovisor refuses to start
+	RolledBack *RollbackRecord `json:"rolled_back,omitempty"`
+	// Journal is the upgrade in progress, or that cosmovisor was stopped in, nil if none is
+	Journal *UpgradeJournal `json:"journal,omitempty"`
+	// Immutable is set if the layout is read-only, the state is kept in StateDir
+	Immutable bool   `json:"immutable"`
+	StateDir  string `json:"state_dir"`
+	// Plan is the upgrade plan the app wrote to its data directory, nil if there is none
+	Plan *UpgradeInfo `json:"plan,omitempty"`
+	// PlanPending is set if Plan isn't the upgrade Binary belongs to yet
+	PlanPending bool          `json:"plan_pending"`
+	Queue       []*QueuedPlan `json:"queue"`
+	// Upgrades are the upgrade directories, whether staged by add-upgrade or by hand
+	Upgrades     []*StagedUpgrade `json:"upgrades"`
+	Hotfix       *Hotfix          `json:"hotfix,omitempty"`
+	CrashReports []string         `json:"crash_reports"`
+}
+
+// GetStatus reads the status of the home of cfg. It only reads, so it can be used on the
+// home of a node supervised by another cosmovisor process.
+func GetStatus(cfg *Config) (*Status, error) {
+	s := &Status{Immutable: cfg.Immutable, StateDir: cfg.StateDir()}
+	s.Binary, s.Linked = cfg.resolveCurrentBin()
+	s.Upgrade = cfg.upgradeOf(s.Binary)
+
+	var err error
+	if s.Running, err = cfg.RunState(); err != nil {
+		return nil, err
+	}
+	if s.Running != nil {
+		s.UptimeSeconds = int64(NowUTC().Sub(s.Running.StartedAt) / time.Second)
+	}
+	if s.Pause, err = cfg.PauseState(); err != nil {
+		return nil, err
+	}
+	if s.LastUpgrade, err = cfg.LastUpgrade(); err != nil {
+		return nil, err
+	}
+	var rolledBack *RolledBackError
+	if err := cfg.checkRolledBack(); errors.As(err, &rolledBack) {
+		s.RolledBack = &rolledBack.Record
+	} else if err != nil {
+		return nil, err
+	}
+	if s.Journal, err = cfg.UpgradeJournal(); err != nil {
+		return nil, err
+	}
+	if s.Journal != nil && s.Journal.done() {
+		s.Journal = nil
+	}
+	if s.Plan, err = cfg.PlanFile(); err != nil {
+		return nil, fmt.Errorf("invalid plan file: %w", err)
+	}
+	s.PlanPending = s.Plan != nil && s.Plan.Name != s.Upgrade
+	if s.Queue, err = cfg.UpgradeQueue(); err != nil {
+		return nil, fmt.Errorf("invalid upgrade queue in %s: %w", cfg.QueueDir(), err)
+	}
+	if s.Upgrades, err = cfg.StagedUpgrades(); err != nil {
+		return nil, err
+	}
+	if s.Hotfix, err = cfg.PendingHotfix(); err != nil {
+		return nil, fmt.Errorf("invalid hotfix in %s: %w", cfg.HotfixDir(), err)
+	}
+	if s.CrashReports, err = cfg.CrashReports(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// upgradeOf returns the name of the upgrade directory holding bin, or "" for genesis and
+// binaries outside the layout
+func (cfg *Config) upgradeOf(bin string) string {
+	dir := filepath.Dir(filepath.Dir(bin))
+	if filepath.Dir(dir) != cfg.upgradesPath() {
+		return ""
+	}
+	name, err := url.PathUnescape(filepath.Base(dir))
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// WriteStatus prints the status as aligned columns
+func WriteStatus(w io.Writer, s *Status) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	version := "genesis"
+	if s.Upgrade != "" {
+		version = fmt.Sprintf("upgrade %q", s.Upgrade)
+	}
+	if !s.Linked {
+		version += ", no current link yet"
+	}
+	fmt.Fprintf(tw, "binary\t%s (%s)\n", s.Binary, version)
+	if s.Running != nil {
+		uptime := time.Duration(s.UptimeSeconds) * time.Second
+		fmt.Fprintf(tw, "running\tdaemon pid %d, up %s since %s, cosmovisor pid %d\n",
+			s.Running.DaemonPID, uptime, s.Running.StartedAt.Format(time.RFC3339), s.Running.PID)
+	} else {
+		fmt.Fprintf(tw, "running\tno\n")
+	}
+	if p := s.Pause; p != nil {
+		deferred := ""
+		if p.Deferred != nil {
+			deferred = fmt.Sprintf(", upgrade %q deferred", p.Deferred.Name)
+		}
+		fmt.Fprintf(tw, "paused\tsince %s, cosmovisor pid %d%s\n", p.Since.Format(time.RFC3339), p.PID, deferred)
+	}
+	if s.LastUpgrade != nil {
+		verification := ""
+		if v := s.LastUpgrade.Verification; v != nil {
+			verification = ", " + verificationStatus(v)
+		}
+		if h := s.LastUpgrade.Health; h != nil {
+			verification += ", " + healthStatus(h)
+		}
+		fmt.Fprintf(tw, "last\tupgrade %q at height %d, applied %s%s\n", s.LastUpgrade.Name, s.LastUpgrade.Height, s.LastUpgrade.AppliedAt.Format(time.RFC3339), verification)
+	}
+	if r := s.RolledBack; r != nil {
+		fmt.Fprintf(tw, "revert\tupgrade %q rolled back %s, cosmovisor won't start until %s is removed\n", r.Upgrade, r.RolledBackAt.Format(time.RFC3339), filepath.Join(s.StateDir, rollbackFile))
+	}
+	if j := s.Journal; j != nil {
+		fmt.Fprintf(tw, "journal\tupgrade %q started %s, completed step %s\n", j.Info.Name, j.StartedAt.Format(time.RFC3339), j.Step)
+	}
+	if s.Immutable {
+		fmt.Fprintf(tw, "layout\timmutable layout, state in %s\n", s.StateDir)
+	}
+
+	if s.Plan != nil {
+		state := "pending"
+		if !s.PlanPending {
+			state = "applied"
+		}
+		fmt.Fprintf(tw, "plan\t%q at height %d, %s\n", s.Plan.Name, s.Plan.Height, state)
+	} else {
+		fmt.Fprintf(tw, "plan\tnone\n")
+	}
+	if len(s.Queue) == 0 {
+		fmt.Fprintf(tw, "queue\tempty\n")
+	}
+	for i, p := range s.Queue {
+		fmt.Fprintf(tw, "queue\t%d. %q at height %d (%s)\n", i+1, p.Name, p.Height, p.File)
+	}
+	for _, u := range s.Upgrades {
+		fmt.Fprintf(tw, "upgrade\t%q %s\n", u.Name, describeStaged(u))
+	}
+	if s.Hotfix != nil {
+		fmt.Fprintf(tw, "hotfix\tpending for the binary with sha256 %s\n", s.Hotfix.BaseSHA256)
+	} else {
+		fmt.Fprintf(tw, "hotfix\tnone\n")
+	}
+	if n := len(s.CrashReports); n > 0 {
+		fmt.Fprintf(tw, "crashes\t%d reports, the latest is %s\n", n, s.CrashReports[n-1])
+	} else {
+		fmt.Fprintf(tw, "crashes\tnone\n")
+	}
+	return tw.Flush()
+}
+
+// describeStaged sums up what is known about a staged upgrade
+func describeStaged(u *StagedUpgrade) string {
+	if u.Err != nil {
+		return fmt.Sprintf("can't be run: %v", u.Err)
+	}
+	desc := "staged"
+	if u.Height > 0 {
+		desc += fmt.Sprintf(" for height %d", u.Height)
+	}
+	if u.Source != "" {
+		desc += " from " + u.Source
+	}
+	return desc
+}
@@ -0,0 +1,63 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetStatus(t *testing.T) {
+	cfg := readOnlyHome(t)
+	cfg.ReadOnly = true
+	s, err := GetStatus(cfg)
+	require.NoError(t, err)
+	require.Equal(t, cfg.GenesisBin(), s.Binary)
+	require.Empty(t, s.Upgrade)
+	require.False(t, s.Linked)
+	require.Nil(t, s.Plan)
+	require.Len(t, s.Queue, 2)
+	require.NotNil(t, s.Hotfix)
+	require.Len(t, s.CrashReports, 1)
+
+	// after an upgrade with a plan pending
+	cfg.ReadOnly = false
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	require.NoError(t, os.MkdirAll(filepath.Join(cfg.Home, "data"), 0755))
+	plan := `{"name": "chain3", "height": 120}`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.Home, "data", "upgrade-info.json"), []byte(plan), 0644))
+	s, err = GetStatus(cfg)
+	require.NoError(t, err)
+	require.Equal(t, cfg.UpgradeBin("chain2"), s.Binary)
+	require.Equal(t, "chain2", s.Upgrade)
+	require.True(t, s.Linked)
+	require.Equal(t, &UpgradeInfo{Name: "chain3", Height: 120}, s.Plan)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteStatus(&buf, s))
+	require.Contains(t, buf.String(), `(upgrade "chain2")`)
+	require.Contains(t, buf.String(), `plan     "chain3" at height 120, pending`)
+	require.Contains(t, buf.String(), "running  no\n")
+	require.Contains(t, buf.String(), `queue    2. "chain3" at height 49 (2-chain3.json)`)
+	require.Contains(t, buf.String(), "crashes  1 reports")
+}
+
+func TestStatusImmutableLayout(t *testing.T) {
+	cfg := readOnlyHome(t)
+	cfg.Immutable = true
+	cfg.WritableRoot = t.TempDir()
+	require.NoError(t, cfg.writeCurrentPointer(cfg.UpgradeDir("chain2")))
+
+	s, err := GetStatus(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "chain2", s.Upgrade)
+	var buf bytes.Buffer
+	require.NoError(t, WriteStatus(&buf, s))
+	require.Contains(t, buf.String(), "layout   immutable layout, state in "+cfg.StateDir())
+}
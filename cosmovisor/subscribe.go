@@ -0,0 +1,99 @@
+package cosmovisor
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// subscriptionBuffer is how many events a subscription of SubscribeFunc holds while its
+// function runs
+const subscriptionBuffer = 256
+
+// Subscription receives the events of cosmovisor in this process as they are recorded, the
+// notified ones and those only written to the event log, for programs embedding it to act
+// on them, e.g. to restart other nodes once an upgrade switched the binary
+type Subscription struct {
+	// C receives the events, in order. It is closed by Close.
+	C <-chan Event
+
+	c       chan Event
+	types   []string
+	dropped uint64
+}
+
+var subscriptions struct {
+	mutex sync.Mutex
+	subs  []*Subscription
+}
+
+// Subscribe returns a subscription to the events of the given types, to all events without
+// types. C holds up to buffer events: the supervision never waits for a subscriber, an
+// event that doesn't fit is dropped for it and counted by Dropped.
+func Subscribe(buffer int, types ...string) *Subscription {
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, types: types}
+	subscriptions.mutex.Lock()
+	defer subscriptions.mutex.Unlock()
+	subscriptions.subs = append(subscriptions.subs, s)
+	return s
+}
+
+// SubscribeFunc calls fn with the events of the given types, all events without types, one
+// at a time and in order, from a goroutine of its own. It returns the function ending the
+// subscription; the events already received are still passed to fn.
+func SubscribeFunc(fn func(Event), types ...string) (unsubscribe func()) {
+	s := Subscribe(subscriptionBuffer, types...)
+	go func() {
+		for ev := range s.C {
+			fn(ev)
+		}
+	}()
+	return s.Close
+}
+
+// Close ends the subscription and closes C, the events in C can still be read
+func (s *Subscription) Close() {
+	subscriptions.mutex.Lock()
+	defer subscriptions.mutex.Unlock()
+	for i, sub := range subscriptions.subs {
+		if sub == s {
+			subscriptions.subs = append(subscriptions.subs[:i:i], subscriptions.subs[i+1:]...)
+			close(s.c)
+			return
+		}
+	}
+}
+
+// Dropped is the number of events dropped as C was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// wants returns true if the subscription is to events of type typ
+func (s *Subscription) wants(typ string) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, t := range s.types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// publish passes the event to the subscriptions to its type
+func publish(ev Event) {
+	subscriptions.mutex.Lock()
+	defer subscriptions.mutex.Unlock()
+	for _, s := range subscriptions.subs {
+		if !s.wants(ev.Type) {
+			continue
+		}
+		select {
+		case s.c <- ev:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
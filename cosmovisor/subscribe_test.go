@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	all := Subscribe(10)
+	defer all.Close()
+	crashes := Subscribe(1, EventCrash)
+	defer crashes.Close()
+
+	publish(NewEvent(EventNodeStalled, "", "stalled"))
+	publish(NewEvent(EventCrash, "", "first"))
+	publish(NewEvent(EventCrash, "", "second"))
+
+	require.Equal(t, EventNodeStalled, (<-all.C).Type)
+	require.Equal(t, "first", (<-all.C).Message)
+	require.Equal(t, "second", (<-all.C).Message)
+	// the second crash didn't fit
+	require.Equal(t, "first", (<-crashes.C).Message)
+	require.Equal(t, uint64(1), crashes.Dropped())
+	require.Zero(t, all.Dropped())
+
+	crashes.Close()
+	_, open := <-crashes.C
+	require.False(t, open)
+	publish(NewEvent(EventCrash, "", "third"))
+	require.Equal(t, "third", (<-all.C).Message)
+	crashes.Close()
+
+	received := make(chan Event, 1)
+	unsubscribe := SubscribeFunc(func(ev Event) { received <- ev }, EventNodeStalled)
+	publish(NewEvent(EventCrash, "", "ignored"))
+	publish(NewEvent(EventNodeStalled, "", "stalled"))
+	require.Equal(t, "stalled", (<-received).Message)
+	unsubscribe()
+}
+
+func TestSubscribeUpgrade(t *testing.T) {
+	cfg := &Config{Home: validateHome(t), Name: "dummyd", BackupCommand: "true"}
+	// the trace of the upgrade waits for a restart that never comes
+	defer FlushUpgradeTraces(time.Second)
+	s := Subscribe(100, EventDaemonStarted, EventDaemonExited, EventUpgradeDetected, EventBackupCompleted, EventBinarySwitched)
+	defer s.Close()
+
+	upgraded, err := LaunchProcess(cfg, nil, ioutil.Discard, ioutil.Discard)
+	require.NoError(t, err)
+	require.True(t, upgraded)
+
+	var types []string
+	var switched Event
+	for len(types) < 5 {
+		select {
+		case ev := <-s.C:
+			types = append(types, ev.Type)
+			if ev.Type == EventBinarySwitched {
+				switched = ev
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing events, got %v", types)
+		}
+	}
+	require.Equal(t, []string{EventDaemonStarted, EventDaemonExited, EventUpgradeDetected, EventBackupCompleted, EventBinarySwitched}, types)
+	require.Equal(t, "chain2", switched.Upgrade)
+	require.Equal(t, int64(49), switched.Height)
+	require.Equal(t, map[string]string{"from": cfg.GenesisBin(), "to": cfg.UpgradeBin("chain2"), "reason": "upgrade"}, switched.Fields)
+}
@@ -0,0 +1,19 @@
+package cosmovisor
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/otiai10/copy"
+	"github.com/stretchr/testify/require"
+)
+
+// validateHome returns a new home with a copy of testdata/validate: the genesis binary of
+// dummyd, the upgrades chain2 and chain3, nobin without a binary and noexec with a binary
+// that isn't executable
+func validateHome(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	require.NoError(t, copy.Copy(filepath.Join("testdata", "validate"), home))
+	return home
+}
@@ -0,0 +1,81 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimestampFormat is the format of timestamps used in file and directory names.
+// It is always UTC, sorts lexically and contains no characters that need escaping.
+const TimestampFormat = "20060102T150405Z"
+
+// legacyTimestampFormats are formats older versions persisted in local time.
+// They are only ever parsed, never written.
+var legacyTimestampFormats = []string{
+	"2006-01-02-15-04-05",
+	"2006-01-02T15:04:05",
+	"2006-1-2",
+	"01-02-2006",
+}
+
+// NowUTC returns the current time in UTC. All persisted timestamps must be derived from it.
+// UTC strips the monotonic clock reading, so durations measured from it follow clock steps:
+// measure them with a Stopwatch.
+func NowUTC() time.Time {
+	return time.Now().UTC()
+}
+
+// FormatTimestamp formats t for use in file and directory names
+func FormatTimestamp(t time.Time) string {
+	return t.UTC().Format(TimestampFormat)
+}
+
+// formatLogTime formats t for the time of a log line, in RFC3339 and UTC
+func formatLogTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// ParseTimestamp parses a timestamp written by FormatTimestamp, RFC3339, or one of the local
+// time formats used by older versions. Legacy local timestamps are interpreted in the local
+// time zone and returned in UTC.
+func ParseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{TimestampFormat, time.RFC3339Nano, time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	for _, layout := range legacyTimestampFormats {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q", s)
+}
+
+// Stopwatch measures durations using the monotonic clock only, so a wall clock step
+// (e.g. an NTP correction in the middle of an upgrade) doesn't affect the result
+type Stopwatch struct {
+	start time.Time
+}
+
+// StartStopwatch starts measuring from now
+func StartStopwatch() Stopwatch {
+	return Stopwatch{start: time.Now()}
+}
+
+// Started returns the (UTC) wall clock time the stopwatch was started at
+func (s Stopwatch) Started() time.Time {
+	return s.start.UTC()
+}
+
+// running returns true unless s is the zero Stopwatch, which was never started
+func (s Stopwatch) running() bool {
+	return !s.start.IsZero()
+}
+
+// Elapsed returns the monotonic time since the stopwatch was started
+func (s Stopwatch) Elapsed() time.Duration {
+	return time.Since(s.start)
+}
@@ -0,0 +1,90 @@
+package cosmovisor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatTimestamp(t *testing.T) {
+	loc := time.FixedZone("UTC+5", 5*60*60)
+	ts := time.Date(2021, 7, 22, 15, 4, 5, 0, loc)
+
+	formatted := FormatTimestamp(ts)
+	require.Equal(t, "20210722T100405Z", formatted)
+
+	parsed, err := ParseTimestamp(formatted)
+	require.NoError(t, err)
+	require.True(t, ts.Equal(parsed))
+	require.Equal(t, time.UTC, parsed.Location())
+}
+
+func TestFormatLogTime(t *testing.T) {
+	ts := time.Date(2021, 7, 22, 15, 4, 5, 0, time.FixedZone("UTC+5", 5*60*60))
+	require.Equal(t, "2021-07-22T10:04:05Z", formatLogTime(ts))
+}
+
+func TestParseTimestamp(t *testing.T) {
+	cases := map[string]struct {
+		input  string
+		expect time.Time
+		isErr  bool
+	}{
+		"current format": {
+			input:  "20210722T100405Z",
+			expect: time.Date(2021, 7, 22, 10, 4, 5, 0, time.UTC),
+		},
+		"rfc3339": {
+			input:  "2021-07-22T12:04:05+02:00",
+			expect: time.Date(2021, 7, 22, 10, 4, 5, 0, time.UTC),
+		},
+		"legacy local with time": {
+			input:  "2021-07-22-10-04-05",
+			expect: time.Date(2021, 7, 22, 10, 4, 5, 0, time.Local),
+		},
+		"legacy local date": {
+			input:  "2021-7-2",
+			expect: time.Date(2021, 7, 2, 0, 0, 0, 0, time.Local),
+		},
+		"legacy us date": {
+			input:  "07-22-2021",
+			expect: time.Date(2021, 7, 22, 0, 0, 0, 0, time.Local),
+		},
+		"garbage": {
+			input: "yesterday",
+			isErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			parsed, err := ParseTimestamp(tc.input)
+			if tc.isErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, tc.expect.Equal(parsed), "expected %s, got %s", tc.expect, parsed)
+			require.Equal(t, time.UTC, parsed.Location())
+		})
+	}
+}
+
+func TestStopwatchIgnoresClockStep(t *testing.T) {
+	sw := StartStopwatch()
+
+	// simulate the wall clock stepping back an hour while the phase is measured:
+	// Round(0) strips the monotonic reading, so this only has the (stepped) wall clock
+	stepped := time.Now().Round(0).Add(-time.Hour)
+	naive := stepped.Sub(sw.start.Round(0))
+	require.True(t, naive < 0, "wall clock arithmetic is affected by the step")
+
+	time.Sleep(10 * time.Millisecond)
+	elapsed := sw.Elapsed()
+	require.True(t, elapsed >= 10*time.Millisecond, elapsed.String())
+	require.True(t, elapsed < time.Minute, elapsed.String())
+	require.Equal(t, time.UTC, sw.Started().Location())
+	require.True(t, sw.running())
+	require.False(t, Stopwatch{}.running())
+}
@@ -0,0 +1,79 @@
+package cosmovisor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// tmpDirName is the directory of the temporary files below the state directory
+const tmpDirName = "tmp"
+
+// startTmpDir is TMPDIR as cosmovisor was started with, saved by SaveStartTmpDir
+var startTmpDir struct {
+	sync.Mutex
+	saved bool
+	set   bool
+	value string
+}
+
+// tmpPath is the directory of the temporary files, TmpDir if set
+func (cfg *Config) tmpPath() string {
+	if cfg.TmpDir != "" {
+		return cfg.TmpDir
+	}
+	return filepath.Join(cfg.StateDir(), tmpDirName)
+}
+
+// MakeTmpDir creates the directory of the temporary files and returns it. The cosmovisor
+// command points its TMPDIR there, so that go-getter unpacks archives and fetches checksum
+// files there rather than in /tmp, which is read-only with a read-only root filesystem.
+// The package never changes the environment of the process itself.
+func (cfg *Config) MakeTmpDir() (string, error) {
+	dir := cfg.tmpPath()
+	if err := cfg.fs().mkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// SaveStartTmpDir saves TMPDIR as it is now, for a program about to point its TMPDIR at
+// MakeTmpDir: the processes cosmovisor starts get the saved TMPDIR instead. Only the first
+// call saves it.
+func SaveStartTmpDir() {
+	startTmpDir.Lock()
+	defer startTmpDir.Unlock()
+	if !startTmpDir.saved {
+		startTmpDir.value, startTmpDir.set = os.LookupEnv("TMPDIR")
+		startTmpDir.saved = true
+	}
+}
+
+// tmpDirChanged returns true once TMPDIR was saved by SaveStartTmpDir
+func tmpDirChanged() bool {
+	startTmpDir.Lock()
+	defer startTmpDir.Unlock()
+	return startTmpDir.saved
+}
+
+// environ is the environment of cosmovisor as the processes it starts get it, with TMPDIR
+// as cosmovisor was started with
+func environ() []string {
+	env := os.Environ()
+	startTmpDir.Lock()
+	defer startTmpDir.Unlock()
+	if !startTmpDir.saved {
+		return env
+	}
+	kept := env[:0]
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "TMPDIR=") {
+			kept = append(kept, kv)
+		}
+	}
+	if startTmpDir.set {
+		kept = append(kept, "TMPDIR="+startTmpDir.value)
+	}
+	return kept
+}
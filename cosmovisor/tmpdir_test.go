@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeTmpDir(t *testing.T) {
+	original, set := os.LookupEnv("TMPDIR")
+	t.Cleanup(func() {
+		if set {
+			os.Setenv("TMPDIR", original)
+		} else {
+			os.Unsetenv("TMPDIR")
+		}
+		startTmpDir.saved, startTmpDir.set, startTmpDir.value = false, false, ""
+	})
+	started := t.TempDir()
+	require.NoError(t, os.Setenv("TMPDIR", started))
+	home := t.TempDir()
+	cfg := &Config{Home: home, Name: "dummyd", StatePath: filepath.Join(home, "state")}
+	require.Nil(t, cfg.daemonEnv())
+
+	dir, err := cfg.MakeTmpDir()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(home, "state", tmpDirName), dir)
+	require.DirExists(t, dir)
+	// the environment of the process is left to the program
+	require.Equal(t, started, os.TempDir())
+	require.Nil(t, cfg.daemonEnv())
+
+	// as the cosmovisor command points its TMPDIR there, the processes it starts get
+	// TMPDIR as it was
+	SaveStartTmpDir()
+	require.NoError(t, os.Setenv("TMPDIR", dir))
+	require.Contains(t, environ(), "TMPDIR="+started)
+	require.NotContains(t, environ(), "TMPDIR="+dir)
+	require.Contains(t, cfg.daemonEnv(), "TMPDIR="+started)
+
+	// a second call doesn't lose it
+	SaveStartTmpDir()
+	require.Contains(t, environ(), "TMPDIR="+started)
+}
+
+func TestTempDirInHome(t *testing.T) {
+	home := t.TempDir()
+	cfg := &Config{Home: home, Name: "dummyd"}
+	scratch, err := cfg.fs().tempDir("cosmovisor-download")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(cfg.StateDir(), tmpDirName), filepath.Dir(scratch))
+
+	cfg.TmpDir = filepath.Join(t.TempDir(), "tmp")
+	scratch, err = cfg.fs().scratchDir("", "cosmovisor-simulate-")
+	require.NoError(t, err)
+	require.Equal(t, cfg.TmpDir, filepath.Dir(scratch))
+
+	// nothing is written outside of the home if the directory can't be created
+	blocked := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, ioutil.WriteFile(blocked, nil, 0644))
+	cfg.TmpDir = filepath.Join(blocked, "tmp")
+	_, err = cfg.fs().scratchDir("", "cosmovisor-simulate-")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "set DAEMON_TMP_DIR")
+}
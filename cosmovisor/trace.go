@@ -0,0 +1,215 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// UpgradeTimings records the phases of one upgrade as it runs through the pipeline.
+// Timestamps are UTC and durations are measured on the monotonic clock.
+type UpgradeTimings struct {
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+	Phases   []*PhaseTiming
+
+	sw Stopwatch
+	// lead is the time the upgrade started before it was detected, see Detected
+	lead time.Duration
+	// cfg is the home the phases are recorded in the event log of, none if nil
+	cfg *Config
+}
+
+// PhaseTiming is a single phase of an upgrade, e.g. stop, download or switch
+type PhaseTiming struct {
+	Name       string
+	Start      time.Time
+	Duration   time.Duration
+	Attributes map[string]string
+	Err        error
+
+	sw      Stopwatch
+	timings *UpgradeTimings
+}
+
+// UpgradeTraceExporter receives the timings of every finished upgrade
+type UpgradeTraceExporter func(*UpgradeTimings)
+
+var (
+	traceExportersMutex sync.Mutex
+	traceExporters      []UpgradeTraceExporter
+	traceExportsPending sync.WaitGroup
+)
+
+// restarting is the upgrade whose restart phase runs until the daemon is launched again
+var restarting struct {
+	mutex   sync.Mutex
+	timings *UpgradeTimings
+	phase   *PhaseTiming
+}
+
+// RegisterUpgradeTraceExporter adds an exporter called for every finished upgrade.
+// Exporters run in their own goroutine and can't affect the upgrade itself.
+func RegisterUpgradeTraceExporter(exporter UpgradeTraceExporter) {
+	traceExportersMutex.Lock()
+	defer traceExportersMutex.Unlock()
+	traceExporters = append(traceExporters, exporter)
+}
+
+// NewUpgradeTimings starts timing the named upgrade
+func NewUpgradeTimings(name string) *UpgradeTimings {
+	sw := StartStopwatch()
+	return &UpgradeTimings{Name: name, Start: sw.Started(), sw: sw}
+}
+
+// Phase starts a new phase, which must be ended by the caller
+func (t *UpgradeTimings) Phase(name string) *PhaseTiming {
+	setPhase("upgrade " + name)
+	sw := StartStopwatch()
+	p := &PhaseTiming{Name: name, Start: sw.Started(), Attributes: map[string]string{}, sw: sw, timings: t}
+	t.Phases = append(t.Phases, p)
+	return p
+}
+
+// Detected records the detect phase, from the time the app halted for the upgrade to the
+// time cosmovisor saw it, and moves the start of the upgrade back to the halt
+func (t *UpgradeTimings) Detected(halted time.Time) {
+	halted = halted.UTC()
+	if !halted.Before(t.Start) {
+		return
+	}
+	detect := &PhaseTiming{Name: "detect", Start: halted, Duration: t.Start.Sub(halted), Attributes: map[string]string{}}
+	t.Phases = append([]*PhaseTiming{detect}, t.Phases...)
+	t.lead += detect.Duration
+	t.Start = halted
+}
+
+// EndAfterRestart finishes the upgrade with a restart phase once the daemon is launched
+// again, see upgradeRelaunched. An upgrade that failed has no restart and ends right away.
+func (t *UpgradeTimings) EndAfterRestart(err error) {
+	if err != nil {
+		t.End(err)
+		return
+	}
+	phase := t.Phase("restart")
+	restarting.mutex.Lock()
+	previous := restarting.timings
+	restarting.timings, restarting.phase = t, phase
+	restarting.mutex.Unlock()
+	if previous != nil {
+		previous.endWithoutRestart()
+	}
+}
+
+// upgradeRelaunched ends the restart phase of the upgrade the daemon was launched again for
+func upgradeRelaunched() {
+	restarting.mutex.Lock()
+	t, phase := restarting.timings, restarting.phase
+	restarting.timings, restarting.phase = nil, nil
+	restarting.mutex.Unlock()
+	if t != nil {
+		phase.End(nil)
+		t.End(nil)
+	}
+}
+
+// endWithoutRestart finishes an upgrade the daemon isn't launched again for by cosmovisor,
+// dropping its restart phase
+func (t *UpgradeTimings) endWithoutRestart() {
+	t.Phases = t.Phases[:len(t.Phases)-1]
+	t.End(nil)
+}
+
+// End finishes the upgrade and hands the timings to all registered exporters
+func (t *UpgradeTimings) End(err error) {
+	t.Duration = t.sw.Elapsed() + t.lead
+	t.Err = err
+	metrics.upgradePhases(t)
+
+	traceExportersMutex.Lock()
+	exporters := make([]UpgradeTraceExporter, len(traceExporters))
+	copy(exporters, traceExporters)
+	traceExportersMutex.Unlock()
+
+	for _, export := range exporters {
+		traceExportsPending.Add(1)
+		go func(export UpgradeTraceExporter) {
+			defer traceExportsPending.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Warnf("exporting upgrade trace: %v", r)
+				}
+			}()
+			export(t)
+		}(export)
+	}
+}
+
+// attribute returns the attribute set by the named phase, empty if the phase didn't run or
+// didn't set it
+func (t *UpgradeTimings) attribute(phase, key string) string {
+	if p := t.phase(phase); p != nil {
+		return p.Attributes[key]
+	}
+	return ""
+}
+
+// phase returns the named phase, nil if it didn't run
+func (t *UpgradeTimings) phase(name string) *PhaseTiming {
+	for _, p := range t.Phases {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// FlushUpgradeTraces waits up to timeout for exporters of finished upgrades to return. An
+// upgrade still waiting for its restart is finished without it.
+func FlushUpgradeTraces(timeout time.Duration) {
+	restarting.mutex.Lock()
+	pending := restarting.timings
+	restarting.timings, restarting.phase = nil, nil
+	restarting.mutex.Unlock()
+	if pending != nil {
+		pending.endWithoutRestart()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		traceExportsPending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// Set adds an attribute to the phase
+func (p *PhaseTiming) Set(key, value string) {
+	p.Attributes[key] = value
+}
+
+// End finishes the phase, recording err if it failed
+func (p *PhaseTiming) End(err error) {
+	p.Duration = p.sw.Elapsed()
+	p.Err = err
+	if p.timings == nil || p.timings.cfg == nil {
+		return
+	}
+	fields := map[string]string{"phase": p.Name, "duration": p.Duration.String()}
+	for k, v := range p.Attributes {
+		fields[k] = v
+	}
+	message := fmt.Sprintf("%s of upgrade %q took %s", p.Name, p.timings.Name, p.Duration.Round(time.Millisecond))
+	if err != nil {
+		fields["error"] = err.Error()
+		message = fmt.Sprintf("%s of upgrade %q failed after %s: %v", p.Name, p.timings.Name, p.Duration.Round(time.Millisecond), err)
+	}
+	ev := NewEvent(EventUpgradePhase, p.timings.Name, message)
+	ev.Fields = fields
+	recordEvent(p.timings.cfg, ev)
+}
@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordTraces collects the upgrades handed to exporters until the test ends
+func recordTraces(t *testing.T) <-chan *UpgradeTimings {
+	traceExportersMutex.Lock()
+	saved := traceExporters
+	traceExportersMutex.Unlock()
+	t.Cleanup(func() {
+		traceExportersMutex.Lock()
+		traceExporters = saved
+		traceExportersMutex.Unlock()
+	})
+	exported := make(chan *UpgradeTimings, 4)
+	RegisterUpgradeTraceExporter(func(t *UpgradeTimings) { exported <- t })
+	return exported
+}
+
+func phaseNames(t *UpgradeTimings) []string {
+	var names []string
+	for _, p := range t.Phases {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+func TestUpgradeTimingsRestart(t *testing.T) {
+	resetMetrics(t)
+	exported := recordTraces(t)
+
+	timings := NewUpgradeTimings("chain2")
+	detected := timings.Start
+	timings.Detected(detected.Add(-2 * time.Second))
+	timings.Detected(detected.Add(time.Second))
+	timings.Phase("switch").End(nil)
+	timings.EndAfterRestart(nil)
+	require.Empty(t, exported, "the trace waits for the restart")
+
+	upgradeRelaunched()
+	trace := <-exported
+	require.Equal(t, []string{"detect", "switch", "restart"}, phaseNames(trace))
+	require.Equal(t, detected.Add(-2*time.Second), trace.Start)
+	require.Equal(t, 2*time.Second, trace.Phases[0].Duration)
+	require.True(t, trace.Duration >= 2*time.Second)
+	require.Contains(t, metrics.phaseSeconds, "restart")
+
+	// an upgrade the daemon isn't launched again for ends without a restart phase
+	timings = NewUpgradeTimings("chain3")
+	timings.Phase("switch").End(nil)
+	timings.EndAfterRestart(nil)
+	FlushUpgradeTraces(time.Second)
+	require.Equal(t, []string{"switch"}, phaseNames(<-exported))
+
+	upgradeRelaunched()
+	require.Empty(t, exported)
+}
@@ -7,9 +7,13 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/go-getter"
 	"github.com/otiai10/copy"
@@ -19,70 +23,656 @@ import (
 // We can now make any changes to the underlying directory without interference and leave it
 // in a state, so we can make a proper restart
 func DoUpgrade(cfg *Config, info *UpgradeInfo) error {
+	timings := NewUpgradeTimings(info.Name)
+	err := doUpgrade(cfg, info, timings)
+	timings.End(err)
+	return err
+}
+
+// UpgradePlan is what an upgrade will do, decided before anything is changed on disk
+type UpgradePlan struct {
+	Info *UpgradeInfo
+	// OldBin is the binary that ran until the upgrade, resolved before the current link moves
+	OldBin string
+	// NewBin is the binary the current link will point to
+	NewBin string
+	// Download is set if NewBin isn't staged yet and will be downloaded
+	Download bool
+	// Export is set if the state is exported with OldBin before switching
+	Export bool
+	// Config is the upgrade config the plan info refers to, once it was downloaded
+	Config *UpgradeConfig
+
+	// journal records the steps of the plan completed, once it is applied
+	journal *UpgradeJournal
+	// preflighted is set once the downloaded binary passed the preflight check in staging
+	preflighted bool
+}
+
+// PlanUpgrade decides how the named upgrade will be applied with this config and layout,
+// without changing anything. It returns an error if the upgrade can't be applied.
+func (cfg *Config) PlanUpgrade(info *UpgradeInfo) (*UpgradePlan, error) {
+	if err := injectFault("upgrade.plan"); err != nil {
+		return nil, err
+	}
+	if err := ValidateUpgradeName(info.Name); err != nil {
+		return nil, err
+	}
+	// refuse the upgrade before anything is changed if it needs a newer cosmovisor
+	if config, ok := parseUpgradeConfig(info); ok {
+		if err := checkUpgradeVersion(info, config); err != nil {
+			return nil, err
+		}
+	}
+
+	oldBin, _ := cfg.resolveCurrentBin()
+	plan := &UpgradePlan{
+		Info:   info,
+		OldBin: oldBin,
+		NewBin: cfg.UpgradeBin(info.Name),
+		Export: cfg.wantsExport(info),
+	}
+
 	// Simplest case is to switch the link
-	err := EnsureBinary(cfg.UpgradeBin(info.Name))
+	err := EnsureBinary(plan.NewBin)
 	if err == nil {
-		// we have the binary - do it
-		return cfg.SetCurrentUpgrade(info.Name)
+		return plan, nil
+	}
+	// a staged binary that can't run is reported as is, downloading won't replace it
+	if _, serr := os.Stat(plan.NewBin); serr == nil {
+		return nil, withExitCode(ExitCodeBinaryMissing, fmt.Errorf("the binary of upgrade %q can't be used: %w", info.Name, err))
+	}
+	// an immutable image must ship every binary, nothing can be added to it
+	if cfg.Immutable {
+		return nil, withExitCode(ExitCodeBinaryMissing, fmt.Errorf("binary not present in the immutable layout, downloading disabled: %w", err))
 	}
 	// if auto-download is disabled, we fail
 	if !cfg.AllowDownloadBinaries {
-		return fmt.Errorf("binary not present, downloading disabled: %w", err)
+		return nil, withExitCode(ExitCodeBinaryMissing, fmt.Errorf("binary not present, downloading disabled: %w", err))
 	}
 
 	// if the dir is there already, don't download either
 	if _, err := os.Stat(cfg.UpgradeDir(info.Name)); !os.IsNotExist(err) {
-		return errors.New("upgrade dir already exists, won't overwrite")
+		return nil, errors.New("upgrade dir already exists, won't overwrite")
+	}
+	plan.Download = true
+	return plan, nil
+}
+
+// checkUpgradeVersion refuses the upgrade if its config needs a newer cosmovisor
+func checkUpgradeVersion(info *UpgradeInfo, config UpgradeConfig) error {
+	if config.MinVersion == "" {
+		return nil
+	}
+	if err := CheckMinVersion(config.MinVersion); err != nil {
+		return &MinVersionError{Upgrade: info.Name, Required: config.MinVersion, Config: config, Err: err}
 	}
+	return nil
+}
 
-	// If not there, then we try to download it... maybe
-	if err := DownloadBinary(cfg, info); err != nil {
-		return fmt.Errorf("cannot download binary: %w", err)
+// followReference downloads the upgrade config the plan info refers to, so its minimum
+// version and export request apply as if it were inline, and the binary is downloaded as
+// listed there. A staged binary doesn't need it, so if the config can't be downloaded then,
+// the upgrade goes on without it. Nothing is fetched with downloads disabled.
+func (cfg *Config) followReference(plan *UpgradePlan) error {
+	ref := strings.TrimSpace(plan.Info.Info)
+	if !isReference(ref) || !cfg.AllowDownloadBinaries || cfg.Immutable {
+		return nil
+	}
+	doc, err := fetchReference(cfg.fs(), cfg.downloader(), ref, cfg.DownloadMustHaveChecksum)
+	if err == nil {
+		var config UpgradeConfig
+		if err = json.Unmarshal([]byte(doc), &config); err == nil {
+			plan.Config = &config
+		} else {
+			err = fmt.Errorf("reference link %s doesn't hold an upgrade config: %w", ref, err)
+		}
+	}
+	switch {
+	case err != nil && plan.Download:
+		return withExitCode(ExitCodeDownload, fmt.Errorf("cannot download binary: %w", err))
+	case err != nil:
+		logger.Warnf("upgrading to %q without the upgrade config: %v", plan.Info.Name, err)
+		return nil
+	}
+	if err := checkUpgradeVersion(plan.Info, *plan.Config); err != nil {
+		return err
+	}
+	plan.Export = plan.Export || plan.Config.Export
+	return nil
+}
+
+// doUpgrade is DoUpgrade, recording its phases in timings
+func doUpgrade(cfg *Config, info *UpgradeInfo, timings *UpgradeTimings) (err error) {
+	upgradeDirMutex.Lock()
+	defer upgradeDirMutex.Unlock()
+
+	timings.cfg = cfg
+	snapshot := cfg.takeUpgradeSnapshot(info)
+	defer func() { cfg.finishUpgradeSnapshot(snapshot, err) }()
+	plan, err := cfg.PlanUpgrade(info)
+	if err != nil {
+		return err
+	}
+	if err := cfg.followReference(plan); err != nil {
+		return err
+	}
+	plan.journal = cfg.startJournal(plan)
+	// an upgrade that fails leaves nothing half done to resume
+	if err := applyPlan(cfg, plan, timings); err != nil {
+		cfg.clearJournal()
+		return err
+	}
+	return nil
+}
+
+// applyPlan applies the plan of doUpgrade, recording the steps it completes in its journal
+func applyPlan(cfg *Config, plan *UpgradePlan, timings *UpgradeTimings) error {
+	info := plan.Info
+	started := NewEvent(EventUpgradeStarted, info.Name, fmt.Sprintf("upgrading to %q, from %s to %s", info.Name, plan.OldBin, plan.NewBin))
+	started.Height = info.Height
+	started.Fields = map[string]string{"old_binary": plan.OldBin, "new_binary": plan.NewBin, "download": strconv.FormatBool(plan.Download)}
+	recordEvent(cfg, started)
+	cfg.recordValidatorState(info.Name)
+	if err := cfg.pauseSigner(info, timings); err != nil {
+		return err
+	}
+
+	if plan.Download {
+		phase := timings.Phase("download")
+		if err := downloadUpgrade(cfg, plan); err != nil {
+			phase.End(err)
+			return err
+		}
+		if fi, err := os.Stat(plan.NewBin); err == nil {
+			phase.Set("bytes", strconv.FormatInt(fi.Size(), 10))
+		}
+		phase.End(nil)
+	} else {
+		cfg.checkStagedHeight(info)
+	}
+	cfg.advance(plan.journal, StepDownloaded)
+
+	return switchUpgrade(cfg, plan, timings)
+}
+
+// downloadUpgrade downloads the binary of a plan and checks it can be run
+func downloadUpgrade(cfg *Config, plan *UpgradePlan) error {
+	if err := downloadBinary(cfg, plan.Info, plan.Config); err != nil {
+		// the dir didn't exist before, remove what was downloaded so the next start retries
+		if rerr := cfg.fs().removeAll(cfg.UpgradeDir(plan.Info.Name)); rerr != nil {
+			logger.Warnf("removing partial download: %v", rerr)
+		}
+		return withExitCode(ExitCodeDownload, fmt.Errorf("cannot download binary: %w", err))
 	}
 
 	// and then set the binary again
-	if err := EnsureBinary(cfg.UpgradeBin(info.Name)); err != nil {
-		return fmt.Errorf("downloaded binary doesn't check out: %w", err)
+	if err := EnsureBinary(plan.NewBin); err != nil {
+		return withExitCode(ExitCodeDownload, fmt.Errorf("downloaded binary doesn't check out: %w", err))
+	}
+	plan.preflighted = cfg.wantsPreflight()
+	return nil
+}
+
+// switchUpgrade points the current link to the upgrade, recorded as the switch phase.
+// The new binary passes the preflight check, if enabled and it wasn't run on the download
+// already, and if planned, the state is exported with the old binary first.
+func switchUpgrade(cfg *Config, plan *UpgradePlan, timings *UpgradeTimings) error {
+	if err := cfg.verifyPlanChecksum(plan, timings); err != nil {
+		return err
+	}
+	if cfg.wantsPreflight() && !plan.preflighted {
+		phase := timings.Phase("preflight")
+		err := cfg.preflight(plan.Info, plan.NewBin)
+		if err != nil {
+			err = fmt.Errorf("preflight: %w", err)
+		}
+		phase.End(err)
+		if err != nil {
+			return err
+		}
+	}
+	if err := cfg.runHooks(HookPreUpgrade, cfg.upgradeEnv(plan)); err != nil {
+		return err
+	}
+	if j := plan.journal; j != nil && j.Step.reached(StepBackedUp) {
+		logger.Infof("the node was backed up for upgrade %q before cosmovisor stopped, not backing it up again", plan.Info.Name)
+	} else if err := cfg.backupBeforeSwitch(plan, timings); err != nil {
+		return withExitCode(ExitCodeBackup, err)
+	} else {
+		if j := plan.journal; j != nil {
+			j.Backup = timings.attribute("data-backup", "path")
+		}
+		cfg.advance(plan.journal, StepBackedUp)
+	}
+	if plan.Export {
+		if err := exportBeforeSwitch(cfg, plan.Info, plan.OldBin, timings); err != nil {
+			return err
+		}
+	}
+	if err := cfg.runPreUpgrade(plan, timings); err != nil {
+		return err
 	}
 
-	return cfg.SetCurrentUpgrade(info.Name)
+	phase := timings.Phase("switch")
+	if hash, err := sha256File(plan.NewBin); err == nil {
+		phase.Set("binary_sha256", hash)
+	}
+	err := cfg.SetCurrentUpgrade(plan.Info.Name)
+	phase.End(err)
+	if err != nil {
+		return err
+	}
+	cfg.advance(plan.journal, StepSwitched)
+	finishSwitch(cfg, plan, timings)
+	return nil
 }
 
-// DownloadBinary will grab the binary and place it in the proper directory
+// finishSwitch records the switch to the upgrade of the plan and runs what follows it
+func finishSwitch(cfg *Config, plan *UpgradePlan, timings *UpgradeTimings) {
+	if from, to := daemonNameOf(plan.OldBin), daemonNameOf(plan.NewBin); from != to {
+		logger.Infof("upgrade %q renamed the daemon from %s to %s", plan.Info.Name, from, to)
+	}
+	recordSwitch(cfg, plan.Info.Name, plan.Info.Height, plan.OldBin, plan.NewBin, "upgrade")
+	cfg.recordUpgrade(plan.Info, plan.OldBin)
+	cfg.recordUpgradeHistory(plan, timings)
+	cfg.pruneDataBackups()
+	cfg.pruneUpgradesAfterSwitch()
+	cfg.runPostUpgradeHooks(plan, timings)
+	// the upgrade stands, a failed hook only skips the hooks after it
+	_ = cfg.runHooks(HookPostUpgrade, cfg.upgradeEnv(plan))
+}
+
+// exportBeforeSwitch runs the export phase, failing only if the export policy says so
+func exportBeforeSwitch(cfg *Config, info *UpgradeInfo, oldBin string, timings *UpgradeTimings) error {
+	phase := timings.Phase("export")
+	record, err := ExportState(cfg, info, oldBin)
+	if err == nil {
+		phase.Set("path", record.Path)
+		phase.Set("sha256", record.SHA256)
+		phase.End(nil)
+		logger.Infof("exported state at height %d to %s (sha256 %s)", record.Height, record.Path, record.SHA256)
+		return nil
+	}
+
+	err = fmt.Errorf("pre-upgrade export: %w", err)
+	phase.End(err)
+	if cfg.ExportPolicy == ExportPolicyAbort {
+		return err
+	}
+	logger.Warnf("continuing upgrade without export: %v", err)
+	return nil
+}
+
+const (
+	defaultDownloadAttempts = 3
+	defaultDownloadBackoff  = time.Second
+	maxDownloadBackoff      = 30 * time.Second
+)
+
+// noRetry marks download errors retrying the same URL can't fix
+type noRetry struct{ error }
+
+func (e noRetry) Unwrap() error { return e.error }
+
+// DownloadBinary will grab the binary and place it in the proper directory. Each URL listed
+// for the platform is tried in turn, retrying with exponential backoff, until one succeeds.
 func DownloadBinary(cfg *Config, info *UpgradeInfo) error {
-	url, err := GetDownloadURL(info)
+	return downloadBinary(cfg, info, nil)
+}
+
+// downloadBinary is DownloadBinary, with the upgrade config the plan info refers to if it
+// was downloaded already
+func downloadBinary(cfg *Config, info *UpgradeInfo, config *UpgradeConfig) error {
+	// go-getter writes on its own, so refuse the whole download up front
+	fs := cfg.fs()
+	dir := cfg.UpgradeDir(info.Name)
+	if err := fs.check("download", dir); err != nil {
+		return err
+	}
+	dl := cfg.downloader()
+	if config == nil {
+		_, inline, err := getDownloadURL(fs, dl, info, cfg.DownloadMustHaveChecksum)
+		if err != nil {
+			return err
+		}
+		config = &inline
+	}
+	urls, err := config.BinaryURLs(OSArch())
 	if err != nil {
 		return err
 	}
+	inner, err := archiveBinaryPath(config.BinaryPath)
+	if err != nil {
+		return err
+	}
+	binName := cfg.binName()
+	if config.BinaryName != "" {
+		if err := validateBinaryName(config.BinaryName); err != nil {
+			return err
+		}
+		binName = exeName(config.BinaryName)
+	}
+	var sigURL string
+	if cfg.BinaryPubKey != nil {
+		var ok bool
+		if sigURL, ok = config.SignatureURL(OSArch()); !ok {
+			return fmt.Errorf("%w: the plan has none for %s", errSignatureRequired, OSArch())
+		}
+	}
+	binSum, err := config.BinaryChecksum(OSArch())
+	if err != nil && !cfg.UnsafeSkipPlanChecksum {
+		return err
+	}
+	// a failed attempt is cleaned up, unless the dir was there before
+	_, statErr := os.Stat(dir)
+	clean := os.IsNotExist(statErr)
 
-	// download into the bin dir (works for one file)
-	binPath := cfg.UpgradeBin(info.Name)
-	err = getter.GetFile(binPath, url)
+	attempts := cfg.downloadAttempts()
+	var failures []string
+	ulog := logger.With("upgrade", info.Name)
+	for i, url := range urls {
+		if i > 0 {
+			ulog.Infof("trying mirror %d of %d for upgrade %q", i+1, len(urls), info.Name)
+		}
+		backoff := cfg.downloadBackoff()
+		for attempt := 1; ; attempt++ {
+			err = downloadStaged(cfg, fs, dl, info, url, inner, sigURL, binSum, binName, config.BinaryName)
+			if err == nil {
+				return nil
+			}
+			if clean {
+				if rerr := fs.removeAll(dir); rerr != nil {
+					ulog.Warnf("removing partial download: %v", rerr)
+				}
+			}
+			var permanent noRetry
+			if errors.As(err, &permanent) || attempt >= attempts {
+				break
+			}
+			ulog.Warnf("downloading upgrade %q failed (attempt %d of %d), retrying in %s: %v", info.Name, attempt, attempts, backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxDownloadBackoff {
+				backoff = maxDownloadBackoff
+			}
+		}
+		if len(urls) == 1 {
+			return err
+		}
+		ulog.Warnf("downloading upgrade %q from URL %d of %d failed: %v", info.Name, i+1, len(urls), err)
+		failures = append(failures, err.Error())
+	}
+	return fmt.Errorf("all %d URLs failed: %s", len(urls), strings.Join(failures, "; "))
+}
 
-	// if this fails, let's see if it is a zipped directory
+// downloadStaged downloads the binary from one URL into a staging directory, and installs
+// it in the upgrade directory once it passed its checks and the preflight check, if enabled
+func downloadStaged(cfg *Config, fs fsGuard, dl Downloader, info *UpgradeInfo, url, inner, sigURL string, binSum *Checksum, binName, binaryName string) error {
+	staging, err := cfg.newStagingDir(fs, info.Name)
 	if err != nil {
-		dirPath := cfg.UpgradeDir(info.Name)
-		err = getter.Get(dirPath, url)
+		return err
+	}
+	defer fs.removeAll(staging)
+	if err := downloadFrom(cfg, fs, dl, info, staging, url, inner, sigURL, binSum, binName); err != nil {
+		return err
+	}
+	bin := filepath.Join("bin", binName)
+	if cfg.wantsPreflight() {
+		if err := cfg.preflight(info, filepath.Join(staging, bin)); err != nil {
+			return noRetry{fmt.Errorf("preflight: %w", err)}
+		}
+	}
+	if binaryName != "" {
+		logger.Infof("upgrade %q renames the daemon binary to %s", info.Name, binName)
+	}
+	return cfg.installStaged(fs, staging, cfg.UpgradeDir(info.Name), bin, binaryName)
+}
+
+// downloadFrom downloads the binary from one URL into dir, and verifies it as binName
+func downloadFrom(cfg *Config, fs fsGuard, dl Downloader, info *UpgradeInfo, dir, url, inner, sigURL string, binSum *Checksum, binName string) error {
+	src, sum, err := splitChecksum(url)
+	if err != nil {
+		// an unusable checksum never means skipping the verification
+		if cfg.DownloadMustHaveChecksum {
+			return noRetry{fmt.Errorf("%w: %v", errChecksumRequired, err)}
+		}
+		return noRetry{err}
+	}
+
+	getters := getter.Getters
+	// the CID of an ipfs:// URL is the checksum of the content
+	ipfs := isIPFS(src)
+	switch {
+	case sum == nil && ipfs:
+		logger.Infof("downloading upgrade %q from %s through %s, verifying its CID", info.Name, src, cfg.ipfsGateway())
+	case sum == nil && cfg.DownloadMustHaveChecksum:
+		return noRetry{fmt.Errorf("%w: %s has none", errChecksumRequired, url)}
+	case sum == nil:
+		logger.Warnf("downloading upgrade %q from %s without checksum", info.Name, src)
+	default:
+		logger.Infof("downloading upgrade %q from %s, verifying %s checksum %s", info.Name, src, sum.Algorithm(), sum)
+	}
+	gd, builtin := dl.(getterDownloader)
+	// go-getter unpacks straight from the URL, unless the download is resumable
+	if builtin && !ipfs && !gd.resumes(url) && cfg.BinaryPubKey == nil && (sum == nil || sum.algorithm.getter) {
+		if gd.err != nil {
+			return noRetry{gd.err}
+		}
+		getters = gd.getterMap()
+		// go-getter verifies the download before unpacking it
+		if sum != nil {
+			src = withChecksum(src, sum)
+		}
+	} else {
+		var local string
+		var cleanup func()
+		if ipfs {
+			local, cleanup, err = fetchIPFS(fs, dl, cfg.ipfsGateway(), src, sum)
+		} else {
+			local, cleanup, err = fetchVerified(fs, dl, src, sum)
+		}
 		if err != nil {
 			return err
 		}
-		err = EnsureBinary(binPath)
-		// copy binary to binPath from dirPath if zipped directory don't contain bin directory to wrap the binary
-		if err != nil {
-			err = copy.Copy(filepath.Join(dirPath, cfg.Name), binPath)
-			if err != nil {
+		defer cleanup()
+		if cfg.BinaryPubKey != nil {
+			if err := verifySignature(fs, dl, cfg.BinaryPubKey, local, sigURL); err != nil {
 				return err
 			}
 		}
+		// unpack the verified copy, the file getter must not just link to it
+		src = local
+		getters = copyingGetters()
+	}
+
+	binPath := filepath.Join(dir, "bin", binName)
+	if inner == "" {
+		// download into the bin dir (works for one file)
+		err = getWith(getters, binPath, src, getter.ClientModeFile)
 	}
 
-	// if it is successful, let's ensure the binary is executable
-	return MarkExecutable(binPath)
+	// if this fails, or the plan names the binary inside, let's see if it is an archive
+	if inner != "" || err != nil {
+		err = getWith(getters, dir, src, getter.ClientModeAny)
+		if err != nil {
+			return err
+		}
+		if err := locateBinary(dir, binPath, inner, binName); err != nil {
+			return noRetry{err}
+		}
+	}
+
+	if err := injectFault("download.fetch"); err != nil {
+		return err
+	}
+	// if it is successful, let's ensure the daemon can run the binary
+	if err := cfg.normalizeStaged(fs, dir, binPath); err != nil {
+		return noRetry{err}
+	}
+	// another mirror may serve the binary governance voted on
+	if binSum != nil && !cfg.UnsafeSkipPlanChecksum {
+		if err := verifyFile(binPath, binSum); err != nil {
+			return noRetry{fmt.Errorf("the binary from %s doesn't match the plan: %w", src, err)}
+		}
+	}
+	return nil
+}
+
+// downloadAttempts is how often each URL is tried
+func (cfg *Config) downloadAttempts() int {
+	if cfg.DownloadAttempts <= 0 {
+		return defaultDownloadAttempts
+	}
+	return cfg.DownloadAttempts
+}
+
+// downloadBackoff is the wait before the first retry, it doubles with every retry
+func (cfg *Config) downloadBackoff() time.Duration {
+	if cfg.DownloadBackoff <= 0 {
+		return defaultDownloadBackoff
+	}
+	return cfg.DownloadBackoff
+}
+
+// archiveBinaryPath validates the path of the binary inside an unpacked archive, given by
+// binary_path in the plan info. It must stay inside the upgrade dir.
+func archiveBinaryPath(p string) (string, error) {
+	if p == "" {
+		return "", nil
+	}
+	clean := path.Clean(filepath.ToSlash(p))
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid binary_path %q: must be relative to the unpacked archive", p)
+	}
+	return filepath.FromSlash(clean), nil
+}
+
+// locateBinary puts the binary of an archive unpacked in dirPath at binPath. It is taken
+// from inner if the plan names it, else from bin/<name> or <name> at the top of the archive.
+func locateBinary(dirPath, binPath, inner, name string) error {
+	if inner == "" {
+		if EnsureBinary(binPath) == nil {
+			return nil
+		}
+		// copy binary to binPath from dirPath if zipped directory don't contain bin directory to wrap the binary
+		return copy.Copy(filepath.Join(dirPath, name), binPath)
+	}
+
+	src := filepath.Join(dirPath, inner)
+	if src == binPath {
+		return nil
+	}
+	// an archive may contain links, the binary must be a file it unpacked
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return fmt.Errorf("binary_path %s not found in the downloaded archive: %w", inner, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("binary_path %s in the downloaded archive is not a regular file", inner)
+	}
+	return copy.Copy(src, binPath)
+}
+
+// verifySignature downloads the detached signature at sigURL and checks it is a signature
+// of the artifact by key
+func verifySignature(fs fsGuard, dl Downloader, key SignatureKey, artifact, sigURL string) error {
+	tmpDir, err := fs.tempDir("cosmovisor-signature")
+	if err != nil {
+		return err
+	}
+	defer fs.removeAll(tmpDir)
+	sigPath := filepath.Join(tmpDir, "sig")
+	if err := dl.Download(sigURL, sigPath); err != nil {
+		return fmt.Errorf("downloading signature %s: %w", sigURL, err)
+	}
+	sig, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(artifact)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := key.Verify(f, sig); err != nil {
+		return fmt.Errorf("verifying signature %s with %s: %w", sigURL, key, err)
+	}
+	logger.Infof("verified signature %s with %s", sigURL, key)
+	return nil
+}
+
+// getWith downloads src to dst like getter.Get and getter.GetFile, with the given getters
+func getWith(getters map[string]getter.Getter, dst, src string, mode getter.ClientMode) error {
+	client := &getter.Client{Src: src, Dst: dst, Mode: mode, Getters: getters}
+	return client.Get()
+}
+
+// copyingGetters are the default getters, with local files copied rather than linked
+func copyingGetters() map[string]getter.Getter {
+	getters := make(map[string]getter.Getter, len(getter.Getters))
+	for k, g := range getter.Getters {
+		getters[k] = g
+	}
+	getters["file"] = &getter.FileGetter{Copy: true}
+	return getters
+}
+
+// fetchVerified downloads src as is with dl, without unpacking it, and verifies its checksum
+// if there is one. It is used for the algorithms go-getter can't verify itself, to check
+// signatures before unpacking, and for downloaders other than go-getter.
+func fetchVerified(fs fsGuard, dl Downloader, src string, sum *Checksum) (string, func(), error) {
+	tmpDir, err := fs.tempDir("cosmovisor-download")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { fs.removeAll(tmpDir) }
+
+	// keep the file name, the decompressor is chosen by its extension
+	name := path.Base(strings.SplitN(src, "?", 2)[0])
+	if name == "." || name == "/" {
+		name = "download"
+	}
+	local := filepath.Join(tmpDir, name)
+	_, builtin := dl.(getterDownloader)
+	if sum != nil && sum.algorithm.new == nil && !builtin {
+		cleanup()
+		return "", nil, fmt.Errorf("%s checksums can only be verified by the built-in downloader", sum.Algorithm())
+	}
+	fetch := src
+	if sum != nil && sum.algorithm.getter && builtin {
+		// go-getter verifies it while downloading
+		fetch = withChecksum(src, sum)
+	}
+	if err := dl.Download(fetch, local); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if sum == nil || (sum.algorithm.getter && builtin) {
+		return local, cleanup, nil
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	defer f.Close()
+	if err := sum.Verify(f); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("verifying %s: %w", src, err)
+	}
+	return local, cleanup, nil
 }
 
 // MarkExecutable will try to set the executable bits if not already set
 // Fails if file doesn't exist or we cannot set those bits
 func MarkExecutable(path string) error {
+	return markExecutable(fsGuard{}, path)
+}
+
+// markExecutable is MarkExecutable through the write guard
+func markExecutable(fs fsGuard, path string) error {
 	info, err := os.Stat(path)
 	if err != nil {
 		return fmt.Errorf("stating binary: %w", err)
@@ -93,54 +683,259 @@ func MarkExecutable(path string) error {
 	}
 	// now try to set all exec bits
 	newMode := info.Mode().Perm() | 0111
-	return os.Chmod(path, newMode)
+	return fs.chmod(path, newMode)
 }
 
 // UpgradeConfig is expected format for the info field to allow auto-download
 type UpgradeConfig struct {
-	Binaries map[string]string `json:"binaries"`
+	// Binaries maps os/arch to the URL of the binary, or to a list of mirrors tried in order
+	Binaries map[string]URLList `json:"binaries"`
+	// Export requests a state export with the old binary before switching
+	Export bool `json:"export,omitempty"`
+	// MinVersion is the oldest cosmovisor able to apply the upgrade
+	MinVersion string `json:"cosmovisor_min_version,omitempty"`
+	// BinaryPath is where the daemon binary is inside a downloaded archive, relative to its
+	// top. By default it is bin/<name>, or <name>.
+	BinaryPath string `json:"binary_path,omitempty"`
+	// BinaryName is the new name of the daemon binary, for an upgrade that renames it. It is
+	// recorded in the overrides of the upgrade directory.
+	BinaryName string `json:"binary_name,omitempty"`
+	// Signatures maps os/arch to the URL of the detached signature of the binary, checked
+	// against DAEMON_BINARY_PUBKEY
+	Signatures map[string]string `json:"signatures,omitempty"`
+	// Checksums maps os/arch to the checksum of the binary itself, as unpacked, which the
+	// downloaded or staged binary must match before the switch
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// CosmovisorBinaries maps os/arch to the URL of a cosmovisor binary of at least
+	// MinVersion, with its checksum, installed with DAEMON_SELF_UPGRADE
+	CosmovisorBinaries map[string]string `json:"cosmovisor_binaries,omitempty"`
+}
+
+// parseUpgradeConfig reads the upgrade config if the plan info contains one inline
+func parseUpgradeConfig(info *UpgradeInfo) (UpgradeConfig, bool) {
+	var config UpgradeConfig
+	if err := json.Unmarshal([]byte(strings.TrimSpace(info.Info)), &config); err != nil {
+		return UpgradeConfig{}, false
+	}
+	return config, true
 }
 
 // GetDownloadURL will check if there is an arch-dependent binary specified in Info
 func GetDownloadURL(info *UpgradeInfo) (string, error) {
+	url, _, err := getDownloadURL(fsGuard{}, getterDownloader{}, info, false)
+	return url, err
+}
+
+// getDownloadURL is GetDownloadURL, downloading a reference with dl through the write guard.
+// It also returns the upgrade config the URL was taken from.
+func getDownloadURL(fs fsGuard, dl Downloader, info *UpgradeInfo, mustHaveChecksum bool) (string, UpgradeConfig, error) {
 	doc := strings.TrimSpace(info.Info)
 	// if this is a url, then we download that and try to get a new doc with the real info
-	if _, err := url.Parse(doc); err == nil {
-		tmpDir, err := ioutil.TempDir("", "upgrade-manager-reference")
-		if err != nil {
-			return "", fmt.Errorf("create tempdir for reference file: %w", err)
+	if isReference(doc) {
+		var err error
+		if doc, err = fetchReference(fs, dl, doc, mustHaveChecksum); err != nil {
+			return "", UpgradeConfig{}, err
 		}
-		defer os.RemoveAll(tmpDir)
+	}
+	return binaryURL(doc)
+}
 
-		refPath := filepath.Join(tmpDir, "ref")
-		if err := getter.GetFile(refPath, doc); err != nil {
-			return "", fmt.Errorf("downloading reference link %s: %w", doc, err)
-		}
+// fetchReference downloads the document the plan info links to, verifying the checksum
+// pinned with ?checksum= if there is one. With mustHaveChecksum, only a pinned link is
+// followed: whoever controls an unpinned document picks the binary and its checksum.
+func fetchReference(fs fsGuard, dl Downloader, ref string, mustHaveChecksum bool) (string, error) {
+	src, sum, err := splitChecksum(ref)
+	if err != nil {
+		return "", fmt.Errorf("reference link %s: %w", ref, err)
+	}
+	if sum == nil && mustHaveChecksum {
+		return "", fmt.Errorf("%w: reference link %s has none", errChecksumRequired, ref)
+	}
+	refPath, cleanup, err := fetchVerified(fs, dl, src, sum)
+	if err != nil {
+		return "", fmt.Errorf("downloading reference link %s: %w", ref, err)
+	}
+	defer cleanup()
 
-		refBytes, err := ioutil.ReadFile(refPath)
-		if err != nil {
-			return "", fmt.Errorf("reading downloaded reference: %w", err)
-		}
-		// if download worked properly, then we use this new file as the binary map to parse
-		doc = string(refBytes)
+	refBytes, err := ioutil.ReadFile(refPath)
+	if err != nil {
+		return "", fmt.Errorf("reading downloaded reference: %w", err)
 	}
+	return string(refBytes), nil
+}
 
+// isReference returns true if the plan info is a link to the document holding the binaries
+// map, rather than the document itself
+func isReference(doc string) bool {
+	if doc == "" || strings.HasPrefix(doc, "{") {
+		return false
+	}
+	_, err := url.Parse(doc)
+	return err == nil
+}
+
+// binaryURL picks the binary for this platform from the binaries map in doc, and returns
+// the upgrade config it is part of
+func binaryURL(doc string) (string, UpgradeConfig, error) {
 	// check if it is the upgrade config
 	var config UpgradeConfig
 
 	if err := json.Unmarshal([]byte(doc), &config); err == nil {
-		url, ok := config.Binaries[OSArch()]
-		if !ok {
-			url, ok = config.Binaries["any"]
+		url, err := config.BinaryURL(OSArch())
+		return url, config, err
+	}
+
+	return "", UpgradeConfig{}, errors.New("upgrade info doesn't contain binary map")
+}
+
+// archAliases are the names release pages use for the GOARCH values
+var archAliases = map[string]string{
+	"x86_64":  "amd64",
+	"x86-64":  "amd64",
+	"aarch64": "arm64",
+	"i386":    "386",
+	"i686":    "386",
+}
+
+// normalizePlatform turns an os/arch key of the binaries map into GOOS/GOARCH form
+func normalizePlatform(key string) string {
+	key = strings.ToLower(strings.TrimSpace(key))
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return key
+	}
+	arch := key[i+1:]
+	if alias, ok := archAliases[arch]; ok {
+		arch = alias
+	}
+	return key[:i] + "/" + arch
+}
+
+// BinaryURL picks the binary for platform (GOOS/GOARCH) from the binaries map. An exact
+// key wins, then a key naming the same platform differently (e.g. linux/x86_64 or
+// Linux/AMD64), then "any", so one plan can serve nodes of different platforms.
+// If mirrors are listed, it is the first of them.
+func (c UpgradeConfig) BinaryURL(platform string) (string, error) {
+	urls, err := c.BinaryURLs(platform)
+	if err != nil {
+		return "", err
+	}
+	return urls[0], nil
+}
+
+// BinaryURLs is BinaryURL, with all the mirrors listed for the platform
+func (c UpgradeConfig) BinaryURLs(platform string) ([]string, error) {
+	key, ok := platformKey(c.Binaries, platform)
+	if !ok {
+		return nil, fmt.Errorf("cannot find binary for os/arch: neither %s, nor any (the plan has %s)", platform, listPlatforms(c.Binaries))
+	}
+	if len(c.Binaries[key]) == 0 {
+		return nil, fmt.Errorf("no URL listed for %s", key)
+	}
+	return c.Binaries[key], nil
+}
+
+// SignatureURL picks the signature of the binary for platform from the signatures map,
+// the same way BinaryURL picks the binary
+func (c UpgradeConfig) SignatureURL(platform string) (string, bool) {
+	key, ok := platformKey(c.Signatures, platform)
+	return c.Signatures[key], ok
+}
+
+// CosmovisorURL picks the cosmovisor binary for platform from the cosmovisor_binaries
+// map, the same way BinaryURL picks the binary
+func (c UpgradeConfig) CosmovisorURL(platform string) (string, bool) {
+	key, ok := platformKey(c.CosmovisorBinaries, platform)
+	return c.CosmovisorBinaries[key], ok
+}
+
+// BinaryChecksum picks the checksum of the binary for platform from the checksums map, the
+// same way BinaryURL picks the binary. It returns nil if the plan has none for platform.
+func (c UpgradeConfig) BinaryChecksum(platform string) (*Checksum, error) {
+	key, ok := platformKey(c.Checksums, platform)
+	if !ok {
+		return nil, nil
+	}
+	sum, err := ParseChecksum(c.Checksums[key])
+	if err != nil {
+		return nil, fmt.Errorf("checksum of the %s binary: %w", key, err)
+	}
+	if sum.algorithm.new == nil {
+		return nil, fmt.Errorf("checksum of the %s binary: must be a digest, not %s", key, sum)
+	}
+	return sum, nil
+}
+
+// platformKey finds the key of a map keyed by os/arch to use for platform
+func platformKey(m interface{}, platform string) (string, bool) {
+	keys := mapKeys(m)
+	for _, key := range keys {
+		if key == platform {
+			return key, true
+		}
+	}
+	want := normalizePlatform(platform)
+	for _, key := range keys {
+		if normalizePlatform(key) == want {
+			return key, true
 		}
-		if !ok {
-			return "", fmt.Errorf("cannot find binary for os/arch: neither %s, nor any", OSArch())
+	}
+	for _, key := range keys {
+		if key == "any" {
+			return key, true
 		}
+	}
+	return "", false
+}
 
-		return url, nil
+// mapKeys returns the sorted keys of the binaries or the signatures map
+func mapKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]URLList:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]string:
+		for key := range m {
+			keys = append(keys, key)
+		}
 	}
+	sort.Strings(keys)
+	return keys
+}
 
-	return "", errors.New("upgrade info doesn't contain binary map")
+// listPlatforms formats the keys of a binaries map for an error message
+func listPlatforms(binaries map[string]URLList) string {
+	if len(binaries) == 0 {
+		return "no binaries"
+	}
+	return strings.Join(mapKeys(binaries), ", ")
+}
+
+// URLList is one URL, or a list of mirrors of the same file. In JSON it is a string or an
+// array of strings.
+type URLList []string
+
+func (l *URLList) UnmarshalJSON(bz []byte) error {
+	var one string
+	if err := json.Unmarshal(bz, &one); err == nil {
+		*l = URLList{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(bz, &many); err != nil {
+		return errors.New("expected a URL or a list of URLs")
+	}
+	*l = many
+	return nil
+}
+
+func (l URLList) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
+	}
+	return json.Marshal([]string(l))
 }
 
 func OSArch() string {
@@ -156,31 +951,79 @@ func (cfg *Config) SetCurrentUpgrade(upgradeName string) error {
 		return err
 	}
 
-	// set a symbolic link
-	link := filepath.Join(cfg.Root(), currentLink)
-	safeName := url.PathEscape(upgradeName)
-	upgrade := filepath.Join(cfg.Root(), upgradesDir, safeName)
+	return cfg.setCurrent(cfg.UpgradeDir(upgradeName))
+}
 
-	// remove link if it exists
-	if _, err := os.Stat(link); err == nil {
-		os.Remove(link)
+// errNoDirLinks is returned when the file system can't hold a link to a directory
+var errNoDirLinks = errors.New("directory links are not supported")
+
+// errNotDirLink is returned when reading a link that is another kind of file
+var errNotDirLink = errors.New("not a directory link")
+
+// setCurrent points the current link, or in an immutable layout the current pointer, to
+// the version directory dir. The pointer is used too where no link can be created. The
+// link is relative within DAEMON_HOME, see linkTarget.
+func (cfg *Config) setCurrent(dir string) error {
+	link := cfg.currentPath()
+	if cfg.Immutable {
+		return cfg.writeCurrentPointer(dir)
 	}
 
-	// point to the new directory
-	if err := os.Symlink(upgrade, link); err != nil {
+	// create the new link next to the current one and rename it over it, so a failure
+	// never leaves the home without a current link
+	fs := cfg.fs()
+	tmp := link + ".tmp"
+	fs.remove(tmp)
+	if err := injectFault("switch.symlink"); err != nil {
+		return fmt.Errorf("creating current symlink: %w", err)
+	}
+	if err := fs.linkDir(cfg.linkTarget(dir, link), tmp); errors.Is(err, errNoDirLinks) {
+		return cfg.pointCurrent(dir, err)
+	} else if err != nil {
 		return fmt.Errorf("creating current symlink: %w", err)
 	}
+	if err := injectFault("switch.rename"); err != nil {
+		fs.remove(tmp)
+		return fmt.Errorf("replacing current symlink: %w", err)
+	}
+	if err := fs.replaceLink(tmp, link); err != nil {
+		fs.remove(tmp)
+		return fmt.Errorf("replacing current symlink: %w", err)
+	}
 
 	return nil
 }
 
-// EnsureBinary ensures the file exists and is executable, or returns an error
+// pointCurrent makes current a file naming the version directory, the current pointer,
+// where the link to it couldn't be created
+func (cfg *Config) pointCurrent(dir string, linkErr error) error {
+	logger.Warnf("writing the current version to a file: %v", linkErr)
+	// the pointer can't be renamed over a link to a directory
+	link := cfg.currentPath()
+	if info, err := os.Lstat(link); err == nil && !info.Mode().IsRegular() {
+		if err := cfg.fs().remove(link); err != nil {
+			return fmt.Errorf("removing current symlink: %w", err)
+		}
+	}
+	return cfg.writeCurrentPointer(dir)
+}
+
+// EnsureBinary ensures the file exists, is executable and can run on this host, or returns
+// an error. A binary for another platform, or one needing a shared library that isn't
+// installed, is refused here rather than with an exec error at the upgrade height.
 func EnsureBinary(path string) error {
 	info, err := os.Stat(path)
 	if err != nil {
 		return fmt.Errorf("cannot stat dir %s: %w", path, err)
 	}
+	if err := checkBinary(info); err != nil {
+		return err
+	}
+	return checkPlatform(path)
+}
 
+// checkBinary is EnsureBinary for a file that was already stat'ed
+func checkBinary(info os.FileInfo) error {
 	if !info.Mode().IsRegular() {
 		return fmt.Errorf("%s is not a regular file", info.Name())
 	}
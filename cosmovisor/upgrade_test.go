@@ -1,9 +1,12 @@
+//go:build linux
 // +build linux
 
 package cosmovisor_test
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -81,10 +84,10 @@ func (s *upgradeTestSuite) assertCurrentLink(cfg cosmovisor.Config, target strin
 	s.Require().NoError(err)
 	s.Require().Equal(os.ModeSymlink, info.Mode()&os.ModeSymlink)
 
+	// the link is relative, so the home can be moved
 	dest, err := os.Readlink(link)
 	s.Require().NoError(err)
-	expected := filepath.Join(cfg.Root(), target)
-	s.Require().Equal(expected, dest)
+	s.Require().Equal(target, dest)
 }
 
 // TODO: test with download (and test all download functions)
@@ -122,11 +125,184 @@ func (s *upgradeTestSuite) TestDoUpgradeNoDownloadUrl() {
 	}
 }
 
+func (s *upgradeTestSuite) TestDoUpgradeRequiresNewerCosmovisor() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd"}
+	defer func(v string) { cosmovisor.Version = v }(cosmovisor.Version)
+	cosmovisor.Version = "v0.1.0"
+
+	info := &cosmovisor.UpgradeInfo{Name: "chain2", Info: `{"cosmovisor_min_version":"v0.2.0-rc1"}`}
+	err := cosmovisor.DoUpgrade(cfg, info)
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), "requires cosmovisor v0.2.0-rc1 or newer, this is v0.1.0")
+
+	// the switch wasn't attempted
+	currentBin, err := cfg.CurrentBin()
+	s.Require().NoError(err)
+	s.Require().Equal(cfg.GenesisBin(), currentBin)
+
+	cosmovisor.Version = "v0.2.0"
+	s.Require().NoError(cosmovisor.DoUpgrade(cfg, info))
+}
+
+func (s *upgradeTestSuite) TestDoUpgradePreflight() {
+	home := copyTestData(s.T(), "validate")
+	cfg := &cosmovisor.Config{Home: home, Name: "dummyd", PreflightVersion: "{{.Name}}"}
+	s.Require().NoError(ioutil.WriteFile(cfg.UpgradeBin("chain2"), []byte("#!/bin/sh\necho chain1\n"), 0o755))
+
+	// the binary reports another version, nothing is switched
+	err := cosmovisor.DoUpgrade(cfg, &cosmovisor.UpgradeInfo{Name: "chain2"})
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), `preflight: `+cfg.UpgradeBin("chain2")+` version reports "chain1", DAEMON_PREFLIGHT_VERSION expects "chain2"`)
+	s.Require().Equal(cfg.GenesisBin(), mustCurrentBin(s.T(), cfg))
+
+	s.Require().NoError(ioutil.WriteFile(cfg.UpgradeBin("chain2"), []byte("#!/bin/sh\necho chain2\n"), 0o755))
+	s.Require().NoError(cosmovisor.DoUpgrade(cfg, &cosmovisor.UpgradeInfo{Name: "chain2"}))
+	s.Require().Equal(cfg.UpgradeBin("chain2"), mustCurrentBin(s.T(), cfg))
+}
+
+func (s *upgradeTestSuite) TestDoUpgradeDownloadsWithChecksum() {
+	home := copyTestData(s.T(), "download")
+	cfg := &cosmovisor.Config{Home: home, Name: "autod", AllowDownloadBinaries: true, DownloadMustHaveChecksum: true}
+	bin, err := filepath.Abs("./testdata/repo/raw_binary/autod")
+	s.Require().NoError(err)
+	plan := func(name, checksum string) *cosmovisor.UpgradeInfo {
+		return &cosmovisor.UpgradeInfo{
+			Name: name,
+			Info: fmt.Sprintf(`{"binaries":{"%s": "%s?checksum=sha256:%s"}}`, cosmovisor.OSArch(), bin, checksum),
+		}
+	}
+
+	// a mismatch fails the upgrade and leaves nothing behind, so the next start downloads again
+	err = cosmovisor.DoUpgrade(cfg, plan("amazonas", "73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906"))
+	s.Require().Error(err)
+	s.Require().Equal(cfg.GenesisBin(), mustCurrentBin(s.T(), cfg))
+	_, err = os.Stat(cfg.UpgradeDir("amazonas"))
+	s.Require().True(os.IsNotExist(err))
+
+	// the verified binary is installed and becomes current
+	err = cosmovisor.DoUpgrade(cfg, plan("amazonas", "e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d"))
+	s.Require().NoError(err)
+	s.Require().Equal(cfg.UpgradeBin("amazonas"), mustCurrentBin(s.T(), cfg))
+}
+
+func (s *upgradeTestSuite) TestDoUpgradePlanChecksum() {
+	home := copyTestData(s.T(), "download")
+	cfg := &cosmovisor.Config{Home: home, Name: "autod", AllowDownloadBinaries: true}
+	bin, err := filepath.Abs("./testdata/repo/raw_binary/autod")
+	s.Require().NoError(err)
+	other, err := filepath.Abs("./testdata/download/cosmovisor/genesis/bin/autod")
+	s.Require().NoError(err)
+	plan := func(name, checksum string, urls ...string) *cosmovisor.UpgradeInfo {
+		return &cosmovisor.UpgradeInfo{
+			Name: name,
+			Info: fmt.Sprintf(`{"binaries":{"%s": ["%s"]},"checksums":{"%s": "%s"}}`, cosmovisor.OSArch(), strings.Join(urls, `", "`), cosmovisor.OSArch(), checksum),
+		}
+	}
+
+	// the first mirror serves another binary, the second one the binary of the plan
+	err = cosmovisor.DoUpgrade(cfg, plan("amazonas", "sha256:e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d", other, bin))
+	s.Require().NoError(err)
+	s.Require().Equal(cfg.UpgradeBin("amazonas"), mustCurrentBin(s.T(), cfg))
+
+	// a staged binary must match too
+	home = copyTestData(s.T(), "validate")
+	cfg = &cosmovisor.Config{Home: home, Name: "dummyd"}
+	info := plan("chain2", "sha256:73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906", bin)
+	err = cosmovisor.DoUpgrade(cfg, info)
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), `doesn't match the plan of upgrade "chain2"`)
+	s.Require().Equal(cfg.GenesisBin(), mustCurrentBin(s.T(), cfg))
+
+	s.Require().Error(cosmovisor.DoUpgrade(cfg, plan("chain2", "file:https://example.com/SHA256SUMS", bin)), "a checksum file can't be verified")
+
+	cfg.UnsafeSkipPlanChecksum = true
+	s.Require().NoError(cosmovisor.DoUpgrade(cfg, info))
+	s.Require().Equal(cfg.UpgradeBin("chain2"), mustCurrentBin(s.T(), cfg))
+}
+
+func (s *upgradeTestSuite) TestDoUpgradeFollowsReference() {
+	home := copyTestData(s.T(), "download")
+	cfg := &cosmovisor.Config{Home: home, Name: "autod", AllowDownloadBinaries: true, DownloadMustHaveChecksum: true}
+	defer func(v string) { cosmovisor.Version = v }(cosmovisor.Version)
+	cosmovisor.Version = "v0.1.0"
+	bin, err := filepath.Abs("./testdata/repo/raw_binary/autod")
+	s.Require().NoError(err)
+	doc := filepath.Join(s.T().TempDir(), "amazonas.json")
+	bz := []byte(fmt.Sprintf(`{"binaries":{"%s": "%s?checksum=sha256:e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d"},"cosmovisor_min_version":"v0.2.0"}`,
+		cosmovisor.OSArch(), bin))
+	s.Require().NoError(ioutil.WriteFile(doc, bz, 0644))
+	pinned := fmt.Sprintf("%s?checksum=sha256:%x", doc, sha256.Sum256(bz))
+
+	// whoever can change an unpinned document picks the binary
+	err = cosmovisor.DoUpgrade(cfg, &cosmovisor.UpgradeInfo{Name: "amazonas", Info: doc})
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), "a checksum is required")
+	s.Require().Equal(cfg.GenesisBin(), mustCurrentBin(s.T(), cfg))
+
+	// the linked document needs a newer cosmovisor, nothing is downloaded
+	err = cosmovisor.DoUpgrade(cfg, &cosmovisor.UpgradeInfo{Name: "amazonas", Info: pinned})
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), "requires cosmovisor v0.2.0 or newer")
+	_, err = os.Stat(cfg.UpgradeDir("amazonas"))
+	s.Require().True(os.IsNotExist(err))
+
+	cosmovisor.Version = "v0.2.0"
+	s.Require().NoError(cosmovisor.DoUpgrade(cfg, &cosmovisor.UpgradeInfo{Name: "amazonas", Info: pinned}))
+	s.Require().Equal(cfg.UpgradeBin("amazonas"), mustCurrentBin(s.T(), cfg))
+}
+
+func mustCurrentBin(t *testing.T, cfg *cosmovisor.Config) string {
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	return bin
+}
+
 func (s *upgradeTestSuite) TestOsArch() {
 	// all download tests will fail if we are not on linux...
 	s.Require().Equal("linux/amd64", cosmovisor.OSArch())
 }
 
+func (s *upgradeTestSuite) TestBinaryURL() {
+	fleet := cosmovisor.UpgradeConfig{Binaries: map[string]cosmovisor.URLList{
+		"linux/amd64":  {"https://example.com/linux-amd64"},
+		"linux/arm64":  {"https://example.com/linux-arm64"},
+		"darwin/arm64": {"https://example.com/darwin-arm64"},
+	}}
+	aliased := cosmovisor.UpgradeConfig{Binaries: map[string]cosmovisor.URLList{
+		"Linux/x86_64":  {"https://example.com/linux-x86_64"},
+		"linux/aarch64": {"https://example.com/linux-aarch64"},
+		"any":           {"https://example.com/any"},
+	}}
+
+	cases := map[string]struct {
+		config   cosmovisor.UpgradeConfig
+		platform string
+		url      string
+		err      string
+	}{
+		"linux/amd64":         {config: fleet, platform: "linux/amd64", url: "https://example.com/linux-amd64"},
+		"linux/arm64":         {config: fleet, platform: "linux/arm64", url: "https://example.com/linux-arm64"},
+		"darwin/arm64":        {config: fleet, platform: "darwin/arm64", url: "https://example.com/darwin-arm64"},
+		"missing platform":    {config: fleet, platform: "darwin/amd64", err: "the plan has darwin/arm64, linux/amd64, linux/arm64"},
+		"no binaries":         {platform: "linux/amd64", err: "the plan has no binaries"},
+		"x86_64 alias":        {config: aliased, platform: "linux/amd64", url: "https://example.com/linux-x86_64"},
+		"aarch64 alias":       {config: aliased, platform: "linux/arm64", url: "https://example.com/linux-aarch64"},
+		"any as the fallback": {config: aliased, platform: "darwin/arm64", url: "https://example.com/any"},
+		"other os, same arch": {config: aliased, platform: "windows/amd64", url: "https://example.com/any"},
+	}
+	for name, tc := range cases {
+		url, err := tc.config.BinaryURL(tc.platform)
+		if tc.err != "" {
+			s.Require().Error(err, name)
+			s.Require().Contains(err.Error(), tc.err, name)
+			continue
+		}
+		s.Require().NoError(err, name)
+		s.Require().Equal(tc.url, url, name)
+	}
+}
+
 func (s *upgradeTestSuite) TestGetDownloadURL() {
 	// all download tests will fail if we are not on linux...
 	ref, err := filepath.Abs(filepath.FromSlash("./testdata/repo/ref_zipped"))
@@ -185,9 +361,11 @@ func (s *upgradeTestSuite) TestGetDownloadURL() {
 
 func (s *upgradeTestSuite) TestDownloadBinary() {
 	cases := map[string]struct {
-		url         string
-		canDownload bool
-		validBinary bool
+		url              string
+		binaryPath       string
+		mustHaveChecksum bool
+		canDownload      bool
+		validBinary      bool
 	}{
 		"get raw binary": {
 			url:         "./testdata/repo/raw_binary/autod",
@@ -219,21 +397,109 @@ func (s *upgradeTestSuite) TestDownloadBinary() {
 			url:         "./testdata/repo/zip_directory/autod.zip?checksum=sha256:73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906",
 			canDownload: false,
 		},
+		"get raw binary with sha512 checksum": {
+			// sha512sum ./testdata/repo/raw_binary/autod
+			url:         "./testdata/repo/raw_binary/autod?checksum=sha512:fee982a983ba2aea8e13fca01a84772f4bfee6e82fba2d47899bc18517d6346a37cf20bac5b3865b1f7c8b7a29193e665814172c292efcb15e032ab15cbb2cce",
+			canDownload: true,
+			validBinary: true,
+		},
+		"get raw binary with md5 checksum": {
+			// md5sum ./testdata/repo/raw_binary/autod
+			url:         "./testdata/repo/raw_binary/autod?checksum=md5:94ee569d8d34274997e282c39e8446a6",
+			canDownload: true,
+			validBinary: true,
+		},
+		"get raw binary with bare checksum": {
+			url:         "./testdata/repo/raw_binary/autod?checksum=e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d",
+			canDownload: true,
+			validBinary: true,
+		},
+		"get raw binary with invalid bare md5 checksum": {
+			url:         "./testdata/repo/raw_binary/autod?checksum=0cc175b9c0f1b6a831c399e269772661",
+			canDownload: false,
+		},
+		"get raw binary with blake2b checksum": {
+			// b2sum -l 256 ./testdata/repo/raw_binary/autod
+			url:         "./testdata/repo/raw_binary/autod?checksum=blake2b-256:f987cfc6f94d770a1a491403b1a7266c57801bd01793c3dccd849ab87841024f",
+			canDownload: true,
+			validBinary: true,
+		},
+		"get raw binary with invalid blake2b checksum": {
+			url:         "./testdata/repo/raw_binary/autod?checksum=blake2b-256:0671df81f5dcccbe0385ab830df57d6189ac5395eb6e04bc225bb78e749c7563",
+			canDownload: false,
+		},
+		"get zipped directory with blake2b multihash": {
+			url:         "./testdata/repo/zip_directory/autod.zip?checksum=a0e402200671df81f5dcccbe0385ab830df57d6189ac5395eb6e04bc225bb78e749c7563",
+			canDownload: true,
+			validBinary: true,
+		},
+		"get raw binary with base58 multihash": {
+			url:         "./testdata/repo/raw_binary/autod?checksum=QmdsMATQbnA6NWVp59V516vw61a4ZK89mkRgG5Jc7aiQdr",
+			canDownload: true,
+			validBinary: true,
+		},
+		"unknown checksum algorithm": {
+			url:         "./testdata/repo/raw_binary/autod?checksum=sha3:e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d",
+			canDownload: false,
+		},
+		"checksum required": {
+			url:              "./testdata/repo/raw_binary/autod",
+			mustHaveChecksum: true,
+			canDownload:      false,
+		},
+		"checksum required with checksum": {
+			url:              "./testdata/repo/raw_binary/autod?checksum=blake2b-256:f987cfc6f94d770a1a491403b1a7266c57801bd01793c3dccd849ab87841024f",
+			mustHaveChecksum: true,
+			canDownload:      true,
+			validBinary:      true,
+		},
 		"invalid url": {
 			url:         "./testdata/repo/bad_dir/autod",
 			canDownload: false,
 		},
+		"get tar.gz with nested binary": {
+			url:         "./testdata/repo/tar_nested/autod.tar.gz?checksum=sha256:775edaf035426ca04adbb781cbdf12caa25bc111a800ebfdedf9cb62ba95f4a2",
+			binaryPath:  "autod-v2/bin/autod",
+			canDownload: true,
+			validBinary: true,
+		},
+		"get zip with nested binary": {
+			url:         "./testdata/repo/zip_nested/autod.zip?checksum=sha256:6463110af61f855f44f60e638b9c26455ed5a92ca817f1504b540e2414a659f7",
+			binaryPath:  "release/linux/autod",
+			canDownload: true,
+			validBinary: true,
+		},
+		"get tar.gz without binary path": {
+			url:         "./testdata/repo/tar_nested/autod.tar.gz",
+			canDownload: false,
+		},
+		"binary path not in archive": {
+			url:         "./testdata/repo/tar_nested/autod.tar.gz",
+			binaryPath:  "autod-v2/autod",
+			canDownload: false,
+		},
+		"binary path is a directory": {
+			url:         "./testdata/repo/tar_nested/autod.tar.gz",
+			binaryPath:  "autod-v2/bin",
+			canDownload: false,
+		},
+		"binary path outside the archive": {
+			url:         "./testdata/repo/tar_nested/autod.tar.gz",
+			binaryPath:  "../genesis/bin/autod",
+			canDownload: false,
+		},
 	}
 
-	for _, tc := range cases {
+	for name, tc := range cases {
 		var err error
 		// make temp dir
 		home := copyTestData(s.T(), "download")
 
 		cfg := &cosmovisor.Config{
-			Home:                  home,
-			Name:                  "autod",
-			AllowDownloadBinaries: true,
+			Home:                     home,
+			Name:                     "autod",
+			AllowDownloadBinaries:    true,
+			DownloadMustHaveChecksum: tc.mustHaveChecksum,
 		}
 
 		// if we have a relative path, make it absolute, but don't change eg. https://... urls
@@ -246,21 +512,21 @@ func (s *upgradeTestSuite) TestDownloadBinary() {
 		upgrade := "amazonas"
 		info := &cosmovisor.UpgradeInfo{
 			Name: upgrade,
-			Info: fmt.Sprintf(`{"binaries":{"%s": "%s"}}`, cosmovisor.OSArch(), url),
+			Info: fmt.Sprintf(`{"binaries":{"%s": "%s"}, "binary_path": "%s"}`, cosmovisor.OSArch(), url, tc.binaryPath),
 		}
 
 		err = cosmovisor.DownloadBinary(cfg, info)
 		if !tc.canDownload {
-			s.Require().Error(err)
-			return
+			s.Require().Error(err, name)
+			continue
 		}
-		s.Require().NoError(err)
+		s.Require().NoError(err, name)
 
 		err = cosmovisor.EnsureBinary(cfg.UpgradeBin(upgrade))
 		if tc.validBinary {
-			s.Require().NoError(err)
+			s.Require().NoError(err, name)
 		} else {
-			s.Require().Error(err)
+			s.Require().Error(err, name)
 		}
 	}
 }
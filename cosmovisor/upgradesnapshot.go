@@ -0,0 +1,420 @@
+package cosmovisor
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// upgradeSnapshotFile records the environment an upgrade was applied in, in its upgrade
+	// directory, for the investigation of an upgrade that went wrong
+	upgradeSnapshotFile = "upgrade-snapshot.json"
+	// upgradeSnapshotsDir holds, in the state directory, the snapshots of the upgrades
+	// without an upgrade directory to keep them in: in an immutable layout or failed early
+	upgradeSnapshotsDir = "snapshots"
+)
+
+// secretEnvWords mark the environment variables whose values a snapshot leaves out
+var secretEnvWords = []string{"TOKEN", "SECRET", "PASSWORD", "PASSWD", "KEY", "CREDENTIAL", "AUTH"}
+
+// UpgradeSnapshot is the environment an upgrade was applied in, taken as it starts and
+// completed with its result
+type UpgradeSnapshot struct {
+	Upgrade    *UpgradeInfo `json:"upgrade"`
+	TakenAt    time.Time    `json:"taken_at"`
+	Cosmovisor BuildInfo    `json:"cosmovisor"`
+	Host       string       `json:"host,omitempty"`
+	// Settings is the config in effect, as `cosmovisor config` prints it
+	Settings []Setting `json:"settings"`
+	// Env is the environment of the daemon, the variables of cosmovisor as in Settings and
+	// the values of secrets left out
+	Env      []string           `json:"env"`
+	Binaries []SnapshotBinary   `json:"binaries"`
+	Links    []SnapshotLink     `json:"links"`
+	Node     SnapshotNode       `json:"node"`
+	Disks    []SnapshotDiskFree `json:"disks"`
+	// Result is succeeded or failed once the upgrade finished, Error why it failed
+	Result     string     `json:"result,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// SnapshotBinary is a binary of the upgrade: the one that ran before, the one of the
+// upgrade or the genesis binary
+type SnapshotBinary struct {
+	Role   string `json:"role"`
+	Path   string `json:"path"`
+	Link   string `json:"link,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// SnapshotLink is where the current link pointed when the snapshot was taken or finished
+type SnapshotLink struct {
+	When   string `json:"when"`
+	Path   string `json:"path"`
+	Target string `json:"target,omitempty"`
+	// Binary is the binary the link resolves to
+	Binary string `json:"binary"`
+	Error  string `json:"error,omitempty"`
+}
+
+// SnapshotNode is the state of the node as the upgrade started
+type SnapshotNode struct {
+	Height       int64  `json:"height,omitempty"`
+	HeightSource string `json:"height_source,omitempty"`
+	// DaemonPID is the daemon cosmovisor recorded last, Running whether it still runs
+	DaemonPID int    `json:"daemon_pid,omitempty"`
+	Running   bool   `json:"running"`
+	Error     string `json:"error,omitempty"`
+}
+
+// SnapshotDiskFree is the space left on the file system of a directory of the node
+type SnapshotDiskFree struct {
+	Dir   string `json:"dir"`
+	Path  string `json:"path"`
+	Free  uint64 `json:"free,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// takeUpgradeSnapshot records the environment upgrade info is applied in. It returns nil if
+// the upgrade name can't name a file. Taking it never holds the upgrade up, a part that
+// can't be read records why.
+func (cfg *Config) takeUpgradeSnapshot(info *UpgradeInfo) *UpgradeSnapshot {
+	if ValidateUpgradeName(info.Name) != nil {
+		return nil
+	}
+	s := &UpgradeSnapshot{
+		Upgrade:    info,
+		TakenAt:    NowUTC(),
+		Cosmovisor: GetBuildInfo(),
+		Settings:   cfg.Settings(),
+	}
+	s.Host, _ = os.Hostname()
+	s.Env = snapshotEnv(cfg.daemonEnv(), s.Settings)
+
+	oldBin, _ := cfg.resolveCurrentBin()
+	s.Binaries = []SnapshotBinary{
+		snapshotBinary("current", oldBin),
+		snapshotBinary("upgrade", cfg.UpgradeBin(info.Name)),
+	}
+	if genesis := cfg.GenesisBin(); genesis != oldBin {
+		s.Binaries = append(s.Binaries, snapshotBinary("genesis", genesis))
+	}
+	s.Links = []SnapshotLink{cfg.snapshotLink("before")}
+
+	if h, err := cfg.ProbeLocalHeight(); err == nil {
+		s.Node.Height, s.Node.HeightSource = h.Height, h.Source
+	} else {
+		s.Node.Error = err.Error()
+	}
+	var state RunState
+	if ok, _ := cfg.readStateFile(runStateFile, &state); ok {
+		s.Node.DaemonPID, s.Node.Running = state.DaemonPID, processAlive(state.DaemonPID)
+	}
+
+	for _, d := range []struct{ name, path string }{
+		{"home", cfg.Home}, {"data", cfg.DataDir()}, {"state", cfg.StateDir()},
+		{"upgrades", cfg.upgradesPath()}, {"backups", cfg.dataBackupDir()}, {"staging", cfg.stagingPath()},
+	} {
+		disk := SnapshotDiskFree{Dir: d.name, Path: d.path}
+		if free, err := diskFree(d.path); err == nil {
+			disk.Free = free
+		} else {
+			disk.Error = err.Error()
+		}
+		s.Disks = append(s.Disks, disk)
+	}
+	cfg.writeUpgradeSnapshot(s)
+	return s
+}
+
+// finishUpgradeSnapshot records the result of the upgrade of s, err if it failed, with the
+// binary of the upgrade and the current link as it left them
+func (cfg *Config) finishUpgradeSnapshot(s *UpgradeSnapshot, err error) {
+	if s == nil {
+		return
+	}
+	now := NowUTC()
+	s.FinishedAt = &now
+	s.Result = "succeeded"
+	if err != nil {
+		s.Result, s.Error = "failed", err.Error()
+	}
+	for i, b := range s.Binaries {
+		if b.Role == "upgrade" {
+			s.Binaries[i] = snapshotBinary(b.Role, b.Path)
+		}
+	}
+	s.Links = append(s.Links, cfg.snapshotLink("after"))
+	cfg.writeUpgradeSnapshot(s)
+}
+
+// snapshotBinary describes the binary at path
+func snapshotBinary(role, path string) SnapshotBinary {
+	b := SnapshotBinary{Role: role, Path: path}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		b.Link, _ = os.Readlink(path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		b.Error = err.Error()
+		return b
+	}
+	b.Size, b.Mode = fi.Size(), fi.Mode().String()
+	if b.SHA256, err = sha256File(path); err != nil {
+		b.Error = err.Error()
+	}
+	return b
+}
+
+// snapshotLink describes the current link
+func (cfg *Config) snapshotLink(when string) SnapshotLink {
+	l := SnapshotLink{When: when, Path: cfg.currentPath()}
+	l.Binary, _ = cfg.resolveCurrentBin()
+	target, err := readDirLink(l.Path)
+	if err != nil {
+		l.Error = err.Error()
+	}
+	l.Target = target
+	return l
+}
+
+// snapshotEnv is env, the environment of cosmovisor if nil, with the variables listed in
+// settings set to the value in effect there, and the values of the others that name a
+// secret left out. The passwords of URLs are hidden.
+func snapshotEnv(env []string, settings []Setting) []string {
+	if env == nil {
+		env = environ()
+	}
+	values := make(map[string]string, len(settings))
+	for _, s := range settings {
+		values[s.Env] = s.Value
+	}
+	redacted := make([]string, 0, len(env))
+	for _, kv := range env {
+		kv := strings.SplitN(kv, "=", 2)
+		name, value := kv[0], ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		if v, ok := values[name]; ok {
+			value = v
+		} else {
+			value = redactEnvValue(name, value)
+		}
+		redacted = append(redacted, name+"="+value)
+	}
+	return redacted
+}
+
+// redactEnvValue is the value of the variable name with a secret left out, going by its
+// name, and the passwords of URLs hidden
+func redactEnvValue(name, value string) string {
+	if isSecretEnv(name) {
+		return "xxxxx"
+	}
+	if strings.Contains(value, "://") {
+		return redactURL(value)
+	}
+	return value
+}
+
+// isSecretEnv returns true if the variable name holds a secret, going by its name
+func isSecretEnv(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, word := range secretEnvWords {
+		if strings.Contains(upper, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeSnapshotPath is where the snapshot of the named upgrade is kept: in its upgrade
+// directory, or in the state directory if there is none or the layout is immutable
+func (cfg *Config) upgradeSnapshotPath(name string) string {
+	if !cfg.Immutable {
+		if fi, err := os.Stat(cfg.UpgradeDir(name)); err == nil && fi.IsDir() {
+			return filepath.Join(cfg.UpgradeDir(name), upgradeSnapshotFile)
+		}
+	}
+	return cfg.stateSnapshotPath(name)
+}
+
+func (cfg *Config) stateSnapshotPath(name string) string {
+	return filepath.Join(cfg.StateDir(), upgradeSnapshotsDir, url.PathEscape(name)+".json")
+}
+
+// writeUpgradeSnapshot records s. The upgrade isn't held up for it, a failure is only
+// logged. A snapshot of the state directory moves to the upgrade directory once there is one.
+func (cfg *Config) writeUpgradeSnapshot(s *UpgradeSnapshot) {
+	name := s.Upgrade.Name
+	err := func() error {
+		bz, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		fs := cfg.fs()
+		path := cfg.upgradeSnapshotPath(name)
+		if err := fs.mkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := fs.writeFile(path+".tmp", append(bz, '\n'), 0644); err != nil {
+			return err
+		}
+		if err := fs.rename(path+".tmp", path); err != nil {
+			return err
+		}
+		if state := cfg.stateSnapshotPath(name); state != path {
+			if err := fs.remove(state); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		logger.Warnf("recording the snapshot of upgrade %q: %v", name, err)
+	}
+}
+
+// UpgradeSnapshot returns the snapshot of the environment the named upgrade was applied in,
+// nil if there is none
+func (cfg *Config) UpgradeSnapshot(name string) (*UpgradeSnapshot, error) {
+	if err := ValidateUpgradeName(name); err != nil {
+		return nil, err
+	}
+	path := cfg.upgradeSnapshotPath(name)
+	bz, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s UpgradeSnapshot
+	if err := json.Unmarshal(bz, &s); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// WriteUpgradeBundle writes what was recorded about the named upgrade to w as a gzip
+// compressed tar archive, for the investigation of an upgrade: its snapshot, its entries
+// of the history, its events, its journal if it was the last upgrade applied and the
+// overrides of its upgrade directory, in a directory named after the upgrade. It fails
+// if nothing was recorded about the upgrade.
+func (cfg *Config) WriteUpgradeBundle(name string, w io.Writer) error {
+	files, err := cfg.upgradeBundleFiles(name)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("nothing was recorded about upgrade %q", name)
+	}
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	dir := url.PathEscape(name)
+	now := NowUTC()
+	for _, f := range files {
+		hdr := &tar.Header{Name: path.Join(dir, f.name), Mode: 0644, Size: int64(len(f.content)), ModTime: now, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+type bundleFile struct {
+	name    string
+	content []byte
+}
+
+// upgradeBundleFiles collects the files of the bundle of the named upgrade
+func (cfg *Config) upgradeBundleFiles(name string) ([]bundleFile, error) {
+	var files []bundleFile
+	addJSON := func(file string, v interface{}) error {
+		bz, err := json.MarshalIndent(v, "", "  ")
+		if err == nil {
+			files = append(files, bundleFile{file, append(bz, '\n')})
+		}
+		return err
+	}
+
+	snapshot, err := cfg.UpgradeSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot != nil {
+		if err := addJSON(upgradeSnapshotFile, snapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	history, err := cfg.UpgradeHistory()
+	if err != nil {
+		return nil, err
+	}
+	var entries []HistoryEntry
+	for _, e := range history {
+		if e.Name == name {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) > 0 {
+		if err := addJSON(historyFile, entries); err != nil {
+			return nil, err
+		}
+	}
+
+	events, _, err := ReadEvents(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var lines []byte
+	for _, ev := range events {
+		if ev.Upgrade != name {
+			continue
+		}
+		bz, err := json.Marshal(ev)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(append(lines, bz...), '\n')
+	}
+	if len(lines) > 0 {
+		files = append(files, bundleFile{eventLogFile, lines})
+	}
+
+	// what the rest was recorded with is only worth adding if there is a record
+	if len(files) == 0 {
+		return nil, nil
+	}
+	if j, err := cfg.UpgradeJournal(); err == nil && j != nil && j.Info.Name == name {
+		if err := addJSON(upgradeJournalFile, j); err != nil {
+			return nil, err
+		}
+	}
+	if bz, err := ioutil.ReadFile(filepath.Join(cfg.UpgradeDir(name), overridesFile)); err == nil {
+		files = append(files, bundleFile{overridesFile, bz})
+	}
+	return files, nil
+}
@@ -0,0 +1,473 @@
+package cosmovisor
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The names of the built-in upgrade sources in DAEMON_UPGRADE_SOURCES
+const (
+	SourceAdmin  = "admin"
+	SourceFile   = "file"
+	SourceChain  = "chain"
+	SourceOutput = "output"
+)
+
+// EventUpgradeConflict is sent when two upgrade sources disagree about the upgrade the
+// daemon halted for
+const EventUpgradeConflict = "upgrade_conflict"
+
+// defaultSourcePriority is the priority of the built-in sources, highest first: the
+// operator, the plan the app writes, the plan of the chain, then the upgrade line
+var defaultSourcePriority = []string{SourceAdmin, SourceFile, SourceChain, SourceOutput}
+
+// UpgradeSource is a way of learning that the daemon reached an upgrade: its output, the
+// plan file it writes, the plan of the chain, a request on the admin API, or a source
+// added with RegisterUpgradeSource
+type UpgradeSource interface {
+	// Name describes the source in the logs
+	Name() string
+	// Watch reports the upgrades found until done is closed or the source has nothing more
+	// to tell, and returns the error that ended it, if any
+	Watch(done <-chan struct{}, report func(*UpgradeInfo)) error
+}
+
+// UpgradeConflict is what cosmovisor does when two sources report the same upgrade at
+// different heights, or different upgrades at the same height
+type UpgradeConflict string
+
+const (
+	// ConflictPriority applies the upgrade of the source of higher priority
+	ConflictPriority UpgradeConflict = "priority"
+	// ConflictHalt applies neither, the daemon is stopped and cosmovisor exits
+	ConflictHalt UpgradeConflict = "halt"
+)
+
+// UpgradeConflictError is the disagreement of two sources that halted the node
+type UpgradeConflictError struct {
+	Upgrade     *UpgradeInfo
+	Source      string
+	Other       *UpgradeInfo
+	OtherSource string
+}
+
+func (e *UpgradeConflictError) Error() string {
+	return fmt.Sprintf("upgrade %q at height %d reported by %s conflicts with upgrade %q at height %d reported by %s",
+		e.Upgrade.Name, e.Upgrade.Height, e.Source, e.Other.Name, e.Other.Height, e.OtherSource)
+}
+
+// parseUpgradeConflict validates the value of DAEMON_UPGRADE_CONFLICT
+func parseUpgradeConflict(s string) (UpgradeConflict, error) {
+	switch c := UpgradeConflict(strings.ToLower(strings.TrimSpace(s))); c {
+	case "":
+		return ConflictPriority, nil
+	case ConflictPriority, ConflictHalt:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown upgrade conflict %q, must be %s or %s", s, ConflictPriority, ConflictHalt)
+	}
+}
+
+// upgradeConflict is what a conflict of the sources does, the priority decides by default
+func (cfg *Config) upgradeConflict() UpgradeConflict {
+	if cfg == nil {
+		return ConflictPriority
+	}
+	return UpgradeConflict(orDefault(string(cfg.UpgradeConflict), string(ConflictPriority)))
+}
+
+var upgradeSources struct {
+	mutex   sync.Mutex
+	sources []registeredSource
+}
+
+// registeredSource is a source added with RegisterUpgradeSource
+type registeredSource struct {
+	key       string
+	newSource func(*Config) UpgradeSource
+}
+
+// RegisterUpgradeSource adds a source of upgrades to every launch of the daemon, typically
+// from an init function. newSource returns the source of a launch, or nil for none. The
+// source ranks as key in DAEMON_UPGRADE_SOURCES, which is only accepted once it is added.
+func RegisterUpgradeSource(key string, newSource func(cfg *Config) UpgradeSource) {
+	upgradeSources.mutex.Lock()
+	defer upgradeSources.mutex.Unlock()
+	upgradeSources.sources = append(upgradeSources.sources, registeredSource{key: strings.ToLower(key), newSource: newSource})
+}
+
+// registeredKeys are the keys of the sources added with RegisterUpgradeSource
+func registeredKeys() []string {
+	upgradeSources.mutex.Lock()
+	defer upgradeSources.mutex.Unlock()
+	keys := make([]string, len(upgradeSources.sources))
+	for i, r := range upgradeSources.sources {
+		keys[i] = r.key
+	}
+	return keys
+}
+
+// customSource is the source of a launch returned by a registered source
+type customSource struct {
+	UpgradeSource
+	key string
+}
+
+// registeredSources returns the sources of a launch added with RegisterUpgradeSource
+func (cfg *Config) registeredSources() []UpgradeSource {
+	upgradeSources.mutex.Lock()
+	registered := append([]registeredSource(nil), upgradeSources.sources...)
+	upgradeSources.mutex.Unlock()
+	var sources []UpgradeSource
+	for _, r := range registered {
+		if src := r.newSource(cfg); src != nil {
+			sources = append(sources, customSource{UpgradeSource: src, key: r.key})
+		}
+	}
+	return sources
+}
+
+// parseUpgradeSources validates the value of DAEMON_UPGRADE_SOURCES, the comma separated
+// names of the sources from the highest priority to the lowest
+func parseUpgradeSources(s string) ([]string, error) {
+	known := append(append([]string(nil), defaultSourcePriority...), registeredKeys()...)
+	var keys []string
+	for _, key := range strings.Split(s, ",") {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			continue
+		}
+		if !containsString(known, key) {
+			return nil, fmt.Errorf("unknown upgrade source %q, must be one of %s", key, strings.Join(known, ", "))
+		}
+		if containsString(keys, key) {
+			return nil, fmt.Errorf("upgrade source %q is listed twice", key)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sourcePriority is the order of the sources, highest priority first: UpgradeSources, then
+// the built-in sources in their default order, then the registered ones
+func (cfg *Config) sourcePriority() []string {
+	var order []string
+	if cfg != nil {
+		order = append(order, cfg.UpgradeSources...)
+	}
+	for _, key := range append(append([]string(nil), defaultSourcePriority...), registeredKeys()...) {
+		if !containsString(order, key) {
+			order = append(order, key)
+		}
+	}
+	return order
+}
+
+// sourceRank is the rank of src in the priority of the sources, 0 being the highest
+func (cfg *Config) sourceRank(src UpgradeSource) int {
+	var key string
+	switch s := src.(type) {
+	case adminSource:
+		key = SourceAdmin
+	case planFileSource:
+		key = SourceFile
+	case chainPlanSource:
+		key = SourceChain
+	case outputSource:
+		key = SourceOutput
+	case customSource:
+		key = s.key
+	}
+	order := cfg.sourcePriority()
+	for i, k := range order {
+		if k == key {
+			return i
+		}
+	}
+	return len(order)
+}
+
+// finalChecker is a source read once more after the daemon exited, for an upgrade it
+// reported right before exiting that the watch didn't see yet
+type finalChecker interface {
+	finalCheck() *UpgradeInfo
+}
+
+// outputSource scans a stream of the daemon's output for the upgrade line
+type outputSource struct {
+	stream string
+	scan   *bufio.Scanner
+	// match is false if the output is only drained, see DAEMON_UPGRADE_DETECTION
+	match bool
+	// blocks records the blocks the daemon logs it committed, if set
+	blocks *blockWatch
+}
+
+func (s outputSource) Name() string {
+	return "the daemon's " + s.stream
+}
+
+// Watch ends with the stream, once the daemon and whoever inherited its output exited
+func (s outputSource) Watch(_ <-chan struct{}, report func(*UpgradeInfo)) error {
+	for s.scan.Scan() {
+		if s.blocks != nil {
+			s.blocks.scan(s.scan.Bytes())
+		}
+		if !s.match {
+			continue
+		}
+		if info := parseUpgradeLine(s.scan.Text()); info != nil {
+			report(info)
+		}
+	}
+	return s.scan.Err()
+}
+
+// planFileSource watches the plan file the app writes to its data directory as it halts
+type planFileSource struct {
+	cfg  *Config
+	seen *planSeen
+}
+
+func (s planFileSource) Name() string {
+	return upgradeInfoFile
+}
+
+func (s planFileSource) Watch(done <-chan struct{}, report func(*UpgradeInfo)) error {
+	if plan := s.cfg.watchPlanFile(s.seen, done); plan != nil {
+		report(plan)
+	}
+	return nil
+}
+
+// finalCheck reads the plan file the app may have written just before it exited
+func (s planFileSource) finalCheck() *UpgradeInfo {
+	return s.cfg.newPlan(s.seen)
+}
+
+// chainPlanSource polls the plan of x/upgrade on DAEMON_PLAN_API
+type chainPlanSource struct {
+	cfg *Config
+	api *NodeAPI
+}
+
+func (s chainPlanSource) Name() string {
+	return s.api.URL
+}
+
+func (s chainPlanSource) Watch(done <-chan struct{}, report func(*UpgradeInfo)) error {
+	if plan := s.cfg.watchChainPlan(s.api, done); plan != nil {
+		report(plan)
+	}
+	return nil
+}
+
+// adminSource is the upgrades requested on the admin API, they are applied even while the
+// supervision is paused
+type adminSource struct {
+	requests <-chan *UpgradeInfo
+}
+
+func (adminSource) Name() string {
+	return "the admin API"
+}
+
+func (s adminSource) Watch(done <-chan struct{}, report func(*UpgradeInfo)) error {
+	for {
+		select {
+		case info := <-s.requests:
+			report(info)
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// upgradePipeline watches all the upgrade sources of a daemon and stops it for the first
+// upgrade one of them reports. The same upgrade reported by other sources is ignored, as
+// is anything reported once the daemon exited and the pipeline decided. A source that
+// reports the same upgrade at another height, or another upgrade at the same height,
+// before then is a conflict, settled as DAEMON_UPGRADE_CONFLICT says.
+type upgradePipeline struct {
+	cfg     *Config
+	cmd     *exec.Cmd
+	sources []UpgradeSource
+	// onUpgrade is called before the daemon is stopped for an upgrade
+	onUpgrade func(*UpgradeInfo)
+
+	res   WaitResult
+	mutex sync.Mutex
+	// reportedBy is the source of the upgrade the daemon is stopped for
+	reportedBy UpgradeSource
+	// conflict halts the node instead of upgrading it
+	conflict *UpgradeConflictError
+	// deferred is the upgrade last deferred while the supervision is paused
+	deferred *UpgradeInfo
+	decided  bool
+}
+
+// newUpgradePipeline returns the pipeline of the sources of cmd, cfg may be nil
+func newUpgradePipeline(cfg *Config, cmd *exec.Cmd, onUpgrade func(*UpgradeInfo), sources ...UpgradeSource) *upgradePipeline {
+	return &upgradePipeline{cfg: cfg, cmd: cmd, sources: sources, onUpgrade: onUpgrade}
+}
+
+// sameUpgrade returns true if a and b are the same plan
+func sameUpgrade(a, b *UpgradeInfo) bool {
+	return a != nil && b != nil && a.Name == b.Name && a.Height == b.Height
+}
+
+// conflictingUpgrades returns true if a and b disagree about the upgrade: the same name at
+// different heights, or different names at the same height. An unknown height agrees with
+// any.
+func conflictingUpgrades(a, b *UpgradeInfo) bool {
+	if a.Height == 0 || b.Height == 0 {
+		return false
+	}
+	return (a.Name == b.Name) != (a.Height == b.Height)
+}
+
+// report stops the daemon for the upgrade src found, unless it was stopped for one already
+// or the supervision is paused
+func (p *upgradePipeline) report(src UpgradeSource, info *UpgradeInfo) {
+	if err := injectFault("upgrade.detect"); err != nil {
+		p.res.SetError(err)
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.decided || p.conflict != nil {
+		return
+	}
+	if current, _ := p.res.AsResult(); current != nil {
+		switch {
+		case sameUpgrade(current, info):
+		case conflictingUpgrades(current, info):
+			p.settleConflict(current, src, info)
+		default:
+			logger.Warnf("ignoring upgrade %q reported by %s, the daemon is stopped for upgrade %q", info.Name, src.Name(), current.Name)
+		}
+		return
+	}
+	if _, requested := src.(adminSource); !requested {
+		if sameUpgrade(p.deferred, info) {
+			return
+		}
+		if admin.deferUpgrade(p.cfg, info) {
+			p.deferred = info
+			return
+		}
+	}
+	p.res.SetUpgrade(info)
+	p.reportedBy = src
+	logger.Infof("upgrade %q at height %d reported by %s", info.Name, info.Height, src.Name())
+	if p.onUpgrade != nil {
+		p.onUpgrade(info)
+	}
+	// the last vote is taken while the old binary still runs, and again once it exited
+	p.cfg.recordValidatorState(info.Name)
+	p.cfg.stopForUpgrade(p.cmd)
+}
+
+// settleConflict settles the upgrade info src reported against current, the upgrade the
+// daemon is stopped for: the source of higher priority wins, or neither is applied
+func (p *upgradePipeline) settleConflict(current *UpgradeInfo, src UpgradeSource, info *UpgradeInfo) {
+	conflict := &UpgradeConflictError{Upgrade: current, Source: p.reportedBy.Name(), Other: info, OtherSource: src.Name()}
+	policy := p.cfg.upgradeConflict()
+	if p.cfg != nil {
+		notify(p.cfg, Event{ID: fmt.Sprintf("%s/%s/%d/%s/%d", EventUpgradeConflict, current.Name, current.Height, info.Name, info.Height),
+			Type: EventUpgradeConflict, Upgrade: current.Name, Height: current.Height, Message: conflict.Error(),
+			Fields: map[string]string{"source": conflict.Source, "other_source": conflict.OtherSource, "other_upgrade": info.Name,
+				"other_height": fmt.Sprint(info.Height), "policy": string(policy)}})
+	}
+	switch {
+	case policy == ConflictHalt:
+		logger.Errorf("%v, applying neither as DAEMON_UPGRADE_CONFLICT is %s", conflict, ConflictHalt)
+		p.conflict = conflict
+	case p.cfg.sourceRank(src) < p.cfg.sourceRank(p.reportedBy):
+		logger.Warnf("%v, applying upgrade %q at height %d of %s, which has the higher priority", conflict, info.Name, info.Height, src.Name())
+		p.res.replaceUpgrade(info)
+		p.reportedBy = src
+	default:
+		logger.Warnf("%v, keeping upgrade %q at height %d of %s, which has the higher priority", conflict, current.Name, current.Height, conflict.Source)
+	}
+}
+
+// run watches the sources until the daemon exits and returns like WaitForUpgradeOrExit, or
+// the conflict of the sources that halted the node
+func (p *upgradePipeline) run() (*UpgradeInfo, error) {
+	done := make(chan struct{})
+	var watching sync.WaitGroup
+	finished := make([]bool, len(p.sources))
+	var finishedMu sync.Mutex
+	for i, src := range p.sources {
+		i, src := i, src
+		watching.Add(1)
+		goGuarded(p.cfg, func() {
+			defer watching.Done()
+			err := src.Watch(done, func(info *UpgradeInfo) { p.report(src, info) })
+			p.res.SetError(err)
+			finishedMu.Lock()
+			finished[i] = true
+			finishedMu.Unlock()
+		})
+	}
+
+	// if the command exits normally (eg. short command like `gaiad version`), just return (nil, nil)
+	// if we had upgrade info, we would have killed it, and thus got a non-nil error code
+	err := p.cmd.Wait()
+	close(done)
+	// give the sources a chance to see what the child wrote right before exiting.
+	// A grandchild still holding the pipes must not keep us waiting forever.
+	watched := make(chan struct{})
+	go func() {
+		watching.Wait()
+		close(watched)
+	}()
+	select {
+	case <-watched:
+	case <-time.After(outputDrainTimeout):
+	}
+
+	// the daemon may have halted for an upgrade right before exiting, and what the other
+	// sources found since must agree with the upgrade reported
+	finishedMu.Lock()
+	for i, src := range p.sources {
+		if checker, ok := src.(finalChecker); ok && finished[i] {
+			if info := checker.finalCheck(); info != nil {
+				p.report(src, info)
+			}
+		}
+	}
+	finishedMu.Unlock()
+	p.mutex.Lock()
+	p.decided = true
+	conflict := p.conflict
+	p.mutex.Unlock()
+	if conflict != nil {
+		return nil, conflict
+	}
+
+	if err == nil {
+		// a daemon stopped for an upgrade may exit cleanly on the stop signal
+		if info, _ := p.res.AsResult(); info != nil {
+			return info, nil
+		}
+		return nil, nil
+	}
+	// this will set the error code if it wasn't stopped due to upgrade
+	p.res.SetError(err)
+	return p.res.AsResult()
+}
@@ -0,0 +1,192 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"os/exec"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSource reports its upgrades in order, then waits for the daemon to exit
+type fakeSource struct {
+	label    string
+	upgrades []*UpgradeInfo
+}
+
+func (s fakeSource) Name() string {
+	return s.label
+}
+
+func (s fakeSource) Watch(done <-chan struct{}, report func(*UpgradeInfo)) error {
+	for _, info := range s.upgrades {
+		report(info)
+	}
+	<-done
+	return nil
+}
+
+// finalSource only finds its upgrade once the daemon exited
+type finalSource struct {
+	fakeSource
+	final *UpgradeInfo
+}
+
+func (s finalSource) finalCheck() *UpgradeInfo {
+	return s.final
+}
+
+func TestUpgradePipeline(t *testing.T) {
+	chain2 := &UpgradeInfo{Name: "chain2", Height: 49}
+	chain3 := &UpgradeInfo{Name: "chain3", Height: 80}
+
+	chain2Later := &UpgradeInfo{Name: "chain2", Height: 50}
+	output := func(infos ...*UpgradeInfo) UpgradeSource {
+		return customSource{UpgradeSource: fakeSource{"stdout", infos}, key: SourceOutput}
+	}
+	planFile := func(infos ...*UpgradeInfo) UpgradeSource {
+		return customSource{UpgradeSource: fakeSource{"plan file", infos}, key: SourceFile}
+	}
+
+	cases := map[string]struct {
+		cfg     Config
+		script  string
+		sources []UpgradeSource
+		upgrade *UpgradeInfo
+		err     string
+	}{
+		"reported by several sources": {
+			script:  "sleep 10",
+			sources: []UpgradeSource{fakeSource{"stdout", []*UpgradeInfo{chain2}}, fakeSource{"plan file", []*UpgradeInfo{{Name: "chain2", Height: 49}}}},
+			upgrade: chain2,
+		},
+		"first upgrade wins": {
+			script:  "sleep 10",
+			sources: []UpgradeSource{fakeSource{"stdout", []*UpgradeInfo{chain2, chain3}}},
+			upgrade: chain2,
+		},
+		"found after exit": {
+			script:  "exit 3",
+			sources: []UpgradeSource{finalSource{fakeSource: fakeSource{label: "plan file"}, final: chain2}},
+			upgrade: chain2,
+		},
+		"conflict settled by priority": {
+			script:  "sleep 10",
+			sources: []UpgradeSource{output(chain2), planFile(chain2Later)},
+			upgrade: chain2Later,
+		},
+		"conflict settled by configured priority": {
+			cfg:     Config{UpgradeSources: []string{SourceOutput}},
+			script:  "sleep 10",
+			sources: []UpgradeSource{output(chain2), planFile(chain2Later)},
+			upgrade: chain2,
+		},
+		"conflict at the same height": {
+			script:  "sleep 10",
+			sources: []UpgradeSource{output(&UpgradeInfo{Name: "chain3", Height: 49}), planFile(chain2)},
+			upgrade: chain2,
+		},
+		"conflict halts": {
+			cfg:     Config{UpgradeConflict: ConflictHalt},
+			script:  "sleep 10",
+			sources: []UpgradeSource{output(chain2), planFile(chain2Later)},
+			err:     "reported by",
+		},
+		"exits": {
+			script:  "exit 3",
+			sources: []UpgradeSource{finalSource{fakeSource: fakeSource{label: "plan file"}}},
+			err:     "exit status 3",
+		},
+		"exits cleanly": {
+			script:  "true",
+			sources: []UpgradeSource{fakeSource{label: "stdout"}},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command("sh", "-c", tc.script)
+			require.NoError(t, cmd.Start())
+			var mutex sync.Mutex
+			var stopped []string
+			onUpgrade := func(info *UpgradeInfo) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				stopped = append(stopped, info.Name)
+			}
+
+			cfg := tc.cfg
+			cfg.Home = t.TempDir()
+			info, err := newUpgradePipeline(&cfg, cmd, onUpgrade, tc.sources...).run()
+			var conflict *UpgradeConflictError
+			if errors.As(err, &conflict) {
+				require.Contains(t, err.Error(), tc.err)
+				require.Contains(t, err.Error(), "conflicts with")
+				require.Nil(t, info)
+				require.Len(t, stopped, 1, "the daemon is stopped once")
+				return
+			}
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				require.Nil(t, info)
+				require.Empty(t, stopped)
+				return
+			}
+			require.NoError(t, err)
+			if tc.upgrade == nil {
+				require.Nil(t, info)
+				require.Empty(t, stopped)
+				return
+			}
+			require.True(t, sameUpgrade(tc.upgrade, info), "%+v", info)
+			require.Len(t, stopped, 1, "the daemon is stopped once")
+		})
+	}
+}
+
+func TestUpgradeSourcePriority(t *testing.T) {
+	defer func(sources []registeredSource) { upgradeSources.sources = sources }(upgradeSources.sources)
+	RegisterUpgradeSource("Oracle", func(*Config) UpgradeSource { return fakeSource{label: "oracle"} })
+
+	cases := map[string]struct {
+		in    string
+		order []string
+		err   string
+	}{
+		"default":    {order: []string{SourceAdmin, SourceFile, SourceChain, SourceOutput, "oracle"}},
+		"some first": {in: " Oracle, output ", order: []string{"oracle", SourceOutput, SourceAdmin, SourceFile, SourceChain}},
+		"unknown":    {in: "file,rpc", err: `unknown upgrade source "rpc", must be one of admin, file, chain, output, oracle`},
+		"twice":      {in: "file,chain,file", err: `upgrade source "file" is listed twice`},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			sources, err := parseUpgradeSources(tc.in)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			cfg := &Config{UpgradeSources: sources}
+			require.Equal(t, tc.order, cfg.sourcePriority())
+		})
+	}
+
+	cfg := &Config{UpgradeSources: []string{"oracle"}}
+	registered := cfg.registeredSources()
+	require.Len(t, registered, 1)
+	require.Equal(t, "oracle", registered[0].Name())
+	require.Equal(t, 0, cfg.sourceRank(registered[0]))
+	require.Equal(t, 1, cfg.sourceRank(adminSource{}))
+	require.Equal(t, 4, cfg.sourceRank(outputSource{}))
+
+	for in, want := range map[string]UpgradeConflict{"": ConflictPriority, "Halt": ConflictHalt} {
+		got, err := parseUpgradeConflict(in)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+	_, err := parseUpgradeConflict("first")
+	require.EqualError(t, err, `unknown upgrade conflict "first", must be priority or halt`)
+}
@@ -0,0 +1,209 @@
+package cosmovisor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// validatorStateFile records the last vote the validator signed before the daemon was
+	// stopped for an upgrade, until the new binary signed past it
+	validatorStateFile = "validator-state.json"
+	// validatorStatePoll is how often priv_validator_state.json is read while the new binary
+	// catches up to the recorded vote
+	validatorStatePoll = 2 * time.Second
+)
+
+// EventValidatorStateRegressed is sent when priv_validator_state.json went back below the
+// vote signed before an upgrade
+const EventValidatorStateRegressed = "validator_state_regressed"
+
+// ValidatorState is the last vote a validator signed, as priv_validator_state.json keeps
+// it to refuse signing twice for the same height, round and step
+type ValidatorState struct {
+	Height int64 `json:"height"`
+	Round  int32 `json:"round"`
+	Step   int8  `json:"step"`
+}
+
+// Before returns true if s is an earlier vote than o
+func (s ValidatorState) Before(o ValidatorState) bool {
+	if s.Height != o.Height {
+		return s.Height < o.Height
+	}
+	if s.Round != o.Round {
+		return s.Round < o.Round
+	}
+	return s.Step < o.Step
+}
+
+func (s ValidatorState) String() string {
+	return fmt.Sprintf("height %d round %d step %d", s.Height, s.Round, s.Step)
+}
+
+// ValidatorStateRecord is the validator state read before the daemon was stopped for an
+// upgrade
+type ValidatorStateRecord struct {
+	Upgrade string `json:"upgrade"`
+	ValidatorState
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// ValidatorStateError is returned instead of launching a daemon whose
+// priv_validator_state.json is behind the vote signed before the last upgrade, which it
+// could sign again differently
+type ValidatorStateError struct {
+	Record ValidatorStateRecord
+	// Found is the state in priv_validator_state.json, nil if the file is missing
+	Found *ValidatorState
+	// Path is the record, removing it allows cosmovisor to start again
+	Path string
+}
+
+func (e *ValidatorStateError) Error() string {
+	found := "is missing"
+	if e.Found != nil {
+		found = "went back to " + e.Found.String()
+	}
+	return fmt.Sprintf("%s %s, the validator signed up to %s before upgrade %q: the node could double sign. "+
+		"Check the data directory, then remove %s to start again", privValidatorStateFile, found, e.Record.ValidatorState, e.Record.Upgrade, e.Path)
+}
+
+// readValidatorState reads the priv_validator_state.json of the node
+func (cfg *Config) readValidatorState() (*ValidatorState, error) {
+	bz, err := readFileInDir(cfg.Home, filepath.Join(dataDir, privValidatorStateFile))
+	if err != nil {
+		return nil, err
+	}
+	state, err := parseValidatorState(bz)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", privValidatorStateFile, err)
+	}
+	return state, nil
+}
+
+// parseValidatorState parses a priv_validator_state.json, tendermint writes the height as
+// a string
+func parseValidatorState(bz []byte) (*ValidatorState, error) {
+	var doc struct {
+		Height json.RawMessage `json:"height"`
+		Round  int32           `json:"round"`
+		Step   int8            `json:"step"`
+	}
+	if err := json.Unmarshal(bz, &doc); err != nil {
+		return nil, err
+	}
+	height, err := strconv.ParseInt(strings.Trim(string(doc.Height), `"`), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid height %s", doc.Height)
+	}
+	return &ValidatorState{Height: height, Round: doc.Round, Step: doc.Step}, nil
+}
+
+// RecordedValidatorState returns the validator state recorded before the last upgrade, nil
+// if the new binary signed past it
+func (cfg *Config) RecordedValidatorState() (*ValidatorStateRecord, error) {
+	var record ValidatorStateRecord
+	if ok, err := cfg.readStateFile(validatorStateFile, &record); !ok {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// recordValidatorState records the last vote of the validator for the upgrade. It is read
+// before the daemon is stopped and again once it exited, the latest vote is kept. A node
+// that never signed has nothing to protect. Failures are logged: the state is only missing
+// from the check.
+func (cfg *Config) recordValidatorState(upgrade string) {
+	if cfg == nil || !cfg.ValidatorStateCheck {
+		return
+	}
+	state, err := cfg.readValidatorState()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("not recording the validator state: %v", err)
+		}
+		return
+	}
+	if state.Height == 0 {
+		return
+	}
+	if recorded, err := cfg.RecordedValidatorState(); err == nil && recorded != nil && recorded.Upgrade == upgrade && state.Before(recorded.ValidatorState) {
+		return
+	}
+	record := ValidatorStateRecord{Upgrade: upgrade, ValidatorState: *state, RecordedAt: NowUTC()}
+	if err := cfg.writeStateFile(validatorStateFile, record); err != nil {
+		logger.Warnf("recording the validator state: %v", err)
+		return
+	}
+	logger.Debugf("recorded validator state %s for upgrade %q", state, upgrade)
+}
+
+// checkValidatorState returns a *ValidatorStateError if priv_validator_state.json is missing
+// or behind the vote recorded before the last upgrade
+func (cfg *Config) checkValidatorState() error {
+	if !cfg.ValidatorStateCheck {
+		return nil
+	}
+	record, err := cfg.RecordedValidatorState()
+	if err != nil || record == nil {
+		return err
+	}
+	return cfg.compareValidatorState(record)
+}
+
+// compareValidatorState compares priv_validator_state.json with record
+func (cfg *Config) compareValidatorState(record *ValidatorStateRecord) error {
+	state, err := cfg.readValidatorState()
+	if os.IsNotExist(err) {
+		state = nil
+	} else if err != nil {
+		return err
+	} else if !state.Before(record.ValidatorState) {
+		return nil
+	}
+	regressed := &ValidatorStateError{Record: *record, Found: state, Path: filepath.Join(cfg.StateDir(), validatorStateFile)}
+	ev := NewEvent(EventValidatorStateRegressed, record.Upgrade, regressed.Error())
+	ev.Height = record.Height
+	notify(cfg, ev)
+	return regressed
+}
+
+// watchValidatorState follows priv_validator_state.json while the new binary runs, until
+// done is closed. The daemon is killed if the file goes back below the recorded vote, and
+// the record is removed once the validator signed for a later height.
+func (cfg *Config) watchValidatorState(control *launchControl, done <-chan struct{}) {
+	record, err := cfg.RecordedValidatorState()
+	if err != nil || record == nil {
+		return
+	}
+	ticker := time.NewTicker(validatorStatePoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		var regressed *ValidatorStateError
+		if err := cfg.compareValidatorState(record); errors.As(err, &regressed) {
+			control.abort(err)
+			return
+		}
+		state, err := cfg.readValidatorState()
+		if err != nil || state.Height <= record.Height {
+			continue
+		}
+		logger.Infof("the validator signed at height %d, past %s before upgrade %q", state.Height, record.ValidatorState, record.Upgrade)
+		if err := cfg.fs().remove(filepath.Join(cfg.StateDir(), validatorStateFile)); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("removing %s: %v", validatorStateFile, err)
+		}
+		return
+	}
+}
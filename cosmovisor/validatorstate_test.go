@@ -0,0 +1,111 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeValidatorState writes the priv_validator_state.json of cfg
+func writeValidatorState(t *testing.T, cfg *Config, state string) {
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), privValidatorStateFile), []byte(state), 0600))
+}
+
+func TestParseValidatorState(t *testing.T) {
+	state, err := parseValidatorState([]byte(`{"height":"1299","round":2,"step":3,"signature":"c2ln","signbytes":"AA=="}`))
+	require.NoError(t, err)
+	require.Equal(t, ValidatorState{Height: 1299, Round: 2, Step: 3}, *state)
+	_, err = parseValidatorState([]byte(`{"height":"tall"}`))
+	require.Error(t, err)
+
+	require.True(t, ValidatorState{Height: 1298, Round: 5, Step: 3}.Before(*state))
+	require.True(t, ValidatorState{Height: 1299, Round: 2, Step: 2}.Before(*state))
+	require.False(t, state.Before(*state))
+	require.False(t, ValidatorState{Height: 1300}.Before(*state))
+}
+
+func TestValidatorStateCheck(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", ValidatorStateCheck: true}
+	// a node that never signed has nothing recorded
+	writeValidatorState(t, cfg, `{"height":"0","round":0,"step":0}`)
+	cfg.recordValidatorState("v2")
+	record, err := cfg.RecordedValidatorState()
+	require.NoError(t, err)
+	require.Nil(t, record)
+
+	writeValidatorState(t, cfg, `{"height":"1299","round":0,"step":2}`)
+	cfg.recordValidatorState("v2")
+	// the vote signed while the daemon was stopped is kept, an earlier read isn't
+	writeValidatorState(t, cfg, `{"height":"1299","round":0,"step":3}`)
+	cfg.recordValidatorState("v2")
+	writeValidatorState(t, cfg, `{"height":"1299","round":0,"step":1}`)
+	cfg.recordValidatorState("v2")
+	record, err = cfg.RecordedValidatorState()
+	require.NoError(t, err)
+	require.Equal(t, ValidatorState{Height: 1299, Step: 3}, record.ValidatorState)
+
+	var regressed *ValidatorStateError
+	err = cfg.checkValidatorState()
+	require.True(t, errors.As(err, &regressed), "%v", err)
+	require.Equal(t, &ValidatorState{Height: 1299, Step: 1}, regressed.Found)
+	require.Contains(t, err.Error(), "priv_validator_state.json went back to height 1299 round 0 step 1")
+
+	require.NoError(t, os.Remove(filepath.Join(cfg.DataDir(), privValidatorStateFile)))
+	err = cfg.checkValidatorState()
+	require.True(t, errors.As(err, &regressed), "%v", err)
+	require.Nil(t, regressed.Found)
+
+	writeValidatorState(t, cfg, `{"height":"1299","round":0,"step":3}`)
+	require.NoError(t, cfg.checkValidatorState())
+	cfg.ValidatorStateCheck = false
+	writeValidatorState(t, cfg, `{"height":"12","round":0,"step":3}`)
+	require.NoError(t, cfg.checkValidatorState())
+}
+
+func TestWatchValidatorState(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd", ValidatorStateCheck: true}
+	writeValidatorState(t, cfg, `{"height":"1299","round":0,"step":3}`)
+	cfg.recordValidatorState("v2")
+
+	cmd := exec.Command("sleep", "60")
+	require.NoError(t, cmd.Start())
+	control := &launchControl{cfg: cfg, cmd: cmd}
+	done := make(chan struct{})
+	defer close(done)
+
+	// the new binary signs past the recorded vote, the record is done with
+	writeValidatorState(t, cfg, `{"height":"1300","round":0,"step":1}`)
+	watched := make(chan struct{})
+	go func() {
+		cfg.watchValidatorState(control, done)
+		close(watched)
+	}()
+	select {
+	case <-watched:
+	case <-time.After(5 * validatorStatePoll):
+		t.Fatal("the watch didn't end")
+	}
+	record, err := cfg.RecordedValidatorState()
+	require.NoError(t, err)
+	require.Nil(t, record)
+	require.False(t, control.restartRequested())
+
+	// a binary that resets the file is killed
+	cfg.recordValidatorState("v3")
+	writeValidatorState(t, cfg, `{"height":"0","round":0,"step":0}`)
+	go cfg.watchValidatorState(control, done)
+	require.Error(t, cmd.Wait())
+	var regressed *ValidatorStateError
+	require.True(t, errors.As(control.restartErr(), &regressed))
+	require.Equal(t, "v3", regressed.Record.Upgrade)
+}
@@ -0,0 +1,156 @@
+package cosmovisor
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultVerifyUpgradeTimeout is how long after the switch the chain may take to apply
+	// the upgrade
+	defaultVerifyUpgradeTimeout = 10 * time.Minute
+	// verifyUpgradePoll is how often the node is asked for the applied upgrade
+	verifyUpgradePoll = time.Second
+
+	// EventUpgradeVerified is sent once the chain applied the upgrade the node switched to
+	EventUpgradeVerified = "upgrade_verified"
+	// EventUpgradeUnverified is sent when the chain didn't apply the upgrade the node
+	// switched to, or the new binary logged a consensus failure
+	EventUpgradeUnverified = "upgrade_unverified"
+)
+
+// consensusFailureMarker is in the line CometBFT logs when the new binary disagrees with
+// the network, e.g. on the app hash. The node keeps running without making blocks.
+var consensusFailureMarker = []byte("CONSENSUS FAILURE")
+
+// UpgradeVerification is what the chain told of an upgrade after the switch
+type UpgradeVerification struct {
+	// Verified is set if x/upgrade applied the upgrade at its height
+	Verified bool `json:"verified"`
+	// Height is the height x/upgrade applied the upgrade at, 0 if it didn't
+	Height int64 `json:"height,omitempty"`
+	// Reason is why the upgrade wasn't verified
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// UnverifiedUpgradeError is the failure of an upgrade the chain didn't apply after the switch
+type UnverifiedUpgradeError struct {
+	Upgrade string
+	Reason  string
+}
+
+func (e *UnverifiedUpgradeError) Error() string {
+	return fmt.Sprintf("upgrade %q isn't applied on chain: %s", e.Upgrade, e.Reason)
+}
+
+func (cfg *Config) verifyUpgradeTimeout() time.Duration {
+	if cfg.VerifyUpgradeTimeout <= 0 {
+		return defaultVerifyUpgradeTimeout
+	}
+	return cfg.VerifyUpgradeTimeout
+}
+
+// pendingVerification returns the upgrade switched to last if bin is its binary and the
+// chain wasn't asked about it yet, nil otherwise
+func (cfg *Config) pendingVerification(bin string) *AppliedUpgrade {
+	if !cfg.VerifyUpgrade {
+		return nil
+	}
+	applied, err := cfg.LastUpgrade()
+	if err != nil || applied == nil || applied.Verification != nil || bin != cfg.UpgradeBin(applied.Name) {
+		return nil
+	}
+	return applied
+}
+
+// watchVerification asks PlanAPI at which height x/upgrade applied the upgrade until it did,
+// or done is closed. The upgrade is unverified if the chain applied it at another height,
+// if the new binary logged a consensus failure and keeps running, or once
+// VerifyUpgradeTimeout passed since the switch: a binary that keeps failing is found out by
+// the first launch after that. An unverified upgrade is rolled back if DAEMON_ROLLBACK is
+// set, and only reported otherwise.
+func (cfg *Config) watchVerification(control *launchControl, applied *AppliedUpgrade, blocks *blockWatch, done <-chan struct{}) {
+	api := NewNodeAPI(cfg.PlanAPI)
+	timeout := cfg.verifyUpgradeTimeout()
+	deadline := applied.AppliedAt.Add(timeout)
+	ticker := time.NewTicker(verifyUpgradePoll)
+	defer ticker.Stop()
+	for {
+		height, err := api.AppliedPlan(applied.Name)
+		var reason string
+		switch {
+		case err == nil && height > 0 && (applied.Height == 0 || height == applied.Height):
+			cfg.upgradeVerified(applied, height)
+			return
+		case err == nil && height > 0:
+			reason = fmt.Sprintf("the chain applied it at height %d, not %d", height, applied.Height)
+		case blocks.consensusFailure() != "":
+			reason = "the new binary logged a consensus failure: " + blocks.consensusFailure()
+		case NowUTC().After(deadline):
+			reason = fmt.Sprintf("the chain didn't apply it within %s of the switch", timeout)
+			if err != nil {
+				reason += fmt.Sprintf(", the last query failed: %v", err)
+			}
+		default:
+			if err != nil {
+				logger.Debugf("asking for the applied upgrade %q: %v", applied.Name, err)
+			}
+		}
+		if reason != "" {
+			cfg.upgradeUnverified(control, applied, reason)
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// upgradeVerified records that the chain applied the upgrade at height
+func (cfg *Config) upgradeVerified(applied *AppliedUpgrade, height int64) {
+	verification := &UpgradeVerification{Verified: true, Height: height, At: NowUTC()}
+	cfg.recordVerification(applied, verification)
+	logger.Infof("upgrade %q verified, the chain applied it at height %d", applied.Name, height)
+	notify(cfg, Event{ID: fmt.Sprintf("%s/%s/%d", EventUpgradeVerified, applied.Name, height), Type: EventUpgradeVerified,
+		Upgrade: applied.Name, Height: height, Message: fmt.Sprintf("upgrade %q verified, the chain applied it at height %d", applied.Name, height)})
+}
+
+// upgradeUnverified records and reports the upgrade the chain didn't apply and, with a
+// rollback policy, stops the daemon still running for the rollback
+func (cfg *Config) upgradeUnverified(control *launchControl, applied *AppliedUpgrade, reason string) {
+	unverified := &UnverifiedUpgradeError{Upgrade: applied.Name, Reason: reason}
+	cfg.recordVerification(applied, &UpgradeVerification{Reason: reason, At: NowUTC()})
+	logger.Errorf("%v", unverified)
+	notify(cfg, Event{ID: fmt.Sprintf("%s/%s/%d", EventUpgradeUnverified, applied.Name, applied.AppliedAt.Unix()), Type: EventUpgradeUnverified,
+		Upgrade: applied.Name, Height: applied.Height, Message: unverified.Error(), Fields: map[string]string{"reason": reason}})
+	if cfg.rollback() == RollbackOff {
+		return
+	}
+	if err := control.stopForRestart(unverified); err != nil {
+		logger.Warnf("not rolling back upgrade %q: %v", applied.Name, err)
+	}
+}
+
+// recordVerification records the verification with the applied upgrade and in the history
+func (cfg *Config) recordVerification(applied *AppliedUpgrade, verification *UpgradeVerification) {
+	applied.Verification = verification
+	if err := cfg.updateLastUpgrade(applied.Name, func(a *AppliedUpgrade) { a.Verification = verification }); err != nil {
+		logger.Warnf("recording the verification of upgrade %q: %v", applied.Name, err)
+	}
+	cfg.updateUpgradeHistory(applied.Name, func(e *HistoryEntry) { e.Verification = verification })
+	if !verification.Verified {
+		metrics.upgradeUnverified()
+	}
+}
+
+// verificationStatus describes the verification of an upgrade
+func verificationStatus(v *UpgradeVerification) string {
+	if v.Verified {
+		return "applied on chain at height " + strconv.FormatInt(v.Height, 10)
+	}
+	return "NOT applied on chain: " + v.Reason
+}
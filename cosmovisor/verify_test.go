@@ -0,0 +1,135 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// appliedPlanServer answers the applied plan of x/upgrade with the height of the upgrades
+// in heights, 0 for the others, or fails with status if it isn't 0
+func appliedPlanServer(t *testing.T, heights map[string]int64, status int) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		name := filepath.Base(r.URL.Path)
+		if r.URL.Path != "/cosmos/upgrade/v1beta1/applied_plan/"+name {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"height":"%d"}`, heights[name])
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAppliedPlan(t *testing.T) {
+	api := NewNodeAPI(appliedPlanServer(t, map[string]int64{"v2": 100}, 0).URL)
+	height, err := api.AppliedPlan("v2")
+	require.NoError(t, err)
+	require.Equal(t, int64(100), height)
+	height, err = api.AppliedPlan("v3")
+	require.NoError(t, err)
+	require.Zero(t, height)
+}
+
+func TestWatchVerification(t *testing.T) {
+	cases := map[string]struct {
+		height  int64
+		status  int
+		since   time.Duration
+		output  string
+		verdict *UpgradeVerification
+	}{
+		"verified": {
+			height:  100,
+			verdict: &UpgradeVerification{Verified: true, Height: 100},
+		},
+		"another height": {
+			height:  99,
+			verdict: &UpgradeVerification{Reason: "the chain applied it at height 99, not 100"},
+		},
+		"consensus failure": {
+			output:  `E[2022-01-02|15:04:05.000] CONSENSUS FAILURE!!! err="wrong Block.Header.AppHash" module=consensus`,
+			verdict: &UpgradeVerification{Reason: `the new binary logged a consensus failure: E[2022-01-02|15:04:05.000] CONSENSUS FAILURE!!! err="wrong Block.Header.AppHash" module=consensus`},
+		},
+		"not applied in time": {
+			since:   time.Hour,
+			verdict: &UpgradeVerification{Reason: "the chain didn't apply it within 10m0s of the switch"},
+		},
+		"api failing": {
+			status:  http.StatusServiceUnavailable,
+			since:   time.Hour,
+			verdict: &UpgradeVerification{Reason: "the chain didn't apply it within 10m0s of the switch, the last query failed: "},
+		},
+		"api failing in time": {
+			status: http.StatusServiceUnavailable,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := appliedPlanServer(t, map[string]int64{"v2": tc.height}, tc.status)
+			cfg := &Config{Home: t.TempDir(), Name: "dummyd", VerifyUpgrade: true, PlanAPI: srv.URL}
+			applied := &AppliedUpgrade{Name: "v2", Height: 100, AppliedAt: NowUTC().Add(-tc.since)}
+			require.NoError(t, cfg.writeStateFile(lastUpgradeFile, applied))
+			cfg.recordHistory(HistoryEntry{Kind: HistoryUpgrade, Name: "v2", Height: 100, At: applied.AppliedAt})
+			blocks := &blockWatch{cfg: cfg}
+			if tc.output != "" {
+				blocks.scan([]byte(tc.output))
+			}
+
+			done := make(chan struct{})
+			time.AfterFunc(100*time.Millisecond, func() { close(done) })
+			cfg.watchVerification(nil, applied, blocks, done)
+			recorded, err := cfg.LastUpgrade()
+			require.NoError(t, err)
+			if tc.verdict == nil {
+				require.Nil(t, recorded.Verification)
+				return
+			}
+			require.NotNil(t, recorded.Verification)
+			require.Equal(t, tc.verdict.Verified, recorded.Verification.Verified)
+			require.Equal(t, tc.verdict.Height, recorded.Verification.Height)
+			require.Contains(t, recorded.Verification.Reason, tc.verdict.Reason)
+			history, err := cfg.UpgradeHistory()
+			require.NoError(t, err)
+			require.Equal(t, recorded.Verification, history[0].Verification)
+			// the upgrade is asked about once
+			require.Nil(t, cfg.pendingVerification(cfg.UpgradeBin("v2")))
+		})
+	}
+}
+
+func TestVerifyRollsBack(t *testing.T) {
+	srv := appliedPlanServer(t, nil, 0)
+	cfg := &Config{Home: validateHome(t), Name: "dummyd", RestartAfterUpgrade: true, Rollback: RollbackBinary,
+		VerifyUpgrade: true, PlanAPI: srv.URL}
+	// the new binary keeps running without making blocks
+	script := "#!/bin/sh\n[ \"$1\" = pre-upgrade ] && exit 0\n" +
+		"echo 'E CONSENSUS FAILURE!!! err=\"wrong Block.Header.AppHash\" module=consensus'\nexec sleep 30\n"
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("chain2"), []byte(script), 0755))
+
+	err := Supervise(cfg, nil, ioutil.Discard, ioutil.Discard)
+	var rolledBack *RolledBackError
+	require.True(t, errors.As(err, &rolledBack), "%v", err)
+	require.Equal(t, "chain2", rolledBack.Record.Upgrade)
+	require.Contains(t, rolledBack.Record.Reason, `upgrade "chain2" isn't applied on chain: the new binary logged a consensus failure`)
+	bin, err := cfg.CurrentBin()
+	require.NoError(t, err)
+	require.Equal(t, cfg.GenesisBin(), bin)
+	status, err := GetStatus(cfg)
+	require.NoError(t, err)
+	require.False(t, status.LastUpgrade.Verification.Verified)
+}
@@ -0,0 +1,99 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/hashicorp/go-version"
+)
+
+// devVersion is reported by builds that didn't set Version
+const devVersion = "devel"
+
+// Version of cosmovisor, set at build time with
+// -ldflags "-X github.com/cosmos/cosmos-sdk/cosmovisor.Version=v0.1.0"
+var Version = devVersion
+
+// Commit is the git commit cosmovisor was built from, set at build time like Version
+var Commit = ""
+
+// BuildInfo describes the cosmovisor binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// GetBuildInfo returns the build info of this cosmovisor. A build without Version set by
+// `go install` with a module version reports that version.
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{Version: Version, Commit: Commit, GoVersion: runtime.Version(), Platform: OSArch()}
+	if bi, ok := debug.ReadBuildInfo(); ok && info.Version == devVersion && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		info.Version = bi.Main.Version
+	}
+	return info
+}
+
+// DaemonBuild describes the binary the daemon is started from and the version it reports
+type DaemonBuild struct {
+	Name string `json:"name"`
+	// Binary is the path the current link resolves to
+	Binary string `json:"binary"`
+	// Upgrade names the upgrade Binary belongs to, empty for the genesis binary
+	Upgrade string `json:"upgrade,omitempty"`
+	SHA256  string `json:"sha256"`
+	// Version is the output of `<binary> version`, kept as is if it is JSON
+	Version json.RawMessage `json:"version"`
+	// Output is the raw output of `<binary> version`
+	Output []byte `json:"-"`
+}
+
+// GetDaemonBuild runs `<current binary> version` with args and describes the binary.
+// The daemon's stderr goes to stderr. Nothing is written, the current link isn't created.
+func GetDaemonBuild(cfg *Config, args []string, stderr io.Writer) (*DaemonBuild, error) {
+	bin, _ := cfg.resolveCurrentBin()
+	build := &DaemonBuild{Name: daemonNameOf(bin), Binary: bin, Upgrade: cfg.upgradeOf(bin)}
+	var err error
+	if build.SHA256, err = sha256File(bin); err != nil {
+		return nil, err
+	}
+	cmd := cfg.daemonCommand(context.Background(), bin, append([]string{"version"}, args...)...)
+	cmd.Stderr = stderr
+	if build.Output, err = cmd.Output(); err != nil {
+		return nil, fmt.Errorf("%s version: %w", bin, err)
+	}
+	out := bytes.TrimSpace(build.Output)
+	if json.Valid(out) {
+		build.Version = out
+	} else if build.Version, err = json.Marshal(string(out)); err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+// CheckMinVersion returns an error if this cosmovisor is older than the required version.
+// Development builds don't know their version and pass the check with a warning.
+func CheckMinVersion(required string) error {
+	min, err := version.NewVersion(required)
+	if err != nil {
+		return fmt.Errorf("plan requires cosmovisor %q, which is not a valid version: %w", required, err)
+	}
+	if Version == devVersion {
+		logger.Warnf("development build of cosmovisor, assuming it satisfies the required version %s", required)
+		return nil
+	}
+	running, err := version.NewVersion(Version)
+	if err != nil {
+		return fmt.Errorf("cannot compare cosmovisor version %q to the required %s: %w", Version, required, err)
+	}
+	if running.LessThan(min) {
+		return fmt.Errorf("plan requires cosmovisor %s or newer, this is %s: install cosmovisor %s and start it again to apply the upgrade", required, Version, required)
+	}
+	return nil
+}
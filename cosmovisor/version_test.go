@@ -0,0 +1,49 @@
+package cosmovisor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckMinVersion(t *testing.T) {
+	cases := map[string]struct {
+		running  string
+		required string
+		isErr    bool
+	}{
+		"older":                    {running: "v0.1.0", required: "v0.2.0", isErr: true},
+		"equal":                    {running: "v0.2.0", required: "v0.2.0"},
+		"newer":                    {running: "v1.0.0", required: "v0.2.0"},
+		"without v prefix":         {running: "0.2.1", required: "v0.2.0"},
+		"pre-release is older":     {running: "v0.2.0-rc1", required: "v0.2.0", isErr: true},
+		"pre-release satisfied":    {running: "v0.2.0-rc2", required: "v0.2.0-rc1"},
+		"release after pre":        {running: "v0.2.0", required: "v0.2.0-rc1"},
+		"unparseable requirement":  {running: "v0.2.0", required: "latest", isErr: true},
+		"unparseable running":      {running: "custom-build", required: "v0.2.0", isErr: true},
+		"development build passes": {running: devVersion, required: "v9.0.0"},
+	}
+
+	defer func(v string) { Version = v }(Version)
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			Version = tc.running
+			err := CheckMinVersion(tc.required)
+			if tc.isErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestGetBuildInfo(t *testing.T) {
+	defer func(v, c string) { Version, Commit = v, c }(Version, Commit)
+	Version, Commit = "v1.2.0", "0a1b2c"
+	info := GetBuildInfo()
+	require.Equal(t, "v1.2.0", info.Version)
+	require.Equal(t, "0a1b2c", info.Commit)
+	require.Equal(t, OSArch(), info.Platform)
+	require.NotEmpty(t, info.GoVersion)
+}
@@ -0,0 +1,270 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// defaultPollInterval is how often the plan file is read when the data directory can't be watched
+	defaultPollInterval = 300 * time.Millisecond
+	// planSettleDelay is the wait before the plan file is read again to see if it is complete
+	planSettleDelay = 25 * time.Millisecond
+	// planSettleAttempts bounds the reads of a plan file that doesn't decode or keeps changing
+	planSettleAttempts = 6
+)
+
+// pollRand picks the jitter of the polls, seeded so nodes started together don't pick the same
+var pollRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(NowUTC().UnixNano()))}
+
+// pollInterval is how often the plan file is read when it can't be watched
+func (cfg *Config) pollInterval() time.Duration {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	if cfg.PollInterval <= 0 {
+		return defaultPollInterval
+	}
+	return cfg.PollInterval
+}
+
+// nextPoll is the wait before the next read of the plan file, the poll interval plus a
+// random part of the jitter
+func (cfg *Config) nextPoll() time.Duration {
+	wait := cfg.pollInterval()
+	reloadLock.RLock()
+	jitter := cfg.PollJitter
+	reloadLock.RUnlock()
+	if jitter > 0 {
+		pollRand.Lock()
+		wait += time.Duration(pollRand.Int63n(int64(jitter) + 1))
+		pollRand.Unlock()
+	}
+	return wait
+}
+
+// parsePollDuration parses a duration, a bare number is milliseconds
+func parsePollDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		s = strconv.FormatInt(ms, 10) + "ms"
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %q", s)
+	}
+	return d, nil
+}
+
+// planSeen is the plan file as the watcher saw it last
+type planSeen struct {
+	content []byte
+	// launched is when the daemon was started
+	launched time.Time
+}
+
+// seePlanFile takes the plan file as it is before the daemon is launched
+func (cfg *Config) seePlanFile() *planSeen {
+	content, _ := cfg.readPlanFile()
+	return &planSeen{content: content, launched: NowUTC()}
+}
+
+// planWrittenAt returns when the app wrote the plan of the upgrade info to its data
+// directory, as it does when it halts for it, if it did since launched
+func (cfg *Config) planWrittenAt(info *UpgradeInfo, launched time.Time) (time.Time, bool) {
+	fi, err := os.Stat(filepath.Join(cfg.DataDir(), upgradeInfoFile))
+	if err != nil || fi.ModTime().Before(launched) {
+		return time.Time{}, false
+	}
+	if plan, err := cfg.PlanFile(); err != nil || plan == nil || plan.Name != info.Name {
+		return time.Time{}, false
+	}
+	return fi.ModTime(), true
+}
+
+// watchPlanFile waits for the app to write a new plan to its data directory, as it does
+// when it halts for an upgrade, and returns it. It returns nil once done is closed. The
+// plan file as seen at start and stale plans (see stalePlan) are ignored.
+//
+// The data directory is watched with inotify or kqueue, so the plan is seen right away.
+// It is read every PollInterval, plus up to PollJitter, instead if it can't be watched,
+// e.g. on a network filesystem that doesn't report changes made by other hosts, or until
+// the app created it.
+func (cfg *Config) watchPlanFile(seen *planSeen, done <-chan struct{}) *UpgradeInfo {
+	for {
+		watcher, err := cfg.newPlanWatcher()
+		if err == nil {
+			defer watcher.Close()
+			return cfg.waitPlanEvents(watcher, seen, done)
+		}
+		// the app creates its data directory when it first starts
+		missing := os.IsNotExist(err)
+		if !missing {
+			metrics.planWatchFailed()
+			logger.Warnf("reading %s every %s: %v", filepath.Join(cfg.DataDir(), upgradeInfoFile), cfg.pollInterval(), err)
+		}
+		if plan, created := cfg.pollPlanFile(seen, done, missing); !created {
+			return plan
+		}
+	}
+}
+
+// waitPlanEvents returns the first new plan written once the watcher is set up
+func (cfg *Config) waitPlanEvents(watcher *fsnotify.Watcher, seen *planSeen, done <-chan struct{}) *UpgradeInfo {
+	// the file may have been written before the watch was set up
+	if plan := cfg.newPlan(seen); plan != nil {
+		return plan
+	}
+	for {
+		select {
+		case <-done:
+			return nil
+		case event := <-watcher.Events:
+			// a plan written to a temporary file is seen once it is renamed into place
+			if filepath.Base(event.Name) != upgradeInfoFile {
+				continue
+			}
+		case err := <-watcher.Errors:
+			// events may have been dropped, the file is read to be sure
+			metrics.planWatchFailed()
+			logger.Warnf("watching %s: %v", cfg.DataDir(), err)
+		}
+		if plan := cfg.newPlan(seen); plan != nil {
+			return plan
+		}
+	}
+}
+
+// newPlanWatcher watches the data directory for changes
+func (cfg *Config) newPlanWatcher() (*fsnotify.Watcher, error) {
+	if err := injectFault("watch.plan"); err != nil {
+		return nil, err
+	}
+	dir := cfg.DataDir()
+	if err := checkWatchable(dir); err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// checkWatchable returns why changes in dir can't be watched, nil if they can
+func checkWatchable(dir string) error {
+	if fs, remote := remoteFilesystem(dir); remote {
+		return fmt.Errorf("%s may not report changes made by other hosts", fs)
+	}
+	_, err := os.Stat(dir)
+	return err
+}
+
+// pollPlanFile reads the plan file every nextPoll until a new plan shows up or done is
+// closed. With untilCreated, it also returns once the data directory exists, so it can be
+// watched.
+func (cfg *Config) pollPlanFile(seen *planSeen, done <-chan struct{}, untilCreated bool) (plan *UpgradeInfo, created bool) {
+	timer := time.NewTimer(cfg.nextPoll())
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return nil, false
+		case <-timer.C:
+			timer.Reset(cfg.nextPoll())
+		}
+		if plan := cfg.newPlan(seen); plan != nil {
+			return plan, false
+		}
+		if _, err := os.Stat(cfg.DataDir()); untilCreated && err == nil {
+			return nil, true
+		}
+	}
+}
+
+// readPlanFile returns the content of the plan file
+func (cfg *Config) readPlanFile() ([]byte, error) {
+	// the data directory is written by the app, don't follow symlinks
+	return readFileInDir(cfg.Home, filepath.Join(dataDir, upgradeInfoFile))
+}
+
+// newPlan reads the plan file and returns its plan if the file changed since seen and the
+// plan isn't stale. seen is updated to the content read.
+func (cfg *Config) newPlan(seen *planSeen) *UpgradeInfo {
+	bz, err := cfg.readPlanFile()
+	if err != nil && !os.IsNotExist(err) {
+		metrics.planWatchFailed()
+	}
+	if err != nil || bytes.Equal(bz, seen.content) {
+		return nil
+	}
+	plan, bz, err := cfg.settlePlan(bz)
+	seen.content = bz
+	path := filepath.Join(cfg.DataDir(), upgradeInfoFile)
+	if err != nil {
+		metrics.planWatchFailed()
+		logger.Warnf("ignoring %s: %v", path, err)
+		return nil
+	}
+	if err := cfg.verifyPlanSignature(bz, plan); err != nil {
+		logger.Errorf("ignoring upgrade %q in %s: %v", plan.Name, path, err)
+		cfg.rejectPlan(bz, plan, err)
+		return nil
+	}
+	var modified time.Time
+	if info, err := statInDir(cfg.Home, filepath.Join(dataDir, upgradeInfoFile)); err == nil {
+		modified = info.ModTime()
+	}
+	if reason := cfg.stalePlan(plan, modified, seen.launched); reason != "" {
+		logger.Warnf("ignoring upgrade %q in %s: %s", plan.Name, path, reason)
+		return nil
+	}
+	return plan
+}
+
+// settlePlan reads the plan file again until it decodes and stays the same across two
+// reads, as the app may still be writing it. The wait between reads doubles, up to
+// planSettleAttempts reads. It returns the plan with the content it was read from, or the
+// last content read with the error.
+func (cfg *Config) settlePlan(bz []byte) (*UpgradeInfo, []byte, error) {
+	delay := planSettleDelay
+	for attempt := 1; ; attempt++ {
+		time.Sleep(delay)
+		delay *= 2
+		again, err := cfg.readPlanFile()
+		switch {
+		case err != nil:
+			// removed, or replaced by a symlink
+		case !bytes.Equal(again, bz):
+			err = errors.New("still changing")
+		default:
+			var plan *UpgradeInfo
+			if plan, err = parsePlanFile(again); err == nil {
+				return plan, again, nil
+			}
+		}
+		if attempt == planSettleAttempts {
+			return nil, again, err
+		}
+		bz = again
+	}
+}
@@ -0,0 +1,25 @@
+package cosmovisor
+
+import "syscall"
+
+// remoteFilesystems are the filesystems inotify doesn't see changes of made by other hosts,
+// by their statfs magic number
+var remoteFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x01021997: "9p",
+	0x65735546: "fuse",
+	0x00c36400: "ceph",
+}
+
+// remoteFilesystem returns the name of the filesystem of dir if inotify can't be relied on there
+func remoteFilesystem(dir string) (string, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return "", false
+	}
+	name, ok := remoteFilesystems[uint32(st.Type)]
+	return name, ok
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package cosmovisor
+
+// remoteFilesystem can't tell filesystems apart outside of linux, kqueue and
+// ReadDirectoryChangesW are trusted
+func remoteFilesystem(string) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,167 @@
+//go:build linux
+// +build linux
+
+package cosmovisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// watchPlanAsync runs watchPlanFile until the test ends
+func watchPlanAsync(t *testing.T, cfg *Config) <-chan *UpgradeInfo {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	plans := make(chan *UpgradeInfo, 1)
+	seen := cfg.seePlanFile()
+	go func() { plans <- cfg.watchPlanFile(seen, done) }()
+	// let the watch be set up
+	time.Sleep(50 * time.Millisecond)
+	return plans
+}
+
+func writePlan(t *testing.T, cfg *Config, plan string) {
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), upgradeInfoFile), []byte(plan), 0644))
+}
+
+func requireNoPlan(t *testing.T, plans <-chan *UpgradeInfo) {
+	select {
+	case plan := <-plans:
+		t.Fatalf("unexpected plan %+v", plan)
+	case <-time.After(2 * defaultPollInterval):
+	}
+}
+
+func requirePlan(t *testing.T, plans <-chan *UpgradeInfo, name string) {
+	select {
+	case plan := <-plans:
+		require.NotNil(t, plan)
+		require.Equal(t, name, plan.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("plan %q not seen", name)
+	}
+}
+
+func TestWatchPlanFile(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	// the plan of the running binary is there from its upgrade
+	writePlan(t, cfg, `{"name":"chain2","height":49}`)
+
+	plans := watchPlanAsync(t, cfg)
+	requireNoPlan(t, plans)
+	// rewritten by the app, chain2 is applied
+	writePlan(t, cfg, `{"name":"chain2","height":49,"info":"{}"}`)
+	requireNoPlan(t, plans)
+	writePlan(t, cfg, `{"name":"chain3`)
+	requireNoPlan(t, plans)
+	writePlan(t, cfg, `{"name":"chain3","height":120}`)
+	requirePlan(t, plans, "chain3")
+}
+
+func TestWatchPlanFileWrites(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+
+	// read while the app is still writing it
+	plans := watchPlanAsync(t, cfg)
+	writePlan(t, cfg, `{"name":"chain2",`)
+	time.Sleep(10 * time.Millisecond)
+	writePlan(t, cfg, `{"name":"chain2","height":49}`)
+	requirePlan(t, plans, "chain2")
+
+	// written to a temporary file and renamed into place
+	plans = watchPlanAsync(t, cfg)
+	tmp := filepath.Join(cfg.DataDir(), upgradeInfoFile+".tmp")
+	require.NoError(t, ioutil.WriteFile(tmp, []byte(`{"name":"chain3",`), 0644))
+	requireNoPlan(t, plans)
+	require.NoError(t, ioutil.WriteFile(tmp, []byte(`{"name":"chain3","height":120}`), 0644))
+	require.NoError(t, os.Rename(tmp, filepath.Join(cfg.DataDir(), upgradeInfoFile)))
+	requirePlan(t, plans, "chain3")
+}
+
+func TestSettlePlan(t *testing.T) {
+	cfg := &Config{Home: t.TempDir(), Name: "dummyd"}
+	writePlan(t, cfg, `{"name":"chain2","height":49}`)
+	plan, bz, err := cfg.settlePlan([]byte(`{"name":"chain2"`))
+	require.NoError(t, err)
+	require.Equal(t, "chain2", plan.Name)
+	require.Equal(t, `{"name":"chain2","height":49}`, string(bz))
+
+	// never completed
+	writePlan(t, cfg, `{"name":"chain2"`)
+	_, bz, err = cfg.settlePlan([]byte(`{"name":"chain2"`))
+	require.Error(t, err)
+	require.Equal(t, `{"name":"chain2"`, string(bz))
+
+	// gone
+	require.NoError(t, os.Remove(filepath.Join(cfg.DataDir(), upgradeInfoFile)))
+	_, bz, err = cfg.settlePlan([]byte(`{"name":"chain2"`))
+	require.True(t, os.IsNotExist(err))
+	require.Nil(t, bz)
+}
+
+func TestWatchPlanFileCreated(t *testing.T) {
+	home := validateHome(t)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// the data directory only shows up once the daemon started
+	plans := watchPlanAsync(t, cfg)
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	time.Sleep(2 * defaultPollInterval)
+	writePlan(t, cfg, `{"name":"chain2","height":49}`)
+	requirePlan(t, plans, "chain2")
+
+	done := make(chan struct{})
+	close(done)
+	require.Nil(t, cfg.watchPlanFile(cfg.seePlanFile(), done))
+}
+
+func TestParsePollDuration(t *testing.T) {
+	cases := map[string]struct {
+		input  string
+		expect time.Duration
+		isErr  bool
+	}{
+		"milliseconds": {input: "300", expect: 300 * time.Millisecond},
+		"duration":     {input: "2s", expect: 2 * time.Second},
+		"fraction":     {input: " 1.5s ", expect: 1500 * time.Millisecond},
+		"zero":         {input: "0", expect: 0},
+		"negative":     {input: "-300", isErr: true},
+		"no unit":      {input: "1.5", isErr: true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			d, err := parsePollDuration(tc.input)
+			if tc.isErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, d)
+		})
+	}
+}
+
+func TestNextPoll(t *testing.T) {
+	cfg := &Config{}
+	require.Equal(t, defaultPollInterval, cfg.nextPoll())
+
+	cfg.PollInterval, cfg.PollJitter = time.Second, 100*time.Millisecond
+	spread := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		wait := cfg.nextPoll()
+		require.GreaterOrEqual(t, int64(wait), int64(time.Second))
+		require.LessOrEqual(t, int64(wait), int64(1100*time.Millisecond))
+		spread[wait] = true
+	}
+	require.Greater(t, len(spread), 1)
+}
@@ -0,0 +1,75 @@
+package cosmovisor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// webhookTimeout bounds a single webhook request
+const webhookTimeout = 10 * time.Second
+
+// webhook is the notifier registered for NotifyWebhook, replaced when a reload of the config
+// file changes it
+var webhook struct {
+	mutex    sync.Mutex
+	notifier *WebhookNotifier
+}
+
+// RegisterWebhook registers a WebhookNotifier for NotifyWebhook, sending at most one event
+// every NotifyInterval, if it is set. It replaces the notifier registered before.
+func RegisterWebhook(cfg *Config) {
+	webhook.mutex.Lock()
+	defer webhook.mutex.Unlock()
+	if webhook.notifier != nil {
+		UnregisterNotifier(webhook.notifier)
+		webhook.notifier = nil
+	}
+	if cfg.NotifyWebhook == "" {
+		return
+	}
+	webhook.notifier = NewWebhookNotifier(cfg.NotifyWebhook)
+	RegisterNotifier(webhook.notifier, NotifierOptions{Interval: cfg.NotifyInterval})
+}
+
+// WebhookNotifier posts every event as JSON to a URL
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookNotifier creates a notifier posting to url
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{URL: url, Client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// Destination implements Notifier
+func (w *WebhookNotifier) Destination() string {
+	return "webhook " + w.URL
+}
+
+// Notify implements Notifier, any response other than 2xx is an error
+func (w *WebhookNotifier) Notify(ev Event) error {
+	bz, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.URL, bytes.NewReader(bz))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", w.URL, resp.Status)
+	}
+	return nil
+}